@@ -0,0 +1,51 @@
+import mongoose from 'mongoose';
+
+// Entry kinds, the same as goproxy/internal/ledger
+export type LedgerKind =
+  | 'deduction'
+  | 'top_up'
+  | 'refund'
+  | 'referral_transfer'
+  | 'friend_key_usage'
+  | 'reversal'
+  | 'adjustment'
+  | 'opening_balance'
+  | 'expiry';
+
+export interface ICreditLedgerEntry {
+  _id: string;                 // Idempotency key: `${kind}:${ref}`
+  kind: LedgerKind;
+  username?: string;
+  requestId?: string;
+  charged?: number;
+  credits?: number;            // Signed change, debits are negative
+  refCredits?: number;
+  creditsNew?: number;
+  friendKey?: string;
+  reverses?: string;           // _id of the entry a reversal undoes
+  note?: string;
+  createdAt: Date;
+}
+
+// Entries are immutable and written by both the backend and goproxy, which also creates
+// the indexes, so the schema declares none
+const creditLedgerSchema = new mongoose.Schema({
+  _id: { type: String, required: true },
+  kind: { type: String, required: true },
+  username: { type: String },
+  requestId: { type: String },
+  charged: { type: Number },
+  credits: { type: Number },
+  refCredits: { type: Number },
+  creditsNew: { type: Number },
+  friendKey: { type: String },
+  reverses: { type: String },
+  note: { type: String },
+  createdAt: { type: Date, required: true },
+}, { versionKey: false, autoIndex: false });
+
+export const CreditLedger = mongoose.model<ICreditLedgerEntry>(
+  'CreditLedger',
+  creditLedgerSchema,
+  'credit_ledger'
+);
@@ -6,3 +6,4 @@ export * from './model-pricing.model.js';
 export * from './friend-key.model.js';
 export * from './migration-log.model.js';
 export * from './error-log.model.js';
+export * from './credit-ledger.model.js';
@@ -1,5 +1,6 @@
 import { UserNew, IUserNew, hashPassword, generateApiKey, generateReferralCode } from '../models/user-new.model.js';
 import { MigrationLog } from '../models/migration-log.model.js';
+import { ledgerService, LedgerSource, ADMIN_ADJUSTMENT } from '../services/ledger.service.js';
 
 export interface CreateUserNewData {
   username: string;
@@ -122,20 +123,12 @@ export class UserNewRepository {
     return newApiKey;
   }
 
-  async addCredits(username: string, credits: number): Promise<IUserNew | null> {
-    return UserNew.findByIdAndUpdate(
-      username,
-      { $inc: { credits } },
-      { new: true }
-    ).lean();
+  async addCredits(username: string, credits: number, source: LedgerSource = ADMIN_ADJUSTMENT): Promise<IUserNew | null> {
+    return ledgerService.apply(username, { credits }, source);
   }
 
-  async setCredits(username: string, credits: number): Promise<IUserNew | null> {
-    return UserNew.findByIdAndUpdate(
-      username,
-      { credits },
-      { new: true }
-    ).lean();
+  async setCredits(username: string, credits: number, source: LedgerSource = ADMIN_ADJUSTMENT): Promise<IUserNew | null> {
+    return ledgerService.setBalance(username, 'credits', credits, source);
   }
 
   async getFullUser(username: string): Promise<IUserNew | null> {
@@ -191,24 +184,18 @@ export class UserNewRepository {
     };
   }
 
-  async updateRefCredits(username: string, refCredits: number): Promise<IUserNew | null> {
-    return UserNew.findByIdAndUpdate(
-      username,
-      { refCredits },
-      { new: true }
-    ).lean();
+  async updateRefCredits(username: string, refCredits: number, source: LedgerSource = ADMIN_ADJUSTMENT): Promise<IUserNew | null> {
+    return ledgerService.setBalance(username, 'refCredits', refCredits, source);
   }
 
   async resetExpiredCredits(username: string): Promise<IUserNew | null> {
-    return UserNew.findByIdAndUpdate(
+    return ledgerService.setBalance(
       username,
-      {
-        credits: 0,
-        purchasedAt: null,
-        expiresAt: null,
-      },
-      { new: true }
-    ).lean();
+      'credits',
+      0,
+      { kind: 'expiry' },
+      { purchasedAt: null, expiresAt: null }
+    );
   }
 
   async checkAndResetExpiredCredits(username: string): Promise<{ wasExpired: boolean; user: IUserNew | null }> {
@@ -228,26 +215,15 @@ export class UserNewRepository {
     return UserNew.findOne({ referralCode }).lean();
   }
 
-  async addRefCredits(username: string, amount: number): Promise<IUserNew | null> {
-    return UserNew.findByIdAndUpdate(
-      username,
-      { $inc: { refCredits: amount } },
-      { new: true }
-    ).lean();
+  async addRefCredits(username: string, amount: number, source: LedgerSource = ADMIN_ADJUSTMENT): Promise<IUserNew | null> {
+    return ledgerService.apply(username, { refCredits: amount }, source);
   }
 
-  async setCreditPackage(username: string, credits: number, expiresAt: Date): Promise<IUserNew | null> {
-    return UserNew.findByIdAndUpdate(
-      username,
-      {
-        $set: {
-          credits,
-          expiresAt,
-          purchasedAt: new Date()
-        }
-      },
-      { new: true }
-    ).lean();
+  async setCreditPackage(username: string, credits: number, expiresAt: Date, source: LedgerSource = ADMIN_ADJUSTMENT): Promise<IUserNew | null> {
+    return ledgerService.setBalance(username, 'credits', credits, source, {
+      expiresAt,
+      purchasedAt: new Date(),
+    });
   }
 
   async markReferralBonusAwarded(username: string): Promise<void> {
@@ -342,15 +318,13 @@ export class UserNewRepository {
     const oldCredits = user.credits;
     const newCredits = oldCredits / 2.5;
 
-    // Update user with migrated status and new credits
-    const updatedUser = await UserNew.findByIdAndUpdate(
+    // Update user with migrated status and new credits; keyed by user so it is applied once
+    const updatedUser = await ledgerService.apply(
       userId,
-      {
-        migration: true,
-        credits: newCredits,
-      },
-      { new: true }
-    ).lean();
+      { credits: newCredits - oldCredits },
+      { kind: 'adjustment', ref: `migration-${userId}`, note: 'rate migration 1000 -> 2500' },
+      { migration: true }
+    );
 
     // Create migration log
     await MigrationLog.create({
@@ -1,6 +1,7 @@
 import { UserNew, IUserNew, hashPassword, generateApiKey, generateReferralCode } from '../models/user-new.model.js';
 import { UserKey } from '../models/user-key.model.js';
 import { RequestLog } from '../models/request-log.model.js';
+import { ledgerService, LedgerSource, ADMIN_ADJUSTMENT } from '../services/ledger.service.js';
 
 // Alias for backward compatibility
 const User = UserNew;
@@ -143,24 +144,17 @@ export class UserRepository {
     return newApiKey;
   }
 
-  async addCredits(username: string, credits: number, resetExpiration: boolean = true): Promise<IUser | null> {
+  async addCredits(username: string, credits: number, resetExpiration: boolean = true, source: LedgerSource = ADMIN_ADJUSTMENT): Promise<IUser | null> {
     const VALIDITY_DAYS = 7;
     const now = new Date();
     const expiresAt = new Date(now.getTime() + VALIDITY_DAYS * 24 * 60 * 60 * 1000);
 
-    const updateQuery: any = {
-      $inc: { credits }
-    };
-
-    if (resetExpiration) {
-      updateQuery.$set = { expiresAt, purchasedAt: now };
-    }
-
-    const updatedUser = await User.findByIdAndUpdate(
+    const updatedUser = await ledgerService.apply(
       username,
-      updateQuery,
-      { new: true }
-    ).lean();
+      { credits },
+      source,
+      resetExpiration ? { expiresAt, purchasedAt: now } : undefined
+    );
 
     if (resetExpiration && updatedUser?.apiKey) {
       await UserKey.updateOne(
@@ -173,22 +167,18 @@ export class UserRepository {
     return updatedUser;
   }
 
-  async setCredits(username: string, credits: number, resetExpiration: boolean = true): Promise<IUser | null> {
+  async setCredits(username: string, credits: number, resetExpiration: boolean = true, source: LedgerSource = ADMIN_ADJUSTMENT): Promise<IUser | null> {
     const VALIDITY_DAYS = 7;
     const now = new Date();
     const expiresAt = new Date(now.getTime() + VALIDITY_DAYS * 24 * 60 * 60 * 1000);
 
-    const setFields: any = { credits };
-    if (resetExpiration) {
-      setFields.expiresAt = expiresAt;
-      setFields.purchasedAt = now;
-    }
-
-    const updatedUser = await User.findByIdAndUpdate(
+    const updatedUser = await ledgerService.setBalance(
       username,
-      { $set: setFields },
-      { new: true }
-    ).lean();
+      'credits',
+      credits,
+      source,
+      resetExpiration ? { expiresAt, purchasedAt: now } : undefined
+    );
 
     if (resetExpiration && updatedUser?.apiKey) {
       await UserKey.updateOne(
@@ -201,46 +191,31 @@ export class UserRepository {
     return updatedUser;
   }
 
-  async addCreditsNew(username: string, amount: number, resetExpiration: boolean = true): Promise<IUser | null> {
+  async addCreditsNew(username: string, amount: number, resetExpiration: boolean = true, source: LedgerSource = ADMIN_ADJUSTMENT): Promise<IUser | null> {
     const VALIDITY_DAYS = 7;
     const now = new Date();
     const expiresAtNew = new Date(now.getTime() + VALIDITY_DAYS * 24 * 60 * 60 * 1000);
 
-    const updateQuery: any = {
-      $inc: { creditsNew: amount }
-    };
-
-    if (resetExpiration) {
-      updateQuery.$set = { expiresAtNew, purchasedAtNew: now };
-    }
-
-    const updatedUser = await User.findByIdAndUpdate(
+    return ledgerService.apply(
       username,
-      updateQuery,
-      { new: true }
-    ).lean();
-
-    return updatedUser;
+      { creditsNew: amount },
+      source,
+      resetExpiration ? { expiresAtNew, purchasedAtNew: now } : undefined
+    );
   }
 
-  async setCreditsNew(username: string, creditsNew: number, resetExpiration: boolean = true): Promise<IUser | null> {
+  async setCreditsNew(username: string, creditsNew: number, resetExpiration: boolean = true, source: LedgerSource = ADMIN_ADJUSTMENT): Promise<IUser | null> {
     const VALIDITY_DAYS = 7;
     const now = new Date();
     const expiresAtNew = new Date(now.getTime() + VALIDITY_DAYS * 24 * 60 * 60 * 1000);
 
-    const setFields: any = { creditsNew };
-    if (resetExpiration) {
-      setFields.expiresAtNew = expiresAtNew;
-      setFields.purchasedAtNew = now;
-    }
-
-    const updatedUser = await User.findByIdAndUpdate(
+    return ledgerService.setBalance(
       username,
-      { $set: setFields },
-      { new: true }
-    ).lean();
-
-    return updatedUser;
+      'creditsNew',
+      creditsNew,
+      source,
+      resetExpiration ? { expiresAtNew, purchasedAtNew: now } : undefined
+    );
   }
 
   async getFullUser(username: string): Promise<IUser | null> {
@@ -374,12 +349,8 @@ export class UserRepository {
     };
   }
 
-  async updateRefCredits(username: string, refCredits: number): Promise<IUser | null> {
-    return User.findByIdAndUpdate(
-      username,
-      { refCredits },
-      { new: true }
-    ).lean();
+  async updateRefCredits(username: string, refCredits: number, source: LedgerSource = ADMIN_ADJUSTMENT): Promise<IUser | null> {
+    return ledgerService.setBalance(username, 'refCredits', refCredits, source);
   }
 
   async resetExpiredCredits(username: string): Promise<IUser | null> {
@@ -388,15 +359,13 @@ export class UserRepository {
 
     await UserKey.deleteOne({ _id: user.apiKey });
 
-    return User.findByIdAndUpdate(
+    return ledgerService.setBalance(
       username,
-      {
-        credits: 0,
-        purchasedAt: null,
-        expiresAt: null,
-      },
-      { new: true }
-    ).lean();
+      'credits',
+      0,
+      { kind: 'expiry' },
+      { purchasedAt: null, expiresAt: null }
+    );
   }
 
   async checkAndResetExpiredCredits(username: string): Promise<{ wasExpired: boolean; user: IUser | null }> {
@@ -416,26 +385,15 @@ export class UserRepository {
     return User.findOne({ referralCode }).lean();
   }
 
-  async addRefCredits(username: string, amount: number): Promise<IUser | null> {
-    return User.findByIdAndUpdate(
-      username,
-      { $inc: { refCredits: amount } },
-      { new: true }
-    ).lean();
+  async addRefCredits(username: string, amount: number, source: LedgerSource = ADMIN_ADJUSTMENT): Promise<IUser | null> {
+    return ledgerService.apply(username, { refCredits: amount }, source);
   }
 
-  async setCreditPackage(username: string, credits: number, expiresAt: Date): Promise<IUser | null> {
-    return User.findByIdAndUpdate(
-      username,
-      { 
-        $set: { 
-          credits,
-          expiresAt,
-          purchasedAt: new Date()
-        } 
-      },
-      { new: true }
-    ).lean();
+  async setCreditPackage(username: string, credits: number, expiresAt: Date, source: LedgerSource = ADMIN_ADJUSTMENT): Promise<IUser | null> {
+    return ledgerService.setBalance(username, 'credits', credits, source, {
+      expiresAt,
+      purchasedAt: new Date(),
+    });
   }
 
   async markReferralBonusAwarded(username: string): Promise<void> {
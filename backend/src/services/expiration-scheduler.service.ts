@@ -1,6 +1,7 @@
 import { UserNew, IUserNew } from '../models/user-new.model.js';
 import { creditsResetLogRepository } from '../repositories/credits-reset-log.repository.js';
 import { ResetTrigger } from '../models/credits-reset-log.model.js';
+import { ledgerService } from './ledger.service.js';
 
 // In-memory map of scheduled timeouts
 const scheduledExpirations = new Map<string, NodeJS.Timeout>();
@@ -270,11 +271,13 @@ export class ExpirationSchedulerService {
       }
 
       // Reset credits
-      await UserNew.findByIdAndUpdate(username, {
-        credits: 0,
-        purchasedAt: null,
-        expiresAt: null,
-      });
+      await ledgerService.setBalance(
+        username,
+        'credits',
+        0,
+        { kind: 'expiry', note: `triggered by ${triggeredBy}` },
+        { purchasedAt: null, expiresAt: null }
+      );
 
       // Log the reset (only when credits > 0)
       await creditsResetLogRepository.create({
@@ -327,11 +330,13 @@ export class ExpirationSchedulerService {
       }
 
       // Reset creditsNew
-      await UserNew.findByIdAndUpdate(username, {
-        creditsNew: 0,
-        purchasedAtNew: null,
-        expiresAtNew: null,
-      });
+      await ledgerService.setBalance(
+        username,
+        'creditsNew',
+        0,
+        { kind: 'expiry', note: `triggered by ${triggeredBy}` },
+        { purchasedAtNew: null, expiresAtNew: null }
+      );
 
       // Log the reset (only when creditsNew > 0)
       await creditsResetLogRepository.create({
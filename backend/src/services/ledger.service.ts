@@ -0,0 +1,116 @@
+import crypto from 'crypto';
+import { CreditLedger, LedgerKind } from '../models/credit-ledger.model.js';
+import { UserNew, IUserNew } from '../models/user-new.model.js';
+
+/**
+ * Credit ledger (credit_ledger)
+ * Every change to a balance in usersNew is recorded as an entry before it is written, so
+ * goproxy's reconciler can check each balance against the sum of its entries. An entry's _id
+ * is the idempotency key of the change: a change whose key was recorded before is not applied
+ * again. A balance write that fails after its entry was recorded is undone with a reversal.
+ */
+
+export type BalanceField = 'credits' | 'refCredits' | 'creditsNew';
+
+export type BalanceChange = Partial<Record<BalanceField, number>>;
+
+// What caused a change: its kind, the ID it is keyed by (payment, referral...) and a note.
+// Changes without a ref get a random key.
+export interface LedgerSource {
+  kind: LedgerKind;
+  ref?: string;
+  note?: string;
+}
+
+export const ADMIN_ADJUSTMENT: LedgerSource = { kind: 'adjustment', note: 'admin' };
+
+export function ledgerKey(kind: LedgerKind, ref?: string): string {
+  return `${kind}:${ref || `anon-${crypto.randomBytes(8).toString('hex')}`}`;
+}
+
+// nonZero drops the fields a change leaves alone, as goproxy omits them
+function nonZero(change: BalanceChange): BalanceChange {
+  const out: BalanceChange = {};
+  for (const [field, amount] of Object.entries(change) as [BalanceField, number | undefined][]) {
+    if (amount) out[field] = amount;
+  }
+  return out;
+}
+
+export class LedgerService {
+  /**
+   * Record an entry. Returns false if its key was recorded before,
+   * i.e. the change it describes was already applied
+   */
+  async append(id: string, kind: LedgerKind, username: string, change: BalanceChange, note?: string, reverses?: string): Promise<boolean> {
+    try {
+      await CreditLedger.create({ _id: id, kind, username, ...nonZero(change), note, reverses, createdAt: new Date() });
+      return true;
+    } catch (error: any) {
+      if (error?.code === 11000) return false;
+      throw error;
+    }
+  }
+
+  /**
+   * Change a user's balances by change, recorded in the ledger first. set is written along
+   * with it (expiration dates...). Returns the updated user, the user unchanged if the change
+   * was applied before, or null if the user does not exist.
+   */
+  async apply(username: string, change: BalanceChange, source: LedgerSource, set?: Record<string, unknown>): Promise<IUserNew | null> {
+    const inc = nonZero(change);
+    const update: Record<string, unknown> = {};
+    if (Object.keys(inc).length > 0) update.$inc = inc;
+    if (set) update.$set = set;
+
+    if (!update.$inc) {
+      return UserNew.findByIdAndUpdate(username, update, { new: true }).lean();
+    }
+    if (!(await UserNew.exists({ _id: username }))) {
+      return null;
+    }
+
+    const id = ledgerKey(source.kind, source.ref);
+    if (!(await this.append(id, source.kind, username, inc, source.note))) {
+      console.log(`[Ledger] ${id} already applied to ${username}, skipping`);
+      return UserNew.findById(username).lean();
+    }
+
+    try {
+      const user = await UserNew.findByIdAndUpdate(username, update, { new: true }).lean();
+      if (!user) {
+        await this.reverse(id, username, inc, 'user deleted before the balance write');
+      }
+      return user;
+    } catch (error) {
+      await this.reverse(id, username, inc, `balance write failed: ${error}`);
+      throw error;
+    }
+  }
+
+  /**
+   * Set a user's balance field to amount. It is applied as the difference from the stored
+   * balance, so deductions written in between stay counted.
+   */
+  async setBalance(username: string, field: BalanceField, amount: number, source: LedgerSource, set?: Record<string, unknown>): Promise<IUserNew | null> {
+    const user = await UserNew.findById(username, { [field]: 1 }).lean();
+    if (!user) return null;
+    return this.apply(username, { [field]: amount - (user[field] || 0) }, source, set);
+  }
+
+  // reverse records the undoing of an entry whose balance write failed; the reconciler
+  // reports it if this fails too
+  private async reverse(id: string, username: string, change: BalanceChange, note: string): Promise<void> {
+    const undo: BalanceChange = {};
+    for (const [field, amount] of Object.entries(change) as [BalanceField, number][]) {
+      undo[field] = -amount;
+    }
+    try {
+      await this.append(ledgerKey('reversal', id), 'reversal', username, undo, note, id);
+    } catch (error) {
+      console.error(`[Ledger] Failed to reverse ${id}:`, error);
+    }
+  }
+}
+
+export const ledgerService = new LedgerService();
@@ -12,6 +12,7 @@ import {
 } from '../models/payment.model.js';
 import { UserKey } from '../models/user-key.model.js';
 import { expirationSchedulerService } from './expiration-scheduler.service.js';
+import { ledgerService } from './ledger.service.js';
 
 // ============================================================
 // PROMO CONFIGURATION - ENABLED
@@ -275,22 +276,25 @@ export class PaymentService {
     const expiresAtNew = new Date(now.getTime() + VALIDITY_DAYS * 24 * 60 * 60 * 1000);
     console.log(`[Payment] Setting expiresAtNew to ${VALIDITY_DAYS} days from now: ${expiresAtNew}`);
 
-    // Build update object for creditsNew (OpenHands system)
-    const updateData: Record<string, unknown> = {
+    // Fields set along with the creditsNew top-up (OpenHands system)
+    const setData: Record<string, unknown> = {
       purchasedAtNew: now,
       expiresAtNew,
-      $inc: { creditsNew: credits },
     };
 
     // Only update discordId if provided (don't overwrite existing with empty value)
     if (discordId) {
-      updateData.discordId = discordId;
+      setData.discordId = discordId;
       console.log(`[Payment] Saving discordId: ${discordId}`);
     }
 
-    // Update user with new creditsNew - use UserNew model (usersNew collection)
-    const { UserNew } = await import('../models/user-new.model.js');
-    await UserNew.findByIdAndUpdate(userId, updateData);
+    // Top up creditsNew with its ledger entry, keyed by payment so a payment is credited once
+    await ledgerService.apply(
+      userId,
+      { creditsNew: credits },
+      { kind: 'top_up', ref: paymentId },
+      setData
+    );
 
     // Update payment record with creditsBefore and creditsAfter
     if (paymentId) {
@@ -361,11 +365,15 @@ export class PaymentService {
     const bonusCredits = calculateRefBonus(credits);
 
     // Award refCredits to the referred user (new user)
-    await userRepository.addRefCredits(userId, bonusCredits);
+    await userRepository.addRefCredits(userId, bonusCredits, { kind: 'referral_transfer', ref: userId });
     await userRepository.markReferralBonusAwarded(userId);
 
     // Award refCredits to the referrer
-    await userRepository.addRefCredits(user.referredBy, bonusCredits);
+    await userRepository.addRefCredits(user.referredBy, bonusCredits, {
+      kind: 'referral_transfer',
+      ref: `${userId}-referrer`,
+      note: `referred ${userId}`,
+    });
 
     console.log(`[Referral] ✅ Awarded $${bonusCredits} refCredits to ${userId} and ${user.referredBy} for $${credits} purchase`);
   }
@@ -3,12 +3,15 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"math/rand"
 	"os"
 	"strings"
 	"sync"
 	"time"
+
+	"goproxy/internal/provider"
 )
 
 // Endpoint configuration
@@ -32,23 +35,126 @@ type Model struct {
 	BatchInputPricePerMTok  float64     `json:"batch_input_price_per_mtok,omitempty"`  // Optional: Batch mode input price (defaults to 50% of regular)
 	BatchOutputPricePerMTok float64     `json:"batch_output_price_per_mtok,omitempty"` // Optional: Batch mode output price (defaults to 50% of regular)
 	BillingMultiplier       float64     `json:"billing_multiplier,omitempty"`          // Multiplier applied to final billing cost (default 1.0)
-	Upstream                string      `json:"upstream"`                              // "troll" or "main" - determines which upstream provider to use (request routing)
+	Upstream                string      `json:"upstream"`                              // Name of an instance in "upstreams" - determines which upstream provider to use (request routing)
 	UpstreamModelID         interface{} `json:"upstream_model_id,omitempty"`           // Model ID to use when sending to upstream (can be string or []string for random selection)
 	UpstreamModelWeights    []int       `json:"upstream_model_weights,omitempty"`      // Optional weights for random selection (must match length of UpstreamModelID array)
 	BillingUpstream         string      `json:"billing_upstream,omitempty"`            // "openhands" or "ohmygpt" - determines which credit field to deduct from (independent of Upstream)
+	Tokenizer               string      `json:"tokenizer,omitempty"`                   // Tokenizer vocabulary for token estimates (internal/tokenizer/vocab, e.g. "bpe24k"); inferred from model ID if empty
+	Fallbacks               []Fallback  `json:"fallbacks,omitempty"`                   // Tried in order when the upstream fails (connection error, 5xx, 529, no available keys)
+	APIFormat               string      `json:"api_format,omitempty"`                  // Format the upstream serves this model in ("anthropic" = /v1/messages, "openai" = /v1/chat/completions); inferred from model ID if empty
+	Experiment              *Experiment `json:"experiment,omitempty"`                  // A/B assignment for an upstream_model_id pool; conversations stick to one arm by default
 	// NOTE: BillingUpstream controls credit field selection, NOT upstream provider
 	// "openhands" = deduct from creditsNew field (chat.trollllm.xyz)
 	// "ohmygpt" = deduct from credits field (chat2.trollllm.xyz)
 	// Both can use same Upstream provider but different credit fields
 }
 
+// Fallback is the next tier of a model's upstream chain. Unset prices are taken from the model;
+// set prices replace them for requests this tier serves.
+type Fallback struct {
+	Upstream               string   `json:"upstream"`
+	UpstreamModelID        string   `json:"upstream_model_id,omitempty"` // Defaults to the model ID
+	InputPricePerMTok      *float64 `json:"input_price_per_mtok,omitempty"`
+	OutputPricePerMTok     *float64 `json:"output_price_per_mtok,omitempty"`
+	CacheWritePricePerMTok *float64 `json:"cache_write_price_per_mtok,omitempty"`
+	CacheHitPricePerMTok   *float64 `json:"cache_hit_price_per_mtok,omitempty"`
+}
+
+// Experiment names an upstream_model_id pool and sets how long a client stays on the arm it
+// was assigned. Every pool is an experiment; without this block it is named after the model.
+type Experiment struct {
+	Name  string `json:"name,omitempty"`  // Recorded on request logs; defaults to the model ID
+	Scope string `json:"scope,omitempty"` // ExperimentScope*; defaults to conversation
+}
+
+// Experiment stickiness scopes
+const (
+	ExperimentScopeConversation = "conversation" // same arm for every turn of a conversation (falls back to user)
+	ExperimentScopeUser         = "user"         // same arm for all of a user's requests
+	ExperimentScopeRequest      = "request"      // drawn again on every request
+)
+
 // Config global configuration
 type Config struct {
-	Port         int        `json:"port"`
-	Endpoints    []Endpoint `json:"endpoints"`
-	Models       []Model    `json:"models"`
-	SystemPrompt string     `json:"system_prompt"`
-	UserAgent    string     `json:"user_agent"`
+	Port         int             `json:"port"`
+	Endpoints    []Endpoint      `json:"endpoints"`
+	Upstreams    []provider.Spec `json:"upstreams,omitempty"` // Named upstream instances; DefaultUpstreams if empty
+	Models       []Model         `json:"models"`
+	SystemPrompt string          `json:"system_prompt"`
+	UserAgent    string          `json:"user_agent"`
+}
+
+// DefaultUpstreams are the upstream instances used when config.json has no "upstreams" section
+var DefaultUpstreams = []provider.Spec{
+	{Name: "main", Type: "main", APIKeyEnv: "MAIN_UPSTREAM_KEY"},
+	{Name: "openhands", Type: "openhands", KeyCollection: "openhands_keys", UseProxy: true, HeaderProfile: provider.HeaderProfileSDK},
+	{Name: "troll", AliasOf: "openhands"},
+	{Name: "ohmygpt", Type: "ohmygpt", KeyCollection: "ohmygpt_keys", UseProxy: true, HeaderProfile: provider.HeaderProfileOpenHandsCLI, Disabled: true},
+	{Name: "modal", Type: "openai_compat", BaseURL: "https://api.us-west-2.modal.direct", APIKeyEnv: "MODAL_API_KEY"},
+}
+
+// UpstreamSpecs returns the declared upstream instances
+func (c *Config) UpstreamSpecs() []provider.Spec {
+	if len(c.Upstreams) > 0 {
+		return c.Upstreams
+	}
+	return DefaultUpstreams
+}
+
+// upstreamSpec returns the declared instance with the given name (aliases resolved), or nil
+func (c *Config) upstreamSpec(name string) *provider.Spec {
+	specs := c.UpstreamSpecs()
+	for hops := 0; hops <= len(specs); hops++ {
+		var found *provider.Spec
+		for i := range specs {
+			if specs[i].Name == name {
+				found = &specs[i]
+				break
+			}
+		}
+		if found == nil || found.AliasOf == "" {
+			return found
+		}
+		name = found.AliasOf
+	}
+	return nil // alias cycle
+}
+
+// validateUpstreams checks the "upstreams" section and every upstream a model routes to
+func (c *Config) validateUpstreams() error {
+	seen := make(map[string]bool)
+	for i, spec := range c.Upstreams {
+		if spec.Name == "" {
+			return fmt.Errorf("upstreams[%d]: name is required", i)
+		}
+		if seen[spec.Name] {
+			return fmt.Errorf("upstreams[%d]: duplicate name %q", i, spec.Name)
+		}
+		seen[spec.Name] = true
+		if spec.AliasOf == "" && !provider.IsRegisteredType(spec.Type) {
+			return fmt.Errorf("upstream %s: unknown provider type %q", spec.Name, spec.Type)
+		}
+		if !provider.IsValidHeaderProfile(spec.HeaderProfile) {
+			return fmt.Errorf("upstream %s: unknown header_profile %q", spec.Name, spec.HeaderProfile)
+		}
+	}
+
+	for _, model := range c.Models {
+		if model.Upstream != "" && !c.isValidUpstream(model.Upstream) {
+			return fmt.Errorf("model %s: invalid upstream %q", model.ID, model.Upstream)
+		}
+		for i, fb := range model.Fallbacks {
+			if !c.isValidUpstream(fb.Upstream) {
+				return fmt.Errorf("model %s: fallbacks[%d]: invalid upstream %q", model.ID, i, fb.Upstream)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) isValidUpstream(name string) bool {
+	spec := c.upstreamSpec(name)
+	return spec != nil && provider.IsRegisteredType(spec.Type)
 }
 
 var (
@@ -76,6 +182,10 @@ func LoadConfig(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	if err := cfg.validateUpstreams(); err != nil {
+		return nil, err
+	}
+
 	// Set default values
 	if cfg.Port == 0 {
 		cfg.Port = 8000
@@ -244,20 +354,48 @@ func GetModelThinkingBudget(modelID string) int {
 	}
 
 	// Default budgets based on reasoning level
-	switch model.Reasoning {
+	if budget := ThinkingBudgetForEffort(model.Reasoning); budget > 0 {
+		return budget
+	}
+	return 10000
+}
+
+// ThinkingBudgetForEffort maps a reasoning effort level (OpenAI reasoning_effort)
+// to an Anthropic thinking budget. Returns 0 for "none" or unknown levels.
+func ThinkingBudgetForEffort(effort string) int {
+	switch effort {
 	case "high":
 		return 10000
 	case "medium":
 		return 5000
 	case "low":
 		return 2000
+	case "minimal":
+		return 1024 // Anthropic minimum budget_tokens
 	default:
-		return 10000
+		return 0
+	}
+}
+
+// EffortForThinkingBudget maps an Anthropic thinking budget back to a reasoning effort level
+// (the inverse of ThinkingBudgetForEffort). Returns "" when thinking is off.
+func EffortForThinkingBudget(budget int) string {
+	switch {
+	case budget >= 10000:
+		return "high"
+	case budget >= 5000:
+		return "medium"
+	case budget >= 2000:
+		return "low"
+	case budget > 0:
+		return "minimal"
+	default:
+		return ""
 	}
 }
 
-// GetModelUpstream gets upstream provider for a model
-// Returns "main", "troll", or "openhands" (default is "troll" if not specified)
+// GetModelUpstream gets the upstream instance name for a model
+// (default is "troll" if not specified)
 func GetModelUpstream(modelID string) string {
 	model := GetModelByID(modelID)
 	if model == nil {
@@ -269,14 +407,76 @@ func GetModelUpstream(modelID string) string {
 	return "troll" // default to troll-key
 }
 
-// IsValidUpstream checks if upstream value is valid
+// IsValidUpstream checks if upstream names a declared instance of a registered provider type
 func IsValidUpstream(upstream string) bool {
-	switch upstream {
-	case "troll", "main", "openhands":
-		return true
-	default:
-		return false
+	return currentConfig().isValidUpstream(upstream)
+}
+
+// GetUpstreams returns the declared upstream instances
+func GetUpstreams() []provider.Spec {
+	return currentConfig().UpstreamSpecs()
+}
+
+// GetUpstreamType returns the provider type of an upstream instance ("" if not declared)
+func GetUpstreamType(upstream string) string {
+	spec := currentConfig().upstreamSpec(upstream)
+	if spec == nil {
+		return ""
+	}
+	return spec.Type
+}
+
+// currentConfig returns the loaded config, or an empty one (default upstreams) before loading
+func currentConfig() *Config {
+	if cfg := GetConfig(); cfg != nil {
+		return cfg
+	}
+	return &Config{}
+}
+
+// GetModelFallbacks returns the fallback chain of a model (nil if none)
+func GetModelFallbacks(modelID string) []Fallback {
+	model := GetModelByID(modelID)
+	if model == nil {
+		return nil
 	}
+	return model.Fallbacks
+}
+
+// FallbackModel returns the model as served by its hop-th fallback (1-based): the fallback's
+// upstream, upstream model ID and price overrides replace the model's own, so pricing
+// follows the tier that actually served the request. Returns nil if there is no such hop.
+func FallbackModel(modelID string, hop int) *Model {
+	model := GetModelByID(modelID)
+	if model == nil || hop < 1 || hop > len(model.Fallbacks) {
+		return nil
+	}
+	fb := model.Fallbacks[hop-1]
+
+	tier := *model
+	tier.Upstream = fb.Upstream
+	tier.UpstreamModelID = model.ID
+	if fb.UpstreamModelID != "" {
+		tier.UpstreamModelID = fb.UpstreamModelID
+	}
+	tier.UpstreamModelWeights = nil
+	tier.Fallbacks = nil
+	// Overridden prices drop the model's batch prices so batch falls back to 50% of the new price
+	if fb.InputPricePerMTok != nil {
+		tier.InputPricePerMTok = *fb.InputPricePerMTok
+		tier.BatchInputPricePerMTok = 0
+	}
+	if fb.OutputPricePerMTok != nil {
+		tier.OutputPricePerMTok = *fb.OutputPricePerMTok
+		tier.BatchOutputPricePerMTok = 0
+	}
+	if fb.CacheWritePricePerMTok != nil {
+		tier.CacheWritePricePerMTok = *fb.CacheWritePricePerMTok
+	}
+	if fb.CacheHitPricePerMTok != nil {
+		tier.CacheHitPricePerMTok = *fb.CacheHitPricePerMTok
+	}
+	return &tier
 }
 
 // IsValidBillingUpstream checks if billing_upstream value is valid
@@ -297,6 +497,42 @@ func GetModelBillingUpstream(modelID string) string {
 	return "ohmygpt" // default to ohmygpt for backward compatibility
 }
 
+// GetModelTokenizer returns the tokenizer vocabulary for a model
+// Uses the configured tokenizer, otherwise picks one by the model ID's family ("" = tokenizer default)
+func GetModelTokenizer(modelID string) string {
+	model := GetModelByID(modelID)
+	if model != nil && model.Tokenizer != "" {
+		return model.Tokenizer
+	}
+
+	id := strings.ToLower(modelID)
+	if model != nil {
+		id = strings.ToLower(model.ID)
+	}
+	switch {
+	case strings.HasPrefix(id, "claude"):
+		return "bpe24k"
+	case strings.HasPrefix(id, "gpt"), strings.HasPrefix(id, "o1"), strings.HasPrefix(id, "o3"), strings.HasPrefix(id, "o4"):
+		return "bpe32k"
+	default:
+		return ""
+	}
+}
+
+// GetModelAPIFormat returns the format the upstream serves a model in: "anthropic" (/v1/messages)
+// or "openai" (/v1/chat/completions). Uses the configured api_format, otherwise Claude models are "anthropic"
+func GetModelAPIFormat(modelID string) string {
+	model := GetModelByID(modelID)
+	if model != nil && model.APIFormat != "" {
+		return model.APIFormat
+	}
+
+	if strings.HasPrefix(strings.ToLower(modelID), "claude") {
+		return "anthropic"
+	}
+	return "openai"
+}
+
 // GetUpstreamModelID gets the model ID to use when sending to upstream
 // Returns UpstreamModelID if configured, otherwise returns the original model ID
 // Supports both single string and array of strings for random/weighted selection
@@ -319,36 +555,101 @@ func GetUpstreamModelID(modelID string) string {
 	}
 
 	// Handle array of strings for random selection
-	if arrID, ok := model.UpstreamModelID.([]interface{}); ok {
-		if len(arrID) == 0 {
-			return modelID
-		}
+	modelIDs := upstreamModelPool(model)
+	if len(modelIDs) == 0 {
+		return modelID
+	}
 
-		// Convert to string array
-		modelIDs := make([]string, 0, len(arrID))
-		for _, id := range arrID {
-			if strID, ok := id.(string); ok && strID != "" {
-				modelIDs = append(modelIDs, strID)
-			}
-		}
+	// If only one model, return it
+	if len(modelIDs) == 1 {
+		return modelIDs[0]
+	}
+
+	// Random selection with optional weights
+	selectedID := selectUpstreamWithWeights(modelIDs, model.UpstreamModelWeights)
+	log.Printf("🎲 [RANDOM SELECT] model=%s selected_upstream=%s from_pool=%v weights=%v",
+		modelID, selectedID, modelIDs, model.UpstreamModelWeights)
+	return selectedID
+}
 
-		if len(modelIDs) == 0 {
-			return modelID
+// upstreamModelPool returns the non-empty entries of an upstream_model_id array
+func upstreamModelPool(model *Model) []string {
+	arrID, ok := model.UpstreamModelID.([]interface{})
+	if !ok {
+		return nil
+	}
+	modelIDs := make([]string, 0, len(arrID))
+	for _, id := range arrID {
+		if strID, ok := id.(string); ok && strID != "" {
+			modelIDs = append(modelIDs, strID)
 		}
+	}
+	return modelIDs
+}
 
-		// If only one model, return it
-		if len(modelIDs) == 1 {
-			return modelIDs[0]
+// GetModelExperiment returns the experiment name and stickiness scope of a model whose
+// upstream_model_id is a pool of two or more models. ok is false for every other model.
+func GetModelExperiment(modelID string) (name string, scope string, ok bool) {
+	model := GetModelByID(modelID)
+	if model == nil || len(upstreamModelPool(model)) < 2 {
+		return "", "", false
+	}
+
+	name, scope = model.ID, ExperimentScopeConversation
+	if model.Experiment != nil {
+		if model.Experiment.Name != "" {
+			name = model.Experiment.Name
+		}
+		switch model.Experiment.Scope {
+		case ExperimentScopeUser, ExperimentScopeRequest:
+			scope = model.Experiment.Scope
 		}
+	}
+	return name, scope, true
+}
+
+// AssignUpstreamModelID picks the pool entry for subject (a user or conversation hash).
+// The same subject always gets the same upstream model while the pool and its weights are
+// unchanged; arms are filled in proportion to upstream_model_weights. An empty subject
+// draws at random like GetUpstreamModelID.
+func AssignUpstreamModelID(modelID, subject string) string {
+	name, _, ok := GetModelExperiment(modelID)
+	if !ok || subject == "" {
+		return GetUpstreamModelID(modelID)
+	}
+	model := GetModelByID(modelID)
+	modelIDs := upstreamModelPool(model)
 
-		// Random selection with optional weights
-		selectedID := selectUpstreamWithWeights(modelIDs, model.UpstreamModelWeights)
-		log.Printf("🎲 [RANDOM SELECT] model=%s selected_upstream=%s from_pool=%v weights=%v",
-			modelID, selectedID, modelIDs, model.UpstreamModelWeights)
-		return selectedID
+	weights := model.UpstreamModelWeights
+	if len(weights) != len(modelIDs) || !hasValidWeights(weights) {
+		weights = nil
 	}
+	total := len(modelIDs)
+	if weights != nil {
+		total = 0
+		for _, w := range weights {
+			total += w
+		}
+	}
+
+	// Hashing the experiment name with the subject keeps experiments independent of each other
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(subject))
+	bucket := int(h.Sum64() % uint64(total))
 
-	return modelID // fallback
+	if weights == nil {
+		return modelIDs[bucket]
+	}
+	cumulative := 0
+	for i, w := range weights {
+		cumulative += w
+		if bucket < cumulative {
+			return modelIDs[i]
+		}
+	}
+	return modelIDs[len(modelIDs)-1]
 }
 
 // selectUpstreamWithWeights selects a model ID from the pool using weighted random selection
@@ -428,7 +729,10 @@ const (
 
 // GetModelPricing gets input/output pricing for a model
 func GetModelPricing(modelID string) (inputPrice, outputPrice float64) {
-	model := GetModelByID(modelID)
+	return modelPricing(GetModelByID(modelID))
+}
+
+func modelPricing(model *Model) (inputPrice, outputPrice float64) {
 	if model == nil {
 		return DefaultInputPricePerMTok, DefaultOutputPricePerMTok
 	}
@@ -446,7 +750,10 @@ func GetModelPricing(modelID string) (inputPrice, outputPrice float64) {
 // GetModelCachePricing gets cache write/hit pricing for a model
 // Returns 0 if explicitly set to 0 in config (e.g., models without cache support)
 func GetModelCachePricing(modelID string) (cacheWritePrice, cacheHitPrice float64) {
-	model := GetModelByID(modelID)
+	return modelCachePricing(GetModelByID(modelID))
+}
+
+func modelCachePricing(model *Model) (cacheWritePrice, cacheHitPrice float64) {
 	if model == nil {
 		return DefaultCacheWritePricePerMTok, DefaultCacheHitPricePerMTok
 	}
@@ -457,7 +764,10 @@ func GetModelCachePricing(modelID string) (cacheWritePrice, cacheHitPrice float6
 // GetBillingMultiplier gets the billing multiplier for a model
 // Returns 1.0 if not configured or model not found
 func GetBillingMultiplier(modelID string) float64 {
-	model := GetModelByID(modelID)
+	return modelBillingMultiplier(GetModelByID(modelID))
+}
+
+func modelBillingMultiplier(model *Model) float64 {
 	if model == nil || model.BillingMultiplier <= 0 {
 		return 1.0 // Default multiplier
 	}
@@ -467,7 +777,10 @@ func GetBillingMultiplier(modelID string) float64 {
 // GetBatchPricing gets batch input/output pricing for a model
 // Returns 50% of regular pricing if batch pricing is not explicitly configured
 func GetBatchPricing(modelID string) (inputPrice, outputPrice float64) {
-	model := GetModelByID(modelID)
+	return modelBatchPricing(GetModelByID(modelID))
+}
+
+func modelBatchPricing(model *Model) (inputPrice, outputPrice float64) {
 	if model == nil {
 		// Fallback to 50% of default pricing
 		return DefaultInputPricePerMTok * 0.5, DefaultOutputPricePerMTok * 0.5
@@ -479,7 +792,7 @@ func GetBatchPricing(modelID string) (inputPrice, outputPrice float64) {
 	}
 
 	// Default to 50% of regular pricing
-	regularIn, regularOut := GetModelPricing(modelID)
+	regularIn, regularOut := modelPricing(model)
 	return regularIn * 0.5, regularOut * 0.5
 }
 
@@ -504,16 +817,24 @@ func CalculateBillingCostWithCache(modelID string, inputTokens, outputTokens, ca
 // CalculateBillingCostWithCacheAndBatch calculates the cost in USD including cache tokens with optional batch mode
 // isBatch: if true, applies batch pricing (50% discount by default)
 func CalculateBillingCostWithCacheAndBatch(modelID string, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64, isBatch bool) float64 {
+	return calculateBillingCost(modelID, GetModelByID(modelID), inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens, isBatch)
+}
+
+// CalculateTierBillingCost is CalculateBillingCostWithCacheAndBatch for a resolved model config,
+// e.g. the fallback tier (FallbackModel) that served the request
+func CalculateTierBillingCost(model *Model, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64, isBatch bool) float64 {
+	return calculateBillingCost(model.ID, model, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens, isBatch)
+}
+
+func calculateBillingCost(modelID string, model *Model, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64, isBatch bool) float64 {
 	var inputPrice, outputPrice float64
 	var batchInputPrice, batchOutputPrice float64
 
-	model := GetModelByID(modelID)
-
 	// Get pricing info for logging
 	if isBatch {
-		inputPrice, outputPrice = GetBatchPricing(modelID)
+		inputPrice, outputPrice = modelBatchPricing(model)
 	} else {
-		inputPrice, outputPrice = GetModelPricing(modelID)
+		inputPrice, outputPrice = modelPricing(model)
 	}
 
 	// Get batch pricing for comparison/logging
@@ -522,8 +843,8 @@ func CalculateBillingCostWithCacheAndBatch(modelID string, inputTokens, outputTo
 		batchOutputPrice = model.BatchOutputPricePerMTok
 	}
 
-	cacheWritePrice, cacheHitPrice := GetModelCachePricing(modelID)
-	multiplier := GetBillingMultiplier(modelID)
+	cacheWritePrice, cacheHitPrice := modelCachePricing(model)
+	multiplier := modelBillingMultiplier(model)
 
 	// Log pricing details for debugging
 	regularInPrice, regularOutPrice := inputPrice, outputPrice
@@ -548,7 +869,7 @@ func CalculateBillingCostWithCacheAndBatch(modelID string, inputTokens, outputTo
 	// For OpenHands: input_tokens is already uncached, don't subtract
 	// For others: input_tokens includes cache, need to subtract
 	var actualInputTokens int64
-	if model != nil && model.Upstream == "openhands" {
+	if model != nil && GetUpstreamType(model.Upstream) == "openhands" {
 		actualInputTokens = inputTokens // OpenHands already returns net input
 	} else {
 		actualInputTokens = inputTokens - cacheHitTokens - cacheWriteTokens
@@ -579,15 +900,19 @@ func CalculateBillingTokens(modelID string, inputTokens, outputTokens int64) int
 // Uses original cache hit tokens from upstream (no discount applied)
 // Finally applies billing_multiplier from config (default 1.0)
 func CalculateBillingTokensWithCache(modelID string, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64) int64 {
-	inputPrice, _ := GetModelPricing(modelID)
-	cacheWritePrice, cacheHitPrice := GetModelCachePricing(modelID)
-	multiplier := GetBillingMultiplier(modelID)
+	return CalculateTierBillingTokens(GetModelByID(modelID), inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
+}
+
+// CalculateTierBillingTokens is CalculateBillingTokensWithCache for a resolved model config
+func CalculateTierBillingTokens(model *Model, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64) int64 {
+	inputPrice, _ := modelPricing(model)
+	cacheWritePrice, cacheHitPrice := modelCachePricing(model)
+	multiplier := modelBillingMultiplier(model)
 
 	// For OpenHands: input_tokens is already uncached, don't subtract
 	// For others: input_tokens includes cache, need to subtract
-	model := GetModelByID(modelID)
 	var actualInputTokens int64
-	if model != nil && model.Upstream == "openhands" {
+	if model != nil && GetUpstreamType(model.Upstream) == "openhands" {
 		actualInputTokens = inputTokens // OpenHands already returns net input
 	} else {
 		actualInputTokens = inputTokens - cacheHitTokens - cacheWriteTokens
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAssignUpstreamModelID(t *testing.T) {
+	configMutex.Lock()
+	oldCfg := globalConfig
+	globalConfig = &Config{
+		Models: []Model{
+			{
+				ID:                   "glm-4.6",
+				UpstreamModelID:      []interface{}{"glm-4.6", "glm-4.6-fast"},
+				UpstreamModelWeights: []int{3, 1},
+			},
+			{
+				ID:              "glm-4.5",
+				UpstreamModelID: []interface{}{"glm-4.5", "glm-4.5-air"},
+				Experiment:      &Experiment{Name: "glm-air-trial", Scope: ExperimentScopeUser},
+			},
+			{ID: "gpt-5", UpstreamModelID: "gpt-5-2025-08-07"},
+		},
+	}
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		globalConfig = oldCfg
+		configMutex.Unlock()
+	}()
+
+	if name, scope, ok := GetModelExperiment("glm-4.6"); !ok || name != "glm-4.6" || scope != ExperimentScopeConversation {
+		t.Errorf("GetModelExperiment(glm-4.6) = %q, %q, %v; want model name and conversation scope", name, scope, ok)
+	}
+	if name, scope, ok := GetModelExperiment("glm-4.5"); !ok || name != "glm-air-trial" || scope != ExperimentScopeUser {
+		t.Errorf("GetModelExperiment(glm-4.5) = %q, %q, %v; want configured experiment", name, scope, ok)
+	}
+	if _, _, ok := GetModelExperiment("gpt-5"); ok {
+		t.Error("Expected no experiment for a single upstream model")
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		subject := fmt.Sprintf("conversation-%d", i)
+		arm := AssignUpstreamModelID("glm-4.6", subject)
+		for j := 0; j < 3; j++ {
+			if again := AssignUpstreamModelID("glm-4.6", subject); again != arm {
+				t.Fatalf("Subject %s moved from %s to %s", subject, arm, again)
+			}
+		}
+		counts[arm]++
+	}
+	// 3:1 weights: expect ~3000/1000
+	if counts["glm-4.6"] < 2700 || counts["glm-4.6-fast"] < 800 || len(counts) != 2 {
+		t.Errorf("Assignments do not follow the weights: %v", counts)
+	}
+
+	if got := AssignUpstreamModelID("gpt-5", "conversation-1"); got != "gpt-5-2025-08-07" {
+		t.Errorf("Expected the single upstream model, got %s", got)
+	}
+}
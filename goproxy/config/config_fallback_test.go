@@ -0,0 +1,58 @@
+package config
+
+import "testing"
+
+func TestFallbackModel(t *testing.T) {
+	cheaper := 1.5
+	configMutex.Lock()
+	oldCfg := globalConfig
+	globalConfig = &Config{
+		Models: []Model{
+			{
+				ID:                 "claude-sonnet-4-5-20250929",
+				Upstream:           "openhands",
+				UpstreamModelID:    "claude-sonnet-4-5",
+				InputPricePerMTok:  3,
+				OutputPricePerMTok: 15,
+				Fallbacks: []Fallback{
+					{Upstream: "main"},
+					{Upstream: "ohmygpt", UpstreamModelID: "claude-sonnet-4.5", InputPricePerMTok: &cheaper},
+				},
+			},
+		},
+	}
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		globalConfig = oldCfg
+		configMutex.Unlock()
+	}()
+
+	modelID := "claude-sonnet-4-5-20250929"
+
+	first := FallbackModel(modelID, 1)
+	if first == nil || first.Upstream != "main" || first.UpstreamModelID != modelID {
+		t.Fatalf("hop 1 = %+v, want upstream main serving %s", first, modelID)
+	}
+	if in, out := modelPricing(first); in != 3 || out != 15 {
+		t.Fatalf("hop 1 pricing = %v/%v, want model pricing 3/15", in, out)
+	}
+
+	second := FallbackModel(modelID, 2)
+	if second == nil || second.Upstream != "ohmygpt" || second.UpstreamModelID != "claude-sonnet-4.5" {
+		t.Fatalf("hop 2 = %+v, want upstream ohmygpt serving claude-sonnet-4.5", second)
+	}
+	if in, out := modelPricing(second); in != 1.5 || out != 15 {
+		t.Fatalf("hop 2 pricing = %v/%v, want overridden input 1.5/15", in, out)
+	}
+	if in, _ := modelBatchPricing(second); in != 0.75 {
+		t.Fatalf("hop 2 batch input = %v, want 50%% of overridden price", in)
+	}
+
+	if FallbackModel(modelID, 0) != nil || FallbackModel(modelID, 3) != nil {
+		t.Fatal("out-of-range hops should return nil")
+	}
+	if got := len(GetModelFallbacks(modelID)); got != 2 {
+		t.Fatalf("GetModelFallbacks = %d entries, want 2", got)
+	}
+}
@@ -0,0 +1,43 @@
+package config
+
+import "testing"
+
+func TestGetModelTokenizer(t *testing.T) {
+	configMutex.Lock()
+	oldCfg := globalConfig
+	globalConfig = &Config{
+		Models: []Model{
+			{ID: "claude-sonnet-4-5-20250929", IDAliases: []string{"claude-sonnet-4-5"}},
+			{ID: "gpt-5.1"},
+			{ID: "gemini-3-pro-preview"},
+			{ID: "claude-opus-4-5-20251101", Tokenizer: "bpe32k"},
+		},
+	}
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		globalConfig = oldCfg
+		configMutex.Unlock()
+	}()
+
+	tests := []struct {
+		name    string
+		modelID string
+		want    string
+	}{
+		{"claude inferred from id", "claude-sonnet-4-5-20250929", "bpe24k"},
+		{"alias resolves to model", "claude-sonnet-4-5", "bpe24k"},
+		{"gpt inferred from id", "gpt-5.1", "bpe32k"},
+		{"unknown family uses default", "gemini-3-pro-preview", ""},
+		{"explicit tokenizer wins", "claude-opus-4-5-20251101", "bpe32k"},
+		{"unconfigured model inferred from id", "gpt-4o-mini", "bpe32k"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetModelTokenizer(tt.modelID); got != tt.want {
+				t.Fatalf("GetModelTokenizer(%q) = %q, want %q", tt.modelID, got, tt.want)
+			}
+		})
+	}
+}
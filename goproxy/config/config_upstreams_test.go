@@ -0,0 +1,45 @@
+package config
+
+import (
+	"testing"
+
+	"goproxy/internal/provider"
+)
+
+func TestValidateUpstreams(t *testing.T) {
+	provider.RegisterType("test-type", func(spec provider.Spec) (provider.Provider, error) {
+		return nil, nil
+	})
+
+	cfg := &Config{
+		Upstreams: []provider.Spec{
+			{Name: "primary", Type: "test-type"},
+			{Name: "secondary", AliasOf: "primary"},
+		},
+		Models: []Model{
+			{ID: "m", Upstream: "secondary", Fallbacks: []Fallback{{Upstream: "primary"}}},
+		},
+	}
+	if err := cfg.validateUpstreams(); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+	if cfg.upstreamSpec("secondary").Name != "primary" {
+		t.Fatal("alias should resolve to its target spec")
+	}
+
+	cfg.Models[0].Fallbacks = []Fallback{{Upstream: "unknown"}}
+	if err := cfg.validateUpstreams(); err == nil {
+		t.Fatal("fallback to an undeclared upstream should fail")
+	}
+
+	cfg.Models = nil
+	cfg.Upstreams = append(cfg.Upstreams, provider.Spec{Name: "bad", Type: "test-type", HeaderProfile: "browser"})
+	if err := cfg.validateUpstreams(); err == nil {
+		t.Fatal("unknown header_profile should fail")
+	}
+
+	cfg.Upstreams = []provider.Spec{{Name: "loop", AliasOf: "loop"}}
+	if cfg.isValidUpstream("loop") {
+		t.Fatal("alias cycle should not be a valid upstream")
+	}
+}
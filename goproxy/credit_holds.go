@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"goproxy/config"
+	"goproxy/internal/reservation"
+	"goproxy/internal/spendcap"
+)
+
+// Credit holds
+// Before a request is forwarded, its worst-case cost (estimated prompt plus max output tokens,
+// at the priciest tier of the model's chain) is held on the user's balance. The request log
+// settles the hold with the actual cost; handlers release it when the request ends without one.
+// The credit hold counts against the user's spend caps as well; user keys hold the cost on
+// their own caps (internal/spendcap).
+
+// holdOutputTokens is the output assumed for requests without max_tokens
+var holdOutputTokens int64 = 4096
+
+type creditHoldKey struct{}
+
+// holdFor returns the credit hold of r (the upstream request of a response works too), or nil
+func holdFor(r *http.Request) *reservation.Hold {
+	if r == nil {
+		return nil
+	}
+	hold, _ := r.Context().Value(creditHoldKey{}).(*reservation.Hold)
+	return hold
+}
+
+// requestHolds are the holds of one request: on the balance and on the spend caps
+type requestHolds struct {
+	credit *reservation.Hold
+	spend  *spendcap.Hold
+}
+
+// Release ends both holds, unless the request log settled them already
+func (h requestHolds) Release() {
+	h.credit.Release()
+	h.spend.Release()
+}
+
+// reserveCredits holds the worst-case cost of a request on username's balance and on the
+// spend caps of the user and of apiKey. The returned request carries the credit hold for the
+// request log; the caller must defer holds.Release(). Errors wrap spendcap.ErrExceeded or
+// reservation.ErrInsufficient; a failed hold write lets the request through without a
+// hold, like a failed credit pre-check does.
+func reserveCredits(r *http.Request, modelID, username, apiKey string, estimateInput func() int64, maxOutputTokens int64, isBatch bool) (*http.Request, requestHolds, error) {
+	var holds requestHolds
+	if username == "" || (!reservation.Enabled && !spendcap.Enabled) {
+		return r, holds, nil
+	}
+	if maxOutputTokens <= 0 {
+		maxOutputTokens = holdOutputTokens
+	}
+	cost := maxRequestCost(modelID, estimateInput(), maxOutputTokens, isBatch)
+	requestID := requestIDFor(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	spend, err := spendcap.ReserveKey(ctx, requestID, apiKey, cost)
+	if err != nil {
+		log.Printf("💸 [%s] Spend hold of $%.6f refused for %s: %v", username, cost, modelID, err)
+		return r, holds, err
+	}
+	holds.spend = spend
+
+	// The user's caps are checked in the same write as the balance
+	account := reservation.Credits
+	if config.GetModelBillingUpstream(modelID) == "openhands" {
+		account = reservation.CreditsNew
+	}
+	var caps reservation.Cap
+	if spendcap.Enabled {
+		caps = spendcap.UserCaps{Username: username}
+	}
+	hold, err := reservation.Reserve(ctx, username, requestID, account, cost, caps)
+	if err != nil {
+		log.Printf("💸 [%s] Hold of $%.6f refused for %s: %v", username, cost, modelID, err)
+		holds.Release()
+		return r, requestHolds{}, err
+	}
+	if hold == nil {
+		return r, holds, nil
+	}
+	holds.credit = hold
+	return r.WithContext(context.WithValue(r.Context(), creditHoldKey{}, hold)), holds, nil
+}
+
+// maxRequestCost prices a request at the most expensive tier of the model's chain
+func maxRequestCost(modelID string, inputTokens, outputTokens int64, isBatch bool) float64 {
+	cost := config.CalculateBillingCostWithCacheAndBatch(modelID, inputTokens, outputTokens, 0, 0, isBatch)
+	for _, tier := range upstreamTiers(modelID) {
+		if tier.Model == nil {
+			continue
+		}
+		if tierCost := config.CalculateTierBillingCost(tier.Model, inputTokens, outputTokens, 0, 0, isBatch); tierCost > cost {
+			cost = tierCost
+		}
+	}
+	return cost
+}
@@ -7,6 +7,7 @@ import (
 	"sync"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -84,6 +85,26 @@ func RequestLogsCollection() *mongo.Collection {
 	return GetCollection("request_logs")
 }
 
+func CreditLedgerCollection() *mongo.Collection {
+	return GetCollection("credit_ledger")
+}
+
+func CreditLedgerDriftCollection() *mongo.Collection {
+	return GetCollection("credit_ledger_drift")
+}
+
+func CreditLedgerStateCollection() *mongo.Collection {
+	return GetCollection("credit_ledger_state")
+}
+
+func AppliedWritesCollection() *mongo.Collection {
+	return GetCollection("applied_writes")
+}
+
+func SpendAlertsCollection() *mongo.Collection {
+	return GetCollection("spend_alerts")
+}
+
 func FriendKeysCollection() *mongo.Collection {
 	return GetCollection("friend_keys")
 }
@@ -100,6 +121,22 @@ func OhMyGPTKeysCollection() *mongo.Collection {
 	return GetCollection("ohmygpt_keys")
 }
 
+func MessageBatchesCollection() *mongo.Collection {
+	return GetCollection("message_batches")
+}
+
+func MessageBatchRequestsCollection() *mongo.Collection {
+	return GetCollection("message_batch_requests")
+}
+
+func OpenAIBatchesCollection() *mongo.Collection {
+	return GetCollection("openai_batches")
+}
+
+func OpenAIBatchRequestsCollection() *mongo.Collection {
+	return GetCollection("openai_batch_requests")
+}
+
 func Disconnect() {
 	if client != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -112,6 +149,18 @@ func Disconnect() {
 
 // EnsureIndexes creates required indexes for collections
 func EnsureIndexes() {
-	// No-op: spend history logging disabled to reduce DB storage
+	// Spend history logging disabled to reduce DB storage
 	// Previously created TTL index for openhands_key_spend_history (3h expiry)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// IDs of applied usage updates expire at their expireAt
+	_, err := AppliedWritesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expireAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Printf("⚠️ Failed to create applied_writes TTL index: %v", err)
+	}
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"goproxy/config"
+	"goproxy/internal/affinity"
+	"goproxy/internal/experiment"
+)
+
+// Upstream model experiments
+// A model whose upstream_model_id is a pool is an A/B experiment (config.Experiment). The arm
+// is assigned once per request from the user or conversation hash, so every turn of an agent
+// session is served by the same upstream model, and carried in the request context.
+
+// experimentArm is the arm of a model's experiment assigned to a request
+type experimentArm struct {
+	Experiment string
+	Arm        string // upstream model ID
+}
+
+type experimentArmKey struct{}
+
+// withExperiment assigns r to an arm of modelID's experiment. Conversations are identified
+// by their affinity prefix, so affinity.WithPrefix must run first.
+func withExperiment(r *http.Request, modelID, username string) *http.Request {
+	name, scope, ok := config.GetModelExperiment(modelID)
+	if !ok {
+		return r
+	}
+
+	var subject string
+	switch scope {
+	case config.ExperimentScopeUser:
+		subject = username
+	case config.ExperimentScopeConversation:
+		subject = affinity.PrefixFrom(r.Context())
+		if subject == "" {
+			subject = username
+		}
+	}
+	arm := experimentArm{Experiment: name, Arm: config.AssignUpstreamModelID(modelID, subject)}
+	log.Printf("🧪 [Experiment] %s: model=%s arm=%s scope=%s", name, modelID, arm.Arm, scope)
+	return r.WithContext(context.WithValue(r.Context(), experimentArmKey{}, arm))
+}
+
+// experimentFor returns the arm assigned to r. Fallback tiers serve another model and get
+// the zero arm, so their requests are not counted towards the experiment.
+func experimentFor(r *http.Request) experimentArm {
+	if r == nil || tierFor(r).Hop > 0 {
+		return experimentArm{}
+	}
+	arm, _ := r.Context().Value(experimentArmKey{}).(experimentArm)
+	return arm
+}
+
+// experimentsHandler reports per-arm latency, error rate and cost
+func experimentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"arms": experiment.Stats(),
+	}); err != nil {
+		log.Printf("Error: failed to encode response: %v", err)
+	}
+}
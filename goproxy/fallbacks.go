@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"goproxy/config"
+	"goproxy/internal/breaker"
+	"goproxy/internal/experiment"
+	"goproxy/internal/proxy"
+)
+
+// Cross-upstream fallback chains
+// A model is served by its own upstream first, then by each entry of its "fallbacks" list.
+// A tier is abandoned when it answers 5xx before anything reached the client: connection
+// errors (502), no available keys (503), upstream 5xx and 529 overloaded all surface that way.
+
+// upstreamTier is the position in a model's fallback chain that is serving the request.
+// Handlers read it from the request context to pick the upstream model ID and pricing.
+type upstreamTier struct {
+	Hop      int           // 0 = the model's own upstream
+	Upstream string        // upstream name as in config.json ("main", "openhands", "ohmygpt")
+	Model    *config.Model // model as served by this tier; nil for hop 0
+}
+
+type upstreamTierKey struct{}
+
+func withUpstreamTier(r *http.Request, tier upstreamTier) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), upstreamTierKey{}, tier))
+}
+
+// tierFor returns the tier serving r (the upstream request of a response works too).
+// Requests outside serveWithFallbacks get the zero tier, i.e. the model's own config.
+func tierFor(r *http.Request) upstreamTier {
+	if r == nil {
+		return upstreamTier{}
+	}
+	tier, _ := r.Context().Value(upstreamTierKey{}).(upstreamTier)
+	return tier
+}
+
+// upstreamTiers lists the chain for a model: its own upstream, then each fallback
+func upstreamTiers(modelID string) []upstreamTier {
+	tiers := []upstreamTier{{Upstream: config.GetModelUpstream(modelID)}}
+	for i, fb := range config.GetModelFallbacks(modelID) {
+		tiers = append(tiers, upstreamTier{Hop: i + 1, Upstream: fb.Upstream, Model: config.FallbackModel(modelID, i+1)})
+	}
+	return tiers
+}
+
+// upstreamModelIDFor is config.GetUpstreamModelID for the tier serving r, or the experiment
+// arm r was assigned to (withExperiment)
+func upstreamModelIDFor(r *http.Request, modelID string) string {
+	if tier := tierFor(r); tier.Model != nil {
+		if upstreamModelID, ok := tier.Model.UpstreamModelID.(string); ok && upstreamModelID != "" {
+			return upstreamModelID
+		}
+	}
+	if arm := experimentFor(r); arm.Arm != "" {
+		return arm.Arm
+	}
+	return config.GetUpstreamModelID(modelID)
+}
+
+// billingTokensFor is config.CalculateBillingTokensWithCache priced at the tier serving r
+func billingTokensFor(r *http.Request, modelID string, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64) int64 {
+	if tier := tierFor(r); tier.Model != nil {
+		return config.CalculateTierBillingTokens(tier.Model, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
+	}
+	return config.CalculateBillingTokensWithCache(modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
+}
+
+// billingCostFor is config.CalculateBillingCostWithCacheAndBatch priced at the tier serving r
+func billingCostFor(r *http.Request, modelID string, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64, isBatch bool) float64 {
+	if tier := tierFor(r); tier.Model != nil {
+		return config.CalculateTierBillingCost(tier.Model, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens, isBatch)
+	}
+	return config.CalculateBillingCostWithCacheAndBatch(modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens, isBatch)
+}
+
+// tierHandler serves a request on one tier of the chain
+type tierHandler func(w http.ResponseWriter, r *http.Request, upstreamConfig *UpstreamConfig, selectedProxy *proxy.Proxy)
+
+// serveWithFallbacks runs serve on each tier of the model's chain until one does not fail.
+// Tiers whose upstream circuit is open are skipped (breaker.Upstream); the last tier waits
+// in its admission queue while all of its keys are rate limited (admit). A failed tier's
+// response is held back while another tier remains and is replayed if none serves the
+// request. Returns an error only if no tier could be selected at all, wrapping
+// breaker.ErrOpen if the last one was skipped for its circuit.
+func serveWithFallbacks(w http.ResponseWriter, r *http.Request, modelID string, clientAPIKey string, username string, serve tierHandler) error {
+	tiers := upstreamTiers(modelID)
+	var failed *fallbackWriter
+	var selectErr error
+
+	for i, tier := range tiers {
+		upstreamConfig, selectedProxy, err := selectUpstreamConfig(modelID, tier.Upstream, clientAPIKey)
+		if err != nil {
+			log.Printf("⚠️ [Fallback] %s: hop %d (%s) unavailable: %v", modelID, tier.Hop, tier.Upstream, err)
+			selectErr = err
+			continue
+		}
+		circuit := breaker.Upstream(tier.Upstream)
+		if !circuit.Allow() {
+			log.Printf("⚠️ [Fallback] %s: hop %d (%s) skipped, circuit open", modelID, tier.Hop, tier.Upstream)
+			selectErr = fmt.Errorf("%w for upstream %s", breaker.ErrOpen, tier.Upstream)
+			continue
+		}
+		if tier.Hop > 0 {
+			log.Printf("↪️ [Fallback] %s -> %s (hop %d)", modelID, tier.Upstream, tier.Hop)
+		}
+		tierWriter, finish, release := w, func() {}, func() {}
+		if i == len(tiers)-1 {
+			// Nowhere left to fall back to: wait for a key rather than fail
+			queueClient := username
+			if queueClient == "" {
+				queueClient = clientAPIKey
+			}
+			tierWriter, finish, release, err = admit(w, r, tier.Upstream, upstreamConfig.Provider, queueClient)
+			if err != nil {
+				log.Printf("⚠️ [Fallback] %s: client left while waiting for %s: %v", modelID, tier.Upstream, err)
+				circuit.Release()
+				return nil
+			}
+		}
+
+		// The upstream has answered once the response starts: the key's rate-limit state is
+		// known and the next queued request may take a slot
+		fw := &fallbackWriter{ResponseWriter: tierWriter, header: http.Header{}, canFallBack: i < len(tiers)-1, onCommit: release}
+		tierReq := withUpstreamTier(r, tier)
+		start := time.Now()
+		serve(fw, tierReq, upstreamConfig, selectedProxy)
+		release()
+		finish()
+		if arm := experimentFor(tierReq); arm.Arm != "" {
+			experiment.RecordOutcome(arm.Experiment, arm.Arm, time.Since(start), !fw.failed && fw.status < http.StatusBadRequest)
+		}
+		// The upstream's latency is its time to first byte; streams run for as long as they run
+		latency := time.Since(start)
+		if fw.committed {
+			latency = fw.committedAt.Sub(start)
+		}
+		circuit.Record(!fw.failed && !breaker.IsFailure(fw.status), latency)
+		if !fw.failed {
+			return nil
+		}
+		log.Printf("⚠️ [Fallback] %s: hop %d (%s) failed with status %d", modelID, tier.Hop, tier.Upstream, fw.status)
+		failed = fw
+	}
+
+	if failed == nil {
+		return selectErr
+	}
+	// Every remaining tier was unavailable: the client gets the last failure
+	failed.replay()
+	return nil
+}
+
+// isFallbackStatus reports whether a tier's response should move the request to the next tier
+func isFallbackStatus(status int) bool {
+	return status >= 500
+}
+
+// fallbackWriter holds back a tier's 5xx response so the next tier can still answer.
+// Anything else is passed through, after which the tier has served the request.
+type fallbackWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	canFallBack bool
+	onCommit    func() // called when the response starts, if set
+
+	committed   bool
+	committedAt time.Time
+	failed      bool
+	status      int // status sent, or held back if failed
+	body        bytes.Buffer
+}
+
+func (f *fallbackWriter) Header() http.Header {
+	if f.committed {
+		return f.ResponseWriter.Header()
+	}
+	return f.header
+}
+
+func (f *fallbackWriter) WriteHeader(code int) {
+	if f.committed || f.failed {
+		return
+	}
+	if f.canFallBack && isFallbackStatus(code) {
+		f.failed = true
+		f.status = code
+		return
+	}
+	f.commit(code)
+}
+
+func (f *fallbackWriter) Write(p []byte) (int, error) {
+	if f.failed {
+		return f.body.Write(p)
+	}
+	if !f.committed {
+		f.commit(http.StatusOK)
+	}
+	return f.ResponseWriter.Write(p)
+}
+
+func (f *fallbackWriter) Flush() {
+	if !f.committed {
+		return
+	}
+	if flusher, ok := f.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (f *fallbackWriter) Unwrap() http.ResponseWriter {
+	return f.ResponseWriter
+}
+
+func (f *fallbackWriter) commit(code int) {
+	f.committed = true
+	f.committedAt = time.Now()
+	f.status = code
+	if f.onCommit != nil {
+		f.onCommit()
+	}
+	dst := f.ResponseWriter.Header()
+	for key, values := range f.header {
+		dst[key] = values
+	}
+	f.ResponseWriter.WriteHeader(code)
+}
+
+// replay writes a held-back failure to the client
+func (f *fallbackWriter) replay() {
+	f.failed = false
+	f.commit(f.status)
+	f.ResponseWriter.Write(f.body.Bytes())
+}
@@ -0,0 +1,251 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Admission queues for upstreams whose keys are all rate limited
+// A request that finds no available key waits in its upstream's queue instead of failing
+// right away; keys usually come back within seconds. Waiters are admitted one per free key:
+// an admitted waiter holds its key's slot until its request has an answer from the upstream,
+// so the queue does not drain in one burst onto the key that just came back. Waiters take
+// turns across clients (users) so one busy client cannot starve the others.
+
+var (
+	// MaxWait is the longest a request waits for a key
+	MaxWait = 30 * time.Second
+
+	// MaxDepth bounds each upstream's queue; requests beyond it fail fast
+	MaxDepth = 256
+
+	// PollInterval is how often the head of a queue checks for a free key
+	PollInterval = 250 * time.Millisecond
+)
+
+var (
+	ErrQueueFull = errors.New("admission queue full")
+	ErrTimeout   = errors.New("timed out waiting for an available key")
+)
+
+// Stats reports one upstream's queue
+type Stats struct {
+	Depth    int   `json:"depth"`
+	MaxDepth int   `json:"max_depth"`
+	InFlight int   `json:"in_flight"` // admitted requests still waiting for the upstream's answer
+	Admitted int64 `json:"admitted"`  // requests that waited and got a key
+	TimedOut int64 `json:"timed_out"` // requests that gave up waiting (deadline or client gone)
+	Rejected int64 `json:"rejected"`  // requests turned away by a full queue
+}
+
+type waiter struct {
+	client string
+}
+
+// Queue is one upstream's wait queue
+type Queue struct {
+	mu      sync.Mutex
+	clients []string             // clients with waiters, in turn order
+	waiting map[string][]*waiter // FIFO per client
+	turn    int                  // index in clients whose oldest waiter goes next
+	depth   int
+	flying  int           // admitted waiters that have not released their slot
+	wake    chan struct{} // closed and replaced to wake every waiter
+	stats   Stats
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*Queue)
+)
+
+// For returns the queue of an upstream instance
+func For(upstream string) *Queue {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	q, ok := registry[upstream]
+	if !ok {
+		q = &Queue{waiting: make(map[string][]*waiter), wake: make(chan struct{})}
+		registry[upstream] = q
+	}
+	return q
+}
+
+// All returns the stats of every upstream's queue
+func All() map[string]Stats {
+	registryMu.Lock()
+	queues := make(map[string]*Queue, len(registry))
+	for name, q := range registry {
+		queues[name] = q
+	}
+	registryMu.Unlock()
+
+	stats := make(map[string]Stats, len(queues))
+	for name, q := range queues {
+		stats[name] = q.Stats()
+	}
+	return stats
+}
+
+// Reset drops every queue
+func Reset() {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = make(map[string]*Queue)
+}
+
+// Wait returns once available reports a free key not held by another admitted waiter and
+// it is client's turn, or fails with ErrQueueFull, ErrTimeout or the context's error. With
+// nobody queued, a request that finds a free key goes straight through. onQueued runs once if
+// the request has to wait. An admitted waiter holds a slot until it calls release, which it
+// must do once the upstream has answered (or the request ended without reaching it).
+func (q *Queue) Wait(ctx context.Context, client string, timeout time.Duration, available func() int, onQueued func()) (release func(), err error) {
+	q.mu.Lock()
+	if q.depth == 0 && available() > q.flying {
+		q.mu.Unlock()
+		return func() {}, nil
+	}
+	if timeout <= 0 {
+		q.mu.Unlock()
+		return nil, ErrTimeout
+	}
+	if q.depth >= MaxDepth {
+		q.stats.Rejected++
+		q.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &waiter{client: client}
+	q.enqueueLocked(w)
+	q.mu.Unlock()
+
+	if onQueued != nil {
+		onQueued()
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(PollInterval)
+	defer poll.Stop()
+
+	for {
+		q.mu.Lock()
+		if q.headLocked() == w && available() > q.flying {
+			q.removeLocked(w, true)
+			q.flying++
+			q.stats.Admitted++
+			q.wakeLocked()
+			q.mu.Unlock()
+			return q.releaser(), nil
+		}
+		wake := q.wake
+		q.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-poll.C:
+		case <-deadline.C:
+			q.giveUp(w)
+			return nil, ErrTimeout
+		case <-ctx.Done():
+			q.giveUp(w)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// releaser returns the release func of an admitted waiter's slot; calls after the first
+// are no-ops
+func (q *Queue) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.flying--
+			q.wakeLocked()
+		})
+	}
+}
+
+// Stats returns the queue's depth and counters
+func (q *Queue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Depth = q.depth
+	stats.InFlight = q.flying
+	stats.MaxDepth = MaxDepth
+	return stats
+}
+
+func (q *Queue) giveUp(w *waiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.removeLocked(w, false)
+	q.stats.TimedOut++
+	q.wakeLocked()
+}
+
+func (q *Queue) enqueueLocked(w *waiter) {
+	if len(q.waiting[w.client]) == 0 {
+		q.clients = append(q.clients, w.client)
+	}
+	q.waiting[w.client] = append(q.waiting[w.client], w)
+	q.depth++
+}
+
+// headLocked is the waiter whose turn it is: the oldest of the client at turn
+func (q *Queue) headLocked() *waiter {
+	if len(q.clients) == 0 {
+		return nil
+	}
+	if q.turn >= len(q.clients) {
+		q.turn = 0
+	}
+	return q.waiting[q.clients[q.turn]][0]
+}
+
+// removeLocked drops w. An admitted waiter passes the turn to the next client.
+func (q *Queue) removeLocked(w *waiter, admitted bool) {
+	list := q.waiting[w.client]
+	for i, other := range list {
+		if other == w {
+			list = append(list[:i], list[i+1:]...)
+			q.depth--
+			break
+		}
+	}
+
+	idx := -1
+	for i, client := range q.clients {
+		if client == w.client {
+			idx = i
+			break
+		}
+	}
+
+	if len(list) > 0 {
+		q.waiting[w.client] = list
+		if admitted && idx == q.turn {
+			q.turn++
+		}
+	} else {
+		delete(q.waiting, w.client)
+		if idx >= 0 {
+			q.clients = append(q.clients[:idx], q.clients[idx+1:]...)
+			if idx < q.turn {
+				q.turn--
+			}
+		}
+	}
+	if len(q.clients) == 0 || q.turn >= len(q.clients) {
+		q.turn = 0
+	}
+}
+
+func (q *Queue) wakeLocked() {
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
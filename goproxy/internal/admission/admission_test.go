@@ -0,0 +1,188 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func withTunables(t *testing.T) {
+	t.Helper()
+	maxDepth, poll := MaxDepth, PollInterval
+	t.Cleanup(func() {
+		MaxDepth, PollInterval = maxDepth, poll
+		Reset()
+	})
+	MaxDepth, PollInterval = 16, 5*time.Millisecond
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWait_FastPath(t *testing.T) {
+	withTunables(t)
+	q := For("openhands")
+
+	queued := false
+	_, err := q.Wait(context.Background(), "alice", time.Second, func() int { return 1 }, func() { queued = true })
+	if err != nil || queued {
+		t.Fatalf("Expected a free key to go straight through, got err=%v queued=%v", err, queued)
+	}
+	if stats := q.Stats(); stats.Depth != 0 || stats.Admitted != 0 {
+		t.Errorf("Expected nothing counted for the fast path, got %+v", stats)
+	}
+}
+
+func TestWait_TimesOut(t *testing.T) {
+	withTunables(t)
+	q := For("openhands")
+
+	queued := false
+	start := time.Now()
+	_, err := q.Wait(context.Background(), "alice", 30*time.Millisecond, func() int { return 0 }, func() { queued = true })
+	if !errors.Is(err, ErrTimeout) || !queued {
+		t.Fatalf("Expected ErrTimeout after queueing, got err=%v queued=%v", err, queued)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Expected to wait for the deadline, returned after %v", elapsed)
+	}
+	if stats := q.Stats(); stats.Depth != 0 || stats.TimedOut != 1 {
+		t.Errorf("Expected an empty queue and one timeout, got %+v", stats)
+	}
+
+	if _, err := q.Wait(context.Background(), "alice", 0, func() int { return 0 }, nil); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected a zero timeout to fail fast, got %v", err)
+	}
+}
+
+func TestWait_QueueFullAndCancel(t *testing.T) {
+	withTunables(t)
+	MaxDepth = 1
+	q := For("ohmygpt")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := q.Wait(ctx, "alice", time.Minute, func() int { return 0 }, nil)
+		done <- err
+	}()
+	waitFor(t, "the first waiter", func() bool { return q.Stats().Depth == 1 })
+
+	if _, err := q.Wait(context.Background(), "bob", time.Minute, func() int { return 0 }, nil); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Expected ErrQueueFull, got %v", err)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the waiter to leave with the client, got %v", err)
+	}
+	if stats := q.Stats(); stats.Depth != 0 || stats.Rejected != 1 || stats.TimedOut != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestWait_FairAcrossClients(t *testing.T) {
+	withTunables(t)
+	q := For("openhands")
+
+	var keys atomic.Int32
+	available := func() int { return int(keys.Load()) }
+
+	admitted := make(chan string, 4)
+	enqueue := func(client, label string) {
+		depth := q.Stats().Depth
+		go func() {
+			release, err := q.Wait(context.Background(), client, time.Minute, available, nil)
+			if err != nil {
+				t.Errorf("%s: %v", label, err)
+				return
+			}
+			// The admitted request used the key up
+			keys.Add(-1)
+			release()
+			admitted <- label
+		}()
+		waitFor(t, label+" to queue", func() bool { return q.Stats().Depth == depth+1 })
+	}
+
+	// alice floods the queue before bob arrives
+	enqueue("alice", "alice-1")
+	enqueue("alice", "alice-2")
+	enqueue("alice", "alice-3")
+	enqueue("bob", "bob-1")
+
+	var order []string
+	for i := 0; i < 4; i++ {
+		keys.Add(1)
+		select {
+		case label := <-admitted:
+			order = append(order, label)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out after admitting %v", order)
+		}
+	}
+
+	want := []string{"alice-1", "bob-1", "alice-2", "alice-3"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("Expected admission order %v, got %v", want, order)
+		}
+	}
+	if stats := q.Stats(); stats.Depth != 0 || stats.Admitted != 4 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestWait_AdmitsOnePerFreeKey(t *testing.T) {
+	withTunables(t)
+	q := For("openhands")
+
+	var keys atomic.Int32
+	available := func() int { return int(keys.Load()) }
+
+	releases := make(chan func(), 3)
+	for i := 0; i < 3; i++ {
+		depth := q.Stats().Depth
+		go func() {
+			release, err := q.Wait(context.Background(), "alice", time.Minute, available, nil)
+			if err != nil {
+				t.Errorf("Wait: %v", err)
+				return
+			}
+			releases <- release
+		}()
+		waitFor(t, "the waiter to queue", func() bool { return q.Stats().Depth == depth+1 })
+	}
+
+	// One key comes back: one waiter is admitted, the others wait for its answer
+	keys.Store(1)
+	release := <-releases
+	time.Sleep(10 * PollInterval)
+	if stats := q.Stats(); stats.InFlight != 1 || stats.Depth != 2 {
+		t.Fatalf("Expected one admitted waiter holding the key, got %+v", stats)
+	}
+
+	// Its answer leaves the key available: the next waiter takes the slot
+	release()
+	release()
+	<-releases
+	if stats := q.Stats(); stats.InFlight != 1 || stats.Depth != 1 {
+		t.Fatalf("Expected the next waiter admitted, got %+v", stats)
+	}
+
+	// A fresh request does not jump the queue while the slot is held
+	if _, err := q.Wait(context.Background(), "bob", 20*time.Millisecond, available, nil); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected the newcomer to wait behind the queue, got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package affinity
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Cache-affinity key selection
+// Upstream prompt caches are per account, so a conversation that moves between keys pays
+// cache-write prices again on every turn. A conversation is identified by the hash of its
+// stable prefix and pinned to the key that served it until the pin is idle for TTL.
+
+var (
+	// TTL is how long a pin survives without traffic; Anthropic's prompt cache lives 5 minutes
+	TTL = 5 * time.Minute
+
+	// PrefixMessages is how many conversation messages (after the system prompt) identify a conversation
+	PrefixMessages = 1
+)
+
+type prefixKey struct{}
+
+// WithPrefix returns a context carrying the request's conversation prefix
+func WithPrefix(ctx context.Context, prefix string) context.Context {
+	if prefix == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, prefixKey{}, prefix)
+}
+
+// PrefixFrom returns the conversation prefix set by WithPrefix, or ""
+func PrefixFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	prefix, _ := ctx.Value(prefixKey{}).(string)
+	return prefix
+}
+
+// Prefix hashes the stable prefix of a /v1/messages or /v1/chat/completions body: model,
+// tools, system prompt and the first PrefixMessages messages. cache_control markers are
+// ignored since clients move breakpoints forward every turn. Returns "" without messages.
+func Prefix(body []byte) string {
+	var req struct {
+		Model    string                   `json:"model"`
+		System   interface{}              `json:"system"`
+		Tools    interface{}              `json:"tools"`
+		Messages []map[string]interface{} `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return ""
+	}
+
+	// OpenAI bodies carry the system prompt as leading system/developer messages
+	system := []interface{}{req.System}
+	messages := req.Messages
+	for len(messages) > 0 && (messages[0]["role"] == "system" || messages[0]["role"] == "developer") {
+		system = append(system, messages[0]["content"])
+		messages = messages[1:]
+	}
+	if len(messages) == 0 {
+		return ""
+	}
+	if len(messages) > PrefixMessages {
+		messages = messages[:PrefixMessages]
+	}
+
+	data, err := json.Marshal(stripCacheControl([]interface{}{req.Model, req.Tools, system, messages}))
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// stripCacheControl removes cache_control from every object in v
+func stripCacheControl(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		delete(val, "cache_control")
+		for k, item := range val {
+			val[k] = stripCacheControl(item)
+		}
+	case []map[string]interface{}:
+		for _, item := range val {
+			stripCacheControl(item)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = stripCacheControl(item)
+		}
+	}
+	return v
+}
+
+// Stats reports how often requests were served by their pinned key
+type Stats struct {
+	Pins        int     `json:"pins"`        // pinned conversations (expired pins are dropped lazily)
+	Hits        int64   `json:"hits"`        // served by the pinned key
+	Misses      int64   `json:"misses"`      // new conversations (or expired pins)
+	Unavailable int64   `json:"unavailable"` // pinned key was unavailable and the pin moved
+	HitRate     float64 `json:"hit_rate"`    // hits / (hits + misses + unavailable)
+}
+
+type pin struct {
+	keyID   string
+	expires time.Time
+}
+
+// Table maps conversation prefixes to the key that served them. A nil Table never pins.
+type Table struct {
+	mu          sync.Mutex
+	pins        map[string]pin
+	nextSweep   int
+	hits        int64
+	misses      int64
+	unavailable int64
+}
+
+// NewTable creates an empty affinity table
+func NewTable() *Table {
+	return &Table{pins: make(map[string]pin), nextSweep: 1024}
+}
+
+// Pick returns the key pinned to prefix if usable(keyID) accepts it. Otherwise it takes the
+// next key from the pool's round-robin and pins prefix to it. Without a prefix it is next().
+func (t *Table) Pick(prefix string, usable func(keyID string) bool, next func() (string, error)) (string, error) {
+	if t == nil || prefix == "" {
+		return next()
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	p, pinned := t.pins[prefix]
+	t.mu.Unlock()
+	pinned = pinned && now.Before(p.expires)
+
+	// usable runs outside the lock: it takes the pool's lock
+	if pinned && usable(p.keyID) {
+		t.mu.Lock()
+		t.hits++
+		t.pins[prefix] = pin{keyID: p.keyID, expires: now.Add(TTL)}
+		t.mu.Unlock()
+		return p.keyID, nil
+	}
+
+	keyID, err := next()
+	if err != nil {
+		return "", err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if pinned {
+		t.unavailable++
+	} else {
+		t.misses++
+	}
+	t.pins[prefix] = pin{keyID: keyID, expires: now.Add(TTL)}
+	if len(t.pins) >= t.nextSweep {
+		t.sweepLocked(now)
+	}
+	return keyID, nil
+}
+
+// sweepLocked drops expired pins and schedules the next sweep at twice the remaining size
+func (t *Table) sweepLocked(now time.Time) {
+	for prefix, p := range t.pins {
+		if !now.Before(p.expires) {
+			delete(t.pins, prefix)
+		}
+	}
+	t.nextSweep = 2 * len(t.pins)
+	if t.nextSweep < 1024 {
+		t.nextSweep = 1024
+	}
+}
+
+// Stats returns the table's hit counters
+func (t *Table) Stats() Stats {
+	if t == nil {
+		return Stats{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := Stats{
+		Pins:        len(t.pins),
+		Hits:        t.hits,
+		Misses:      t.misses,
+		Unavailable: t.unavailable,
+	}
+	if total := t.hits + t.misses + t.unavailable; total > 0 {
+		stats.HitRate = float64(t.hits) / float64(total)
+	}
+	return stats
+}
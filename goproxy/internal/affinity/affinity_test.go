@@ -0,0 +1,107 @@
+package affinity
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPrefix_StableAcrossTurns(t *testing.T) {
+	first := Prefix([]byte(`{
+		"model": "claude-sonnet-4-5",
+		"system": [{"type": "text", "text": "You are helpful.", "cache_control": {"type": "ephemeral"}}],
+		"messages": [{"role": "user", "content": [{"type": "text", "text": "Hi", "cache_control": {"type": "ephemeral"}}]}]
+	}`))
+	later := Prefix([]byte(`{
+		"model": "claude-sonnet-4-5",
+		"system": [{"type": "text", "text": "You are helpful.", "cache_control": {"type": "ephemeral"}}],
+		"messages": [
+			{"role": "user", "content": [{"type": "text", "text": "Hi"}]},
+			{"role": "assistant", "content": "Hello!"},
+			{"role": "user", "content": [{"type": "text", "text": "More", "cache_control": {"type": "ephemeral"}}]}
+		]
+	}`))
+	if first == "" || first != later {
+		t.Errorf("Expected the same prefix for later turns, got %q and %q", first, later)
+	}
+
+	other := Prefix([]byte(`{"model": "claude-sonnet-4-5", "system": "You are helpful.", "messages": [{"role": "user", "content": "Bye"}]}`))
+	if other == first {
+		t.Error("Expected a different first message to give a different prefix")
+	}
+}
+
+func TestPrefix_OpenAISystemMessages(t *testing.T) {
+	withSystem := Prefix([]byte(`{"model": "gpt-5", "messages": [{"role": "system", "content": "Be brief."}, {"role": "user", "content": "Hi"}]}`))
+	withoutSystem := Prefix([]byte(`{"model": "gpt-5", "messages": [{"role": "user", "content": "Hi"}]}`))
+	if withSystem == "" || withSystem == withoutSystem {
+		t.Errorf("Expected the system message to be part of the prefix, got %q and %q", withSystem, withoutSystem)
+	}
+	if p := Prefix([]byte(`{"model": "gpt-5", "messages": [{"role": "system", "content": "Be brief."}]}`)); p != "" {
+		t.Errorf("Expected no prefix without conversation messages, got %q", p)
+	}
+}
+
+func TestTable_Pick(t *testing.T) {
+	table := NewTable()
+	available := map[string]bool{"key-a": true, "key-b": true}
+	usable := func(keyID string) bool { return available[keyID] }
+	keys := []string{"key-a", "key-b"}
+	calls := 0
+	next := func() (string, error) {
+		keyID := keys[calls%len(keys)]
+		calls++
+		return keyID, nil
+	}
+
+	if keyID, _ := table.Pick("conv", usable, next); keyID != "key-a" {
+		t.Fatalf("Expected round-robin key-a, got %s", keyID)
+	}
+	if keyID, _ := table.Pick("conv", usable, next); keyID != "key-a" {
+		t.Errorf("Expected pinned key-a, got %s", keyID)
+	}
+
+	available["key-a"] = false
+	if keyID, _ := table.Pick("conv", usable, next); keyID != "key-b" {
+		t.Errorf("Expected fallback to key-b, got %s", keyID)
+	}
+	available["key-a"] = true
+	if keyID, _ := table.Pick("conv", usable, next); keyID != "key-b" {
+		t.Errorf("Expected the pin to move to key-b, got %s", keyID)
+	}
+
+	// Requests without a prefix are never pinned
+	table.Pick("", usable, next)
+
+	stats := table.Stats()
+	if stats.Pins != 1 || stats.Hits != 2 || stats.Misses != 1 || stats.Unavailable != 1 || stats.HitRate != 0.5 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestTable_PickExpiredAndErrors(t *testing.T) {
+	defer func(ttl time.Duration) { TTL = ttl }(TTL)
+	TTL = time.Millisecond
+
+	table := NewTable()
+	usable := func(string) bool { return true }
+	table.Pick("conv", usable, func() (string, error) { return "key-a", nil })
+	time.Sleep(5 * time.Millisecond)
+
+	if keyID, _ := table.Pick("conv", usable, func() (string, error) { return "key-b", nil }); keyID != "key-b" {
+		t.Errorf("Expected an expired pin to be replaced, got %s", keyID)
+	}
+	if stats := table.Stats(); stats.Misses != 2 || stats.Hits != 0 {
+		t.Errorf("Expected expired pins to count as misses, got %+v", stats)
+	}
+
+	errNoKeys := errors.New("no keys")
+	if _, err := table.Pick("other", usable, func() (string, error) { return "", errNoKeys }); err != errNoKeys {
+		t.Errorf("Expected the pool error, got %v", err)
+	}
+
+	var nilTable *Table
+	if keyID, _ := nilTable.Pick("conv", usable, func() (string, error) { return "key-c", nil }); keyID != "key-c" {
+		t.Errorf("Expected a nil table to use next, got %s", keyID)
+	}
+}
@@ -0,0 +1,350 @@
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore is an in-memory Store for worker tests
+type memoryStore struct {
+	mu       sync.Mutex
+	batches  map[string]*MessageBatch
+	requests map[string]*BatchRequest
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{batches: map[string]*MessageBatch{}, requests: map[string]*BatchRequest{}}
+}
+
+func (s *memoryStore) CreateBatch(ctx context.Context, b *MessageBatch, requests []*BatchRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches[b.ID] = b
+	for _, req := range requests {
+		s.requests[req.ID] = req
+	}
+	return nil
+}
+
+func (s *memoryStore) GetBatch(ctx context.Context, id string) (*MessageBatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.batches[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *b
+	return &copied, nil
+}
+
+func (s *memoryStore) ListBatches(ctx context.Context, userKeyID string, limit int, beforeID, afterID string) ([]*MessageBatch, bool, error) {
+	return nil, false, nil
+}
+
+func (s *memoryStore) ClaimNextRequest(ctx context.Context) (*BatchRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.requests))
+	for id, req := range s.requests {
+		if req.Status == RequestPending {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	sort.Strings(ids)
+	req := s.requests[ids[0]]
+	req.Status = RequestProcessing
+	copied := *req
+	return &copied, nil
+}
+
+func (s *memoryStore) CompleteRequest(ctx context.Context, req *BatchRequest, resultType, result string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := s.requests[req.ID]
+	stored.Status = resultType
+	stored.Result = result
+
+	b := s.batches[req.BatchID]
+	b.RequestCounts.Processing--
+	switch resultType {
+	case ResultSucceeded:
+		b.RequestCounts.Succeeded++
+	case ResultErrored:
+		b.RequestCounts.Errored++
+	case ResultCanceled:
+		b.RequestCounts.Canceled++
+	case ResultExpired:
+		b.RequestCounts.Expired++
+	}
+	if b.RequestCounts.Processing == 0 {
+		b.ProcessingStatus = StatusEnded
+	}
+	return nil
+}
+
+func (s *memoryStore) CancelBatch(ctx context.Context, id string) (*MessageBatch, error) {
+	s.mu.Lock()
+	s.batches[id].ProcessingStatus = StatusCanceling
+	s.mu.Unlock()
+	return s.GetBatch(ctx, id)
+}
+
+func (s *memoryStore) EachResult(ctx context.Context, batchID string, fn func(*BatchRequest) error) error {
+	return nil
+}
+
+func (s *memoryStore) RequeueStale(ctx context.Context, olderThan time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (s *memoryStore) ReleaseRequest(ctx context.Context, req *BatchRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[req.ID].Status = RequestPending
+	return nil
+}
+
+func newTestBatch(t *testing.T, store *memoryStore, body string) *MessageBatch {
+	t.Helper()
+	var params CreateParams
+	if err := json.Unmarshal([]byte(body), &params); err != nil {
+		t.Fatalf("invalid params: %v", err)
+	}
+	if err := params.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	b, requests := NewBatch("alice", "sk-test", &params, time.Now())
+	store.CreateBatch(context.Background(), b, requests)
+	return b
+}
+
+// =============================================================================
+// Validation and Result Format Tests
+// =============================================================================
+
+func TestCreateParamsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		errorHas string
+	}{
+		{"valid", `{"requests":[{"custom_id":"a-1","params":{"model":"m"}},{"custom_id":"a_2","params":{"model":"m"}}]}`, ""},
+		{"empty", `{"requests":[]}`, "at least one request"},
+		{"bad custom_id", `{"requests":[{"custom_id":"a b","params":{}}]}`, "requests.0.custom_id"},
+		{"duplicate custom_id", `{"requests":[{"custom_id":"a","params":{}},{"custom_id":"a","params":{}}]}`, "requests.1.custom_id: duplicate"},
+		{"params not an object", `{"requests":[{"custom_id":"a","params":"hi"}]}`, "requests.0.params"},
+		{"missing params", `{"requests":[{"custom_id":"a"}]}`, "requests.0.params"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params CreateParams
+			if err := json.Unmarshal([]byte(tt.body), &params); err != nil {
+				t.Fatalf("invalid body: %v", err)
+			}
+			err := params.Validate()
+			if tt.errorHas == "" {
+				if err != nil {
+					t.Errorf("Expected valid, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errorHas) {
+				t.Errorf("Expected error containing %q, got %v", tt.errorHas, err)
+			}
+		})
+	}
+}
+
+func TestBuildResult(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		resultType string
+		expected   string
+	}{
+		{"success", 200, `{"id":"msg_1","type":"message"}`, ResultSucceeded, `{"message":{"id":"msg_1","type":"message"},"type":"succeeded"}`},
+		{"anthropic error", 400, `{"type":"error","error":{"type":"invalid_request_error","message":"bad"}}`, ResultErrored, `{"error":{"error":{"message":"bad","type":"invalid_request_error"},"type":"error"},"type":"errored"}`},
+		{"openai style error", 402, `{"error":{"message":"Insufficient credits","type":"insufficient_credits"}}`, ResultErrored, `{"error":{"error":{"message":"Insufficient credits","type":"api_error"},"type":"error"},"type":"errored"}`},
+		{"plain text error", 502, "upstream failed\n", ResultErrored, `{"error":{"error":{"message":"Request failed with status 502","type":"api_error"},"type":"error"},"type":"errored"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resultType, result := BuildResult(tt.status, []byte(tt.body))
+			if resultType != tt.resultType || result != tt.expected {
+				t.Errorf("Expected %s %s, got %s %s", tt.resultType, tt.expected, resultType, result)
+			}
+		})
+	}
+}
+
+func TestResultLine(t *testing.T) {
+	line := ResultLine(&BatchRequest{CustomID: "req-1", Status: ResultCanceled})
+	if string(line) != `{"custom_id":"req-1","result":{"type":"canceled"}}`+"\n" {
+		t.Errorf("Unexpected result line: %s", line)
+	}
+}
+
+func TestNewBatchRequestOrder(t *testing.T) {
+	body := `{"requests":[{"custom_id":"a","params":{}},{"custom_id":"b","params":{}}]}`
+	var params CreateParams
+	json.Unmarshal([]byte(body), &params)
+
+	first, firstReqs := NewBatch("", "k", &params, time.Now())
+	second, _ := NewBatch("", "k", &params, time.Now().Add(time.Second))
+
+	if !strings.HasPrefix(first.ID, "msgbatch_") || first.ID >= second.ID {
+		t.Errorf("Expected time-ordered batch IDs, got %s and %s", first.ID, second.ID)
+	}
+	if firstReqs[0].ID >= firstReqs[1].ID || firstReqs[1].ID >= second.ID {
+		t.Errorf("Expected request IDs to sort by batch then index, got %s %s", firstReqs[0].ID, firstReqs[1].ID)
+	}
+	if first.RequestCounts.Processing != 2 || first.ExpiresAt.Sub(first.CreatedAt) != ExpirationWindow {
+		t.Errorf("Unexpected new batch: %+v", first)
+	}
+}
+
+// =============================================================================
+// Worker Pool Tests
+// =============================================================================
+
+func TestPoolProcessesBatch(t *testing.T) {
+	store := newMemoryStore()
+	b := newTestBatch(t, store, `{"requests":[{"custom_id":"ok","params":{"model":"m"}},{"custom_id":"fail","params":{"model":"bad"}}]}`)
+
+	var executed []string
+	execute := func(ctx context.Context, mb *MessageBatch, params []byte) (int, []byte) {
+		if mb.UserKeyID != "sk-test" {
+			t.Errorf("Expected executor to receive the batch owner, got %q", mb.UserKeyID)
+		}
+		executed = append(executed, string(params))
+		if strings.Contains(string(params), "bad") {
+			return 404, []byte(`{"type":"error","error":{"type":"invalid_request_error","message":"Model not found"}}`)
+		}
+		return 200, []byte(`{"id":"msg_1","type":"message"}`)
+	}
+	pool := NewPool(store, execute, 1, nil)
+
+	for pool.processNext(context.Background()) {
+	}
+
+	if len(executed) != 2 {
+		t.Fatalf("Expected 2 executions, got %d", len(executed))
+	}
+	ended, _ := store.GetBatch(context.Background(), b.ID)
+	if ended.ProcessingStatus != StatusEnded || ended.RequestCounts.Succeeded != 1 || ended.RequestCounts.Errored != 1 {
+		t.Errorf("Unexpected batch after processing: %+v", ended)
+	}
+}
+
+func TestPoolSkipsCanceledAndExpired(t *testing.T) {
+	execute := func(ctx context.Context, mb *MessageBatch, params []byte) (int, []byte) {
+		t.Errorf("Executor must not run for canceled or expired batches")
+		return 200, nil
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		store := newMemoryStore()
+		b := newTestBatch(t, store, `{"requests":[{"custom_id":"a","params":{}}]}`)
+		store.CancelBatch(context.Background(), b.ID)
+
+		pool := NewPool(store, execute, 1, nil)
+		pool.processNext(context.Background())
+
+		ended, _ := store.GetBatch(context.Background(), b.ID)
+		if ended.RequestCounts.Canceled != 1 || ended.ProcessingStatus != StatusEnded {
+			t.Errorf("Expected canceled request and ended batch, got %+v", ended)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		store := newMemoryStore()
+		b := newTestBatch(t, store, `{"requests":[{"custom_id":"a","params":{}}]}`)
+
+		pool := NewPool(store, execute, 1, nil)
+		pool.now = func() time.Time { return b.ExpiresAt.Add(time.Minute) }
+		pool.processNext(context.Background())
+
+		ended, _ := store.GetBatch(context.Background(), b.ID)
+		if ended.RequestCounts.Expired != 1 {
+			t.Errorf("Expected expired request, got %+v", ended.RequestCounts)
+		}
+		if store.requests[b.ID+"_000000"].Result != `{"type":"expired"}` {
+			t.Errorf("Unexpected expired result: %s", store.requests[b.ID+"_000000"].Result)
+		}
+	})
+}
+
+func TestPoolStopWaitsForRunningRequest(t *testing.T) {
+	store := newMemoryStore()
+	b := newTestBatch(t, store, `{"requests":[{"custom_id":"a","params":{}},{"custom_id":"b","params":{}}]}`)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var executions int
+	execute := func(ctx context.Context, mb *MessageBatch, params []byte) (int, []byte) {
+		executions++
+		if executions == 1 {
+			close(started)
+			<-release
+		}
+		return 200, []byte(`{"id":"msg_1","type":"message"}`)
+	}
+	pool := NewPool(store, execute, 1, nil)
+	pool.Start()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		pool.Stop(context.Background())
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Expected Stop to wait for the running request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+
+	if executions != 1 {
+		t.Errorf("Expected no request claimed after Stop, got %d executions", executions)
+	}
+	if got := store.requests[b.ID+"_000000"].Result; got == "" {
+		t.Error("Expected the running request's result to be stored")
+	}
+}
+
+func TestPoolStopCancelsRequestsAtTheDeadline(t *testing.T) {
+	store := newMemoryStore()
+	b := newTestBatch(t, store, `{"requests":[{"custom_id":"a","params":{}}]}`)
+
+	started := make(chan struct{})
+	execute := func(ctx context.Context, mb *MessageBatch, params []byte) (int, []byte) {
+		close(started)
+		<-ctx.Done()
+		return 500, []byte(`{"type":"error","error":{"type":"api_error","message":"canceled"}}`)
+	}
+	pool := NewPool(store, execute, 1, nil)
+	pool.Start()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	pool.Stop(ctx)
+
+	req := store.requests[b.ID+"_000000"]
+	if req.Status != RequestPending || req.Result != "" {
+		t.Errorf("Expected the cancelled request back to pending without a result, got %s %q", req.Status, req.Result)
+	}
+}
@@ -0,0 +1,214 @@
+package batch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Batch processing status (Anthropic Message Batches API)
+const (
+	StatusInProgress = "in_progress"
+	StatusCanceling  = "canceling"
+	StatusEnded      = "ended"
+)
+
+// Per-request status. Pending and processing are internal; the others are result types.
+const (
+	RequestPending    = "pending"
+	RequestProcessing = "processing"
+	ResultSucceeded   = "succeeded"
+	ResultErrored     = "errored"
+	ResultCanceled    = "canceled"
+	ResultExpired     = "expired"
+)
+
+const (
+	// ExpirationWindow is how long a batch may take; requests not started by then expire
+	ExpirationWindow = 24 * time.Hour
+
+	// MaxRequestsPerBatch matches the Anthropic limit
+	MaxRequestsPerBatch = 100000
+)
+
+var (
+	ErrNotFound  = errors.New("message batch not found")
+	ErrNotActive = errors.New("message batch is not in progress")
+
+	customIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+)
+
+// RequestCounts tallies batch requests by status
+type RequestCounts struct {
+	Processing int64 `bson:"processing" json:"processing"`
+	Succeeded  int64 `bson:"succeeded" json:"succeeded"`
+	Errored    int64 `bson:"errored" json:"errored"`
+	Canceled   int64 `bson:"canceled" json:"canceled"`
+	Expired    int64 `bson:"expired" json:"expired"`
+}
+
+// MessageBatch is a batch job stored in the message_batches collection
+type MessageBatch struct {
+	ID                string        `bson:"_id"`
+	UserID            string        `bson:"userId,omitempty"`
+	UserKeyID         string        `bson:"userKeyId"`
+	ProcessingStatus  string        `bson:"processingStatus"`
+	RequestCounts     RequestCounts `bson:"requestCounts"`
+	CreatedAt         time.Time     `bson:"createdAt"`
+	ExpiresAt         time.Time     `bson:"expiresAt"`
+	EndedAt           *time.Time    `bson:"endedAt,omitempty"`
+	CancelInitiatedAt *time.Time    `bson:"cancelInitiatedAt,omitempty"`
+}
+
+// BatchRequest is one request of a batch, stored in the message_batch_requests collection.
+// IDs sort in batch creation order, then by index, so workers drain batches FIFO.
+type BatchRequest struct {
+	ID        string     `bson:"_id"`
+	BatchID   string     `bson:"batchId"`
+	Index     int        `bson:"index"`
+	CustomID  string     `bson:"customId"`
+	Params    string     `bson:"params"` // Messages API request body (JSON)
+	Status    string     `bson:"status"`
+	Result    string     `bson:"result,omitempty"` // result object (JSON) once finished
+	CreatedAt time.Time  `bson:"createdAt"`
+	ClaimedAt *time.Time `bson:"claimedAt,omitempty"`
+}
+
+// CreateParams is the body of POST /v1/messages/batches
+type CreateParams struct {
+	Requests []struct {
+		CustomID string          `json:"custom_id"`
+		Params   json.RawMessage `json:"params"`
+	} `json:"requests"`
+}
+
+// NewBatch builds a batch and its pending requests from validated create params
+func NewBatch(userID, userKeyID string, params *CreateParams, now time.Time) (*MessageBatch, []*BatchRequest) {
+	b := &MessageBatch{
+		ID:               "msgbatch_" + primitive.NewObjectIDFromTimestamp(now).Hex(),
+		UserID:           userID,
+		UserKeyID:        userKeyID,
+		ProcessingStatus: StatusInProgress,
+		RequestCounts:    RequestCounts{Processing: int64(len(params.Requests))},
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(ExpirationWindow),
+	}
+
+	requests := make([]*BatchRequest, 0, len(params.Requests))
+	for i, req := range params.Requests {
+		requests = append(requests, &BatchRequest{
+			ID:        fmt.Sprintf("%s_%06d", b.ID, i),
+			BatchID:   b.ID,
+			Index:     i,
+			CustomID:  req.CustomID,
+			Params:    string(req.Params),
+			Status:    RequestPending,
+			CreatedAt: now,
+		})
+	}
+	return b, requests
+}
+
+// Validate checks request count, custom_id format/uniqueness and that params are objects
+func (p *CreateParams) Validate() error {
+	if len(p.Requests) == 0 {
+		return errors.New("requests: at least one request is required")
+	}
+	if len(p.Requests) > MaxRequestsPerBatch {
+		return fmt.Errorf("requests: a batch may contain at most %d requests", MaxRequestsPerBatch)
+	}
+
+	seen := make(map[string]struct{}, len(p.Requests))
+	for i, req := range p.Requests {
+		if !customIDPattern.MatchString(req.CustomID) {
+			return fmt.Errorf("requests.%d.custom_id: must be 1-64 characters of letters, digits, '_' or '-'", i)
+		}
+		if _, dup := seen[req.CustomID]; dup {
+			return fmt.Errorf("requests.%d.custom_id: duplicate custom_id '%s'", i, req.CustomID)
+		}
+		seen[req.CustomID] = struct{}{}
+
+		var params map[string]interface{}
+		if err := json.Unmarshal(req.Params, &params); err != nil || params == nil {
+			return fmt.Errorf("requests.%d.params: must be a Messages API request object", i)
+		}
+	}
+	return nil
+}
+
+// View returns the API representation of the batch.
+// resultsURL is only exposed once the batch has ended.
+func (b *MessageBatch) View(resultsURL string) map[string]interface{} {
+	view := map[string]interface{}{
+		"id":                  b.ID,
+		"type":                "message_batch",
+		"processing_status":   b.ProcessingStatus,
+		"request_counts":      b.RequestCounts,
+		"created_at":          b.CreatedAt.UTC().Format(time.RFC3339),
+		"expires_at":          b.ExpiresAt.UTC().Format(time.RFC3339),
+		"ended_at":            formatTime(b.EndedAt),
+		"cancel_initiated_at": formatTime(b.CancelInitiatedAt),
+		"archived_at":         nil,
+		"results_url":         nil,
+	}
+	if b.ProcessingStatus == StatusEnded {
+		view["results_url"] = resultsURL
+	}
+	return view
+}
+
+func formatTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// BuildResult converts an upstream Messages response into a batch result object.
+// 200 responses succeed with the message; anything else is errored with the Anthropic error body.
+func BuildResult(statusCode int, body []byte) (resultType string, result string) {
+	var parsed map[string]interface{}
+	isObject := json.Unmarshal(body, &parsed) == nil && parsed != nil
+
+	if statusCode == 200 && isObject {
+		data, _ := json.Marshal(map[string]interface{}{"type": ResultSucceeded, "message": parsed})
+		return ResultSucceeded, string(data)
+	}
+
+	if !isObject || parsed["type"] != "error" {
+		message := fmt.Sprintf("Request failed with status %d", statusCode)
+		if errObj, ok := parsed["error"].(map[string]interface{}); ok {
+			if msg, ok := errObj["message"].(string); ok && msg != "" {
+				message = msg
+			}
+		}
+		parsed = map[string]interface{}{
+			"type":  "error",
+			"error": map[string]interface{}{"type": "api_error", "message": message},
+		}
+	}
+	data, _ := json.Marshal(map[string]interface{}{"type": ResultErrored, "error": parsed})
+	return ResultErrored, string(data)
+}
+
+// SimpleResult returns the result object for canceled and expired requests
+func SimpleResult(resultType string) string {
+	return fmt.Sprintf(`{"type":"%s"}`, resultType)
+}
+
+// ResultLine returns the JSONL line for a finished request
+func ResultLine(req *BatchRequest) []byte {
+	result := json.RawMessage(req.Result)
+	if len(result) == 0 {
+		result = json.RawMessage(SimpleResult(req.Status))
+	}
+	line, _ := json.Marshal(struct {
+		CustomID string          `json:"custom_id"`
+		Result   json.RawMessage `json:"result"`
+	}{req.CustomID, result})
+	return append(line, '\n')
+}
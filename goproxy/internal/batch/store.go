@@ -0,0 +1,243 @@
+package batch
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"goproxy/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Store persists batches and their requests
+type Store interface {
+	CreateBatch(ctx context.Context, b *MessageBatch, requests []*BatchRequest) error
+	GetBatch(ctx context.Context, id string) (*MessageBatch, error)
+	// ListBatches returns the key's batches newest first. afterID pages to older batches,
+	// beforeID to newer ones.
+	ListBatches(ctx context.Context, userKeyID string, limit int, beforeID, afterID string) ([]*MessageBatch, bool, error)
+	// ClaimNextRequest marks the oldest pending request as processing; nil when none is pending
+	ClaimNextRequest(ctx context.Context) (*BatchRequest, error)
+	// CompleteRequest stores the result, updates the batch counts and ends the batch
+	// once no request is left processing
+	CompleteRequest(ctx context.Context, req *BatchRequest, resultType, result string) error
+	// CancelBatch moves an in-progress batch to canceling and cancels its pending requests
+	CancelBatch(ctx context.Context, id string) (*MessageBatch, error)
+	// EachResult calls fn for every request of the batch in index order
+	EachResult(ctx context.Context, batchID string, fn func(*BatchRequest) error) error
+	// RequeueStale returns requests claimed before olderThan (e.g. by a crashed worker) to pending
+	RequeueStale(ctx context.Context, olderThan time.Time) (int64, error)
+	// ReleaseRequest returns a claimed request to pending, e.g. one whose run was cancelled
+	ReleaseRequest(ctx context.Context, req *BatchRequest) error
+}
+
+// MongoStore stores batches in message_batches and requests in message_batch_requests
+type MongoStore struct{}
+
+// NewMongoStore creates a MongoDB-backed store
+func NewMongoStore() *MongoStore {
+	return &MongoStore{}
+}
+
+// EnsureIndexes creates the indexes used by workers and list queries
+func (s *MongoStore) EnsureIndexes(ctx context.Context) {
+	if _, err := db.MessageBatchRequestsCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "batchId", Value: 1}, {Key: "index", Value: 1}}},
+	}); err != nil {
+		log.Printf("⚠️ [Batch] Failed to create request indexes: %v", err)
+	}
+	if _, err := db.MessageBatchesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "userKeyId", Value: 1}, {Key: "_id", Value: -1}},
+	}); err != nil {
+		log.Printf("⚠️ [Batch] Failed to create batch indexes: %v", err)
+	}
+}
+
+func (s *MongoStore) CreateBatch(ctx context.Context, b *MessageBatch, requests []*BatchRequest) error {
+	docs := make([]interface{}, 0, len(requests))
+	for _, req := range requests {
+		docs = append(docs, req)
+	}
+	// Requests first: a batch document must never exist without its requests
+	if _, err := db.MessageBatchRequestsCollection().InsertMany(ctx, docs, options.InsertMany().SetOrdered(false)); err != nil {
+		return err
+	}
+	_, err := db.MessageBatchesCollection().InsertOne(ctx, b)
+	return err
+}
+
+func (s *MongoStore) GetBatch(ctx context.Context, id string) (*MessageBatch, error) {
+	var b MessageBatch
+	if err := db.MessageBatchesCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&b); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *MongoStore) ListBatches(ctx context.Context, userKeyID string, limit int, beforeID, afterID string) ([]*MessageBatch, bool, error) {
+	filter := bson.M{"userKeyId": userKeyID}
+	sortOrder := -1
+	if afterID != "" {
+		filter["_id"] = bson.M{"$lt": afterID}
+	} else if beforeID != "" {
+		filter["_id"] = bson.M{"$gt": beforeID}
+		sortOrder = 1
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: sortOrder}}).SetLimit(int64(limit + 1))
+	cursor, err := db.MessageBatchesCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	var batches []*MessageBatch
+	if err := cursor.All(ctx, &batches); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(batches) > limit
+	if hasMore {
+		batches = batches[:limit]
+	}
+	if sortOrder == 1 {
+		// Keep newest-first order for before_id pages
+		for i, j := 0, len(batches)-1; i < j; i, j = i+1, j-1 {
+			batches[i], batches[j] = batches[j], batches[i]
+		}
+	}
+	return batches, hasMore, nil
+}
+
+func (s *MongoStore) ClaimNextRequest(ctx context.Context) (*BatchRequest, error) {
+	var req BatchRequest
+	err := db.MessageBatchRequestsCollection().FindOneAndUpdate(
+		ctx,
+		bson.M{"status": RequestPending},
+		bson.M{"$set": bson.M{"status": RequestProcessing, "claimedAt": time.Now()}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "_id", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&req)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (s *MongoStore) CompleteRequest(ctx context.Context, req *BatchRequest, resultType, result string) error {
+	res, err := db.MessageBatchRequestsCollection().UpdateOne(ctx,
+		bson.M{"_id": req.ID, "status": RequestProcessing},
+		bson.M{"$set": bson.M{"status": resultType, "result": result}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		// Already finished elsewhere (e.g. requeued and completed twice)
+		return nil
+	}
+	return s.recordResults(ctx, req.BatchID, resultType, 1)
+}
+
+func (s *MongoStore) CancelBatch(ctx context.Context, id string) (*MessageBatch, error) {
+	now := time.Now()
+	res, err := db.MessageBatchesCollection().UpdateOne(ctx,
+		bson.M{"_id": id, "processingStatus": StatusInProgress},
+		bson.M{"$set": bson.M{"processingStatus": StatusCanceling, "cancelInitiatedAt": now}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		if _, err := s.GetBatch(ctx, id); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotActive
+	}
+
+	// Requests already processing finish normally; pending ones are canceled now
+	canceled, err := db.MessageBatchRequestsCollection().UpdateMany(ctx,
+		bson.M{"batchId": id, "status": RequestPending},
+		bson.M{"$set": bson.M{"status": ResultCanceled, "result": SimpleResult(ResultCanceled)}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if canceled.ModifiedCount > 0 {
+		if err := s.recordResults(ctx, id, ResultCanceled, canceled.ModifiedCount); err != nil {
+			return nil, err
+		}
+	} else if err := s.endIfDone(ctx, id); err != nil {
+		return nil, err
+	}
+	return s.GetBatch(ctx, id)
+}
+
+// recordResults moves n requests from processing to resultType and ends the batch when done
+func (s *MongoStore) recordResults(ctx context.Context, batchID, resultType string, n int64) error {
+	_, err := db.MessageBatchesCollection().UpdateOne(ctx,
+		bson.M{"_id": batchID},
+		bson.M{"$inc": bson.M{"requestCounts.processing": -n, "requestCounts." + resultType: n}},
+	)
+	if err != nil {
+		return err
+	}
+	return s.endIfDone(ctx, batchID)
+}
+
+func (s *MongoStore) endIfDone(ctx context.Context, batchID string) error {
+	res, err := db.MessageBatchesCollection().UpdateOne(ctx,
+		bson.M{"_id": batchID, "requestCounts.processing": bson.M{"$lte": 0}, "processingStatus": bson.M{"$ne": StatusEnded}},
+		bson.M{"$set": bson.M{"processingStatus": StatusEnded, "endedAt": time.Now()}},
+	)
+	if err == nil && res.ModifiedCount > 0 {
+		log.Printf("✅ [Batch] %s ended", batchID)
+	}
+	return err
+}
+
+func (s *MongoStore) EachResult(ctx context.Context, batchID string, fn func(*BatchRequest) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "index", Value: 1}}).SetProjection(bson.M{"params": 0})
+	cursor, err := db.MessageBatchRequestsCollection().Find(ctx, bson.M{"batchId": batchID}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var req BatchRequest
+		if err := cursor.Decode(&req); err != nil {
+			return err
+		}
+		if err := fn(&req); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *MongoStore) RequeueStale(ctx context.Context, olderThan time.Time) (int64, error) {
+	res, err := db.MessageBatchRequestsCollection().UpdateMany(ctx,
+		bson.M{"status": RequestProcessing, "claimedAt": bson.M{"$lt": olderThan}},
+		bson.M{"$set": bson.M{"status": RequestPending}, "$unset": bson.M{"claimedAt": ""}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (s *MongoStore) ReleaseRequest(ctx context.Context, req *BatchRequest) error {
+	_, err := db.MessageBatchRequestsCollection().UpdateOne(ctx,
+		bson.M{"_id": req.ID, "status": RequestProcessing},
+		bson.M{"$set": bson.M{"status": RequestPending}, "$unset": bson.M{"claimedAt": ""}},
+	)
+	return err
+}
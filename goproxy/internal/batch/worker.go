@@ -0,0 +1,197 @@
+package batch
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Executor runs one batch request through the normal /v1/messages pipeline (billed at
+// batch rates) and returns the response status and body
+type Executor func(ctx context.Context, b *MessageBatch, params []byte) (statusCode int, body []byte)
+
+const (
+	idlePollInterval  = 5 * time.Second
+	yieldInterval     = 1 * time.Second
+	staleClaimTimeout = 30 * time.Minute
+	storeTimeout      = 10 * time.Second
+)
+
+// Pool drains pending batch requests with a fixed number of workers.
+// Batches are low priority: workers pause whenever Yield reports interactive load.
+type Pool struct {
+	store   Store
+	execute Executor
+	workers int
+	yield   func() bool
+	wake    chan struct{}
+	stop    chan struct{}
+	ctx     context.Context // runs the work; cancelled once Stop stops waiting for it
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	now     func() time.Time
+}
+
+// NewPool creates a worker pool. yield may be nil.
+func NewPool(store Store, execute Executor, workers int, yield func() bool) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	if yield == nil {
+		yield = func() bool { return false }
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Pool{
+		store:   store,
+		execute: execute,
+		workers: workers,
+		yield:   yield,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+		now:     time.Now,
+	}
+}
+
+// Start launches the workers and the stale-claim recovery loop
+func (p *Pool) Start() {
+	log.Printf("📦 [Batch] Starting %d batch workers", p.workers)
+	go p.requeueLoop()
+	p.wg.Add(p.workers)
+	for i := 0; i < p.workers; i++ {
+		go p.worker()
+	}
+}
+
+// Stop stops the workers and waits for the work they are doing until ctx is done, then
+// cancels it and waits for the workers to return. A cancelled request that did not succeed
+// goes back to pending; other work cut off is claimed again once its claim is stale.
+func (p *Pool) Stop(ctx context.Context) {
+	close(p.stop)
+	defer p.cancel()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	log.Printf("⚠️ [Batch] Cancelling the batch requests still running")
+	p.cancel()
+	<-done
+}
+
+// Wake signals idle workers that new requests are pending
+func (p *Pool) Wake() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Pool) worker() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		if p.yield() {
+			select {
+			case <-time.After(yieldInterval):
+			case <-p.stop:
+			}
+			continue
+		}
+		if p.processNext(p.ctx) {
+			continue
+		}
+		select {
+		case <-p.wake:
+		case <-time.After(idlePollInterval):
+		case <-p.stop:
+		}
+	}
+}
+
+// processNext claims and runs one pending request; false when nothing is pending
+func (p *Pool) processNext(ctx context.Context) bool {
+	claimCtx, cancel := context.WithTimeout(ctx, storeTimeout)
+	req, err := p.store.ClaimNextRequest(claimCtx)
+	cancel()
+	if err != nil {
+		log.Printf("⚠️ [Batch] Failed to claim request: %v", err)
+		return false
+	}
+	if req == nil {
+		return false
+	}
+
+	resultType, result := p.run(ctx, req)
+
+	// The claim is ended even if ctx was cancelled by Stop
+	storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), storeTimeout)
+	defer cancel()
+	if ctx.Err() != nil && resultType != ResultSucceeded {
+		// Cut off by Stop: the next worker runs it again instead of storing the cancellation
+		if err := p.store.ReleaseRequest(storeCtx, req); err != nil {
+			log.Printf("⚠️ [Batch] Failed to release %s/%s, it is claimed again once stale: %v", req.BatchID, req.CustomID, err)
+		}
+		return true
+	}
+	if err := p.store.CompleteRequest(storeCtx, req, resultType, result); err != nil {
+		log.Printf("❌ [Batch] Failed to store result for %s/%s: %v", req.BatchID, req.CustomID, err)
+	}
+	return true
+}
+
+// run decides the outcome of a claimed request, calling the executor unless the
+// batch is canceling or past its expiration
+func (p *Pool) run(ctx context.Context, req *BatchRequest) (resultType string, result string) {
+	getCtx, cancel := context.WithTimeout(ctx, storeTimeout)
+	b, err := p.store.GetBatch(getCtx, req.BatchID)
+	cancel()
+	if err != nil {
+		log.Printf("⚠️ [Batch] Failed to load batch %s: %v", req.BatchID, err)
+		return BuildResult(500, nil)
+	}
+
+	switch {
+	case b.ProcessingStatus == StatusCanceling:
+		return ResultCanceled, SimpleResult(ResultCanceled)
+	case !p.now().Before(b.ExpiresAt):
+		return ResultExpired, SimpleResult(ResultExpired)
+	}
+
+	start := p.now()
+	statusCode, body := p.execute(ctx, b, []byte(req.Params))
+	resultType, result = BuildResult(statusCode, body)
+	log.Printf("📦 [Batch] %s/%s -> %s (status=%d, %v)", req.BatchID, req.CustomID, resultType, statusCode, time.Since(start))
+	return resultType, result
+}
+
+func (p *Pool) requeueLoop() {
+	ticker := time.NewTicker(staleClaimTimeout / 2)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		if n, err := p.store.RequeueStale(ctx, p.now().Add(-staleClaimTimeout)); err != nil {
+			log.Printf("⚠️ [Batch] Failed to requeue stale requests: %v", err)
+		} else if n > 0 {
+			log.Printf("🔄 [Batch] Requeued %d stale requests", n)
+			p.Wake()
+		}
+		cancel()
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package breaker
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Circuit breakers for upstreams and keys
+// Every upstream and every key has a breaker fed by the forwarders with the outcome and
+// latency of each upstream call. A breaker opens when its rolling error rate crosses
+// ErrorRate, rejects traffic for OpenTimeout, then lets HalfOpenProbes requests through:
+// their success closes it again, a failure reopens it. Slow calls count as failures.
+
+// State is a breaker's state
+type State string
+
+const (
+	Closed   State = "closed"
+	Open     State = "open"
+	HalfOpen State = "half_open"
+)
+
+// ErrOpen is returned when every upstream that could serve a request has an open circuit
+var ErrOpen = errors.New("circuit open")
+
+// Tunables, set from env at startup
+var (
+	Enabled        = true
+	Window         = 60 * time.Second // rolling window for the error rate
+	MinRequests    = 10               // calls in the window before the breaker may open
+	ErrorRate      = 0.5              // failure ratio that opens the breaker
+	SlowCall       = 60 * time.Second // time to response headers counted as a failure; 0 disables
+	OpenTimeout    = 30 * time.Second // how long an open breaker rejects traffic
+	HalfOpenProbes = 1                // concurrent trial calls while half-open
+)
+
+const buckets = 10
+
+type bucket struct {
+	epoch    int64 // window slot this bucket counts, see slot
+	calls    int64
+	failures int64
+	latency  time.Duration
+}
+
+// Breaker is the circuit of one upstream or key
+type Breaker struct {
+	name string
+
+	mu       sync.Mutex
+	state    State
+	buckets  [buckets]bucket
+	openedAt time.Time
+
+	// Half-open trial calls
+	probes      int       // in flight
+	probeSince  time.Time // when the oldest in-flight probe started
+	probeWins   int       // successful probes so far
+	transitions int64
+}
+
+// Status is a breaker's state as reported on /keys/status
+type Status struct {
+	Name         string     `json:"name"`
+	State        State      `json:"state"`
+	Calls        int64      `json:"calls"`    // in the rolling window
+	Failures     int64      `json:"failures"` // in the rolling window, slow calls included
+	ErrorRate    float64    `json:"error_rate"`
+	AvgLatencyMs float64    `json:"avg_latency_ms"`
+	OpenedAt     *time.Time `json:"opened_at,omitempty"`
+	Transitions  int64      `json:"transitions"` // state changes since startup
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*Breaker)
+)
+
+// Get returns the breaker for name, creating it closed
+func Get(name string) *Breaker {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	b, ok := registry[name]
+	if !ok {
+		b = &Breaker{name: name, state: Closed}
+		registry[name] = b
+	}
+	return b
+}
+
+// Upstream returns the breaker of an upstream instance (config.json "upstreams" name)
+func Upstream(name string) *Breaker {
+	return Get("upstream:" + name)
+}
+
+// Key returns the breaker of a key in an upstream's pool
+func Key(upstream, keyID string) *Breaker {
+	return Get("key:" + upstream + "/" + keyID)
+}
+
+// All returns the status of every breaker, ordered by name
+func All() []Status {
+	registryMu.Lock()
+	all := make([]*Breaker, 0, len(registry))
+	for _, b := range registry {
+		all = append(all, b)
+	}
+	registryMu.Unlock()
+
+	statuses := make([]Status, 0, len(all))
+	for _, b := range all {
+		statuses = append(statuses, b.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Reset drops every breaker
+func Reset() {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = make(map[string]*Breaker)
+}
+
+// IsFailure reports whether an upstream status counts against its breaker:
+// server errors, overload and rate limits. Other 4xx are the client's fault.
+func IsFailure(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusTooManyRequests
+}
+
+// Allow reports whether a call may go through. While half-open it reserves one of the
+// HalfOpenProbes trial slots, which the call's Record releases, or Release if the call is
+// not made; a probe that never reports frees its slot after OpenTimeout.
+func (b *Breaker) Allow() bool {
+	if !Enabled {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case Open:
+		if now.Sub(b.openedAt) < OpenTimeout {
+			return false
+		}
+		b.setState(HalfOpen)
+		b.probes, b.probeWins = 0, 0
+	case HalfOpen:
+		if b.probes > 0 && now.Sub(b.probeSince) >= OpenTimeout {
+			b.probes = 0
+		}
+	default:
+		return true
+	}
+
+	if b.probes >= HalfOpenProbes {
+		return false
+	}
+	if b.probes == 0 {
+		b.probeSince = now
+	}
+	b.probes++
+	return true
+}
+
+// Release frees the trial slot Allow reserved for a call that was not made, without counting
+// an outcome
+func (b *Breaker) Release() {
+	if !Enabled {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == HalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// Ready reports whether the breaker would let a call through, without reserving a probe
+func (b *Breaker) Ready() bool {
+	if !Enabled {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Open:
+		return time.Since(b.openedAt) >= OpenTimeout
+	case HalfOpen:
+		return b.probes < HalfOpenProbes || time.Since(b.probeSince) >= OpenTimeout
+	}
+	return true
+}
+
+// Record feeds the outcome of a call
+func (b *Breaker) Record(success bool, latency time.Duration) {
+	if !Enabled {
+		return
+	}
+	if SlowCall > 0 && latency >= SlowCall {
+		success = false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	slot := b.slot(now)
+	bk := &b.buckets[slot%buckets]
+	if bk.epoch != slot {
+		*bk = bucket{epoch: slot}
+	}
+	bk.calls++
+	bk.latency += latency
+	if !success {
+		bk.failures++
+	}
+
+	switch b.state {
+	case HalfOpen:
+		if b.probes > 0 {
+			b.probes--
+		}
+		if !success {
+			b.trip(now)
+			return
+		}
+		b.probeWins++
+		if b.probeWins >= HalfOpenProbes {
+			b.setState(Closed)
+			b.buckets = [buckets]bucket{}
+		}
+	case Closed:
+		calls, failures, _ := b.windowLocked(now)
+		if calls >= int64(MinRequests) && float64(failures)/float64(calls) >= ErrorRate {
+			b.trip(now)
+		}
+	}
+}
+
+// RecordResponse feeds the outcome of an upstream HTTP call
+func (b *Breaker) RecordResponse(statusCode int, err error, latency time.Duration) {
+	b.Record(err == nil && !IsFailure(statusCode), latency)
+}
+
+// State returns the breaker's current state
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Status returns the breaker's state and rolling window
+func (b *Breaker) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	calls, failures, latency := b.windowLocked(time.Now())
+	status := Status{
+		Name:        b.name,
+		State:       b.state,
+		Calls:       calls,
+		Failures:    failures,
+		Transitions: b.transitions,
+	}
+	if calls > 0 {
+		status.ErrorRate = float64(failures) / float64(calls)
+		status.AvgLatencyMs = float64(latency.Milliseconds()) / float64(calls)
+	}
+	if b.state != Closed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+func (b *Breaker) trip(now time.Time) {
+	b.setState(Open)
+	b.openedAt = now
+	b.probes, b.probeWins = 0, 0
+}
+
+func (b *Breaker) setState(state State) {
+	if b.state != state {
+		b.state = state
+		b.transitions++
+	}
+}
+
+// slot is the index of the Window/buckets wide time slot containing now
+func (b *Breaker) slot(now time.Time) int64 {
+	width := Window / buckets
+	if width <= 0 {
+		width = time.Second
+	}
+	return now.UnixNano() / int64(width)
+}
+
+// windowLocked sums the buckets still inside the rolling window
+func (b *Breaker) windowLocked(now time.Time) (calls, failures int64, latency time.Duration) {
+	current := b.slot(now)
+	for _, bk := range b.buckets {
+		if bk.epoch > current-buckets && bk.epoch <= current {
+			calls += bk.calls
+			failures += bk.failures
+			latency += bk.latency
+		}
+	}
+	return calls, failures, latency
+}
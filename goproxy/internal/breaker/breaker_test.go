@@ -0,0 +1,99 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+func withTunables(t *testing.T) {
+	t.Helper()
+	window, minRequests, errorRate, slowCall, openTimeout, probes := Window, MinRequests, ErrorRate, SlowCall, OpenTimeout, HalfOpenProbes
+	t.Cleanup(func() {
+		Window, MinRequests, ErrorRate, SlowCall, OpenTimeout, HalfOpenProbes = window, minRequests, errorRate, slowCall, openTimeout, probes
+		Reset()
+	})
+	Window, MinRequests, ErrorRate, SlowCall, OpenTimeout, HalfOpenProbes = time.Minute, 4, 0.5, time.Second, 20*time.Millisecond, 1
+}
+
+func TestBreaker_OpensAndRecovers(t *testing.T) {
+	withTunables(t)
+	b := Upstream("openhands")
+
+	b.Record(true, 10*time.Millisecond)
+	b.Record(false, 10*time.Millisecond)
+	b.Record(true, 10*time.Millisecond)
+	if b.State() != Closed {
+		t.Fatal("Expected the breaker to stay closed below MinRequests")
+	}
+	b.Record(false, 10*time.Millisecond)
+	if b.State() != Open || b.Allow() || b.Ready() {
+		t.Fatalf("Expected an open breaker at 50%% errors, got %s", b.State())
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if !b.Ready() || !b.Allow() {
+		t.Fatal("Expected a probe after OpenTimeout")
+	}
+	if b.State() != HalfOpen || b.Allow() {
+		t.Fatal("Expected a single probe while half-open")
+	}
+	b.Record(true, 10*time.Millisecond)
+	if b.State() != Closed || !b.Allow() {
+		t.Fatalf("Expected a successful probe to close the breaker, got %s", b.State())
+	}
+	if status := b.Status(); status.Calls != 0 || status.Transitions != 3 {
+		t.Errorf("Expected a fresh window after closing, got %+v", status)
+	}
+}
+
+func TestBreaker_FailedProbeReopens(t *testing.T) {
+	withTunables(t)
+	b := Key("ohmygpt", "key-1")
+
+	for i := 0; i < 4; i++ {
+		b.RecordResponse(529, nil, time.Millisecond)
+	}
+	time.Sleep(25 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("Expected a probe after OpenTimeout")
+	}
+	b.RecordResponse(0, nil, 2*time.Second) // slow call
+	if b.State() != Open || b.Allow() {
+		t.Fatalf("Expected a slow probe to reopen the breaker, got %s", b.State())
+	}
+}
+
+func TestBreaker_ReleasedProbeFreesItsSlot(t *testing.T) {
+	withTunables(t)
+	b := Upstream("openhands")
+
+	for i := 0; i < 4; i++ {
+		b.Record(false, time.Millisecond)
+	}
+	time.Sleep(25 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("Expected a probe after OpenTimeout")
+	}
+	b.Release() // e.g. the client left before the call
+	if b.State() != HalfOpen || !b.Allow() {
+		t.Fatalf("Expected the released slot to admit the next probe, got %s", b.State())
+	}
+	if status := b.Status(); status.Calls != 4 {
+		t.Errorf("Expected no outcome counted for the released probe, got %+v", status)
+	}
+}
+
+func TestBreaker_ClientErrorsDoNotCount(t *testing.T) {
+	withTunables(t)
+	b := Key("openhands", "key-2")
+
+	for i := 0; i < 10; i++ {
+		b.RecordResponse(400, nil, time.Millisecond)
+	}
+	if b.State() != Closed {
+		t.Fatalf("Expected client errors to leave the breaker closed, got %s", b.State())
+	}
+	if all := All(); len(all) != 1 || all[0].Name != "key:openhands/key-2" || all[0].Calls != 10 {
+		t.Errorf("Unexpected statuses: %+v", all)
+	}
+}
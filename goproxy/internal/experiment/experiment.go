@@ -0,0 +1,114 @@
+package experiment
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Per-arm metrics for upstream model experiments (config.Experiment)
+// Outcomes are recorded by the router when the model's own upstream finishes a request,
+// costs by the request log. Counters live in memory and reset on restart; request logs
+// carry the experiment and arm for longer analyses.
+
+// ArmStats summarizes one arm of an experiment
+type ArmStats struct {
+	Experiment   string  `json:"experiment"`
+	Arm          string  `json:"arm"` // upstream model ID
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"` // full response time, streams included
+	Billed       int64   `json:"billed"`         // requests with a request log
+	TotalCost    float64 `json:"total_cost"`
+	AvgCost      float64 `json:"avg_cost"` // per billed request
+}
+
+type armKey struct {
+	experiment string
+	arm        string
+}
+
+type counters struct {
+	requests  int64
+	errors    int64
+	latency   time.Duration
+	billed    int64
+	totalCost float64
+}
+
+var (
+	mu   sync.Mutex
+	arms = make(map[armKey]*counters)
+)
+
+func countersFor(experiment, arm string) *counters {
+	key := armKey{experiment: experiment, arm: arm}
+	c, ok := arms[key]
+	if !ok {
+		c = &counters{}
+		arms[key] = c
+	}
+	return c
+}
+
+// RecordOutcome records a request served by an arm
+func RecordOutcome(experiment, arm string, latency time.Duration, success bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	c := countersFor(experiment, arm)
+	c.requests++
+	c.latency += latency
+	if !success {
+		c.errors++
+	}
+}
+
+// RecordCost records the billed cost of a request served by an arm
+func RecordCost(experiment, arm string, cost float64) {
+	mu.Lock()
+	defer mu.Unlock()
+	c := countersFor(experiment, arm)
+	c.billed++
+	c.totalCost += cost
+}
+
+// Stats returns every arm's metrics, ordered by experiment and arm
+func Stats() []ArmStats {
+	mu.Lock()
+	defer mu.Unlock()
+
+	stats := make([]ArmStats, 0, len(arms))
+	for key, c := range arms {
+		s := ArmStats{
+			Experiment: key.experiment,
+			Arm:        key.arm,
+			Requests:   c.requests,
+			Errors:     c.errors,
+			Billed:     c.billed,
+			TotalCost:  c.totalCost,
+		}
+		if c.requests > 0 {
+			s.ErrorRate = float64(c.errors) / float64(c.requests)
+			s.AvgLatencyMs = float64(c.latency.Milliseconds()) / float64(c.requests)
+		}
+		if c.billed > 0 {
+			s.AvgCost = c.totalCost / float64(c.billed)
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Experiment != stats[j].Experiment {
+			return stats[i].Experiment < stats[j].Experiment
+		}
+		return stats[i].Arm < stats[j].Arm
+	})
+	return stats
+}
+
+// Reset clears all counters
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	arms = make(map[armKey]*counters)
+}
@@ -0,0 +1,31 @@
+package experiment
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	Reset()
+	defer Reset()
+
+	RecordOutcome("glm-4.6", "glm-4.6-fast", 100*time.Millisecond, true)
+	RecordOutcome("glm-4.6", "glm-4.6-fast", 300*time.Millisecond, false)
+	RecordCost("glm-4.6", "glm-4.6-fast", 0.02)
+	RecordOutcome("glm-4.6", "glm-4.6", 50*time.Millisecond, true)
+
+	stats := Stats()
+	if len(stats) != 2 || stats[0].Arm != "glm-4.6" || stats[1].Arm != "glm-4.6-fast" {
+		t.Fatalf("Unexpected arms: %+v", stats)
+	}
+	fast := stats[1]
+	if fast.Requests != 2 || fast.Errors != 1 || fast.ErrorRate != 0.5 || fast.AvgLatencyMs != 200 {
+		t.Errorf("Unexpected outcome stats: %+v", fast)
+	}
+	if fast.Billed != 1 || fast.AvgCost != 0.02 {
+		t.Errorf("Unexpected cost stats: %+v", fast)
+	}
+	if stats[0].AvgCost != 0 || stats[0].ErrorRate != 0 {
+		t.Errorf("Expected no cost or errors for the unbilled arm: %+v", stats[0])
+	}
+}
@@ -0,0 +1,190 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"goproxy/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// File purposes (OpenAI Files API). Clients upload batch input; batch_output is written by the batch worker.
+const (
+	PurposeBatch       = "batch"
+	PurposeBatchOutput = "batch_output"
+)
+
+// bucketName is the GridFS bucket (files.files / files.chunks collections)
+const bucketName = "files"
+
+var ErrNotFound = errors.New("file not found")
+
+// File is a stored file. Owner and purpose live in the GridFS metadata document.
+type File struct {
+	ID         string    `bson:"_id"`
+	Bytes      int64     `bson:"length"`
+	UploadDate time.Time `bson:"uploadDate"`
+	Filename   string    `bson:"filename"`
+	Metadata   struct {
+		UserKeyID string `bson:"userKeyId"`
+		Purpose   string `bson:"purpose"`
+	} `bson:"metadata"`
+}
+
+// View returns the API representation of the file
+func (f *File) View() map[string]interface{} {
+	return map[string]interface{}{
+		"id":         f.ID,
+		"object":     "file",
+		"bytes":      f.Bytes,
+		"created_at": f.UploadDate.Unix(),
+		"filename":   f.Filename,
+		"purpose":    f.Metadata.Purpose,
+		"status":     "processed",
+	}
+}
+
+// NewID returns a time-ordered file ID
+func NewID(now time.Time) string {
+	return "file-" + primitive.NewObjectIDFromTimestamp(now).Hex()
+}
+
+func bucket() (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(db.GetDatabase(), options.GridFSBucket().SetName(bucketName))
+}
+
+// Writer streams a new file into GridFS
+type Writer struct {
+	id     string
+	stream *gridfs.UploadStream
+}
+
+// Create opens a new file for writing. Call Close to store it or Abort to discard it.
+func Create(userKeyID, filename, purpose string) (*Writer, error) {
+	b, err := bucket()
+	if err != nil {
+		return nil, err
+	}
+	id := NewID(time.Now())
+	opts := options.GridFSUpload().SetMetadata(bson.M{"userKeyId": userKeyID, "purpose": purpose})
+	stream, err := b.OpenUploadStreamWithID(id, filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{id: id, stream: stream}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.stream.Write(p)
+}
+
+// Close finishes the upload and returns the stored file
+func (w *Writer) Close(ctx context.Context) (*File, error) {
+	if err := w.stream.Close(); err != nil {
+		return nil, err
+	}
+	return Get(ctx, w.id)
+}
+
+// Abort discards everything written so far
+func (w *Writer) Abort() error {
+	return w.stream.Abort()
+}
+
+// Upload stores the content of r as a new file
+func Upload(ctx context.Context, userKeyID, filename, purpose string, r io.Reader) (*File, error) {
+	w, err := Create(userKeyID, filename, purpose)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w.Close(ctx)
+}
+
+// Get returns the file metadata
+func Get(ctx context.Context, id string) (*File, error) {
+	b, err := bucket()
+	if err != nil {
+		return nil, err
+	}
+	var f File
+	if err := b.GetFilesCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&f); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &f, nil
+}
+
+// List returns the key's files newest first, paging to older files with afterID
+func List(ctx context.Context, userKeyID, purpose string, limit int, afterID string) ([]*File, bool, error) {
+	b, err := bucket()
+	if err != nil {
+		return nil, false, err
+	}
+	filter := bson.M{"metadata.userKeyId": userKeyID}
+	if purpose != "" {
+		filter["metadata.purpose"] = purpose
+	}
+	if afterID != "" {
+		filter["_id"] = bson.M{"$lt": afterID}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(limit + 1))
+	cursor, err := b.GetFilesCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	var list []*File
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(list) > limit
+	if hasMore {
+		list = list[:limit]
+	}
+	return list, hasMore, nil
+}
+
+// Open returns a reader for the file content
+func Open(id string) (io.ReadCloser, error) {
+	b, err := bucket()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := b.OpenDownloadStream(id)
+	if err == gridfs.ErrFileNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Delete removes the file and its chunks
+func Delete(ctx context.Context, id string) error {
+	b, err := bucket()
+	if err != nil {
+		return err
+	}
+	if err := b.DeleteContext(ctx, id); err != nil {
+		if err == gridfs.ErrFileNotFound {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
@@ -11,12 +12,16 @@ import (
 
 	"go.mongodb.org/mongo-driver/bson"
 	"goproxy/db"
+	"goproxy/internal/keyquota"
 )
 
 var (
 	ErrNoHealthyKeys = errors.New("no healthy troll keys available")
 )
 
+// quotas tracks upstream rate limits per troll key, shared by the legacy and optimized pools
+var quotas = keyquota.NewTracker()
+
 // UseOptimizedKeyPool controls whether to use the lock-free optimized pool
 // Can be disabled via env: GOPROXY_DISABLE_OPTIMIZATIONS=true
 var UseOptimizedKeyPool = true
@@ -33,9 +38,10 @@ func isKeyPoolEnvDisabled(key string) bool {
 }
 
 type KeyPool struct {
-	mu      sync.Mutex
-	keys    []*TrollKey
-	current int
+	mu         sync.Mutex
+	keys       []*TrollKey
+	current    int
+	stopReload chan struct{} // closed by StopAutoReload
 }
 
 var (
@@ -68,6 +74,7 @@ func GetOptimizedOrLegacyKeyPool() interface {
 	MarkExhausted(string)
 	MarkError(string, string)
 	CheckAndRotateOnError(string, int, string)
+	ObserveRateLimits(string, int, http.Header)
 } {
 	if UseOptimizedKeyPool {
 		return GetOptimizedKeyPool()
@@ -169,8 +176,14 @@ func (p *KeyPool) MarkHealthy(keyID string) {
 	p.MarkStatus(keyID, StatusHealthy, 0, "")
 }
 
+// MarkRateLimited cools a key down until the upstream's reported reset (see keyquota.Tracker)
 func (p *KeyPool) MarkRateLimited(keyID string) {
-	p.MarkStatus(keyID, StatusRateLimited, 60*time.Second, "Rate limited by upstream")
+	p.MarkStatus(keyID, StatusRateLimited, quotas.Cooldown(keyID, 60*time.Second), "Rate limited by upstream")
+}
+
+// ObserveRateLimits records the rate-limit headers of an upstream response made with keyID
+func (p *KeyPool) ObserveRateLimits(keyID string, statusCode int, header http.Header) {
+	quotas.Observe(keyID, statusCode, header)
 }
 
 func (p *KeyPool) MarkExhausted(keyID string) {
@@ -265,17 +278,37 @@ func (p *KeyPool) Reload() error {
 
 // StartAutoReload starts a background goroutine that periodically reloads keys from database
 func (p *KeyPool) StartAutoReload(interval time.Duration) {
+	p.mu.Lock()
+	stop := make(chan struct{})
+	p.stopReload = stop
+	p.mu.Unlock()
+
 	go func() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
 		// Auto-reload started log disabled to reduce noise
 
-		for range ticker.C {
-			if err := p.LoadKeys(); err != nil {
-				log.Printf("⚠️ Key pool auto-reload failed: %v", err)
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.LoadKeys(); err != nil {
+					log.Printf("⚠️ Key pool auto-reload failed: %v", err)
+				}
+				// Auto-reload success log disabled to reduce noise
+			case <-stop:
+				return
 			}
-			// Auto-reload success log disabled to reduce noise
 		}
 	}()
 }
+
+// StopAutoReload stops the auto-reload goroutine, if running
+func (p *KeyPool) StopAutoReload() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopReload != nil {
+		close(p.stopReload)
+		p.stopReload = nil
+	}
+}
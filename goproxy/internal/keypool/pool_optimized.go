@@ -3,6 +3,7 @@ package keypool
 import (
 	"context"
 	"log"
+	"net/http"
 	"sync/atomic"
 	"time"
 
@@ -130,9 +131,14 @@ func (p *OptimizedKeyPool) MarkHealthy(keyID string) {
 	p.MarkStatus(keyID, StatusHealthy, 0, "")
 }
 
-// MarkRateLimited marks a key as rate limited
+// MarkRateLimited cools a key down until the upstream's reported reset (see keyquota.Tracker)
 func (p *OptimizedKeyPool) MarkRateLimited(keyID string) {
-	p.MarkStatus(keyID, StatusRateLimited, 60*time.Second, "Rate limited by upstream")
+	p.MarkStatus(keyID, StatusRateLimited, quotas.Cooldown(keyID, 60*time.Second), "Rate limited by upstream")
+}
+
+// ObserveRateLimits records the rate-limit headers of an upstream response made with keyID
+func (p *OptimizedKeyPool) ObserveRateLimits(keyID string, statusCode int, header http.Header) {
+	quotas.Observe(keyID, statusCode, header)
 }
 
 // MarkExhausted marks a key as exhausted
@@ -0,0 +1,281 @@
+package keyquota
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Live rate-limit quotas per upstream key
+// Upstreams report what is left of a key's quota on every response: Anthropic with
+// anthropic-ratelimit-{requests,tokens}-{limit,remaining,reset}, OpenAI and LiteLLM with
+// x-ratelimit-{limit,remaining,reset}-{requests,tokens}, and rate limit errors with
+// retry-after. Pools feed those headers to a Tracker, prefer keys that are not about to
+// run dry, and cool rate-limited keys down until the upstream's reset time.
+
+var (
+	// LowWatermark is the share of a limit left at which a key is deprioritized
+	LowWatermark = 0.05
+
+	// MaxCooldown caps rate-limit cooldowns, including backoff
+	MaxCooldown = 30 * time.Minute
+
+	// StrikeTTL is how long a rate limit counts towards the backoff of the next one
+	StrikeTTL = 10 * time.Minute
+)
+
+// Window is one rate-limit dimension (requests or tokens). Unknown values are -1.
+type Window struct {
+	Limit     int64     `json:"limit"`
+	Remaining int64     `json:"remaining"`
+	Reset     time.Time `json:"reset,omitempty"`
+}
+
+func unknownWindow() Window {
+	return Window{Limit: -1, Remaining: -1}
+}
+
+func (w Window) known() bool {
+	return w.Remaining >= 0
+}
+
+// low reports whether the window is at or below LowWatermark and not yet reset
+func (w Window) low(now time.Time) bool {
+	if !w.known() || (!w.Reset.IsZero() && !now.Before(w.Reset)) {
+		return false
+	}
+	var threshold int64
+	if w.Limit > 0 {
+		threshold = int64(float64(w.Limit) * LowWatermark)
+	}
+	return w.Remaining <= threshold
+}
+
+// Quota is what an upstream last reported about a key
+type Quota struct {
+	Requests   Window    `json:"requests"`
+	Tokens     Window    `json:"tokens"`
+	RetryAfter time.Time `json:"retry_after,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// ParseHeaders reads rate-limit headers. ok is false when the response carries none.
+func ParseHeaders(h http.Header, now time.Time) (q Quota, ok bool) {
+	q = Quota{Requests: unknownWindow(), Tokens: unknownWindow(), UpdatedAt: now}
+
+	if retryAt, found := parseRetryAfter(h, now); found {
+		q.RetryAfter = retryAt
+		ok = true
+	}
+
+	// Anthropic reports input/output token limits separately on some models
+	for _, dim := range []struct {
+		window *Window
+		names  []string
+	}{
+		{&q.Requests, []string{"requests"}},
+		{&q.Tokens, []string{"tokens", "input-tokens"}},
+	} {
+		for _, name := range dim.names {
+			w := parseWindow(h, now,
+				"anthropic-ratelimit-"+name+"-limit", "anthropic-ratelimit-"+name+"-remaining", "anthropic-ratelimit-"+name+"-reset")
+			if !w.known() {
+				w = parseWindow(h, now,
+					"x-ratelimit-limit-"+name, "x-ratelimit-remaining-"+name, "x-ratelimit-reset-"+name)
+			}
+			if w.known() {
+				*dim.window = w
+				ok = true
+				break
+			}
+		}
+	}
+	return q, ok
+}
+
+func parseWindow(h http.Header, now time.Time, limitHeader, remainingHeader, resetHeader string) Window {
+	w := unknownWindow()
+	if v, err := strconv.ParseInt(strings.TrimSpace(h.Get(remainingHeader)), 10, 64); err == nil {
+		w.Remaining = v
+	}
+	if v, err := strconv.ParseInt(strings.TrimSpace(h.Get(limitHeader)), 10, 64); err == nil {
+		w.Limit = v
+	}
+	w.Reset = parseReset(h.Get(resetHeader), now)
+	return w
+}
+
+// parseReset accepts an RFC 3339 time (Anthropic), a Go-style duration such as "6m0s" or
+// "20ms" (OpenAI), seconds, or a Unix timestamp
+func parseReset(v string, now time.Time) time.Time {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(d)
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		if secs > 1e9 {
+			return time.Unix(int64(secs), 0)
+		}
+		return now.Add(time.Duration(secs * float64(time.Second)))
+	}
+	return time.Time{}
+}
+
+// parseRetryAfter reads retry-after-ms, or retry-after in seconds or as an HTTP date
+func parseRetryAfter(h http.Header, now time.Time) (time.Time, bool) {
+	if ms, err := strconv.ParseFloat(strings.TrimSpace(h.Get("retry-after-ms")), 64); err == nil && ms >= 0 {
+		return now.Add(time.Duration(ms * float64(time.Millisecond))), true
+	}
+	v := strings.TrimSpace(h.Get("retry-after"))
+	if v == "" {
+		return time.Time{}, false
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil && secs >= 0 {
+		return now.Add(time.Duration(secs * float64(time.Second))), true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// resetAfterLimit is when a rate-limited key may be used again according to the upstream:
+// retry-after, else the latest reset of an exhausted window. Zero if unknown.
+func (q Quota) resetAfterLimit(now time.Time) time.Time {
+	if q.RetryAfter.After(now) {
+		return q.RetryAfter
+	}
+	var until time.Time
+	for _, w := range []Window{q.Requests, q.Tokens} {
+		if w.Remaining == 0 && w.Reset.After(until) {
+			until = w.Reset
+		}
+	}
+	if until.After(now) {
+		return until
+	}
+	return time.Time{}
+}
+
+type keyState struct {
+	quota      Quota
+	hasQuota   bool
+	strikes    int // consecutive rate limits
+	lastStrike time.Time
+}
+
+// Tracker holds the live quota of every key in a pool. A nil Tracker tracks nothing.
+type Tracker struct {
+	mu   sync.Mutex
+	keys map[string]*keyState
+}
+
+// NewTracker creates an empty tracker
+func NewTracker() *Tracker {
+	return &Tracker{keys: make(map[string]*keyState)}
+}
+
+func (t *Tracker) stateLocked(keyID string) *keyState {
+	st, ok := t.keys[keyID]
+	if !ok {
+		st = &keyState{}
+		t.keys[keyID] = st
+	}
+	return st
+}
+
+// Observe records the rate-limit headers of an upstream response for keyID.
+// A successful response ends the key's run of rate limits.
+func (t *Tracker) Observe(keyID string, statusCode int, h http.Header) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	q, ok := ParseHeaders(h, now)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.stateLocked(keyID)
+	if ok {
+		st.quota = q
+		st.hasQuota = true
+	}
+	if statusCode > 0 && statusCode < 400 {
+		st.strikes = 0
+	}
+}
+
+// Cooldown returns how long a key that was just rate limited should rest: until the reset
+// the upstream reported, or base if it reported none. Each further rate limit within
+// StrikeTTL doubles the wait, up to MaxCooldown.
+func (t *Tracker) Cooldown(keyID string, base time.Duration) time.Duration {
+	if t == nil {
+		return base
+	}
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.stateLocked(keyID)
+	if now.Sub(st.lastStrike) > StrikeTTL {
+		st.strikes = 0
+	}
+	st.strikes++
+	st.lastStrike = now
+
+	wait := base
+	if st.hasQuota {
+		if until := st.quota.resetAfterLimit(now); !until.IsZero() {
+			wait = until.Sub(now)
+		}
+	}
+	for i := 1; i < st.strikes && wait < MaxCooldown; i++ {
+		wait *= 2
+	}
+	if wait > MaxCooldown {
+		wait = MaxCooldown
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// Low reports whether a key is close to running out of requests or tokens before its
+// window resets, so pools should prefer other keys
+func (t *Tracker) Low(keyID string) bool {
+	if t == nil {
+		return false
+	}
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.keys[keyID]
+	if !ok || !st.hasQuota {
+		return false
+	}
+	return st.quota.Requests.low(now) || st.quota.Tokens.low(now)
+}
+
+// Quota returns the last quota reported for keyID
+func (t *Tracker) Quota(keyID string) (Quota, bool) {
+	if t == nil {
+		return Quota{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.keys[keyID]
+	if !ok || !st.hasQuota {
+		return Quota{}, false
+	}
+	return st.quota, true
+}
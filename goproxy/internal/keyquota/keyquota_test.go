@@ -0,0 +1,122 @@
+package keyquota
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseHeaders_Anthropic(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := http.Header{}
+	h.Set("anthropic-ratelimit-requests-limit", "50")
+	h.Set("anthropic-ratelimit-requests-remaining", "49")
+	h.Set("anthropic-ratelimit-requests-reset", "2026-01-02T03:05:00Z")
+	h.Set("anthropic-ratelimit-input-tokens-limit", "30000")
+	h.Set("anthropic-ratelimit-input-tokens-remaining", "1000")
+	h.Set("anthropic-ratelimit-input-tokens-reset", "2026-01-02T03:04:30Z")
+
+	q, ok := ParseHeaders(h, now)
+	if !ok {
+		t.Fatal("Expected Anthropic headers to be parsed")
+	}
+	if q.Requests.Limit != 50 || q.Requests.Remaining != 49 || !q.Requests.Reset.Equal(now.Add(55*time.Second)) {
+		t.Errorf("Unexpected requests window: %+v", q.Requests)
+	}
+	if q.Tokens.Limit != 30000 || q.Tokens.Remaining != 1000 || !q.Tokens.Reset.Equal(now.Add(25*time.Second)) {
+		t.Errorf("Expected input tokens as the tokens window, got %+v", q.Tokens)
+	}
+	if !q.RetryAfter.IsZero() {
+		t.Errorf("Expected no retry-after, got %v", q.RetryAfter)
+	}
+}
+
+func TestParseHeaders_OpenAI(t *testing.T) {
+	now := time.Now()
+	h := http.Header{}
+	h.Set("x-ratelimit-limit-requests", "500")
+	h.Set("x-ratelimit-remaining-requests", "0")
+	h.Set("x-ratelimit-reset-requests", "6m0s")
+	h.Set("x-ratelimit-remaining-tokens", "12000")
+	h.Set("x-ratelimit-reset-tokens", "20ms")
+	h.Set("retry-after", "7")
+
+	q, ok := ParseHeaders(h, now)
+	if !ok {
+		t.Fatal("Expected OpenAI headers to be parsed")
+	}
+	if q.Requests.Remaining != 0 || !q.Requests.Reset.Equal(now.Add(6*time.Minute)) {
+		t.Errorf("Unexpected requests window: %+v", q.Requests)
+	}
+	if q.Tokens.Limit != -1 || q.Tokens.Remaining != 12000 || !q.Tokens.Reset.Equal(now.Add(20*time.Millisecond)) {
+		t.Errorf("Unexpected tokens window: %+v", q.Tokens)
+	}
+	if !q.RetryAfter.Equal(now.Add(7 * time.Second)) {
+		t.Errorf("Expected retry-after in 7s, got %v", q.RetryAfter)
+	}
+
+	if _, ok := ParseHeaders(http.Header{"Content-Type": {"application/json"}}, now); ok {
+		t.Error("Expected no quota without rate-limit headers")
+	}
+}
+
+func TestTracker_Cooldown(t *testing.T) {
+	tracker := NewTracker()
+
+	// Retry-after wins over the default cooldown
+	h := http.Header{}
+	h.Set("retry-after", "10")
+	tracker.Observe("key-1", http.StatusTooManyRequests, h)
+	if got := tracker.Cooldown("key-1", time.Minute); got < 9*time.Second || got > 10*time.Second {
+		t.Errorf("Expected the upstream's 10s, got %v", got)
+	}
+	// Repeated rate limits back off exponentially
+	if got := tracker.Cooldown("key-1", time.Minute); got < 19*time.Second || got > 20*time.Second {
+		t.Errorf("Expected 2x backoff, got %v", got)
+	}
+
+	// A success ends the run; without headers the default cooldown applies
+	tracker.Observe("key-1", http.StatusOK, http.Header{})
+	tracker.Observe("key-2", http.StatusTooManyRequests, http.Header{})
+	if got := tracker.Cooldown("key-2", time.Minute); got != time.Minute {
+		t.Errorf("Expected the default cooldown, got %v", got)
+	}
+
+	// An exhausted window cools the key down until its reset
+	h = http.Header{}
+	h.Set("x-ratelimit-remaining-tokens", "0")
+	h.Set("x-ratelimit-reset-tokens", "30s")
+	tracker.Observe("key-3", http.StatusTooManyRequests, h)
+	if got := tracker.Cooldown("key-3", time.Minute); got < 29*time.Second || got > 30*time.Second {
+		t.Errorf("Expected the window reset, got %v", got)
+	}
+
+	defer func(max time.Duration) { MaxCooldown = max }(MaxCooldown)
+	MaxCooldown = 90 * time.Second
+	tracker.Cooldown("key-2", time.Minute)
+	if got := tracker.Cooldown("key-2", time.Minute); got != MaxCooldown {
+		t.Errorf("Expected the cap, got %v", got)
+	}
+}
+
+func TestTracker_Low(t *testing.T) {
+	tracker := NewTracker()
+
+	h := http.Header{}
+	h.Set("anthropic-ratelimit-requests-limit", "100")
+	h.Set("anthropic-ratelimit-requests-remaining", "4")
+	h.Set("anthropic-ratelimit-requests-reset", time.Now().Add(time.Minute).Format(time.RFC3339))
+	tracker.Observe("low", http.StatusOK, h)
+
+	h.Set("anthropic-ratelimit-requests-remaining", "40")
+	tracker.Observe("healthy", http.StatusOK, h)
+
+	h.Set("anthropic-ratelimit-requests-remaining", "0")
+	h.Set("anthropic-ratelimit-requests-reset", time.Now().Add(-time.Second).Format(time.RFC3339))
+	tracker.Observe("reset", http.StatusOK, h)
+
+	if !tracker.Low("low") || tracker.Low("healthy") || tracker.Low("reset") || tracker.Low("unknown") {
+		t.Errorf("Unexpected low keys: low=%v healthy=%v reset=%v unknown=%v",
+			tracker.Low("low"), tracker.Low("healthy"), tracker.Low("reset"), tracker.Low("unknown"))
+	}
+}
@@ -0,0 +1,202 @@
+package ledger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goproxy/db"
+)
+
+// Append-only credit ledger (credit_ledger)
+// Every change to a balance in usersNew is recorded as an immutable entry before the balance
+// is written. An entry's _id is its idempotency key, derived from the request that caused it,
+// so a change is applied at most once. A write that fails after its entry was recorded is
+// undone with a reversal entry; entries are never updated or deleted. The proxy records
+// deductions and friend key usage. Top-ups, referral transfers, admin adjustments and
+// expiries are made by the dashboard backend, which records them the same way
+// (backend/src/services/ledger.service.ts).
+
+// Kind is what caused a balance change
+type Kind string
+
+const (
+	KindDeduction        Kind = "deduction"         // cost of a request
+	KindTopUp            Kind = "top_up"            // credits purchased
+	KindRefund           Kind = "refund"            // credits returned to the user
+	KindReferralTransfer Kind = "referral_transfer" // refCredits granted for a referral
+	KindFriendKeyUsage   Kind = "friend_key_usage"  // spend counted against a friend key's limits
+	KindReversal         Kind = "reversal"          // undoes an entry whose balance write failed
+	KindAdjustment       Kind = "adjustment"        // manual correction after a dispute or drift
+	KindOpening          Kind = "opening_balance"   // balance when the user's ledger was started
+	KindExpiry           Kind = "expiry"            // credits lost when they expired
+)
+
+// Entry is one balance change. Amounts are signed: debits are negative.
+type Entry struct {
+	ID         string    `bson:"_id"`
+	Kind       Kind      `bson:"kind"`
+	Username   string    `bson:"username,omitempty"`
+	RequestID  string    `bson:"requestId,omitempty"`
+	Charged    float64   `bson:"charged,omitempty"` // request cost; more than the debits if the balance ran out
+	Credits    float64   `bson:"credits,omitempty"`
+	RefCredits float64   `bson:"refCredits,omitempty"`
+	CreditsNew float64   `bson:"creditsNew,omitempty"`
+	FriendKey  string    `bson:"friendKey,omitempty"` // masked
+	Reverses   string    `bson:"reverses,omitempty"`  // ID of the entry a reversal undoes
+	Note       string    `bson:"note,omitempty"`
+	CreatedAt  time.Time `bson:"createdAt"`
+}
+
+// ErrDuplicate is returned when an entry with the same key was already recorded,
+// i.e. the change it describes was already applied
+var ErrDuplicate = errors.New("ledger entry already recorded")
+
+// Key is the idempotency key of the kind of change a request causes. Requests without an ID
+// get a random key: they are recorded but cannot be deduplicated.
+func Key(kind Kind, requestID string) string {
+	if requestID == "" {
+		requestID = "anon-" + randomID()
+	}
+	return string(kind) + ":" + requestID
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Debit builds the deduction entry of a request
+func Debit(username, requestID string, charged, credits, refCredits, creditsNew float64) Entry {
+	return Entry{
+		ID:         Key(KindDeduction, requestID),
+		Kind:       KindDeduction,
+		Username:   username,
+		RequestID:  requestID,
+		Charged:    charged,
+		Credits:    -credits,
+		RefCredits: -refCredits,
+		CreditsNew: -creditsNew,
+	}
+}
+
+// Reversal builds the entry undoing e
+func Reversal(e Entry, note string) Entry {
+	return Entry{
+		ID:         Key(KindReversal, e.ID),
+		Kind:       KindReversal,
+		Username:   e.Username,
+		RequestID:  e.RequestID,
+		Credits:    -e.Credits,
+		RefCredits: -e.RefCredits,
+		CreditsNew: -e.CreditsNew,
+		Reverses:   e.ID,
+		Note:       note,
+	}
+}
+
+// Changes reports whether the entry moves any balance
+func (e Entry) Changes() bool {
+	return e.Credits != 0 || e.RefCredits != 0 || e.CreditsNew != 0
+}
+
+// Append records e, or returns ErrDuplicate if its key was recorded before
+func Append(ctx context.Context, e Entry) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	_, err := db.CreditLedgerCollection().InsertOne(ctx, e)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// AppendMany records entries in one round trip. duplicate[i] is true for entries whose key
+// was recorded before; on any other error nothing can be assumed to be recorded.
+func AppendMany(ctx context.Context, entries []Entry) (duplicate []bool, err error) {
+	duplicate = make([]bool, len(entries))
+	if len(entries) == 0 {
+		return duplicate, nil
+	}
+	now := time.Now()
+	docs := make([]interface{}, len(entries))
+	for i, e := range entries {
+		if e.CreatedAt.IsZero() {
+			e.CreatedAt = now
+		}
+		docs[i] = e
+	}
+
+	_, err = db.CreditLedgerCollection().InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		for _, we := range bulkErr.WriteErrors {
+			if we.Code != 11000 {
+				return duplicate, err
+			}
+			duplicate[we.Index] = true
+		}
+		return duplicate, nil
+	}
+	return duplicate, err
+}
+
+// Get returns the recorded entries with the given keys
+func Get(ctx context.Context, ids []string) (map[string]Entry, error) {
+	cursor, err := db.CreditLedgerCollection().Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	entries := make(map[string]Entry, len(ids))
+	for cursor.Next(ctx) {
+		var e Entry
+		if err := cursor.Decode(&e); err != nil {
+			return nil, err
+		}
+		entries[e.ID] = e
+	}
+	return entries, cursor.Err()
+}
+
+// Reverse records reversals of entries whose balance write failed. Failures are logged:
+// the reconciler reports what is left.
+func Reverse(entries []Entry, cause error) {
+	if len(entries) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reversals := make([]Entry, len(entries))
+	for i, e := range entries {
+		reversals[i] = Reversal(e, fmt.Sprintf("balance write failed: %v", cause))
+	}
+	if _, err := AppendMany(ctx, reversals); err != nil {
+		log.Printf("❌ [Ledger] Failed to reverse %d entries: %v", len(entries), err)
+	}
+}
+
+// EnsureIndexes creates the indexes reconciliation and disputes look entries up by
+func EnsureIndexes() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := db.CreditLedgerCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}, {Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "requestId", Value: 1}}},
+		{Keys: bson.D{{Key: "createdAt", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("⚠️ [Ledger] Failed to create indexes: %v", err)
+	}
+}
@@ -0,0 +1,422 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goproxy/db"
+)
+
+// Reconciliation
+// The reconciler checks the ledger against usersNew and request_logs:
+//   - each user's balances must equal the sum of their entries (opening balance included)
+//   - each billed request log must have a deduction entry charging the same cost, and each
+//     deduction a request log
+// Findings are written to credit_ledger_drift and logged. Balance drift is only reported
+// once it survives two runs, since a change may be between its entry and its write, and is
+// reported once for as long as it stays the same. Every instance may run a reconciler; they
+// take turns holding a lease in credit_ledger_state, and only its holder runs.
+
+var (
+	// Tolerance is the difference in USD below which amounts are considered equal
+	Tolerance = 0.000001
+
+	// SettleLag keeps the newest entries and request logs out of the request check,
+	// since both are written asynchronously
+	SettleLag = 5 * time.Minute
+)
+
+// Drift kinds
+const (
+	DriftBalance      = "balance"       // stored balance differs from the ledger
+	DriftMissingEntry = "missing_entry" // billed request without a deduction entry
+	DriftMissingLog   = "missing_log"   // deduction entry without a request log
+	DriftCost         = "cost_mismatch" // entry charged a different cost than the request log
+)
+
+// Balances are a user's three balance fields
+type Balances struct {
+	Credits    float64 `bson:"credits"`
+	RefCredits float64 `bson:"refCredits"`
+	CreditsNew float64 `bson:"creditsNew"`
+}
+
+func (b Balances) sub(o Balances) Balances {
+	return Balances{Credits: b.Credits - o.Credits, RefCredits: b.RefCredits - o.RefCredits, CreditsNew: b.CreditsNew - o.CreditsNew}
+}
+
+func (b Balances) zero() bool {
+	return math.Abs(b.Credits) <= Tolerance && math.Abs(b.RefCredits) <= Tolerance && math.Abs(b.CreditsNew) <= Tolerance
+}
+
+// Drift is one reconciliation finding
+type Drift struct {
+	Kind       string    `bson:"kind" json:"kind"`
+	Username   string    `bson:"username,omitempty" json:"username,omitempty"`
+	RequestID  string    `bson:"requestId,omitempty" json:"request_id,omitempty"`
+	Ledger     *Balances `bson:"ledger,omitempty" json:"ledger,omitempty"`
+	Stored     *Balances `bson:"stored,omitempty" json:"stored,omitempty"`
+	Charged    float64   `bson:"charged,omitempty" json:"charged,omitempty"`        // deduction entry
+	LoggedCost float64   `bson:"loggedCost,omitempty" json:"logged_cost,omitempty"` // request log
+	DetectedAt time.Time `bson:"detectedAt" json:"detected_at"`
+}
+
+// compareBalances returns the users whose stored balances differ from their ledger sums
+func compareBalances(ledger, stored map[string]Balances) []Drift {
+	var drifts []Drift
+	for username, sum := range ledger {
+		actual := stored[username]
+		if actual.sub(sum).zero() {
+			continue
+		}
+		sum, actual := sum, actual
+		drifts = append(drifts, Drift{Kind: DriftBalance, Username: username, Ledger: &sum, Stored: &actual})
+	}
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].Username < drifts[j].Username })
+	return drifts
+}
+
+// billed is what a request was charged, by the ledger or its request log
+type billed struct {
+	Username string
+	Cost     float64
+}
+
+// compareRequests matches deduction entries with request logs by request ID
+func compareRequests(entries, logs map[string]billed) []Drift {
+	var drifts []Drift
+	for requestID, e := range entries {
+		l, ok := logs[requestID]
+		switch {
+		case !ok:
+			drifts = append(drifts, Drift{Kind: DriftMissingLog, Username: e.Username, RequestID: requestID, Charged: e.Cost})
+		case math.Abs(e.Cost-l.Cost) > Tolerance:
+			drifts = append(drifts, Drift{Kind: DriftCost, Username: e.Username, RequestID: requestID, Charged: e.Cost, LoggedCost: l.Cost})
+		}
+	}
+	for requestID, l := range logs {
+		if _, ok := entries[requestID]; !ok {
+			drifts = append(drifts, Drift{Kind: DriftMissingEntry, Username: l.Username, RequestID: requestID, LoggedCost: l.Cost})
+		}
+	}
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].RequestID < drifts[j].RequestID })
+	return drifts
+}
+
+// leaseID is the credit_ledger_state document naming the instance that reconciles
+const leaseID = "reconciler"
+
+// suspect is a balance difference seen on the last run
+type suspect struct {
+	diff     Balances
+	reported bool
+}
+
+// Reconciler runs reconciliation periodically
+type Reconciler struct {
+	interval time.Duration
+	owner    string // this instance in the lease
+	leading  bool   // held the lease on the last tick
+	stopChan chan struct{}
+
+	mu        sync.Mutex
+	suspected map[string]suspect // by user
+}
+
+// NewReconciler creates a reconciler that checks the last interval of requests on every run
+func NewReconciler(interval time.Duration) *Reconciler {
+	host, _ := os.Hostname()
+	return &Reconciler{
+		interval:  interval,
+		owner:     fmt.Sprintf("%s-%d-%s", host, os.Getpid(), randomID()),
+		stopChan:  make(chan struct{}),
+		suspected: make(map[string]suspect),
+	}
+}
+
+// Start runs the reconciler in the background, on each tick this instance holds the lease
+func (rc *Reconciler) Start() {
+	go func() {
+		ticker := time.NewTicker(rc.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !rc.lead(context.Background()) {
+					continue
+				}
+				if _, err := rc.Run(context.Background()); err != nil {
+					log.Printf("⚠️ [Ledger] Reconciliation failed: %v", err)
+				}
+			case <-rc.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background runs; a run in progress finishes
+func (rc *Reconciler) Stop() {
+	close(rc.stopChan)
+}
+
+// leaseFilter matches the lease while owner holds it or it has expired at now
+func leaseFilter(owner string, now time.Time) bson.M {
+	return bson.M{"_id": leaseID, "$or": bson.A{
+		bson.M{"owner": owner},
+		bson.M{"leaseUntil": bson.M{"$lte": now}},
+	}}
+}
+
+// lead takes or renews the lease for two intervals, so it passes to another instance only
+// once its holder missed a tick. It reports whether this instance holds it.
+func (rc *Reconciler) lead(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	update := bson.M{"$set": bson.M{"owner": rc.owner, "leaseUntil": now.Add(2 * rc.interval)}}
+	_, err := db.CreditLedgerStateCollection().UpdateOne(ctx, leaseFilter(rc.owner, now), update, options.Update().SetUpsert(true))
+	leading := err == nil
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		log.Printf("⚠️ [Ledger] Failed to take the reconciler lease: %v", err)
+	}
+	if leading != rc.leading {
+		if leading {
+			log.Printf("📒 [Ledger] This instance (%s) now reconciles the credit ledger", rc.owner)
+		} else {
+			log.Printf("📒 [Ledger] Another instance reconciles the credit ledger")
+		}
+	}
+	rc.leading = leading
+	return leading
+}
+
+// Run reconciles once and returns the findings it recorded
+func (rc *Reconciler) Run(ctx context.Context) ([]Drift, error) {
+	now := time.Now()
+
+	ledgerSums, err := sumEntries(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("sum ledger: %w", err)
+	}
+	stored, err := storedBalances(ctx, ledgerSums)
+	if err != nil {
+		return nil, fmt.Errorf("read balances: %w", err)
+	}
+	openBalances(ctx, ledgerSums, stored, now.Add(-SettleLag))
+
+	drifts := rc.confirmed(compareBalances(ledgerSums.Sums, stored))
+
+	end := now.Add(-SettleLag)
+	start := end.Add(-rc.interval)
+	entries, err := deductionsBetween(ctx, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("read deductions: %w", err)
+	}
+	logs, err := billedLogsBetween(ctx, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("read request logs: %w", err)
+	}
+	drifts = append(drifts, compareRequests(entries, logs)...)
+
+	for i := range drifts {
+		drifts[i].DetectedAt = now
+	}
+	if len(drifts) > 0 {
+		docs := make([]interface{}, len(drifts))
+		for i, d := range drifts {
+			docs[i] = d
+		}
+		if _, err := db.CreditLedgerDriftCollection().InsertMany(ctx, docs); err != nil {
+			log.Printf("⚠️ [Ledger] Failed to record %d drift findings: %v", len(drifts), err)
+		}
+		log.Printf("⚠️ [Ledger] Reconciliation found %d drifts (%d users, %d entries, %d billed logs checked)", len(drifts), len(ledgerSums.Sums), len(entries), len(logs))
+	} else {
+		log.Printf("✅ [Ledger] Reconciled %d users, %d entries, %d billed logs", len(ledgerSums.Sums), len(entries), len(logs))
+	}
+
+	return drifts, nil
+}
+
+// confirmed keeps the balance drifts also seen with the same difference on the previous run
+// that were not reported yet
+func (rc *Reconciler) confirmed(drifts []Drift) []Drift {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	previous := rc.suspected
+	rc.suspected = make(map[string]suspect, len(drifts))
+	var out []Drift
+	for _, d := range drifts {
+		s := suspect{diff: d.Stored.sub(*d.Ledger)}
+		if before, ok := previous[d.Username]; ok && s.diff.sub(before.diff).zero() {
+			if !before.reported {
+				out = append(out, d)
+			}
+			s.reported = true
+		}
+		rc.suspected[d.Username] = s
+	}
+	return out
+}
+
+// ledgerSums are the per-user sums of every entry, the users with an opening entry and
+// when each user's last entry was recorded
+type ledgerSums struct {
+	Sums   map[string]Balances
+	Opened map[string]bool
+	Last   map[string]time.Time
+}
+
+func sumEntries(ctx context.Context) (ledgerSums, error) {
+	cursor, err := db.CreditLedgerCollection().Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"username": bson.M{"$gt": ""}}},
+		{"$group": bson.M{
+			"_id":        "$username",
+			"credits":    bson.M{"$sum": "$credits"},
+			"refCredits": bson.M{"$sum": "$refCredits"},
+			"creditsNew": bson.M{"$sum": "$creditsNew"},
+			"opened":     bson.M{"$max": bson.M{"$eq": bson.A{"$kind", KindOpening}}},
+			"last":       bson.M{"$max": "$createdAt"},
+		}},
+	})
+	if err != nil {
+		return ledgerSums{}, err
+	}
+	defer cursor.Close(ctx)
+
+	sums := ledgerSums{Sums: make(map[string]Balances), Opened: make(map[string]bool), Last: make(map[string]time.Time)}
+	for cursor.Next(ctx) {
+		var row struct {
+			Username string `bson:"_id"`
+			Balances `bson:",inline"`
+			Opened   bool      `bson:"opened"`
+			Last     time.Time `bson:"last"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return ledgerSums{}, err
+		}
+		sums.Sums[row.Username] = row.Balances
+		sums.Opened[row.Username] = row.Opened
+		sums.Last[row.Username] = row.Last
+	}
+	return sums, cursor.Err()
+}
+
+func storedBalances(ctx context.Context, sums ledgerSums) (map[string]Balances, error) {
+	usernames := make([]string, 0, len(sums.Sums))
+	for username := range sums.Sums {
+		usernames = append(usernames, username)
+	}
+	stored := make(map[string]Balances, len(usernames))
+	if len(usernames) == 0 {
+		return stored, nil
+	}
+
+	cursor, err := db.UsersNewCollection().Find(ctx, bson.M{"_id": bson.M{"$in": usernames}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var row struct {
+			Username string `bson:"_id"`
+			Balances `bson:",inline"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return nil, err
+		}
+		stored[row.Username] = row.Balances
+	}
+	return stored, cursor.Err()
+}
+
+// openBalances starts the ledger of users seen for the first time with an opening entry
+// covering whatever their balance was before it, and counts it into sums. Users with entries
+// newer than settled wait for the next run, as their balance may not be written yet; users
+// without an opening entry are left out of the balance check.
+func openBalances(ctx context.Context, sums ledgerSums, stored map[string]Balances, settled time.Time) {
+	for username, sum := range sums.Sums {
+		if sums.Opened[username] {
+			continue
+		}
+		if sums.Last[username].After(settled) {
+			delete(sums.Sums, username)
+			continue
+		}
+		opening := stored[username].sub(sum)
+		err := Append(ctx, Entry{
+			ID:         Key(KindOpening, username),
+			Kind:       KindOpening,
+			Username:   username,
+			Credits:    opening.Credits,
+			RefCredits: opening.RefCredits,
+			CreditsNew: opening.CreditsNew,
+		})
+		if err != nil {
+			log.Printf("⚠️ [Ledger] Failed to open ledger of %s: %v", username, err)
+			delete(sums.Sums, username)
+			continue
+		}
+		sums.Sums[username] = stored[username]
+	}
+}
+
+func deductionsBetween(ctx context.Context, start, end time.Time) (map[string]billed, error) {
+	cursor, err := db.CreditLedgerCollection().Find(ctx, bson.M{
+		"kind":      KindDeduction,
+		"requestId": bson.M{"$gt": ""},
+		"createdAt": bson.M{"$gte": start, "$lt": end},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	entries := make(map[string]billed)
+	for cursor.Next(ctx) {
+		var e Entry
+		if err := cursor.Decode(&e); err != nil {
+			return nil, err
+		}
+		entries[e.RequestID] = billed{Username: e.Username, Cost: e.Charged}
+	}
+	return entries, cursor.Err()
+}
+
+func billedLogsBetween(ctx context.Context, start, end time.Time) (map[string]billed, error) {
+	cursor, err := db.RequestLogsCollection().Find(ctx, bson.M{
+		"requestId":   bson.M{"$gt": ""},
+		"userId":      bson.M{"$gt": ""},
+		"creditsCost": bson.M{"$gt": 0},
+		"createdAt":   bson.M{"$gte": start, "$lt": end},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	logs := make(map[string]billed)
+	for cursor.Next(ctx) {
+		var row struct {
+			UserID      string  `bson:"userId"`
+			RequestID   string  `bson:"requestId"`
+			CreditsCost float64 `bson:"creditsCost"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return nil, err
+		}
+		logs[row.RequestID] = billed{Username: row.UserID, Cost: row.CreditsCost}
+	}
+	return logs, cursor.Err()
+}
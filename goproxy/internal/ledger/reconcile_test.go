@@ -0,0 +1,117 @@
+package ledger
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCompareBalances_ReportsUsersOffTheLedger(t *testing.T) {
+	ledger := map[string]Balances{
+		"alice": {Credits: 10, RefCredits: 2},
+		"bob":   {CreditsNew: 5},
+		"carol": {Credits: 1},
+	}
+	stored := map[string]Balances{
+		"alice": {Credits: 10, RefCredits: 2.0000001}, // within tolerance
+		"bob":   {CreditsNew: 4.5},
+	}
+
+	drifts := compareBalances(ledger, stored)
+	if len(drifts) != 2 {
+		t.Fatalf("Expected drift for bob and carol, got %+v", drifts)
+	}
+	if drifts[0].Username != "bob" || drifts[0].Stored.CreditsNew != 4.5 || drifts[0].Ledger.CreditsNew != 5 {
+		t.Errorf("Unexpected drift for bob: %+v", drifts[0])
+	}
+	if drifts[1].Username != "carol" || drifts[1].Stored.Credits != 0 {
+		t.Errorf("Expected a missing user to count as a zero balance, got %+v", drifts[1])
+	}
+}
+
+func TestCompareRequests_MatchesEntriesAndLogs(t *testing.T) {
+	entries := map[string]billed{
+		"req-ok":       {Username: "alice", Cost: 0.25},
+		"req-mismatch": {Username: "alice", Cost: 0.25},
+		"req-nolog":    {Username: "bob", Cost: 0.1},
+	}
+	logs := map[string]billed{
+		"req-ok":       {Username: "alice", Cost: 0.25},
+		"req-mismatch": {Username: "alice", Cost: 0.3},
+		"req-noentry":  {Username: "bob", Cost: 0.2},
+	}
+
+	drifts := compareRequests(entries, logs)
+	if len(drifts) != 3 {
+		t.Fatalf("Expected 3 drifts, got %+v", drifts)
+	}
+	want := map[string]string{
+		"req-mismatch": DriftCost,
+		"req-noentry":  DriftMissingEntry,
+		"req-nolog":    DriftMissingLog,
+	}
+	for _, d := range drifts {
+		if want[d.RequestID] != d.Kind {
+			t.Errorf("Expected %s for %s, got %s", want[d.RequestID], d.RequestID, d.Kind)
+		}
+	}
+}
+
+func TestReconciler_ReportsBalanceDriftOnlyWhenItPersists(t *testing.T) {
+	rc := NewReconciler(0)
+	drift := compareBalances(map[string]Balances{"alice": {Credits: 5}}, map[string]Balances{"alice": {Credits: 4}})
+
+	if got := rc.confirmed(drift); len(got) != 0 {
+		t.Fatalf("Expected a first sighting to be held back, got %+v", got)
+	}
+	if got := rc.confirmed(drift); len(got) != 1 {
+		t.Fatalf("Expected the same drift on the next run to be reported, got %+v", got)
+	}
+	if got := rc.confirmed(drift); len(got) != 0 {
+		t.Fatalf("Expected a reported drift not to be reported again, got %+v", got)
+	}
+
+	// A deduction written in between changes the difference: not the same drift
+	moved := compareBalances(map[string]Balances{"alice": {Credits: 5}}, map[string]Balances{"alice": {Credits: 3}})
+	if got := rc.confirmed(moved); len(got) != 0 {
+		t.Fatalf("Expected a changed difference to be held back, got %+v", got)
+	}
+	if got := rc.confirmed(nil); len(got) != 0 || len(rc.suspected) != 0 {
+		t.Fatalf("Expected a settled balance to clear the suspicion, got %+v", got)
+	}
+}
+
+func TestLeaseFilter_TakesExpiredOrOwnLease(t *testing.T) {
+	now := time.Now()
+	filter := leaseFilter("host-1", now)
+	if filter["_id"] != leaseID {
+		t.Fatalf("Expected the filter on the lease document, got %v", filter)
+	}
+	or := filter["$or"].(bson.A)
+	if or[0].(bson.M)["owner"] != "host-1" {
+		t.Errorf("Expected the holder to renew its lease, got %v", or[0])
+	}
+	if expiry := or[1].(bson.M)["leaseUntil"].(bson.M)["$lte"]; expiry != now {
+		t.Errorf("Expected an expired lease to be taken over, got %v", or[1])
+	}
+}
+
+func TestDebitAndReversal_CancelOut(t *testing.T) {
+	debit := Debit("alice", "req-1", 0.5, 0.3, 0.2, 0)
+	if debit.ID != "deduction:req-1" || debit.Credits != -0.3 || debit.RefCredits != -0.2 || !debit.Changes() {
+		t.Fatalf("Unexpected debit: %+v", debit)
+	}
+
+	reversal := Reversal(debit, "write failed")
+	if reversal.ID != "reversal:deduction:req-1" || reversal.Reverses != debit.ID {
+		t.Fatalf("Unexpected reversal: %+v", reversal)
+	}
+	if debit.Credits+reversal.Credits != 0 || debit.RefCredits+reversal.RefCredits != 0 {
+		t.Errorf("Expected the reversal to cancel the debit, got %+v", reversal)
+	}
+
+	if Key(KindDeduction, "") == Key(KindDeduction, "") {
+		t.Error("Expected requests without an ID to get distinct keys")
+	}
+}
@@ -3,42 +3,93 @@ package maintarget
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"goproxy/internal/provider"
+	"goproxy/internal/sse"
+	"goproxy/transformers"
+
 	"golang.org/x/net/http2"
 )
 
+const (
+	MainTargetType = "main"
+
+	// Environment defaults for instances that don't set base_url / api_key_env
+	defaultServerEnv = "MAIN_TARGET_SERVER"
+	defaultKeyEnv    = "MAIN_UPSTREAM_KEY"
+)
+
 var (
 	client     *http.Client
 	clientOnce sync.Once
+)
+
+func init() {
+	provider.RegisterType(MainTargetType, func(spec provider.Spec) (provider.Provider, error) {
+		return New(spec), nil
+	})
+}
 
+// Target is a main target server: an Anthropic-compatible passthrough proxy with a single API key
+type Target struct {
+	name      string
 	serverURL string
 	apiKey    string
-)
+}
+
+// New creates a main target instance. The server URL defaults to $MAIN_TARGET_SERVER
+// and the API key is read from api_key_env (default $MAIN_UPSTREAM_KEY).
+func New(spec provider.Spec) *Target {
+	serverURL := spec.BaseURL
+	if serverURL == "" {
+		serverURL = os.Getenv(defaultServerEnv)
+	}
+	keyEnv := spec.APIKeyEnv
+	if keyEnv == "" {
+		keyEnv = defaultKeyEnv
+	}
+	t := &Target{
+		name:      spec.Name,
+		serverURL: strings.TrimSuffix(serverURL, "/"),
+		apiKey:    os.Getenv(keyEnv),
+	}
+	if t.IsConfigured() {
+		log.Printf("✅ [MainTarget] %s configured: %s", t.name, t.serverURL)
+	} else {
+		log.Printf("⚠️ [MainTarget] %s not configured (no server URL or %s)", t.name, keyEnv)
+	}
+	return t
+}
 
-// Configure sets the main target server URL and API key
-func Configure(url, key string) {
-	serverURL = strings.TrimSuffix(url, "/")
-	apiKey = key
-	log.Printf("✅ [MainTarget] Configured: %s", serverURL)
+// Name returns the instance name
+func (t *Target) Name() string {
+	return t.name
+}
+
+// Type returns the provider type
+func (t *Target) Type() string {
+	return MainTargetType
 }
 
 // IsConfigured returns true if main target is configured
-func IsConfigured() bool {
-	return serverURL != "" && apiKey != ""
+func (t *Target) IsConfigured() bool {
+	return t.serverURL != "" && t.apiKey != ""
 }
 
 // GetServerURL returns the configured server URL
-func GetServerURL() string {
-	return serverURL
+func (t *Target) GetServerURL() string {
+	return t.serverURL
 }
 
 func getClient() *http.Client {
@@ -109,21 +160,21 @@ func sanitizeAnthropicError(statusCode int, originalError []byte) []byte {
 	}
 }
 
-// ForwardRequest forwards Anthropic request to /v1/messages
-func ForwardRequest(originalBody []byte, isStreaming bool) (*http.Response, error) {
-	if !IsConfigured() {
+// ForwardMessagesRequest forwards Anthropic request to /v1/messages
+func (t *Target) ForwardMessagesRequest(ctx context.Context, originalBody []byte, isStreaming bool) (*http.Response, error) {
+	if !t.IsConfigured() {
 		return nil, fmt.Errorf("main target not configured")
 	}
 
-	endpoint := serverURL + "/v1/messages"
-	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(originalBody))
+	endpoint := t.serverURL + "/v1/messages"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(originalBody))
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", apiKey)
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("x-api-key", t.apiKey)
+	req.Header.Set("Authorization", "Bearer "+t.apiKey)
 	req.Header.Set("anthropic-version", "2023-06-01")
 	if isStreaming {
 		req.Header.Set("Accept", "text/event-stream")
@@ -133,21 +184,21 @@ func ForwardRequest(originalBody []byte, isStreaming bool) (*http.Response, erro
 	return getClient().Do(req)
 }
 
-// ForwardOpenAIRequest forwards OpenAI request to /v1/chat/completions
-func ForwardOpenAIRequest(originalBody []byte, isStreaming bool) (*http.Response, error) {
-	if !IsConfigured() {
+// ForwardRequest forwards OpenAI request to /v1/chat/completions
+func (t *Target) ForwardRequest(ctx context.Context, originalBody []byte, isStreaming bool) (*http.Response, error) {
+	if !t.IsConfigured() {
 		return nil, fmt.Errorf("main target not configured")
 	}
 
-	endpoint := serverURL + "/v1/chat/completions"
-	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(originalBody))
+	endpoint := t.serverURL + "/v1/chat/completions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(originalBody))
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("x-api-key", apiKey)
+	req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	req.Header.Set("x-api-key", t.apiKey)
 	if isStreaming {
 		req.Header.Set("Accept", "text/event-stream")
 	}
@@ -182,12 +233,18 @@ func HandleStreamResponseWithPrefix(w http.ResponseWriter, resp *http.Response,
 		return
 	}
 
+	// Keepalives stop idle timeouts from dropping the connection while upstream is silent
+	heartbeat := sse.StartHeartbeat(w, sse.AnthropicPing)
+	defer heartbeat.Stop()
+	w, flusher = heartbeat, heartbeat
+
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024)
 
 	var totalInput, totalOutput, totalCacheWrite, totalCacheHit int64
 	var eventCount int64
 	var lastEventType string
+	var delivered transformers.DeliveredOutput
 
 	for scanner.Scan() {
 		eventCount++
@@ -202,6 +259,7 @@ func HandleStreamResponseWithPrefix(w http.ResponseWriter, resp *http.Response,
 				if eventType != "" {
 					lastEventType = eventType
 				}
+				delivered.AddAnthropicEvent(event)
 
 				// message_start may contain input tokens and cache tokens (standard Anthropic)
 				if eventType == "message_start" {
@@ -246,6 +304,17 @@ func HandleStreamResponseWithPrefix(w http.ResponseWriter, resp *http.Response,
 
 	// Check for scanner errors (connection issues, truncation, etc)
 	if err := scanner.Err(); err != nil {
+		if transformers.ClientCancelled(resp) {
+			// Client went away: bill only the output it received
+			if deliveredOutput := delivered.Tokens(""); deliveredOutput > totalOutput {
+				totalOutput = deliveredOutput
+			}
+			log.Printf("🛑 [%s] Client cancelled stream (in=%d delivered_out=%d, events=%d)", logPrefix, totalInput, totalOutput, eventCount)
+			if onUsage != nil && (totalInput > 0 || totalOutput > 0) {
+				onUsage(totalInput, totalOutput, totalCacheWrite, totalCacheHit)
+			}
+			return
+		}
 		log.Printf("❌ [%s] Scanner error: %v (in=%d out=%d, events=%d, lastEvent=%s)", logPrefix, err, totalInput, totalOutput, eventCount, lastEventType)
 		// Send generic error event to client (don't expose internal error)
 		errorEvent := `event: error
@@ -335,11 +404,17 @@ func HandleOpenAIStreamResponse(w http.ResponseWriter, resp *http.Response, onUs
 		return
 	}
 
+	// Keepalives stop idle timeouts from dropping the connection while upstream is silent
+	heartbeat := sse.StartHeartbeat(w, sse.OpenAIKeepalive)
+	defer heartbeat.Stop()
+	w, flusher = heartbeat, heartbeat
+
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024)
 
 	var totalInput, totalOutput int64
 	var estimatedOutputChars int64 // Count output characters for estimation
+	var delivered transformers.DeliveredOutput
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -350,6 +425,8 @@ func HandleOpenAIStreamResponse(w http.ResponseWriter, resp *http.Response, onUs
 			if dataStr != "[DONE]" {
 				var event map[string]interface{}
 				if json.Unmarshal([]byte(dataStr), &event) == nil {
+					delivered.AddOpenAIChunk(event)
+
 					// Check if this event contains usage
 					if usage, ok := event["usage"].(map[string]interface{}); ok {
 						if v, ok := usage["prompt_tokens"].(float64); ok {
@@ -380,6 +457,17 @@ func HandleOpenAIStreamResponse(w http.ResponseWriter, resp *http.Response, onUs
 
 	// Check for scanner errors (connection issues, truncation, etc)
 	if err := scanner.Err(); err != nil {
+		if transformers.ClientCancelled(resp) {
+			// Client went away: bill only the output it received
+			if deliveredOutput := delivered.Tokens(""); deliveredOutput > totalOutput {
+				totalOutput = deliveredOutput
+			}
+			log.Printf("🛑 [MainTarget-OpenAI] Client cancelled stream (in=%d delivered_out=%d)", totalInput, totalOutput)
+			if onUsage != nil {
+				onUsage(totalInput, totalOutput, 0, 0)
+			}
+			return
+		}
 		log.Printf("❌ [MainTarget-OpenAI] Scanner error detected: %v", err)
 		// Send error event to client
 		errorEvent := fmt.Sprintf("data: {\"error\":{\"message\":\"Stream interrupted: %v\",\"type\":\"stream_error\"}}\n\n", err)
@@ -441,3 +529,13 @@ func HandleOpenAINonStreamResponse(w http.ResponseWriter, resp *http.Response, o
 	w.WriteHeader(http.StatusOK)
 	w.Write(body)
 }
+
+// HandleStreamResponse handles a streaming response to ForwardRequest (OpenAI format)
+func (t *Target) HandleStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage provider.UsageCallback) {
+	HandleOpenAIStreamResponse(w, resp, onUsage)
+}
+
+// HandleNonStreamResponse handles a non-streaming response to ForwardRequest (OpenAI format)
+func (t *Target) HandleNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage provider.UsageCallback) {
+	HandleOpenAINonStreamResponse(w, resp, onUsage)
+}
@@ -16,22 +16,32 @@ import (
 
 	"goproxy/config"
 	"goproxy/db"
+	"goproxy/internal/affinity"
+	"goproxy/internal/breaker"
 	"goproxy/internal/cache"
+	"goproxy/internal/keyquota"
+	"goproxy/internal/provider"
 	"goproxy/internal/proxy"
+	"goproxy/internal/sse"
+	"goproxy/transformers"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/net/http2"
 )
 
 const (
-	OhMyGPTBaseURL             = "https://apic1.ohmycdn.com/api/v1/ai/openai/cc-omg"
-	OhMyGPTMessagesEndpoint    = OhMyGPTBaseURL + "/v1/messages"
-	OhMyGPTCompletionsEndpoint = OhMyGPTBaseURL + "/v1/chat/completions"
-	OhMyGPTEndpoint            = OhMyGPTCompletionsEndpoint // default for OpenAI format
-	OhMyGPTName                = "ohmygpt"
+	OhMyGPTBaseURL        = "https://apic1.ohmycdn.com/api/v1/ai/openai/cc-omg"
+	OhMyGPTType           = "ohmygpt"
+	defaultKeysCollection = "ohmygpt_keys"
+	defaultHeaderProfile  = provider.HeaderProfileOpenHandsCLI
 
 	RateLimitCooldownDuration = 2 * time.Minute  // Cooldown for rate-limited keys
 	AutoRecoveryCheckInterval = 30 * time.Second // Auto-recovery check interval
+
+	// maxKeyRetries is how many other keys a request is retried with after a key error.
+	// Streams retry too, as long as nothing has been sent to the client.
+	maxKeyRetries = 2
 )
 
 // OhMyGPTKeyStatus represents the health status of an API key
@@ -79,34 +89,23 @@ type OhMyGPTKeyBinding struct {
 	CreatedAt    time.Time `bson:"createdAt" json:"created_at"`
 }
 
-// OhMyGPTProvider implements Provider interface for OhMyGPT with MongoDB key pool
+// OhMyGPTProvider implements provider.Provider for OhMyGPT with MongoDB key pool
 type OhMyGPTProvider struct {
+	spec          provider.Spec
 	keys          []*OhMyGPTKey
 	bindings      map[string][]*OhMyGPTKeyBinding // proxyId -> bindings
 	current       int
 	keyIndex      map[string]int // proxyId -> current key index for rotation
 	lastUsedKeyID string
+	affinity      *affinity.Table   // conversation prefix -> key
+	quota         *keyquota.Tracker // live upstream rate limits per key
 	lastUsedProxy string
 	client        *http.Client
 	proxyPool     *proxy.ProxyPool
 	useProxy      bool
 	mu            sync.Mutex
-}
-
-var ohmygptInstance *OhMyGPTProvider
-var ohmygptOnce sync.Once
-
-// GetOhMyGPT returns the singleton OhMyGPT provider instance
-func GetOhMyGPT() *OhMyGPTProvider {
-	ohmygptOnce.Do(func() {
-		ohmygptInstance = &OhMyGPTProvider{
-			keys:     make([]*OhMyGPTKey, 0),
-			bindings: make(map[string][]*OhMyGPTKeyBinding),
-			keyIndex: make(map[string]int),
-			current:  0,
-		}
-	})
-	return ohmygptInstance
+	stopChan      chan struct{} // closed by Stop
+	stopOnce      sync.Once
 }
 
 // GetCacheDetector returns the cache detector instance (helper for ohmygpt package)
@@ -114,22 +113,72 @@ func GetCacheDetector() *cache.CacheDetector {
 	return cache.GetCacheDetector()
 }
 
-// ConfigureOhMyGPT initializes the OhMyGPT provider and loads keys from MongoDB
-func ConfigureOhMyGPT() error {
-	provider := GetOhMyGPT()
-	provider.client = createOhMyGPTClient()
+func init() {
+	provider.RegisterType(OhMyGPTType, func(spec provider.Spec) (provider.Provider, error) {
+		return New(spec), nil
+	})
+}
+
+// New creates an OhMyGPT instance; keys are loaded when it starts
+func New(spec provider.Spec) *OhMyGPTProvider {
+	if spec.BaseURL == "" {
+		spec.BaseURL = OhMyGPTBaseURL
+	}
+	spec.BaseURL = strings.TrimSuffix(spec.BaseURL, "/")
+	if spec.KeyCollection == "" {
+		spec.KeyCollection = defaultKeysCollection
+	}
+	if spec.HeaderProfile == "" {
+		spec.HeaderProfile = defaultHeaderProfile
+	}
+	return &OhMyGPTProvider{
+		spec:     spec,
+		keys:     make([]*OhMyGPTKey, 0),
+		bindings: make(map[string][]*OhMyGPTKeyBinding),
+		keyIndex: make(map[string]int),
+		current:  0,
+		client:   createOhMyGPTClient(),
+		affinity: affinity.NewTable(),
+		quota:    keyquota.NewTracker(),
+		stopChan: make(chan struct{}),
+	}
+}
 
-	if err := provider.LoadKeys(); err != nil {
+// Start loads keys from MongoDB, enables the proxy pool and starts auto-reload and auto-recovery
+func (p *OhMyGPTProvider) Start(rt provider.Runtime) error {
+	if err := p.LoadKeys(); err != nil {
 		return err
 	}
+	if p.spec.UseProxy && rt.ProxyPool != nil && rt.ProxyPool.HasProxies() {
+		p.SetProxyPool(rt.ProxyPool)
+	}
+	if rt.ReloadInterval > 0 {
+		p.StartAutoReload(rt.ReloadInterval)
+	}
+	p.StartAutoRecovery()
+	if p.GetKeyCount() == 0 {
+		log.Printf("⚠️ [Troll-LLM] %s not configured (no keys in %s collection)", p.spec.Name, p.spec.KeyCollection)
+	} else {
+		log.Printf("✅ [Troll-LLM] %s key pool loaded: %d keys", p.spec.Name, p.GetKeyCount())
+	}
+	return nil
+}
 
-	// Register with TrollProxy registry
-	RegisterProvider(OhMyGPTName, provider)
-
-	// Start auto-recovery background service
-	provider.StartAutoRecovery()
+// keysCollection returns the MongoDB collection holding this instance's keys
+func (p *OhMyGPTProvider) keysCollection() *mongo.Collection {
+	return db.GetCollection(p.spec.KeyCollection)
+}
 
-	return nil
+// UpdateKeyStats records a request's tokens against a key (no lastUsedAt, unlike UpdateKeyUsage)
+func (p *OhMyGPTProvider) UpdateKeyStats(keyID string, tokens int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p.keysCollection().UpdateByID(ctx, keyID, bson.M{
+		"$inc": bson.M{
+			"tokensUsed":    tokens,
+			"requestsCount": 1,
+		},
+	})
 }
 
 // SetProxyPool sets the proxy pool to use for requests
@@ -151,7 +200,7 @@ func (p *OhMyGPTProvider) LoadKeys() error {
 	defer cancel()
 
 	// Load keys
-	cursor, err := db.OhMyGPTKeysCollection().Find(ctx, bson.M{})
+	cursor, err := p.keysCollection().Find(ctx, bson.M{})
 	if err != nil {
 		return err
 	}
@@ -205,11 +254,16 @@ func (p *OhMyGPTProvider) StartAutoReload(interval time.Duration) {
 
 		// Auto-reload started log disabled to reduce noise
 
-		for range ticker.C {
-			if err := p.LoadKeys(); err != nil {
-				log.Printf("⚠️ [Troll-LLM] OhMyGPT Auto-reload failed: %v", err)
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.LoadKeys(); err != nil {
+					log.Printf("⚠️ [Troll-LLM] OhMyGPT Auto-reload failed: %v", err)
+				}
+				// Auto-reload success log disabled to reduce noise
+			case <-p.stopChan:
+				return
 			}
-			// Auto-reload success log disabled to reduce noise
 		}
 	}()
 }
@@ -222,12 +276,22 @@ func (p *OhMyGPTProvider) StartAutoRecovery() {
 
 		log.Printf("🔄 [Troll-LLM] OhMyGPT Auto-recovery service started (interval: %v)", AutoRecoveryCheckInterval)
 
-		for range ticker.C {
-			p.runAutoRecovery()
+		for {
+			select {
+			case <-ticker.C:
+				p.runAutoRecovery()
+			case <-p.stopChan:
+				return
+			}
 		}
 	}()
 }
 
+// Stop stops auto-reload and auto-recovery
+func (p *OhMyGPTProvider) Stop() {
+	p.stopOnce.Do(func() { close(p.stopChan) })
+}
+
 // runAutoRecovery checks for expired cooldowns and recovers keys to healthy status
 func (p *OhMyGPTProvider) runAutoRecovery() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -248,7 +312,7 @@ func (p *OhMyGPTProvider) runAutoRecovery() {
 		},
 	}
 
-	result, err := db.OhMyGPTKeysCollection().UpdateMany(ctx, filter, update)
+	result, err := p.keysCollection().UpdateMany(ctx, filter, update)
 	if err != nil {
 		log.Printf("⚠️ [Troll-LLM] OhMyGPT Auto-recovery failed: %v", err)
 		return
@@ -276,21 +340,99 @@ func (p *OhMyGPTProvider) SelectKey() (*OhMyGPTKey, error) {
 		return nil, fmt.Errorf("no OhMyGPT keys configured")
 	}
 
+	// Keys close to their upstream rate limit are only used when no other key is available
 	startIdx := p.current
+	low := -1
 	for i := 0; i < len(p.keys); i++ {
 		idx := (startIdx + i) % len(p.keys)
 		key := p.keys[idx]
 
-		if key.IsAvailable() {
+		if p.quota.Low(key.ID) && key.IsAvailable() {
+			if low < 0 {
+				low = idx
+			}
+			continue
+		}
+		if p.keyUsable(key) {
 			p.current = (idx + 1) % len(p.keys)
 			p.lastUsedKeyID = key.ID
 			return key, nil
 		}
 	}
+	if low >= 0 && p.keyUsable(p.keys[low]) {
+		key := p.keys[low]
+		p.current = (low + 1) % len(p.keys)
+		p.lastUsedKeyID = key.ID
+		return key, nil
+	}
 
 	return nil, fmt.Errorf("no healthy OhMyGPT keys available")
 }
 
+// SelectKeyFor selects the key pinned to the request's conversation (see affinity.WithPrefix)
+// so consecutive turns hit the same prompt cache, falling back to SelectKey
+func (p *OhMyGPTProvider) SelectKeyFor(ctx context.Context) (*OhMyGPTKey, error) {
+	var selected *OhMyGPTKey
+	_, err := p.affinity.Pick(affinity.PrefixFrom(ctx), func(keyID string) bool {
+		key := p.GetKeyByID(keyID)
+		if key == nil || !p.keyUsable(key) {
+			return false
+		}
+		selected = key
+		return true
+	}, func() (string, error) {
+		key, err := p.SelectKey()
+		if err != nil {
+			return "", err
+		}
+		selected = key
+		return key.ID, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.lastUsedKeyID = selected.ID
+	p.mu.Unlock()
+	return selected, nil
+}
+
+// keyUsable reports whether key can take a request: healthy and its circuit not open.
+// While the circuit is half-open this reserves one of its probe slots.
+func (p *OhMyGPTProvider) keyUsable(key *OhMyGPTKey) bool {
+	return key.IsAvailable() && breaker.Key(p.Name(), key.ID).Allow()
+}
+
+// AvailableKeys counts the keys that could take a request right now, without selecting
+// one or reserving a half-open probe (see admission)
+func (p *OhMyGPTProvider) AvailableKeys() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, key := range p.keys {
+		if key.IsAvailable() && breaker.Key(p.Name(), key.ID).Ready() {
+			n++
+		}
+	}
+	return n
+}
+
+// recordKeyCall feeds the key's circuit breaker with the outcome of an upstream call
+func (p *OhMyGPTProvider) recordKeyCall(keyID string, success bool, latency time.Duration) {
+	breaker.Key(p.Name(), keyID).Record(success, latency)
+}
+
+// ObserveRateLimits records the rate-limit headers of an upstream response made with keyID
+func (p *OhMyGPTProvider) ObserveRateLimits(keyID string, statusCode int, header http.Header) {
+	p.quota.Observe(keyID, statusCode, header)
+}
+
+// AffinityStats returns how often conversations were served by their pinned key
+func (p *OhMyGPTProvider) AffinityStats() affinity.Stats {
+	return p.affinity.Stats()
+}
+
 // MarkStatus updates key status in memory and database
 func (p *OhMyGPTProvider) MarkStatus(keyID string, status OhMyGPTKeyStatus, cooldown time.Duration, lastError string) {
 	p.mu.Lock()
@@ -326,7 +468,7 @@ func (p *OhMyGPTProvider) updateKeyStatus(keyID string, status OhMyGPTKeyStatus,
 		},
 	}
 
-	_, err := db.OhMyGPTKeysCollection().UpdateByID(ctx, keyID, update)
+	_, err := p.keysCollection().UpdateByID(ctx, keyID, update)
 	if err != nil {
 		log.Printf("⚠️ [Troll-LLM] Failed to update OhMyGPT key status: %v", err)
 	}
@@ -337,9 +479,11 @@ func (p *OhMyGPTProvider) MarkHealthy(keyID string) {
 	log.Printf("✅ [Troll-LLM] OhMyGPT Key %s marked healthy", keyID)
 }
 
+// MarkRateLimited cools a key down until the upstream's reported reset (see keyquota.Tracker)
 func (p *OhMyGPTProvider) MarkRateLimited(keyID string) {
-	p.MarkStatus(keyID, OhMyGPTStatusRateLimited, RateLimitCooldownDuration, "Rate limited by upstream")
-	log.Printf("⚠️ [Troll-LLM] OhMyGPT Key %s rate limited (cooldown: 2m0s)", keyID)
+	cooldown := p.quota.Cooldown(keyID, RateLimitCooldownDuration)
+	p.MarkStatus(keyID, OhMyGPTStatusRateLimited, cooldown, "Rate limited by upstream")
+	log.Printf("⚠️ [Troll-LLM] OhMyGPT Key %s rate limited (cooldown: %v)", keyID, cooldown)
 }
 
 func (p *OhMyGPTProvider) MarkExhausted(keyID string) {
@@ -386,6 +530,10 @@ func (p *OhMyGPTProvider) CheckAndRotateOnError(keyID string, statusCode int, bo
 			p.MarkRateLimited(keyID)
 			return
 		}
+	case 529:
+		p.MarkRateLimited(keyID)
+		log.Printf("⏳ [Troll-LLM] OhMyGPT Key %s temporarily unavailable due to upstream overload (529)", keyID)
+		return
 	}
 
 	if shouldRotate {
@@ -453,6 +601,10 @@ func (p *OhMyGPTProvider) GetAllKeysStatus() []map[string]interface{} {
 		if key.CooldownUntil != nil {
 			keyInfo["cooldown_until"] = key.CooldownUntil.Format(time.RFC3339)
 		}
+		if quota, ok := p.quota.Quota(key.ID); ok {
+			keyInfo["quota"] = quota
+			keyInfo["quota_low"] = p.quota.Low(key.ID)
+		}
 		result = append(result, keyInfo)
 	}
 	return result
@@ -491,7 +643,7 @@ func (p *OhMyGPTProvider) UpdateKeyUsage(keyID string, inputTokens, outputTokens
 		return nil
 	}
 
-	collection := db.OhMyGPTKeysCollection()
+	collection := p.keysCollection()
 	if collection == nil {
 		return fmt.Errorf("ohmygpt_keys collection not available")
 	}
@@ -555,7 +707,7 @@ func (p *OhMyGPTProvider) RotateKey(failedKeyID string, reason string) (string,
 	log.Printf("✅ [OhMyGPT/Rotation] Found backup key: %s (%s)", backupKey.ID, newKeyMasked)
 
 	// 2. DELETE old key completely
-	keysCol := db.OhMyGPTKeysCollection()
+	keysCol := p.keysCollection()
 	_, err = keysCol.DeleteOne(ctx, bson.M{"_id": failedKeyID})
 	if err != nil {
 		log.Printf("⚠️ [OhMyGPT/Rotation] Failed to delete old key: %v", err)
@@ -654,9 +806,14 @@ func createOhMyGPTClient() *http.Client {
 	return &http.Client{Transport: transport, Timeout: 0}
 }
 
-// Name returns the provider name
+// Name returns the instance name
 func (p *OhMyGPTProvider) Name() string {
-	return OhMyGPTName
+	return p.spec.Name
+}
+
+// Type returns the provider type
+func (p *OhMyGPTProvider) Type() string {
+	return OhMyGPTType
 }
 
 // IsConfigured returns true if the provider is configured
@@ -667,49 +824,33 @@ func (p *OhMyGPTProvider) IsConfigured() bool {
 }
 
 // ForwardRequest forwards request to OhMyGPT chat/completions endpoint (OpenAI format)
-func (p *OhMyGPTProvider) ForwardRequest(body []byte, isStreaming bool) (*http.Response, error) {
-	return p.forwardToEndpoint(OhMyGPTCompletionsEndpoint, body, isStreaming)
+func (p *OhMyGPTProvider) ForwardRequest(ctx context.Context, body []byte, isStreaming bool) (*http.Response, error) {
+	return p.forwardToEndpoint(ctx, p.spec.BaseURL+"/v1/chat/completions", body, isStreaming)
 }
 
 // ForwardMessagesRequest forwards request to OhMyGPT messages endpoint (Anthropic format)
-func (p *OhMyGPTProvider) ForwardMessagesRequest(body []byte, isStreaming bool) (*http.Response, error) {
-	return p.forwardToEndpoint(OhMyGPTMessagesEndpoint, body, isStreaming)
+func (p *OhMyGPTProvider) ForwardMessagesRequest(ctx context.Context, body []byte, isStreaming bool) (*http.Response, error) {
+	return p.forwardToEndpoint(ctx, p.spec.BaseURL+"/v1/messages", body, isStreaming)
 }
 
 // forwardToEndpoint forwards request to specified endpoint with key rotation and optional proxy
-func (p *OhMyGPTProvider) forwardToEndpoint(endpoint string, body []byte, isStreaming bool) (*http.Response, error) {
+func (p *OhMyGPTProvider) forwardToEndpoint(ctx context.Context, endpoint string, body []byte, isStreaming bool) (*http.Response, error) {
 	if !p.IsConfigured() {
 		return nil, fmt.Errorf("OhMyGPT not configured")
 	}
 
 	// Select proxy and key together (with binding support)
-	client, proxyName, key, err := p.selectProxyAndKey()
+	client, proxyName, key, err := p.selectProxyAndKey(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+key.APIKey)
-	req.Header.Set("x-api-key", key.APIKey)
-	// Add User-Agent from config (openhands-cli/1.0.0 for official CLI appearance)
-	if userAgent := config.GetUserAgent(); userAgent != "" {
-		req.Header.Set("User-Agent", userAgent)
-	}
-	// Add x-openhands-client header to match official CLI behavior
-	req.Header.Set("x-openhands-client", "cli")
-	// Add common headers to avoid detection
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
-	if isStreaming {
-		req.Header.Set("Accept", "text/event-stream")
-	} else {
-		req.Header.Set("Accept", "application/json")
-	}
+	provider.SetHeaders(req, p.spec.HeaderProfile, key.APIKey, config.GetUserAgent(), isStreaming)
 
 	// Log request
 	if proxyName != "" {
@@ -724,11 +865,13 @@ func (p *OhMyGPTProvider) forwardToEndpoint(endpoint string, body []byte, isStre
 	if err != nil {
 		// Log detailed error with timing to help debug proxy vs upstream timeouts
 		log.Printf("⏱️ [Troll-LLM] OhMyGPT Request failed after %v (proxy=%s): %v", elapsed, proxyName, err)
+		p.recordKeyCall(key.ID, false, elapsed)
 		return nil, err
 	}
+	p.ObserveRateLimits(key.ID, resp.StatusCode, resp.Header)
 
-	// Check for rate limit, quota errors, or budget exceeded (400 with ExceededBudget)
-	if resp.StatusCode == 429 || resp.StatusCode == 402 || resp.StatusCode == 401 || resp.StatusCode == 400 {
+	// Check for rate limit, quota errors, budget exceeded (400 with ExceededBudget), or service overload (529)
+	if resp.StatusCode == 429 || resp.StatusCode == 402 || resp.StatusCode == 401 || resp.StatusCode == 400 || resp.StatusCode == 529 {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyStr := string(bodyBytes)
 		resp.Body.Close()
@@ -737,28 +880,29 @@ func (p *OhMyGPTProvider) forwardToEndpoint(endpoint string, body []byte, isStre
 		if resp.StatusCode == 400 && !strings.Contains(bodyStr, "ExceededBudget") && !strings.Contains(bodyStr, "budget_exceeded") && !strings.Contains(bodyStr, "over budget") {
 			// Not a budget error - return sanitized error response
 			resp.Body = io.NopCloser(bytes.NewReader(SanitizeError(resp.StatusCode, bodyBytes)))
+			p.recordKeyCall(key.ID, true, elapsed)
 			return resp, nil
 		}
 
+		p.recordKeyCall(key.ID, false, elapsed)
 		p.CheckAndRotateOnError(key.ID, resp.StatusCode, bodyStr)
 
-		// IMPORTANT: Only retry for non-streaming requests
-		if !isStreaming {
-			log.Printf("⚠️ [Troll-LLM] OhMyGPT Non-streaming request failed (HTTP %d), retrying with next key...", resp.StatusCode)
-			return p.retryWithNextKeyToEndpoint(endpoint, body, isStreaming, 2)
-		} else {
-			log.Printf("🚫 [Troll-LLM] OhMyGPT Streaming request got HTTP %d - CANNOT RETRY to prevent double response!", resp.StatusCode)
-			// Return sanitized error response - handler will forward to client
-			resp.Body = io.NopCloser(bytes.NewReader(SanitizeError(resp.StatusCode, bodyBytes)))
-			return resp, nil
-		}
+		// Nothing has been written to the client yet, so streaming requests can retry too
+		log.Printf("⚠️ [Troll-LLM] OhMyGPT Request failed (HTTP %d, stream=%v), retrying with next key...", resp.StatusCode, isStreaming)
+		return p.retryWithNextKeyToEndpoint(ctx, endpoint, body, isStreaming, maxKeyRetries)
 	}
 
+	if isStreaming && resp.StatusCode == http.StatusOK && p.streamKeyError(resp, key.ID) {
+		p.recordKeyCall(key.ID, false, elapsed)
+		return p.retryWithNextKeyToEndpoint(ctx, endpoint, body, isStreaming, maxKeyRetries)
+	}
+
+	p.recordKeyCall(key.ID, !breaker.IsFailure(resp.StatusCode), elapsed)
 	return resp, nil
 }
 
 // selectProxyAndKey selects a proxy and corresponding key based on bindings
-func (p *OhMyGPTProvider) selectProxyAndKey() (*http.Client, string, *OhMyGPTKey, error) {
+func (p *OhMyGPTProvider) selectProxyAndKey(ctx context.Context) (*http.Client, string, *OhMyGPTKey, error) {
 	p.mu.Lock()
 	useProxy := p.useProxy
 	pool := p.proxyPool
@@ -767,7 +911,7 @@ func (p *OhMyGPTProvider) selectProxyAndKey() (*http.Client, string, *OhMyGPTKey
 
 	// If no proxy, just select key with round-robin
 	if !useProxy || pool == nil {
-		key, err := p.SelectKey()
+		key, err := p.SelectKeyFor(ctx)
 		if err != nil {
 			return nil, "", nil, err
 		}
@@ -778,7 +922,7 @@ func (p *OhMyGPTProvider) selectProxyAndKey() (*http.Client, string, *OhMyGPTKey
 	selectedProxy, err := pool.SelectProxy()
 	if err != nil {
 		log.Printf("⚠️ [Troll-LLM] OhMyGPT Failed to select proxy, using direct: %v", err)
-		key, err := p.SelectKey()
+		key, err := p.SelectKeyFor(ctx)
 		if err != nil {
 			return nil, "", nil, err
 		}
@@ -789,7 +933,7 @@ func (p *OhMyGPTProvider) selectProxyAndKey() (*http.Client, string, *OhMyGPTKey
 	transport, err := selectedProxy.CreateHTTPTransport()
 	if err != nil {
 		log.Printf("⚠️ [Troll-LLM] OhMyGPT Failed to create proxy transport, using direct: %v", err)
-		key, err := p.SelectKey()
+		key, err := p.SelectKeyFor(ctx)
 		if err != nil {
 			return nil, "", nil, err
 		}
@@ -820,7 +964,7 @@ func (p *OhMyGPTProvider) selectProxyAndKey() (*http.Client, string, *OhMyGPTKey
 
 			// Find the key
 			key := p.GetKeyByID(binding.OhMyGPTKeyID)
-			if key != nil && key.IsAvailable() {
+			if key != nil && p.keyUsable(key) {
 				p.mu.Lock()
 				p.lastUsedKeyID = key.ID
 				p.mu.Unlock()
@@ -830,7 +974,7 @@ func (p *OhMyGPTProvider) selectProxyAndKey() (*http.Client, string, *OhMyGPTKey
 	}
 
 	// No binding found, use round-robin key selection
-	key, err := p.SelectKey()
+	key, err := p.SelectKeyFor(ctx)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -843,39 +987,23 @@ func (p *OhMyGPTProvider) selectProxyAndKey() (*http.Client, string, *OhMyGPTKey
 }
 
 // retryWithNextKeyToEndpoint attempts request with remaining keys to specified endpoint
-func (p *OhMyGPTProvider) retryWithNextKeyToEndpoint(endpoint string, body []byte, isStreaming bool, retriesLeft int) (*http.Response, error) {
+func (p *OhMyGPTProvider) retryWithNextKeyToEndpoint(ctx context.Context, endpoint string, body []byte, isStreaming bool, retriesLeft int) (*http.Response, error) {
 	if retriesLeft <= 0 {
 		return nil, fmt.Errorf("all OhMyGPT keys exhausted or rate limited")
 	}
 
 	// Select proxy and key together (with binding support)
-	client, proxyName, key, err := p.selectProxyAndKey()
+	client, proxyName, key, err := p.selectProxyAndKey(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+key.APIKey)
-	req.Header.Set("x-api-key", key.APIKey)
-	// Add User-Agent from config (openhands-cli/1.0.0 for official CLI appearance)
-	if userAgent := config.GetUserAgent(); userAgent != "" {
-		req.Header.Set("User-Agent", userAgent)
-	}
-	// Add x-openhands-client header to match official CLI behavior
-	req.Header.Set("x-openhands-client", "cli")
-	// Add common headers to avoid detection
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
-	if isStreaming {
-		req.Header.Set("Accept", "text/event-stream")
-	} else {
-		req.Header.Set("Accept", "application/json")
-	}
+	provider.SetHeaders(req, p.spec.HeaderProfile, key.APIKey, config.GetUserAgent(), isStreaming)
 
 	if proxyName != "" {
 		log.Printf("📤 [Troll-LLM] OhMyGPT RETRY POST %s (key=%s, proxy=%s, stream=%v, retries=%d)", endpoint, key.ID, proxyName, isStreaming, retriesLeft)
@@ -888,10 +1016,12 @@ func (p *OhMyGPTProvider) retryWithNextKeyToEndpoint(endpoint string, body []byt
 	elapsed := time.Since(startTime)
 	if err != nil {
 		log.Printf("⏱️ [Troll-LLM] OhMyGPT RETRY failed after %v (proxy=%s): %v", elapsed, proxyName, err)
+		p.recordKeyCall(key.ID, false, elapsed)
 		return nil, err
 	}
+	p.ObserveRateLimits(key.ID, resp.StatusCode, resp.Header)
 
-	if resp.StatusCode == 429 || resp.StatusCode == 402 || resp.StatusCode == 401 || resp.StatusCode == 400 {
+	if resp.StatusCode == 429 || resp.StatusCode == 402 || resp.StatusCode == 401 || resp.StatusCode == 400 || resp.StatusCode == 529 {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyStr := string(bodyBytes)
 		resp.Body.Close()
@@ -899,18 +1029,53 @@ func (p *OhMyGPTProvider) retryWithNextKeyToEndpoint(endpoint string, body []byt
 		// For 400, only handle budget_exceeded errors - other 400s should be sanitized
 		if resp.StatusCode == 400 && !strings.Contains(bodyStr, "ExceededBudget") && !strings.Contains(bodyStr, "budget_exceeded") && !strings.Contains(bodyStr, "over budget") {
 			resp.Body = io.NopCloser(bytes.NewReader(SanitizeError(resp.StatusCode, bodyBytes)))
+			p.recordKeyCall(key.ID, true, elapsed)
 			return resp, nil
 		}
 
+		p.recordKeyCall(key.ID, false, elapsed)
 		p.CheckAndRotateOnError(key.ID, resp.StatusCode, bodyStr)
-		return p.retryWithNextKeyToEndpoint(endpoint, body, isStreaming, retriesLeft-1)
+		return p.retryWithNextKeyToEndpoint(ctx, endpoint, body, isStreaming, retriesLeft-1)
+	}
+
+	if isStreaming && resp.StatusCode == http.StatusOK && p.streamKeyError(resp, key.ID) {
+		p.recordKeyCall(key.ID, false, elapsed)
+		return p.retryWithNextKeyToEndpoint(ctx, endpoint, body, isStreaming, retriesLeft-1)
 	}
 
+	p.recordKeyCall(key.ID, !breaker.IsFailure(resp.StatusCode), elapsed)
 	return resp, nil
 }
 
+// streamKeyError buffers the first event of a streaming response. Upstreams report rate limits
+// and overload as an error event after a 200; nothing has reached the client yet, so the
+// request can still move to another key.
+func (p *OhMyGPTProvider) streamKeyError(resp *http.Response, keyID string) bool {
+	event := sse.PeekFirstEvent(resp)
+	status, isError := sse.ErrorStatus(event)
+	if !isError || !isKeyError(status, string(event)) {
+		return false
+	}
+	resp.Body.Close()
+	p.CheckAndRotateOnError(keyID, status, string(event))
+	log.Printf("⚠️ [Troll-LLM] OhMyGPT Stream opened with an error event (%d), retrying with next key...", status)
+	return true
+}
+
+// isKeyError reports whether an upstream error is tied to the key (rate limit, quota,
+// auth, budget, overload) so the request can be retried with another key
+func isKeyError(statusCode int, body string) bool {
+	switch statusCode {
+	case 429, 402, 401, 529:
+		return true
+	case 400:
+		return strings.Contains(body, "ExceededBudget") || strings.Contains(body, "budget_exceeded") || strings.Contains(body, "over budget")
+	}
+	return false
+}
+
 // HandleStreamResponse handles streaming response from OhMyGPT (pure passthrough)
-func (p *OhMyGPTProvider) HandleStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage UsageCallback) {
+func (p *OhMyGPTProvider) HandleStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage provider.UsageCallback) {
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		log.Printf("❌ [Troll-LLM] OhMyGPT Error %d", resp.StatusCode)
@@ -937,10 +1102,16 @@ func (p *OhMyGPTProvider) HandleStreamResponse(w http.ResponseWriter, resp *http
 		return
 	}
 
+	// Keepalives stop idle timeouts from dropping the connection while upstream is silent
+	heartbeat := sse.StartHeartbeat(w, sse.KeepaliveFor(resp))
+	defer heartbeat.Stop()
+	w, flusher = heartbeat, heartbeat
+
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024)
 
 	var totalInput, totalOutput, cacheCreation, cacheRead int64
+	var delivered transformers.DeliveredOutput
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -951,6 +1122,9 @@ func (p *OhMyGPTProvider) HandleStreamResponse(w http.ResponseWriter, resp *http
 			if dataStr != "[DONE]" {
 				var event map[string]interface{}
 				if json.Unmarshal([]byte(dataStr), &event) == nil {
+					delivered.AddAnthropicEvent(event)
+					delivered.AddOpenAIChunk(event)
+
 					// Check event type for Anthropic format
 					eventType, _ := event["type"].(string)
 
@@ -1019,6 +1193,12 @@ func (p *OhMyGPTProvider) HandleStreamResponse(w http.ResponseWriter, resp *http
 
 	if err := scanner.Err(); err != nil {
 		log.Printf("⚠️ [Troll-LLM] OhMyGPT Scanner error: %v", err)
+		if transformers.ClientCancelled(resp) {
+			// Client went away: bill only the output it received
+			if deliveredOutput := delivered.Tokens(modelID); deliveredOutput > totalOutput {
+				totalOutput = deliveredOutput
+			}
+		}
 	}
 
 	if cacheCreation > 0 || cacheRead > 0 {
@@ -1032,7 +1212,7 @@ func (p *OhMyGPTProvider) HandleStreamResponse(w http.ResponseWriter, resp *http
 }
 
 // HandleNonStreamResponse handles non-streaming response from OhMyGPT (pure passthrough)
-func (p *OhMyGPTProvider) HandleNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage UsageCallback) {
+func (p *OhMyGPTProvider) HandleNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage provider.UsageCallback) {
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		http.Error(w, `{"error":"failed to read response"}`, http.StatusInternalServerError)
@@ -2,21 +2,8 @@ package ohmygpt
 
 import (
 	"log"
-	"net/http"
 )
 
-// UsageCallback is called after a request completes with token usage data (with cache support)
-type UsageCallback func(input, output, cacheWrite, cacheHit int64)
-
-// Provider interface for upstream providers
-type Provider interface {
-	Name() string
-	IsConfigured() bool
-	ForwardRequest(body []byte, isStreaming bool) (*http.Response, error)
-	HandleStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage UsageCallback)
-	HandleNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage UsageCallback)
-}
-
 // sanitizeError returns a generic error message (OpenAI format)
 func SanitizeError(statusCode int, originalError []byte) []byte {
 	log.Printf("🔒 [TrollProxy] Original error (hidden): %s", string(originalError))
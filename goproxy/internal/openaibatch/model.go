@@ -0,0 +1,356 @@
+package openaibatch
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Batch status (OpenAI Batch API). validating -> in_progress -> finalizing -> completed,
+// with failed (invalid input), expired (24h window passed) and cancelling -> cancelled on the side.
+const (
+	StatusValidating = "validating"
+	StatusFailed     = "failed"
+	StatusInProgress = "in_progress"
+	StatusFinalizing = "finalizing"
+	StatusCompleted  = "completed"
+	StatusExpired    = "expired"
+	StatusCancelling = "cancelling"
+	StatusCancelled  = "cancelled"
+)
+
+// Per-line status
+const (
+	RequestPending    = "pending"
+	RequestProcessing = "processing"
+	RequestDone       = "done"
+)
+
+// Line error codes for requests that never ran
+const (
+	ErrorCodeExpired   = "batch_expired"
+	ErrorCodeCancelled = "batch_cancelled"
+)
+
+const (
+	// CompletionWindow is the only window OpenAI accepts
+	CompletionWindow = "24h"
+	completionWindow = 24 * time.Hour
+
+	// EndpointChatCompletions is the only endpoint batches may target
+	EndpointChatCompletions = "/v1/chat/completions"
+
+	// MaxRequestsPerBatch matches the OpenAI limit
+	MaxRequestsPerBatch = 50000
+
+	// maxLineErrors caps the errors reported for an invalid input file
+	maxLineErrors = 100
+
+	maxLineSize = 10 << 20
+)
+
+var (
+	ErrNotFound  = errors.New("batch not found")
+	ErrNotActive = errors.New("batch cannot be cancelled in its current status")
+)
+
+// RequestCounts tallies lines by outcome
+type RequestCounts struct {
+	Total     int64 `bson:"total" json:"total"`
+	Completed int64 `bson:"completed" json:"completed"`
+	Failed    int64 `bson:"failed" json:"failed"`
+}
+
+// LineError is a validation error of the input file
+type LineError struct {
+	Code    string `bson:"code" json:"code"`
+	Message string `bson:"message" json:"message"`
+	Param   string `bson:"param,omitempty" json:"param"`
+	Line    int    `bson:"line,omitempty" json:"line"`
+}
+
+// Batch is a batch job stored in the openai_batches collection
+type Batch struct {
+	ID               string            `bson:"_id"`
+	UserID           string            `bson:"userId,omitempty"`
+	UserKeyID        string            `bson:"userKeyId"`
+	Endpoint         string            `bson:"endpoint"`
+	InputFileID      string            `bson:"inputFileId"`
+	CompletionWindow string            `bson:"completionWindow"`
+	Status           string            `bson:"status"`
+	OutputFileID     string            `bson:"outputFileId,omitempty"`
+	ErrorFileID      string            `bson:"errorFileId,omitempty"`
+	Errors           []LineError       `bson:"errors,omitempty"`
+	RequestCounts    RequestCounts     `bson:"requestCounts"`
+	Expired          int64             `bson:"expiredRequests"` // lines that expired before running
+	Metadata         map[string]string `bson:"metadata,omitempty"`
+	CreatedAt        time.Time         `bson:"createdAt"`
+	ExpiresAt        time.Time         `bson:"expiresAt"`
+	InProgressAt     *time.Time        `bson:"inProgressAt,omitempty"`
+	FinalizingAt     *time.Time        `bson:"finalizingAt,omitempty"`
+	CompletedAt      *time.Time        `bson:"completedAt,omitempty"`
+	FailedAt         *time.Time        `bson:"failedAt,omitempty"`
+	ExpiredAt        *time.Time        `bson:"expiredAt,omitempty"`
+	CancellingAt     *time.Time        `bson:"cancellingAt,omitempty"`
+	CancelledAt      *time.Time        `bson:"cancelledAt,omitempty"`
+	ClaimedAt        *time.Time        `bson:"claimedAt,omitempty"` // worker claim while validating/finalizing
+}
+
+// Request is one input line, stored in the openai_batch_requests collection.
+// IDs sort in batch creation order, then by line, so workers drain batches FIFO.
+type Request struct {
+	ID           string     `bson:"_id"`
+	BatchID      string     `bson:"batchId"`
+	Index        int        `bson:"index"`
+	CustomID     string     `bson:"customId"`
+	Body         string     `bson:"body"` // chat completions request body (JSON)
+	Status       string     `bson:"status"`
+	StatusCode   int        `bson:"statusCode,omitempty"`
+	Response     string     `bson:"response,omitempty"` // response body (JSON)
+	ErrorCode    string     `bson:"errorCode,omitempty"`
+	ErrorMessage string     `bson:"errorMessage,omitempty"`
+	CreatedAt    time.Time  `bson:"createdAt"`
+	ClaimedAt    *time.Time `bson:"claimedAt,omitempty"`
+}
+
+// Succeeded reports whether the line belongs in the output file rather than the error file
+func (r *Request) Succeeded() bool {
+	return r.ErrorCode == "" && r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// CreateParams is the body of POST /v1/batches
+type CreateParams struct {
+	InputFileID      string            `json:"input_file_id"`
+	Endpoint         string            `json:"endpoint"`
+	CompletionWindow string            `json:"completion_window"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// Validate checks the create parameters; the input file itself is validated by the worker
+func (p *CreateParams) Validate() error {
+	if p.InputFileID == "" {
+		return errors.New("input_file_id: is required")
+	}
+	if p.Endpoint != EndpointChatCompletions {
+		return fmt.Errorf("endpoint: only %s is supported", EndpointChatCompletions)
+	}
+	if p.CompletionWindow != CompletionWindow {
+		return fmt.Errorf("completion_window: only %s is supported", CompletionWindow)
+	}
+	if len(p.Metadata) > 16 {
+		return errors.New("metadata: at most 16 key-value pairs are allowed")
+	}
+	return nil
+}
+
+// NewBatch builds a batch awaiting validation
+func NewBatch(userID, userKeyID string, params *CreateParams, now time.Time) *Batch {
+	return &Batch{
+		ID:               "batch_" + primitive.NewObjectIDFromTimestamp(now).Hex(),
+		UserID:           userID,
+		UserKeyID:        userKeyID,
+		Endpoint:         params.Endpoint,
+		InputFileID:      params.InputFileID,
+		CompletionWindow: params.CompletionWindow,
+		Status:           StatusValidating,
+		Metadata:         params.Metadata,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(completionWindow),
+	}
+}
+
+// Done reports whether every line has finished
+func (b *Batch) Done() bool {
+	return b.RequestCounts.Completed+b.RequestCounts.Failed >= b.RequestCounts.Total
+}
+
+// FinalStatus is the status a finalized batch ends in
+func (b *Batch) FinalStatus() string {
+	switch {
+	case b.CancellingAt != nil:
+		return StatusCancelled
+	case b.Expired > 0:
+		return StatusExpired
+	default:
+		return StatusCompleted
+	}
+}
+
+// View returns the API representation of the batch
+func (b *Batch) View() map[string]interface{} {
+	view := map[string]interface{}{
+		"id":                b.ID,
+		"object":            "batch",
+		"endpoint":          b.Endpoint,
+		"errors":            nil,
+		"input_file_id":     b.InputFileID,
+		"completion_window": b.CompletionWindow,
+		"status":            b.Status,
+		"output_file_id":    nilIfEmpty(b.OutputFileID),
+		"error_file_id":     nilIfEmpty(b.ErrorFileID),
+		"created_at":        b.CreatedAt.Unix(),
+		"in_progress_at":    unixTime(b.InProgressAt),
+		"expires_at":        b.ExpiresAt.Unix(),
+		"finalizing_at":     unixTime(b.FinalizingAt),
+		"completed_at":      unixTime(b.CompletedAt),
+		"failed_at":         unixTime(b.FailedAt),
+		"expired_at":        unixTime(b.ExpiredAt),
+		"cancelling_at":     unixTime(b.CancellingAt),
+		"cancelled_at":      unixTime(b.CancelledAt),
+		"request_counts":    b.RequestCounts,
+		"metadata":          b.Metadata,
+	}
+	if len(b.Errors) > 0 {
+		view["errors"] = map[string]interface{}{"object": "list", "data": b.Errors}
+	}
+	return view
+}
+
+func nilIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func unixTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Unix()
+}
+
+// inputLine is one line of a batch input file
+type inputLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// ParseInput reads a JSONL input file into pending requests. Any invalid line fails the
+// whole batch, matching OpenAI; up to maxLineErrors errors are returned.
+func ParseInput(b *Batch, r io.Reader, now time.Time) ([]*Request, []LineError) {
+	var requests []*Request
+	var lineErrors []LineError
+	addError := func(line int, code, param, message string) {
+		if len(lineErrors) < maxLineErrors {
+			lineErrors = append(lineErrors, LineError{Code: code, Message: message, Param: param, Line: line})
+		}
+	}
+
+	seen := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+
+		var line inputLine
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			addError(lineNum, "invalid_json_line", "", "This line is not parseable as valid JSON.")
+			continue
+		}
+		if line.CustomID == "" {
+			addError(lineNum, "missing_required_parameter", "custom_id", "custom_id is required.")
+			continue
+		}
+		if _, dup := seen[line.CustomID]; dup {
+			addError(lineNum, "duplicate_custom_id", "custom_id", fmt.Sprintf("The custom_id '%s' is duplicated within the file.", line.CustomID))
+			continue
+		}
+		seen[line.CustomID] = struct{}{}
+		if line.Method != "POST" {
+			addError(lineNum, "invalid_method", "method", "method must be POST.")
+			continue
+		}
+		if line.URL != b.Endpoint {
+			addError(lineNum, "mismatched_endpoint", "url", fmt.Sprintf("url must match the batch endpoint %s.", b.Endpoint))
+			continue
+		}
+
+		var body map[string]interface{}
+		if err := json.Unmarshal(line.Body, &body); err != nil || body == nil {
+			addError(lineNum, "invalid_request", "body", "body must be a JSON object.")
+			continue
+		}
+		if model, _ := body["model"].(string); model == "" {
+			addError(lineNum, "missing_required_parameter", "body.model", "body.model is required.")
+			continue
+		}
+		if stream, _ := body["stream"].(bool); stream {
+			addError(lineNum, "invalid_request", "body.stream", "Streaming is not supported in batches.")
+			continue
+		}
+
+		requests = append(requests, &Request{
+			ID:        fmt.Sprintf("%s_%06d", b.ID, len(requests)),
+			BatchID:   b.ID,
+			Index:     len(requests),
+			CustomID:  line.CustomID,
+			Body:      string(line.Body),
+			Status:    RequestPending,
+			CreatedAt: now,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		addError(lineNum+1, "invalid_json_line", "", fmt.Sprintf("Failed to read input file: %v", err))
+	}
+
+	if len(lineErrors) == 0 {
+		switch {
+		case len(requests) == 0:
+			addError(0, "empty_file", "", "The input file contains no requests.")
+		case len(requests) > MaxRequestsPerBatch:
+			addError(0, "too_many_requests", "", fmt.Sprintf("A batch may contain at most %d requests.", MaxRequestsPerBatch))
+		}
+	}
+	if len(lineErrors) > 0 {
+		return nil, lineErrors
+	}
+	return requests, nil
+}
+
+// OutputLine returns the JSONL line written to the output or error file for a finished request
+func OutputLine(req *Request) []byte {
+	type lineResponse struct {
+		StatusCode int             `json:"status_code"`
+		RequestID  string          `json:"request_id"`
+		Body       json.RawMessage `json:"body"`
+	}
+	type lineError struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	out := struct {
+		ID       string        `json:"id"`
+		CustomID string        `json:"custom_id"`
+		Response *lineResponse `json:"response"`
+		Error    *lineError    `json:"error"`
+	}{ID: "batch_req_" + strings.TrimPrefix(req.ID, "batch_"), CustomID: req.CustomID}
+
+	if req.ErrorCode != "" {
+		out.Error = &lineError{Code: req.ErrorCode, Message: req.ErrorMessage}
+	} else {
+		body := json.RawMessage(req.Response)
+		if !json.Valid(body) {
+			body, _ = json.Marshal(map[string]interface{}{
+				"error": map[string]interface{}{"message": strings.TrimSpace(req.Response), "type": "api_error"},
+			})
+		}
+		out.Response = &lineResponse{StatusCode: req.StatusCode, RequestID: out.ID, Body: body}
+	}
+
+	line, _ := json.Marshal(out)
+	return append(line, '\n')
+}
@@ -0,0 +1,207 @@
+package openaibatch
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestBatch() *Batch {
+	return NewBatch("alice", "sk-test", &CreateParams{
+		InputFileID:      "file-1",
+		Endpoint:         EndpointChatCompletions,
+		CompletionWindow: CompletionWindow,
+	}, time.Now())
+}
+
+// =============================================================================
+// Create Params Tests
+// =============================================================================
+
+func TestCreateParamsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		errorHas string
+	}{
+		{"valid", `{"input_file_id":"file-1","endpoint":"/v1/chat/completions","completion_window":"24h"}`, ""},
+		{"missing file", `{"endpoint":"/v1/chat/completions","completion_window":"24h"}`, "input_file_id"},
+		{"unsupported endpoint", `{"input_file_id":"file-1","endpoint":"/v1/embeddings","completion_window":"24h"}`, "endpoint"},
+		{"unsupported window", `{"input_file_id":"file-1","endpoint":"/v1/chat/completions","completion_window":"1h"}`, "completion_window"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params CreateParams
+			if err := json.Unmarshal([]byte(tt.body), &params); err != nil {
+				t.Fatalf("invalid body: %v", err)
+			}
+			err := params.Validate()
+			if tt.errorHas == "" {
+				if err != nil {
+					t.Errorf("Expected valid, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errorHas) {
+				t.Errorf("Expected error containing %q, got %v", tt.errorHas, err)
+			}
+		})
+	}
+}
+
+// =============================================================================
+// Input File Tests
+// =============================================================================
+
+func TestParseInput(t *testing.T) {
+	line := func(customID, method, url, body string) string {
+		return `{"custom_id":"` + customID + `","method":"` + method + `","url":"` + url + `","body":` + body + `}`
+	}
+	valid := line("a", "POST", "/v1/chat/completions", `{"model":"m","messages":[]}`)
+
+	tests := []struct {
+		name      string
+		input     string
+		requests  int
+		errorCode string
+		errorLine int
+	}{
+		{"valid with blank lines", valid + "\n\n" + line("b", "POST", "/v1/chat/completions", `{"model":"m"}`) + "\n", 2, "", 0},
+		{"invalid json", valid + "\n{not json", 0, "invalid_json_line", 2},
+		{"duplicate custom_id", valid + "\n" + valid, 0, "duplicate_custom_id", 2},
+		{"wrong method", line("a", "GET", "/v1/chat/completions", `{"model":"m"}`), 0, "invalid_method", 1},
+		{"wrong url", line("a", "POST", "/v1/embeddings", `{"model":"m"}`), 0, "mismatched_endpoint", 1},
+		{"missing model", line("a", "POST", "/v1/chat/completions", `{}`), 0, "missing_required_parameter", 1},
+		{"streaming", line("a", "POST", "/v1/chat/completions", `{"model":"m","stream":true}`), 0, "invalid_request", 1},
+		{"empty", "\n", 0, "empty_file", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBatch()
+			requests, lineErrors := ParseInput(b, strings.NewReader(tt.input), time.Now())
+			if len(requests) != tt.requests {
+				t.Errorf("Expected %d requests, got %d", tt.requests, len(requests))
+			}
+			if tt.errorCode == "" {
+				if len(lineErrors) > 0 {
+					t.Errorf("Expected no errors, got %+v", lineErrors)
+				}
+				return
+			}
+			if len(lineErrors) != 1 || lineErrors[0].Code != tt.errorCode || lineErrors[0].Line != tt.errorLine {
+				t.Errorf("Expected %s on line %d, got %+v", tt.errorCode, tt.errorLine, lineErrors)
+			}
+		})
+	}
+}
+
+func TestParseInputRequestOrder(t *testing.T) {
+	b := newTestBatch()
+	input := `{"custom_id":"x","method":"POST","url":"/v1/chat/completions","body":{"model":"m"}}
+{"custom_id":"y","method":"POST","url":"/v1/chat/completions","body":{"model":"m"}}`
+	requests, _ := ParseInput(b, strings.NewReader(input), time.Now())
+
+	if len(requests) != 2 || requests[0].ID != b.ID+"_000000" || requests[1].ID != b.ID+"_000001" {
+		t.Fatalf("Unexpected request IDs: %+v", requests)
+	}
+	if requests[1].CustomID != "y" || requests[1].Body != `{"model":"m"}` || requests[1].Status != RequestPending {
+		t.Errorf("Unexpected request: %+v", requests[1])
+	}
+}
+
+// =============================================================================
+// Output File Tests
+// =============================================================================
+
+func TestOutputLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       Request
+		succeeded bool
+		expected  string
+	}{
+		{
+			"success",
+			Request{ID: "batch_abc_000001", CustomID: "a", StatusCode: 200, Response: `{"id":"chatcmpl-1"}`},
+			true,
+			`{"id":"batch_req_abc_000001","custom_id":"a","response":{"status_code":200,"request_id":"batch_req_abc_000001","body":{"id":"chatcmpl-1"}},"error":null}`,
+		},
+		{
+			"upstream error",
+			Request{ID: "batch_abc_000002", CustomID: "b", StatusCode: 402, Response: `{"error":{"message":"Insufficient credits"}}`},
+			false,
+			`{"id":"batch_req_abc_000002","custom_id":"b","response":{"status_code":402,"request_id":"batch_req_abc_000002","body":{"error":{"message":"Insufficient credits"}}},"error":null}`,
+		},
+		{
+			"plain text body",
+			Request{ID: "batch_abc_000003", CustomID: "c", StatusCode: 502, Response: "upstream failed\n"},
+			false,
+			`{"id":"batch_req_abc_000003","custom_id":"c","response":{"status_code":502,"request_id":"batch_req_abc_000003","body":{"error":{"message":"upstream failed","type":"api_error"}}},"error":null}`,
+		},
+		{
+			"expired",
+			Request{ID: "batch_abc_000004", CustomID: "d", ErrorCode: ErrorCodeExpired, ErrorMessage: "too late"},
+			false,
+			`{"id":"batch_req_abc_000004","custom_id":"d","response":null,"error":{"code":"batch_expired","message":"too late"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.req.Succeeded() != tt.succeeded {
+				t.Errorf("Expected Succeeded()=%v", tt.succeeded)
+			}
+			if got := string(OutputLine(&tt.req)); got != tt.expected+"\n" {
+				t.Errorf("Unexpected line:\n got %s\nwant %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+// =============================================================================
+// Batch Status Tests
+// =============================================================================
+
+func TestFinalStatus(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		batch    Batch
+		expected string
+	}{
+		{"completed", Batch{RequestCounts: RequestCounts{Total: 2, Completed: 1, Failed: 1}}, StatusCompleted},
+		{"expired lines", Batch{Expired: 1}, StatusExpired},
+		{"cancelled", Batch{CancellingAt: &now, Expired: 1}, StatusCancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.batch.FinalStatus(); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBatchView(t *testing.T) {
+	b := newTestBatch()
+	view := b.View()
+
+	if !strings.HasPrefix(b.ID, "batch_") || view["object"] != "batch" || view["status"] != StatusValidating {
+		t.Errorf("Unexpected view: %+v", view)
+	}
+	if view["expires_at"].(int64)-view["created_at"].(int64) != int64((24 * time.Hour).Seconds()) {
+		t.Errorf("Expected a 24h completion window, got %+v", view)
+	}
+	if view["output_file_id"] != nil || view["errors"] != nil || view["completed_at"] != nil {
+		t.Errorf("Expected unset fields to be null, got %+v", view)
+	}
+
+	b.Errors = []LineError{{Code: "invalid_json_line", Line: 3}}
+	if errs, ok := b.View()["errors"].(map[string]interface{}); !ok || errs["object"] != "list" {
+		t.Errorf("Expected errors list, got %+v", b.View()["errors"])
+	}
+}
@@ -0,0 +1,340 @@
+package openaibatch
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"goproxy/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Store persists batches and their requests
+type Store interface {
+	CreateBatch(ctx context.Context, b *Batch) error
+	GetBatch(ctx context.Context, id string) (*Batch, error)
+	// ListBatches returns the key's batches newest first, paging to older batches with afterID
+	ListBatches(ctx context.Context, userKeyID string, limit int, afterID string) ([]*Batch, bool, error)
+	// ClaimBatch claims a batch in status (validating or finalizing) that no worker holds,
+	// or whose claim is older than staleBefore; nil when there is none
+	ClaimBatch(ctx context.Context, status string, staleBefore time.Time) (*Batch, error)
+	// StartBatch stores the parsed requests and moves a validating batch to in_progress
+	StartBatch(ctx context.Context, b *Batch, requests []*Request) error
+	// FailBatch marks a validating batch failed with the input file errors
+	FailBatch(ctx context.Context, id string, lineErrors []LineError) error
+	// ClaimNextRequest marks the oldest pending request as processing; nil when none is pending
+	ClaimNextRequest(ctx context.Context) (*Request, error)
+	// CompleteRequest stores the outcome, updates the counts and moves the batch to
+	// finalizing once every line is done
+	CompleteRequest(ctx context.Context, req *Request) error
+	// CancelBatch moves a validating or in-progress batch to cancelling and cancels its pending requests
+	CancelBatch(ctx context.Context, id string) (*Batch, error)
+	// EachRequest calls fn for every request of the batch in line order
+	EachRequest(ctx context.Context, batchID string, fn func(*Request) error) error
+	// FinishBatch moves a finalizing batch to its final status with the written files
+	FinishBatch(ctx context.Context, id, status, outputFileID, errorFileID string) error
+	// RequeueStale returns requests claimed before olderThan (e.g. by a crashed worker) to pending
+	RequeueStale(ctx context.Context, olderThan time.Time) (int64, error)
+	// ReleaseRequest returns a claimed request to pending, e.g. one whose run was cancelled
+	ReleaseRequest(ctx context.Context, req *Request) error
+}
+
+// MongoStore stores batches in openai_batches and requests in openai_batch_requests
+type MongoStore struct{}
+
+// NewMongoStore creates a MongoDB-backed store
+func NewMongoStore() *MongoStore {
+	return &MongoStore{}
+}
+
+// EnsureIndexes creates the indexes used by workers and list queries
+func (s *MongoStore) EnsureIndexes(ctx context.Context) {
+	if _, err := db.OpenAIBatchRequestsCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "batchId", Value: 1}, {Key: "index", Value: 1}}},
+	}); err != nil {
+		log.Printf("⚠️ [OpenAIBatch] Failed to create request indexes: %v", err)
+	}
+	if _, err := db.OpenAIBatchesCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userKeyId", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+	}); err != nil {
+		log.Printf("⚠️ [OpenAIBatch] Failed to create batch indexes: %v", err)
+	}
+}
+
+func (s *MongoStore) CreateBatch(ctx context.Context, b *Batch) error {
+	_, err := db.OpenAIBatchesCollection().InsertOne(ctx, b)
+	return err
+}
+
+func (s *MongoStore) GetBatch(ctx context.Context, id string) (*Batch, error) {
+	var b Batch
+	if err := db.OpenAIBatchesCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&b); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *MongoStore) ListBatches(ctx context.Context, userKeyID string, limit int, afterID string) ([]*Batch, bool, error) {
+	filter := bson.M{"userKeyId": userKeyID}
+	if afterID != "" {
+		filter["_id"] = bson.M{"$lt": afterID}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(limit + 1))
+	cursor, err := db.OpenAIBatchesCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	var batches []*Batch
+	if err := cursor.All(ctx, &batches); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(batches) > limit
+	if hasMore {
+		batches = batches[:limit]
+	}
+	return batches, hasMore, nil
+}
+
+func (s *MongoStore) ClaimBatch(ctx context.Context, status string, staleBefore time.Time) (*Batch, error) {
+	var b Batch
+	err := db.OpenAIBatchesCollection().FindOneAndUpdate(
+		ctx,
+		bson.M{"status": status, "$or": bson.A{
+			bson.M{"claimedAt": bson.M{"$exists": false}},
+			bson.M{"claimedAt": bson.M{"$lt": staleBefore}},
+		}},
+		bson.M{"$set": bson.M{"claimedAt": time.Now()}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "_id", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&b)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *MongoStore) StartBatch(ctx context.Context, b *Batch, requests []*Request) error {
+	// A re-claimed validation may have inserted some requests already
+	if _, err := db.OpenAIBatchRequestsCollection().DeleteMany(ctx, bson.M{"batchId": b.ID}); err != nil {
+		return err
+	}
+	docs := make([]interface{}, 0, len(requests))
+	for _, req := range requests {
+		docs = append(docs, req)
+	}
+	if _, err := db.OpenAIBatchRequestsCollection().InsertMany(ctx, docs, options.InsertMany().SetOrdered(false)); err != nil {
+		return err
+	}
+
+	res, err := db.OpenAIBatchesCollection().UpdateOne(ctx,
+		bson.M{"_id": b.ID, "status": StatusValidating},
+		bson.M{
+			"$set":   bson.M{"status": StatusInProgress, "inProgressAt": time.Now(), "requestCounts.total": int64(len(requests))},
+			"$unset": bson.M{"claimedAt": ""},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		// Cancelled while validating: the batch already finalized without requests
+		_, err := db.OpenAIBatchRequestsCollection().DeleteMany(ctx, bson.M{"batchId": b.ID})
+		return err
+	}
+	return nil
+}
+
+func (s *MongoStore) FailBatch(ctx context.Context, id string, lineErrors []LineError) error {
+	_, err := db.OpenAIBatchesCollection().UpdateOne(ctx,
+		bson.M{"_id": id, "status": StatusValidating},
+		bson.M{
+			"$set":   bson.M{"status": StatusFailed, "failedAt": time.Now(), "errors": lineErrors},
+			"$unset": bson.M{"claimedAt": ""},
+		},
+	)
+	return err
+}
+
+func (s *MongoStore) ClaimNextRequest(ctx context.Context) (*Request, error) {
+	var req Request
+	err := db.OpenAIBatchRequestsCollection().FindOneAndUpdate(
+		ctx,
+		bson.M{"status": RequestPending},
+		bson.M{"$set": bson.M{"status": RequestProcessing, "claimedAt": time.Now()}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "_id", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&req)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (s *MongoStore) CompleteRequest(ctx context.Context, req *Request) error {
+	res, err := db.OpenAIBatchRequestsCollection().UpdateOne(ctx,
+		bson.M{"_id": req.ID, "status": RequestProcessing},
+		bson.M{"$set": bson.M{
+			"status":       RequestDone,
+			"statusCode":   req.StatusCode,
+			"response":     req.Response,
+			"errorCode":    req.ErrorCode,
+			"errorMessage": req.ErrorMessage,
+		}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		// Already finished elsewhere (e.g. requeued and completed twice)
+		return nil
+	}
+
+	inc := bson.M{}
+	if req.Succeeded() {
+		inc["requestCounts.completed"] = int64(1)
+	} else {
+		inc["requestCounts.failed"] = int64(1)
+	}
+	if req.ErrorCode == ErrorCodeExpired {
+		inc["expiredRequests"] = int64(1)
+	}
+	if _, err := db.OpenAIBatchesCollection().UpdateOne(ctx, bson.M{"_id": req.BatchID}, bson.M{"$inc": inc}); err != nil {
+		return err
+	}
+	return s.finalizeIfDone(ctx, req.BatchID)
+}
+
+func (s *MongoStore) CancelBatch(ctx context.Context, id string) (*Batch, error) {
+	res, err := db.OpenAIBatchesCollection().UpdateOne(ctx,
+		bson.M{"_id": id, "status": bson.M{"$in": bson.A{StatusValidating, StatusInProgress}}},
+		bson.M{"$set": bson.M{"status": StatusCancelling, "cancellingAt": time.Now()}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		if _, err := s.GetBatch(ctx, id); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotActive
+	}
+
+	// Requests already processing finish normally; pending ones are cancelled now
+	cancelled, err := db.OpenAIBatchRequestsCollection().UpdateMany(ctx,
+		bson.M{"batchId": id, "status": RequestPending},
+		bson.M{"$set": bson.M{"status": RequestDone, "errorCode": ErrorCodeCancelled, "errorMessage": "The batch was cancelled before this request ran."}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if cancelled.ModifiedCount > 0 {
+		if _, err := db.OpenAIBatchesCollection().UpdateOne(ctx,
+			bson.M{"_id": id},
+			bson.M{"$inc": bson.M{"requestCounts.failed": cancelled.ModifiedCount}},
+		); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.finalizeIfDone(ctx, id); err != nil {
+		return nil, err
+	}
+	return s.GetBatch(ctx, id)
+}
+
+// finalizeIfDone hands a batch with no lines left to the finalizing workers
+func (s *MongoStore) finalizeIfDone(ctx context.Context, batchID string) error {
+	res, err := db.OpenAIBatchesCollection().UpdateOne(ctx,
+		bson.M{
+			"_id":    batchID,
+			"status": bson.M{"$in": bson.A{StatusInProgress, StatusCancelling}},
+			"$expr":  bson.M{"$gte": bson.A{bson.M{"$add": bson.A{"$requestCounts.completed", "$requestCounts.failed"}}, "$requestCounts.total"}},
+		},
+		bson.M{
+			"$set":   bson.M{"status": StatusFinalizing, "finalizingAt": time.Now()},
+			"$unset": bson.M{"claimedAt": ""},
+		},
+	)
+	if err == nil && res.ModifiedCount > 0 {
+		log.Printf("📝 [OpenAIBatch] %s finalizing", batchID)
+	}
+	return err
+}
+
+func (s *MongoStore) EachRequest(ctx context.Context, batchID string, fn func(*Request) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "index", Value: 1}}).SetProjection(bson.M{"body": 0})
+	cursor, err := db.OpenAIBatchRequestsCollection().Find(ctx, bson.M{"batchId": batchID}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var req Request
+		if err := cursor.Decode(&req); err != nil {
+			return err
+		}
+		if err := fn(&req); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *MongoStore) FinishBatch(ctx context.Context, id, status, outputFileID, errorFileID string) error {
+	set := bson.M{"status": status, statusTimeField(status): time.Now()}
+	if outputFileID != "" {
+		set["outputFileId"] = outputFileID
+	}
+	if errorFileID != "" {
+		set["errorFileId"] = errorFileID
+	}
+	_, err := db.OpenAIBatchesCollection().UpdateOne(ctx,
+		bson.M{"_id": id, "status": StatusFinalizing},
+		bson.M{"$set": set, "$unset": bson.M{"claimedAt": ""}},
+	)
+	return err
+}
+
+func statusTimeField(status string) string {
+	switch status {
+	case StatusCancelled:
+		return "cancelledAt"
+	case StatusExpired:
+		return "expiredAt"
+	default:
+		return "completedAt"
+	}
+}
+
+func (s *MongoStore) RequeueStale(ctx context.Context, olderThan time.Time) (int64, error) {
+	res, err := db.OpenAIBatchRequestsCollection().UpdateMany(ctx,
+		bson.M{"status": RequestProcessing, "claimedAt": bson.M{"$lt": olderThan}},
+		bson.M{"$set": bson.M{"status": RequestPending}, "$unset": bson.M{"claimedAt": ""}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (s *MongoStore) ReleaseRequest(ctx context.Context, req *Request) error {
+	_, err := db.OpenAIBatchRequestsCollection().UpdateOne(ctx,
+		bson.M{"_id": req.ID, "status": RequestProcessing},
+		bson.M{"$set": bson.M{"status": RequestPending}, "$unset": bson.M{"claimedAt": ""}},
+	)
+	return err
+}
@@ -0,0 +1,330 @@
+package openaibatch
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"goproxy/internal/files"
+)
+
+// Executor runs one input line through the normal /v1/chat/completions pipeline (billed at
+// batch rates) and returns the response status and body
+type Executor func(ctx context.Context, b *Batch, body []byte) (statusCode int, response []byte)
+
+const (
+	idlePollInterval  = 5 * time.Second
+	yieldInterval     = 1 * time.Second
+	staleClaimTimeout = 30 * time.Minute
+	storeTimeout      = 10 * time.Second
+	fileTimeout       = 10 * time.Minute
+)
+
+// Pool validates input files, drains pending lines and writes output files with a fixed
+// number of workers. Batches are low priority: workers pause whenever Yield reports interactive load.
+type Pool struct {
+	store   Store
+	execute Executor
+	workers int
+	yield   func() bool
+	wake    chan struct{}
+	stop    chan struct{}
+	ctx     context.Context // runs the work; cancelled once Stop stops waiting for it
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	now     func() time.Time
+}
+
+// NewPool creates a worker pool. yield may be nil.
+func NewPool(store Store, execute Executor, workers int, yield func() bool) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	if yield == nil {
+		yield = func() bool { return false }
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Pool{
+		store:   store,
+		execute: execute,
+		workers: workers,
+		yield:   yield,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+		now:     time.Now,
+	}
+}
+
+// Start launches the workers and the stale-claim recovery loop
+func (p *Pool) Start() {
+	log.Printf("📦 [OpenAIBatch] Starting %d batch workers", p.workers)
+	go p.requeueLoop()
+	p.wg.Add(p.workers)
+	for i := 0; i < p.workers; i++ {
+		go p.worker()
+	}
+}
+
+// Stop stops the workers and waits for the work they are doing until ctx is done, then
+// cancels it and waits for the workers to return. A cancelled request that did not succeed
+// goes back to pending; other work cut off is claimed again once its claim is stale.
+func (p *Pool) Stop(ctx context.Context) {
+	close(p.stop)
+	defer p.cancel()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	log.Printf("⚠️ [OpenAIBatch] Cancelling the batch requests still running")
+	p.cancel()
+	<-done
+}
+
+// Wake signals idle workers that there is work
+func (p *Pool) Wake() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Pool) worker() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		if p.yield() {
+			select {
+			case <-time.After(yieldInterval):
+			case <-p.stop:
+			}
+			continue
+		}
+		if p.processNext(p.ctx) {
+			continue
+		}
+		select {
+		case <-p.wake:
+		case <-time.After(idlePollInterval):
+		case <-p.stop:
+		}
+	}
+}
+
+// processNext does one unit of work: finalize a finished batch, validate a new batch,
+// or run one pending line. False when there is nothing to do.
+func (p *Pool) processNext(ctx context.Context) bool {
+	staleBefore := p.now().Add(-staleClaimTimeout)
+	for _, status := range []string{StatusFinalizing, StatusValidating} {
+		claimCtx, cancel := context.WithTimeout(ctx, storeTimeout)
+		b, err := p.store.ClaimBatch(claimCtx, status, staleBefore)
+		cancel()
+		if err != nil {
+			log.Printf("⚠️ [OpenAIBatch] Failed to claim %s batch: %v", status, err)
+			return false
+		}
+		if b == nil {
+			continue
+		}
+		if status == StatusFinalizing {
+			p.finalize(ctx, b)
+		} else {
+			p.validate(ctx, b)
+		}
+		return true
+	}
+
+	claimCtx, cancel := context.WithTimeout(ctx, storeTimeout)
+	req, err := p.store.ClaimNextRequest(claimCtx)
+	cancel()
+	if err != nil {
+		log.Printf("⚠️ [OpenAIBatch] Failed to claim request: %v", err)
+		return false
+	}
+	if req == nil {
+		return false
+	}
+
+	p.run(ctx, req)
+
+	// The claim is ended even if ctx was cancelled by Stop
+	storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), storeTimeout)
+	defer cancel()
+	if ctx.Err() != nil && !req.Succeeded() {
+		// Cut off by Stop: the next worker runs it again instead of storing the cancellation
+		if err := p.store.ReleaseRequest(storeCtx, req); err != nil {
+			log.Printf("⚠️ [OpenAIBatch] Failed to release %s/%s, it is claimed again once stale: %v", req.BatchID, req.CustomID, err)
+		}
+		return true
+	}
+	if err := p.store.CompleteRequest(storeCtx, req); err != nil {
+		log.Printf("❌ [OpenAIBatch] Failed to store result for %s/%s: %v", req.BatchID, req.CustomID, err)
+	}
+	return true
+}
+
+// validate parses the input file and either starts or fails the batch
+func (p *Pool) validate(ctx context.Context, b *Batch) {
+	fileCtx, cancel := context.WithTimeout(ctx, fileTimeout)
+	defer cancel()
+
+	input, err := files.Open(b.InputFileID)
+	if err == files.ErrNotFound {
+		p.store.FailBatch(fileCtx, b.ID, []LineError{{Code: "invalid_file", Message: "The input file no longer exists.", Param: "input_file_id"}})
+		return
+	}
+	if err != nil {
+		// Leave the claim to go stale so another worker retries
+		log.Printf("⚠️ [OpenAIBatch] %s: failed to open input file %s: %v", b.ID, b.InputFileID, err)
+		return
+	}
+	requests, lineErrors := ParseInput(b, input, p.now())
+	input.Close()
+
+	if len(lineErrors) > 0 {
+		log.Printf("❌ [OpenAIBatch] %s failed validation (%d errors)", b.ID, len(lineErrors))
+		if err := p.store.FailBatch(fileCtx, b.ID, lineErrors); err != nil {
+			log.Printf("⚠️ [OpenAIBatch] Failed to mark %s failed: %v", b.ID, err)
+		}
+		return
+	}
+	if err := p.store.StartBatch(fileCtx, b, requests); err != nil {
+		log.Printf("⚠️ [OpenAIBatch] Failed to start %s: %v", b.ID, err)
+		return
+	}
+	log.Printf("📦 [OpenAIBatch] %s in progress (%d requests)", b.ID, len(requests))
+	p.Wake()
+}
+
+// run fills in the outcome of a claimed line, calling the executor unless the batch is
+// cancelling or past its completion window
+func (p *Pool) run(ctx context.Context, req *Request) {
+	getCtx, cancel := context.WithTimeout(ctx, storeTimeout)
+	b, err := p.store.GetBatch(getCtx, req.BatchID)
+	cancel()
+	if err != nil {
+		log.Printf("⚠️ [OpenAIBatch] Failed to load batch %s: %v", req.BatchID, err)
+		req.StatusCode, req.Response = 500, `{"error":{"message":"Failed to load batch","type":"server_error"}}`
+		return
+	}
+
+	switch {
+	case b.Status == StatusCancelling:
+		req.ErrorCode, req.ErrorMessage = ErrorCodeCancelled, "The batch was cancelled before this request ran."
+		return
+	case !p.now().Before(b.ExpiresAt):
+		req.ErrorCode, req.ErrorMessage = ErrorCodeExpired, "This request could not be executed before the completion window expired."
+		return
+	}
+
+	start := p.now()
+	statusCode, response := p.execute(ctx, b, []byte(req.Body))
+	req.StatusCode, req.Response = statusCode, string(response)
+	log.Printf("📦 [OpenAIBatch] %s/%s -> %d (%v)", req.BatchID, req.CustomID, statusCode, time.Since(start))
+}
+
+// finalize writes successful lines to the output file and the rest to the error file.
+// On failure the claim goes stale and another worker retries.
+func (p *Pool) finalize(ctx context.Context, b *Batch) {
+	fileCtx, cancel := context.WithTimeout(ctx, fileTimeout)
+	defer cancel()
+
+	output := &lazyFile{userKeyID: b.UserKeyID, filename: b.ID + "_output.jsonl"}
+	errorsFile := &lazyFile{userKeyID: b.UserKeyID, filename: b.ID + "_error.jsonl"}
+	err := p.store.EachRequest(fileCtx, b.ID, func(req *Request) error {
+		if req.Succeeded() {
+			return output.write(OutputLine(req))
+		}
+		return errorsFile.write(OutputLine(req))
+	})
+
+	var outputID, errorID string
+	if err == nil {
+		outputID, err = output.close(fileCtx)
+	}
+	if err == nil {
+		errorID, err = errorsFile.close(fileCtx)
+	}
+	if err != nil {
+		output.abort()
+		errorsFile.abort()
+		log.Printf("❌ [OpenAIBatch] Failed to write files for %s: %v", b.ID, err)
+		return
+	}
+
+	status := b.FinalStatus()
+	if err := p.store.FinishBatch(fileCtx, b.ID, status, outputID, errorID); err != nil {
+		log.Printf("❌ [OpenAIBatch] Failed to finish %s: %v", b.ID, err)
+		return
+	}
+	log.Printf("✅ [OpenAIBatch] %s %s (completed=%d, failed=%d)", b.ID, status, b.RequestCounts.Completed, b.RequestCounts.Failed)
+}
+
+// lazyFile creates its batch_output file on first write so empty files are never stored
+type lazyFile struct {
+	userKeyID string
+	filename  string
+	writer    *files.Writer
+}
+
+func (f *lazyFile) write(line []byte) error {
+	if f.writer == nil {
+		w, err := files.Create(f.userKeyID, f.filename, files.PurposeBatchOutput)
+		if err != nil {
+			return err
+		}
+		f.writer = w
+	}
+	_, err := f.writer.Write(line)
+	return err
+}
+
+func (f *lazyFile) close(ctx context.Context) (string, error) {
+	if f.writer == nil {
+		return "", nil
+	}
+	file, err := f.writer.Close(ctx)
+	if err != nil {
+		return "", err
+	}
+	f.writer = nil
+	return file.ID, nil
+}
+
+func (f *lazyFile) abort() {
+	if f.writer != nil {
+		f.writer.Abort()
+	}
+}
+
+func (p *Pool) requeueLoop() {
+	ticker := time.NewTicker(staleClaimTimeout / 2)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		if n, err := p.store.RequeueStale(ctx, p.now().Add(-staleClaimTimeout)); err != nil {
+			log.Printf("⚠️ [OpenAIBatch] Failed to requeue stale requests: %v", err)
+		} else if n > 0 {
+			log.Printf("🔄 [OpenAIBatch] Requeued %d stale requests", n)
+			p.Wake()
+		}
+		cancel()
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
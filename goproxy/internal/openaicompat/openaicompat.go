@@ -0,0 +1,308 @@
+package openaicompat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"goproxy/internal/provider"
+	"goproxy/internal/sse"
+	"goproxy/transformers"
+
+	"golang.org/x/net/http2"
+)
+
+// OpenAICompatType is a generic OpenAI-compatible /v1/chat/completions server
+// (Modal, vLLM, llama.cpp, ...)
+const OpenAICompatType = "openai_compat"
+
+func init() {
+	provider.RegisterType(OpenAICompatType, func(spec provider.Spec) (provider.Provider, error) {
+		return New(spec)
+	})
+}
+
+// Upstream is an OpenAI-compatible server with an optional single API key
+type Upstream struct {
+	name       string
+	baseURL    string
+	apiKey     string
+	keyEnv     string
+	authHeader string
+	httpClient *http.Client
+}
+
+// New creates an instance from its spec. base_url is required; the API key is read
+// from api_key_env and sent in auth_header. Without api_key_env no auth header is sent.
+func New(spec provider.Spec) (*Upstream, error) {
+	if spec.BaseURL == "" {
+		return nil, fmt.Errorf("base_url is required for %s upstreams", OpenAICompatType)
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	// Enable HTTP/2
+	http2.ConfigureTransport(transport)
+
+	u := &Upstream{
+		name:       spec.Name,
+		baseURL:    strings.TrimSuffix(spec.BaseURL, "/"),
+		keyEnv:     spec.APIKeyEnv,
+		authHeader: spec.AuthHeader,
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   5 * time.Minute,
+		},
+	}
+	if u.authHeader == "" {
+		u.authHeader = "Authorization"
+	}
+	if u.keyEnv != "" {
+		u.apiKey = os.Getenv(u.keyEnv)
+	}
+
+	if u.IsConfigured() {
+		log.Printf("✅ [OpenAI-Compat] %s configured (endpoint: %s)", u.name, u.Endpoint())
+	} else {
+		log.Printf("⚠️ [OpenAI-Compat] %s not configured (%s not set)", u.name, u.keyEnv)
+	}
+	return u, nil
+}
+
+// Name returns the instance name
+func (u *Upstream) Name() string {
+	return u.name
+}
+
+// Type returns the provider type
+func (u *Upstream) Type() string {
+	return OpenAICompatType
+}
+
+// IsConfigured returns true if the instance has a base URL and, when api_key_env is set, a key
+func (u *Upstream) IsConfigured() bool {
+	return u != nil && u.baseURL != "" && (u.keyEnv == "" || u.apiKey != "")
+}
+
+// Endpoint returns the instance's /v1/chat/completions URL
+func (u *Upstream) Endpoint() string {
+	return u.baseURL + "/v1/chat/completions"
+}
+
+// ForwardRequest sends an OpenAI-format request body to the instance.
+// The caller must have already set the model field to the upstream model ID.
+// Streaming requests ask for a final usage chunk so the stream can be billed.
+func (u *Upstream) ForwardRequest(ctx context.Context, body []byte, isStreaming bool) (*http.Response, error) {
+	if !u.IsConfigured() {
+		return nil, fmt.Errorf("%s upstream not configured", u.name)
+	}
+	if isStreaming {
+		body = withStreamUsage(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.Endpoint(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s request: %w", u.name, err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if u.apiKey != "" {
+		if strings.EqualFold(u.authHeader, "Authorization") {
+			req.Header.Set("Authorization", "Bearer "+u.apiKey)
+		} else {
+			req.Header.Set(u.authHeader, u.apiKey)
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+	if isStreaming {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+
+	log.Printf("📤 [OpenAI-Compat] %s POST %s", u.name, u.Endpoint())
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s request failed: %w", u.name, err)
+	}
+
+	if resp.StatusCode >= 400 {
+		// Read error body for logging
+		errBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		log.Printf("❌ [OpenAI-Compat] %s upstream error %d: %s", u.name, resp.StatusCode, string(errBody))
+		// Return a new response with the error body so the caller can handle it
+		resp.Body = io.NopCloser(bytes.NewReader(errBody))
+	}
+
+	return resp, nil
+}
+
+// withStreamUsage sets stream_options.include_usage unless the client already set stream_options
+func withStreamUsage(body []byte) []byte {
+	var reqMap map[string]interface{}
+	if err := json.Unmarshal(body, &reqMap); err != nil {
+		return body
+	}
+	if _, ok := reqMap["stream_options"]; ok {
+		return body
+	}
+	reqMap["stream_options"] = map[string]interface{}{"include_usage": true}
+	if mapped, err := json.Marshal(reqMap); err == nil {
+		return mapped
+	}
+	return body
+}
+
+// usageFrom extracts prompt, completion and cached prompt tokens from an OpenAI usage object
+func usageFrom(usage map[string]interface{}) (input, output, cached int64) {
+	if v, ok := usage["prompt_tokens"].(float64); ok {
+		input = int64(v)
+	}
+	if v, ok := usage["completion_tokens"].(float64); ok {
+		output = int64(v)
+	}
+	if details, ok := usage["prompt_tokens_details"].(map[string]interface{}); ok {
+		if v, ok := details["cached_tokens"].(float64); ok {
+			cached = int64(v)
+		}
+	}
+	return input, output, cached
+}
+
+// sanitizeError returns a generic error message (OpenAI format)
+func (u *Upstream) sanitizeError(statusCode int, originalError []byte) []byte {
+	log.Printf("🔒 [OpenAI-Compat] %s original error (hidden): %s", u.name, string(originalError))
+	switch statusCode {
+	case 400:
+		return []byte(`{"error":{"message":"Bad request","type":"invalid_request_error","code":"invalid_request_error"}}`)
+	case 401, 403:
+		return []byte(`{"error":{"message":"Upstream authentication failed","type":"server_error","code":"server_error"}}`)
+	case 404:
+		return []byte(`{"error":{"message":"Model not found","type":"not_found_error","code":"not_found"}}`)
+	case 429:
+		return []byte(`{"error":{"message":"Rate limit exceeded","type":"rate_limit_error","code":"rate_limit_exceeded"}}`)
+	case 500, 502, 503, 504:
+		return []byte(`{"error":{"message":"Upstream service unavailable","type":"server_error","code":"server_error"}}`)
+	default:
+		return []byte(`{"error":{"message":"Request failed","type":"api_error","code":"api_error"}}`)
+	}
+}
+
+// HandleStreamResponse passes an OpenAI stream through and reports its usage chunk
+func (u *Upstream) HandleStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage provider.UsageCallback) {
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(u.sanitizeError(resp.StatusCode, body))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, `{"error":"streaming not supported"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Keepalives stop idle timeouts from dropping the connection while upstream is silent
+	heartbeat := sse.StartHeartbeat(w, sse.OpenAIKeepalive)
+	defer heartbeat.Stop()
+	w, flusher = heartbeat, heartbeat
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024)
+
+	var totalInput, totalOutput, cacheHit int64
+	var delivered transformers.DeliveredOutput
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "data: ") {
+			dataStr := strings.TrimPrefix(line, "data: ")
+			if dataStr != "[DONE]" {
+				var event map[string]interface{}
+				if json.Unmarshal([]byte(dataStr), &event) == nil {
+					delivered.AddOpenAIChunk(event)
+					if usage, ok := event["usage"].(map[string]interface{}); ok {
+						totalInput, totalOutput, cacheHit = usageFrom(usage)
+					}
+				}
+			}
+		}
+
+		// Pure passthrough - forward line as-is
+		fmt.Fprintf(w, "%s\n", line)
+		flusher.Flush()
+	}
+
+	if err := scanner.Err(); err != nil {
+		if !transformers.ClientCancelled(resp) {
+			log.Printf("❌ [OpenAI-Compat] %s scanner error: %v", u.name, err)
+			fmt.Fprintf(w, "data: {\"error\":{\"message\":\"Stream interrupted\",\"type\":\"stream_error\"}}\n\n")
+			flusher.Flush()
+			return
+		}
+		log.Printf("🛑 [OpenAI-Compat] %s client cancelled stream", u.name)
+	}
+
+	// Servers that ignore include_usage (or cancelled streams) have no usage chunk:
+	// bill the output that was actually delivered
+	if totalOutput == 0 {
+		totalOutput = delivered.Tokens(modelID)
+	}
+
+	log.Printf("📊 [OpenAI-Compat] %s stream usage: in=%d out=%d cached=%d", u.name, totalInput, totalOutput, cacheHit)
+	if onUsage != nil && (totalInput > 0 || totalOutput > 0) {
+		onUsage(totalInput, totalOutput, 0, cacheHit)
+	}
+}
+
+// HandleNonStreamResponse passes an OpenAI response through and reports its usage
+func (u *Upstream) HandleNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage provider.UsageCallback) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, `{"error":"failed to read response"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(u.sanitizeError(resp.StatusCode, body))
+		return
+	}
+
+	var response map[string]interface{}
+	if json.Unmarshal(body, &response) == nil {
+		if usage, ok := response["usage"].(map[string]interface{}); ok {
+			input, output, cached := usageFrom(usage)
+			log.Printf("📊 [OpenAI-Compat] %s usage: in=%d out=%d cached=%d", u.name, input, output, cached)
+			if onUsage != nil && (input > 0 || output > 0) {
+				onUsage(input, output, 0, cached)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,80 @@
+package openaicompat
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"goproxy/internal/provider"
+)
+
+func TestForwardStreamRequestsUsage(t *testing.T) {
+	var gotAuth string
+	var gotBody map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("path = %s, want /v1/chat/completions", r.URL.Path)
+		}
+		gotAuth = r.Header.Get("X-Api-Key")
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &gotBody)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n")
+		io.WriteString(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":12,\"completion_tokens\":3,\"prompt_tokens_details\":{\"cached_tokens\":8}}}\n\n")
+		io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	t.Setenv("TEST_COMPAT_KEY", "secret")
+	u, err := New(provider.Spec{Name: "vllm", BaseURL: server.URL + "/", APIKeyEnv: "TEST_COMPAT_KEY", AuthHeader: "x-api-key"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	resp, err := u.ForwardRequest(context.Background(), []byte(`{"model":"zai-org/GLM-5-FP8","stream":true}`), true)
+	if err != nil {
+		t.Fatalf("ForwardRequest: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if gotAuth != "secret" {
+		t.Fatalf("x-api-key = %q, want raw key", gotAuth)
+	}
+	if opts, _ := gotBody["stream_options"].(map[string]interface{}); opts["include_usage"] != true {
+		t.Fatalf("stream_options = %v, want include_usage", gotBody["stream_options"])
+	}
+
+	var input, output, cacheHit int64
+	rec := httptest.NewRecorder()
+	u.HandleStreamResponse(rec, resp, "glm-5", func(in, out, cw, ch int64) {
+		input, output, cacheHit = in, out, ch
+	})
+	if input != 12 || output != 3 || cacheHit != 8 {
+		t.Fatalf("usage = in %d out %d cached %d, want 12/3/8", input, output, cacheHit)
+	}
+	if !strings.Contains(rec.Body.String(), "data: [DONE]") {
+		t.Fatal("stream should be passed through to the client")
+	}
+}
+
+func TestConfigured(t *testing.T) {
+	if _, err := New(provider.Spec{Name: "no-url"}); err == nil {
+		t.Fatal("base_url should be required")
+	}
+
+	keyless, _ := New(provider.Spec{Name: "llamacpp", BaseURL: "http://127.0.0.1:8080"})
+	if !keyless.IsConfigured() {
+		t.Fatal("an upstream without api_key_env needs no key")
+	}
+
+	t.Setenv("TEST_COMPAT_MISSING", "")
+	missing, _ := New(provider.Spec{Name: "modal", BaseURL: "http://127.0.0.1:8080", APIKeyEnv: "TEST_COMPAT_MISSING"})
+	if missing.IsConfigured() {
+		t.Fatal("an upstream whose api_key_env is unset should not be configured")
+	}
+}
@@ -225,6 +225,8 @@ func CleanupUsedBackupKeys() (int64, error) {
 	return result.DeletedCount, nil
 }
 
+var stopCleanup = make(chan struct{})
+
 // StartBackupKeyCleanupJob starts a goroutine that periodically cleans up used backup keys
 func StartBackupKeyCleanupJob(interval time.Duration) {
 	go func() {
@@ -239,16 +241,26 @@ func StartBackupKeyCleanupJob(interval time.Duration) {
 			log.Printf("🗑️ [OpenHands/Cleanup] Initial cleanup: deleted %d expired backup keys", deleted)
 		}
 
-		for range ticker.C {
-			if deleted, err := CleanupUsedBackupKeys(); err != nil {
-				log.Printf("⚠️ [OpenHands/Cleanup] Cleanup failed: %v", err)
-			} else if deleted > 0 {
-				log.Printf("🗑️ [OpenHands/Cleanup] Deleted %d expired backup keys (used > 6h)", deleted)
+		for {
+			select {
+			case <-ticker.C:
+				if deleted, err := CleanupUsedBackupKeys(); err != nil {
+					log.Printf("⚠️ [OpenHands/Cleanup] Cleanup failed: %v", err)
+				} else if deleted > 0 {
+					log.Printf("🗑️ [OpenHands/Cleanup] Deleted %d expired backup keys (used > 6h)", deleted)
+				}
+			case <-stopCleanup:
+				return
 			}
 		}
 	}()
 }
 
+// StopBackupKeyCleanupJob stops the cleanup job; call it once
+func StopBackupKeyCleanupJob() {
+	close(stopCleanup)
+}
+
 // RotateOpenHandsKey replaces a failed key with a backup key:
 // 1. Check if key exists (early idempotency check)
 // 2. Atomically claim backup key
@@ -263,7 +275,7 @@ func (p *OpenHandsProvider) RotateKey(failedKeyID string, reason string) (string
 	log.Printf("🔄 [OpenHands/Rotation] Starting rotation for failed key: %s (reason: %s)", failedKeyID, reason)
 
 	// 1. Check if key exists before fetching backup (idempotency check)
-	keysCol := db.OpenHandsKeysCollection()
+	keysCol := p.keysCollection()
 	var existingKeyDoc bson.M
 	err := keysCol.FindOne(ctx, bson.M{"_id": failedKeyID}).Decode(&existingKeyDoc)
 	if err != nil {
@@ -0,0 +1,76 @@
+package openhands
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"goproxy/internal/provider"
+)
+
+func TestForward_ReturnsServingKeyAndRawError(t *testing.T) {
+	const upstreamErr = `{"type":"error","error":{"type":"invalid_request_error","message":"image exceeds 8000 pixels"}}`
+	var gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, upstreamErr)
+	}))
+	defer server.Close()
+
+	p := New(provider.Spec{Name: "openhands-forward-test", BaseURL: server.URL})
+	p.keys = []*OpenHandsKey{{ID: "k1", APIKey: "sk-one", Status: OpenHandsStatusHealthy}}
+
+	resp, key, err := p.Forward(context.Background(), p.MessagesEndpoint(), []byte(`{}`), false)
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if key == nil || key.ID != "k1" {
+		t.Fatalf("key = %v, want k1", key)
+	}
+	if gotAuth != "Bearer sk-one" {
+		t.Fatalf("Authorization = %q, want the selected key", gotAuth)
+	}
+	// Non-key errors are left for the caller to sanitize in its own format
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest || string(body) != upstreamErr {
+		t.Fatalf("got %d %s, want the upstream 400 unchanged", resp.StatusCode, body)
+	}
+}
+
+func TestForward_NoUsableKey(t *testing.T) {
+	p := New(provider.Spec{Name: "openhands-nokey-test", BaseURL: "http://127.0.0.1:0"})
+	p.keys = []*OpenHandsKey{{ID: "k1", APIKey: "sk-one", Status: OpenHandsStatusExhausted}}
+
+	_, _, err := p.Forward(context.Background(), p.CompletionsEndpoint(), []byte(`{}`), true)
+	if !errors.Is(err, ErrNoKeys) {
+		t.Fatalf("err = %v, want ErrNoKeys", err)
+	}
+}
+
+func TestIsKeyError(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   bool
+	}{
+		{429, "", true},
+		{529, "", true},
+		{401, "", true},
+		{402, "", true},
+		{403, "", true},
+		{400, `{"error":{"message":"ExceededBudget: over budget"}}`, true},
+		{400, `{"error":{"message":"messages.0: invalid"}}`, false},
+		{500, "", false},
+	}
+	for _, tt := range tests {
+		if got := isKeyError(tt.status, tt.body); got != tt.want {
+			t.Errorf("isKeyError(%d, %q) = %v, want %v", tt.status, tt.body, got, tt.want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,7 +17,13 @@ import (
 
 	"goproxy/config"
 	"goproxy/db"
+	"goproxy/internal/affinity"
+	"goproxy/internal/breaker"
+	"goproxy/internal/keyquota"
+	"goproxy/internal/provider"
 	"goproxy/internal/proxy"
+	"goproxy/internal/sse"
+	"goproxy/transformers"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -24,13 +31,20 @@ import (
 )
 
 const (
-	OpenHandsBaseURL             = "https://llm-proxy.app.all-hands.dev"
-	OpenHandsMessagesEndpoint    = OpenHandsBaseURL + "/v1/messages"
-	OpenHandsCompletionsEndpoint = OpenHandsBaseURL + "/v1/chat/completions"
-	OpenHandsEndpoint            = OpenHandsCompletionsEndpoint // default for OpenAI format
-	OpenHandsName                = "openhands"
+	OpenHandsBaseURL      = "https://llm-proxy.app.all-hands.dev"
+	OpenHandsType         = "openhands"
+	defaultKeysCollection = "openhands_keys"
+	defaultHeaderProfile  = provider.HeaderProfileCLI
+
+	// maxKeyRetries is how many other keys a request is retried with after a key error.
+	// Streams retry too, as long as nothing has been sent to the client.
+	maxKeyRetries = 2
 )
 
+// ErrNoKeys is returned when no key can take a request: every key is rate limited,
+// exhausted or behind an open circuit
+var ErrNoKeys = errors.New("no healthy OpenHands keys available")
+
 // OpenHandsKeyStatus represents the health status of an API key
 type OpenHandsKeyStatus string
 
@@ -80,50 +94,95 @@ type OpenHandsKeyBinding struct {
 	CreatedAt      time.Time `bson:"createdAt" json:"created_at"`
 }
 
-// OpenHandsProvider implements Provider interface for OpenHands with MongoDB key pool
+// OpenHandsProvider implements provider.Provider for OpenHands with MongoDB key pool
 type OpenHandsProvider struct {
+	spec          provider.Spec
 	keys          []*OpenHandsKey
 	bindings      map[string][]*OpenHandsKeyBinding // proxyId -> bindings
 	current       int
 	keyIndex      map[string]int // proxyId -> current key index for rotation
 	lastUsedKeyID string
+	affinity      *affinity.Table   // conversation prefix -> key
+	quota         *keyquota.Tracker // live upstream rate limits per key
 	lastUsedProxy string
 	client        *http.Client
 	proxyPool     *proxy.ProxyPool
 	useProxy      bool
 	mu            sync.Mutex
+	stopChan      chan struct{} // closed by Stop
+	stopOnce      sync.Once
 }
 
-var openhandsInstance *OpenHandsProvider
-var openhandsOnce sync.Once
-
-// GetOpenHands returns the singleton OpenHands provider instance
-func GetOpenHands() *OpenHandsProvider {
-	openhandsOnce.Do(func() {
-		openhandsInstance = &OpenHandsProvider{
-			keys:     make([]*OpenHandsKey, 0),
-			bindings: make(map[string][]*OpenHandsKeyBinding),
-			keyIndex: make(map[string]int),
-			current:  0,
-		}
+func init() {
+	provider.RegisterType(OpenHandsType, func(spec provider.Spec) (provider.Provider, error) {
+		return New(spec), nil
 	})
-	return openhandsInstance
 }
 
-// ConfigureOpenHands initializes the OpenHands provider and loads keys from MongoDB
-func ConfigureOpenHands() error {
-	provider := GetOpenHands()
-	provider.client = createOpenHandsClient()
+// New creates an OpenHands instance; keys are loaded when it starts
+func New(spec provider.Spec) *OpenHandsProvider {
+	if spec.BaseURL == "" {
+		spec.BaseURL = OpenHandsBaseURL
+	}
+	spec.BaseURL = strings.TrimSuffix(spec.BaseURL, "/")
+	if spec.KeyCollection == "" {
+		spec.KeyCollection = defaultKeysCollection
+	}
+	if spec.HeaderProfile == "" {
+		spec.HeaderProfile = defaultHeaderProfile
+	}
+	return &OpenHandsProvider{
+		spec:     spec,
+		keys:     make([]*OpenHandsKey, 0),
+		bindings: make(map[string][]*OpenHandsKeyBinding),
+		keyIndex: make(map[string]int),
+		current:  0,
+		client:   createOpenHandsClient(),
+		affinity: affinity.NewTable(),
+		quota:    keyquota.NewTracker(),
+		stopChan: make(chan struct{}),
+	}
+}
 
-	if err := provider.LoadKeys(); err != nil {
+// Start loads keys from MongoDB, enables the proxy pool and starts auto-reload
+func (p *OpenHandsProvider) Start(rt provider.Runtime) error {
+	if err := p.LoadKeys(); err != nil {
 		return err
 	}
-
-	// Register with TrollProxy registry
-	RegisterProvider(OpenHandsName, provider)
+	if p.spec.UseProxy && rt.ProxyPool != nil && rt.ProxyPool.HasProxies() {
+		p.SetProxyPool(rt.ProxyPool)
+	}
+	if rt.ReloadInterval > 0 {
+		p.StartAutoReload(rt.ReloadInterval)
+	}
+	if p.GetKeyCount() == 0 {
+		log.Printf("⚠️ [Troll-LLM] %s not configured (no keys in %s collection)", p.spec.Name, p.spec.KeyCollection)
+	} else {
+		log.Printf("✅ [Troll-LLM] %s key pool loaded: %d keys", p.spec.Name, p.GetKeyCount())
+	}
 	return nil
 }
 
+// keysCollection returns the MongoDB collection holding this instance's keys
+func (p *OpenHandsProvider) keysCollection() *mongo.Collection {
+	return db.GetCollection(p.spec.KeyCollection)
+}
+
+// MessagesEndpoint returns the instance's /v1/messages URL (Anthropic format)
+func (p *OpenHandsProvider) MessagesEndpoint() string {
+	return p.spec.BaseURL + "/v1/messages"
+}
+
+// CompletionsEndpoint returns the instance's /v1/chat/completions URL (OpenAI format)
+func (p *OpenHandsProvider) CompletionsEndpoint() string {
+	return p.spec.BaseURL + "/v1/chat/completions"
+}
+
+// SetHeaders sets the instance's header profile on an upstream request
+func (p *OpenHandsProvider) SetHeaders(req *http.Request, apiKey string, isStreaming bool) {
+	provider.SetHeaders(req, p.spec.HeaderProfile, apiKey, config.GetUserAgent(), isStreaming)
+}
+
 // SetProxyPool sets the proxy pool to use for requests
 func (p *OpenHandsProvider) SetProxyPool(pool *proxy.ProxyPool) {
 	p.mu.Lock()
@@ -143,7 +202,7 @@ func (p *OpenHandsProvider) LoadKeys() error {
 	defer cancel()
 
 	// Load keys
-	cursor, err := db.OpenHandsKeysCollection().Find(ctx, bson.M{})
+	cursor, err := p.keysCollection().Find(ctx, bson.M{})
 	if err != nil {
 		return err
 	}
@@ -201,15 +260,25 @@ func (p *OpenHandsProvider) StartAutoReload(interval time.Duration) {
 
 		// Auto-reload started log disabled to reduce noise
 
-		for range ticker.C {
-			if err := p.LoadKeys(); err != nil {
-				log.Printf("⚠️ [Troll-LLM] Auto-reload failed: %v", err)
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.LoadKeys(); err != nil {
+					log.Printf("⚠️ [Troll-LLM] Auto-reload failed: %v", err)
+				}
+				// Auto-reload success log disabled to reduce noise
+			case <-p.stopChan:
+				return
 			}
-			// Auto-reload success log disabled to reduce noise
 		}
 	}()
 }
 
+// Stop stops auto-reload
+func (p *OpenHandsProvider) Stop() {
+	p.stopOnce.Do(func() { close(p.stopChan) })
+}
+
 // SelectKey selects the next available key using round-robin
 func (p *OpenHandsProvider) SelectKey() (*OpenHandsKey, error) {
 	p.mu.Lock()
@@ -219,19 +288,97 @@ func (p *OpenHandsProvider) SelectKey() (*OpenHandsKey, error) {
 		return nil, fmt.Errorf("no OpenHands keys configured")
 	}
 
+	// Keys close to their upstream rate limit are only used when no other key is available
 	startIdx := p.current
+	low := -1
 	for i := 0; i < len(p.keys); i++ {
 		idx := (startIdx + i) % len(p.keys)
 		key := p.keys[idx]
 
-		if key.IsAvailable() {
+		if p.quota.Low(key.ID) && key.IsAvailable() {
+			if low < 0 {
+				low = idx
+			}
+			continue
+		}
+		if p.keyUsable(key) {
 			p.current = (idx + 1) % len(p.keys)
 			p.lastUsedKeyID = key.ID
 			return key, nil
 		}
 	}
+	if low >= 0 && p.keyUsable(p.keys[low]) {
+		key := p.keys[low]
+		p.current = (low + 1) % len(p.keys)
+		p.lastUsedKeyID = key.ID
+		return key, nil
+	}
+
+	return nil, ErrNoKeys
+}
+
+// SelectKeyFor selects the key pinned to the request's conversation (see affinity.WithPrefix)
+// so consecutive turns hit the same prompt cache, falling back to SelectKey
+func (p *OpenHandsProvider) SelectKeyFor(ctx context.Context) (*OpenHandsKey, error) {
+	var selected *OpenHandsKey
+	_, err := p.affinity.Pick(affinity.PrefixFrom(ctx), func(keyID string) bool {
+		key := p.GetKeyByID(keyID)
+		if key == nil || !p.keyUsable(key) {
+			return false
+		}
+		selected = key
+		return true
+	}, func() (string, error) {
+		key, err := p.SelectKey()
+		if err != nil {
+			return "", err
+		}
+		selected = key
+		return key.ID, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.lastUsedKeyID = selected.ID
+	p.mu.Unlock()
+	return selected, nil
+}
 
-	return nil, fmt.Errorf("no healthy OpenHands keys available")
+// keyUsable reports whether key can take a request: healthy and its circuit not open.
+// While the circuit is half-open this reserves one of its probe slots.
+func (p *OpenHandsProvider) keyUsable(key *OpenHandsKey) bool {
+	return key.IsAvailable() && breaker.Key(p.Name(), key.ID).Allow()
+}
+
+// AvailableKeys counts the keys that could take a request right now, without selecting
+// one or reserving a half-open probe (see admission)
+func (p *OpenHandsProvider) AvailableKeys() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, key := range p.keys {
+		if key.IsAvailable() && breaker.Key(p.Name(), key.ID).Ready() {
+			n++
+		}
+	}
+	return n
+}
+
+// recordKeyCall feeds the key's circuit breaker with the outcome of an upstream call
+func (p *OpenHandsProvider) recordKeyCall(keyID string, success bool, latency time.Duration) {
+	breaker.Key(p.Name(), keyID).Record(success, latency)
+}
+
+// ObserveRateLimits records the rate-limit headers of an upstream response made with keyID
+func (p *OpenHandsProvider) ObserveRateLimits(keyID string, statusCode int, header http.Header) {
+	p.quota.Observe(keyID, statusCode, header)
+}
+
+// AffinityStats returns how often conversations were served by their pinned key
+func (p *OpenHandsProvider) AffinityStats() affinity.Stats {
+	return p.affinity.Stats()
 }
 
 // MarkStatus updates key status in memory and database
@@ -269,7 +416,7 @@ func (p *OpenHandsProvider) updateKeyStatus(keyID string, status OpenHandsKeySta
 		},
 	}
 
-	_, err := db.OpenHandsKeysCollection().UpdateByID(ctx, keyID, update)
+	_, err := p.keysCollection().UpdateByID(ctx, keyID, update)
 	if err != nil {
 		log.Printf("⚠️ [Troll-LLM] Failed to update key status: %v", err)
 	}
@@ -280,9 +427,11 @@ func (p *OpenHandsProvider) MarkHealthy(keyID string) {
 	log.Printf("✅ [Troll-LLM] Key %s marked healthy", keyID)
 }
 
+// MarkRateLimited cools a key down until the upstream's reported reset (see keyquota.Tracker)
 func (p *OpenHandsProvider) MarkRateLimited(keyID string) {
-	p.MarkStatus(keyID, OpenHandsStatusRateLimited, 60*time.Second, "Rate limited by upstream")
-	log.Printf("⚠️ [Troll-LLM] Key %s rate limited (cooldown: 60s)", keyID)
+	cooldown := p.quota.Cooldown(keyID, 60*time.Second)
+	p.MarkStatus(keyID, OpenHandsStatusRateLimited, cooldown, "Rate limited by upstream")
+	log.Printf("⚠️ [Troll-LLM] Key %s rate limited (cooldown: %v)", keyID, cooldown)
 }
 
 func (p *OpenHandsProvider) MarkExhausted(keyID string) {
@@ -296,7 +445,7 @@ func (p *OpenHandsProvider) DeleteKey(keyID string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	keysCol := db.OpenHandsKeysCollection()
+	keysCol := p.keysCollection()
 	var existingDoc bson.M
 	err := keysCol.FindOne(ctx, bson.M{"_id": keyID}).Decode(&existingDoc)
 	if err != nil {
@@ -307,7 +456,7 @@ func (p *OpenHandsProvider) DeleteKey(keyID string) error {
 	} else {
 		archiveErr := db.ArchiveDeletedDocument(
 			ctx,
-			"openhands_keys",
+			p.spec.KeyCollection,
 			keyID,
 			"manual_delete",
 			"openhands.DeleteKey",
@@ -381,7 +530,7 @@ func (p *OpenHandsProvider) CheckAndRotateOnError(keyID string, statusCode int,
 		return
 	case 529:
 		p.MarkRateLimited(keyID)
-		log.Printf("⏳ [Troll-LLM] Key %s temporarily unavailable due to upstream overload (529, cooldown: 60s)", keyID)
+		log.Printf("⏳ [Troll-LLM] Key %s temporarily unavailable due to upstream overload (529)", keyID)
 		return
 	}
 
@@ -458,6 +607,10 @@ func (p *OpenHandsProvider) GetAllKeysStatus() []map[string]interface{} {
 		if key.CooldownUntil != nil {
 			keyInfo["cooldown_until"] = key.CooldownUntil.Format(time.RFC3339)
 		}
+		if quota, ok := p.quota.Quota(key.ID); ok {
+			keyInfo["quota"] = quota
+			keyInfo["quota_low"] = p.quota.Low(key.ID)
+		}
 		result = append(result, keyInfo)
 	}
 	return result
@@ -496,7 +649,7 @@ func (p *OpenHandsProvider) UpdateKeyUsage(keyID string, inputTokens, outputToke
 		return nil
 	}
 
-	collection := db.OpenHandsKeysCollection()
+	collection := p.keysCollection()
 	if collection == nil {
 		return fmt.Errorf("openhands_keys collection not available")
 	}
@@ -547,9 +700,14 @@ func createOpenHandsClient() *http.Client {
 	return &http.Client{Transport: transport, Timeout: 0}
 }
 
-// Name returns the provider name
+// Name returns the instance name
 func (p *OpenHandsProvider) Name() string {
-	return OpenHandsName
+	return p.spec.Name
+}
+
+// Type returns the provider type
+func (p *OpenHandsProvider) Type() string {
+	return OpenHandsType
 }
 
 // IsConfigured returns true if the provider is configured
@@ -560,46 +718,43 @@ func (p *OpenHandsProvider) IsConfigured() bool {
 }
 
 // ForwardRequest forwards request to OpenHands chat/completions endpoint (OpenAI format)
-func (p *OpenHandsProvider) ForwardRequest(body []byte, isStreaming bool) (*http.Response, error) {
-	return p.forwardToEndpoint(OpenHandsCompletionsEndpoint, body, isStreaming)
+func (p *OpenHandsProvider) ForwardRequest(ctx context.Context, body []byte, isStreaming bool) (*http.Response, error) {
+	resp, _, err := p.Forward(ctx, p.CompletionsEndpoint(), body, isStreaming)
+	return resp, err
 }
 
 // ForwardMessagesRequest forwards request to OpenHands messages endpoint (Anthropic format)
-func (p *OpenHandsProvider) ForwardMessagesRequest(body []byte, isStreaming bool) (*http.Response, error) {
-	return p.forwardToEndpoint(OpenHandsMessagesEndpoint, body, isStreaming)
+func (p *OpenHandsProvider) ForwardMessagesRequest(ctx context.Context, body []byte, isStreaming bool) (*http.Response, error) {
+	resp, _, err := p.Forward(ctx, p.MessagesEndpoint(), body, isStreaming)
+	return resp, err
+}
+
+// Forward sends body to endpoint with key rotation and optional proxy, and returns the key
+// that served the response so the caller can bill it. Key errors (see isKeyError) move the
+// request to the next key, streams included, before anything reaches the client. Other
+// error responses are returned unchanged for the caller to sanitize in its own format.
+func (p *OpenHandsProvider) Forward(ctx context.Context, endpoint string, body []byte, isStreaming bool) (*http.Response, *OpenHandsKey, error) {
+	return p.forwardToEndpoint(ctx, endpoint, body, isStreaming)
 }
 
 // forwardToEndpoint forwards request to specified endpoint with key rotation and optional proxy
-func (p *OpenHandsProvider) forwardToEndpoint(endpoint string, body []byte, isStreaming bool) (*http.Response, error) {
+func (p *OpenHandsProvider) forwardToEndpoint(ctx context.Context, endpoint string, body []byte, isStreaming bool) (*http.Response, *OpenHandsKey, error) {
 	if !p.IsConfigured() {
-		return nil, fmt.Errorf("OpenHands not configured")
+		return nil, nil, fmt.Errorf("OpenHands not configured")
 	}
 
 	// Select proxy and key together (with binding support)
-	client, proxyName, key, err := p.selectProxyAndKey()
+	client, proxyName, key, err := p.selectProxyAndKey(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(body))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+key.APIKey)
-	// Add User-Agent from config (openhands-cli/1.0.0 for official CLI appearance)
-	if userAgent := config.GetUserAgent(); userAgent != "" {
-		req.Header.Set("User-Agent", userAgent)
-	}
-	// Add common headers to avoid detection
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
-	if isStreaming {
-		req.Header.Set("Accept", "text/event-stream")
-	} else {
-		req.Header.Set("Accept", "application/json")
-	}
+	p.SetHeaders(req, key.APIKey, isStreaming)
 
 	// Log request with API key prefix for debugging
 	apiKeyPrefix := key.APIKey
@@ -618,44 +773,31 @@ func (p *OpenHandsProvider) forwardToEndpoint(endpoint string, body []byte, isSt
 	if err != nil {
 		// Log detailed error with timing to help debug proxy vs upstream timeouts
 		log.Printf("⏱️ [Troll-LLM] Request failed after %v (proxy=%s): %v", elapsed, proxyName, err)
-		return nil, err
+		p.recordKeyCall(key.ID, false, elapsed)
+		return nil, key, err
+	}
+	p.ObserveRateLimits(key.ID, resp.StatusCode, resp.Header)
+
+	// Rate limits, quota, auth, budget exceeded (400 with ExceededBudget) and overload (529)
+	// cool down or rotate the key
+	if p.responseKeyError(resp, key.ID, elapsed) {
+		// Nothing has been written to the client yet, so streaming requests can retry too
+		log.Printf("⚠️ [Troll-LLM] Request failed (HTTP %d, stream=%v), retrying with next key...", resp.StatusCode, isStreaming)
+		return p.retryWithNextKeyToEndpoint(ctx, endpoint, body, isStreaming, maxKeyRetries, resp, key)
 	}
 
-	// Check for rate limit, quota errors, or budget exceeded (400 with ExceededBudget), or service overload (529)
-	if resp.StatusCode == 429 || resp.StatusCode == 402 || resp.StatusCode == 401 || resp.StatusCode == 400 || resp.StatusCode == 529 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		bodyStr := string(bodyBytes)
-		resp.Body.Close()
-
-		// For 400, only handle budget_exceeded errors - other 400s should be sanitized
-		if resp.StatusCode == 400 && !strings.Contains(bodyStr, "ExceededBudget") && !strings.Contains(bodyStr, "budget_exceeded") && !strings.Contains(bodyStr, "over budget") {
-			// Not a budget error - return sanitized error response
-			resp.Body = io.NopCloser(bytes.NewReader(SanitizeError(resp.StatusCode, bodyBytes)))
-			return resp, nil
-		}
-
-		p.CheckAndRotateOnError(key.ID, resp.StatusCode, bodyStr)
-
-		// IMPORTANT: Only retry for non-streaming requests
-		// For streaming, retrying would cause double response (partial + new full response)
-		if !isStreaming {
-			log.Printf("⚠️ [Troll-LLM] Non-streaming request failed (HTTP %d), retrying with next key...", resp.StatusCode)
-			return p.retryWithNextKeyToEndpoint(endpoint, body, isStreaming, 2)
-		} else {
-			log.Printf("🚫 [Troll-LLM] Streaming request got HTTP %d - CANNOT RETRY to prevent double response!", resp.StatusCode)
-			// Return sanitized error response - handler will forward to client
-			// Don't retry to avoid double response
-			resp.Body = io.NopCloser(bytes.NewReader(SanitizeError(resp.StatusCode, bodyBytes)))
-			return resp, nil
-		}
+	if isStreaming && resp.StatusCode == http.StatusOK && p.streamKeyError(resp, key.ID) {
+		p.recordKeyCall(key.ID, false, elapsed)
+		return p.retryWithNextKeyToEndpoint(ctx, endpoint, body, isStreaming, maxKeyRetries, resp, key)
 	}
 
-	return resp, nil
+	p.recordKeyCall(key.ID, !breaker.IsFailure(resp.StatusCode), elapsed)
+	return resp, key, nil
 }
 
 // selectProxyAndKey selects a proxy and corresponding key based on bindings
 // Returns: client, proxyName, key, error
-func (p *OpenHandsProvider) selectProxyAndKey() (*http.Client, string, *OpenHandsKey, error) {
+func (p *OpenHandsProvider) selectProxyAndKey(ctx context.Context) (*http.Client, string, *OpenHandsKey, error) {
 	p.mu.Lock()
 	useProxy := p.useProxy
 	pool := p.proxyPool
@@ -664,7 +806,7 @@ func (p *OpenHandsProvider) selectProxyAndKey() (*http.Client, string, *OpenHand
 
 	// If no proxy, just select key with round-robin
 	if !useProxy || pool == nil {
-		key, err := p.SelectKey()
+		key, err := p.SelectKeyFor(ctx)
 		if err != nil {
 			return nil, "", nil, err
 		}
@@ -675,7 +817,7 @@ func (p *OpenHandsProvider) selectProxyAndKey() (*http.Client, string, *OpenHand
 	selectedProxy, err := pool.SelectProxy()
 	if err != nil {
 		log.Printf("⚠️ [Troll-LLM] Failed to select proxy, using direct: %v", err)
-		key, err := p.SelectKey()
+		key, err := p.SelectKeyFor(ctx)
 		if err != nil {
 			return nil, "", nil, err
 		}
@@ -686,7 +828,7 @@ func (p *OpenHandsProvider) selectProxyAndKey() (*http.Client, string, *OpenHand
 	transport, err := selectedProxy.CreateHTTPTransport()
 	if err != nil {
 		log.Printf("⚠️ [Troll-LLM] Failed to create proxy transport, using direct: %v", err)
-		key, err := p.SelectKey()
+		key, err := p.SelectKeyFor(ctx)
 		if err != nil {
 			return nil, "", nil, err
 		}
@@ -717,7 +859,7 @@ func (p *OpenHandsProvider) selectProxyAndKey() (*http.Client, string, *OpenHand
 
 			// Find the key
 			key := p.GetKeyByID(binding.OpenHandsKeyID)
-			if key != nil && key.IsAvailable() {
+			if key != nil && p.keyUsable(key) {
 				p.mu.Lock()
 				p.lastUsedKeyID = key.ID
 				p.mu.Unlock()
@@ -727,7 +869,7 @@ func (p *OpenHandsProvider) selectProxyAndKey() (*http.Client, string, *OpenHand
 	}
 
 	// No binding found, use round-robin key selection
-	key, err := p.SelectKey()
+	key, err := p.SelectKeyFor(ctx)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -741,7 +883,7 @@ func (p *OpenHandsProvider) selectProxyAndKey() (*http.Client, string, *OpenHand
 
 // getClientWithProxy returns an HTTP client, optionally configured with a proxy (legacy method)
 func (p *OpenHandsProvider) getClientWithProxy() (*http.Client, string) {
-	client, proxyName, _, _ := p.selectProxyAndKey()
+	client, proxyName, _, _ := p.selectProxyAndKey(context.Background())
 	return client, proxyName
 }
 
@@ -771,37 +913,30 @@ func (p *OpenHandsProvider) GetClientWithProxyOnly() (*http.Client, string) {
 	return client, selectedProxy.Name
 }
 
-// retryWithNextKeyToEndpoint attempts request with remaining keys to specified endpoint
-func (p *OpenHandsProvider) retryWithNextKeyToEndpoint(endpoint string, body []byte, isStreaming bool, retriesLeft int) (*http.Response, error) {
+// retryWithNextKeyToEndpoint attempts request with remaining keys to specified endpoint.
+// last is the key error response of the previous attempt, by lastKey: it is closed once
+// another response replaces it, and returned as is if no other key can answer, so the
+// client gets the upstream's status and body (Retry-After included).
+func (p *OpenHandsProvider) retryWithNextKeyToEndpoint(ctx context.Context, endpoint string, body []byte, isStreaming bool, retriesLeft int, last *http.Response, lastKey *OpenHandsKey) (*http.Response, *OpenHandsKey, error) {
 	if retriesLeft <= 0 {
-		return nil, fmt.Errorf("all OpenHands keys exhausted or rate limited")
+		log.Printf("⚠️ [Troll-LLM] Retries exhausted, returning the last upstream error (HTTP %d)", last.StatusCode)
+		return last, lastKey, nil
 	}
 
 	// Select proxy and key together (with binding support)
-	client, proxyName, key, err := p.selectProxyAndKey()
+	client, proxyName, key, err := p.selectProxyAndKey(ctx)
 	if err != nil {
-		return nil, err
+		log.Printf("⚠️ [Troll-LLM] No key left to retry (%v), returning the last upstream error (HTTP %d)", err, last.StatusCode)
+		return last, lastKey, nil
 	}
 
-	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(body))
 	if err != nil {
-		return nil, err
+		last.Body.Close()
+		return nil, nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+key.APIKey)
-	// Add User-Agent from config (openhands-cli/1.0.0 for official CLI appearance)
-	if userAgent := config.GetUserAgent(); userAgent != "" {
-		req.Header.Set("User-Agent", userAgent)
-	}
-	// Add common headers to avoid detection
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
-	if isStreaming {
-		req.Header.Set("Accept", "text/event-stream")
-	} else {
-		req.Header.Set("Accept", "application/json")
-	}
+	p.SetHeaders(req, key.APIKey, isStreaming)
 
 	if proxyName != "" {
 		log.Printf("📤 [Troll-LLM] RETRY POST %s (key=%s, proxy=%s, stream=%v, retries=%d)", endpoint, key.ID, proxyName, isStreaming, retriesLeft)
@@ -814,30 +949,74 @@ func (p *OpenHandsProvider) retryWithNextKeyToEndpoint(endpoint string, body []b
 	elapsed := time.Since(startTime)
 	if err != nil {
 		log.Printf("⏱️ [Troll-LLM] RETRY failed after %v (proxy=%s): %v", elapsed, proxyName, err)
-		return nil, err
+		p.recordKeyCall(key.ID, false, elapsed)
+		last.Body.Close()
+		return nil, key, err
 	}
+	last.Body.Close()
+	p.ObserveRateLimits(key.ID, resp.StatusCode, resp.Header)
 
-	if resp.StatusCode == 429 || resp.StatusCode == 402 || resp.StatusCode == 401 || resp.StatusCode == 400 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		bodyStr := string(bodyBytes)
-		resp.Body.Close()
+	if p.responseKeyError(resp, key.ID, elapsed) {
+		return p.retryWithNextKeyToEndpoint(ctx, endpoint, body, isStreaming, retriesLeft-1, resp, key)
+	}
 
-		// For 400, only handle budget_exceeded errors - other 400s should be sanitized
-		if resp.StatusCode == 400 && !strings.Contains(bodyStr, "ExceededBudget") && !strings.Contains(bodyStr, "budget_exceeded") && !strings.Contains(bodyStr, "over budget") {
-			resp.Body = io.NopCloser(bytes.NewReader(SanitizeError(resp.StatusCode, bodyBytes)))
-			return resp, nil
-		}
+	if isStreaming && resp.StatusCode == http.StatusOK && p.streamKeyError(resp, key.ID) {
+		p.recordKeyCall(key.ID, false, elapsed)
+		return p.retryWithNextKeyToEndpoint(ctx, endpoint, body, isStreaming, retriesLeft-1, resp, key)
+	}
+
+	p.recordKeyCall(key.ID, !breaker.IsFailure(resp.StatusCode), elapsed)
+	return resp, key, nil
+}
+
+// responseKeyError reads an error response and, if the error is tied to the key (see
+// isKeyError), cools down or rotates the key so the request can move to another one.
+// The body is put back either way: the caller sanitizes other errors, and a key error is
+// returned if no other key can take the request.
+func (p *OpenHandsProvider) responseKeyError(resp *http.Response, keyID string, elapsed time.Duration) bool {
+	if resp.StatusCode < 400 {
+		return false
+	}
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	if !isKeyError(resp.StatusCode, string(bodyBytes)) {
+		return false
+	}
+	p.recordKeyCall(keyID, false, elapsed)
+	p.CheckAndRotateOnError(keyID, resp.StatusCode, string(bodyBytes))
+	return true
+}
 
-		p.CheckAndRotateOnError(key.ID, resp.StatusCode, bodyStr)
-		return p.retryWithNextKeyToEndpoint(endpoint, body, isStreaming, retriesLeft-1)
+// streamKeyError buffers the first event of a streaming response. Upstreams report rate limits
+// and overload as an error event after a 200; nothing has reached the client yet, so the
+// request can still move to another key. The stream is left open for the retry to close.
+func (p *OpenHandsProvider) streamKeyError(resp *http.Response, keyID string) bool {
+	event := sse.PeekFirstEvent(resp)
+	status, isError := sse.ErrorStatus(event)
+	if !isError || !isKeyError(status, string(event)) {
+		return false
 	}
+	p.CheckAndRotateOnError(keyID, status, string(event))
+	log.Printf("⚠️ [Troll-LLM] Stream opened with an error event (%d), retrying with next key...", status)
+	return true
+}
 
-	return resp, nil
+// isKeyError reports whether an upstream error is tied to the key (rate limit, quota,
+// auth, budget, overload) so the request can be retried with another key
+func isKeyError(statusCode int, body string) bool {
+	switch statusCode {
+	case 429, 402, 401, 403, 529:
+		return true
+	case 400:
+		return strings.Contains(body, "ExceededBudget") || strings.Contains(body, "budget_exceeded") || strings.Contains(body, "over budget")
+	}
+	return false
 }
 
 // HandleStreamResponse handles streaming response from OpenHands (pure passthrough)
 // Supports both OpenAI and Anthropic streaming formats
-func (p *OpenHandsProvider) HandleStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage UsageCallback) {
+func (p *OpenHandsProvider) HandleStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage provider.UsageCallback) {
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		log.Printf("❌ [Troll-LLM] Error %d", resp.StatusCode)
@@ -857,10 +1036,16 @@ func (p *OpenHandsProvider) HandleStreamResponse(w http.ResponseWriter, resp *ht
 		return
 	}
 
+	// Keepalives stop idle timeouts from dropping the connection while upstream is silent
+	heartbeat := sse.StartHeartbeat(w, sse.KeepaliveFor(resp))
+	defer heartbeat.Stop()
+	w, flusher = heartbeat, heartbeat
+
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024)
 
 	var totalInput, totalOutput, cacheCreation, cacheRead int64
+	var delivered transformers.DeliveredOutput
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -871,6 +1056,9 @@ func (p *OpenHandsProvider) HandleStreamResponse(w http.ResponseWriter, resp *ht
 			if dataStr != "[DONE]" {
 				var event map[string]interface{}
 				if json.Unmarshal([]byte(dataStr), &event) == nil {
+					delivered.AddAnthropicEvent(event)
+					delivered.AddOpenAIChunk(event)
+
 					// Check event type for Anthropic format
 					eventType, _ := event["type"].(string)
 
@@ -939,6 +1127,12 @@ func (p *OpenHandsProvider) HandleStreamResponse(w http.ResponseWriter, resp *ht
 
 	if err := scanner.Err(); err != nil {
 		log.Printf("⚠️ [Troll-LLM] Scanner error: %v", err)
+		if transformers.ClientCancelled(resp) {
+			// Client went away: bill only the output it received
+			if deliveredOutput := delivered.Tokens(modelID); deliveredOutput > totalOutput {
+				totalOutput = deliveredOutput
+			}
+		}
 	}
 
 	if cacheCreation > 0 || cacheRead > 0 {
@@ -952,7 +1146,7 @@ func (p *OpenHandsProvider) HandleStreamResponse(w http.ResponseWriter, resp *ht
 }
 
 // HandleNonStreamResponse handles non-streaming response from OpenHands (pure passthrough)
-func (p *OpenHandsProvider) HandleNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage UsageCallback) {
+func (p *OpenHandsProvider) HandleNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage provider.UsageCallback) {
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		http.Error(w, `{"error":"failed to read response"}`, http.StatusInternalServerError)
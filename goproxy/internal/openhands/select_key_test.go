@@ -0,0 +1,38 @@
+package openhands
+
+import (
+	"net/http"
+	"testing"
+
+	"goproxy/internal/keyquota"
+	"goproxy/internal/provider"
+)
+
+func TestSelectKey_DeprioritizesLowQuota(t *testing.T) {
+	p := &OpenHandsProvider{
+		spec: provider.Spec{Name: "openhands-select-test"},
+		keys: []*OpenHandsKey{
+			{ID: "low", Status: OpenHandsStatusHealthy},
+			{ID: "ok", Status: OpenHandsStatusHealthy},
+		},
+		quota: keyquota.NewTracker(),
+	}
+
+	h := http.Header{}
+	h.Set("x-ratelimit-limit-requests", "100")
+	h.Set("x-ratelimit-remaining-requests", "1")
+	h.Set("x-ratelimit-reset-requests", "1m0s")
+	p.ObserveRateLimits("low", http.StatusOK, h)
+
+	for i := 0; i < 3; i++ {
+		key, err := p.SelectKey()
+		if err != nil || key.ID != "ok" {
+			t.Fatalf("Expected the key with quota left, got %v (%v)", key, err)
+		}
+	}
+
+	p.keys[1].Status = OpenHandsStatusExhausted
+	if key, err := p.SelectKey(); err != nil || key.ID != "low" {
+		t.Fatalf("Expected the low key when no other is available, got %v (%v)", key, err)
+	}
+}
@@ -14,8 +14,6 @@ import (
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
-	"goproxy/db"
-	"goproxy/internal/openhandspool"
 )
 
 // Constants for spend checking
@@ -370,9 +368,8 @@ func (sc *SpendChecker) checkKeySpend(key *OpenHandsKey, isActive bool) SpendChe
 			log.Printf("🚨 [OpenHands/SpendChecker] Key %s AUTH ERROR (401): %s", key.ID, bodyStr)
 			result.Error = fmt.Errorf("auth error 401: %s", bodyStr)
 
-			// Use openhandspool to mark key and attempt rotation
-			pool := openhandspool.GetPool()
-			pool.CheckAndRotateOnError(key.ID, 401, bodyStr)
+			// Drop the key from the instance that serves traffic and rotate in a backup
+			sc.provider.CheckAndRotateOnError(key.ID, 401, bodyStr)
 
 			return result
 		}
@@ -403,7 +400,7 @@ func (sc *SpendChecker) updateKeySpendInfo(keyID string, spend float64, checkedA
 	defer cancel()
 
 	// Update in MongoDB
-	_, err := db.OpenHandsKeysCollection().UpdateByID(ctx, keyID, bson.M{
+	_, err := sc.provider.keysCollection().UpdateByID(ctx, keyID, bson.M{
 		"$set": bson.M{
 			"totalSpend":     spend,
 			"lastSpendCheck": checkedAt,
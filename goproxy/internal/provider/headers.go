@@ -0,0 +1,60 @@
+package provider
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Header profiles: the header set an instance sends with each upstream request
+const (
+	HeaderProfileSDK          = "sdk"           // plain API client ("OpenAI/v1 GoProxy/1.0")
+	HeaderProfileCLI          = "cli"           // CLI client: configured User-Agent and browser-like Accept-* headers
+	HeaderProfileOpenHandsCLI = "openhands-cli" // "cli" plus x-api-key and x-openhands-client
+)
+
+// IsValidHeaderProfile checks if a header_profile value is known (empty = type default)
+func IsValidHeaderProfile(profile string) bool {
+	switch profile {
+	case "", HeaderProfileSDK, HeaderProfileCLI, HeaderProfileOpenHandsCLI:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetHeaders sets the auth and client headers of profile on an upstream request.
+// userAgent is the configured CLI User-Agent; requests to a /messages endpoint get Anthropic headers.
+func SetHeaders(req *http.Request, profile string, apiKey string, userAgent string, isStreaming bool) {
+	isMessages := strings.HasSuffix(req.URL.Path, "/messages")
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	if profile == HeaderProfileSDK {
+		req.Header.Set("Accept", "application/json")
+		if isMessages {
+			req.Header.Set("anthropic-version", "2023-06-01")
+			req.Header.Set("User-Agent", "Anthropic/v1 GoProxy/1.0")
+		} else {
+			req.Header.Set("User-Agent", "OpenAI/v1 GoProxy/1.0")
+		}
+		return
+	}
+
+	if profile == HeaderProfileOpenHandsCLI {
+		req.Header.Set("x-api-key", apiKey)
+		// Match official CLI behavior
+		req.Header.Set("x-openhands-client", "cli")
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	// Common headers to avoid detection
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+	if isStreaming {
+		req.Header.Set("Accept", "text/event-stream")
+	} else {
+		req.Header.Set("Accept", "application/json")
+	}
+}
@@ -0,0 +1,202 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"goproxy/internal/affinity"
+	"goproxy/internal/proxy"
+)
+
+// UsageCallback is called after a request completes with token usage data (with cache support)
+type UsageCallback func(input, output, cacheWrite, cacheHit int64)
+
+// Provider is an upstream instance requests can be routed to
+type Provider interface {
+	Name() string // instance name from the "upstreams" section
+	Type() string // registered provider type
+	IsConfigured() bool
+	ForwardRequest(ctx context.Context, body []byte, isStreaming bool) (*http.Response, error)
+	HandleStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage UsageCallback)
+	HandleNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage UsageCallback)
+}
+
+// Starter is implemented by providers that load keys or start background jobs
+type Starter interface {
+	Start(rt Runtime) error
+}
+
+// Stopper is implemented by providers with background jobs to stop on shutdown
+type Stopper interface {
+	Stop()
+}
+
+// Reloader is implemented by providers with a key pool that can be refreshed on demand
+type Reloader interface {
+	Reload() error
+	GetKeyCount() int
+}
+
+// AffinityReporter is implemented by providers that pin conversations to keys (see affinity.Table)
+type AffinityReporter interface {
+	AffinityStats() affinity.Stats
+}
+
+// KeyAvailability is implemented by providers with a key pool whose keys can all be rate
+// limited at once; requests then wait in the upstream's admission queue, admitted one per
+// available key
+type KeyAvailability interface {
+	AvailableKeys() int
+}
+
+// Runtime is what the process hands to each instance when it starts
+type Runtime struct {
+	ProxyPool      *proxy.ProxyPool // shared proxy pool, used by instances with use_proxy
+	ReloadInterval time.Duration    // key/binding auto-reload interval
+}
+
+// Spec declares a named upstream instance (an entry of "upstreams" in config.json)
+type Spec struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`                     // registered provider type ("main", "openhands", "ohmygpt", "openai_compat")
+	BaseURL       string `json:"base_url,omitempty"`       // defaults to the type's base URL
+	KeyCollection string `json:"key_collection,omitempty"` // MongoDB collection holding the key pool
+	APIKeyEnv     string `json:"api_key_env,omitempty"`    // environment variable holding a single API key
+	AuthHeader    string `json:"auth_header,omitempty"`    // header carrying the API key (default "Authorization: Bearer <key>")
+	UseProxy      bool   `json:"use_proxy,omitempty"`      // route through the shared proxy pool
+	HeaderProfile string `json:"header_profile,omitempty"` // header set sent upstream (see SetHeaders)
+	AliasOf       string `json:"alias_of,omitempty"`       // serve this name with another instance
+	Disabled      bool   `json:"disabled,omitempty"`       // declared but never started
+}
+
+// Factory builds an instance of a provider type from its spec
+type Factory func(spec Spec) (Provider, error)
+
+var (
+	factories   = make(map[string]Factory)
+	instances   = make(map[string]Provider)
+	registryMux sync.RWMutex
+)
+
+// RegisterType registers a provider type; called from the provider package's init
+func RegisterType(typeName string, factory Factory) {
+	registryMux.Lock()
+	defer registryMux.Unlock()
+	factories[typeName] = factory
+}
+
+// IsRegisteredType returns true if a provider type with the given name is registered
+func IsRegisteredType(typeName string) bool {
+	registryMux.RLock()
+	defer registryMux.RUnlock()
+	_, ok := factories[typeName]
+	return ok
+}
+
+// Build creates the instances declared by specs and registers them by name.
+// Aliases are resolved after every other instance exists; disabled specs are skipped.
+func Build(specs []Spec) error {
+	for _, spec := range specs {
+		if spec.AliasOf != "" || spec.Disabled {
+			continue
+		}
+		registryMux.RLock()
+		factory, ok := factories[spec.Type]
+		registryMux.RUnlock()
+		if !ok {
+			return fmt.Errorf("upstream %s: unknown provider type %q", spec.Name, spec.Type)
+		}
+		p, err := factory(spec)
+		if err != nil {
+			return fmt.Errorf("upstream %s: %w", spec.Name, err)
+		}
+		Register(spec.Name, p)
+	}
+
+	for _, spec := range specs {
+		if spec.AliasOf == "" || spec.Disabled {
+			continue
+		}
+		target := Get(spec.AliasOf)
+		if target == nil {
+			return fmt.Errorf("upstream %s: alias_of %q is not a started upstream", spec.Name, spec.AliasOf)
+		}
+		Register(spec.Name, target)
+	}
+	return nil
+}
+
+// Register registers an instance under the given name
+func Register(name string, p Provider) {
+	registryMux.Lock()
+	defer registryMux.Unlock()
+	instances[name] = p
+	log.Printf("✅ [Provider] Registered upstream: %s (type=%s)", name, p.Type())
+}
+
+// Get returns the instance registered under name, or nil if not found
+func Get(name string) Provider {
+	registryMux.RLock()
+	defer registryMux.RUnlock()
+	return instances[name]
+}
+
+// IsConfigured returns true if the instance is registered and configured
+func IsConfigured(name string) bool {
+	p := Get(name)
+	if p == nil {
+		return false
+	}
+	return p.IsConfigured()
+}
+
+// Names returns all registered instance names, sorted
+func Names() []string {
+	registryMux.RLock()
+	defer registryMux.RUnlock()
+	names := make([]string, 0, len(instances))
+	for name := range instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StartAll starts every registered instance once (aliases share their target's start)
+func StartAll(rt Runtime) {
+	started := make(map[Provider]bool)
+	for _, name := range Names() {
+		p := Get(name)
+		if started[p] {
+			continue
+		}
+		started[p] = true
+		starter, ok := p.(Starter)
+		if !ok {
+			continue
+		}
+		if err := starter.Start(rt); err != nil {
+			log.Printf("⚠️ [Provider] %s failed to start: %v", name, err)
+		}
+	}
+}
+
+// StopAll stops the background jobs of every registered instance
+func StopAll() {
+	stopped := make(map[Provider]bool)
+	for _, name := range Names() {
+		p := Get(name)
+		if stopped[p] {
+			continue
+		}
+		stopped[p] = true
+		if stopper, ok := p.(Stopper); ok {
+			stopper.Stop()
+		}
+	}
+}
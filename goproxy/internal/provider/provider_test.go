@@ -0,0 +1,95 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeProvider struct {
+	spec   Spec
+	starts int
+}
+
+func (f *fakeProvider) Name() string       { return f.spec.Name }
+func (f *fakeProvider) Type() string       { return f.spec.Type }
+func (f *fakeProvider) IsConfigured() bool { return true }
+func (f *fakeProvider) ForwardRequest(ctx context.Context, body []byte, isStreaming bool) (*http.Response, error) {
+	return nil, nil
+}
+func (f *fakeProvider) HandleStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage UsageCallback) {
+}
+func (f *fakeProvider) HandleNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage UsageCallback) {
+}
+func (f *fakeProvider) Start(rt Runtime) error {
+	f.starts++
+	return nil
+}
+
+func TestBuild(t *testing.T) {
+	RegisterType("fake", func(spec Spec) (Provider, error) {
+		return &fakeProvider{spec: spec}, nil
+	})
+
+	err := Build([]Spec{
+		{Name: "fake-a", Type: "fake"},
+		{Name: "fake-alias", AliasOf: "fake-a"},
+		{Name: "fake-off", Type: "fake", Disabled: true},
+	})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	a := Get("fake-a")
+	if a == nil || a.Name() != "fake-a" {
+		t.Fatalf("fake-a = %v, want registered instance", a)
+	}
+	if Get("fake-alias") != a {
+		t.Fatal("alias should resolve to its target instance")
+	}
+	if Get("fake-off") != nil || IsConfigured("fake-off") {
+		t.Fatal("disabled upstream should not be registered")
+	}
+
+	StartAll(Runtime{})
+	if starts := a.(*fakeProvider).starts; starts != 1 {
+		t.Fatalf("fake-a started %d times, want 1 (aliases share the start)", starts)
+	}
+
+	if err := Build([]Spec{{Name: "bad", Type: "no-such-type"}}); err == nil {
+		t.Fatal("unknown provider type should fail")
+	}
+	if err := Build([]Spec{{Name: "dangling", AliasOf: "missing"}}); err == nil {
+		t.Fatal("alias of a missing upstream should fail")
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	messages := httptest.NewRequest(http.MethodPost, "https://upstream.example/v1/messages", nil)
+	SetHeaders(messages, HeaderProfileSDK, "sk-1", "cli/1.0", false)
+	if got := messages.Header.Get("anthropic-version"); got != "2023-06-01" {
+		t.Fatalf("sdk messages anthropic-version = %q", got)
+	}
+	if got := messages.Header.Get("User-Agent"); got != "Anthropic/v1 GoProxy/1.0" {
+		t.Fatalf("sdk messages User-Agent = %q", got)
+	}
+
+	completions := httptest.NewRequest(http.MethodPost, "https://upstream.example/v1/chat/completions", nil)
+	SetHeaders(completions, HeaderProfileOpenHandsCLI, "sk-2", "cli/1.0", true)
+	for header, want := range map[string]string{
+		"Authorization":      "Bearer sk-2",
+		"x-api-key":          "sk-2",
+		"x-openhands-client": "cli",
+		"User-Agent":         "cli/1.0",
+		"Accept":             "text/event-stream",
+	} {
+		if got := completions.Header.Get(header); got != want {
+			t.Errorf("openhands-cli %s = %q, want %q", header, got, want)
+		}
+	}
+
+	if IsValidHeaderProfile("browser") {
+		t.Fatal("unknown header profile should be invalid")
+	}
+}
@@ -28,6 +28,7 @@ type ProxyPool struct {
 	keyIndex    map[string]int          // proxyId -> current key index for round-robin
 	clientCache map[string]*http.Client // proxyId -> cached HTTP client
 	clientMu    sync.RWMutex            // separate mutex for client cache
+	stopReload  chan struct{}           // closed by StopAutoReload
 }
 
 // UseOptimizedPool controls whether to use the lock-free optimized pool
@@ -412,21 +413,41 @@ func (p *ProxyPool) Reload() error {
 
 // StartAutoReload starts a background goroutine that periodically reloads bindings from database
 func (p *ProxyPool) StartAutoReload(interval time.Duration) {
+	p.mu.Lock()
+	stop := make(chan struct{})
+	p.stopReload = stop
+	p.mu.Unlock()
+
 	go func() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
 		// Auto-reload started log disabled to reduce noise
 
-		for range ticker.C {
-			if err := p.LoadFromDB(); err != nil {
-				log.Printf("⚠️ Auto-reload failed: %v", err)
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.LoadFromDB(); err != nil {
+					log.Printf("⚠️ Auto-reload failed: %v", err)
+				}
+				// Auto-reload success log disabled to reduce noise
+			case <-stop:
+				return
 			}
-			// Auto-reload success log disabled to reduce noise
 		}
 	}()
 }
 
+// StopAutoReload stops the auto-reload goroutine, if running
+func (p *ProxyPool) StopAutoReload() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopReload != nil {
+		close(p.stopReload)
+		p.stopReload = nil
+	}
+}
+
 // GetBindingsInfo returns a summary of current bindings for logging
 func (p *ProxyPool) GetBindingsInfo() map[string][]string {
 	p.mu.RLock()
@@ -0,0 +1,344 @@
+package reservation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"goproxy/db"
+)
+
+// Credit reservations (hold and settle)
+// Credits are deducted after the response, asynchronously when writes are batched, so a
+// balance check alone lets a user with many parallel requests pass every check and overspend.
+// Each request therefore holds its worst-case cost before it is forwarded. Holds live on the
+// user's usersNew document (creditHolds), keyed by request ID, so every instance billing the
+// same balance sees them: a hold is pushed by one conditional update that only matches while
+// the balance minus the account's unexpired holds covers it, and the user's spend caps have
+// room for it (see Cap). The deduction write pulls the request's hold in the same update. A
+// deduction queued by the batcher marks its hold queued, so the hold keeps counting until the
+// flush writes the deduction and pulls it. Holds of requests that never finish stop counting
+// after TTL and are pulled by later writes.
+
+var (
+	// Enabled turns holds off; requests then only pass the balance pre-check
+	Enabled = true
+
+	// TTL is how long a hold counts if its request never settles it (crash, panic)
+	TTL = 15 * time.Minute
+)
+
+// Account is the balance a hold is placed on (config billing_upstream)
+type Account string
+
+const (
+	Credits    Account = "credits"    // credits + refCredits
+	CreditsNew Account = "creditsNew" // OpenHands balance
+)
+
+// holdsField is the usersNew array of holds
+const holdsField = "creditHolds"
+
+// ErrInsufficient is returned when the available balance cannot cover a hold
+var ErrInsufficient = errors.New("insufficient credits")
+
+// InsufficientError reports the hold that could not be placed
+type InsufficientError struct {
+	Amount    float64
+	Available float64
+}
+
+func (e *InsufficientError) Error() string {
+	return fmt.Sprintf("insufficient credits for request. Estimated cost: $%.2f, Available: $%.2f", e.Amount, e.Available)
+}
+
+func (e *InsufficientError) Unwrap() error {
+	return ErrInsufficient
+}
+
+// Entry is a hold as stored in the user's creditHolds
+type Entry struct {
+	ID        string    `bson:"id"` // request ID
+	Account   Account   `bson:"account"`
+	Amount    float64   `bson:"amount"`
+	Queued    bool      `bson:"queued,omitempty"` // its deduction waits in the batcher
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// Entries are a user's stored holds
+type Entries []Entry
+
+// Held sums the unexpired holds on account, or on every account if it is empty
+func (e Entries) Held(account Account, now time.Time) float64 {
+	total := 0.0
+	for _, h := range e {
+		if (account == "" || h.Account == account) && now.Before(h.ExpiresAt) {
+			total += h.Amount
+		}
+	}
+	return total
+}
+
+// Hold is credit set aside for one in-flight request. A nil Hold is a no-op, so requests
+// without a user or with holds disabled need no special casing.
+type Hold struct {
+	RequestID string
+	Username  string
+	Account   Account
+	Amount    float64
+	ExpiresAt time.Time
+
+	once sync.Once
+}
+
+// Stats counts holds since startup
+type Stats struct {
+	Placed   int64   `json:"placed"`   // holds granted
+	Rejected int64   `json:"rejected"` // holds refused for lack of credits
+	Settled  int64   `json:"settled"`
+	Released int64   `json:"released"` // ended without a charge (errors, cancelled)
+	Failed   int64   `json:"failed"`   // holds that could not be placed or pulled (Mongo errors)
+	Charged  float64 `json:"charged"`  // actual cost of settled holds
+	Freed    float64 `json:"freed"`    // held but not charged on settlement
+}
+
+var (
+	statsMu sync.Mutex
+	stats   Stats
+)
+
+// GetStats returns the counters since startup
+func GetStats() Stats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	return stats
+}
+
+func count(f func(s *Stats)) {
+	statsMu.Lock()
+	f(&stats)
+	statsMu.Unlock()
+}
+
+// balanceExpr is the account's balance in an aggregation expression
+func balanceExpr(account Account) interface{} {
+	if account == CreditsNew {
+		return bson.M{"$ifNull": bson.A{"$creditsNew", 0}}
+	}
+	return bson.M{"$add": bson.A{
+		bson.M{"$ifNull": bson.A{"$credits", 0}},
+		bson.M{"$ifNull": bson.A{"$refCredits", 0}},
+	}}
+}
+
+// heldExpr sums the holds unexpired at now in an aggregation expression, on account or on
+// every account if it is empty
+func heldExpr(account Account, now time.Time) interface{} {
+	cond := bson.A{bson.M{"$gt": bson.A{"$$h.expiresAt", now}}}
+	if account != "" {
+		cond = append(cond, bson.M{"$eq": bson.A{"$$h.account", string(account)}})
+	}
+	return bson.M{"$sum": bson.M{"$map": bson.M{
+		"input": bson.M{"$filter": bson.M{
+			"input": bson.M{"$ifNull": bson.A{"$" + holdsField, bson.A{}}},
+			"as":    "h",
+			"cond":  bson.M{"$and": cond},
+		}},
+		"as": "h",
+		"in": "$$h.amount",
+	}}}
+}
+
+// Cap is a limit on the user's document checked in the same write that places a hold
+// (spend caps). Every hold of the user counts against it, whatever its account.
+type Cap interface {
+	// Expr is true while the document leaves room for amount on top of held, the
+	// expression of the user's holds
+	Expr(amount float64, held interface{}, now time.Time) interface{}
+	// Refused explains a refused hold by the user's document, nil if the cap has room
+	Refused(doc bson.Raw, amount, held float64, now time.Time) error
+}
+
+// reserveFilter matches username's document while the account's balance minus its holds
+// covers amount, if holds check the balance, and caps has room for it
+func reserveFilter(username string, account Account, amount float64, caps Cap, now time.Time) bson.M {
+	var conds bson.A
+	if Enabled {
+		conds = append(conds, bson.M{"$gte": bson.A{
+			bson.M{"$subtract": bson.A{balanceExpr(account), heldExpr(account, now)}},
+			amount,
+		}})
+	}
+	if caps != nil {
+		conds = append(conds, caps.Expr(amount, heldExpr("", now), now))
+	}
+	return bson.M{"_id": username, "$expr": bson.M{"$and": conds}}
+}
+
+// Reserve places a hold of amount on username's account for the request requestID. The
+// checks and the hold are one conditional write on the user's document, so parallel requests
+// on any instance cannot all pass on the same balance or cap. The balance is checked while
+// holds are enabled, caps (may be nil) always. It returns a nil hold if there is nothing to
+// check, the user does not exist or the write failed: the request then only passed the
+// balance pre-check. A refusal is an *InsufficientError or the error of caps.
+func Reserve(ctx context.Context, username, requestID string, account Account, amount float64, caps Cap) (*Hold, error) {
+	if (!Enabled && caps == nil) || username == "" || requestID == "" || amount <= 0 {
+		return nil, nil
+	}
+	now := time.Now()
+	h := &Hold{RequestID: requestID, Username: username, Account: account, Amount: amount, ExpiresAt: now.Add(TTL)}
+	entry := Entry{ID: requestID, Account: account, Amount: amount, ExpiresAt: h.ExpiresAt}
+
+	// A refusal is explained by the document as read afterwards; if a hold ended in between,
+	// the write is tried once more
+	for attempt := 0; attempt < 2; attempt++ {
+		result, err := db.UsersNewCollection().UpdateOne(ctx, reserveFilter(username, account, amount, caps, now), bson.M{"$push": bson.M{holdsField: entry}})
+		if err != nil {
+			count(func(s *Stats) { s.Failed++ })
+			log.Printf("⚠️ [%s] Failed to place credit hold: %v", username, err)
+			return nil, nil
+		}
+		if result.MatchedCount > 0 {
+			count(func(s *Stats) { s.Placed++ })
+			return h, nil
+		}
+
+		raw, err := db.UsersNewCollection().FindOne(ctx, bson.M{"_id": username}).Raw()
+		if err != nil {
+			if !errors.Is(err, mongo.ErrNoDocuments) {
+				log.Printf("⚠️ [%s] Failed to read balance after a refused credit hold: %v", username, err)
+			}
+			return nil, nil
+		}
+		if err := refusal(raw, account, amount, caps, now); err != nil {
+			count(func(s *Stats) { s.Rejected++ })
+			return nil, err
+		}
+	}
+	log.Printf("⚠️ [%s] Credit hold of $%.6f refused without a cause, letting the request through", username, amount)
+	return nil, nil
+}
+
+// refusal is why the user's document cannot take a hold of amount, nil if it can
+func refusal(raw bson.Raw, account Account, amount float64, caps Cap, now time.Time) error {
+	var user struct {
+		Credits     float64 `bson:"credits"`
+		RefCredits  float64 `bson:"refCredits"`
+		CreditsNew  float64 `bson:"creditsNew"`
+		CreditHolds Entries `bson:"creditHolds"`
+	}
+	if err := bson.Unmarshal(raw, &user); err != nil {
+		return nil
+	}
+	if caps != nil {
+		if err := caps.Refused(raw, amount, user.CreditHolds.Held("", now), now); err != nil {
+			return err
+		}
+	}
+	if !Enabled {
+		return nil
+	}
+	balance := user.Credits + user.RefCredits
+	if account == CreditsNew {
+		balance = user.CreditsNew
+	}
+	if available := balance - user.CreditHolds.Held(account, now); available < amount {
+		return &InsufficientError{Amount: amount, Available: available}
+	}
+	return nil
+}
+
+// Settle ends the hold with the request's actual cost, whose deduction must already be
+// written or queued (MarkQueued). A written deduction pulled the hold already; a queued one
+// keeps it until the flush. Settling twice is a no-op.
+func (h *Hold) Settle(actual float64) {
+	if h == nil {
+		return
+	}
+	h.once.Do(func() {
+		if h.pull() {
+			count(func(s *Stats) {
+				s.Settled++
+				s.Charged += actual
+				if freed := h.Amount - actual; freed > 0 {
+					s.Freed += freed
+				}
+			})
+		}
+	})
+}
+
+// Release ends the hold without a charge, unless it was settled already. Handlers defer it
+// so failed requests give their hold back.
+func (h *Hold) Release() {
+	if h == nil {
+		return
+	}
+	h.once.Do(func() {
+		if h.pull() {
+			count(func(s *Stats) {
+				s.Released++
+				s.Freed += h.Amount
+			})
+		}
+	})
+}
+
+// pull removes the hold unless its deduction is queued, along with the user's expired holds
+func (h *Hold) pull() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	update := bson.M{"$pull": bson.M{holdsField: bson.M{"$or": bson.A{
+		bson.M{"id": h.RequestID, "queued": bson.M{"$ne": true}},
+		bson.M{"expiresAt": bson.M{"$lte": time.Now()}},
+	}}}}
+	if _, err := db.UsersNewCollection().UpdateByID(ctx, h.Username, update); err != nil {
+		count(func(s *Stats) { s.Failed++ })
+		log.Printf("⚠️ [%s] Failed to end credit hold %s, it expires at %s: %v", h.Username, h.RequestID, h.ExpiresAt.Format(time.RFC3339), err)
+		return false
+	}
+	return true
+}
+
+// MarkQueued records that the deduction of requestID was queued but not yet written: its
+// hold becomes the deduction's cost and stays until the flush pulls it (PullIn)
+func MarkQueued(ctx context.Context, username, requestID string, cost float64) {
+	if username == "" || requestID == "" {
+		return
+	}
+	filter := bson.M{"_id": username, holdsField + ".id": requestID}
+	update := bson.M{"$set": bson.M{
+		holdsField + ".$.queued":    true,
+		holdsField + ".$.amount":    cost,
+		holdsField + ".$.expiresAt": time.Now().Add(TTL),
+	}}
+	if _, err := db.UsersNewCollection().UpdateOne(ctx, filter, update); err != nil {
+		log.Printf("⚠️ [%s] Failed to mark credit hold %s queued: %v", username, requestID, err)
+	}
+}
+
+// PullIn adds the removal of the requests' holds to a deduction's update, so the deduction
+// and the end of its holds are one write
+func PullIn(update bson.M, requestIDs ...string) {
+	var ids []string
+	for _, id := range requestIDs {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	pull, _ := update["$pull"].(bson.M)
+	if pull == nil {
+		pull = bson.M{}
+		update["$pull"] = pull
+	}
+	pull[holdsField] = bson.M{"id": bson.M{"$in": ids}}
+}
@@ -0,0 +1,117 @@
+package reservation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestEntries_HeldSkipsExpiredAndOtherAccounts(t *testing.T) {
+	now := time.Now()
+	holds := Entries{
+		{ID: "req-1", Account: Credits, Amount: 3, ExpiresAt: now.Add(TTL)},
+		{ID: "req-2", Account: Credits, Amount: 0.5, Queued: true, ExpiresAt: now.Add(time.Minute)},
+		{ID: "req-3", Account: CreditsNew, Amount: 3, ExpiresAt: now.Add(TTL)},
+		{ID: "req-4", Account: Credits, Amount: 7, ExpiresAt: now.Add(-time.Second)},
+	}
+
+	if held := holds.Held(Credits, now); held != 3.5 {
+		t.Fatalf("Expected $3.50 held on credits, got $%.2f", held)
+	}
+	if held := holds.Held(CreditsNew, now); held != 3 {
+		t.Fatalf("Expected creditsNew to be held separately, got $%.2f", held)
+	}
+	if held := holds.Held(Credits, now.Add(TTL+time.Second)); held != 0 {
+		t.Fatalf("Expected abandoned holds to expire, got $%.2f", held)
+	}
+}
+
+// stubCap is a cap with a fixed expression
+type stubCap struct{}
+
+func (stubCap) Expr(amount float64, held interface{}, now time.Time) interface{} {
+	return bson.M{"stub": held}
+}
+
+func (stubCap) Refused(doc bson.Raw, amount, held float64, now time.Time) error {
+	return nil
+}
+
+// TestReserveFilter_ChecksBalanceMinusHolds verifies the hold is conditional on the stored
+// balance net of the account's unexpired holds, and on the caps, so the checks and the hold
+// are one write
+func TestReserveFilter_ChecksBalanceMinusHolds(t *testing.T) {
+	now := time.Now()
+	filter := reserveFilter("alice", CreditsNew, 0.3, stubCap{}, now)
+	if filter["_id"] != "alice" {
+		t.Fatalf("Expected the filter on the user, got %v", filter)
+	}
+	conds := filter["$expr"].(bson.M)["$and"].(bson.A)
+	if len(conds) != 2 {
+		t.Fatalf("Expected the balance and the caps checked, got %v", conds)
+	}
+	gte := conds[0].(bson.M)["$gte"].(bson.A)
+	if gte[1] != 0.3 {
+		t.Fatalf("Expected the hold amount on the right of the check, got %v", gte)
+	}
+	sub := gte[0].(bson.M)["$subtract"].(bson.A)
+	if balance := sub[0].(bson.M)["$ifNull"].(bson.A); balance[0] != "$creditsNew" {
+		t.Errorf("Expected the creditsNew balance, got %v", sub[0])
+	}
+	held := sub[1].(bson.M)["$sum"].(bson.M)["$map"].(bson.M)["input"].(bson.M)["$filter"].(bson.M)
+	cond := held["cond"].(bson.M)["$and"].(bson.A)
+	if expiry := cond[0].(bson.M)["$gt"].(bson.A); expiry[1] != now {
+		t.Errorf("Expected expired holds left out, got %v", expiry)
+	}
+	if account := cond[1].(bson.M)["$eq"].(bson.A); account[1] != "creditsNew" {
+		t.Errorf("Expected only creditsNew holds counted, got %v", account)
+	}
+
+	// The caps count the holds of every account
+	capsHeld := conds[1].(bson.M)["stub"].(bson.M)["$sum"].(bson.M)["$map"].(bson.M)["input"].(bson.M)["$filter"].(bson.M)
+	if cond := capsHeld["cond"].(bson.M)["$and"].(bson.A); len(cond) != 1 {
+		t.Errorf("Expected the caps to count holds of both accounts, got %v", cond)
+	}
+
+	enabled := Enabled
+	t.Cleanup(func() { Enabled = enabled })
+	Enabled = false
+	if conds := reserveFilter("alice", Credits, 0.3, stubCap{}, now)["$expr"].(bson.M)["$and"].(bson.A); len(conds) != 1 {
+		t.Errorf("Expected only the caps checked with holds off, got %v", conds)
+	}
+}
+
+func TestPullIn_EndsHoldsWithTheDeduction(t *testing.T) {
+	update := bson.M{"$inc": bson.M{"credits": -0.5}}
+	PullIn(update, "req-1", "", "req-2")
+	ids := update["$pull"].(bson.M)[holdsField].(bson.M)["id"].(bson.M)["$in"].([]string)
+	if len(ids) != 2 || ids[0] != "req-1" || ids[1] != "req-2" {
+		t.Fatalf("Expected the holds of both requests pulled, got %v", update)
+	}
+
+	update = bson.M{"$inc": bson.M{"credits": -0.5}}
+	PullIn(update, "")
+	if _, ok := update["$pull"]; ok {
+		t.Errorf("Expected no pull for requests without an ID, got %v", update)
+	}
+}
+
+func TestReserve_NoHoldWhenDisabled(t *testing.T) {
+	enabled := Enabled
+	t.Cleanup(func() { Enabled = enabled })
+	Enabled = false
+
+	h, err := Reserve(context.Background(), "alice", "req-1", Credits, 100, nil)
+	if h != nil || err != nil {
+		t.Fatalf("Expected no hold and no error while disabled without caps, got %v, %v", h, err)
+	}
+	h.Settle(1) // nil holds are no-ops
+	h.Release()
+
+	Enabled = true
+	if h, err := Reserve(context.Background(), "", "req-1", Credits, 100, stubCap{}); h != nil || err != nil {
+		t.Fatalf("Expected env-key requests without a user to skip holds, got %v, %v", h, err)
+	}
+}
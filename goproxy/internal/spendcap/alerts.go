@@ -0,0 +1,163 @@
+package spendcap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// AlertThresholds are the shares of a daily or monthly cap that trigger an alert. Each is
+// sent once per window length (a day or 30 days) per subject.
+var AlertThresholds = []int{50, 80, 100}
+
+// Alert reports that a subject's spend crossed a share of one of its caps
+type Alert struct {
+	Subject   string    `bson:"subject" json:"-"`
+	Username  string    `bson:"username" json:"username"`
+	Key       string    `bson:"key,omitempty" json:"key,omitempty"` // masked; empty for user caps
+	Window    Window    `bson:"window" json:"window"`
+	Threshold int       `bson:"threshold" json:"threshold"` // percent of the cap
+	Limit     float64   `bson:"limitUsd" json:"limit_usd"`
+	Spent     float64   `bson:"spentUsd" json:"spent_usd"`
+	CreatedAt time.Time `bson:"createdAt" json:"created_at"`
+	ExpiresAt time.Time `bson:"expireAt" json:"-"` // when the same alert may be sent again
+}
+
+// ID identifies the alert per subject, window and threshold
+func (a Alert) ID() string {
+	return fmt.Sprintf("%s|%s|%d", a.Subject, a.Window, a.Threshold)
+}
+
+// Notifier delivers spend alerts
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// LogNotifier writes alerts to the log
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, a Alert) error {
+	who := "user " + a.Username
+	if a.Key != "" {
+		who = "key " + a.Key + " of " + who
+	}
+	log.Printf("🔔 [SpendCap] %s reached %d%% of its %s cap: $%.2f of $%.2f", who, a.Threshold, a.Window, a.Spent, a.Limit)
+	return nil
+}
+
+// WebhookNotifier posts alerts as JSON to URL
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n WebhookNotifier) Notify(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(map[string]interface{}{"type": "spend_cap_alert", "alert": a})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Notifiers delivers each alert to all of its notifiers
+type Notifiers []Notifier
+
+func (ns Notifiers) Notify(ctx context.Context, a Alert) error {
+	var first error
+	for _, n := range ns {
+		if err := n.Notify(ctx, a); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// crossed returns the alerts of the highest threshold each cap of s crossed with the last
+// spend of cost, unless this instance sent them already. u is the subject's usage after the
+// spend was recorded, extra spend not yet in its buckets (queued deductions).
+func (g *Guard) crossed(s Subject, username string, u usage, extra, cost float64, now time.Time) []Alert {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var alerts []Alert
+	for _, win := range []Window{Daily, Monthly} {
+		limit := win.limit(u.Policy)
+		if limit <= 0 {
+			continue
+		}
+		after := u.spent(win, now) + extra
+		before := after - cost
+		crossed := 0
+		for _, t := range AlertThresholds {
+			level := limit * float64(t) / 100
+			if before < level && after >= level {
+				crossed = t
+			}
+		}
+		if crossed == 0 {
+			continue
+		}
+		a := Alert{
+			Subject:   s.String(),
+			Username:  username,
+			Window:    win,
+			Threshold: crossed,
+			Limit:     limit,
+			Spent:     after,
+			CreatedAt: now,
+			ExpiresAt: now.Add(time.Duration(win.hours()) * time.Hour),
+		}
+		if s.Kind == KindKey {
+			a.Key = maskKey(s.ID)
+		}
+		if until, ok := g.alerted[a.ID()]; ok && now.Before(until) {
+			continue
+		}
+		for id, until := range g.alerted {
+			if now.After(until) {
+				delete(g.alerted, id)
+			}
+		}
+		g.alerted[a.ID()] = a.ExpiresAt
+		alerts = append(alerts, a)
+	}
+	return alerts
+}
+
+// send records the alert, so other instances do not send it again, and delivers it
+func (g *Guard) send(a Alert) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	claimed, err := g.store.ClaimAlert(ctx, a)
+	if err != nil {
+		log.Printf("⚠️ [SpendCap] Failed to record alert %s: %v", a.ID(), err)
+	}
+	if !claimed && err == nil {
+		return
+	}
+	g.count(func(s *Stats) { s.Alerts++ })
+	if err := g.notifier.Notify(ctx, a); err != nil {
+		log.Printf("⚠️ [SpendCap] Failed to deliver alert %s: %v", a.ID(), err)
+	}
+}
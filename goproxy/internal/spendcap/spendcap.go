@@ -0,0 +1,503 @@
+package spendcap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"goproxy/internal/userkey"
+)
+
+// Spend caps
+// A user (usersNew) or one of their keys (user_keys) can carry a spendPolicy: a daily and a
+// monthly USD cap and a per-request maximum. Spend is kept on the same document in hourly
+// (spendHours) and daily (spendDays) buckets; the daily cap applies to the last 24 hours and
+// the monthly cap to the last 30 days. A request holds its worst-case cost before it is
+// forwarded, in the conditional write that checks the caps, so parallel requests on any
+// instance cannot pass the same headroom: for a user that is the credit hold (UserCaps), for
+// a key a hold in its spendHolds. The user's spend is recorded in the write that deducts its
+// credits (RecordIn), the key's in the write that ends its hold (Settle), so the caps are
+// enforced against what was charged and no spend waits in memory. Spend is recorded for every
+// user and key, so a policy set later applies to past spend too.
+
+var (
+	// Enabled turns spend caps and spend recording off
+	Enabled = true
+
+	// HoldTTL is how long a key hold counts if its request never settles or releases it
+	HoldTTL = 15 * time.Minute
+)
+
+// Fields of usersNew and user_keys documents
+const (
+	policyField = "spendPolicy"
+	hoursField  = "spendHours" // Unix hour -> USD
+	daysField   = "spendDays"  // Unix day -> USD
+	holdsField  = "spendHolds" // holds on a key's caps
+)
+
+// Policy limits what a user or key may spend. Zero fields are unlimited.
+type Policy struct {
+	DailyUSD      float64 `bson:"dailyUsd,omitempty" json:"daily_usd,omitempty"`
+	MonthlyUSD    float64 `bson:"monthlyUsd,omitempty" json:"monthly_usd,omitempty"`
+	MaxRequestUSD float64 `bson:"maxRequestUsd,omitempty" json:"max_request_usd,omitempty"`
+}
+
+// Limited reports whether the policy caps anything
+func (p Policy) Limited() bool {
+	return p.DailyUSD > 0 || p.MonthlyUSD > 0 || p.MaxRequestUSD > 0
+}
+
+// Window is the span a cap applies to
+type Window string
+
+const (
+	Daily      Window = "daily"   // last 24 hours
+	Monthly    Window = "monthly" // last 30 days
+	PerRequest Window = "request" // worst-case cost of one request
+)
+
+// hours is the length of the window
+func (w Window) hours() int64 {
+	if w == Monthly {
+		return 30 * 24
+	}
+	return 24
+}
+
+func (w Window) limit(p Policy) float64 {
+	switch w {
+	case Daily:
+		return p.DailyUSD
+	case Monthly:
+		return p.MonthlyUSD
+	}
+	return p.MaxRequestUSD
+}
+
+// policyField is the policy's field of the window's cap
+func (w Window) policyField() string {
+	switch w {
+	case Daily:
+		return "dailyUsd"
+	case Monthly:
+		return "monthlyUsd"
+	}
+	return "maxRequestUsd"
+}
+
+// buckets returns the bucket field of the window and the first of its buckets at now
+func (w Window) buckets(now time.Time) (field string, from int64) {
+	if w == Monthly {
+		return daysField, dayOf(now) - 29
+	}
+	return hoursField, hourOf(now) - 23
+}
+
+func hourOf(t time.Time) int64 {
+	return t.Unix() / 3600
+}
+
+func dayOf(t time.Time) int64 {
+	return t.Unix() / 86400
+}
+
+// Subject is what a policy is set on: a user or a user key
+type Subject struct {
+	Kind string // KindUser or KindKey
+	ID   string // username or API key
+}
+
+const (
+	KindUser = "user"
+	KindKey  = "key"
+)
+
+func (s Subject) String() string {
+	return s.Kind + ":" + s.ID
+}
+
+// label names the subject in errors and alerts without revealing a key
+func (s Subject) label() string {
+	if s.Kind == KindKey {
+		return "key " + maskKey(s.ID)
+	}
+	return "user " + s.ID
+}
+
+func maskKey(key string) string {
+	if len(key) < 10 {
+		return "***"
+	}
+	return key[:7] + "***" + key[len(key)-3:]
+}
+
+// Subjects returns the subjects a request is counted against: its user and, for user keys,
+// the key. Friend keys are limited by their own per-model limits.
+func Subjects(username, apiKey string) []Subject {
+	var subjects []Subject
+	if username != "" {
+		subjects = append(subjects, Subject{Kind: KindUser, ID: username})
+	}
+	if userkey.GetKeyType(apiKey) == userkey.KeyTypeUser {
+		subjects = append(subjects, Subject{Kind: KindKey, ID: apiKey})
+	}
+	return subjects
+}
+
+// ErrExceeded is returned when a request would go over a spend cap
+var ErrExceeded = errors.New("spend cap exceeded")
+
+// ExceededError reports the cap a request would go over
+type ExceededError struct {
+	Subject Subject
+	Window  Window
+	Limit   float64
+	Spent   float64 // spent and held in the window; unused for per-request caps
+	Cost    float64 // worst-case cost of the request
+}
+
+func (e *ExceededError) Error() string {
+	if e.Window == PerRequest {
+		return fmt.Sprintf("request may cost up to $%.2f, over the per-request spend cap of $%.2f for this %s", e.Cost, e.Limit, e.Subject.Kind)
+	}
+	span := "24 hours"
+	if e.Window == Monthly {
+		span = "30 days"
+	}
+	return fmt.Sprintf("%s spend cap of $%.2f for this %s reached: $%.2f spent in the last %s, request may cost up to $%.2f", e.Window, e.Limit, e.Subject.Kind, e.Spent, span, e.Cost)
+}
+
+func (e *ExceededError) Unwrap() error {
+	return ErrExceeded
+}
+
+// usage is a subject's policy and spend as stored on its document
+type usage struct {
+	Policy Policy             `bson:"spendPolicy"`
+	Hours  map[string]float64 `bson:"spendHours"`
+	Days   map[string]float64 `bson:"spendDays"`
+	Holds  []keyHold          `bson:"spendHolds"`
+}
+
+// keyHold is a hold on a key's caps as stored in its spendHolds
+type keyHold struct {
+	ID        string    `bson:"id"` // request ID
+	Amount    float64   `bson:"amount"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// spent sums the window's buckets at now
+func (u usage) spent(win Window, now time.Time) float64 {
+	field, from := win.buckets(now)
+	buckets := u.Hours
+	if field == daysField {
+		buckets = u.Days
+	}
+	total := 0.0
+	for k, usd := range buckets {
+		if i, err := strconv.ParseInt(k, 10, 64); err == nil && i >= from {
+			total += usd
+		}
+	}
+	return total
+}
+
+// held sums the key holds unexpired at now
+func (u usage) held(now time.Time) float64 {
+	total := 0.0
+	for _, h := range u.Holds {
+		if now.Before(h.ExpiresAt) {
+			total += h.Amount
+		}
+	}
+	return total
+}
+
+// exceeded returns the cap of s that cost does not fit under on top of held, or nil
+func (u usage) exceeded(s Subject, cost, held float64, now time.Time) *ExceededError {
+	if limit := u.Policy.MaxRequestUSD; limit > 0 && cost > limit {
+		return &ExceededError{Subject: s, Window: PerRequest, Limit: limit, Cost: cost}
+	}
+	for _, win := range []Window{Daily, Monthly} {
+		limit := win.limit(u.Policy)
+		if limit <= 0 {
+			continue
+		}
+		if spent := u.spent(win, now) + held; spent+cost > limit {
+			return &ExceededError{Subject: s, Window: win, Limit: limit, Spent: spent, Cost: cost}
+		}
+	}
+	return nil
+}
+
+// spentExpr sums the window's buckets at now in an aggregation expression
+func spentExpr(win Window, now time.Time) interface{} {
+	field, from := win.buckets(now)
+	return bson.M{"$sum": bson.M{"$map": bson.M{
+		"input": bson.M{"$filter": bson.M{
+			"input": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$" + field, bson.M{}}}},
+			"as":    "b",
+			"cond":  bson.M{"$gte": bson.A{bson.M{"$toLong": "$$b.k"}, from}},
+		}},
+		"as": "b",
+		"in": "$$b.v",
+	}}}
+}
+
+// capsExpr is true while the document's policy has room for cost on top of held, an
+// expression of the holds on the document
+func capsExpr(cost float64, held interface{}, now time.Time) bson.M {
+	unlimited := func(win Window) bson.M {
+		return bson.M{"$lte": bson.A{bson.M{"$ifNull": bson.A{"$" + policyField + "." + win.policyField(), 0}}, 0}}
+	}
+	limit := func(win Window) string {
+		return "$" + policyField + "." + win.policyField()
+	}
+	conds := bson.A{bson.M{"$or": bson.A{
+		unlimited(PerRequest),
+		bson.M{"$lte": bson.A{cost, limit(PerRequest)}},
+	}}}
+	for _, win := range []Window{Daily, Monthly} {
+		conds = append(conds, bson.M{"$or": bson.A{
+			unlimited(win),
+			bson.M{"$lte": bson.A{bson.M{"$add": bson.A{spentExpr(win, now), held, cost}}, limit(win)}},
+		}})
+	}
+	return bson.M{"$and": conds}
+}
+
+// RecordIn adds cost to the spend buckets in update, a write to a usersNew or user_keys
+// document, and drops buckets that fell out of the windows in the same write. Buckets of
+// subjects idle for longer than the windows are left, but no longer counted.
+func RecordIn(update bson.M, cost float64, now time.Time) {
+	if !Enabled || cost <= 0 {
+		return
+	}
+	inc, _ := update["$inc"].(bson.M)
+	if inc == nil {
+		inc = bson.M{}
+		update["$inc"] = inc
+	}
+	hour, day := hourOf(now), dayOf(now)
+	inc[hoursField+"."+strconv.FormatInt(hour, 10)] = cost
+	inc[daysField+"."+strconv.FormatInt(day, 10)] = cost
+
+	unset, _ := update["$unset"].(bson.M)
+	if unset == nil {
+		unset = bson.M{}
+		update["$unset"] = unset
+	}
+	for h := hour - 47; h <= hour-24; h++ {
+		unset[hoursField+"."+strconv.FormatInt(h, 10)] = ""
+	}
+	for d := day - 35; d <= day-30; d++ {
+		unset[daysField+"."+strconv.FormatInt(d, 10)] = ""
+	}
+}
+
+// UserCaps are a user's caps, checked in the write that places the request's credit hold
+// (reservation.Cap): the user's credit holds are its holds on the caps
+type UserCaps struct {
+	Username string
+}
+
+func (c UserCaps) Expr(amount float64, held interface{}, now time.Time) interface{} {
+	return capsExpr(amount, held, now)
+}
+
+func (c UserCaps) Refused(doc bson.Raw, amount, held float64, now time.Time) error {
+	var u usage
+	if err := bson.Unmarshal(doc, &u); err != nil {
+		return nil
+	}
+	if e := u.exceeded(Subject{Kind: KindUser, ID: c.Username}, amount, held, now); e != nil {
+		return e
+	}
+	return nil
+}
+
+// Hold is a request's worst-case cost held on its key's caps. A nil Hold is a no-op.
+type Hold struct {
+	RequestID string
+	APIKey    string
+	Amount    float64
+	ExpiresAt time.Time
+
+	once sync.Once
+}
+
+// Release ends the hold without a charge, unless it was settled already
+func (h *Hold) Release() {
+	if h == nil {
+		return
+	}
+	h.once.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := releaseKey(ctx, h.APIKey, h.RequestID, time.Now()); err != nil {
+			log.Printf("⚠️ [SpendCap] Failed to release hold %s of key %s, it expires at %s: %v", h.RequestID, maskKey(h.APIKey), h.ExpiresAt.Format(time.RFC3339), err)
+		}
+	})
+}
+
+// Stats counts holds and alerts since startup
+type Stats struct {
+	Placed   int64 `json:"placed"` // holds on key caps
+	Rejected int64 `json:"rejected"`
+	Alerts   int64 `json:"alerts"`
+	Failed   int64 `json:"failed"` // spend that could not be recorded on a key
+}
+
+// Store records the alerts sent by every instance
+type Store interface {
+	// ClaimAlert records an alert; false if it was sent before (by any instance)
+	ClaimAlert(ctx context.Context, a Alert) (bool, error)
+}
+
+// Guard holds key caps, records key spend and sends alerts
+type Guard struct {
+	store    Store
+	notifier Notifier
+
+	mu      sync.Mutex
+	alerted map[string]time.Time // alert ID -> when it may be sent again
+	stats   Stats
+	now     func() time.Time
+}
+
+// NewGuard creates a guard that claims alerts in store and sends them to notifier
+func NewGuard(store Store, notifier Notifier) *Guard {
+	return &Guard{
+		store:    store,
+		notifier: notifier,
+		alerted:  make(map[string]time.Time),
+		now:      time.Now,
+	}
+}
+
+// ReserveKey checks a request's worst-case cost against the caps of apiKey and holds it on
+// them in one conditional write on the key's document. It returns an *ExceededError if a cap
+// would be exceeded, and a nil hold for keys that are not user keys or have no policy. A
+// failed write lets the request through.
+func (g *Guard) ReserveKey(ctx context.Context, requestID, apiKey string, cost float64) (*Hold, error) {
+	if !Enabled || requestID == "" || userkey.GetKeyType(apiKey) != userkey.KeyTypeUser {
+		return nil, nil
+	}
+	now := g.now()
+	h := &Hold{RequestID: requestID, APIKey: apiKey, Amount: cost, ExpiresAt: now.Add(HoldTTL)}
+	placed, u, err := holdKey(ctx, apiKey, keyHold{ID: requestID, Amount: cost, ExpiresAt: h.ExpiresAt}, now)
+	if err != nil {
+		log.Printf("⚠️ [SpendCap] Failed to hold $%.6f on key %s: %v", cost, maskKey(apiKey), err)
+		return nil, nil
+	}
+	if placed {
+		g.count(func(s *Stats) { s.Placed++ })
+		return h, nil
+	}
+	if e := u.exceeded(Subject{Kind: KindKey, ID: apiKey}, cost, u.held(now), now); e != nil {
+		g.count(func(s *Stats) { s.Rejected++ })
+		return nil, e
+	}
+	// No policy, or a hold ended since the write
+	return nil, nil
+}
+
+// Settle records a request's actual cost on its key, ending the key's hold in the same write,
+// and alerts on crossed thresholds of the user's and the key's caps in the background. The
+// user's spend was recorded with its deduction (RecordIn).
+func (g *Guard) Settle(requestID, username, apiKey string, cost float64) {
+	if !Enabled {
+		return
+	}
+	now := g.now()
+	subjects := Subjects(username, apiKey)
+	keyUsage := make(map[Subject]usage)
+	for _, s := range subjects {
+		if s.Kind != KindKey {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		u, err := settleKey(ctx, s.ID, requestID, cost, now)
+		cancel()
+		if err != nil {
+			g.count(func(s *Stats) { s.Failed++ })
+			log.Printf("⚠️ [SpendCap] Failed to record $%.6f on %s: %v", cost, s.label(), err)
+			continue
+		}
+		keyUsage[s] = u
+	}
+	if cost <= 0 {
+		return
+	}
+
+	go func() {
+		for _, s := range subjects {
+			u, ok := keyUsage[s]
+			extra := 0.0
+			if s.Kind == KindUser {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				var err error
+				u, extra, err = loadUser(ctx, s.ID, now)
+				cancel()
+				if err != nil {
+					log.Printf("⚠️ [SpendCap] Failed to read spend of %s for alerts: %v", s.label(), err)
+					continue
+				}
+			} else if !ok {
+				continue
+			}
+			for _, a := range g.crossed(s, username, u, extra, cost, now) {
+				g.send(a)
+			}
+		}
+	}()
+}
+
+func (g *Guard) count(f func(s *Stats)) {
+	g.mu.Lock()
+	f(&g.stats)
+	g.mu.Unlock()
+}
+
+// Stats returns the guard's counters
+func (g *Guard) Stats() Stats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stats
+}
+
+var defaultGuard *Guard
+
+// Init sets up the process-wide guard
+func Init(store Store, notifier Notifier) *Guard {
+	defaultGuard = NewGuard(store, notifier)
+	return defaultGuard
+}
+
+// Default returns the process-wide guard, nil before Init
+func Default() *Guard {
+	return defaultGuard
+}
+
+// ReserveKey is Guard.ReserveKey on the default guard
+func ReserveKey(ctx context.Context, requestID, apiKey string, cost float64) (*Hold, error) {
+	if defaultGuard == nil {
+		return nil, nil
+	}
+	return defaultGuard.ReserveKey(ctx, requestID, apiKey, cost)
+}
+
+// Settle is Guard.Settle on the default guard
+func Settle(requestID, username, apiKey string, cost float64) {
+	if defaultGuard == nil {
+		return
+	}
+	defaultGuard.Settle(requestID, username, apiKey, cost)
+}
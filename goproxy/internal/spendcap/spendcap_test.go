@@ -0,0 +1,201 @@
+package spendcap
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const testKey = "sk-trollllm-abcdef123456"
+
+// memoryStore is an in-memory Store for alert tests
+type memoryStore struct {
+	mu     sync.Mutex
+	alerts map[string]Alert
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{alerts: map[string]Alert{}}
+}
+
+func (s *memoryStore) ClaimAlert(ctx context.Context, a Alert) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.alerts[a.ID()]; ok {
+		return false, nil
+	}
+	s.alerts[a.ID()] = a
+	return true, nil
+}
+
+// recordingNotifier collects delivered alerts
+type recordingNotifier struct {
+	mu     sync.Mutex
+	alerts []Alert
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, a Alert) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.alerts = append(n.alerts, a)
+	return nil
+}
+
+var testNow = time.Date(2026, 10, 16, 12, 30, 0, 0, time.UTC)
+
+func user(name string) Subject {
+	return Subject{Kind: KindUser, ID: name}
+}
+
+// spentHoursAgo is usage with usd spent at each of the given hours before testNow
+func spentHoursAgo(policy Policy, usd map[int64]float64) usage {
+	u := usage{Policy: policy, Hours: map[string]float64{}, Days: map[string]float64{}}
+	for ago, amount := range usd {
+		t := testNow.Add(-time.Duration(ago) * time.Hour)
+		u.Hours[strconv.FormatInt(hourOf(t), 10)] += amount
+		u.Days[strconv.FormatInt(dayOf(t), 10)] += amount
+	}
+	return u
+}
+
+func TestSubjects_CountsUserKeysButNotFriendKeys(t *testing.T) {
+	if got := Subjects("alice", testKey); len(got) != 2 || got[1] != (Subject{Kind: KindKey, ID: testKey}) {
+		t.Errorf("Expected the user and the key, got %v", got)
+	}
+	if got := Subjects("alice", "sk-trollllm-friend-abcdef123456"); len(got) != 1 || got[0] != user("alice") {
+		t.Errorf("Expected only the owner for a friend key, got %v", got)
+	}
+}
+
+func TestUsage_HoldsCountAgainstTheCap(t *testing.T) {
+	u := spentHoursAgo(Policy{DailyUSD: 1}, map[int64]float64{2: 0.5})
+
+	if e := u.exceeded(user("alice"), 0.3, 0, testNow); e != nil {
+		t.Fatalf("Expected the first request to fit, got %v", e)
+	}
+
+	// $0.50 spent + $0.30 held leaves $0.20 for a parallel request
+	var err error = u.exceeded(user("alice"), 0.3, 0.3, testNow)
+	var exceeded *ExceededError
+	if !errors.As(err, &exceeded) || !errors.Is(err, ErrExceeded) {
+		t.Fatalf("Expected the parallel request to exceed the daily cap, got %v", err)
+	}
+	if exceeded.Window != Daily || exceeded.Limit != 1 || !floatEqual(exceeded.Spent, 0.8) {
+		t.Errorf("Unexpected error: %+v", exceeded)
+	}
+}
+
+func TestUsage_WindowsRoll(t *testing.T) {
+	u := spentHoursAgo(Policy{DailyUSD: 1, MonthlyUSD: 5.5}, map[int64]float64{
+		24:      0.9,  // a day ago: out of the daily window
+		24 * 28: 4.0,  // in the monthly window
+		24 * 31: 10.0, // out of both
+	})
+
+	if e := u.exceeded(user("alice"), 0.5, 0, testNow); e != nil {
+		t.Fatalf("Expected spend older than a day to be out of the daily cap, got %v", e)
+	}
+	if e := u.exceeded(user("alice"), 0.7, 0, testNow); e == nil || e.Window != Monthly {
+		t.Fatalf("Expected the monthly cap to count the last 30 days, got %v", e)
+	}
+}
+
+func TestUsage_PerRequestCap(t *testing.T) {
+	key := Subject{Kind: KindKey, ID: testKey}
+	u := usage{Policy: Policy{MaxRequestUSD: 0.25}}
+
+	if e := u.exceeded(key, 0.5, 0, testNow); e == nil || e.Window != PerRequest || e.Subject != key {
+		t.Fatalf("Expected the per-request cap to refuse the request, got %v", e)
+	}
+	if e := u.exceeded(key, 0.2, 10, testNow); e != nil {
+		t.Fatalf("Expected a cheaper request to pass whatever is held, got %v", e)
+	}
+}
+
+func TestUserCaps_RefusedReadsTheUserDocument(t *testing.T) {
+	u := spentHoursAgo(Policy{DailyUSD: 1}, map[int64]float64{1: 0.9})
+	doc, err := bson.Marshal(bson.M{"_id": "alice", policyField: u.Policy, hoursField: u.Hours, daysField: u.Days})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caps := UserCaps{Username: "alice"}
+
+	var exceeded *ExceededError
+	if err := caps.Refused(doc, 0.2, 0, testNow); !errors.As(err, &exceeded) || exceeded.Subject != user("alice") {
+		t.Fatalf("Expected the user's daily cap to explain the refusal, got %v", err)
+	}
+	if err := caps.Refused(doc, 0.05, 0, testNow); err != nil {
+		t.Fatalf("Expected no cap error with room left, got %v", err)
+	}
+}
+
+// TestRecordIn_SpendIsPartOfTheDeduction verifies the spend buckets are updated by the
+// deduction's own write, next to its other fields
+func TestRecordIn_SpendIsPartOfTheDeduction(t *testing.T) {
+	update := bson.M{"$inc": bson.M{"credits": -0.5, "creditsUsed": 0.5}}
+	RecordIn(update, 0.5, testNow)
+
+	inc := update["$inc"].(bson.M)
+	hour := strconv.FormatInt(hourOf(testNow), 10)
+	day := strconv.FormatInt(dayOf(testNow), 10)
+	if inc[hoursField+"."+hour] != 0.5 || inc[daysField+"."+day] != 0.5 || inc["credits"] != -0.5 {
+		t.Fatalf("Expected the spend added to the deduction's $inc, got %v", inc)
+	}
+	unset := update["$unset"].(bson.M)
+	if _, ok := unset[hoursField+"."+strconv.FormatInt(hourOf(testNow)-24, 10)]; !ok {
+		t.Errorf("Expected the hour that left the daily window dropped, got %v", unset)
+	}
+	if _, ok := unset[hoursField+"."+strconv.FormatInt(hourOf(testNow)-23, 10)]; ok {
+		t.Errorf("Expected the daily window's buckets kept, got %v", unset)
+	}
+	if _, ok := unset[daysField+"."+strconv.FormatInt(dayOf(testNow)-29, 10)]; ok {
+		t.Errorf("Expected the monthly window's buckets kept, got %v", unset)
+	}
+
+	update = bson.M{"$inc": bson.M{"credits": 0.0}}
+	RecordIn(update, 0, testNow)
+	if len(update["$inc"].(bson.M)) != 1 {
+		t.Errorf("Expected nothing recorded without a cost, got %v", update)
+	}
+}
+
+func TestGuard_AlertsOnceAtEachThreshold(t *testing.T) {
+	store := newMemoryStore()
+	notifier := &recordingNotifier{}
+	g := NewGuard(store, notifier)
+
+	var alerts []Alert
+	spent := 0.0
+	for _, cost := range []float64{4, 2, 3, 0.5, 1} { // 40%, 60%, 90%, 95%, 105%
+		spent += cost
+		u := spentHoursAgo(Policy{DailyUSD: 10}, map[int64]float64{0: spent})
+		alerts = append(alerts, g.crossed(user("alice"), "alice", u, 0, cost, testNow)...)
+	}
+	if len(alerts) != 3 || alerts[0].Threshold != 50 || alerts[1].Threshold != 80 || alerts[2].Threshold != 100 {
+		t.Fatalf("Expected one alert at 50, 80 and 100%%, got %+v", alerts)
+	}
+
+	// Queued deductions count before they reach the buckets
+	u := spentHoursAgo(Policy{MonthlyUSD: 10}, map[int64]float64{0: 3})
+	if got := g.crossed(user("bob"), "bob", u, 2.5, 2.5, testNow); len(got) != 1 || got[0].Threshold != 50 || got[0].Window != Monthly {
+		t.Fatalf("Expected the queued spend to cross 50%% of the monthly cap, got %+v", got)
+	}
+
+	// Another instance sent it already: not delivered again
+	store.alerts[alerts[0].ID()] = alerts[0]
+	g.send(alerts[0])
+	g.send(alerts[1])
+	if len(notifier.alerts) != 1 || notifier.alerts[0].Threshold != 80 {
+		t.Errorf("Expected only the unclaimed alert delivered, got %+v", notifier.alerts)
+	}
+}
+
+func floatEqual(a, b float64) bool {
+	d := a - b
+	return d < 1e-9 && d > -1e-9
+}
@@ -0,0 +1,134 @@
+package spendcap
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goproxy/db"
+	"goproxy/internal/reservation"
+)
+
+// usageProjection reads a subject's policy, spend and key holds
+var usageProjection = bson.M{policyField: 1, hoursField: 1, daysField: 1, holdsField: 1}
+
+// keyHeldExpr sums the key holds unexpired at now in an aggregation expression
+func keyHeldExpr(now time.Time) interface{} {
+	return bson.M{"$sum": bson.M{"$map": bson.M{
+		"input": bson.M{"$filter": bson.M{
+			"input": bson.M{"$ifNull": bson.A{"$" + holdsField, bson.A{}}},
+			"as":    "h",
+			"cond":  bson.M{"$gt": bson.A{"$$h.expiresAt", now}},
+		}},
+		"as": "h",
+		"in": "$$h.amount",
+	}}}
+}
+
+// endKeyHold is the $pull of a request's key hold and of the key's expired holds
+func endKeyHold(requestID string, now time.Time) bson.M {
+	return bson.M{holdsField: bson.M{"$or": bson.A{
+		bson.M{"id": requestID},
+		bson.M{"expiresAt": bson.M{"$lte": now}},
+	}}}
+}
+
+// holdKey pushes h onto the key's holds if the key has a policy with room for it. If not,
+// it returns the key's usage to explain why.
+func holdKey(ctx context.Context, apiKey string, h keyHold, now time.Time) (bool, usage, error) {
+	filter := bson.M{
+		"_id":       apiKey,
+		policyField: bson.M{"$exists": true},
+		"$expr":     capsExpr(h.Amount, keyHeldExpr(now), now),
+	}
+	result, err := db.UserKeysCollection().UpdateOne(ctx, filter, bson.M{"$push": bson.M{holdsField: h}})
+	if err != nil {
+		return false, usage{}, err
+	}
+	if result.MatchedCount > 0 {
+		return true, usage{}, nil
+	}
+	var u usage
+	err = db.UserKeysCollection().FindOne(ctx, bson.M{"_id": apiKey}, options.FindOne().SetProjection(usageProjection)).Decode(&u)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return false, usage{}, err
+	}
+	return false, u, nil
+}
+
+// releaseKey ends a request's key hold without a charge
+func releaseKey(ctx context.Context, apiKey, requestID string, now time.Time) error {
+	_, err := db.UserKeysCollection().UpdateByID(ctx, apiKey, bson.M{"$pull": endKeyHold(requestID, now)})
+	return err
+}
+
+// settleKey records cost on the key and ends the request's hold in one write, and returns the
+// key's usage after it
+func settleKey(ctx context.Context, apiKey, requestID string, cost float64, now time.Time) (usage, error) {
+	update := bson.M{"$pull": endKeyHold(requestID, now)}
+	RecordIn(update, cost, now)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(usageProjection)
+	var u usage
+	err := db.UserKeysCollection().FindOneAndUpdate(ctx, bson.M{"_id": apiKey}, update, opts).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		return usage{}, nil
+	}
+	return u, err
+}
+
+// loadUser reads a user's usage and the cost of their deductions queued but not yet written
+func loadUser(ctx context.Context, username string, now time.Time) (usage, float64, error) {
+	var doc struct {
+		usage       `bson:",inline"`
+		CreditHolds reservation.Entries `bson:"creditHolds"`
+	}
+	projection := bson.M{policyField: 1, hoursField: 1, daysField: 1, "creditHolds": 1}
+	err := db.UsersNewCollection().FindOne(ctx, bson.M{"_id": username}, options.FindOne().SetProjection(projection)).Decode(&doc)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return usage{}, 0, err
+	}
+	queued := 0.0
+	for _, h := range doc.CreditHolds {
+		if h.Queued && now.Before(h.ExpiresAt) {
+			queued += h.Amount
+		}
+	}
+	return doc.usage, queued, nil
+}
+
+// MongoStore keeps alerts in spend_alerts
+type MongoStore struct{}
+
+// NewMongoStore creates the MongoDB-backed store
+func NewMongoStore() *MongoStore {
+	return &MongoStore{}
+}
+
+func (s *MongoStore) ClaimAlert(ctx context.Context, a Alert) (bool, error) {
+	doc := struct {
+		ID    string `bson:"_id"`
+		Alert `bson:",inline"`
+	}{ID: a.ID(), Alert: a}
+	_, err := db.SpendAlertsCollection().InsertOne(ctx, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// EnsureIndexes creates the alert lookup index and expires old alerts
+func EnsureIndexes() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := db.SpendAlertsCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "expireAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		log.Printf("⚠️ [SpendCap] Failed to create spend_alerts indexes: %v", err)
+	}
+}
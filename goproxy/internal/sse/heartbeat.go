@@ -0,0 +1,174 @@
+package sse
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keepalive payloads. Both are complete SSE events so they can only be written between events.
+const (
+	// AnthropicPing is the ping event Anthropic itself sends; SDKs ignore it
+	AnthropicPing = "event: ping\ndata: {\"type\": \"ping\"}\n\n"
+
+	// OpenAIKeepalive is an SSE comment, skipped by every OpenAI client
+	OpenAIKeepalive = ": keepalive\n\n"
+)
+
+var (
+	// HeartbeatInterval is how long a stream may stay silent before a keepalive is sent
+	HeartbeatInterval = 15 * time.Second
+
+	// WriteTimeout is the write deadline set before every stream write, so an active
+	// stream keeps pushing it forward while a stalled client still times out
+	WriteTimeout = 60 * time.Second
+)
+
+// Writer serializes writes to a streaming response and sends a keepalive whenever the
+// upstream stays silent for HeartbeatInterval (e.g. Claude thinking before the first delta).
+// Stop must be called before the handler returns.
+type Writer struct {
+	w         http.ResponseWriter
+	rc        *http.ResponseController
+	keepalive string
+
+	mu        sync.Mutex
+	lastWrite time.Time
+	tail      string // last two bytes written, to detect event boundaries
+	started   bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartHeartbeat wraps w and starts the keepalive loop. Response headers must already be set.
+func StartHeartbeat(w http.ResponseWriter, keepalive string) *Writer {
+	s := &Writer{
+		w:         w,
+		rc:        http.NewResponseController(w),
+		keepalive: keepalive,
+		lastWrite: time.Now(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	s.extendDeadline()
+	go s.run()
+	return s
+}
+
+func (s *Writer) Header() http.Header {
+	return s.w.Header()
+}
+
+func (s *Writer) WriteHeader(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.WriteHeader(code)
+}
+
+func (s *Writer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked(p)
+}
+
+func (s *Writer) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *Writer) Unwrap() http.ResponseWriter {
+	return s.w
+}
+
+// Stop ends the keepalive loop and waits for an in-flight keepalive to finish
+func (s *Writer) Stop() {
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	<-s.done
+}
+
+func (s *Writer) writeLocked(p []byte) (int, error) {
+	s.extendDeadline()
+	s.lastWrite = time.Now()
+	s.started = true
+	if n := len(p); n >= 2 {
+		s.tail = string(p[n-2:])
+	} else {
+		s.tail = lastTwo(s.tail + string(p))
+	}
+	return s.w.Write(p)
+}
+
+func (s *Writer) flushLocked() {
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// atBoundary reports whether a keepalive would not split an event. Handlers that pass
+// upstream lines through one at a time are mid-event until the blank line arrives.
+func (s *Writer) atBoundary() bool {
+	return !s.started || s.tail == "\n\n"
+}
+
+func (s *Writer) extendDeadline() {
+	// Not every writer supports deadlines (e.g. buffered batch replays); ignore the error
+	s.rc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+}
+
+func (s *Writer) run() {
+	defer close(s.done)
+	timer := time.NewTimer(HeartbeatInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-timer.C:
+		}
+
+		s.mu.Lock()
+		idle := time.Since(s.lastWrite)
+		if idle >= HeartbeatInterval && s.atBoundary() {
+			if _, err := s.writeLocked([]byte(s.keepalive)); err != nil {
+				// Client is gone; the handler finds out on its next write
+				s.mu.Unlock()
+				return
+			}
+			s.flushLocked()
+			idle = 0
+		}
+		s.mu.Unlock()
+
+		if wait := HeartbeatInterval - idle; wait > 0 {
+			timer.Reset(wait)
+		} else {
+			// Mid-event: check again shortly
+			timer.Reset(HeartbeatInterval / 10)
+		}
+	}
+}
+
+func lastTwo(s string) string {
+	if len(s) <= 2 {
+		return s
+	}
+	return s[len(s)-2:]
+}
+
+// KeepaliveFor picks the keepalive matching the upstream endpoint's format, for handlers
+// shared by the Anthropic (/v1/messages) and OpenAI (/v1/chat/completions) routes
+func KeepaliveFor(resp *http.Response) string {
+	if resp != nil && resp.Request != nil && strings.HasSuffix(resp.Request.URL.Path, "/messages") {
+		return AnthropicPing
+	}
+	return OpenAIKeepalive
+}
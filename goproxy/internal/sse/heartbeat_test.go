@@ -0,0 +1,104 @@
+package sse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withInterval(t *testing.T, d time.Duration) {
+	t.Helper()
+	old := HeartbeatInterval
+	HeartbeatInterval = d
+	t.Cleanup(func() { HeartbeatInterval = old })
+}
+
+// =============================================================================
+// Heartbeat Tests
+// =============================================================================
+
+func TestHeartbeat_SilentStream(t *testing.T) {
+	withInterval(t, 10*time.Millisecond)
+	rec := httptest.NewRecorder()
+
+	hb := StartHeartbeat(rec, AnthropicPing)
+	hb.Write([]byte("event: message_start\ndata: {}\n\n"))
+	time.Sleep(50 * time.Millisecond)
+	hb.Stop()
+
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, "event: message_start\ndata: {}\n\n"+AnthropicPing) {
+		t.Errorf("Expected ping after message_start, got %q", body)
+	}
+	if !rec.Flushed {
+		t.Error("Expected keepalive to be flushed")
+	}
+}
+
+func TestHeartbeat_ActiveStream(t *testing.T) {
+	withInterval(t, 40*time.Millisecond)
+	rec := httptest.NewRecorder()
+
+	hb := StartHeartbeat(rec, OpenAIKeepalive)
+	for i := 0; i < 5; i++ {
+		hb.Write([]byte("data: {}\n\n"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	hb.Stop()
+
+	if strings.Contains(rec.Body.String(), OpenAIKeepalive) {
+		t.Errorf("Expected no keepalive while upstream is writing, got %q", rec.Body.String())
+	}
+}
+
+func TestHeartbeat_WaitsForEventBoundary(t *testing.T) {
+	withInterval(t, 10*time.Millisecond)
+	rec := httptest.NewRecorder()
+
+	hb := StartHeartbeat(rec, AnthropicPing)
+	// Passthrough handlers write one line at a time
+	hb.Write([]byte("event: content_block_delta\n"))
+	time.Sleep(40 * time.Millisecond)
+	hb.Write([]byte("data: {}\n"))
+	hb.Write([]byte("\n"))
+	time.Sleep(40 * time.Millisecond)
+	hb.Stop()
+
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, "event: content_block_delta\ndata: {}\n\n"+AnthropicPing) {
+		t.Errorf("Expected ping only after the event ended, got %q", body)
+	}
+}
+
+func TestHeartbeat_StopIsIdempotent(t *testing.T) {
+	hb := StartHeartbeat(httptest.NewRecorder(), OpenAIKeepalive)
+	hb.Stop()
+	hb.Stop()
+}
+
+func TestKeepaliveFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		expected string
+	}{
+		{"messages", "https://api.example.com/v1/messages", AnthropicPing},
+		{"chat completions", "https://api.example.com/v1/chat/completions", OpenAIKeepalive},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse(tt.url)
+			resp := &http.Response{Request: &http.Request{URL: u}}
+			if got := KeepaliveFor(resp); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+	if got := KeepaliveFor(nil); got != OpenAIKeepalive {
+		t.Errorf("Expected OpenAI keepalive for nil response, got %q", got)
+	}
+}
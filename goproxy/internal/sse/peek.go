@@ -0,0 +1,101 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxPeekBytes bounds how much of the stream is buffered while looking for the first event
+const maxPeekBytes = 1 << 20
+
+// PeekFirstEvent reads the first SSE event of resp (skipping comment-only keepalives) and
+// puts everything it read back in front of resp.Body, so the stream can still be passed
+// through unchanged. Read errors are left for the caller's own read loop to hit.
+func PeekFirstEvent(resp *http.Response) []byte {
+	br := bufio.NewReader(resp.Body)
+	var buf, event bytes.Buffer
+
+	for buf.Len() < maxPeekBytes {
+		line, err := br.ReadBytes('\n')
+		buf.Write(line)
+		trimmed := bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(trimmed) == 0 && event.Len() > 0:
+			err = io.EOF
+		case len(trimmed) > 0 && trimmed[0] != ':':
+			event.Write(trimmed)
+			event.WriteByte('\n')
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	resp.Body = &peekedBody{Reader: io.MultiReader(bytes.NewReader(buf.Bytes()), br), Closer: resp.Body}
+	return event.Bytes()
+}
+
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// ErrorStatus reports whether an SSE event is an error event and the HTTP status it stands
+// for. Upstreams that already answered 200 report rate limits and overload this way, e.g.
+// Anthropic's `event: error` with overloaded_error, or an OpenAI chunk carrying "error".
+func ErrorStatus(event []byte) (int, bool) {
+	isErrorEvent := false
+	var data struct {
+		Type  string `json:"type"`
+		Error *struct {
+			Type string      `json:"type"`
+			Code interface{} `json:"code"`
+		} `json:"error"`
+	}
+	for _, line := range strings.Split(string(event), "\n") {
+		if name, ok := strings.CutPrefix(line, "event:"); ok && strings.TrimSpace(name) == "error" {
+			isErrorEvent = true
+		}
+		if payload, ok := strings.CutPrefix(line, "data:"); ok {
+			json.Unmarshal([]byte(strings.TrimSpace(payload)), &data)
+		}
+	}
+	if data.Error == nil && data.Type != "error" && !isErrorEvent {
+		return 0, false
+	}
+	if data.Error == nil {
+		return http.StatusInternalServerError, true
+	}
+
+	switch code := data.Error.Code.(type) {
+	case float64:
+		if code >= 400 && code < 600 {
+			return int(code), true
+		}
+	case string:
+		if n, err := strconv.Atoi(code); err == nil && n >= 400 && n < 600 {
+			return n, true
+		}
+	}
+
+	switch data.Error.Type {
+	case "rate_limit_error", "rate_limit_exceeded":
+		return http.StatusTooManyRequests, true
+	case "overloaded_error":
+		return 529, true
+	case "authentication_error", "invalid_api_key":
+		return http.StatusUnauthorized, true
+	case "billing_error", "insufficient_quota":
+		return http.StatusPaymentRequired, true
+	case "permission_error":
+		return http.StatusForbidden, true
+	case "invalid_request_error":
+		return http.StatusBadRequest, true
+	}
+	return http.StatusInternalServerError, true
+}
@@ -0,0 +1,75 @@
+package sse
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// First Event Tests
+// =============================================================================
+
+func TestPeekFirstEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		stream   string
+		expected string
+	}{
+		{
+			"anthropic",
+			"event: message_start\ndata: {\"type\":\"message_start\"}\n\nevent: ping\ndata: {}\n\n",
+			"event: message_start\ndata: {\"type\":\"message_start\"}\n",
+		},
+		{
+			"skips comments",
+			": OPENROUTER PROCESSING\n\n: keepalive\n\ndata: {\"choices\":[]}\n\ndata: [DONE]\n\n",
+			"data: {\"choices\":[]}\n",
+		},
+		{"crlf", "data: {}\r\n\r\ndata: [DONE]\r\n\r\n", "data: {}\n"},
+		{"unterminated", "data: {}", "data: {}\n"},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Body: io.NopCloser(strings.NewReader(tt.stream))}
+			if got := string(PeekFirstEvent(resp)); got != tt.expected {
+				t.Errorf("Expected event %q, got %q", tt.expected, got)
+			}
+			rest, _ := io.ReadAll(resp.Body)
+			if string(rest) != tt.stream {
+				t.Errorf("Expected body to be restored, got %q", rest)
+			}
+		})
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    string
+		status   int
+		expected bool
+	}{
+		{"message_start", "event: message_start\ndata: {\"type\":\"message_start\"}\n", 0, false},
+		{"openai chunk", "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n", 0, false},
+		{"anthropic overloaded", "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n", 529, true},
+		{"anthropic rate limit", "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"rate_limit_error\"}}\n", 429, true},
+		{"anthropic budget", "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"invalid_request_error\",\"message\":\"ExceededBudget\"}}\n", 400, true},
+		{"openai quota", "data: {\"error\":{\"type\":\"insufficient_quota\",\"message\":\"quota\"}}\n", 402, true},
+		{"openai numeric code", "data: {\"error\":{\"message\":\"slow down\",\"code\":429}}\n", 429, true},
+		{"openai string code", "data: {\"error\":{\"message\":\"bad key\",\"code\":\"401\"}}\n", 401, true},
+		{"error event without body", "event: error\ndata: oops\n", 500, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, isError := ErrorStatus([]byte(tt.event))
+			if status != tt.status || isError != tt.expected {
+				t.Errorf("Expected (%d, %v), got (%d, %v)", tt.status, tt.expected, status, isError)
+			}
+		})
+	}
+}
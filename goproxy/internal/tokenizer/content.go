@@ -0,0 +1,175 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+)
+
+const (
+	// MessageOverhead covers role markers and turn delimiters per message
+	MessageOverhead = 3
+
+	// ToolUseSystemTokens is the tool-use system prompt Anthropic injects
+	// when a request defines tools
+	ToolUseSystemTokens = 346
+
+	// MaxImageEdge is the long edge images are downscaled to before billing
+	MaxImageEdge = 1568
+
+	// MaxImageTokens is the cost of a full-size image, also used when the
+	// dimensions cannot be read (URL sources, unsupported formats)
+	MaxImageTokens = 1600
+
+	// imageHeaderBytes is how much base64 is decoded to read image dimensions
+	imageHeaderBytes = 64 * 1024
+)
+
+// ImageTokens returns the token cost of an image using Anthropic's
+// width*height/750 formula after downscaling to MaxImageEdge.
+func ImageTokens(width, height int) int {
+	if width <= 0 || height <= 0 {
+		return MaxImageTokens
+	}
+
+	long := width
+	if height > long {
+		long = height
+	}
+	if long > MaxImageEdge {
+		scale := float64(MaxImageEdge) / float64(long)
+		width = int(float64(width) * scale)
+		height = int(float64(height) * scale)
+	}
+
+	tokens := (width*height + 749) / 750
+	if tokens > MaxImageTokens {
+		tokens = MaxImageTokens
+	}
+	return tokens
+}
+
+// CountContent counts tokens in message content in either Anthropic or
+// OpenAI shape: a plain string or an array of typed content blocks.
+func (e *Encoding) CountContent(content interface{}) int {
+	switch c := content.(type) {
+	case nil:
+		return 0
+	case string:
+		return e.Count(c)
+	case []interface{}:
+		total := 0
+		for _, block := range c {
+			total += e.countBlock(block)
+		}
+		return total
+	case []map[string]interface{}:
+		total := 0
+		for _, block := range c {
+			total += e.countBlock(block)
+		}
+		return total
+	default:
+		return e.CountJSON(c)
+	}
+}
+
+// CountJSON counts tokens in the JSON encoding of v (tool schemas, tool inputs)
+func (e *Encoding) CountJSON(v interface{}) int {
+	if v == nil {
+		return 0
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return e.Count(string(data))
+}
+
+func (e *Encoding) countBlock(block interface{}) int {
+	m, ok := block.(map[string]interface{})
+	if !ok {
+		return e.CountContent(block)
+	}
+
+	blockType, _ := m["type"].(string)
+	switch blockType {
+	case "text", "input_text", "output_text":
+		text, _ := m["text"].(string)
+		return e.Count(text)
+	case "thinking":
+		thinking, _ := m["thinking"].(string)
+		return e.Count(thinking)
+	case "redacted_thinking":
+		data, _ := m["data"].(string)
+		return e.Count(data)
+	case "image":
+		source, _ := m["source"].(map[string]interface{})
+		return imageSourceTokens(source)
+	case "image_url":
+		url := ""
+		switch u := m["image_url"].(type) {
+		case string:
+			url = u
+		case map[string]interface{}:
+			url, _ = u["url"].(string)
+		}
+		return imageURLTokens(url)
+	case "tool_use":
+		name, _ := m["name"].(string)
+		return e.Count(name) + e.CountJSON(m["input"])
+	case "tool_result":
+		return e.CountContent(m["content"])
+	case "document":
+		source, _ := m["source"].(map[string]interface{})
+		if data, ok := source["data"].(string); ok && source["type"] == "text" {
+			return e.Count(data)
+		}
+		if content, ok := source["content"]; ok {
+			return e.CountContent(content)
+		}
+		return e.CountJSON(m)
+	default:
+		return e.CountJSON(m)
+	}
+}
+
+func imageSourceTokens(source map[string]interface{}) int {
+	if source == nil {
+		return MaxImageTokens
+	}
+	if sourceType, _ := source["type"].(string); sourceType == "url" {
+		return MaxImageTokens
+	}
+	data, _ := source["data"].(string)
+	return base64ImageTokens(data)
+}
+
+func imageURLTokens(url string) int {
+	if !strings.HasPrefix(url, "data:") {
+		return MaxImageTokens
+	}
+	parts := strings.SplitN(url, ",", 2)
+	if len(parts) != 2 {
+		return MaxImageTokens
+	}
+	return base64ImageTokens(parts[1])
+}
+
+// base64ImageTokens reads the image dimensions from the start of the base64
+// payload without decoding the whole image
+func base64ImageTokens(data string) int {
+	if len(data) > imageHeaderBytes {
+		data = data[:imageHeaderBytes]
+	}
+	decoder := base64.NewDecoder(base64.StdEncoding, strings.NewReader(data))
+	cfg, _, err := image.DecodeConfig(decoder)
+	if err != nil {
+		return MaxImageTokens
+	}
+	return ImageTokens(cfg.Width, cfg.Height)
+}
@@ -0,0 +1,164 @@
+package tokenizer
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// splitChunks splits text into the pieces BPE merges are applied to.
+// It follows the cl100k pre-tokenizer pattern:
+//
+//	'(?i:s|t|re|ve|m|ll|d) | [^\r\n\p{L}\p{N}]?\p{L}+ | \p{N}{1,3} |
+//	 ?[^\s\p{L}\p{N}]+[\r\n]* | \s*[\r\n]+ | \s+(?!\S) | \s+
+//
+// Go's regexp has no lookahead, so the alternatives are matched by hand.
+func splitChunks(text string) []string {
+	chunks := make([]string, 0, len(text)/4+1)
+	for i := 0; i < len(text); {
+		n := matchChunk(text[i:])
+		chunks = append(chunks, text[i:i+n])
+		i += n
+	}
+	return chunks
+}
+
+// matchChunk returns the byte length of the chunk at the start of s (len(s) > 0)
+func matchChunk(s string) int {
+	r, size := utf8.DecodeRuneInString(s)
+
+	// Contractions: 's 't 're 've 'm 'll 'd
+	if r == '\'' {
+		if n := matchContraction(s[size:]); n > 0 {
+			return size + n
+		}
+	}
+
+	// Letters with an optional single leading non-letter/non-number
+	if isLetter(r) {
+		return size + spanLetters(s[size:])
+	}
+	if r != '\r' && r != '\n' && !isNumber(r) {
+		if next, nsize := utf8.DecodeRuneInString(s[size:]); isLetter(next) {
+			return size + nsize + spanLetters(s[size+nsize:])
+		}
+	}
+
+	// Numbers, at most three digits per chunk
+	if isNumber(r) {
+		n := size
+		for count := 1; count < 3 && n < len(s); count++ {
+			next, nsize := utf8.DecodeRuneInString(s[n:])
+			if !isNumber(next) {
+				break
+			}
+			n += nsize
+		}
+		return n
+	}
+
+	// Punctuation runs with an optional leading space and trailing newlines
+	start := 0
+	if r == ' ' {
+		if next, _ := utf8.DecodeRuneInString(s[size:]); size < len(s) && isPunct(next) {
+			start = size
+		}
+	}
+	if p, psize := utf8.DecodeRuneInString(s[start:]); isPunct(p) {
+		n := start + psize
+		for n < len(s) {
+			next, nsize := utf8.DecodeRuneInString(s[n:])
+			if !isPunct(next) {
+				break
+			}
+			n += nsize
+		}
+		for n < len(s) && (s[n] == '\r' || s[n] == '\n') {
+			n++
+		}
+		return n
+	}
+
+	// Whitespace
+	end, lastNewline, lastStart := 0, -1, 0
+	for end < len(s) {
+		next, nsize := utf8.DecodeRuneInString(s[end:])
+		if !unicode.IsSpace(next) {
+			break
+		}
+		if next == '\r' || next == '\n' {
+			lastNewline = end + nsize
+		}
+		lastStart = end
+		end += nsize
+	}
+	if lastNewline > 0 {
+		// \s*[\r\n]+ ends at the last newline of the run
+		return lastNewline
+	}
+	if end == len(s) || lastStart == 0 {
+		// \s+ at end of input, or a single space before text
+		return end
+	}
+	// \s+(?!\S) leaves the final space to prefix the next word
+	return lastStart
+}
+
+func matchContraction(s string) int {
+	if len(s) >= 2 {
+		switch lower(s[0]) {
+		case 'r':
+			if lower(s[1]) == 'e' {
+				return 2
+			}
+		case 'v':
+			if lower(s[1]) == 'e' {
+				return 2
+			}
+		case 'l':
+			if lower(s[1]) == 'l' {
+				return 2
+			}
+		}
+	}
+	if len(s) >= 1 {
+		switch lower(s[0]) {
+		case 's', 't', 'm', 'd':
+			return 1
+		}
+	}
+	return 0
+}
+
+func spanLetters(s string) int {
+	n := 0
+	for n < len(s) {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if !isLetter(r) {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+func lower(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + ('a' - 'A')
+	}
+	return b
+}
+
+// isLetter matches \p{L}. Combining marks are included so decomposed
+// Vietnamese diacritics stay attached to their base letter.
+func isLetter(r rune) bool {
+	return unicode.IsLetter(r) || unicode.Is(unicode.Mn, r)
+}
+
+func isNumber(r rune) bool {
+	return unicode.IsNumber(r)
+}
+
+// isPunct matches [^\s\p{L}\p{N}]
+func isPunct(r rune) bool {
+	return !unicode.IsSpace(r) && !isLetter(r) && !isNumber(r)
+}
@@ -0,0 +1,228 @@
+// Package tokenizer counts tokens offline with byte-level BPE so pre-flight
+// estimates don't depend on an upstream round trip.
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// Vocabularies are stored in the tiktoken rank format (one "base64(token) rank"
+// pair per line), gzip-compressed. Every single byte must have a rank so any
+// input can be encoded. See vocab/README.md for what each vocabulary is.
+//
+//go:embed vocab/*.tiktoken.gz
+var vocabFS embed.FS
+
+// DefaultEncoding is used when a model does not configure a tokenizer
+const DefaultEncoding = "bpe24k"
+
+// Encoding is a byte-level BPE tokenizer backed by a merge-rank vocabulary
+type Encoding struct {
+	name  string
+	ranks map[string]int
+}
+
+var (
+	encodings     = make(map[string]*Encoding)
+	loadErrors    = make(map[string]error)
+	encodingMutex sync.Mutex
+)
+
+// Get returns the named encoding, loading it from the embedded vocabulary on
+// first use. Unknown names fall back to DefaultEncoding; an error is returned
+// only if that cannot be loaded either.
+func Get(name string) (*Encoding, error) {
+	if name == "" {
+		name = DefaultEncoding
+	}
+
+	encodingMutex.Lock()
+	defer encodingMutex.Unlock()
+	return getLocked(name)
+}
+
+func getLocked(name string) (*Encoding, error) {
+	if enc, ok := encodings[name]; ok {
+		return enc, nil
+	}
+	if err, ok := loadErrors[name]; ok {
+		return nil, err
+	}
+
+	enc, err := load(name)
+	if err != nil && name != DefaultEncoding {
+		log.Printf("⚠️ [Tokenizer] %v, falling back to %s", err, DefaultEncoding)
+		enc, err = getLocked(DefaultEncoding)
+	}
+	if err != nil {
+		loadErrors[name] = err
+		return nil, err
+	}
+	encodings[name] = enc
+	return enc, nil
+}
+
+func load(name string) (*Encoding, error) {
+	raw, err := vocabFS.ReadFile("vocab/" + name + ".tiktoken.gz")
+	if err != nil {
+		return nil, fmt.Errorf("unknown encoding %q", name)
+	}
+	ranks, err := parseRanks(raw)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %q: %w", name, err)
+	}
+	for b := 0; b < 256; b++ {
+		if _, ok := ranks[string([]byte{byte(b)})]; !ok {
+			return nil, fmt.Errorf("encoding %q: missing rank for byte 0x%02x", name, b)
+		}
+	}
+	log.Printf("✅ [Tokenizer] Loaded encoding %s (%d tokens)", name, len(ranks))
+	return &Encoding{name: name, ranks: ranks}, nil
+}
+
+func parseRanks(raw []byte) (map[string]int, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		sep := bytes.IndexByte(line, ' ')
+		if sep < 0 {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(string(line[:sep]))
+		if err != nil {
+			return nil, err
+		}
+		rank, err := strconv.Atoi(string(line[sep+1:]))
+		if err != nil {
+			return nil, err
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ranks, nil
+}
+
+// Name returns the encoding name
+func (e *Encoding) Name() string {
+	if e == nil {
+		return ""
+	}
+	return e.name
+}
+
+// Encode returns the token ranks for text, or nil on a nil Encoding
+func (e *Encoding) Encode(text string) []int {
+	if e == nil {
+		return nil
+	}
+	tokens := make([]int, 0, len(text)/3+1)
+	for i := 0; i < len(text); {
+		chunk := text[i : i+matchChunk(text[i:])]
+		i += len(chunk)
+		if rank, ok := e.ranks[chunk]; ok {
+			tokens = append(tokens, rank)
+			continue
+		}
+		bounds := e.mergeChunk(chunk)
+		for i := 0; i < len(bounds)-1; i++ {
+			tokens = append(tokens, e.ranks[chunk[bounds[i]:bounds[i+1]]])
+		}
+	}
+	return tokens
+}
+
+// Count returns the number of tokens in text. A nil Encoding (no vocabulary
+// could be loaded) estimates one token per three characters.
+func (e *Encoding) Count(text string) int {
+	if e == nil {
+		return (utf8.RuneCountInString(text) + 2) / 3
+	}
+	count := 0
+	for i := 0; i < len(text); {
+		chunk := text[i : i+matchChunk(text[i:])]
+		i += len(chunk)
+		if _, ok := e.ranks[chunk]; ok {
+			count++
+			continue
+		}
+		count += len(e.mergeChunk(chunk)) - 1
+	}
+	return count
+}
+
+const noRank = int(^uint(0) >> 1)
+
+// mergeChunk applies BPE merges to a single pre-tokenized chunk, always
+// merging the adjacent pair with the lowest rank first. It returns the token
+// boundaries as byte offsets, including len(chunk) as the final entry.
+func (e *Encoding) mergeChunk(chunk string) []int {
+	type part struct {
+		start int
+		rank  int // rank of merging this part with the next one
+	}
+
+	parts := make([]part, len(chunk)+1)
+	for i := range parts {
+		parts[i] = part{start: i, rank: noRank}
+	}
+
+	// pairRank returns the rank of the bytes spanning parts[i] through parts[i+skip]
+	pairRank := func(i, skip int) int {
+		if i+skip+2 < len(parts) {
+			if rank, ok := e.ranks[chunk[parts[i].start:parts[i+skip+2].start]]; ok {
+				return rank
+			}
+		}
+		return noRank
+	}
+
+	for i := 0; i < len(parts)-2; i++ {
+		parts[i].rank = pairRank(i, 0)
+	}
+
+	for len(parts) > 2 {
+		best, bestRank := -1, noRank
+		for i := 0; i < len(parts)-1; i++ {
+			if parts[i].rank < bestRank {
+				best, bestRank = i, parts[i].rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		// Recompute neighbours as if parts[best+1] were already removed
+		parts[best].rank = pairRank(best, 1)
+		if best > 0 {
+			parts[best-1].rank = pairRank(best-1, 1)
+		}
+		parts = append(parts[:best+1], parts[best+2:]...)
+	}
+
+	bounds := make([]int, len(parts))
+	for i, p := range parts {
+		bounds[i] = p.start
+	}
+	return bounds
+}
@@ -0,0 +1,209 @@
+package tokenizer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/png"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitChunks(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{"words", "Hello world", []string{"Hello", " world"}},
+		{"contraction", "I'm here", []string{"I", "'m", " here"}},
+		{"numbers split by three", "12345", []string{"123", "45"}},
+		{"punctuation", "Hi!! ok", []string{"Hi", "!!", " ok"}},
+		{"space before punctuation", "a .b", []string{"a", " .", "b"}},
+		{"trailing spaces kept before word", "a   b", []string{"a", "  ", " b"}},
+		{"newlines", "a\n\nb", []string{"a", "\n\n", "b"}},
+		{"trailing whitespace", "a  ", []string{"a", "  "}},
+		{"vietnamese", "Xin chào", []string{"Xin", " chào"}},
+		{"empty", "", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := splitChunks(tt.input)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("splitChunks(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSplitChunks_CoversInput(t *testing.T) {
+	inputs := []string{
+		"func main() {\n\tfmt.Println(\"hi\")\n}\n",
+		"Tôi là một trợ lý ảo 🤖 — xin chào!",
+		"  \r\n\t mixed   whitespace\n",
+		string([]byte{0xff, 0xfe, 'a', 0x80}),
+	}
+	for _, input := range inputs {
+		if joined := strings.Join(splitChunks(input), ""); joined != input {
+			t.Errorf("chunks of %q rejoin to %q", input, joined)
+		}
+	}
+}
+
+func TestEncode_RoundTrip(t *testing.T) {
+	enc, _ := Get(DefaultEncoding)
+	decode := make(map[int]string, len(enc.ranks))
+	for token, rank := range enc.ranks {
+		decode[rank] = token
+	}
+
+	inputs := []string{
+		"The quick brown fox jumps over the lazy dog.",
+		"Xin chào, bạn cần giúp gì không?",
+		"{\"type\":\"object\",\"properties\":{\"path\":{\"type\":\"string\"}}}",
+		string([]byte{0x00, 0xff, 0x10}),
+	}
+	for _, input := range inputs {
+		tokens := enc.Encode(input)
+		var sb strings.Builder
+		for _, token := range tokens {
+			sb.WriteString(decode[token])
+		}
+		if sb.String() != input {
+			t.Errorf("round trip of %q produced %q", input, sb.String())
+		}
+		if count := enc.Count(input); count != len(tokens) {
+			t.Errorf("Count(%q) = %d, Encode returned %d tokens", input, count, len(tokens))
+		}
+	}
+}
+
+func TestCount_FewerTokensThanBytes(t *testing.T) {
+	enc, _ := Get(DefaultEncoding)
+	text := strings.Repeat("The proxy forwards requests to the configured upstream. ", 50)
+
+	count := enc.Count(text)
+	if count <= 0 || count >= len(text)/2 {
+		t.Errorf("Count = %d for %d bytes of English, expected BPE compression", count, len(text))
+	}
+}
+
+func TestGet_EmbeddedEncodings(t *testing.T) {
+	for _, name := range []string{"bpe24k", "bpe32k"} {
+		enc, err := Get(name)
+		if err != nil || enc.Name() != name {
+			t.Errorf("Get(%q) returned %s, vocabulary missing from vocab/", name, enc.Name())
+		}
+		if count := enc.Count("Hello, world!"); count <= 0 {
+			t.Errorf("%s: Count returned %d", name, count)
+		}
+	}
+}
+
+func TestGet_UnknownFallsBackToDefault(t *testing.T) {
+	if enc, _ := Get("no-such-encoding"); enc.Name() != DefaultEncoding {
+		t.Errorf("Get(unknown) = %s, want %s", enc.Name(), DefaultEncoding)
+	}
+	if enc, _ := Get(""); enc.Name() != DefaultEncoding {
+		t.Errorf("Get(\"\") = %s, want %s", enc.Name(), DefaultEncoding)
+	}
+}
+
+func TestImageTokens(t *testing.T) {
+	tests := []struct {
+		width, height int
+		expected      int
+	}{
+		{200, 100, 27},
+		{1000, 1000, 1334},
+		{3136, 3136, 1600}, // downscaled to 1568x1568, capped
+		{4000, 1000, 820},  // downscaled to 1568x392
+		{0, 0, MaxImageTokens},
+	}
+
+	for _, tt := range tests {
+		if result := ImageTokens(tt.width, tt.height); result != tt.expected {
+			t.Errorf("ImageTokens(%d, %d) = %d, want %d", tt.width, tt.height, result, tt.expected)
+		}
+	}
+}
+
+func TestCountContent_Blocks(t *testing.T) {
+	enc, _ := Get(DefaultEncoding)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 200, 100))); err != nil {
+		t.Fatal(err)
+	}
+	imageData := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	text := "Describe this image"
+	content := []interface{}{
+		map[string]interface{}{"type": "text", "text": text},
+		map[string]interface{}{
+			"type":   "image",
+			"source": map[string]interface{}{"type": "base64", "media_type": "image/png", "data": imageData},
+		},
+	}
+
+	expected := enc.Count(text) + 27
+	if result := enc.CountContent(content); result != expected {
+		t.Errorf("CountContent = %d, want %d", result, expected)
+	}
+
+	openAIContent := []interface{}{
+		map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "data:image/png;base64," + imageData}},
+	}
+	if result := enc.CountContent(openAIContent); result != 27 {
+		t.Errorf("CountContent(image_url) = %d, want 27", result)
+	}
+
+	urlImage := []interface{}{
+		map[string]interface{}{"type": "image", "source": map[string]interface{}{"type": "url", "url": "https://example.com/a.png"}},
+	}
+	if result := enc.CountContent(urlImage); result != MaxImageTokens {
+		t.Errorf("CountContent(url image) = %d, want %d", result, MaxImageTokens)
+	}
+}
+
+func TestCountContent_ToolBlocks(t *testing.T) {
+	enc, _ := Get(DefaultEncoding)
+
+	input := map[string]interface{}{"path": "/tmp/a.txt"}
+	content := []interface{}{
+		map[string]interface{}{"type": "tool_use", "id": "toolu_1", "name": "read_file", "input": input},
+		map[string]interface{}{"type": "tool_result", "tool_use_id": "toolu_1", "content": "file contents"},
+	}
+
+	expected := enc.Count("read_file") + enc.CountJSON(input) + enc.Count("file contents")
+	if result := enc.CountContent(content); result != expected {
+		t.Errorf("CountContent = %d, want %d", result, expected)
+	}
+}
+
+func TestLoadFailure_ReturnsError(t *testing.T) {
+	encodingMutex.Lock()
+	saved := encodings[DefaultEncoding]
+	delete(encodings, DefaultEncoding)
+	loadErrors[DefaultEncoding] = errors.New("corrupt vocabulary")
+	encodingMutex.Unlock()
+	defer func() {
+		encodingMutex.Lock()
+		encodings[DefaultEncoding] = saved
+		delete(loadErrors, DefaultEncoding)
+		delete(loadErrors, "no-such-encoding-either")
+		encodingMutex.Unlock()
+	}()
+
+	enc, err := Get("no-such-encoding-either")
+	if err == nil || enc != nil {
+		t.Fatalf("Get = %v, %v, want an error when the default vocabulary cannot load", enc, err)
+	}
+	// A nil Encoding still estimates
+	if count := enc.Count("Hello, world!"); count != 5 {
+		t.Errorf("nil Count = %d, want 5", count)
+	}
+}
@@ -2,15 +2,24 @@ package usage
 
 import (
 	"context"
+	"errors"
 	"log"
+	"math"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"goproxy/db"
+	"goproxy/internal/ledger"
+	"goproxy/internal/reservation"
+	"goproxy/internal/spendcap"
+	"goproxy/internal/wal"
 )
 
 // UseBatchedWrites controls whether to use batched database writes
@@ -45,22 +54,41 @@ func DefaultBatchConfig() BatchConfig {
 }
 
 // BatchedUsageTracker batches database writes for better performance
+// Queued entries are written to a write-ahead log first (see OpenWAL) and the workers mark
+// them done once Mongo has them. A failed write is retried with the same batch instead of
+// being dropped; meanwhile the queues fill up and callers wait (backpressure).
 type BatchedUsageTracker struct {
-	config    BatchConfig
-	logChan   chan RequestLog
-	usageChan chan usageUpdate
+	config     BatchConfig
+	logChan    chan queuedLog
+	usageChan  chan usageUpdate
 	creditChan chan creditUpdate
-	stopChan  chan struct{}
-	wg        sync.WaitGroup
+	stopChan   chan struct{}
+	wg         sync.WaitGroup
+
+	// Write-ahead logs of the three queues; nil without a WAL
+	logWAL    *wal.Log
+	usageWAL  *wal.Log
+	creditWAL *wal.Log
+
+	waits atomic.Int64 // queue calls that found their queue full and waited
+}
+
+type queuedLog struct {
+	entry RequestLog
+	seq   uint64 // WAL sequence number, 0 without a WAL
 }
 
 type usageUpdate struct {
 	apiKey     string
 	tokensUsed int64
+	id         string // WAL record ID, claimed in applied_writes when it is written
+	seq        uint64
 }
 
 type creditUpdate struct {
 	username         string
+	requestID        string  // credit ledger key of the deduction
+	entryID          string  // ledger entry ID, fixed when queued so a replay reuses it
 	cost             float64 // USD cost to deduct
 	tokensUsed       int64   // kept for analytics
 	inputTokens      int64
@@ -69,6 +97,16 @@ type creditUpdate struct {
 	cacheHitTokens   int64
 	useRefCredits    bool // true if deducting from refCredits
 	useCreditsNew    bool // true if deducting from creditsNew (OpenHands upstream)
+	seq              uint64
+}
+
+// BatcherStats describe the queues and their write-ahead logs
+type BatcherStats struct {
+	RequestLogs int                  `json:"request_logs"` // queued entries
+	Usage       int                  `json:"usage"`
+	Credits     int                  `json:"credits"`
+	Waits       int64                `json:"waits"` // queue calls that waited for a full queue
+	WAL         map[string]wal.Stats `json:"wal,omitempty"`
 }
 
 var (
@@ -85,11 +123,26 @@ func GetBatcher() *BatchedUsageTracker {
 	return batcher
 }
 
+// InitBatcher creates and starts the singleton batcher with a write-ahead log in walDir
+// (none if empty), replaying what it holds first. Call it at startup, before GetBatcher.
+func InitBatcher(walDir string, opts wal.Options) error {
+	err := errors.New("batcher already started")
+	batcherOnce.Do(func() {
+		batcher = NewBatchedUsageTracker(DefaultBatchConfig())
+		err = nil
+		if walDir != "" {
+			err = batcher.OpenWAL(walDir, opts)
+		}
+		batcher.Start()
+	})
+	return err
+}
+
 // NewBatchedUsageTracker creates a new batched usage tracker
 func NewBatchedUsageTracker(config BatchConfig) *BatchedUsageTracker {
 	return &BatchedUsageTracker{
 		config:     config,
-		logChan:    make(chan RequestLog, config.BufferSize),
+		logChan:    make(chan queuedLog, config.BufferSize),
 		usageChan:  make(chan usageUpdate, config.BufferSize),
 		creditChan: make(chan creditUpdate, config.BufferSize),
 		stopChan:   make(chan struct{}),
@@ -104,34 +157,81 @@ func (b *BatchedUsageTracker) Start() {
 	go b.creditWorker()
 }
 
-// Stop stops the background workers
+// Stop stops the background workers once they have written what is queued and closes the
+// write-ahead logs. Entries that could not be written stay in the WAL for the next start.
 func (b *BatchedUsageTracker) Stop() {
 	close(b.stopChan)
 	b.wg.Wait()
+	for _, l := range []*wal.Log{b.logWAL, b.usageWAL, b.creditWAL} {
+		if err := l.Close(); err != nil {
+			log.Printf("⚠️ [WAL] Failed to close: %v", err)
+		}
+	}
+}
+
+// Stats returns the queue lengths and write-ahead log state
+func (b *BatchedUsageTracker) Stats() BatcherStats {
+	stats := BatcherStats{
+		RequestLogs: len(b.logChan),
+		Usage:       len(b.usageChan),
+		Credits:     len(b.creditChan),
+		Waits:       b.waits.Load(),
+	}
+	if b.logWAL != nil {
+		stats.WAL = map[string]wal.Stats{
+			"request_logs": b.logWAL.Stats(),
+			"usage":        b.usageWAL.Stats(),
+			"credits":      b.creditWAL.Stats(),
+		}
+	}
+	return stats
+}
+
+// queueFull counts a queue call that has to wait for the worker
+func (b *BatchedUsageTracker) queueFull(queue string) {
+	if b.waits.Add(1)%100 == 1 {
+		log.Printf("⚠️ [BatchedUsageTracker] %s queue full, waiting for the worker", queue)
+	}
 }
 
 // QueueRequestLog queues a request log for batch insert
+// The log gets its _id here, so a replay or retried insert cannot duplicate it
 func (b *BatchedUsageTracker) QueueRequestLog(entry RequestLog) {
+	if entry.ID.IsZero() {
+		entry.ID = primitive.NewObjectID()
+	}
+	queued := queuedLog{entry: entry, seq: appendWAL(b.logWAL, entry)}
 	select {
-	case b.logChan <- entry:
+	case b.logChan <- queued:
 	default:
-		// Channel full, log and drop (non-blocking)
-		log.Printf("⚠️ [BatchedUsageTracker] Log channel full, dropping log entry")
+		// Channel full: wait for the worker rather than drop the entry
+		b.queueFull("Log")
+		select {
+		case b.logChan <- queued:
+		case <-b.stopChan: // left to the WAL replay
+		}
 	}
 }
 
 // QueueUsageUpdate queues a usage update for batch processing
 func (b *BatchedUsageTracker) QueueUsageUpdate(apiKey string, tokensUsed int64) {
+	update := usageUpdate{apiKey: apiKey, tokensUsed: tokensUsed}
+	update.seq = appendWAL(b.usageWAL, usageRecord{APIKey: apiKey, TokensUsed: tokensUsed})
+	update.id = b.usageWAL.RecordID(update.seq)
 	select {
-	case b.usageChan <- usageUpdate{apiKey: apiKey, tokensUsed: tokensUsed}:
+	case b.usageChan <- update:
 	default:
-		log.Printf("⚠️ [BatchedUsageTracker] Usage channel full, dropping update")
+		b.queueFull("Usage")
+		select {
+		case b.usageChan <- update:
+		case <-b.stopChan:
+		}
 	}
 }
 
 // QueueCreditUpdate queues a credits (USD) deduction update for batch processing
 // It automatically checks user's current credits to determine if refCredits should be used
-func (b *BatchedUsageTracker) QueueCreditUpdate(username string, cost float64, tokensUsed, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64) {
+func (b *BatchedUsageTracker) QueueCreditUpdate(username, requestID string, cost float64, tokensUsed, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64) {
 	// Check user's current credits balance to determine where to deduct from
 	useRefCredits := false
 	credits, refCredits, err := getUserCreditsForBatcher(username)
@@ -144,14 +244,15 @@ func (b *BatchedUsageTracker) QueueCreditUpdate(username string, cost float64, t
 			useRefCredits = credits < cost
 		}
 	}
-	b.QueueCreditUpdateWithRef(username, cost, tokensUsed, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens, useRefCredits)
+	b.QueueCreditUpdateWithRef(username, requestID, cost, tokensUsed, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens, useRefCredits)
 }
 
 // QueueCreditUpdateWithRef queues a credits (USD) deduction update with optional refCredits flag
-func (b *BatchedUsageTracker) QueueCreditUpdateWithRef(username string, cost float64, tokensUsed, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64, useRefCredits bool) {
-	select {
-	case b.creditChan <- creditUpdate{
+func (b *BatchedUsageTracker) QueueCreditUpdateWithRef(username, requestID string, cost float64, tokensUsed, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64, useRefCredits bool) {
+	update := creditUpdate{
 		username:         username,
+		requestID:        requestID,
+		entryID:          ledger.Key(ledger.KindDeduction, requestID),
 		cost:             cost,
 		tokensUsed:       tokensUsed,
 		inputTokens:      inputTokens,
@@ -160,133 +261,277 @@ func (b *BatchedUsageTracker) QueueCreditUpdateWithRef(username string, cost flo
 		cacheHitTokens:   cacheHitTokens,
 		useRefCredits:    useRefCredits,
 		useCreditsNew:    false,
-	}:
-	default:
-		log.Printf("⚠️ [BatchedUsageTracker] Credit channel full, dropping update")
 	}
-}
-
-// QueueCreditUpdateOpenHands queues a creditsNew deduction update for OpenHands upstream
-// This bypasses the standard batching for creditsNew field which is separate from credits/refCredits
-func (b *BatchedUsageTracker) QueueCreditUpdateOpenHands(username string, cost float64, tokensUsed, inputTokens, outputTokens int64) {
-	// For now, handle creditsNew updates immediately since they use a different field
-	// This avoids complicating the batching logic for the standard credits field
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		// Deduct from creditsNew field
-		update := bson.M{
-			"$inc": bson.M{
-				"creditsNew": -cost,
-			},
-		}
-
-		_, err := db.UsersNewCollection().UpdateOne(ctx, bson.M{"_id": username}, update)
-		if err != nil {
-			log.Printf("❌ [OpenHands Batcher] Failed to deduct creditsNew for %s: %v", username, err)
+	update.seq = appendWAL(b.creditWAL, newCreditRecord(update))
+	// The request's hold counts against the balance until the flush writes the deduction
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	reservation.MarkQueued(ctx, username, requestID, cost)
+	cancel()
+	select {
+	case b.creditChan <- update:
+	default:
+		b.queueFull("Credit")
+		select {
+		case b.creditChan <- update:
+		case <-b.stopChan:
 		}
-	}()
+	}
 }
 
 // requestLogWorker processes request logs in batches
 func (b *BatchedUsageTracker) requestLogWorker() {
 	defer b.wg.Done()
-	
+
 	ticker := time.NewTicker(b.config.FlushInterval)
 	defer ticker.Stop()
-	
-	batch := make([]interface{}, 0, b.config.MaxBatchSize)
+
+	batch := make([]RequestLog, 0, b.config.MaxBatchSize)
+	var seqs []uint64
+	failed := false
 
 	flush := func() {
 		if len(batch) == 0 {
 			return
 		}
-		
+
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		_, err := db.RequestLogsCollection().InsertMany(ctx, batch)
-		if err != nil {
-			log.Printf("⚠️ [BatchedUsageTracker] Failed to batch insert logs: %v", err)
+		if err := insertRequestLogs(ctx, batch); err != nil {
+			log.Printf("⚠️ [BatchedUsageTracker] Failed to batch insert %d logs, retrying: %v", len(batch), err)
+			failed = true
+			return
 		}
+		markDone(b.logWAL, seqs)
 		batch = batch[:0]
+		seqs = seqs[:0]
+		failed = false
 	}
 
+	stop := b.stopChan
 	for {
+		// After a failed insert, take no more entries until the batch is written
+		in := b.logChan
+		if failed {
+			in = nil
+		}
 		select {
-		case logEntry := <-b.logChan:
-			batch = append(batch, logEntry)
+		case queued := <-in:
+			batch = append(batch, queued.entry)
+			if queued.seq > 0 {
+				seqs = append(seqs, queued.seq)
+			}
 			if len(batch) >= b.config.MaxBatchSize {
 				flush()
 			}
 		case <-ticker.C:
 			flush()
-		case <-b.stopChan:
+		case <-stop:
+			stop = nil
+		}
+		// Stopping: drain the queue, then exit. After a failed write the rest is left to
+		// the WAL replay.
+		if stop == nil && (failed || len(b.logChan) == 0) {
 			flush()
 			return
 		}
 	}
 }
 
+// insertRequestLogs inserts logs by their _id; logs inserted before are skipped
+func insertRequestLogs(ctx context.Context, logs []RequestLog) error {
+	docs := make([]interface{}, len(logs))
+	for i, entry := range logs {
+		docs[i] = entry
+	}
+	_, err := db.RequestLogsCollection().InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if onlyDuplicates(err) {
+		return nil
+	}
+	return err
+}
+
+// onlyDuplicates reports whether err is a bulk write error of duplicate keys alone
+func onlyDuplicates(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return false
+	}
+	for _, we := range bulkErr.WriteErrors {
+		if we.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+// AppliedTTL is how long the IDs of applied usage updates are kept in applied_writes, and
+// the longest a deduction's marker stays on a user (see deductionsField). A WAL replayed later
+// than that may count its updates again.
+var AppliedTTL = 7 * 24 * time.Hour
+
+// claimApplied records the IDs of usage updates about to be written and reports those
+// recorded before, i.e. written by an earlier attempt. On an error none is reported.
+func claimApplied(ctx context.Context, ids []string) (map[string]bool, error) {
+	applied := make(map[string]bool)
+	if len(ids) == 0 {
+		return applied, nil
+	}
+	expireAt := time.Now().Add(AppliedTTL)
+	docs := make([]interface{}, len(ids))
+	for i, id := range ids {
+		docs[i] = bson.M{"_id": id, "expireAt": expireAt}
+	}
+	_, err := db.AppliedWritesCollection().InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil && !onlyDuplicates(err) {
+		return applied, err
+	}
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		for _, we := range bulkErr.WriteErrors {
+			applied[ids[we.Index]] = true
+		}
+	}
+	return applied, nil
+}
+
+// unapplied returns the models an ordered bulk write failing with err left unwritten: those
+// from its first write error on. Without write errors only the write concern failed and all
+// were written; any other error leaves them all to retry.
+func unapplied(models []mongo.WriteModel, err error) []mongo.WriteModel {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) {
+		return models
+	}
+	if len(bulkErr.WriteErrors) == 0 {
+		return nil
+	}
+	return models[bulkErr.WriteErrors[0].Index:]
+}
+
+// usageUpdateDoc is the update of a user key's usage counters
+func usageUpdateDoc(apiKey string, tokens, requests int64, now time.Time) (filter, update bson.M) {
+	filter = bson.M{"_id": apiKey}
+	update = bson.M{
+		"$inc": bson.M{
+			"tokensUsed":    tokens,
+			"requestsCount": requests,
+		},
+		"$set": bson.M{
+			"lastUsedAt": now,
+		},
+	}
+	return filter, update
+}
+
+// prepareUsage claims the queued updates' IDs and sums the ones not written before by key
+func prepareUsage(ctx context.Context, queued []usageUpdate) []mongo.WriteModel {
+	var ids []string
+	for _, u := range queued {
+		if u.id != "" {
+			ids = append(ids, u.id)
+		}
+	}
+	applied, err := claimApplied(ctx, ids)
+	if err != nil {
+		log.Printf("⚠️ [BatchedUsageTracker] Failed to record %d usage updates as applied: %v", len(ids), err)
+	}
+
+	type keyUsage struct {
+		tokens   int64
+		requests int64
+	}
+	usages := make(map[string]*keyUsage)
+	var order []string
+	for _, u := range queued {
+		if applied[u.id] {
+			continue
+		}
+		usage, ok := usages[u.apiKey]
+		if !ok {
+			usage = &keyUsage{}
+			usages[u.apiKey] = usage
+			order = append(order, u.apiKey)
+		}
+		usage.tokens += u.tokensUsed
+		usage.requests++
+	}
+
+	now := time.Now()
+	models := make([]mongo.WriteModel, 0, len(order))
+	for _, apiKey := range order {
+		filter, update := usageUpdateDoc(apiKey, usages[apiKey].tokens, usages[apiKey].requests, now)
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update))
+	}
+	return models
+}
+
 // usageWorker processes usage updates in batches using bulk write
 func (b *BatchedUsageTracker) usageWorker() {
 	defer b.wg.Done()
-	
+
 	ticker := time.NewTicker(b.config.FlushInterval)
 	defer ticker.Stop()
-	
-	// Aggregate updates by apiKey
-	updates := make(map[string]int64)
+
+	// Updates queued since the last flush, summed by key when it is built
+	var queued []usageUpdate
+	keys := make(map[string]bool)
+	var seqs []uint64
+	var pending []mongo.WriteModel // built batch, kept until it is written
 
 	flush := func() {
-		if len(updates) == 0 {
-			return
-		}
-		
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		// Build bulk write operations
-		models := make([]mongo.WriteModel, 0, len(updates))
-		now := time.Now()
-		
-		for apiKey, tokens := range updates {
-			model := mongo.NewUpdateOneModel().
-				SetFilter(bson.M{"_id": apiKey}).
-				SetUpdate(bson.M{
-					"$inc": bson.M{
-						"tokensUsed":    tokens,
-						"requestsCount": 1,
-					},
-					"$set": bson.M{
-						"lastUsedAt": now,
-					},
-				})
-			models = append(models, model)
+		if pending == nil {
+			if len(queued) == 0 {
+				return
+			}
+			pending = prepareUsage(ctx, queued)
+			queued = queued[:0]
+			for k := range keys {
+				delete(keys, k)
+			}
 		}
 
-		_, err := db.UserKeysCollection().BulkWrite(ctx, models)
-		if err != nil {
-			log.Printf("⚠️ [BatchedUsageTracker] Failed to bulk update usage: %v", err)
-		}
-		
-		// Clear map
-		for k := range updates {
-			delete(updates, k)
+		// A retried write leaves out the keys it updated before it failed
+		if len(pending) > 0 {
+			if _, err := db.UserKeysCollection().BulkWrite(ctx, pending); err != nil {
+				log.Printf("⚠️ [BatchedUsageTracker] Failed to bulk update usage, retrying: %v", err)
+				pending = unapplied(pending, err)
+				if len(pending) > 0 {
+					return
+				}
+			}
 		}
+		markDone(b.usageWAL, seqs)
+		seqs = seqs[:0]
+		pending = nil
 	}
 
+	stop := b.stopChan
 	for {
+		in := b.usageChan
+		if pending != nil {
+			in = nil
+		}
 		select {
-		case update := <-b.usageChan:
-			updates[update.apiKey] += update.tokensUsed
-			if len(updates) >= b.config.MaxBatchSize {
+		case update := <-in:
+			queued = append(queued, update)
+			keys[update.apiKey] = true
+			if update.seq > 0 {
+				seqs = append(seqs, update.seq)
+			}
+			if len(keys) >= b.config.MaxBatchSize {
 				flush()
 			}
 		case <-ticker.C:
 			flush()
-		case <-b.stopChan:
+		case <-stop:
+			stop = nil
+		}
+		// Stopping: drain the queue as in requestLogWorker
+		if stop == nil && (pending != nil || len(b.usageChan) == 0) {
 			flush()
 			return
 		}
@@ -295,151 +540,296 @@ func (b *BatchedUsageTracker) usageWorker() {
 
 // creditAggregation tracks aggregated credits (USD) updates for a user
 type creditAggregation struct {
-	creditsToDeduct    float64
-	refCreditsToDeduct float64
-	creditsUsed        float64
-	inputTokens        int64
-	outputTokens       int64
-	cacheWriteTokens   int64
-	cacheHitTokens     int64
+	creditsUsed      float64
+	inputTokens      int64
+	outputTokens     int64
+	cacheWriteTokens int64
+	cacheHitTokens   int64
+	requests         []creditUpdate // split and recorded in the credit ledger one by one
+}
+
+// debitEntries splits a user's queued deductions between credits and refCredits: credits
+// first, then refCredits, never below zero. Capped deductions still record the full charge.
+// Without a known balance the requests' useRefCredits flags decide.
+func debitEntries(username string, requests []creditUpdate, credits, refCredits float64, balanceKnown bool) []ledger.Entry {
+	entries := make([]ledger.Entry, len(requests))
+	for i, req := range requests {
+		var fromCredits, fromRef float64
+		switch {
+		case !balanceKnown && req.useRefCredits:
+			fromRef = req.cost
+		case !balanceKnown:
+			fromCredits = req.cost
+		default:
+			fromCredits = math.Min(req.cost, math.Max(credits, 0))
+			fromRef = math.Min(req.cost-fromCredits, math.Max(refCredits, 0))
+			credits -= fromCredits
+			refCredits -= fromRef
+		}
+		entries[i] = ledger.Debit(username, req.requestID, req.cost, fromCredits, fromRef, 0)
+		if req.entryID != "" {
+			entries[i].ID = req.entryID
+		}
+	}
+	return entries
+}
+
+// deductionsField lists the ledger entries written to a user's balances whose WAL records are
+// not checkpointed yet. A balance write requires its entries to be absent and adds them, so a
+// retry after an error that hid its success, or a replay after a crash, is not applied twice.
+// They are pulled once checkpointed (see pruneDeductions).
+const deductionsField = "appliedDeductions"
+
+// creditsUpdateDoc is the balance write of a user's deduction entries. It matches nothing if
+// they were written before.
+func creditsUpdateDoc(username string, entries []ledger.Entry, inputTokens, outputTokens int64) (filter, update bson.M) {
+	now := time.Now()
+	var creditsUsed, credits, refCredits float64
+	requestIDs := make([]string, len(entries))
+	entryIDs := make([]string, len(entries))
+	markers := make([]bson.M, len(entries))
+	for i, entry := range entries {
+		creditsUsed += entry.Charged
+		credits += entry.Credits
+		refCredits += entry.RefCredits
+		requestIDs[i] = entry.RequestID
+		entryIDs[i] = entry.ID
+		markers[i] = bson.M{"id": entry.ID, "at": now}
+	}
+
+	incFields := bson.M{
+		"creditsUsed": creditsUsed,
+	}
+	if credits < 0 {
+		incFields["credits"] = credits
+	}
+	if refCredits < 0 {
+		incFields["refCredits"] = refCredits
+	}
+	if deducted := -(credits + refCredits); creditsUsed-deducted > 1e-9 {
+		log.Printf("⚠️ [%s] Deduct capped at $%.6f of $%.6f: credits and refCredits exhausted", username, deducted, creditsUsed)
+	}
+
+	// Track tokens for analytics
+	if inputTokens > 0 {
+		incFields["totalInputTokens"] = inputTokens
+	}
+	if outputTokens > 0 {
+		incFields["totalOutputTokens"] = outputTokens
+	}
+
+	filter = bson.M{
+		"_id":                   username,
+		deductionsField + ".id": bson.M{"$nin": entryIDs},
+	}
+	update = bson.M{
+		"$inc":  incFields,
+		"$push": bson.M{deductionsField: bson.M{"$each": markers}},
+	}
+	// The requests' credit holds end with their deductions, which count toward the spend caps
+	reservation.PullIn(update, requestIDs...)
+	spendcap.RecordIn(update, creditsUsed, now)
+	return filter, update
+}
+
+// writtenDeduction is a deduction whose marker is on its user until its WAL record is
+// checkpointed
+type writtenDeduction struct {
+	username string
+	entryID  string
+	seq      uint64
+}
+
+// pruneUpdateDoc pulls a user's markers of entryIDs, and those left older than AppliedTTL
+// by a crash between a checkpoint and its prune
+func pruneUpdateDoc(username string, entryIDs []string, now time.Time) (filter, update bson.M) {
+	filter = bson.M{"_id": username}
+	update = bson.M{
+		"$pull": bson.M{deductionsField: bson.M{"$or": bson.A{
+			bson.M{"id": bson.M{"$in": entryIDs}},
+			bson.M{"at": bson.M{"$lt": now.Add(-AppliedTTL)}},
+		}}},
+	}
+	return filter, update
+}
+
+// pruneDeductions pulls the markers of the written deductions l has checkpointed and returns
+// the others. A failed prune is logged: its markers age out.
+func pruneDeductions(ctx context.Context, l *wal.Log, written []writtenDeduction) []writtenDeduction {
+	checkpoint := l.Stats().Checkpoint
+	var waiting []writtenDeduction
+	users := make(map[string][]string)
+	var order []string
+	for _, w := range written {
+		if w.seq > checkpoint {
+			waiting = append(waiting, w)
+			continue
+		}
+		if _, ok := users[w.username]; !ok {
+			order = append(order, w.username)
+		}
+		users[w.username] = append(users[w.username], w.entryID)
+	}
+	if len(order) == 0 {
+		return waiting
+	}
+
+	now := time.Now()
+	models := make([]mongo.WriteModel, len(order))
+	for i, username := range order {
+		filter, update := pruneUpdateDoc(username, users[username], now)
+		models[i] = mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update)
+	}
+	if _, err := db.UsersCollection().BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		log.Printf("⚠️ [BatchedUsageTracker] Failed to prune deduction markers of %d users: %v", len(order), err)
+	}
+	return waiting
+}
+
+// creditBatch is a flush of the credit queue, kept until its balance writes succeed
+type creditBatch struct {
+	models  []mongo.WriteModel
+	seqs    []uint64
+	written []writtenDeduction
+}
+
+// bulkWriter is the bulk write of a collection
+type bulkWriter interface {
+	BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+}
+
+// write applies the batch's balance writes. After an error they are all retried: those
+// applied before match nothing, their markers being on the users.
+func (batch *creditBatch) write(ctx context.Context, users bulkWriter) error {
+	if len(batch.models) == 0 {
+		return nil
+	}
+	_, err := users.BulkWrite(ctx, batch.models)
+	return err
+}
+
+// prepareCredits splits the queued deductions against the users' balances, records them in
+// the credit ledger and builds the balance writes. Requests recorded before are left out.
+func prepareCredits(ctx context.Context, updates map[string]*creditAggregation) *creditBatch {
+	batch := &creditBatch{}
+
+	var entries []ledger.Entry
+	var requests []creditUpdate
+	for username, agg := range updates {
+		currentCredits, currentRefCredits, err := getUserCreditsForBatcher(username)
+		entries = append(entries, debitEntries(username, agg.requests, currentCredits, currentRefCredits, err == nil)...)
+		requests = append(requests, agg.requests...)
+	}
+	duplicate, err := ledger.AppendMany(ctx, entries)
+	if err != nil {
+		log.Printf("⚠️ [Ledger] Failed to record %d deductions: %v", len(entries), err)
+	}
+
+	// Group the deductions not applied before by user
+	type userDebits struct {
+		entries      []ledger.Entry
+		inputTokens  int64
+		outputTokens int64
+	}
+	users := make(map[string]*userDebits)
+	var order []string
+	for i, entry := range entries {
+		if requests[i].seq > 0 {
+			batch.seqs = append(batch.seqs, requests[i].seq)
+		}
+		if duplicate[i] {
+			log.Printf("🔁 [Ledger] %s already recorded, skipping balance write", entry.ID)
+			continue
+		}
+		u, ok := users[entry.Username]
+		if !ok {
+			u = &userDebits{}
+			users[entry.Username] = u
+			order = append(order, entry.Username)
+		}
+		u.entries = append(u.entries, entry)
+		batch.written = append(batch.written, writtenDeduction{username: entry.Username, entryID: entry.ID, seq: requests[i].seq})
+		u.inputTokens += requests[i].inputTokens
+		u.outputTokens += requests[i].outputTokens
+	}
+
+	for _, username := range order {
+		u := users[username]
+		filter, update := creditsUpdateDoc(username, u.entries, u.inputTokens, u.outputTokens)
+		batch.models = append(batch.models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update))
+	}
+	return batch
 }
 
 // creditWorker processes credits (USD) deduction updates in batches using bulk write
+// Every deduction is recorded in the credit ledger before the balances are written;
+// requests already recorded are left out of the write, and a retried write skips the users
+// it updated before by their deduction markers
 func (b *BatchedUsageTracker) creditWorker() {
 	defer b.wg.Done()
-	
+
 	ticker := time.NewTicker(b.config.FlushInterval)
 	defer ticker.Stop()
-	
-	// Aggregate updates by username (track credits and refCredits separately)
+
+	// Aggregate updates by username
 	updates := make(map[string]*creditAggregation)
+	var pending *creditBatch
+	var written []writtenDeduction
 
 	flush := func() {
-		if len(updates) == 0 {
-			return
-		}
-		
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		// Build bulk write operations
-		models := make([]mongo.WriteModel, 0, len(updates))
-		
-		for username, agg := range updates {
-			incFields := bson.M{
-				"creditsUsed": agg.creditsUsed,
-			}
-			
-			// Get current credits balance to properly split deduction
-			totalCredits := agg.creditsToDeduct + agg.refCreditsToDeduct
-			currentCredits, currentRefCredits, err := getUserCreditsForBatcher(username)
-			
-			if err == nil && totalCredits > 0 {
-				// Smart deduction: use credits first, then refCredits
-				// Never allow negative balances
-				if currentCredits >= totalCredits {
-					// Enough credits, deduct all from credits
-					incFields["credits"] = -totalCredits
-				} else if currentCredits > 0 && currentRefCredits > 0 {
-					// Partial credits available and has refCredits, split between both
-					incFields["credits"] = -currentCredits
-					remainingCredits := totalCredits - currentCredits
-					// Only deduct what's available from refCredits
-					if remainingCredits > currentRefCredits {
-						incFields["refCredits"] = -currentRefCredits
-						log.Printf("⚠️ [%s] Split deduct capped: $%.6f from credits + $%.6f from refCredits (wanted $%.6f more)", username, currentCredits, currentRefCredits, remainingCredits-currentRefCredits)
-					} else {
-						incFields["refCredits"] = -remainingCredits
-						log.Printf("💰 [%s] Split deduct: $%.6f from credits + $%.6f from refCredits", username, currentCredits, remainingCredits)
-					}
-				} else if currentCredits > 0 {
-					// Has some credits but no refCredits, deduct only available
-					deductAmount := currentCredits
-					if deductAmount > totalCredits {
-						deductAmount = totalCredits
-					}
-					incFields["credits"] = -deductAmount
-					if deductAmount < totalCredits {
-						log.Printf("⚠️ [%s] Deduct capped at $%.6f from credits (no refCredits, wanted $%.6f)", username, deductAmount, totalCredits)
-					}
-				} else if currentRefCredits > 0 {
-					// No credits, deduct from refCredits only (capped at available)
-					deductAmount := currentRefCredits
-					if deductAmount > totalCredits {
-						deductAmount = totalCredits
-					}
-					incFields["refCredits"] = -deductAmount
-					if deductAmount < totalCredits {
-						log.Printf("⚠️ [%s] Deduct capped at $%.6f from refCredits (wanted $%.6f)", username, deductAmount, totalCredits)
-					} else {
-						log.Printf("💰 [%s] Deduct $%.6f from refCredits only", username, deductAmount)
-					}
-				} else {
-					// No credits available at all - don't deduct anything to prevent negative
-					log.Printf("⚠️ [%s] No credits available, skipping deduction of $%.6f", username, totalCredits)
-				}
-			} else {
-				// Fallback to original behavior if error getting credits balance
-				if agg.creditsToDeduct > 0 {
-					incFields["credits"] = -agg.creditsToDeduct
-				}
-				if agg.refCreditsToDeduct > 0 {
-					incFields["refCredits"] = -agg.refCreditsToDeduct
-				}
-			}
-			
-			// Track tokens for analytics
-			if agg.inputTokens > 0 {
-				incFields["totalInputTokens"] = agg.inputTokens
+		if pending == nil {
+			if len(updates) == 0 {
+				return
 			}
-			if agg.outputTokens > 0 {
-				incFields["totalOutputTokens"] = agg.outputTokens
+			pending = prepareCredits(ctx, updates)
+			// Clear map
+			for k := range updates {
+				delete(updates, k)
 			}
-
-			model := mongo.NewUpdateOneModel().
-				SetFilter(bson.M{"_id": username}).
-				SetUpdate(bson.M{"$inc": incFields})
-			models = append(models, model)
 		}
 
-		_, err := db.UsersCollection().BulkWrite(ctx, models)
-		if err != nil {
-			log.Printf("⚠️ [BatchedUsageTracker] Failed to bulk update credits: %v", err)
-		}
-		
-		// Clear map
-		for k := range updates {
-			delete(updates, k)
+		if err := pending.write(ctx, db.UsersCollection()); err != nil {
+			log.Printf("⚠️ [BatchedUsageTracker] Failed to bulk update credits, retrying: %v", err)
+			return
 		}
+		markDone(b.creditWAL, pending.seqs)
+		written = pruneDeductions(ctx, b.creditWAL, append(written, pending.written...))
+		pending = nil
 	}
 
+	stop := b.stopChan
 	for {
+		in := b.creditChan
+		if pending != nil {
+			in = nil
+		}
 		select {
-		case update := <-b.creditChan:
+		case update := <-in:
 			existing, ok := updates[update.username]
 			if !ok {
 				existing = &creditAggregation{}
 				updates[update.username] = existing
 			}
-
-			// Track credits in appropriate bucket
-			if update.useRefCredits {
-				existing.refCreditsToDeduct += update.cost
-			} else {
-				existing.creditsToDeduct += update.cost
-			}
 			existing.creditsUsed += update.cost
 			existing.inputTokens += update.inputTokens
 			existing.outputTokens += update.outputTokens
 			existing.cacheWriteTokens += update.cacheWriteTokens
 			existing.cacheHitTokens += update.cacheHitTokens
-			
+			existing.requests = append(existing.requests, update)
+
 			if len(updates) >= b.config.MaxBatchSize {
 				flush()
 			}
 		case <-ticker.C:
 			flush()
-		case <-b.stopChan:
+		case <-stop:
+			stop = nil
+		}
+		// Stopping: drain the queue as in requestLogWorker
+		if stop == nil && (pending != nil || len(b.creditChan) == 0) {
 			flush()
 			return
 		}
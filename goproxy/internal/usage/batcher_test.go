@@ -0,0 +1,212 @@
+package usage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestDebitEntries_SplitsQueuedDeductionsInOrder verifies each queued request gets its own
+// ledger entry and the split matches the batched balance write: credits first, then
+// refCredits, capped at what is left
+func TestDebitEntries_SplitsQueuedDeductionsInOrder(t *testing.T) {
+	requests := []creditUpdate{
+		{requestID: "req-1", cost: 0.30},
+		{requestID: "req-2", cost: 0.30},
+		{requestID: "req-3", cost: 0.30},
+	}
+
+	entries := debitEntries("alice", requests, 0.50, 0.20, true)
+	if len(entries) != 3 {
+		t.Fatalf("Expected one entry per request, got %d", len(entries))
+	}
+
+	want := []struct{ credits, refCredits float64 }{
+		{-0.30, 0},     // from credits
+		{-0.20, -0.10}, // rest of credits, then refCredits
+		{0, -0.10},     // refCredits exhausted: capped
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.ID != "deduction:"+requests[i].requestID || e.Charged != requests[i].cost {
+			t.Errorf("Entry %d: unexpected key or charge: %+v", i, e)
+		}
+		if !floatEqual(e.Credits, w.credits) || !floatEqual(e.RefCredits, w.refCredits) {
+			t.Errorf("Entry %d: expected credits %.2f refCredits %.2f, got %.2f and %.2f", i, w.credits, w.refCredits, e.Credits, e.RefCredits)
+		}
+	}
+}
+
+// TestDebitEntries_FallsBackToRefFlag verifies the queued useRefCredits flag decides when the
+// balance could not be read
+func TestDebitEntries_FallsBackToRefFlag(t *testing.T) {
+	entries := debitEntries("alice", []creditUpdate{
+		{requestID: "req-1", cost: 0.10},
+		{requestID: "req-2", cost: 0.20, useRefCredits: true},
+	}, 0, 0, false)
+
+	if entries[0].Credits != -0.10 || entries[0].RefCredits != 0 {
+		t.Errorf("Expected req-1 from credits, got %+v", entries[0])
+	}
+	if entries[1].Credits != 0 || entries[1].RefCredits != -0.20 {
+		t.Errorf("Expected req-2 from refCredits, got %+v", entries[1])
+	}
+}
+
+// TestCreditsUpdateDoc_EndsHoldsWithTheDeduction verifies a balance write deducts its entries'
+// split, pulls their requests' holds and marks the entries written
+func TestCreditsUpdateDoc_EndsHoldsWithTheDeduction(t *testing.T) {
+	requests := []creditUpdate{
+		{requestID: "req-1", entryID: "deduction:req-1", cost: 0.30, inputTokens: 10, outputTokens: 5},
+		{requestID: "", entryID: "deduction:anon-1", cost: 0.20},
+	}
+	entries := debitEntries("alice", requests, 0.40, 1, true)
+	if entries[1].ID != "deduction:anon-1" {
+		t.Fatalf("Expected the entry ID fixed at queue time, got %s", entries[1].ID)
+	}
+
+	filter, update := creditsUpdateDoc("alice", entries, 10, 5)
+	if filter["_id"] != "alice" {
+		t.Fatalf("Expected the write filtered on the user, got %v", filter)
+	}
+	if ids := filter[deductionsField+".id"].(bson.M)["$nin"].([]string); len(ids) != 2 || ids[0] != "deduction:req-1" || ids[1] != "deduction:anon-1" {
+		t.Errorf("Expected the write to require its entries unmarked, got %v", filter)
+	}
+	if markers := update["$push"].(bson.M)[deductionsField].(bson.M)["$each"].([]bson.M); len(markers) != 2 || markers[1]["id"] != "deduction:anon-1" {
+		t.Errorf("Expected the write to mark its entries, got %v", update["$push"])
+	}
+	pulled := update["$pull"].(bson.M)["creditHolds"].(bson.M)["id"].(bson.M)["$in"].([]string)
+	if len(pulled) != 1 || pulled[0] != "req-1" {
+		t.Errorf("Expected the request's credit hold to end with the write, got %v", update["$pull"])
+	}
+	inc := update["$inc"].(bson.M)
+	if !floatEqual(inc["credits"].(float64), -0.40) || !floatEqual(inc["refCredits"].(float64), -0.10) || !floatEqual(inc["creditsUsed"].(float64), 0.50) {
+		t.Errorf("Unexpected balance write: %v", inc)
+	}
+}
+
+// fakeUsers applies credit writes to in-memory balances as Mongo would, then fails the first
+// bulk write as if the connection dropped before the reply
+type fakeUsers struct {
+	credits map[string]float64
+	markers map[string][]string
+	calls   int
+}
+
+func (f *fakeUsers) BulkWrite(_ context.Context, models []mongo.WriteModel, _ ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	f.calls++
+	result := &mongo.BulkWriteResult{}
+	for _, m := range models {
+		model := m.(*mongo.UpdateOneModel)
+		filter, update := model.Filter.(bson.M), model.Update.(bson.M)
+		username := filter["_id"].(string)
+		applied := false
+		for _, id := range filter[deductionsField+".id"].(bson.M)["$nin"].([]string) {
+			for _, marked := range f.markers[username] {
+				applied = applied || id == marked
+			}
+		}
+		if applied {
+			continue
+		}
+		result.MatchedCount++
+		if credits, ok := update["$inc"].(bson.M)["credits"].(float64); ok {
+			f.credits[username] += credits
+		}
+		for _, marker := range update["$push"].(bson.M)[deductionsField].(bson.M)["$each"].([]bson.M) {
+			f.markers[username] = append(f.markers[username], marker["id"].(string))
+		}
+	}
+	if f.calls == 1 {
+		return nil, errors.New("connection reset by peer")
+	}
+	return result, nil
+}
+
+// TestCreditBatch_RetryAfterCommitDeductsOnce verifies a balance write retried after an error
+// that hid its success does not deduct again
+func TestCreditBatch_RetryAfterCommitDeductsOnce(t *testing.T) {
+	entries := debitEntries("alice", []creditUpdate{{requestID: "req-1", cost: 0.30}}, 1, 0, true)
+	filter, update := creditsUpdateDoc("alice", entries, 0, 0)
+	batch := &creditBatch{models: []mongo.WriteModel{mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update)}}
+	users := &fakeUsers{credits: map[string]float64{"alice": 1}, markers: map[string][]string{}}
+
+	if err := batch.write(context.Background(), users); err == nil {
+		t.Fatal("Expected the first write to fail")
+	}
+	if err := batch.write(context.Background(), users); err != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", err)
+	}
+	if !floatEqual(users.credits["alice"], 0.70) {
+		t.Errorf("Expected $0.30 deducted once, balance is %.2f", users.credits["alice"])
+	}
+}
+
+// TestPruneUpdateDoc_PullsMarkers verifies a prune pulls the checkpointed entries' markers and
+// those left by a crash
+func TestPruneUpdateDoc_PullsMarkers(t *testing.T) {
+	now := time.Now()
+	filter, update := pruneUpdateDoc("alice", []string{"deduction:req-1"}, now)
+	if filter["_id"] != "alice" {
+		t.Fatalf("Expected the prune filtered on the user, got %v", filter)
+	}
+	or := update["$pull"].(bson.M)[deductionsField].(bson.M)["$or"].(bson.A)
+	if ids := or[0].(bson.M)["id"].(bson.M)["$in"].([]string); len(ids) != 1 || ids[0] != "deduction:req-1" {
+		t.Errorf("Expected the entry's marker pulled, got %v", or[0])
+	}
+	if before := or[1].(bson.M)["at"].(bson.M)["$lt"].(time.Time); !before.Equal(now.Add(-AppliedTTL)) {
+		t.Errorf("Expected markers older than AppliedTTL pulled, got %v", or[1])
+	}
+}
+
+// TestUnapplied_RetriesFromTheFailedWrite verifies a retried bulk write leaves out the
+// updates an ordered write applied before it failed
+func TestUnapplied_RetriesFromTheFailedWrite(t *testing.T) {
+	models := []mongo.WriteModel{
+		mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": "alice"}),
+		mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": "bob"}),
+		mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": "carol"}),
+	}
+
+	failed := mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Index: 1, Code: 2}}}}
+	if left := unapplied(models, failed); len(left) != 2 || left[0] != models[1] {
+		t.Fatalf("Expected the writes from the failed one on retried, got %d", len(left))
+	}
+	concern := mongo.BulkWriteException{WriteConcernError: &mongo.WriteConcernError{Code: 64}}
+	if left := unapplied(models, concern); len(left) != 0 {
+		t.Errorf("Expected writes that only missed their write concern not retried, got %d", len(left))
+	}
+	if left := unapplied(models, errors.New("connection reset")); len(left) != 3 {
+		t.Errorf("Expected every write retried after an unknown failure, got %d", len(left))
+	}
+}
+
+// TestCreditRecord_RoundTrips verifies a queued credit update survives the WAL unchanged
+func TestCreditRecord_RoundTrips(t *testing.T) {
+	u := creditUpdate{
+		username:      "alice",
+		requestID:     "req-1",
+		entryID:       "deduction:req-1",
+		cost:          0.25,
+		inputTokens:   100,
+		outputTokens:  50,
+		useRefCredits: true,
+	}
+	data, err := json.Marshal(newCreditRecord(u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r creditRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.update(); got != u {
+		t.Fatalf("Expected %+v back, got %+v", u, got)
+	}
+}
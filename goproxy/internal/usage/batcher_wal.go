@@ -0,0 +1,265 @@
+package usage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"goproxy/db"
+	"goproxy/internal/ledger"
+	"goproxy/internal/wal"
+)
+
+// Write-ahead log of the batcher
+// Each queue has its own log (request_logs, usage, credits under the WAL directory): an entry
+// is written to it before it is queued and marked done once its batch is in Mongo. On start,
+// OpenWAL applies whatever was not done, one record at a time, so no write is lost to a crash
+// or restart. Replays are idempotent: request logs are inserted by their _id, usage updates
+// are written once their record ID is claimed in applied_writes (see claimApplied), and a
+// deduction is written only if its ledger entry's marker is not on the user yet (see
+// deductionsField): the write adds it, and it is pulled once the record is checkpointed.
+
+// usageRecord is a usage update as written to the WAL
+type usageRecord struct {
+	APIKey     string `json:"apiKey"`
+	TokensUsed int64  `json:"tokensUsed"`
+}
+
+// creditRecord is a credit update as written to the WAL
+type creditRecord struct {
+	Username         string  `json:"username"`
+	RequestID        string  `json:"requestId,omitempty"`
+	EntryID          string  `json:"entryId"`
+	Cost             float64 `json:"cost"`
+	TokensUsed       int64   `json:"tokensUsed,omitempty"`
+	InputTokens      int64   `json:"inputTokens,omitempty"`
+	OutputTokens     int64   `json:"outputTokens,omitempty"`
+	CacheWriteTokens int64   `json:"cacheWriteTokens,omitempty"`
+	CacheHitTokens   int64   `json:"cacheHitTokens,omitempty"`
+	UseRefCredits    bool    `json:"useRefCredits,omitempty"`
+}
+
+func newCreditRecord(u creditUpdate) creditRecord {
+	return creditRecord{
+		Username:         u.username,
+		RequestID:        u.requestID,
+		EntryID:          u.entryID,
+		Cost:             u.cost,
+		TokensUsed:       u.tokensUsed,
+		InputTokens:      u.inputTokens,
+		OutputTokens:     u.outputTokens,
+		CacheWriteTokens: u.cacheWriteTokens,
+		CacheHitTokens:   u.cacheHitTokens,
+		UseRefCredits:    u.useRefCredits,
+	}
+}
+
+func (r creditRecord) update() creditUpdate {
+	return creditUpdate{
+		username:         r.Username,
+		requestID:        r.RequestID,
+		entryID:          r.EntryID,
+		cost:             r.Cost,
+		tokensUsed:       r.TokensUsed,
+		inputTokens:      r.InputTokens,
+		outputTokens:     r.OutputTokens,
+		cacheWriteTokens: r.CacheWriteTokens,
+		cacheHitTokens:   r.CacheHitTokens,
+		useRefCredits:    r.UseRefCredits,
+	}
+}
+
+// appendWAL writes v to l and returns its sequence number, 0 if it is not in the WAL. A
+// failed write is logged and the entry is still queued: it is only lost on a crash.
+func appendWAL(l *wal.Log, v interface{}) uint64 {
+	if l == nil {
+		return 0
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("⚠️ [WAL] Failed to encode entry: %v", err)
+		return 0
+	}
+	seq, err := l.Append(data)
+	if err != nil {
+		log.Printf("⚠️ [WAL] Failed to write entry %d: %v", seq, err)
+	}
+	return seq
+}
+
+// markDone marks written entries done in their WAL
+func markDone(l *wal.Log, seqs []uint64) {
+	if err := l.Done(seqs...); err != nil {
+		log.Printf("⚠️ [WAL] Failed to checkpoint: %v", err)
+	}
+}
+
+// checkpointer returns a function marking replayed records done a batch at a time; call it
+// without arguments to mark the rest
+func (b *BatchedUsageTracker) checkpointer(l *wal.Log) func(seqs ...uint64) {
+	var pending []uint64
+	return func(seqs ...uint64) {
+		pending = append(pending, seqs...)
+		if len(seqs) == 0 || len(pending) >= b.config.MaxBatchSize {
+			markDone(l, pending)
+			pending = pending[:0]
+		}
+	}
+}
+
+// OpenWAL opens the batcher's write-ahead logs under dir and applies the entries left from
+// before the last stop. Call it before Start; an error leaves the logs for the next attempt.
+func (b *BatchedUsageTracker) OpenWAL(dir string, opts wal.Options) error {
+	var err error
+	if b.logWAL, err = wal.Open(filepath.Join(dir, "request_logs"), opts); err != nil {
+		return err
+	}
+	if b.usageWAL, err = wal.Open(filepath.Join(dir, "usage"), opts); err != nil {
+		return err
+	}
+	if b.creditWAL, err = wal.Open(filepath.Join(dir, "credits"), opts); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	logs, err := b.replayRequestLogs()
+	if err != nil {
+		return fmt.Errorf("replay request logs: %w", err)
+	}
+	usages, err := b.replayUsage()
+	if err != nil {
+		return fmt.Errorf("replay usage: %w", err)
+	}
+	credits, err := b.replayCredits()
+	if err != nil {
+		return fmt.Errorf("replay credits: %w", err)
+	}
+	if logs+usages+credits > 0 {
+		log.Printf("♻️ [WAL] Replayed %d request logs, %d usage updates and %d credit deductions in %v", logs, usages, credits, time.Since(start))
+	}
+	return nil
+}
+
+func (b *BatchedUsageTracker) replayRequestLogs() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	var batch []RequestLog
+	var seqs []uint64
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := insertRequestLogs(ctx, batch); err != nil {
+				return err
+			}
+		}
+		markDone(b.logWAL, seqs)
+		batch, seqs = batch[:0], seqs[:0]
+		return nil
+	}
+
+	n := 0
+	err := b.logWAL.Replay(func(rec wal.Record) error {
+		seqs = append(seqs, rec.Seq)
+		var entry RequestLog
+		if err := json.Unmarshal(rec.Data, &entry); err != nil {
+			log.Printf("⚠️ [WAL] Skipping unreadable request log %d: %v", rec.Seq, err)
+			return nil
+		}
+		batch = append(batch, entry)
+		n++
+		if len(batch) >= b.config.MaxBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, flush()
+}
+
+func (b *BatchedUsageTracker) replayUsage() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	n := 0
+	done := b.checkpointer(b.usageWAL)
+	err := b.usageWAL.Replay(func(rec wal.Record) error {
+		var r usageRecord
+		if err := json.Unmarshal(rec.Data, &r); err != nil {
+			log.Printf("⚠️ [WAL] Skipping unreadable usage update %d: %v", rec.Seq, err)
+		} else {
+			id := b.usageWAL.RecordID(rec.Seq)
+			applied, err := claimApplied(ctx, []string{id})
+			if err != nil {
+				return err
+			}
+			if !applied[id] {
+				filter, update := usageUpdateDoc(r.APIKey, r.TokensUsed, 1, time.Now())
+				if _, err := db.UserKeysCollection().UpdateOne(ctx, filter, update); err != nil {
+					return err
+				}
+				n++
+			}
+		}
+		done(rec.Seq)
+		return nil
+	})
+	done()
+	return n, err
+}
+
+// replayCredits records and applies each deduction. One recorded in the ledger before is
+// applied with its recorded split, unless its marker shows it was written.
+func (b *BatchedUsageTracker) replayCredits() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	n := 0
+	var written []writtenDeduction
+	done := b.checkpointer(b.creditWAL)
+	err := b.creditWAL.Replay(func(rec wal.Record) error {
+		var r creditRecord
+		if err := json.Unmarshal(rec.Data, &r); err != nil {
+			log.Printf("⚠️ [WAL] Skipping unreadable credit update %d: %v", rec.Seq, err)
+			done(rec.Seq)
+			return nil
+		}
+		u := r.update()
+
+		credits, refCredits, err := getUserCreditsForBatcher(u.username)
+		entry := debitEntries(u.username, []creditUpdate{u}, credits, refCredits, err == nil)[0]
+		if err := ledger.Append(ctx, entry); errors.Is(err, ledger.ErrDuplicate) {
+			recorded, err := ledger.Get(ctx, []string{entry.ID})
+			if err != nil {
+				return err
+			}
+			if e, ok := recorded[entry.ID]; ok {
+				entry = e
+			}
+		} else if err != nil {
+			return err
+		}
+
+		filter, update := creditsUpdateDoc(u.username, []ledger.Entry{entry}, u.inputTokens, u.outputTokens)
+		result, err := db.UsersCollection().UpdateOne(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			log.Printf("🔁 [Ledger] %s already applied, skipping balance write", entry.ID)
+		} else {
+			n++
+		}
+		written = append(written, writtenDeduction{username: u.username, entryID: entry.ID, seq: rec.Seq})
+		done(rec.Seq)
+		return nil
+	})
+	done()
+	pruneDeductions(ctx, b.creditWAL, written)
+	return n, err
+}
@@ -7,7 +7,12 @@ import (
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"goproxy/db"
+	"goproxy/internal/experiment"
+	"goproxy/internal/ledger"
+	"goproxy/internal/reservation"
+	"goproxy/internal/spendcap"
 )
 
 // =============================================================================
@@ -17,6 +22,9 @@ import (
 var (
 	// ErrInsufficientBalance is returned when user balance is insufficient for deduction
 	ErrInsufficientBalance = errors.New("insufficient balance for deduction")
+
+	// ErrFriendKeyModelNotFound is returned when a Friend Key usage matches no key or model limit
+	ErrFriendKeyModelNotFound = errors.New("friend key or model limit not found")
 )
 
 // AtomicDeductionResult contains the result of an atomic deduction operation
@@ -53,30 +61,52 @@ func CalculateDeductionSplit(credits, refCredits, cost float64) (creditsDeduct,
 }
 
 type RequestLog struct {
-	UserID           string    `bson:"userId,omitempty"`
-	UserKeyID        string    `bson:"userKeyId"`
-	TrollKeyID       string    `bson:"trollKeyId,omitempty"`
-	FactoryKeyID     string    `bson:"factoryKeyId,omitempty"`
-	Model            string    `bson:"model,omitempty"`
-	InputTokens      int64     `bson:"inputTokens"`
-	OutputTokens     int64     `bson:"outputTokens"`
-	CacheWriteTokens int64     `bson:"cacheWriteTokens"`
-	CacheHitTokens   int64     `bson:"cacheHitTokens"`
-	CreditsCost      float64   `bson:"creditsCost"`
-	CreditType       string    `bson:"creditType,omitempty"`
-	TokensUsed       int64     `bson:"tokensUsed"`
-	StatusCode       int       `bson:"statusCode"`
-	LatencyMs        int64     `bson:"latencyMs"`
-	IsSuccess        bool      `bson:"isSuccess"`
-	CreatedAt        time.Time `bson:"createdAt"`
+	ID               primitive.ObjectID `bson:"_id,omitempty"` // Set when queued, so a replayed log is not inserted twice
+	UserID           string             `bson:"userId,omitempty"`
+	RequestID        string             `bson:"requestId,omitempty"` // Credit ledger key of the request's deduction
+	UserKeyID        string             `bson:"userKeyId"`
+	TrollKeyID       string             `bson:"trollKeyId,omitempty"`
+	FactoryKeyID     string             `bson:"factoryKeyId,omitempty"`
+	Model            string             `bson:"model,omitempty"`
+	Upstream         string             `bson:"upstream,omitempty"`      // Upstream that served the request
+	FallbackHop      int                `bson:"fallbackHop,omitempty"`   // Position in the model's fallback chain; 0 = its own upstream
+	Experiment       string             `bson:"experiment,omitempty"`    // Upstream model experiment the request was assigned to
+	ExperimentArm    string             `bson:"experimentArm,omitempty"` // Upstream model ID of the assigned arm
+	InputTokens      int64              `bson:"inputTokens"`
+	OutputTokens     int64              `bson:"outputTokens"`
+	CacheWriteTokens int64              `bson:"cacheWriteTokens"`
+	CacheHitTokens   int64              `bson:"cacheHitTokens"`
+	CreditsCost      float64            `bson:"creditsCost"`
+	CreditType       string             `bson:"creditType,omitempty"`
+	TokensUsed       int64              `bson:"tokensUsed"`
+	StatusCode       int                `bson:"statusCode"`
+	LatencyMs        int64              `bson:"latencyMs"`
+	IsSuccess        bool               `bson:"isSuccess"`
+	IsBatch          bool               `bson:"isBatch,omitempty"`
+	Status           string             `bson:"status,omitempty"` // StatusCancelled when the client disconnected mid-response
+	CreatedAt        time.Time          `bson:"createdAt"`
 }
 
+const (
+	// StatusCancelled marks requests the client aborted; only delivered tokens are billed
+	StatusCancelled = "cancelled"
+
+	// StatusClientClosedRequest is logged as the status code of cancelled requests (nginx 499)
+	StatusClientClosedRequest = 499
+)
+
 type RequestLogParams struct {
 	UserID           string
 	UserKeyID        string
 	TrollKeyID       string
 	FactoryKeyID     string
 	Model            string
+	Upstream         string            // Upstream that served the request
+	FallbackHop      int               // 0 = the model's own upstream, n = its n-th fallback
+	Experiment       string            // Upstream model experiment, if the model has an upstream_model_id pool
+	ExperimentArm    string            // Upstream model ID the request was assigned
+	Hold             *reservation.Hold // Credit hold of the request, settled with CreditsCost
+	RequestID        string            // ID of the request's credit ledger entries
 	InputTokens      int64
 	OutputTokens     int64
 	CacheWriteTokens int64
@@ -86,6 +116,8 @@ type RequestLogParams struct {
 	TokensUsed       int64
 	StatusCode       int
 	LatencyMs        int64
+	IsBatch          bool // Billed at batch rates (Message Batches API)
+	Cancelled        bool // Client disconnected before the response finished
 }
 
 func UpdateUsage(apiKey string, tokensUsed int64) error {
@@ -132,13 +164,24 @@ func LogRequest(userKeyID, trollKeyID string, tokensUsed int64, statusCode int,
 func LogRequestDetailed(params RequestLogParams) {
 	// Determine if request was successful (2xx status code)
 	isSuccess := params.StatusCode >= 200 && params.StatusCode < 300
+	status := ""
+	if params.Cancelled {
+		isSuccess = false
+		status = StatusCancelled
+		params.StatusCode = StatusClientClosedRequest
+	}
 
 	logEntry := RequestLog{
 		UserID:           params.UserID,
+		RequestID:        params.RequestID,
 		UserKeyID:        params.UserKeyID,
 		TrollKeyID:       params.TrollKeyID,
 		FactoryKeyID:     params.FactoryKeyID,
 		Model:            params.Model,
+		Upstream:         params.Upstream,
+		FallbackHop:      params.FallbackHop,
+		Experiment:       params.Experiment,
+		ExperimentArm:    params.ExperimentArm,
 		InputTokens:      params.InputTokens,
 		OutputTokens:     params.OutputTokens,
 		CacheWriteTokens: params.CacheWriteTokens,
@@ -149,9 +192,19 @@ func LogRequestDetailed(params RequestLogParams) {
 		StatusCode:       params.StatusCode,
 		LatencyMs:        params.LatencyMs,
 		IsSuccess:        isSuccess,
+		IsBatch:          params.IsBatch,
+		Status:           status,
 		CreatedAt:        time.Now(),
 	}
 
+	if params.Experiment != "" {
+		experiment.RecordCost(params.Experiment, params.ExperimentArm, params.CreditsCost)
+	}
+	// The deduction was written or queued before the log; a hold it did not end ends here
+	params.Hold.Settle(params.CreditsCost)
+	// The key's spend is recorded with the end of its hold; alerts go out for both caps
+	spendcap.Settle(params.RequestID, params.UserID, params.UserKeyID, params.CreditsCost)
+
 	// Use batched writes if enabled
 	if UseBatchedWrites {
 		GetBatcher().QueueRequestLog(logEntry)
@@ -200,20 +253,20 @@ func UpdateTrollKeyUsage(trollKeyID string, tokensUsed int64) {
 }
 
 // DeductCredits deducts tokens from user's tokenBalance (legacy wrapper)
-func DeductCredits(username string, cost float64, tokensUsed int64) error {
-	return DeductCreditsWithTokens(username, cost, tokensUsed, 0, 0)
+func DeductCredits(username, requestID string, cost float64, tokensUsed int64) error {
+	return DeductCreditsWithTokens(username, requestID, cost, tokensUsed, 0, 0)
 }
 
 // DeductCreditsWithRefCheck deducts credits (USD) with refCredits support
 // useRefCredits should be true if the user's main credits is exhausted
-func DeductCreditsWithRefCheck(username string, cost float64, tokensUsed, inputTokens, outputTokens int64, useRefCredits bool) error {
+func DeductCreditsWithRefCheck(username, requestID string, cost float64, tokensUsed, inputTokens, outputTokens int64, useRefCredits bool) error {
 	if username == "" {
 		return nil
 	}
 
 	// Use batched writes if enabled
 	if UseBatchedWrites {
-		GetBatcher().QueueCreditUpdateWithRef(username, cost, tokensUsed, inputTokens, outputTokens, 0, 0, useRefCredits)
+		GetBatcher().QueueCreditUpdateWithRef(username, requestID, cost, tokensUsed, inputTokens, outputTokens, 0, 0, useRefCredits)
 		if useRefCredits {
 			log.Printf("💰 [%s] Deducted $%.6f from refCredits (in=%d, out=%d)", username, cost, inputTokens, outputTokens)
 		} else {
@@ -223,19 +276,19 @@ func DeductCreditsWithRefCheck(username string, cost float64, tokensUsed, inputT
 	}
 
 	// For non-batched mode, fall back to the existing function
-	return DeductCreditsWithTokens(username, cost, tokensUsed, inputTokens, outputTokens)
+	return DeductCreditsWithTokens(username, requestID, cost, tokensUsed, inputTokens, outputTokens)
 }
 
 // DeductCreditsWithTokens deducts credits (USD) and updates token counts for analytics
 // Deducts from main credits first, then from refCredits if insufficient
-func DeductCreditsWithTokens(username string, cost float64, tokensUsed, inputTokens, outputTokens int64) error {
-	return DeductCreditsWithCache(username, cost, tokensUsed, inputTokens, outputTokens, 0, 0)
+func DeductCreditsWithTokens(username, requestID string, cost float64, tokensUsed, inputTokens, outputTokens int64) error {
+	return DeductCreditsWithCache(username, requestID, cost, tokensUsed, inputTokens, outputTokens, 0, 0)
 }
 
 // DeductCreditsWithCache deducts credits (USD) from user including cache token tracking
 // Deducts from main credits first, then from refCredits if insufficient
 // Story 2.2: Uses atomic conditional update to prevent race conditions (AC2, AC4)
-func DeductCreditsWithCache(username string, cost float64, tokensUsed, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64) error {
+func DeductCreditsWithCache(username, requestID string, cost float64, tokensUsed, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64) error {
 	if username == "" {
 		return nil
 	}
@@ -248,7 +301,7 @@ func DeductCreditsWithCache(username string, cost float64, tokensUsed, inputToke
 	// Use batched writes if enabled
 	// Note: Batched writes have pre-check in the batcher queue
 	if UseBatchedWrites {
-		GetBatcher().QueueCreditUpdate(username, cost, tokensUsed, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
+		GetBatcher().QueueCreditUpdate(username, requestID, cost, tokensUsed, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
 		if cacheWriteTokens > 0 || cacheHitTokens > 0 {
 			log.Printf("💰 [%s] Deducted $%.6f (in=%d, out=%d, cache_write=%d, cache_hit=%d)", username, cost, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
 		} else {
@@ -260,7 +313,7 @@ func DeductCreditsWithCache(username string, cost float64, tokensUsed, inputToke
 	// Story 2.2: Atomic deduction with conditional update
 	// AC2: Atomic operations prevent race conditions
 	// AC4: No split reads/writes that could cause inconsistency
-	return deductCreditsAtomic(username, cost, inputTokens, outputTokens)
+	return deductCreditsAtomic(username, requestID, cost, inputTokens, outputTokens)
 }
 
 // deductCreditsAtomic performs atomic credit deduction using MongoDB conditional update
@@ -269,7 +322,8 @@ func DeductCreditsWithCache(username string, cost float64, tokensUsed, inputToke
 // AC2: Atomic operation prevents concurrent deduction race
 // AC3: Handles partial credits + refCredits atomically
 // AC4: Single operation - no split reads/writes
-func deductCreditsAtomic(username string, cost float64, inputTokens, outputTokens int64) error {
+// The deduction is recorded in the credit ledger first; a request already charged is skipped
+func deductCreditsAtomic(username, requestID string, cost float64, inputTokens, outputTokens int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -291,9 +345,16 @@ func deductCreditsAtomic(username string, cost float64, inputTokens, outputToken
 	// AC1: Pre-check - block if cost > total balance
 	if totalBalance < cost {
 		log.Printf("💸 [%s] Insufficient balance: cost=$%.6f > balance=$%.6f", username, cost, totalBalance)
+		recordShortfall(ctx, ledger.Debit(username, requestID, cost, 0, 0, 0))
 		return ErrInsufficientBalance
 	}
 
+	entry := ledger.Debit(username, requestID, cost, creditsDeduct, refDeduct, 0)
+	recorded, apply := recordDebit(ctx, entry)
+	if !apply {
+		return nil
+	}
+
 	// Build atomic update with conditional filter
 	// This ensures the deduction only happens if balance hasn't changed
 	incFields := bson.M{
@@ -334,16 +395,21 @@ func deductCreditsAtomic(username string, cost float64, inputTokens, outputToken
 	update := bson.M{
 		"$inc": incFields,
 	}
+	// The request's credit hold ends with its deduction, which counts toward the spend caps
+	reservation.PullIn(update, requestID)
+	spendcap.RecordIn(update, cost, time.Now())
 
 	result, err := db.UsersNewCollection().UpdateOne(ctx, filter, update)
 	if err != nil {
 		log.Printf("❌ Failed to update user %s: %v", username, err)
+		reverseDebit(recorded, entry, err)
 		return err
 	}
 
 	// AC1 & AC2: If ModifiedCount == 0, balance was insufficient (either already low or race condition)
 	if result.ModifiedCount == 0 {
 		log.Printf("💸 [%s] Atomic deduction failed: balance check failed (cost=$%.6f, race or insufficient)", username, cost)
+		reverseDebit(recorded, entry, ErrInsufficientBalance)
 		return ErrInsufficientBalance
 	}
 
@@ -359,6 +425,39 @@ func deductCreditsAtomic(username string, cost float64, inputTokens, outputToken
 	return nil
 }
 
+// recordDebit records a deduction in the credit ledger before its balance write. It reports
+// whether the entry was recorded and whether the balance must be written: not if the request
+// was charged before. A ledger failure does not block the charge; reconciliation reports it.
+func recordDebit(ctx context.Context, entry ledger.Entry) (recorded, apply bool) {
+	err := ledger.Append(ctx, entry)
+	switch {
+	case err == nil:
+		return true, true
+	case errors.Is(err, ledger.ErrDuplicate):
+		log.Printf("🔁 [Ledger] %s already recorded, skipping balance write", entry.ID)
+		return false, false
+	default:
+		log.Printf("⚠️ [Ledger] Failed to record %s: %v", entry.ID, err)
+		return false, true
+	}
+}
+
+// recordShortfall records a charge the balance could not cover, so the request's cost is
+// still on the ledger
+func recordShortfall(ctx context.Context, entry ledger.Entry) {
+	entry.Note = "insufficient balance"
+	if err := ledger.Append(ctx, entry); err != nil && !errors.Is(err, ledger.ErrDuplicate) {
+		log.Printf("⚠️ [Ledger] Failed to record %s: %v", entry.ID, err)
+	}
+}
+
+// reverseDebit undoes a recorded deduction whose balance write failed
+func reverseDebit(recorded bool, entry ledger.Entry, cause error) {
+	if recorded {
+		ledger.Reverse([]ledger.Entry{entry}, cause)
+	}
+}
+
 func maskKey(key string) string {
 	if len(key) < 10 {
 		return "***"
@@ -370,7 +469,7 @@ func maskKey(key string) string {
 // IMPORTANT: Function name refers to credit field ('creditsNew'), NOT upstream provider
 // Used by chat.trollllm.xyz with OpenHands upstream
 // Deducts from 'creditsNew' field only
-func DeductCreditsOpenHands(username string, cost float64, tokensUsed, inputTokens, outputTokens int64) error {
+func DeductCreditsOpenHands(username, requestID string, cost float64, tokensUsed, inputTokens, outputTokens int64) error {
 	if username == "" {
 		return nil
 	}
@@ -397,9 +496,16 @@ func DeductCreditsOpenHands(username string, cost float64, tokensUsed, inputToke
 	// Pre-check - block if cost > creditsNew balance
 	if user.CreditsNew < cost {
 		log.Printf("💸 [OpenHands] [%s] Insufficient credits: cost=$%.6f > balance=$%.6f", username, cost, user.CreditsNew)
+		recordShortfall(ctx, ledger.Debit(username, requestID, cost, 0, 0, 0))
 		return ErrInsufficientBalance
 	}
 
+	entry := ledger.Debit(username, requestID, cost, 0, 0, cost)
+	recorded, apply := recordDebit(ctx, entry)
+	if !apply {
+		return nil
+	}
+
 	// Build atomic update
 	incFields := bson.M{
 		"creditsNew":      -cost,              // Deduct from creditsNew
@@ -424,16 +530,20 @@ func DeductCreditsOpenHands(username string, cost float64, tokensUsed, inputToke
 	update := bson.M{
 		"$inc": incFields,
 	}
+	reservation.PullIn(update, requestID)
+	spendcap.RecordIn(update, cost, time.Now())
 
 	result, err := db.UsersNewCollection().UpdateOne(ctx, filter, update)
 	if err != nil {
 		log.Printf("❌ [OpenHands] Failed to update user %s: %v", username, err)
+		reverseDebit(recorded, entry, err)
 		return err
 	}
 
 	// If ModifiedCount == 0, balance was insufficient
 	if result.ModifiedCount == 0 {
 		log.Printf("💸 [OpenHands] [%s] Atomic deduction failed: creditsNew balance check failed (cost=$%.6f)", username, cost)
+		reverseDebit(recorded, entry, ErrInsufficientBalance)
 		return ErrInsufficientBalance
 	}
 
@@ -445,7 +555,7 @@ func DeductCreditsOpenHands(username string, cost float64, tokensUsed, inputToke
 // IMPORTANT: Function name refers to credit field ('credits'), NOT upstream provider
 // Used by chat2.trollllm.xyz with OpenHands upstream
 // Deducts from 'credits' and 'refCredits' fields
-func DeductCreditsOhMyGPT(username string, cost float64, tokensUsed, inputTokens, outputTokens int64) error {
+func DeductCreditsOhMyGPT(username, requestID string, cost float64, tokensUsed, inputTokens, outputTokens int64) error {
 	if username == "" {
 		return nil
 	}
@@ -459,7 +569,7 @@ func DeductCreditsOhMyGPT(username string, cost float64, tokensUsed, inputTokens
 	// Always use synchronous deduction
 
 	// Synchronous deduction for OhMyGPT (same as legacy logic)
-	return deductCreditsAtomic(username, cost, inputTokens, outputTokens)
+	return deductCreditsAtomic(username, requestID, cost, inputTokens, outputTokens)
 }
 
 // IsFriendKey checks if an API key is a Friend Key
@@ -469,15 +579,16 @@ func IsFriendKey(apiKey string) bool {
 
 // UpdateFriendKeyUsageIfNeeded checks if the API key is a Friend Key and updates usage
 // This is a convenience function that can be called after any request
-func UpdateFriendKeyUsageIfNeeded(userApiKey, modelID string, costUsd float64) {
+func UpdateFriendKeyUsageIfNeeded(userApiKey, requestID, modelID string, costUsd float64) {
 	if IsFriendKey(userApiKey) {
-		UpdateFriendKeyUsage(userApiKey, modelID, costUsd)
+		UpdateFriendKeyUsage(userApiKey, requestID, modelID, costUsd)
 	}
 }
 
 // UpdateFriendKeyUsage updates the Friend Key usage for a specific model
 // Should be called after a successful request using a Friend Key
-func UpdateFriendKeyUsage(friendKeyID, modelID string, costUsd float64) error {
+// The usage is recorded in the credit ledger first; a request already counted is skipped
+func UpdateFriendKeyUsage(friendKeyID, requestID, modelID string, costUsd float64) error {
 	if friendKeyID == "" || modelID == "" {
 		return nil
 	}
@@ -485,6 +596,19 @@ func UpdateFriendKeyUsage(friendKeyID, modelID string, costUsd float64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	entry := ledger.Entry{
+		ID:        ledger.Key(ledger.KindFriendKeyUsage, requestID),
+		Kind:      ledger.KindFriendKeyUsage,
+		RequestID: requestID,
+		Charged:   costUsd,
+		FriendKey: maskKey(friendKeyID),
+		Note:      modelID,
+	}
+	recorded, apply := recordDebit(ctx, entry)
+	if !apply {
+		return nil
+	}
+
 	now := time.Now()
 
 	// Update the specific model's usedUsd and overall stats
@@ -508,8 +632,14 @@ func UpdateFriendKeyUsage(friendKeyID, modelID string, costUsd float64) error {
 
 	if err != nil {
 		log.Printf("⚠️ Failed to update Friend Key usage: %v", err)
+		reverseDebit(recorded, entry, err)
 		return err
 	}
+	if result.MatchedCount == 0 {
+		log.Printf("⚠️ Friend Key %s has no limit for model %s, usage not counted", maskKey(friendKeyID), modelID)
+		reverseDebit(recorded, entry, ErrFriendKeyModelNotFound)
+		return ErrFriendKeyModelNotFound
+	}
 
 	if result.ModifiedCount > 0 {
 		log.Printf("🔑 Friend Key usage updated: %s model=%s cost=$%.6f", maskKey(friendKeyID), modelID, costUsd)
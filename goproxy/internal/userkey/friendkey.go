@@ -228,31 +228,3 @@ func ValidateFriendKey(apiKey string, modelID string) (*FriendKeyValidationResul
 		UseRefCredits: useRefCredits,
 	}, nil
 }
-
-func UpdateFriendKeyUsage(apiKey string, modelID string, costUsd float64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	now := time.Now()
-
-	// Update the specific model's usedUsd and overall stats
-	_, err := db.FriendKeysCollection().UpdateOne(
-		ctx,
-		bson.M{
-			"_id":                apiKey,
-			"modelLimits.modelId": modelID,
-		},
-		bson.M{
-			"$inc": bson.M{
-				"modelLimits.$.usedUsd": costUsd,
-				"totalUsedUsd":          costUsd,
-				"requestsCount":         1,
-			},
-			"$set": bson.M{
-				"lastUsedAt": now,
-			},
-		},
-	)
-
-	return err
-}
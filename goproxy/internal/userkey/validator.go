@@ -11,6 +11,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"goproxy/db"
+	"goproxy/internal/reservation"
 )
 
 var (
@@ -246,6 +247,8 @@ type UserCredits struct {
 	Credits    float64 `bson:"credits"`    // OhMyGPT balance (port 8005)
 	CreditsNew float64 `bson:"creditsNew"` // OpenHands balance (port 8004)
 	RefCredits float64 `bson:"refCredits"`
+
+	CreditHolds reservation.Entries `bson:"creditHolds"` // in-flight requests' holds
 }
 
 // CreditCheckResult contains the result of credits balance check
@@ -422,6 +425,7 @@ type AffordabilityResult struct {
 	Credits          float64 // main credits balance (USD)
 	RefCredits       float64 // referral credits balance (USD)
 	TotalBalance     float64 // credits + refCredits
+	Available        float64 // TotalBalance minus credit holds and queued deductions
 	RequestCost      float64 // cost of the request
 	RemainingBalance float64 // balance after deduction (if affordable)
 }
@@ -464,19 +468,22 @@ func CanAffordRequest(username string, cost float64) (*AffordabilityResult, erro
 	}
 
 	totalBalance := user.Credits + user.RefCredits
-	canAfford := totalBalance >= cost
+	// In-flight requests' holds and unwritten deductions are already spoken for
+	available := totalBalance - user.CreditHolds.Held(reservation.Credits, time.Now())
+	canAfford := available >= cost
 
 	result := &AffordabilityResult{
 		CanAfford:        canAfford,
 		Credits:          user.Credits,
 		RefCredits:       user.RefCredits,
 		TotalBalance:     totalBalance,
+		Available:        available,
 		RequestCost:      cost,
-		RemainingBalance: totalBalance - cost,
+		RemainingBalance: available - cost,
 	}
 
 	if !canAfford {
-		return result, InsufficientCreditsForRequest(cost, totalBalance)
+		return result, InsufficientCreditsForRequest(cost, available)
 	}
 
 	return result, nil
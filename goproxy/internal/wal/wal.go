@@ -0,0 +1,588 @@
+package wal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Write-ahead log
+// A Log is a directory of append-only segment files. Each record gets a sequence number and
+// is written (and, depending on the sync policy, fsynced) before Append returns. Consumers
+// mark records done once they are stored elsewhere; the checkpoint is the highest sequence
+// number below which every record is done. It is persisted, segments wholly below it are
+// deleted, and Replay hands the records after it back after a crash or restart.
+//
+// Record format: length (4 bytes), CRC-32C of sequence number and data (4), sequence number
+// (8), data. A record torn by a crash fails its checksum and ends the log.
+
+// SyncPolicy is when records are fsynced
+type SyncPolicy int
+
+const (
+	SyncAlways   SyncPolicy = iota // before Append returns; concurrent appends share an fsync
+	SyncInterval                   // every Options.SyncEvery; a crash loses at most that much
+	SyncNever                      // left to the OS
+)
+
+// ParseSyncPolicy parses "always", "interval" or "never"
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return SyncAlways, fmt.Errorf("unknown sync policy %q", s)
+}
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	}
+	return "always"
+}
+
+// Options configure a Log
+type Options struct {
+	SegmentSize int64         // a new segment is started once this size is reached
+	Sync        SyncPolicy    // when records are fsynced
+	SyncEvery   time.Duration // period of SyncInterval
+}
+
+// DefaultOptions fsyncs every append and starts a new segment every 64 MB
+func DefaultOptions() Options {
+	return Options{
+		SegmentSize: 64 << 20,
+		Sync:        SyncAlways,
+		SyncEvery:   100 * time.Millisecond,
+	}
+}
+
+// ErrClosed is returned by appends to a closed Log
+var ErrClosed = errors.New("wal: log closed")
+
+const (
+	headerSize     = 16
+	segmentExt     = ".wal"
+	checkpointFile = "checkpoint"
+	idFile         = "id"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Record is one entry of the log
+type Record struct {
+	Seq  uint64
+	Data []byte
+}
+
+type segment struct {
+	first uint64 // sequence number of its first record
+	path  string
+}
+
+// Stats describe a Log
+type Stats struct {
+	Segments   int    `json:"segments"`
+	Bytes      int64  `json:"bytes"`
+	LastSeq    uint64 `json:"last_seq"`
+	Checkpoint uint64 `json:"checkpoint"`
+	Pending    uint64 `json:"pending"` // records not done yet
+	Sync       string `json:"sync"`
+}
+
+// Log is a write-ahead log. A nil Log accepts appends without writing anything, so callers
+// need no special casing when the WAL is disabled.
+type Log struct {
+	dir  string
+	id   string
+	opts Options
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64 // of the active segment
+	bytes    int64 // of every segment
+	segments []segment
+	nextSeq  uint64
+	closed   bool
+
+	syncMu sync.Mutex
+	synced atomic.Uint64 // highest sequence number known to be on disk
+
+	doneMu     sync.Mutex
+	checkpoint uint64
+	done       map[uint64]bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens the log in dir, creating it if needed. A record torn by a crash at the end of
+// the last segment is truncated away.
+func Open(dir string, opts Options) (*Log, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultOptions().SegmentSize
+	}
+	if opts.SyncEvery <= 0 {
+		opts.SyncEvery = DefaultOptions().SyncEvery
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, opts: opts, done: make(map[uint64]bool), stop: make(chan struct{})}
+
+	var err error
+	if l.id, err = readOrCreateID(dir); err != nil {
+		return nil, err
+	}
+	if l.checkpoint, err = readCheckpoint(dir); err != nil {
+		return nil, err
+	}
+	if l.segments, err = listSegments(dir); err != nil {
+		return nil, err
+	}
+
+	// Find the last record, truncating a torn tail
+	lastSeq := l.checkpoint
+	for i, seg := range l.segments {
+		end, last, size, err := scanSegment(seg.path)
+		if err != nil {
+			return nil, err
+		}
+		if end < size {
+			if i < len(l.segments)-1 {
+				log.Printf("⚠️ [WAL] %s is corrupt after %d bytes; its remaining records are lost", seg.path, end)
+			} else {
+				log.Printf("⚠️ [WAL] Truncating torn record at the end of %s (%d bytes)", seg.path, size-end)
+				if err := os.Truncate(seg.path, end); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if last > lastSeq {
+			lastSeq = last
+		}
+		l.bytes += end
+	}
+	l.nextSeq = lastSeq + 1
+	l.synced.Store(lastSeq)
+
+	if n := len(l.segments); n > 0 {
+		l.file, err = os.OpenFile(l.segments[n-1].path, os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		info, err := l.file.Stat()
+		if err != nil {
+			l.file.Close()
+			return nil, err
+		}
+		l.size = info.Size()
+	} else if err := l.createSegmentLocked(); err != nil {
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval {
+		l.wg.Add(1)
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+// ID identifies the log directory; with a sequence number it makes a record ID that stays
+// unique if the directory is recreated
+func (l *Log) ID() string {
+	if l == nil {
+		return ""
+	}
+	return l.id
+}
+
+// RecordID is the unique ID of the record with sequence number seq, or "" without a log
+func (l *Log) RecordID(seq uint64) string {
+	if l == nil || seq == 0 {
+		return ""
+	}
+	return l.id + ":" + strconv.FormatUint(seq, 10)
+}
+
+// Append writes data as a new record and returns its sequence number. With SyncAlways the
+// record is on disk when Append returns without error; an fsync error still returns the
+// sequence number of the written record, which must be marked done like any other.
+func (l *Log) Append(data []byte) (uint64, error) {
+	if l == nil {
+		return 0, nil
+	}
+	buf := make([]byte, headerSize+len(data))
+	copy(buf[headerSize:], data)
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return 0, ErrClosed
+	}
+	if l.size > 0 && l.size+int64(len(buf)) > l.opts.SegmentSize {
+		if err := l.rotateLocked(); err != nil {
+			l.mu.Unlock()
+			return 0, err
+		}
+	}
+	seq := l.nextSeq
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint64(buf[8:16], seq)
+	binary.LittleEndian.PutUint32(buf[4:8], checksum(buf[8:]))
+	if _, err := l.file.Write(buf); err != nil {
+		// Drop the partial record so the next one does not follow garbage
+		l.file.Truncate(l.size)
+		l.mu.Unlock()
+		return 0, err
+	}
+	l.size += int64(len(buf))
+	l.bytes += int64(len(buf))
+	l.nextSeq++
+	l.mu.Unlock()
+
+	if l.opts.Sync == SyncAlways {
+		if err := l.syncTo(seq); err != nil {
+			return seq, err
+		}
+	}
+	return seq, nil
+}
+
+// syncTo fsyncs the active segment unless seq is already on disk. Appends waiting on the
+// same fsync are satisfied by it.
+func (l *Log) syncTo(seq uint64) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	if l.synced.Load() >= seq {
+		return nil
+	}
+	l.mu.Lock()
+	f, last := l.file, l.nextSeq-1
+	l.mu.Unlock()
+	if err := f.Sync(); err != nil {
+		// A rotation closed the file after fsyncing it
+		if l.synced.Load() >= seq {
+			return nil
+		}
+		return err
+	}
+	l.storeSynced(last)
+	return nil
+}
+
+func (l *Log) storeSynced(seq uint64) {
+	for {
+		cur := l.synced.Load()
+		if seq <= cur || l.synced.CompareAndSwap(cur, seq) {
+			return
+		}
+	}
+}
+
+func (l *Log) syncLoop() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.opts.SyncEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			last := l.nextSeq - 1
+			l.mu.Unlock()
+			if err := l.syncTo(last); err != nil {
+				log.Printf("⚠️ [WAL] fsync of %s failed: %v", l.dir, err)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *Log) rotateLocked() error {
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.storeSynced(l.nextSeq - 1)
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	return l.createSegmentLocked()
+}
+
+func (l *Log) createSegmentLocked() error {
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d%s", l.nextSeq, segmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(l.dir); err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = 0
+	l.segments = append(l.segments, segment{first: l.nextSeq, path: path})
+	return nil
+}
+
+// Replay calls fn with every record after the checkpoint, in order. Call it before appending.
+func (l *Log) Replay(fn func(Record) error) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	segments := append([]segment(nil), l.segments...)
+	l.mu.Unlock()
+	l.doneMu.Lock()
+	checkpoint := l.checkpoint
+	l.doneMu.Unlock()
+
+	for i, seg := range segments {
+		if i+1 < len(segments) && segments[i+1].first <= checkpoint+1 {
+			continue
+		}
+		err := readSegment(seg.path, func(rec Record) error {
+			if rec.Seq <= checkpoint {
+				return nil
+			}
+			return fn(rec)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Done marks records as stored. The checkpoint advances over every record done without a gap
+// and is persisted; segments wholly behind it are deleted.
+func (l *Log) Done(seqs ...uint64) error {
+	if l == nil || len(seqs) == 0 {
+		return nil
+	}
+	l.doneMu.Lock()
+	defer l.doneMu.Unlock()
+	for _, seq := range seqs {
+		if seq > l.checkpoint {
+			l.done[seq] = true
+		}
+	}
+	checkpoint := l.checkpoint
+	for l.done[checkpoint+1] {
+		delete(l.done, checkpoint+1)
+		checkpoint++
+	}
+	if checkpoint == l.checkpoint {
+		return nil
+	}
+	if err := writeCheckpoint(l.dir, checkpoint); err != nil {
+		return err
+	}
+	l.checkpoint = checkpoint
+	l.removeSegments(checkpoint)
+	return nil
+}
+
+// removeSegments deletes the segments whose records are all at or below checkpoint
+func (l *Log) removeSegments(checkpoint uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for n < len(l.segments)-1 && l.segments[n+1].first <= checkpoint+1 {
+		n++
+	}
+	for _, seg := range l.segments[:n] {
+		if info, err := os.Stat(seg.path); err == nil {
+			l.bytes -= info.Size()
+		}
+		if err := os.Remove(seg.path); err != nil {
+			log.Printf("⚠️ [WAL] Failed to remove %s: %v", seg.path, err)
+		}
+	}
+	l.segments = l.segments[n:]
+}
+
+// Stats returns the log's size and progress
+func (l *Log) Stats() Stats {
+	if l == nil {
+		return Stats{}
+	}
+	l.mu.Lock()
+	stats := Stats{Segments: len(l.segments), Bytes: l.bytes, LastSeq: l.nextSeq - 1, Sync: l.opts.Sync.String()}
+	l.mu.Unlock()
+	l.doneMu.Lock()
+	stats.Checkpoint = l.checkpoint
+	l.doneMu.Unlock()
+	if stats.LastSeq > stats.Checkpoint {
+		stats.Pending = stats.LastSeq - stats.Checkpoint
+	}
+	return stats
+}
+
+// Close fsyncs and closes the log. Records not done are replayed on the next Open.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mu.Unlock()
+	close(l.stop)
+	l.wg.Wait()
+
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+func checksum(b []byte) uint32 {
+	return crc32.Checksum(b, crcTable)
+}
+
+// readSegment calls fn with each intact record of the segment at path
+func readSegment(path string, fn func(Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil
+		}
+		if checksum(append(header[8:16:16], data...)) != binary.LittleEndian.Uint32(header[4:8]) {
+			return nil
+		}
+		if err := fn(Record{Seq: binary.LittleEndian.Uint64(header[8:16]), Data: data}); err != nil {
+			return err
+		}
+	}
+}
+
+// scanSegment returns the offset after the last intact record, that record's sequence number
+// and the file size
+func scanSegment(path string) (end int64, last uint64, size int64, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	err = readSegment(path, func(rec Record) error {
+		end += int64(headerSize + len(rec.Data))
+		last = rec.Seq
+		return nil
+	})
+	return end, last, info.Size(), err
+}
+
+func listSegments(dir string) ([]segment, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, path := range names {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{first: first, path: path})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return segments, nil
+}
+
+func readCheckpoint(dir string) (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(dir, checkpointFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// writeCheckpoint replaces the checkpoint file atomically
+func writeCheckpoint(dir string, seq uint64) error {
+	tmp := filepath.Join(dir, checkpointFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strconv.FormatUint(seq, 10)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, checkpointFile)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func readOrCreateID(dir string) (string, error) {
+	path := filepath.Join(dir, idFile)
+	if b, err := os.ReadFile(path); err == nil {
+		return strings.TrimSpace(string(b)), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	b := make([]byte, 6)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	if err := os.WriteFile(path, []byte(id), 0o644); err != nil {
+		return "", err
+	}
+	return id, syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,159 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func replayAll(t *testing.T, l *Log) []string {
+	t.Helper()
+	var got []string
+	if err := l.Replay(func(rec Record) error {
+		got = append(got, fmt.Sprintf("%d=%s", rec.Seq, rec.Data))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestLog_ReplaysRecordsAfterTheCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"a", "b", "c", "d"} {
+		if _, err := l.Append([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Done out of order: the checkpoint stops at the first gap
+	if err := l.Done(1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if stats := l.Stats(); stats.Checkpoint != 1 || stats.Pending != 3 {
+		t.Fatalf("Expected checkpoint 1 with 3 pending, got %+v", stats)
+	}
+	l.Close()
+
+	l, err = Open(dir, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got := replayAll(t, l)
+	want := []string{"2=b", "3=c", "4=d"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Expected %v replayed, got %v", want, got)
+	}
+	if seq, _ := l.Append([]byte("e")); seq != 5 {
+		t.Errorf("Expected sequence numbers to continue at 5, got %d", seq)
+	}
+}
+
+func TestLog_TruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append([]byte("first"))
+	l.Append([]byte("second"))
+	l.Close()
+
+	// A crash in the middle of the second record
+	path := filepath.Join(dir, fmt.Sprintf("%020d%s", 1, segmentExt))
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = Open(dir, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := replayAll(t, l); len(got) != 1 || got[0] != "1=first" {
+		t.Fatalf("Expected only the intact record, got %v", got)
+	}
+	l.Append([]byte("third"))
+	if got := replayAll(t, l); len(got) != 2 || got[1] != "2=third" {
+		t.Fatalf("Expected appends to follow the intact record, got %v", got)
+	}
+}
+
+func TestLog_RotatesAndDeletesCheckpointedSegments(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.SegmentSize = 3 * (headerSize + 4)
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 10; i++ {
+		l.Append([]byte(fmt.Sprintf("r%03d", i)))
+	}
+	if stats := l.Stats(); stats.Segments != 4 {
+		t.Fatalf("Expected 4 segments of 3 records, got %+v", stats)
+	}
+
+	if err := l.Done(1, 2, 3, 4, 5, 6, 7); err != nil {
+		t.Fatal(err)
+	}
+	stats := l.Stats()
+	if stats.Segments != 2 || stats.Checkpoint != 7 {
+		t.Fatalf("Expected the first 2 segments deleted, got %+v", stats)
+	}
+	if got := replayAll(t, l); len(got) != 3 || got[0] != "8=r007" {
+		t.Fatalf("Expected records 8-10 left, got %v", got)
+	}
+}
+
+func TestLog_ConcurrentAppendsGetDistinctSequenceNumbers(t *testing.T) {
+	l, err := Open(t.TempDir(), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			seq, err := l.Append([]byte("x"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			seen[seq] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(seen) != 50 || !seen[1] || !seen[50] {
+		t.Fatalf("Expected sequence numbers 1-50, got %d distinct", len(seen))
+	}
+	if got := replayAll(t, l); len(got) != 50 {
+		t.Fatalf("Expected 50 records on disk, got %d", len(got))
+	}
+}
+
+func TestLog_NilIsANoOp(t *testing.T) {
+	var l *Log
+	if seq, err := l.Append([]byte("x")); seq != 0 || err != nil {
+		t.Fatalf("Expected a nil log to accept appends, got %d, %v", seq, err)
+	}
+	if err := l.Done(1); err != nil || l.RecordID(1) != "" {
+		t.Fatal("Expected a nil log to ignore Done and have no record IDs")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -20,17 +21,26 @@ import (
 
 	"goproxy/config"
 	"goproxy/db"
+	"goproxy/internal/admission"
+	"goproxy/internal/affinity"
+	"goproxy/internal/breaker"
 	"goproxy/internal/cache"
 	"goproxy/internal/errorlog"
 	"goproxy/internal/keypool"
+	"goproxy/internal/ledger"
 	"goproxy/internal/maintarget"
 	"goproxy/internal/ohmygpt"
+	_ "goproxy/internal/openaicompat"
 	"goproxy/internal/openhands"
-	"goproxy/internal/openhandspool"
+	"goproxy/internal/provider"
 	"goproxy/internal/proxy"
 	"goproxy/internal/ratelimit"
+	"goproxy/internal/reservation"
+	"goproxy/internal/spendcap"
+	"goproxy/internal/sse"
 	"goproxy/internal/usage"
 	"goproxy/internal/userkey"
+	"goproxy/internal/wal"
 	"goproxy/transformers"
 
 	"github.com/andybalholm/brotli"
@@ -50,8 +60,6 @@ var (
 
 	// NEW MODEL-BASED ROUTING - BEGIN
 	// Main Target Server configuration (for Sonnet 4.5 and Haiku 4.5)
-	mainTargetServer string
-	mainUpstreamKey  string
 	// NEW MODEL-BASED ROUTING - END
 )
 
@@ -209,7 +217,12 @@ func doRequestWithRetry(client *http.Client, req *http.Request, bodyBytes []byte
 	for attempt := 0; attempt <= maxRetries; attempt++ {
 		if attempt > 0 {
 			delay := retryBaseDelay * time.Duration(1<<(attempt-1))
-			time.Sleep(delay)
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				// Client disconnected: don't keep retrying on its behalf
+				return nil, req.Context().Err()
+			}
 			req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
 		}
 
@@ -281,6 +294,14 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
+// getEnvDuration parses a Go duration (e.g. "15s", "5m"), falling back to defaultValue
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return defaultValue
+}
+
 func parseInt(s string) int {
 	i, err := strconv.Atoi(s)
 	if err != nil {
@@ -292,92 +313,28 @@ func parseInt(s string) int {
 // NEW MODEL-BASED ROUTING - BEGIN
 // UpstreamConfig holds the configuration for routing to upstream provider
 type UpstreamConfig struct {
+	Provider    provider.Provider // upstream instance from the provider registry
+	Type        string            // provider type of the instance ("main", "openhands", "ohmygpt")
 	EndpointURL string
 	APIKey      string
 	UseProxy    bool   // true = use proxy pool, false = direct connection
 	KeyID       string // for logging purposes
 }
 
-// selectUpstreamConfig returns the upstream configuration based on model
-// Returns endpoint URL, API key, whether to use proxy, and key ID for logging
-func selectUpstreamConfig(modelID string, clientAPIKey string) (*UpstreamConfig, *proxy.Proxy, error) {
-	upstream := config.GetModelUpstream(modelID)
-
-	if upstream == "main" {
-		// Use Main Target Server (for Sonnet 4.5 and Haiku 4.5)
-		if mainTargetServer == "" || mainUpstreamKey == "" {
-			return nil, nil, fmt.Errorf("main target server not configured")
-		}
-		log.Printf("🔀 [Model Routing] %s -> Main Target Server", modelID)
-		return &UpstreamConfig{
-			EndpointURL: mainTargetServer + "/v1/messages",
-			APIKey:      mainUpstreamKey,
-			UseProxy:    false,
-			KeyID:       "main",
-		}, nil, nil
-	}
-
-	// TEMPORARILY DISABLED: Factory AI Key logic
-	// All "troll" and "openhands" upstream now route to OpenHands with key rotation
-	if upstream == "openhands" || upstream == "troll" {
-		// Use OpenHands via TrollProxy with key rotation
-		omgProvider := openhands.GetOpenHands()
-		if omgProvider == nil || !omgProvider.IsConfigured() {
-			return nil, nil, fmt.Errorf("openhands not configured")
-		}
-		log.Printf("🔀 [Model Routing] %s -> OpenHands (upstream=%s)", modelID, upstream)
-		return &UpstreamConfig{
-			EndpointURL: openhands.OpenHandsEndpoint,
-			APIKey:      "", // handled by OpenHands provider with key rotation
-			UseProxy:    false,
-			KeyID:       "openhands",
-		}, nil, nil
-	}
-
-	// OhMyGPT routing
-	if upstream == "ohmygpt" {
-		// Use OhMyGPT via TrollProxy with key rotation
-		ohmygptProvider := ohmygpt.GetOhMyGPT()
-		if ohmygptProvider == nil || !ohmygptProvider.IsConfigured() {
-			return nil, nil, fmt.Errorf("ohmygpt not configured")
-		}
-		log.Printf("🔀 [Model Routing] %s -> OhMyGPT (upstream=%s)", modelID, upstream)
-		return &UpstreamConfig{
-			EndpointURL: ohmygpt.OhMyGPTEndpoint,
-			APIKey:      "", // handled by OhMyGPT provider with key rotation
-			UseProxy:    false,
-			KeyID:       "ohmygpt",
-		}, nil, nil
-	}
-
-	// OpenHands LLM Proxy routing
-	if upstream == "openhands" {
-		openhandsPool := openhandspool.GetPool()
-		if openhandsPool == nil || openhandsPool.GetKeyCount() == 0 {
-			return nil, nil, fmt.Errorf("openhands not configured")
-		}
-		log.Printf("🔀 [Model Routing] %s -> OpenHands LLM Proxy", modelID)
-		return &UpstreamConfig{
-			EndpointURL: "https://llm-proxy.app.all-hands.dev",
-			APIKey:      "", // handled by OpenHands provider with key rotation
-			UseProxy:    false,
-			KeyID:       "openhands",
-		}, nil, nil
-	}
-
-	// Fallback: also use OpenHands
-	omgProvider := openhands.GetOpenHands()
-	if omgProvider != nil && omgProvider.IsConfigured() {
-		log.Printf("🔀 [Model Routing] %s -> OpenHands (fallback)", modelID)
-		return &UpstreamConfig{
-			EndpointURL: openhands.OpenHandsEndpoint,
-			APIKey:      "",
-			UseProxy:    false,
-			KeyID:       "openhands",
-		}, nil, nil
-	}
-
-	return nil, nil, fmt.Errorf("no upstream configured for model %s", modelID)
+// selectUpstreamConfig returns the upstream configuration for one tier of a model's chain
+// (its own upstream or a fallback's). The upstream name is looked up in the provider registry
+func selectUpstreamConfig(modelID string, upstream string, clientAPIKey string) (*UpstreamConfig, *proxy.Proxy, error) {
+	p := provider.Get(upstream)
+	if p == nil || !p.IsConfigured() {
+		return nil, nil, fmt.Errorf("%s not configured", upstream)
+	}
+	log.Printf("🔀 [Model Routing] %s -> %s (type=%s)", modelID, upstream, p.Type())
+	return &UpstreamConfig{
+		Provider: p,
+		Type:     p.Type(),
+		UseProxy: false,
+		KeyID:    upstream,
+	}, nil, nil
 
 	/* DISABLED: Factory AI Key with proxy pool
 	// Default: Use Troll Key (Factory AI) with proxy pool
@@ -515,6 +472,18 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// withWriteTimeout sets the write deadline for a route. It replaces the server-wide
+// WriteTimeout, which cut every stream at 300s; streaming handlers push the deadline
+// forward on each write (see sse.Writer), so only stalled clients time out.
+func withWriteTimeout(timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Every request on a keep-alive connection passes through here, so a previous
+		// request's deadline is always replaced before anything is written
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+		next(w, r)
+	}
+}
+
 // Response recorder
 type responseRecorder struct {
 	http.ResponseWriter
@@ -526,6 +495,10 @@ func (r *responseRecorder) WriteHeader(code int) {
 	r.ResponseWriter.WriteHeader(code)
 }
 
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 // checkRateLimit checks if request is within rate limit for the given API key
 // Returns true if allowed, false if rate limited (response already sent)
 // Default: OpenAI format for backward compatibility
@@ -575,8 +548,14 @@ func checkRateLimitWithUsername(w http.ResponseWriter, apiKey string, username s
 // Health check endpoint
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	status := "healthy"
+	if draining.Load() {
+		// Shutting down: take the instance out of rotation
+		status = "draining"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":    "healthy",
+		"status":    status,
 		"timestamp": time.Now().UTC().Format(time.RFC3339),
 		"uptime":    time.Since(startTime).Seconds(),
 	}); err != nil {
@@ -591,9 +570,40 @@ func keysStatusHandler(w http.ResponseWriter, r *http.Request) {
 		"stats":                 trollKeyPool.GetStats(),
 		"backup_keys_available": keypool.GetBackupKeyCount(),
 		"keys":                  trollKeyPool.GetAllKeysStatus(),
+		"affinity":              affinityStats(),
+		"circuits":              breaker.All(),
+		"queues":                admission.All(),
+		"credit_holds":          reservation.GetStats(),
+		"spend_caps":            spendCapStats(),
+		"usage_batcher":         usageBatcherStats(),
 	})
 }
 
+// usageBatcherStats reports the usage tracker's queues and WAL, or nil if writes are not batched
+func usageBatcherStats() *usage.BatcherStats {
+	if !usage.UseBatchedWrites {
+		return nil
+	}
+	stats := usage.GetBatcher().Stats()
+	return &stats
+}
+
+// affinityStats reports cache-affinity hit rates for each upstream that pins conversations to keys
+func affinityStats() map[string]affinity.Stats {
+	stats := make(map[string]affinity.Stats)
+	seen := make(map[provider.Provider]bool)
+	for _, name := range provider.Names() {
+		p := provider.Get(name)
+		reporter, ok := p.(provider.AffinityReporter)
+		if !ok || seen[p] {
+			continue
+		}
+		seen[p] = true
+		stats[p.Name()] = reporter.AffinityStats()
+	}
+	return stats
+}
+
 // OpenHands backup keys endpoint
 func openhandsBackupKeysHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -784,8 +794,11 @@ func chatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Batch workers (/v1/batches) bill at batch rates and bypass the rate limiter
+	isBatch := isBatchBillingRequest(r)
+
 	// Check rate limit (with refCredits support for Pro RPM) - OpenAI format for /v1/chat/completions
-	if !checkRateLimitWithUsername(w, clientAPIKey, username, false) {
+	if !isBatch && !checkRateLimitWithUsername(w, clientAPIKey, username, false) {
 		return
 	}
 	// // Get factory key from proxy pool or environment
@@ -913,16 +926,6 @@ func chatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
 	// OLD CODE - END
 
 	// NEW MODEL-BASED ROUTING - BEGIN
-	// Select upstream based on model configuration
-	upstreamConfig, selectedProxy, err := selectUpstreamConfig(model.ID, clientAPIKey)
-	if err != nil {
-		log.Printf("❌ Failed to select upstream: %v", err)
-		errorlog.HTTPErrorWithUser(w, r, `{"error": {"message": "Server configuration error", "type": "server_error"}}`, http.StatusInternalServerError, username, clientAPIKey)
-		return
-	}
-	authHeader = "Bearer " + upstreamConfig.APIKey
-	trollKeyID := upstreamConfig.KeyID
-
 	// Credit pre-check based on billing_upstream config (not upstream provider)
 	// billing_upstream="openhands" → check creditsNew field
 	// billing_upstream="ohmygpt" → check credits+refCredits fields
@@ -961,47 +964,285 @@ func chatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Route request based on model type and upstream
-	switch model.Type {
-	case "anthropic":
-		handleAnthropicRequest(w, r, &openaiReq, model, authHeader, selectedProxy, clientAPIKey, trollKeyID, username, upstreamConfig, bodyBytes)
-	case "openai":
-		// For "main" upstream: route to Main Target Server with OpenAI response format
-		if upstreamConfig.KeyID == "main" {
-			handleMainTargetRequestOpenAI(w, &openaiReq, bodyBytes, model.ID, clientAPIKey, username)
-		} else if upstreamConfig.KeyID == "openhands" {
-			handleOpenHandsOpenAIRequest(w, &openaiReq, bodyBytes, model.ID, clientAPIKey, username)
-		} else if upstreamConfig.KeyID == "ohmygpt" {
-			handleOhMyGPTOpenAIRequest(w, &openaiReq, bodyBytes, model.ID, clientAPIKey, username)
-		} else {
-			handleTrollOpenAIRequest(w, r, &openaiReq, model, authHeader, selectedProxy, clientAPIKey, trollKeyID, username, bodyBytes)
+	// Identify the request for its log, its ledger entries and the client
+	r = withRequestID(w, r)
+
+	// Hold the request's worst-case cost so parallel requests cannot overspend the balance or the spend caps
+	r, holds, err := reserveCredits(r, model.ID, username, clientAPIKey, func() int64 { return estimateInputTokens(&openaiReq) }, int64(openaiReq.OutputTokenLimit()), isBatch)
+	var capped *spendcap.ExceededError
+	if errors.As(err, &capped) {
+		errorlog.JSONErrorWithUser(w, r, openaiSpendCapError(capped), http.StatusPaymentRequired, username, clientAPIKey)
+		return
+	}
+	var insufficient *reservation.InsufficientError
+	if errors.As(err, &insufficient) {
+		errorlog.JSONErrorWithUser(w, r, fmt.Sprintf(`{"error":{"message":"Insufficient credits for this request. Estimated cost: $%.2f, available balance: $%.2f","type":"insufficient_quota","code":"insufficient_credits","balance":%.2f}}`, insufficient.Amount, insufficient.Available, insufficient.Available), http.StatusPaymentRequired, username, clientAPIKey)
+		return
+	}
+	defer holds.Release()
+
+	// Pin the conversation to the key that served its earlier turns (prompt cache),
+	// and to its experiment arm if the model has an upstream_model_id pool
+	r = r.WithContext(affinity.WithPrefix(r.Context(), affinity.Prefix(bodyBytes)))
+	r = withExperiment(r, model.ID, username)
+	if openaiReq.Stream {
+		r = withStreamKeepalive(r, sse.OpenAIKeepalive)
+	}
+
+	// Route request based on model type and upstream, walking the model's fallback chain.
+	// Each tier gets its own copy of the request since handlers rewrite the model and messages.
+	err = serveWithFallbacks(w, r, model.ID, clientAPIKey, username, func(w http.ResponseWriter, r *http.Request, upstreamConfig *UpstreamConfig, selectedProxy *proxy.Proxy) {
+		tierReq := openaiReq
+		authHeader := "Bearer " + upstreamConfig.APIKey
+		trollKeyID := upstreamConfig.KeyID
+
+		switch model.Type {
+		case "anthropic":
+			handleAnthropicRequest(w, r, &tierReq, model, authHeader, selectedProxy, clientAPIKey, trollKeyID, username, upstreamConfig, bodyBytes, isBatch)
+		case "openai", "openhands", "ohmygpt":
+			// OpenHands and OhMyGPT take OpenAI format as-is; the tier decides where it goes
+			serveChatCompletions(w, r, upstreamConfig, &tierReq, bodyBytes, model.ID, clientAPIKey, username, isBatch)
+		default:
+			errorlog.HTTPErrorWithUser(w, r, `{"error": {"message": "Unsupported model type", "type": "invalid_request_error"}}`, http.StatusBadRequest, username, clientAPIKey)
+		}
+	})
+	if errors.Is(err, breaker.ErrOpen) {
+		log.Printf("❌ No upstream available for %s: %v", model.ID, err)
+		errorlog.HTTPErrorWithUser(w, r, `{"error": {"message": "Service temporarily unavailable. Please try again later.", "type": "server_error"}}`, http.StatusServiceUnavailable, username, clientAPIKey)
+	} else if err != nil {
+		log.Printf("❌ Failed to select upstream: %v", err)
+		errorlog.HTTPErrorWithUser(w, r, `{"error": {"message": "Server configuration error", "type": "server_error"}}`, http.StatusInternalServerError, username, clientAPIKey)
+	}
+	// NEW MODEL-BASED ROUTING - END
+}
+
+// responsesHandler serves the OpenAI Responses API (/v1/responses).
+// The request is translated to chat completions format and handed to chatCompletionsHandler,
+// so auth, rate limiting, credit checks, upstream routing and billing stay in one place.
+// responsesWriter converts the chat completions output back into Responses format.
+func responsesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errorlog.HTTPError(w, r, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error: failed to read request body: %v", err)
+		errorlog.HTTPError(w, r, `{"error": {"message": "Failed to read request body", "type": "invalid_request_error"}}`, http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+
+	var responsesReq transformers.ResponsesRequest
+	if err := json.Unmarshal(bodyBytes, &responsesReq); err != nil {
+		log.Printf("Error: failed to parse request body: %v", err)
+		errorlog.HTTPError(w, r, `{"error": {"message": "Invalid JSON", "type": "invalid_request_error"}}`, http.StatusBadRequest)
+		return
+	}
+
+	openaiReq, err := transformers.TransformResponsesToOpenAI(&responsesReq)
+	if err != nil {
+		log.Printf("❌ [/v1/responses] Invalid request: %v", err)
+		errBody, _ := json.Marshal(map[string]interface{}{
+			"error": map[string]interface{}{
+				"message": err.Error(),
+				"type":    "invalid_request_error",
+			},
+		})
+		errorlog.HTTPError(w, r, string(errBody), http.StatusBadRequest)
+		return
+	}
+
+	chatBody, err := json.Marshal(openaiReq)
+	if err != nil {
+		log.Printf("Error: failed to serialize request: %v", err)
+		errorlog.HTTPError(w, r, `{"error": {"message": "Failed to serialize request", "type": "server_error"}}`, http.StatusInternalServerError)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(chatBody))
+	r.ContentLength = int64(len(chatBody))
+
+	log.Printf("📥 [/v1/responses] Model: %s, Messages: %d, Tools: %d, Stream: %v", openaiReq.Model, len(openaiReq.Messages), len(openaiReq.Tools), openaiReq.Stream)
+
+	rw := &responsesWriter{
+		ResponseWriter: w,
+		model:          responsesReq.Model,
+		stream:         responsesReq.Stream,
+	}
+	chatCompletionsHandler(rw, r)
+	rw.finish()
+}
+
+// responsesWriter rewrites chat completions output into Responses API format.
+// Streams are converted line by line; non-streaming bodies are buffered and converted in finish.
+// Error responses (non-200) pass through unchanged since both APIs share the error format.
+type responsesWriter struct {
+	http.ResponseWriter
+	model       string
+	stream      bool
+	statusCode  int
+	wroteHeader bool
+	buf         bytes.Buffer // non-stream body, or the unterminated tail of the SSE stream
+	event       string       // current SSE event name
+	started     bool
+	transformer *transformers.ResponsesStreamTransformer
+}
+
+func (rw *responsesWriter) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.statusCode = code
+	// Non-streaming success is sent from finish, once the converted body is ready
+	if code != http.StatusOK || rw.stream {
+		rw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (rw *responsesWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.statusCode != http.StatusOK {
+		return rw.ResponseWriter.Write(p)
+	}
+	rw.buf.Write(p)
+	if rw.stream {
+		if err := rw.convertStream(); err != nil {
+			return 0, err
 		}
-	case "openhands":
-		// OpenHands LLM Proxy: Always forward OpenAI format to /v1/chat/completions
-		// No transformation needed - OpenHands handles Claude/GPT/Gemini models in OpenAI format
-		if upstreamConfig.KeyID == "openhands" {
-			handleOpenHandsOpenAIRequest(w, &openaiReq, bodyBytes, model.ID, clientAPIKey, username)
+	}
+	return len(p), nil
+}
+
+// Unwrap lets http.ResponseController reach the connection (write deadlines)
+func (rw *responsesWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *responsesWriter) Flush() {
+	if !rw.wroteHeader || (!rw.stream && rw.statusCode == http.StatusOK) {
+		return
+	}
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// convertStream converts every complete SSE line in buf into Responses events
+func (rw *responsesWriter) convertStream() error {
+	if rw.transformer == nil {
+		rw.transformer = transformers.NewResponsesStreamTransformer(rw.model)
+	}
+
+	for {
+		line, err := rw.buf.ReadString('\n')
+		if err != nil {
+			// Incomplete line - keep it until the rest arrives
+			rw.buf.Reset()
+			rw.buf.WriteString(line)
+			return nil
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		var out string
+		switch {
+		case line == "":
+			rw.event = ""
+		case strings.HasPrefix(line, ":"):
+			out = line + "\n\n"
+		case strings.HasPrefix(line, "event: "):
+			rw.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			dataStr := strings.TrimPrefix(line, "data: ")
+			if strings.TrimSpace(dataStr) == "[DONE]" {
+				out = rw.startEvents() + rw.transformer.Finish()
+				break
+			}
+			var chunk map[string]interface{}
+			if err := json.Unmarshal([]byte(dataStr), &chunk); err != nil {
+				continue
+			}
+			if errData, ok := chunk["error"].(map[string]interface{}); ok || rw.event == "error" {
+				message, _ := errData["message"].(string)
+				if message == "" {
+					message = "Upstream stream error"
+				}
+				out = rw.startEvents() + rw.transformer.Fail(message)
+				break
+			}
+			out = rw.startEvents() + rw.transformer.TransformChunk(chunk)
 		}
-	case "ohmygpt":
-		// OhMyGPT: Always forward OpenAI format to /v1/chat/completions
-		if upstreamConfig.KeyID == "ohmygpt" {
-			handleOhMyGPTOpenAIRequest(w, &openaiReq, bodyBytes, model.ID, clientAPIKey, username)
+
+		if out != "" {
+			if _, err := io.WriteString(rw.ResponseWriter, out); err != nil {
+				return err
+			}
 		}
-	default:
-		errorlog.HTTPErrorWithUser(w, r, `{"error": {"message": "Unsupported model type", "type": "invalid_request_error"}}`, http.StatusBadRequest, username, clientAPIKey)
 	}
-	// NEW MODEL-BASED ROUTING - END
+}
+
+// startEvents returns response.created/in_progress the first time it is called
+func (rw *responsesWriter) startEvents() string {
+	if rw.started {
+		return ""
+	}
+	rw.started = true
+	return rw.transformer.Start()
+}
+
+// finish completes the response after chatCompletionsHandler returns
+func (rw *responsesWriter) finish() {
+	if !rw.wroteHeader || rw.statusCode != http.StatusOK {
+		return
+	}
+
+	if rw.stream {
+		if rw.transformer != nil && !rw.transformer.Finished() {
+			// Upstream ended without [DONE]
+			io.WriteString(rw.ResponseWriter, rw.startEvents()+rw.transformer.Finish())
+			rw.Flush()
+		}
+		return
+	}
+
+	var chatResp map[string]interface{}
+	if err := json.Unmarshal(rw.buf.Bytes(), &chatResp); err != nil {
+		log.Printf("⚠️ [/v1/responses] Failed to parse chat completion: %v", err)
+		rw.ResponseWriter.WriteHeader(http.StatusOK)
+		rw.ResponseWriter.Write(rw.buf.Bytes())
+		return
+	}
+
+	rw.Header().Del("Content-Length")
+	rw.Header().Set("Content-Type", "application/json")
+	rw.ResponseWriter.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw.ResponseWriter).Encode(transformers.TransformChatCompletionToResponse(chatResp, rw.model)); err != nil {
+		log.Printf("Error: failed to encode response: %v", err)
+	}
 }
 
 // Handle Anthropic type request
-func handleAnthropicRequest(w http.ResponseWriter, r *http.Request, openaiReq *transformers.OpenAIRequest, model *config.Model, authHeader string, selectedProxy *proxy.Proxy, userApiKey string, trollKeyID string, username string, upstreamConfig *UpstreamConfig, bodyBytes []byte) {
+func handleAnthropicRequest(w http.ResponseWriter, r *http.Request, openaiReq *transformers.OpenAIRequest, model *config.Model, authHeader string, selectedProxy *proxy.Proxy, userApiKey string, trollKeyID string, username string, upstreamConfig *UpstreamConfig, bodyBytes []byte, isBatch bool) {
 	// For "main" upstream: use maintarget package (passthrough to external proxy)
-	if upstreamConfig.KeyID == "main" {
-		handleMainTargetRequest(w, openaiReq, bodyBytes, model.ID, userApiKey, username)
+	if target, ok := upstreamConfig.Provider.(*maintarget.Target); ok {
+		handleMainTargetRequest(w, r, target, openaiReq, bodyBytes, model.ID, userApiKey, username, isBatch)
+		return
+	}
+
+	// Types without handlers of their own take the request in OpenAI format as-is
+	if _, ok := upstreamHandlers[upstreamConfig.Type]; !ok {
+		handleProviderOpenAIRequest(w, r, upstreamConfig.Provider, openaiReq, model.ID, userApiKey, username, isBatch)
 		return
 	}
 
 	// For "troll" upstream: use Factory AI with full transformation
+	if err := transformers.ValidateAnthropicParams(openaiReq); err != nil {
+		writeUnsupportedParamError(w, r, err, username, userApiKey)
+		return
+	}
 	anthropicReq := transformers.TransformToAnthropic(openaiReq)
 
 	// Determine thinking state based on assistant messages in conversation history
@@ -1017,31 +1258,45 @@ func handleAnthropicRequest(w http.ResponseWriter, r *http.Request, openaiReq *t
 		log.Printf("⚠️ [/v1/chat/completions] Mixed thinking state detected - enabling thinking")
 	}
 
-	if hasThinking {
+	// reasoning_effort from the request takes precedence over the model config ("none" = off)
+	thinkingBudget := transformers.ThinkingBudget(openaiReq.Model, openaiReq.ReasoningEffort)
+
+	if transformers.ForcesToolUse(anthropicReq.ToolChoice) {
+		// Anthropic rejects thinking when tool_choice forces a tool
+		anthropicReq.Thinking = nil
+		log.Printf("🧠 [/v1/chat/completions] Thinking: DISABLED (tool_choice forces tool use)")
+	} else if hasThinking {
 		// Conversation has thinking blocks - MUST enable thinking
 		if anthropicReq.Thinking == nil || anthropicReq.Thinking.Type != "enabled" {
-			budgetTokens := config.GetModelThinkingBudget(openaiReq.Model)
+			budgetTokens := thinkingBudget
+			if budgetTokens == 0 {
+				budgetTokens = config.GetModelThinkingBudget(openaiReq.Model)
+			}
 			anthropicReq.Thinking = &transformers.ThinkingConfig{
 				Type:         "enabled",
 				BudgetTokens: budgetTokens,
 			}
+			if anthropicReq.MaxTokens <= budgetTokens {
+				anthropicReq.MaxTokens = budgetTokens + 4000
+			}
 		}
 		log.Printf("🧠 [/v1/chat/completions] Thinking: ENABLED (conversation has thinking blocks, budget=%d)", anthropicReq.Thinking.BudgetTokens)
 	} else if hasNonThinking {
 		// Conversation lacks thinking blocks BUT model might support it - check config
-		reasoning := config.GetModelReasoning(openaiReq.Model)
-		if reasoning != "" {
+		if thinkingBudget > 0 {
 			// Model supports thinking - ENABLE IT
-			budgetTokens := config.GetModelThinkingBudget(openaiReq.Model)
 			anthropicReq.Thinking = &transformers.ThinkingConfig{
 				Type:         "enabled",
-				BudgetTokens: budgetTokens,
+				BudgetTokens: thinkingBudget,
 			}
-			log.Printf("🧠 [/v1/chat/completions] Thinking: ENABLED (force enable for model with reasoning, budget=%d)", budgetTokens)
+			if anthropicReq.MaxTokens <= thinkingBudget {
+				anthropicReq.MaxTokens = thinkingBudget + 4000
+			}
+			log.Printf("🧠 [/v1/chat/completions] Thinking: ENABLED (force enable for model with reasoning, budget=%d)", thinkingBudget)
 		} else {
-			// Model doesn't support thinking - disable
+			// Model doesn't support thinking (or reasoning_effort=none) - disable
 			anthropicReq.Thinking = nil
-			log.Printf("🧠 [/v1/chat/completions] Thinking: DISABLED (model has no reasoning config)")
+			log.Printf("🧠 [/v1/chat/completions] Thinking: DISABLED (no reasoning config or reasoning_effort)")
 		}
 	} else {
 		// No assistant messages - new conversation, use config
@@ -1066,7 +1321,7 @@ func handleAnthropicRequest(w http.ResponseWriter, r *http.Request, openaiReq *t
 		log.Printf("📤 %s", string(reqBody))
 	}
 
-	proxyReq, err := http.NewRequest(http.MethodPost, endpointURL, bytes.NewBuffer(reqBody))
+	proxyReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, endpointURL, bytes.NewBuffer(reqBody))
 	if err != nil {
 		log.Printf("Error: failed to create request: %v", err)
 		http.Error(w, `{"error": {"message": "Failed to create request", "type": "server_error"}}`, http.StatusInternalServerError)
@@ -1106,22 +1361,22 @@ func handleAnthropicRequest(w http.ResponseWriter, r *http.Request, openaiReq *t
 	}
 
 	if openaiReq.Stream {
-		handleAnthropicStreamResponse(w, resp, model.ID, userApiKey, trollKeyID, requestStartTime, username)
+		handleAnthropicStreamResponse(w, resp, model.ID, userApiKey, trollKeyID, requestStartTime, username, openaiReq.ResponseFormat, openaiReq.IncludeUsage())
 	} else {
-		handleAnthropicNonStreamResponse(w, resp, model.ID, userApiKey, trollKeyID, requestStartTime, username)
+		handleAnthropicNonStreamResponse(w, resp, model.ID, userApiKey, trollKeyID, requestStartTime, username, openaiReq.ResponseFormat, isBatch)
 	}
 }
 
 // handleMainTargetRequest handles requests routed to main target (external proxy)
 // Forwards OpenAI format directly with model ID mapping
-func handleMainTargetRequest(w http.ResponseWriter, openaiReq *transformers.OpenAIRequest, bodyBytes []byte, modelID string, userApiKey string, username string) {
-	if !maintarget.IsConfigured() {
+func handleMainTargetRequest(w http.ResponseWriter, r *http.Request, target *maintarget.Target, openaiReq *transformers.OpenAIRequest, bodyBytes []byte, modelID string, userApiKey string, username string, isBatch bool) {
+	if !target.IsConfigured() {
 		http.Error(w, `{"error": {"message": "Main target not configured", "type": "server_error"}}`, http.StatusInternalServerError)
 		return
 	}
 
 	// Get upstream model ID (may be different from client-requested model ID)
-	upstreamModelID := config.GetUpstreamModelID(modelID)
+	upstreamModelID := upstreamModelIDFor(r, modelID)
 
 	// Prepare request body with mapped model ID
 	var requestBody []byte
@@ -1144,10 +1399,10 @@ func handleMainTargetRequest(w http.ResponseWriter, openaiReq *transformers.Open
 	}
 
 	isStreaming := openaiReq.Stream
-	log.Printf("📤 [MainTarget] Forwarding to %s/v1/chat/completions (model=%s, stream=%v)", maintarget.GetServerURL(), upstreamModelID, isStreaming)
+	log.Printf("📤 [MainTarget] Forwarding to %s/v1/chat/completions (model=%s, stream=%v)", target.GetServerURL(), upstreamModelID, isStreaming)
 
 	requestStartTime := time.Now()
-	resp, err := maintarget.ForwardOpenAIRequest(requestBody, isStreaming)
+	resp, err := target.ForwardRequest(r.Context(), requestBody, isStreaming)
 	if err != nil {
 		log.Printf("❌ [MainTarget] Request failed after %v: %v", time.Since(requestStartTime), err)
 		http.Error(w, `{"error": {"message": "Request to main target failed", "type": "upstream_error"}}`, http.StatusBadGateway)
@@ -1156,8 +1411,14 @@ func handleMainTargetRequest(w http.ResponseWriter, openaiReq *transformers.Open
 	defer resp.Body.Close()
 
 	onUsage := func(input, output, cacheWrite, cacheHit int64) {
-		billingTokens := config.CalculateBillingTokensWithCache(modelID, input, output, cacheWrite, cacheHit)
-		billingCost := calculateDiscountedBillingCost(modelID, upstreamModelID, input, output, cacheWrite, cacheHit)
+		// Cancelled streams end before the usage chunk: estimate the prompt instead
+		cancelled := transformers.ClientCancelled(resp)
+		if cancelled && input == 0 {
+			input = estimateInputTokens(openaiReq)
+		}
+
+		billingTokens := billingTokensFor(r, modelID, input, output, cacheWrite, cacheHit)
+		billingCost := calculateDiscountedBillingCostWithBatch(r, modelID, upstreamModelID, input, output, cacheWrite, cacheHit, isBatch)
 
 		if userApiKey != "" {
 			usage.UpdateUsage(userApiKey, billingTokens)
@@ -1170,16 +1431,16 @@ func handleMainTargetRequest(w http.ResponseWriter, openaiReq *transformers.Open
 				billingUpstream := config.GetModelBillingUpstream(modelID)
 				if billingUpstream == "openhands" {
 					// billing_upstream='openhands' → DeductCreditsOpenHands() → creditsNew field
-					usage.DeductCreditsOpenHands(username, billingCost, billingTokens, input, output)
+					usage.DeductCreditsOpenHands(username, requestIDFor(r), billingCost, billingTokens, input, output)
 					creditType = "openhands"
 					log.Printf("💳 [MainTarget] Billing upstream: OpenHands (creditsNew)")
 				} else {
 					// billing_upstream='ohmygpt' → DeductCreditsOhMyGPT() → credits field
-					usage.DeductCreditsOhMyGPT(username, billingCost, billingTokens, input, output)
+					usage.DeductCreditsOhMyGPT(username, requestIDFor(r), billingCost, billingTokens, input, output)
 					log.Printf("💳 [MainTarget] Billing upstream: OhMyGPT (credits)")
 				}
 				// Update Friend Key usage if applicable
-				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, modelID, billingCost)
+				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(r), modelID, billingCost)
 			}
 			latencyMs := time.Since(requestStartTime).Milliseconds()
 			usage.LogRequestDetailed(usage.RequestLogParams{
@@ -1187,6 +1448,12 @@ func handleMainTargetRequest(w http.ResponseWriter, openaiReq *transformers.Open
 				UserKeyID:        userApiKey,
 				TrollKeyID:       "main",
 				Model:            modelID,
+				FallbackHop:      tierFor(r).Hop,
+				Upstream:         tierFor(r).Upstream,
+				Experiment:       experimentFor(r).Experiment,
+				ExperimentArm:    experimentFor(r).Arm,
+				Hold:             holdFor(r),
+				RequestID:        requestIDFor(r),
 				InputTokens:      input,
 				OutputTokens:     output,
 				CacheWriteTokens: cacheWrite,
@@ -1196,6 +1463,8 @@ func handleMainTargetRequest(w http.ResponseWriter, openaiReq *transformers.Open
 				TokensUsed:       billingTokens,
 				StatusCode:       resp.StatusCode,
 				LatencyMs:        latencyMs,
+				IsBatch:          isBatch,
+				Cancelled:        cancelled,
 			})
 		}
 		log.Printf("📊 [MainTarget] Usage: in=%d out=%d cache_w=%d cache_h=%d cost=$%.6f", input, output, cacheWrite, cacheHit, billingCost)
@@ -1210,14 +1479,14 @@ func handleMainTargetRequest(w http.ResponseWriter, openaiReq *transformers.Open
 
 // handleMainTargetRequestOpenAI handles requests routed to main target with OpenAI format
 // Forwards OpenAI requests directly with model ID mapping
-func handleMainTargetRequestOpenAI(w http.ResponseWriter, openaiReq *transformers.OpenAIRequest, bodyBytes []byte, modelID string, userApiKey string, username string) {
-	if !maintarget.IsConfigured() {
+func handleMainTargetRequestOpenAI(w http.ResponseWriter, r *http.Request, target *maintarget.Target, openaiReq *transformers.OpenAIRequest, bodyBytes []byte, modelID string, userApiKey string, username string, isBatch bool) {
+	if !target.IsConfigured() {
 		http.Error(w, `{"error": {"message": "Main target not configured", "type": "server_error"}}`, http.StatusInternalServerError)
 		return
 	}
 
 	// Get upstream model ID (may be different from client-requested model ID)
-	upstreamModelID := config.GetUpstreamModelID(modelID)
+	upstreamModelID := upstreamModelIDFor(r, modelID)
 
 	// Prepare request body with mapped model ID
 	var requestBody []byte
@@ -1240,11 +1509,11 @@ func handleMainTargetRequestOpenAI(w http.ResponseWriter, openaiReq *transformer
 
 	isStreaming := openaiReq.Stream
 
-	log.Printf("📤 [MainTarget-OpenAI] Forwarding to %s/v1/chat/completions (model=%s, stream=%v)", maintarget.GetServerURL(), upstreamModelID, isStreaming)
+	log.Printf("📤 [MainTarget-OpenAI] Forwarding to %s/v1/chat/completions (model=%s, stream=%v)", target.GetServerURL(), upstreamModelID, isStreaming)
 
 	// Forward to main target with mapped model ID
 	requestStartTime := time.Now()
-	resp, err := maintarget.ForwardOpenAIRequest(requestBody, isStreaming)
+	resp, err := target.ForwardRequest(r.Context(), requestBody, isStreaming)
 	if err != nil {
 		log.Printf("❌ [MainTarget-OpenAI] Request failed after %v: %v", time.Since(requestStartTime), err)
 		http.Error(w, `{"error": {"message": "Request to main target failed", "type": "upstream_error"}}`, http.StatusBadGateway)
@@ -1254,15 +1523,21 @@ func handleMainTargetRequestOpenAI(w http.ResponseWriter, openaiReq *transformer
 
 	// Usage callback
 	onUsage := func(input, output, cacheWrite, cacheHit int64) {
-		billingTokens := config.CalculateBillingTokensWithCache(modelID, input, output, cacheWrite, cacheHit)
-		billingCost := calculateDiscountedBillingCost(modelID, upstreamModelID, input, output, cacheWrite, cacheHit)
+		// Cancelled streams end before the usage chunk: estimate the prompt instead
+		cancelled := transformers.ClientCancelled(resp)
+		if cancelled && input == 0 {
+			input = estimateInputTokens(openaiReq)
+		}
+
+		billingTokens := billingTokensFor(r, modelID, input, output, cacheWrite, cacheHit)
+		billingCost := calculateDiscountedBillingCostWithBatch(r, modelID, upstreamModelID, input, output, cacheWrite, cacheHit, isBatch)
 
 		if userApiKey != "" {
 			usage.UpdateUsage(userApiKey, billingTokens)
 			if username != "" {
-				usage.DeductCreditsWithTokens(username, billingCost, billingTokens, input, output)
+				usage.DeductCreditsWithTokens(username, requestIDFor(r), billingCost, billingTokens, input, output)
 				// Update Friend Key usage if applicable
-				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, modelID, billingCost)
+				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(r), modelID, billingCost)
 			}
 			latencyMs := time.Since(requestStartTime).Milliseconds()
 			usage.LogRequestDetailed(usage.RequestLogParams{
@@ -1270,6 +1545,12 @@ func handleMainTargetRequestOpenAI(w http.ResponseWriter, openaiReq *transformer
 				UserKeyID:        userApiKey,
 				TrollKeyID:       "main",
 				Model:            modelID,
+				FallbackHop:      tierFor(r).Hop,
+				Upstream:         tierFor(r).Upstream,
+				Experiment:       experimentFor(r).Experiment,
+				ExperimentArm:    experimentFor(r).Arm,
+				Hold:             holdFor(r),
+				RequestID:        requestIDFor(r),
 				InputTokens:      input,
 				OutputTokens:     output,
 				CacheWriteTokens: cacheWrite,
@@ -1279,6 +1560,8 @@ func handleMainTargetRequestOpenAI(w http.ResponseWriter, openaiReq *transformer
 				TokensUsed:       billingTokens,
 				StatusCode:       resp.StatusCode,
 				LatencyMs:        latencyMs,
+				IsBatch:          isBatch,
+				Cancelled:        cancelled,
 			})
 		}
 		log.Printf("📊 [MainTarget-OpenAI] Usage: in=%d out=%d cache_w=%d cache_h=%d cost=$%.6f", input, output, cacheWrite, cacheHit, billingCost)
@@ -1292,16 +1575,109 @@ func handleMainTargetRequestOpenAI(w http.ResponseWriter, openaiReq *transformer
 	}
 }
 
+// handleProviderOpenAIRequest handles /v1/chat/completions requests routed to an upstream type
+// without handlers of its own (openai_compat: Modal, vLLM, llama.cpp). Forwards the OpenAI
+// request with model ID mapping through the provider.Provider interface
+func handleProviderOpenAIRequest(w http.ResponseWriter, r *http.Request, upstream provider.Provider, openaiReq *transformers.OpenAIRequest, modelID string, userApiKey string, username string, isBatch bool) {
+	if !upstream.IsConfigured() {
+		http.Error(w, `{"error": {"message": "Service not configured", "type": "server_error"}}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Get upstream model ID (may be different from client-requested model ID)
+	upstreamModelID := upstreamModelIDFor(r, modelID)
+	openaiReq.Model = upstreamModelID
+	if upstreamModelID != modelID {
+		log.Printf("🔀 [OpenAI-Compat] Model mapping: %s -> %s", modelID, upstreamModelID)
+	}
+
+	requestBody, err := json.Marshal(openaiReq)
+	if err != nil {
+		log.Printf("❌ [OpenAI-Compat] Failed to serialize request: %v", err)
+		http.Error(w, `{"error": {"message": "Failed to serialize request", "type": "server_error"}}`, http.StatusInternalServerError)
+		return
+	}
+
+	isStreaming := openaiReq.Stream
+	log.Printf("📤 [OpenAI-Compat] Forwarding /v1/chat/completions (upstream=%s, type=%s, model=%s, stream=%v)", upstream.Name(), upstream.Type(), upstreamModelID, isStreaming)
+
+	requestStartTime := time.Now()
+	resp, err := upstream.ForwardRequest(r.Context(), requestBody, isStreaming)
+	if err != nil {
+		log.Printf("❌ [OpenAI-Compat] Request failed after %v: %v", time.Since(requestStartTime), err)
+		http.Error(w, `{"error": {"message": "Request to upstream service failed", "type": "upstream_error"}}`, http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Usage callback for billing and logging
+	onUsage := func(input, output, cacheWrite, cacheHit int64) {
+		// Servers without a usage chunk (and cancelled streams) report no prompt tokens: estimate them
+		cancelled := transformers.ClientCancelled(resp)
+		if input == 0 {
+			input = estimateInputTokens(openaiReq)
+		}
+
+		billingTokens := billingTokensFor(r, modelID, input, output, cacheWrite, cacheHit)
+		billingCost := calculateDiscountedBillingCostWithBatch(r, modelID, upstreamModelID, input, output, cacheWrite, cacheHit, isBatch)
+
+		if userApiKey != "" {
+			usage.UpdateUsage(userApiKey, billingTokens)
+			creditType := "ohmygpt" // Default
+			if username != "" {
+				if config.GetModelBillingUpstream(modelID) == "openhands" {
+					usage.DeductCreditsOpenHands(username, requestIDFor(r), billingCost, billingTokens, input, output)
+					creditType = "openhands"
+				} else {
+					usage.DeductCreditsOhMyGPT(username, requestIDFor(r), billingCost, billingTokens, input, output)
+				}
+				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(r), modelID, billingCost)
+			}
+			latencyMs := time.Since(requestStartTime).Milliseconds()
+			usage.LogRequestDetailed(usage.RequestLogParams{
+				UserID:           username,
+				UserKeyID:        userApiKey,
+				TrollKeyID:       upstream.Name(),
+				Model:            modelID,
+				FallbackHop:      tierFor(r).Hop,
+				Upstream:         tierFor(r).Upstream,
+				Experiment:       experimentFor(r).Experiment,
+				ExperimentArm:    experimentFor(r).Arm,
+				Hold:             holdFor(r),
+				RequestID:        requestIDFor(r),
+				InputTokens:      input,
+				OutputTokens:     output,
+				CacheWriteTokens: cacheWrite,
+				CacheHitTokens:   cacheHit,
+				CreditsCost:      billingCost,
+				CreditType:       creditType,
+				TokensUsed:       billingTokens,
+				StatusCode:       resp.StatusCode,
+				LatencyMs:        latencyMs,
+				IsBatch:          isBatch,
+				Cancelled:        cancelled,
+			})
+		}
+		log.Printf("📊 [OpenAI-Compat] Usage: model=%s in=%d out=%d cache_hit=%d cost=$%.6f", modelID, input, output, cacheHit, billingCost)
+	}
+
+	if isStreaming {
+		upstream.HandleStreamResponse(w, resp, modelID, onUsage)
+	} else {
+		upstream.HandleNonStreamResponse(w, resp, modelID, onUsage)
+	}
+}
+
 // handleMainTargetMessagesRequest handles /v1/messages requests routed to main target
 // Forwards the original Anthropic request with model ID mapping
-func handleMainTargetMessagesRequest(w http.ResponseWriter, originalBody []byte, isStreaming bool, modelID string, userApiKey string, username string) {
-	if !maintarget.IsConfigured() {
+func handleMainTargetMessagesRequest(w http.ResponseWriter, r *http.Request, target *maintarget.Target, originalBody []byte, isStreaming bool, modelID string, userApiKey string, username string, isBatch bool) {
+	if !target.IsConfigured() {
 		http.Error(w, `{"type":"error","error":{"type":"api_error","message":"Main target not configured"}}`, http.StatusInternalServerError)
 		return
 	}
 
 	// Get upstream model ID (may be different from client-requested model ID)
-	upstreamModelID := config.GetUpstreamModelID(modelID)
+	upstreamModelID := upstreamModelIDFor(r, modelID)
 
 	// Prepare request body with mapped model ID
 	var requestBody []byte
@@ -1323,11 +1699,11 @@ func handleMainTargetMessagesRequest(w http.ResponseWriter, originalBody []byte,
 		requestBody = originalBody
 	}
 
-	log.Printf("📤 [MainTarget] Forwarding /v1/messages to %s (model=%s, stream=%v)", maintarget.GetServerURL(), upstreamModelID, isStreaming)
+	log.Printf("📤 [MainTarget] Forwarding /v1/messages to %s (model=%s, stream=%v)", target.GetServerURL(), upstreamModelID, isStreaming)
 
 	// Forward request body with mapped model ID
 	requestStartTime := time.Now()
-	resp, err := maintarget.ForwardRequest(requestBody, isStreaming)
+	resp, err := target.ForwardMessagesRequest(r.Context(), requestBody, isStreaming)
 	if err != nil {
 		log.Printf("❌ [MainTarget] Request failed after %v: %v", time.Since(requestStartTime), err)
 		http.Error(w, `{"type":"error","error":{"type":"api_error","message":"Request to main target failed"}}`, http.StatusBadGateway)
@@ -1337,15 +1713,15 @@ func handleMainTargetMessagesRequest(w http.ResponseWriter, originalBody []byte,
 
 	// Usage callback
 	onUsage := func(input, output, cacheWrite, cacheHit int64) {
-		billingTokens := config.CalculateBillingTokensWithCache(modelID, input, output, cacheWrite, cacheHit)
-		billingCost := calculateDiscountedBillingCost(modelID, upstreamModelID, input, output, cacheWrite, cacheHit)
+		billingTokens := billingTokensFor(r, modelID, input, output, cacheWrite, cacheHit)
+		billingCost := calculateDiscountedBillingCostWithBatch(r, modelID, upstreamModelID, input, output, cacheWrite, cacheHit, isBatch)
 
 		if userApiKey != "" {
 			usage.UpdateUsage(userApiKey, billingTokens)
 			if username != "" {
-				usage.DeductCreditsWithCache(username, billingCost, billingTokens, input, output, cacheWrite, cacheHit)
+				usage.DeductCreditsWithCache(username, requestIDFor(r), billingCost, billingTokens, input, output, cacheWrite, cacheHit)
 				// Update Friend Key usage if applicable
-				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, modelID, billingCost)
+				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(r), modelID, billingCost)
 			}
 			latencyMs := time.Since(requestStartTime).Milliseconds()
 			usage.LogRequestDetailed(usage.RequestLogParams{
@@ -1353,6 +1729,12 @@ func handleMainTargetMessagesRequest(w http.ResponseWriter, originalBody []byte,
 				UserKeyID:        userApiKey,
 				TrollKeyID:       "main",
 				Model:            modelID,
+				FallbackHop:      tierFor(r).Hop,
+				Upstream:         tierFor(r).Upstream,
+				Experiment:       experimentFor(r).Experiment,
+				ExperimentArm:    experimentFor(r).Arm,
+				Hold:             holdFor(r),
+				RequestID:        requestIDFor(r),
 				InputTokens:      input,
 				OutputTokens:     output,
 				CacheWriteTokens: cacheWrite,
@@ -1362,6 +1744,8 @@ func handleMainTargetMessagesRequest(w http.ResponseWriter, originalBody []byte,
 				TokensUsed:       billingTokens,
 				StatusCode:       resp.StatusCode,
 				LatencyMs:        latencyMs,
+				IsBatch:          isBatch,
+				Cancelled:        transformers.ClientCancelled(resp),
 			})
 		}
 		log.Printf("📊 [MainTarget] Usage: in=%d out=%d cacheW=%d cacheH=%d cost=$%.6f", input, output, cacheWrite, cacheHit, billingCost)
@@ -1377,21 +1761,12 @@ func handleMainTargetMessagesRequest(w http.ResponseWriter, originalBody []byte,
 
 // handleOpenHandsMessagesRequest handles /v1/messages requests routed to OpenHands LLM Proxy
 // Forwards Anthropic format request to OpenHands /v1/messages endpoint
-func handleOpenHandsMessagesRequest(w http.ResponseWriter, originalBody []byte, isStreaming bool, modelID string, userApiKey string, username string) {
-	openhandsPool := openhandspool.GetPool()
-	if openhandsPool == nil || openhandsPool.GetKeyCount() == 0 {
+func handleOpenHandsMessagesRequest(w http.ResponseWriter, r *http.Request, openhandsProvider *openhands.OpenHandsProvider, originalBody []byte, isStreaming bool, modelID string, userApiKey string, username string, isBatch bool) {
+	if !openhandsProvider.IsConfigured() {
 		http.Error(w, `{"type":"error","error":{"type":"api_error","message":"Service not configured"}}`, http.StatusInternalServerError)
 		return
 	}
 
-	// Select a key from the pool
-	key, err := openhandsPool.SelectKey()
-	if err != nil {
-		log.Printf("❌ [Troll-LLM] No healthy keys available: %v", err)
-		http.Error(w, `{"type":"error","error":{"type":"api_error","message":"Service temporarily unavailable. Please try again later."}}`, http.StatusServiceUnavailable)
-		return
-	}
-
 	// Parse request to inject system prompt
 	var anthropicReq transformers.AnthropicRequest
 	if err := json.Unmarshal(originalBody, &anthropicReq); err != nil {
@@ -1404,7 +1779,7 @@ func handleOpenHandsMessagesRequest(w http.ResponseWriter, originalBody []byte,
 	anthropicReq.Messages = sanitizeAnthropicMessages(anthropicReq.Messages)
 
 	// Get upstream model ID (may be different from client-requested model ID)
-	upstreamModelID := config.GetUpstreamModelID(modelID)
+	upstreamModelID := upstreamModelIDFor(r, modelID)
 	anthropicReq.Model = upstreamModelID
 
 	// Claude/Anthropic doesn't allow both temperature and top_p
@@ -1516,7 +1891,7 @@ func handleOpenHandsMessagesRequest(w http.ResponseWriter, originalBody []byte,
 	if username != "" {
 		// Estimate input tokens for cost calculation
 		estimatedInputTokens := estimateAnthropicInputTokens(&anthropicReq)
-		estimatedCost := calculateDiscountedBillingCost(modelID, upstreamModelID, estimatedInputTokens, 0, 0, 0)
+		estimatedCost := calculateDiscountedBillingCost(r, modelID, upstreamModelID, estimatedInputTokens, 0, 0, 0)
 
 		// Check which credit field to use based on billing_upstream
 		billingUpstream := config.GetModelBillingUpstream(modelID)
@@ -1553,117 +1928,41 @@ func handleOpenHandsMessagesRequest(w http.ResponseWriter, originalBody []byte,
 		log.Printf("✅ [Pre-Check] [%s] Balance OK: estimated=$%.6f, balance=$%.6f (field=%s)", username, estimatedCost, totalBalance, billingUpstream)
 	}
 
-	apiKeyPreview := key.APIKey
-	if len(apiKeyPreview) > 12 {
-		apiKeyPreview = apiKeyPreview[:12] + "..."
-	}
-	log.Printf("📤 [OpenHands-Anthropic] Forwarding /v1/messages (model=%s, stream=%v, key=%s, apiKey=%s)", upstreamModelID, isStreaming, key.ID, apiKeyPreview)
+	log.Printf("📤 [OpenHands-Anthropic] Forwarding /v1/messages (model=%s, stream=%v)", upstreamModelID, isStreaming)
 
-	// Create HTTP request
-	req, err := http.NewRequest(http.MethodPost, "https://llm-proxy.app.all-hands.dev/v1/messages", bytes.NewBuffer(requestBody))
-	if err != nil {
-		log.Printf("❌ [Troll-LLM] Failed to create request: %v", err)
-		http.Error(w, `{"type":"error","error":{"type":"api_error","message":"Request creation failed"}}`, http.StatusInternalServerError)
-		return
-	}
-
-	// Set headers - mimic standard API client
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+key.APIKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("User-Agent", "Anthropic/v1 GoProxy/1.0")
-	log.Printf("🔑 [OpenHands-Anthropic] Using Authorization: Bearer %s", apiKeyPreview)
-
-	// Send request
-	log.Printf("🌐 [OpenHands-Anthropic] Sending request to: %s", req.URL.String())
+	// Forward with key rotation: key errors move the request to the next key, streams
+	// included, before anything is written to the client
 	requestStartTime := time.Now()
-	resp, err := httpClient.Do(req)
-	elapsed := time.Since(requestStartTime)
+	resp, key, err := openhandsProvider.Forward(r.Context(), openhandsProvider.MessagesEndpoint(), requestBody, isStreaming)
 	if err != nil {
-		log.Printf("❌ [Troll-LLM] Request failed after %v: %v", elapsed, err)
+		log.Printf("❌ [Troll-LLM] Request failed after %v: %v", time.Since(requestStartTime), err)
+		if errors.Is(err, openhands.ErrNoKeys) {
+			http.Error(w, `{"type":"error","error":{"type":"api_error","message":"Service temporarily unavailable. Please try again later."}}`, http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, `{"type":"error","error":{"type":"api_error","message":"Request to upstream service failed"}}`, http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
-	log.Printf("📥 [OpenHands-Anthropic] Response received in %v, status=%d", elapsed, resp.StatusCode)
+	log.Printf("📥 [OpenHands-Anthropic] Response received in %v, status=%d, key=%s", time.Since(requestStartTime), resp.StatusCode, key.ID)
 
-	// Check for errors and handle key rotation
+	// Return remaining errors sanitized to client
 	if resp.StatusCode >= 400 {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		errorBody := string(bodyBytes)
-		log.Printf("⚠️ [Troll-LLM] Error response (status=%d, key=%s): %s", resp.StatusCode, key.ID, truncateErrorLog(errorBody, 300))
-
-		// Check if this is a rotatable error (budget exceeded, auth error, etc.)
-		isBudgetExceeded := strings.Contains(errorBody, "ExceededBudget") ||
-			strings.Contains(strings.ToLower(errorBody), "budget_exceeded") ||
-			strings.Contains(strings.ToLower(errorBody), "over budget")
-		isAuthError := resp.StatusCode == 401 || resp.StatusCode == 403 || resp.StatusCode == 402
-
-		if isBudgetExceeded || isAuthError {
-			// Rotate the key
-			openhandsPool.CheckAndRotateOnError(key.ID, resp.StatusCode, errorBody)
-
-			// For non-streaming requests, retry with new key
-			if !isStreaming {
-				newKey, retryErr := openhandsPool.SelectKey()
-				if retryErr == nil && newKey.ID != key.ID {
-					log.Printf("🔄 [Troll-LLM] Retrying with new key: %s", newKey.ID)
-
-					// Create new request with new key
-					retryReq, _ := http.NewRequest(http.MethodPost, "https://llm-proxy.app.all-hands.dev/v1/messages", bytes.NewBuffer(requestBody))
-					retryReq.Header.Set("Content-Type", "application/json")
-					retryReq.Header.Set("Authorization", "Bearer "+newKey.APIKey)
-					retryReq.Header.Set("anthropic-version", "2023-06-01")
-
-					retryResp, retryDoErr := httpClient.Do(retryReq)
-					if retryDoErr == nil {
-						defer retryResp.Body.Close()
-						if retryResp.StatusCode < 400 {
-							// Success! Update key for billing and continue to response handling
-							key = newKey
-							resp = retryResp
-							log.Printf("✅ [Troll-LLM] Retry successful with key: %s", newKey.ID)
-							goto handleMessagesResponse
-						}
-						// Retry also failed
-						retryBody, _ := io.ReadAll(retryResp.Body)
-						log.Printf("❌ [Troll-LLM] Retry also failed (status=%d): %s", retryResp.StatusCode, string(retryBody))
-						w.Header().Set("Content-Type", "application/json")
-						w.WriteHeader(retryResp.StatusCode)
-						w.Write(openhands.SanitizeAnthropicError(retryResp.StatusCode, retryBody))
-						return
-					}
-				}
-			}
-		}
-
-		// Return sanitized error to client
+		log.Printf("⚠️ [Troll-LLM] Error response (status=%d, key=%s): %s", resp.StatusCode, key.ID, truncateErrorLog(string(bodyBytes), 300))
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(resp.StatusCode)
 		w.Write(openhands.SanitizeAnthropicError(resp.StatusCode, bodyBytes))
 		return
 	}
 
-handleMessagesResponse:
-
 	// Usage callback for billing (with cache support)
 	onUsage := func(input, output, cacheWrite, cacheHit int64) {
-		billingTokens := config.CalculateBillingTokensWithCache(modelID, input, output, cacheWrite, cacheHit)
-		billingCost := calculateDiscountedBillingCost(modelID, upstreamModelID, input, output, cacheWrite, cacheHit)
+		billingTokens := billingTokensFor(r, modelID, input, output, cacheWrite, cacheHit)
+		billingCost := calculateDiscountedBillingCostWithBatch(r, modelID, upstreamModelID, input, output, cacheWrite, cacheHit, isBatch)
 
 		// Update OpenHands key usage stats in MongoDB
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		db.OpenHandsKeysCollection().UpdateByID(ctx, key.ID, bson.M{
-			"$inc": bson.M{
-				"tokensUsed":    input + output,
-				"requestsCount": 1,
-			},
-			"$set": bson.M{
-				"lastUsedAt": time.Now(),
-			},
-		})
+		openhandsProvider.UpdateKeyUsage(key.ID, input, output)
 
 		if userApiKey != "" {
 			usage.UpdateUsage(userApiKey, billingTokens)
@@ -1673,19 +1972,25 @@ handleMessagesResponse:
 				// Even though this is OpenHands upstream, billing field depends on config
 				billingUpstream := config.GetModelBillingUpstream(modelID)
 				if billingUpstream == "openhands" {
-					usage.DeductCreditsOpenHands(username, billingCost, billingTokens, input, output)
+					usage.DeductCreditsOpenHands(username, requestIDFor(r), billingCost, billingTokens, input, output)
 					creditType = "openhands"
 				} else {
-					usage.DeductCreditsOhMyGPT(username, billingCost, billingTokens, input, output)
+					usage.DeductCreditsOhMyGPT(username, requestIDFor(r), billingCost, billingTokens, input, output)
 				}
-				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, modelID, billingCost)
+				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(r), modelID, billingCost)
 			}
 			latencyMs := time.Since(requestStartTime).Milliseconds()
 			usage.LogRequestDetailed(usage.RequestLogParams{
 				UserID:           username,
 				UserKeyID:        userApiKey,
-				TrollKeyID:       "openhands:" + key.ID,
+				TrollKeyID:       openhandsProvider.Name() + ":" + key.ID,
 				Model:            modelID,
+				FallbackHop:      tierFor(r).Hop,
+				Upstream:         tierFor(r).Upstream,
+				Experiment:       experimentFor(r).Experiment,
+				ExperimentArm:    experimentFor(r).Arm,
+				Hold:             holdFor(r),
+				RequestID:        requestIDFor(r),
 				InputTokens:      input,
 				OutputTokens:     output,
 				CacheWriteTokens: cacheWrite,
@@ -1695,6 +2000,8 @@ handleMessagesResponse:
 				TokensUsed:       billingTokens,
 				StatusCode:       resp.StatusCode,
 				LatencyMs:        latencyMs,
+				IsBatch:          isBatch,
+				Cancelled:        transformers.ClientCancelled(resp),
 			})
 		}
 		// Get remaining creditsNew for logging (OpenHands uses creditsNew)
@@ -1717,23 +2024,14 @@ handleMessagesResponse:
 
 // handleOpenHandsOpenAIRequest handles /v1/chat/completions requests routed to OpenHands
 // Forwards OpenAI format request to OpenHands /v1/chat/completions endpoint
-func handleOpenHandsOpenAIRequest(w http.ResponseWriter, openaiReq *transformers.OpenAIRequest, bodyBytes []byte, modelID string, userApiKey string, username string) {
-	openhandsPool := openhandspool.GetPool()
-	if openhandsPool == nil || openhandsPool.GetKeyCount() == 0 {
+func handleOpenHandsOpenAIRequest(w http.ResponseWriter, r *http.Request, openhandsProvider *openhands.OpenHandsProvider, openaiReq *transformers.OpenAIRequest, bodyBytes []byte, modelID string, userApiKey string, username string, isBatch bool) {
+	if !openhandsProvider.IsConfigured() {
 		http.Error(w, `{"error": {"message": "Service not configured", "type": "server_error"}}`, http.StatusInternalServerError)
 		return
 	}
 
-	// Select a key from the pool
-	key, err := openhandsPool.SelectKey()
-	if err != nil {
-		log.Printf("❌ [Troll-LLM] No healthy keys available: %v", err)
-		http.Error(w, `{"error": {"message": "Service temporarily unavailable. Please try again later.", "type": "server_error"}}`, http.StatusServiceUnavailable)
-		return
-	}
-
 	// Get upstream model ID and inject system prompt
-	upstreamModelID := config.GetUpstreamModelID(modelID)
+	upstreamModelID := upstreamModelIDFor(r, modelID)
 	openaiReq.Model = upstreamModelID
 
 	// Fix tool-related issues for Anthropic/Claude models
@@ -1843,7 +2141,7 @@ func handleOpenHandsOpenAIRequest(w http.ResponseWriter, openaiReq *transformers
 	if username != "" {
 		// Estimate input tokens for cost calculation
 		estimatedInputTokens := estimateInputTokens(openaiReq)
-		estimatedCost := calculateDiscountedBillingCost(modelID, upstreamModelID, estimatedInputTokens, 0, 0, 0)
+		estimatedCost := calculateDiscountedBillingCost(r, modelID, upstreamModelID, estimatedInputTokens, 0, 0, 0)
 
 		// Check which credit field to use based on billing_upstream
 		billingUpstream := config.GetModelBillingUpstream(modelID)
@@ -1881,115 +2179,41 @@ func handleOpenHandsOpenAIRequest(w http.ResponseWriter, openaiReq *transformers
 	}
 
 	isStreaming := openaiReq.Stream
-	apiKeyPreview := key.APIKey
-	if len(apiKeyPreview) > 12 {
-		apiKeyPreview = apiKeyPreview[:12] + "..."
-	}
-	log.Printf("📤 [OpenHands-OpenAI] Forwarding /v1/chat/completions (model=%s, stream=%v, key=%s, apiKey=%s)", upstreamModelID, isStreaming, key.ID, apiKeyPreview)
+	log.Printf("📤 [OpenHands-OpenAI] Forwarding /v1/chat/completions (model=%s, stream=%v)", upstreamModelID, isStreaming)
 
-	// Create HTTP request
-	req, err := http.NewRequest(http.MethodPost, "https://llm-proxy.app.all-hands.dev/v1/chat/completions", bytes.NewBuffer(requestBody))
-	if err != nil {
-		log.Printf("❌ [Troll-LLM] Failed to create request: %v", err)
-		http.Error(w, `{"error": {"message": "Request creation failed", "type": "server_error"}}`, http.StatusInternalServerError)
-		return
-	}
-
-	// Set headers - mimic standard API client
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+key.APIKey)
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("User-Agent", "OpenAI/v1 GoProxy/1.0")
-	log.Printf("🔑 [OpenHands-OpenAI] Using Authorization: Bearer %s", apiKeyPreview)
-
-	// Send request
-	log.Printf("🌐 [OpenHands-OpenAI] Sending request to: %s", req.URL.String())
+	// Forward with key rotation: key errors move the request to the next key, streams
+	// included, before anything is written to the client
 	requestStartTime := time.Now()
-	resp, err := httpClient.Do(req)
-	elapsed := time.Since(requestStartTime)
+	resp, key, err := openhandsProvider.Forward(r.Context(), openhandsProvider.CompletionsEndpoint(), requestBody, isStreaming)
 	if err != nil {
-		log.Printf("❌ [Troll-LLM] Request failed after %v: %v", elapsed, err)
+		log.Printf("❌ [OpenHands-OpenAI] Request failed after %v: %v", time.Since(requestStartTime), err)
+		if errors.Is(err, openhands.ErrNoKeys) {
+			http.Error(w, `{"error": {"message": "Service temporarily unavailable. Please try again later.", "type": "server_error"}}`, http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, `{"error": {"message": "Request to upstream service failed", "type": "upstream_error"}}`, http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
-	log.Printf("📥 [OpenHands-OpenAI] Response received in %v, status=%d", elapsed, resp.StatusCode)
+	log.Printf("📥 [OpenHands-OpenAI] Response received in %v, status=%d, key=%s", time.Since(requestStartTime), resp.StatusCode, key.ID)
 
-	// Check for errors and handle key rotation
+	// Return remaining errors sanitized to client
 	if resp.StatusCode >= 400 {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		errorBody := string(bodyBytes)
-		log.Printf("⚠️ [Troll-LLM] Error response (status=%d, key=%s): %s", resp.StatusCode, key.ID, truncateErrorLog(errorBody, 300))
-
-		// Check if this is a rotatable error (budget exceeded, auth error, etc.)
-		isBudgetExceeded := strings.Contains(errorBody, "ExceededBudget") ||
-			strings.Contains(strings.ToLower(errorBody), "budget_exceeded") ||
-			strings.Contains(strings.ToLower(errorBody), "over budget")
-		isAuthError := resp.StatusCode == 401 || resp.StatusCode == 403 || resp.StatusCode == 402
-
-		if isBudgetExceeded || isAuthError {
-			// Rotate the key
-			openhandsPool.CheckAndRotateOnError(key.ID, resp.StatusCode, errorBody)
-
-			// For non-streaming requests, retry with new key
-			if !isStreaming {
-				newKey, retryErr := openhandsPool.SelectKey()
-				if retryErr == nil && newKey.ID != key.ID {
-					log.Printf("🔄 [OpenHands-OpenAI] Retrying with new key: %s", newKey.ID)
-
-					// Create new request with new key
-					retryReq, _ := http.NewRequest(http.MethodPost, "https://llm-proxy.app.all-hands.dev/v1/chat/completions", bytes.NewBuffer(requestBody))
-					retryReq.Header.Set("Content-Type", "application/json")
-					retryReq.Header.Set("Authorization", "Bearer "+newKey.APIKey)
-
-					retryResp, retryDoErr := httpClient.Do(retryReq)
-					if retryDoErr == nil {
-						defer retryResp.Body.Close()
-						if retryResp.StatusCode < 400 {
-							// Success! Update key for billing and continue to response handling
-							key = newKey
-							resp = retryResp
-							log.Printf("✅ [OpenHands-OpenAI] Retry successful with key: %s", newKey.ID)
-							goto handleOpenAIResponse
-						}
-						// Retry also failed
-						retryBody, _ := io.ReadAll(retryResp.Body)
-						log.Printf("❌ [OpenHands-OpenAI] Retry also failed (status=%d): %s", retryResp.StatusCode, string(retryBody))
-						w.Header().Set("Content-Type", "application/json")
-						w.WriteHeader(retryResp.StatusCode)
-						w.Write(openhands.SanitizeError(retryResp.StatusCode, retryBody))
-						return
-					}
-				}
-			}
-		}
-
-		// Return sanitized error to client
+		log.Printf("⚠️ [OpenHands-OpenAI] Error response (status=%d, key=%s): %s", resp.StatusCode, key.ID, truncateErrorLog(string(bodyBytes), 300))
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(resp.StatusCode)
 		w.Write(openhands.SanitizeError(resp.StatusCode, bodyBytes))
 		return
 	}
 
-handleOpenAIResponse:
-
 	// Usage callback for billing (with cache support)
 	onUsage := func(input, output, cacheWrite, cacheHit int64) {
-		billingTokens := config.CalculateBillingTokensWithCache(modelID, input, output, cacheWrite, cacheHit)
-		billingCost := calculateDiscountedBillingCost(modelID, upstreamModelID, input, output, cacheWrite, cacheHit)
+		billingTokens := billingTokensFor(r, modelID, input, output, cacheWrite, cacheHit)
+		billingCost := calculateDiscountedBillingCostWithBatch(r, modelID, upstreamModelID, input, output, cacheWrite, cacheHit, isBatch)
 
 		// Update OpenHands key usage stats in MongoDB
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		db.OpenHandsKeysCollection().UpdateByID(ctx, key.ID, bson.M{
-			"$inc": bson.M{
-				"tokensUsed":    input + output,
-				"requestsCount": 1,
-			},
-			"$set": bson.M{
-				"lastUsedAt": time.Now(),
-			},
-		})
+		openhandsProvider.UpdateKeyUsage(key.ID, input, output)
 
 		if userApiKey != "" {
 			usage.UpdateUsage(userApiKey, billingTokens)
@@ -1999,19 +2223,25 @@ handleOpenAIResponse:
 				// Even though this is OpenHands upstream, billing field depends on config
 				billingUpstream := config.GetModelBillingUpstream(modelID)
 				if billingUpstream == "openhands" {
-					usage.DeductCreditsOpenHands(username, billingCost, billingTokens, input, output)
+					usage.DeductCreditsOpenHands(username, requestIDFor(r), billingCost, billingTokens, input, output)
 					creditType = "openhands"
 				} else {
-					usage.DeductCreditsOhMyGPT(username, billingCost, billingTokens, input, output)
+					usage.DeductCreditsOhMyGPT(username, requestIDFor(r), billingCost, billingTokens, input, output)
 				}
-				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, modelID, billingCost)
+				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(r), modelID, billingCost)
 			}
 			latencyMs := time.Since(requestStartTime).Milliseconds()
 			usage.LogRequestDetailed(usage.RequestLogParams{
 				UserID:           username,
 				UserKeyID:        userApiKey,
-				TrollKeyID:       "openhands:" + key.ID,
+				TrollKeyID:       openhandsProvider.Name() + ":" + key.ID,
 				Model:            modelID,
+				FallbackHop:      tierFor(r).Hop,
+				Upstream:         tierFor(r).Upstream,
+				Experiment:       experimentFor(r).Experiment,
+				ExperimentArm:    experimentFor(r).Arm,
+				Hold:             holdFor(r),
+				RequestID:        requestIDFor(r),
 				InputTokens:      input,
 				OutputTokens:     output,
 				CacheWriteTokens: cacheWrite,
@@ -2021,6 +2251,8 @@ handleOpenAIResponse:
 				TokensUsed:       billingTokens,
 				StatusCode:       resp.StatusCode,
 				LatencyMs:        latencyMs,
+				IsBatch:          isBatch,
+				Cancelled:        transformers.ClientCancelled(resp),
 			})
 		}
 		// Get remaining creditsNew for logging (OpenHands uses creditsNew)
@@ -2045,8 +2277,13 @@ handleOpenAIResponse:
 	}
 }
 
-func calculateDiscountedBillingCost(modelID string, upstreamModelID string, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64) float64 {
-	billingCost := config.CalculateBillingCostWithCache(modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
+func calculateDiscountedBillingCost(r *http.Request, modelID string, upstreamModelID string, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64) float64 {
+	return calculateDiscountedBillingCostWithBatch(r, modelID, upstreamModelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens, false)
+}
+
+// calculateDiscountedBillingCostWithBatch is calculateDiscountedBillingCost with optional batch pricing
+func calculateDiscountedBillingCostWithBatch(r *http.Request, modelID string, upstreamModelID string, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens int64, isBatch bool) float64 {
+	billingCost := billingCostFor(r, modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens, isBatch)
 	discountedCost := config.ApplyPriorityGLMDiscount(modelID, upstreamModelID, billingCost)
 
 	if discountedCost < billingCost {
@@ -2057,75 +2294,15 @@ func calculateDiscountedBillingCost(modelID string, upstreamModelID string, inpu
 }
 
 // estimateInputTokens estimates input tokens from OpenAI request
-// Uses rough estimation: 1 token ≈ 4 characters
+// Uses the model's BPE tokenizer (config.Model.Tokenizer), including tool schemas and images
 func estimateInputTokens(req *transformers.OpenAIRequest) int64 {
-	var totalChars int64
-
-	// Count characters in all messages
-	for _, msg := range req.Messages {
-		// Add role chars
-		totalChars += int64(len(msg.Role))
-
-		// Add content chars
-		if content, ok := msg.Content.(string); ok {
-			totalChars += int64(len(content))
-		}
-	}
-
-	// Rough estimation: 1 token ≈ 4 chars
-	estimatedTokens := totalChars / 4
-
-	// Add overhead for message structure (rough estimate)
-	estimatedTokens += int64(len(req.Messages) * 4)
-
-	return estimatedTokens
+	return transformers.EstimateOpenAITokens(req)
 }
 
 // estimateAnthropicInputTokens estimates input tokens for Anthropic requests
+// Uses the model's BPE tokenizer (config.Model.Tokenizer), including tool schemas and images
 func estimateAnthropicInputTokens(req *transformers.AnthropicRequest) int64 {
-	var totalChars int64
-
-	// Count system prompt chars
-	if req.System != nil {
-		if systemArray, ok := req.System.([]interface{}); ok {
-			for _, item := range systemArray {
-				if itemMap, ok := item.(map[string]interface{}); ok {
-					if text, ok := itemMap["text"].(string); ok {
-						totalChars += int64(len(text))
-					}
-				}
-			}
-		} else if systemStr, ok := req.System.(string); ok {
-			totalChars += int64(len(systemStr))
-		}
-	}
-
-	// Count characters in all messages
-	for _, msg := range req.Messages {
-		// Add role chars
-		totalChars += int64(len(msg.Role))
-
-		// Add content chars (can be string or array)
-		if content, ok := msg.Content.(string); ok {
-			totalChars += int64(len(content))
-		} else if contentArray, ok := msg.Content.([]interface{}); ok {
-			for _, item := range contentArray {
-				if itemMap, ok := item.(map[string]interface{}); ok {
-					if text, ok := itemMap["text"].(string); ok {
-						totalChars += int64(len(text))
-					}
-				}
-			}
-		}
-	}
-
-	// Rough estimation: 1 token ≈ 4 chars
-	estimatedTokens := totalChars / 4
-
-	// Add overhead for message structure (rough estimate)
-	estimatedTokens += int64(len(req.Messages) * 4)
-
-	return estimatedTokens
+	return transformers.EstimateAnthropicTokens(req)
 }
 
 // handleOpenHandsOpenAIStreamResponse handles OpenHands streaming response with proper logging
@@ -2162,15 +2339,14 @@ func handleOpenHandsOpenAINonStreamResponse(w http.ResponseWriter, resp *http.Re
 }
 
 // handleOhMyGPTOpenAIRequest handles /v1/chat/completions requests routed to OhMyGPT
-func handleOhMyGPTOpenAIRequest(w http.ResponseWriter, openaiReq *transformers.OpenAIRequest, bodyBytes []byte, modelID string, userApiKey string, username string) {
-	ohmygptProvider := ohmygpt.GetOhMyGPT()
-	if ohmygptProvider == nil || !ohmygptProvider.IsConfigured() {
+func handleOhMyGPTOpenAIRequest(w http.ResponseWriter, r *http.Request, ohmygptProvider *ohmygpt.OhMyGPTProvider, openaiReq *transformers.OpenAIRequest, bodyBytes []byte, modelID string, userApiKey string, username string, isBatch bool) {
+	if !ohmygptProvider.IsConfigured() {
 		http.Error(w, `{"error": {"message": "Service not configured", "type": "server_error"}}`, http.StatusInternalServerError)
 		return
 	}
 
 	// Get upstream model ID and inject system prompt
-	upstreamModelID := config.GetUpstreamModelID(modelID)
+	upstreamModelID := upstreamModelIDFor(r, modelID)
 	openaiReq.Model = upstreamModelID
 
 	// Serialize request
@@ -2188,7 +2364,7 @@ func handleOhMyGPTOpenAIRequest(w http.ResponseWriter, openaiReq *transformers.O
 	requestStartTime := time.Now()
 
 	// Forward request using OhMyGPT provider
-	resp, err := ohmygptProvider.ForwardRequest(requestBody, isStreaming)
+	resp, err := ohmygptProvider.ForwardRequest(r.Context(), requestBody, isStreaming)
 	if err != nil {
 		log.Printf("❌ [OhMyGPT-OpenAI] Request failed after %v: %v", time.Since(requestStartTime), err)
 		http.Error(w, `{"error": {"message": "Request to upstream service failed", "type": "upstream_error"}}`, http.StatusBadGateway)
@@ -2198,29 +2374,28 @@ func handleOhMyGPTOpenAIRequest(w http.ResponseWriter, openaiReq *transformers.O
 
 	// Usage callback for billing and logging
 	onUsage := func(input, output, cacheWrite, cacheHit int64) {
-		billingTokens := config.CalculateBillingTokensWithCache(modelID, input, output, cacheWrite, cacheHit)
-		billingCost := config.CalculateBillingCostWithCache(modelID, input, output, cacheWrite, cacheHit)
+		// Cancelled streams end before the usage chunk: estimate the prompt instead
+		cancelled := transformers.ClientCancelled(resp)
+		if cancelled && input == 0 {
+			input = estimateInputTokens(openaiReq)
+		}
+
+		billingTokens := billingTokensFor(r, modelID, input, output, cacheWrite, cacheHit)
+		billingCost := billingCostFor(r, modelID, input, output, cacheWrite, cacheHit, isBatch)
 
 		// Get OhMyGPT key ID for logging
 		factoryKeyID := ohmygptProvider.GetLastUsedKeyID()
 
 		// Update OhMyGPT key usage stats in MongoDB
 		if factoryKeyID != "" {
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-			db.OhMyGPTKeysCollection().UpdateByID(ctx, factoryKeyID, bson.M{
-				"$inc": bson.M{
-					"tokensUsed":    input + output,
-					"requestsCount": 1,
-				},
-			})
+			ohmygptProvider.UpdateKeyStats(factoryKeyID, input+output)
 		}
 
 		if userApiKey != "" {
 			usage.UpdateUsage(userApiKey, billingTokens)
 			if username != "" {
-				usage.DeductCreditsOhMyGPT(username, billingCost, billingTokens, input, output)
-				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, modelID, billingCost)
+				usage.DeductCreditsOhMyGPT(username, requestIDFor(r), billingCost, billingTokens, input, output)
+				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(r), modelID, billingCost)
 			}
 			// Log request to request_logs collection
 			latencyMs := time.Since(requestStartTime).Milliseconds()
@@ -2229,6 +2404,12 @@ func handleOhMyGPTOpenAIRequest(w http.ResponseWriter, openaiReq *transformers.O
 				UserKeyID:        userApiKey,
 				FactoryKeyID:     factoryKeyID,
 				Model:            modelID,
+				FallbackHop:      tierFor(r).Hop,
+				Upstream:         tierFor(r).Upstream,
+				Experiment:       experimentFor(r).Experiment,
+				ExperimentArm:    experimentFor(r).Arm,
+				Hold:             holdFor(r),
+				RequestID:        requestIDFor(r),
 				InputTokens:      input,
 				OutputTokens:     output,
 				CacheWriteTokens: cacheWrite,
@@ -2238,6 +2419,8 @@ func handleOhMyGPTOpenAIRequest(w http.ResponseWriter, openaiReq *transformers.O
 				TokensUsed:       billingTokens,
 				StatusCode:       resp.StatusCode,
 				LatencyMs:        latencyMs,
+				IsBatch:          isBatch,
+				Cancelled:        cancelled,
 			})
 		}
 	}
@@ -2252,15 +2435,14 @@ func handleOhMyGPTOpenAIRequest(w http.ResponseWriter, openaiReq *transformers.O
 
 // handleOhMyGPTMessagesRequest handles /v1/messages requests routed to OhMyGPT Provider
 // Forwards Anthropic format request to OhMyGPT /v1/messages endpoint
-func handleOhMyGPTMessagesRequest(w http.ResponseWriter, originalBody []byte, isStreaming bool, modelID string, userApiKey string, username string) {
-	ohmygptProvider := ohmygpt.GetOhMyGPT()
-	if ohmygptProvider == nil || !ohmygptProvider.IsConfigured() {
+func handleOhMyGPTMessagesRequest(w http.ResponseWriter, r *http.Request, ohmygptProvider *ohmygpt.OhMyGPTProvider, originalBody []byte, isStreaming bool, modelID string, userApiKey string, username string, isBatch bool) {
+	if !ohmygptProvider.IsConfigured() {
 		http.Error(w, `{"type":"error","error":{"type":"api_error","message":"Service not configured"}}`, http.StatusInternalServerError)
 		return
 	}
 
 	// Get upstream model ID (may be different from client-requested model ID)
-	upstreamModelID := config.GetUpstreamModelID(modelID)
+	upstreamModelID := upstreamModelIDFor(r, modelID)
 
 	// Parse original body as raw JSON to preserve all fields
 	var rawRequest map[string]interface{}
@@ -2298,7 +2480,7 @@ func handleOhMyGPTMessagesRequest(w http.ResponseWriter, originalBody []byte, is
 	requestStartTime := time.Now()
 
 	// Forward request using OhMyGPT messages endpoint
-	resp, err := ohmygptProvider.ForwardMessagesRequest(requestBody, isStreaming)
+	resp, err := ohmygptProvider.ForwardMessagesRequest(r.Context(), requestBody, isStreaming)
 	if err != nil {
 		log.Printf("❌ [OhMyGPT-Anthropic] Request failed after %v: %v", time.Since(requestStartTime), err)
 		http.Error(w, `{"type":"error","error":{"type":"api_error","message":"Request to upstream service failed"}}`, http.StatusBadGateway)
@@ -2308,29 +2490,22 @@ func handleOhMyGPTMessagesRequest(w http.ResponseWriter, originalBody []byte, is
 
 	// Usage callback for billing and logging
 	onUsage := func(input, output, cacheWrite, cacheHit int64) {
-		billingTokens := config.CalculateBillingTokensWithCache(modelID, input, output, cacheWrite, cacheHit)
-		billingCost := config.CalculateBillingCostWithCache(modelID, input, output, cacheWrite, cacheHit)
+		billingTokens := billingTokensFor(r, modelID, input, output, cacheWrite, cacheHit)
+		billingCost := billingCostFor(r, modelID, input, output, cacheWrite, cacheHit, isBatch)
 
 		// Get OhMyGPT key ID for logging
 		factoryKeyID := ohmygptProvider.GetLastUsedKeyID()
 
 		// Update OhMyGPT key usage stats in MongoDB
 		if factoryKeyID != "" {
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-			db.OhMyGPTKeysCollection().UpdateByID(ctx, factoryKeyID, bson.M{
-				"$inc": bson.M{
-					"tokensUsed":    input + output,
-					"requestsCount": 1,
-				},
-			})
+			ohmygptProvider.UpdateKeyStats(factoryKeyID, input+output)
 		}
 
 		if userApiKey != "" {
 			usage.UpdateUsage(userApiKey, billingTokens)
 			if username != "" {
-				usage.DeductCreditsOhMyGPT(username, billingCost, billingTokens, input, output)
-				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, modelID, billingCost)
+				usage.DeductCreditsOhMyGPT(username, requestIDFor(r), billingCost, billingTokens, input, output)
+				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(r), modelID, billingCost)
 			}
 			// Log request to request_logs collection
 			latencyMs := time.Since(requestStartTime).Milliseconds()
@@ -2339,6 +2514,12 @@ func handleOhMyGPTMessagesRequest(w http.ResponseWriter, originalBody []byte, is
 				UserKeyID:        userApiKey,
 				FactoryKeyID:     factoryKeyID,
 				Model:            modelID,
+				FallbackHop:      tierFor(r).Hop,
+				Upstream:         tierFor(r).Upstream,
+				Experiment:       experimentFor(r).Experiment,
+				ExperimentArm:    experimentFor(r).Arm,
+				Hold:             holdFor(r),
+				RequestID:        requestIDFor(r),
 				InputTokens:      input,
 				OutputTokens:     output,
 				CacheWriteTokens: cacheWrite,
@@ -2348,6 +2529,8 @@ func handleOhMyGPTMessagesRequest(w http.ResponseWriter, originalBody []byte, is
 				TokensUsed:       billingTokens,
 				StatusCode:       resp.StatusCode,
 				LatencyMs:        latencyMs,
+				IsBatch:          isBatch,
+				Cancelled:        transformers.ClientCancelled(resp),
 			})
 		}
 
@@ -2366,7 +2549,12 @@ func handleOhMyGPTMessagesRequest(w http.ResponseWriter, originalBody []byte, is
 }
 
 // Handle TrollOpenAI type request
-func handleTrollOpenAIRequest(w http.ResponseWriter, r *http.Request, openaiReq *transformers.OpenAIRequest, model *config.Model, authHeader string, selectedProxy *proxy.Proxy, userApiKey string, trollKeyID string, username string, bodyBytes []byte) {
+func handleTrollOpenAIRequest(w http.ResponseWriter, r *http.Request, openaiReq *transformers.OpenAIRequest, model *config.Model, authHeader string, selectedProxy *proxy.Proxy, userApiKey string, trollKeyID string, username string, bodyBytes []byte, isBatch bool) {
+	if err := transformers.ValidateTrollOpenAIParams(openaiReq); err != nil {
+		writeUnsupportedParamError(w, r, err, username, userApiKey)
+		return
+	}
+
 	// Transform request
 	trollReq := transformers.TransformToTrollOpenAI(openaiReq)
 
@@ -2386,7 +2574,7 @@ func handleTrollOpenAIRequest(w http.ResponseWriter, r *http.Request, openaiReq
 	}
 
 	// Create HTTP request
-	proxyReq, err := http.NewRequest(http.MethodPost, endpoint.BaseURL, bytes.NewBuffer(reqBody))
+	proxyReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, endpoint.BaseURL, bytes.NewBuffer(reqBody))
 	if err != nil {
 		log.Printf("Error: failed to create request: %v", err)
 		http.Error(w, `{"error": {"message": "Failed to create request", "type": "server_error"}}`, http.StatusInternalServerError)
@@ -2446,13 +2634,33 @@ func handleTrollOpenAIRequest(w http.ResponseWriter, r *http.Request, openaiReq
 	// Handle response
 	if openaiReq.Stream {
 		// Streaming response
-		handleTrollOpenAIStreamResponse(w, resp, model.ID, userApiKey, trollKeyID, requestStartTime, username)
+		handleTrollOpenAIStreamResponse(w, resp, model.ID, userApiKey, trollKeyID, requestStartTime, username, openaiReq.IncludeUsage())
 	} else {
 		// Non-streaming response
-		handleTrollOpenAINonStreamResponse(w, resp, model.ID, userApiKey, trollKeyID, requestStartTime, username)
+		handleTrollOpenAINonStreamResponse(w, resp, model.ID, userApiKey, trollKeyID, requestStartTime, username, isBatch)
 	}
 }
 
+// writeUnsupportedParamError returns a 400 for a request parameter the selected upstream
+// cannot honor, instead of silently dropping it
+func writeUnsupportedParamError(w http.ResponseWriter, r *http.Request, err error, username string, userApiKey string) {
+	param := ""
+	var paramErr *transformers.UnsupportedParamError
+	if errors.As(err, &paramErr) {
+		param = paramErr.Param
+	}
+	log.Printf("🚫 Unsupported parameter for upstream: %v", err)
+	body, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": err.Error(),
+			"type":    "invalid_request_error",
+			"param":   param,
+			"code":    "unsupported_parameter",
+		},
+	})
+	errorlog.JSONErrorWithUser(w, r, string(body), http.StatusBadRequest, username, userApiKey)
+}
+
 // sanitizeError returns a generic error message without revealing upstream details (OpenAI format)
 // Story 4.1: Added "code" field to all error responses for OpenAI SDK compatibility
 func sanitizeError(statusCode int, originalError []byte) []byte {
@@ -2502,7 +2710,8 @@ func sanitizeAnthropicError(statusCode int, originalError []byte) []byte {
 }
 
 // Handle Anthropic non-streaming response
-func handleAnthropicNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, userApiKey string, trollKeyID string, requestStartTime time.Time, username string) {
+// responseFormat is the client's response_format; JSON formats are unwrapped from the structured output tool
+func handleAnthropicNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, userApiKey string, trollKeyID string, requestStartTime time.Time, username string, responseFormat *transformers.ResponseFormat, isBatch bool) {
 	// Read response body (automatically handle gzip)
 	body, err := readResponseBody(resp)
 	if err != nil {
@@ -2558,8 +2767,8 @@ func handleAnthropicNonStreamResponse(w http.ResponseWriter, resp *http.Response
 		if cht, ok := usageData["cache_read_input_tokens"].(float64); ok {
 			cacheHitTokens = int64(cht)
 		}
-		billingTokens := config.CalculateBillingTokensWithCache(modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
-		billingCost := config.CalculateBillingCostWithCache(modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
+		billingTokens := billingTokensFor(resp.Request, modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
+		billingCost := billingCostFor(resp.Request, modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens, isBatch)
 
 		// Update user usage in database
 		if userApiKey != "" {
@@ -2573,13 +2782,13 @@ func handleAnthropicNonStreamResponse(w http.ResponseWriter, resp *http.Response
 			}
 			// Deduct credits and update tokensUsed for user
 			if username != "" {
-				if err := usage.DeductCreditsWithCache(username, billingCost, billingTokens, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens); err != nil {
+				if err := usage.DeductCreditsWithCache(username, requestIDFor(resp.Request), billingCost, billingTokens, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens); err != nil {
 					log.Printf("⚠️ Failed to update user: %v", err)
 				} else if debugMode {
 					log.Printf("💰 Deducted $%.6f, used %d tokens for user %s", billingCost, billingTokens, username)
 				}
 				// Update Friend Key usage if applicable
-				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, modelID, billingCost)
+				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(resp.Request), modelID, billingCost)
 			}
 			// Log request for analytics (include latency)
 			latencyMs := time.Since(requestStartTime).Milliseconds()
@@ -2588,6 +2797,12 @@ func handleAnthropicNonStreamResponse(w http.ResponseWriter, resp *http.Response
 				UserKeyID:        userApiKey,
 				TrollKeyID:       trollKeyID,
 				Model:            modelID,
+				FallbackHop:      tierFor(resp.Request).Hop,
+				Upstream:         tierFor(resp.Request).Upstream,
+				Experiment:       experimentFor(resp.Request).Experiment,
+				ExperimentArm:    experimentFor(resp.Request).Arm,
+				Hold:             holdFor(resp.Request),
+				RequestID:        requestIDFor(resp.Request),
 				InputTokens:      inputTokens,
 				OutputTokens:     outputTokens,
 				CacheWriteTokens: cacheWriteTokens,
@@ -2597,13 +2812,31 @@ func handleAnthropicNonStreamResponse(w http.ResponseWriter, resp *http.Response
 				TokensUsed:       billingTokens,
 				StatusCode:       resp.StatusCode,
 				LatencyMs:        latencyMs,
+				IsBatch:          isBatch,
 			})
 		}
 	}
 
 	// Transform to OpenAI format
 	transformer := transformers.NewAnthropicResponseTransformer(modelID, "")
+	transformer.ResponseFormat = responseFormat
 	openaiResp, err := transformer.TransformNonStreamResponse(anthropicResp)
+	var structuredErr *transformers.StructuredOutputError
+	if errors.As(err, &structuredErr) {
+		// Billed above: the model produced output, it just doesn't match the schema
+		log.Printf("❌ [Anthropic] %v", structuredErr)
+		errBody, _ := json.Marshal(map[string]interface{}{
+			"error": map[string]interface{}{
+				"message": structuredErr.Error(),
+				"type":    "invalid_response_error",
+				"code":    "structured_output_invalid",
+			},
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write(errBody)
+		return
+	}
 	if err != nil {
 		log.Printf("Error: failed to transform response: %v", err)
 		http.Error(w, `{"error": {"message": "Failed to transform response", "type": "server_error"}}`, http.StatusInternalServerError)
@@ -2622,7 +2855,7 @@ func handleAnthropicNonStreamResponse(w http.ResponseWriter, resp *http.Response
 }
 
 // Handle Anthropic streaming response
-func handleAnthropicStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, userApiKey string, trollKeyID string, requestStartTime time.Time, username string) {
+func handleAnthropicStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, userApiKey string, trollKeyID string, requestStartTime time.Time, username string, responseFormat *transformers.ResponseFormat, includeUsage bool) {
 	// Handle error responses from upstream
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
@@ -2633,6 +2866,7 @@ func handleAnthropicStreamResponse(w http.ResponseWriter, resp *http.Response, m
 		}
 		// Check if key needs rotation (async)
 		if trollKeyID != "" && trollKeyID != "env" && trollKeyID != "main" {
+			trollKeyPool.ObserveRateLimits(trollKeyID, resp.StatusCode, resp.Header)
 			trollKeyPool.CheckAndRotateOnError(trollKeyID, resp.StatusCode, string(body))
 		}
 		// Sanitize and forward error response (hide upstream details)
@@ -2652,8 +2886,15 @@ func handleAnthropicStreamResponse(w http.ResponseWriter, resp *http.Response, m
 		return
 	}
 
+	// Keepalives stop idle timeouts from dropping the connection while upstream is silent
+	heartbeat := sse.StartHeartbeat(w, sse.OpenAIKeepalive)
+	defer heartbeat.Stop()
+	w, flusher = heartbeat, heartbeat
+
 	// Create transformer
 	transformer := transformers.NewAnthropicResponseTransformer(modelID, "")
+	transformer.ResponseFormat = responseFormat
+	transformer.IncludeUsage = includeUsage
 
 	// Process SSE events manually to capture usage data
 	scanner := bufio.NewScanner(resp.Body)
@@ -2661,6 +2902,8 @@ func handleAnthropicStreamResponse(w http.ResponseWriter, resp *http.Response, m
 	var totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens int64
 	var currentEvent string
 	var hasError bool // Track if there was an error in the stream
+	var delivered transformers.DeliveredOutput
+	var clientGone bool
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -2714,53 +2957,50 @@ func handleAnthropicStreamResponse(w http.ResponseWriter, resp *http.Response, m
 					}
 					if _, err := fmt.Fprint(w, chunk); err != nil {
 						log.Printf("Error: failed to write streaming response: %v", err)
-						return
+						clientGone = true
+						break
 					}
 					flusher.Flush()
+					delivered.AddAnthropicEvent(eventData)
 				}
 			}
 		}
 	}
 
-	// Send final chunk with usage data (OpenAI format)
-	if totalInputTokens > 0 || totalOutputTokens > 0 {
-		usageChunk := map[string]interface{}{
-			"id":      fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano()),
-			"object":  "chat.completion.chunk",
-			"created": time.Now().Unix(),
-			"model":   modelID,
-			"choices": []map[string]interface{}{},
-			"usage": map[string]interface{}{
-				"prompt_tokens":     totalInputTokens,
-				"completion_tokens": totalOutputTokens,
-				"total_tokens":      totalInputTokens + totalOutputTokens,
-			},
-		}
-		if usageJSON, err := json.Marshal(usageChunk); err == nil {
-			fmt.Fprintf(w, "data: %s\n\n", string(usageJSON))
-			flusher.Flush()
+	// Client disconnected: nothing more can be sent, bill only the delivered output
+	cancelled := clientGone || (scanner.Err() != nil && transformers.ClientCancelled(resp))
+	if cancelled {
+		if deliveredOutput := delivered.Tokens(modelID); deliveredOutput > totalOutputTokens {
+			totalOutputTokens = deliveredOutput
 		}
-	}
-
-	// Check for scanner errors (connection issues, truncation, etc)
-	if err := scanner.Err(); err != nil {
+		log.Printf("🛑 [Stream] Client disconnected (in=%d, delivered out=%d)", totalInputTokens, totalOutputTokens)
+	} else if err := scanner.Err(); err != nil {
+		// Check for scanner errors (connection issues, truncation, etc)
 		log.Printf("❌ [Stream] Scanner error detected: %v (in=%d out=%d)", err, totalInputTokens, totalOutputTokens)
 		// Send error event to client
 		errorEvent := fmt.Sprintf("event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"stream_error\",\"message\":\"Stream interrupted\"}}\n\n")
 		fmt.Fprint(w, errorEvent)
 		flusher.Flush()
 		return
-	}
+	} else {
+		// Send final usage chunk with the billed counts (always with stream_options.include_usage)
+		if !hasError {
+			if usageChunk := transformer.UsageChunk(totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens); usageChunk != "" {
+				fmt.Fprint(w, usageChunk)
+				flusher.Flush()
+			}
+		}
 
-	// Send end marker
-	log.Printf("✅ [Stream] Sending [DONE] marker (events processed, in=%d, out=%d)", totalInputTokens, totalOutputTokens)
-	fmt.Fprint(w, "data: [DONE]\n\n")
-	flusher.Flush()
+		// Send end marker
+		log.Printf("✅ [Stream] Sending [DONE] marker (events processed, in=%d, out=%d)", totalInputTokens, totalOutputTokens)
+		fmt.Fprint(w, "data: [DONE]\n\n")
+		flusher.Flush()
+	}
 
 	// Update usage after stream completes - only if no errors occurred
 	if !hasError && (totalInputTokens > 0 || totalOutputTokens > 0) {
-		billingTokens := config.CalculateBillingTokensWithCache(modelID, totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens)
-		billingCost := config.CalculateBillingCostWithCache(modelID, totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens)
+		billingTokens := billingTokensFor(resp.Request, modelID, totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens)
+		billingCost := billingCostFor(resp.Request, modelID, totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens, false)
 		if userApiKey != "" {
 			if err := usage.UpdateUsage(userApiKey, billingTokens); err != nil {
 				log.Printf("⚠️ Failed to update usage: %v", err)
@@ -2772,13 +3012,13 @@ func handleAnthropicStreamResponse(w http.ResponseWriter, resp *http.Response, m
 			}
 			// Deduct credits and update tokensUsed for user
 			if username != "" {
-				if err := usage.DeductCreditsWithCache(username, billingCost, billingTokens, totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens); err != nil {
+				if err := usage.DeductCreditsWithCache(username, requestIDFor(resp.Request), billingCost, billingTokens, totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens); err != nil {
 					log.Printf("⚠️ Failed to update user: %v", err)
 				} else if debugMode {
 					log.Printf("💰 Deducted $%.6f, used %d tokens for user %s", billingCost, billingTokens, username)
 				}
 				// Update Friend Key usage if applicable
-				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, modelID, billingCost)
+				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(resp.Request), modelID, billingCost)
 			}
 			// Log request for analytics
 			latencyMs := time.Since(requestStartTime).Milliseconds()
@@ -2787,6 +3027,12 @@ func handleAnthropicStreamResponse(w http.ResponseWriter, resp *http.Response, m
 				UserKeyID:        userApiKey,
 				TrollKeyID:       trollKeyID,
 				Model:            modelID,
+				FallbackHop:      tierFor(resp.Request).Hop,
+				Upstream:         tierFor(resp.Request).Upstream,
+				Experiment:       experimentFor(resp.Request).Experiment,
+				ExperimentArm:    experimentFor(resp.Request).Arm,
+				Hold:             holdFor(resp.Request),
+				RequestID:        requestIDFor(resp.Request),
 				InputTokens:      totalInputTokens,
 				OutputTokens:     totalOutputTokens,
 				CacheWriteTokens: totalCacheWriteTokens,
@@ -2796,6 +3042,7 @@ func handleAnthropicStreamResponse(w http.ResponseWriter, resp *http.Response, m
 				TokensUsed:       billingTokens,
 				StatusCode:       resp.StatusCode,
 				LatencyMs:        latencyMs,
+				Cancelled:        cancelled,
 			})
 		}
 	} else if hasError {
@@ -2804,7 +3051,7 @@ func handleAnthropicStreamResponse(w http.ResponseWriter, resp *http.Response, m
 }
 
 // Handle TrollOpenAI non-streaming response
-func handleTrollOpenAINonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, userApiKey string, trollKeyID string, requestStartTime time.Time, username string) {
+func handleTrollOpenAINonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, userApiKey string, trollKeyID string, requestStartTime time.Time, username string, isBatch bool) {
 	// Debug mode: log response headers
 	if debugMode {
 		log.Printf("📋 Response headers:")
@@ -2842,6 +3089,7 @@ func handleTrollOpenAINonStreamResponse(w http.ResponseWriter, resp *http.Respon
 		}
 		// Check if key needs rotation (async)
 		if trollKeyID != "" && trollKeyID != "env" && trollKeyID != "main" {
+			trollKeyPool.ObserveRateLimits(trollKeyID, resp.StatusCode, resp.Header)
 			trollKeyPool.CheckAndRotateOnError(trollKeyID, resp.StatusCode, string(body))
 		}
 		// Sanitize and forward error response (hide upstream details)
@@ -2891,8 +3139,8 @@ func handleTrollOpenAINonStreamResponse(w http.ResponseWriter, resp *http.Respon
 		if cht, ok := usageData["cache_read_input_tokens"].(float64); ok {
 			cacheHitTokens = int64(cht)
 		}
-		billingTokens := config.CalculateBillingTokensWithCache(modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
-		billingCost := config.CalculateBillingCostWithCache(modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
+		billingTokens := billingTokensFor(resp.Request, modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
+		billingCost := billingCostFor(resp.Request, modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens, isBatch)
 
 		// Update user usage in database
 		if userApiKey != "" {
@@ -2906,13 +3154,13 @@ func handleTrollOpenAINonStreamResponse(w http.ResponseWriter, resp *http.Respon
 			}
 			// Deduct credits and update tokensUsed for user
 			if username != "" {
-				if err := usage.DeductCreditsWithCache(username, billingCost, billingTokens, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens); err != nil {
+				if err := usage.DeductCreditsWithCache(username, requestIDFor(resp.Request), billingCost, billingTokens, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens); err != nil {
 					log.Printf("⚠️ Failed to update user: %v", err)
 				} else if debugMode {
 					log.Printf("💰 Deducted $%.6f, used %d tokens for user %s", billingCost, billingTokens, username)
 				}
 				// Update Friend Key usage if applicable
-				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, modelID, billingCost)
+				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(resp.Request), modelID, billingCost)
 			}
 			// Log request for analytics (include latency)
 			latencyMs := time.Since(requestStartTime).Milliseconds()
@@ -2921,6 +3169,12 @@ func handleTrollOpenAINonStreamResponse(w http.ResponseWriter, resp *http.Respon
 				UserKeyID:        userApiKey,
 				TrollKeyID:       trollKeyID,
 				Model:            modelID,
+				FallbackHop:      tierFor(resp.Request).Hop,
+				Upstream:         tierFor(resp.Request).Upstream,
+				Experiment:       experimentFor(resp.Request).Experiment,
+				ExperimentArm:    experimentFor(resp.Request).Arm,
+				Hold:             holdFor(resp.Request),
+				RequestID:        requestIDFor(resp.Request),
 				InputTokens:      inputTokens,
 				OutputTokens:     outputTokens,
 				CacheWriteTokens: cacheWriteTokens,
@@ -2930,6 +3184,7 @@ func handleTrollOpenAINonStreamResponse(w http.ResponseWriter, resp *http.Respon
 				TokensUsed:       billingTokens,
 				StatusCode:       resp.StatusCode,
 				LatencyMs:        latencyMs,
+				IsBatch:          isBatch,
 			})
 		}
 	}
@@ -2951,7 +3206,7 @@ func handleTrollOpenAINonStreamResponse(w http.ResponseWriter, resp *http.Respon
 }
 
 // Handle TrollOpenAI streaming response
-func handleTrollOpenAIStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, userApiKey string, trollKeyID string, requestStartTime time.Time, username string) {
+func handleTrollOpenAIStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, userApiKey string, trollKeyID string, requestStartTime time.Time, username string, includeUsage bool) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
@@ -2962,15 +3217,23 @@ func handleTrollOpenAIStreamResponse(w http.ResponseWriter, resp *http.Response,
 		return
 	}
 
+	// Keepalives stop idle timeouts from dropping the connection while upstream is silent
+	heartbeat := sse.StartHeartbeat(w, sse.OpenAIKeepalive)
+	defer heartbeat.Stop()
+	w, flusher = heartbeat, heartbeat
+
 	// Create transformer
 	transformer := transformers.NewTrollOpenAIResponseTransformer(modelID, "")
+	transformer.IncludeUsage = includeUsage
 
 	// Process SSE events manually to capture usage data
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024) // 10MB max buffer
-	var totalInputTokens, totalOutputTokens int64
+	var totalInputTokens, totalOutputTokens, totalCacheHitTokens int64
 	var currentEvent string
 	var hasError bool // Track if there was an error in the stream
+	var delivered transformers.DeliveredOutput
+	var clientGone bool
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -2983,10 +3246,8 @@ func handleTrollOpenAIStreamResponse(w http.ResponseWriter, resp *http.Response,
 		} else if strings.HasPrefix(line, "data: ") {
 			dataStr := strings.TrimPrefix(line, "data: ")
 
-			// Check if it's [DONE] marker
+			// [DONE] is sent after the usage chunk once the stream ends
 			if strings.TrimSpace(dataStr) == "[DONE]" {
-				fmt.Fprint(w, "data: [DONE]\n\n")
-				flusher.Flush()
 				continue
 			}
 
@@ -3008,6 +3269,16 @@ func handleTrollOpenAIStreamResponse(w http.ResponseWriter, resp *http.Response,
 						if ot, ok := usageData["completion_tokens"].(float64); ok {
 							totalOutputTokens = int64(ot)
 						}
+						if details, ok := usageData["prompt_tokens_details"].(map[string]interface{}); ok {
+							if cht, ok := details["cached_tokens"].(float64); ok {
+								totalCacheHitTokens = int64(cht)
+							}
+						}
+						// Replaced by our own usage chunk at the end of the stream
+						delete(eventData, "usage")
+						if choices, ok := eventData["choices"].([]interface{}); ok && len(choices) == 0 {
+							continue
+						}
 					}
 					// Forward with filtering
 					eventData["model"] = modelID
@@ -3025,6 +3296,7 @@ func handleTrollOpenAIStreamResponse(w http.ResponseWriter, resp *http.Response,
 					if jsonData, err := json.Marshal(eventData); err == nil {
 						fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
 						flusher.Flush()
+						delivered.AddOpenAIChunk(eventData)
 					}
 					continue
 				}
@@ -3039,6 +3311,11 @@ func handleTrollOpenAIStreamResponse(w http.ResponseWriter, resp *http.Response,
 							if ot, ok := usageData["output_tokens"].(float64); ok {
 								totalOutputTokens = int64(ot)
 							}
+							if details, ok := usageData["input_tokens_details"].(map[string]interface{}); ok {
+								if cht, ok := details["cached_tokens"].(float64); ok {
+									totalCacheHitTokens = int64(cht)
+								}
+							}
 						}
 					}
 				}
@@ -3047,32 +3324,49 @@ func handleTrollOpenAIStreamResponse(w http.ResponseWriter, resp *http.Response,
 				if chunk, err := transformer.TransformStreamChunk(currentEvent, eventData); err == nil && chunk != "" {
 					if _, err := fmt.Fprint(w, chunk); err != nil {
 						log.Printf("Error: failed to write streaming response: %v", err)
-						return
+						clientGone = true
+						break
 					}
 					flusher.Flush()
+					delivered.AddOpenAISSE(chunk)
 				}
 			}
 		}
 	}
 
-	// Check for scanner errors (connection issues, truncation, etc)
-	if err := scanner.Err(); err != nil {
+	// Client disconnected: nothing more can be sent, bill only the delivered output
+	cancelled := clientGone || (scanner.Err() != nil && transformers.ClientCancelled(resp))
+	if cancelled {
+		if deliveredOutput := delivered.Tokens(modelID); deliveredOutput > totalOutputTokens {
+			totalOutputTokens = deliveredOutput
+		}
+		log.Printf("🛑 [TrollOpenAI Stream] Client disconnected (in=%d, delivered out=%d)", totalInputTokens, totalOutputTokens)
+	} else if err := scanner.Err(); err != nil {
+		// Check for scanner errors (connection issues, truncation, etc)
 		log.Printf("❌ [TrollOpenAI Stream] Scanner error detected: %v (in=%d out=%d)", err, totalInputTokens, totalOutputTokens)
 		// Send error event to client
 		errorEvent := fmt.Sprintf("data: {\"error\":{\"message\":\"Stream interrupted\",\"type\":\"stream_error\"}}\n\n")
 		fmt.Fprint(w, errorEvent)
 		flusher.Flush()
 		return
-	}
+	} else {
+		// Send final usage chunk with the billed counts (always with stream_options.include_usage)
+		if !hasError {
+			if usageChunk := transformer.UsageChunk(totalInputTokens, totalOutputTokens, totalCacheHitTokens); usageChunk != "" {
+				fmt.Fprint(w, usageChunk)
+				flusher.Flush()
+			}
+		}
 
-	// Send end marker if not sent
-	fmt.Fprint(w, "data: [DONE]\n\n")
-	flusher.Flush()
+		// Send end marker
+		fmt.Fprint(w, "data: [DONE]\n\n")
+		flusher.Flush()
+	}
 
 	// Update usage after stream completes - only if no errors occurred
 	if !hasError && (totalInputTokens > 0 || totalOutputTokens > 0) {
-		billingTokens := config.CalculateBillingTokensWithCache(modelID, totalInputTokens, totalOutputTokens, 0, 0)
-		billingCost := config.CalculateBillingCostWithCache(modelID, totalInputTokens, totalOutputTokens, 0, 0)
+		billingTokens := billingTokensFor(resp.Request, modelID, totalInputTokens, totalOutputTokens, 0, 0)
+		billingCost := billingCostFor(resp.Request, modelID, totalInputTokens, totalOutputTokens, 0, 0, false)
 		if userApiKey != "" {
 			if err := usage.UpdateUsage(userApiKey, billingTokens); err != nil {
 				log.Printf("⚠️ Failed to update usage: %v", err)
@@ -3083,28 +3377,35 @@ func handleTrollOpenAIStreamResponse(w http.ResponseWriter, resp *http.Response,
 			}
 			// Deduct credits and update tokensUsed for user
 			if username != "" {
-				if err := usage.DeductCreditsWithTokens(username, billingCost, billingTokens, totalInputTokens, totalOutputTokens); err != nil {
+				if err := usage.DeductCreditsWithTokens(username, requestIDFor(resp.Request), billingCost, billingTokens, totalInputTokens, totalOutputTokens); err != nil {
 					log.Printf("⚠️ Failed to update user: %v", err)
 				} else if debugMode {
 					log.Printf("💰 Deducted $%.6f, used %d tokens for user %s", billingCost, billingTokens, username)
 				}
 				// Update Friend Key usage if applicable
-				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, modelID, billingCost)
+				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(resp.Request), modelID, billingCost)
 			}
 			// Log request for analytics
 			latencyMs := time.Since(requestStartTime).Milliseconds()
 			usage.LogRequestDetailed(usage.RequestLogParams{
-				UserID:       username,
-				UserKeyID:    userApiKey,
-				TrollKeyID:   trollKeyID,
-				Model:        modelID,
-				InputTokens:  totalInputTokens,
-				OutputTokens: totalOutputTokens,
-				CreditsCost:  billingCost,
-				CreditType:   "ohmygpt",
-				TokensUsed:   billingTokens,
-				StatusCode:   resp.StatusCode,
-				LatencyMs:    latencyMs,
+				UserID:        username,
+				UserKeyID:     userApiKey,
+				TrollKeyID:    trollKeyID,
+				Model:         modelID,
+				FallbackHop:   tierFor(resp.Request).Hop,
+				Upstream:      tierFor(resp.Request).Upstream,
+				Experiment:    experimentFor(resp.Request).Experiment,
+				ExperimentArm: experimentFor(resp.Request).Arm,
+				Hold:          holdFor(resp.Request),
+				RequestID:     requestIDFor(resp.Request),
+				InputTokens:   totalInputTokens,
+				OutputTokens:  totalOutputTokens,
+				CreditsCost:   billingCost,
+				CreditType:    "ohmygpt",
+				TokensUsed:    billingTokens,
+				StatusCode:    resp.StatusCode,
+				LatencyMs:     latencyMs,
+				Cancelled:     cancelled,
 			})
 		}
 	} else if hasError {
@@ -3326,32 +3627,33 @@ func extractClientHeaders(r *http.Request) map[string]string {
 	return headers
 }
 
-// Anthropic Messages API endpoint - Direct pass-through to Factory AI
-// Supports Anthropic native provider in Droid CLI and Anthropic SDK
-func handleAnthropicMessagesEndpoint(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorlog.HTTPError(w, r, `{"type":"error","error":{"type":"invalid_request_error","message":"Method not allowed"}}`, http.StatusMethodNotAllowed)
-		return
-	}
+// anthropicAuth holds the caller identity resolved by authenticateAnthropicRequest
+type anthropicAuth struct {
+	clientAPIKey  string
+	clientKeyMask string
+	username      string // Username for credit deduction
+	friendKeyID   string // Set when the request uses a Friend Key (model limit check later)
+}
 
+// authenticateAnthropicRequest validates the client API key (Authorization/Bearer or x-api-key)
+// and writes an Anthropic-format error on failure. Shared by /v1/messages and /v1/messages/count_tokens.
+func authenticateAnthropicRequest(w http.ResponseWriter, r *http.Request) (*anthropicAuth, bool) {
 	// Validate Authorization header (support both Authorization/Bearer and x-api-key)
-	authHeader := r.Header.Get("Authorization")
 	clientAPIKey := ""
 
-	if authHeader != "" {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
 		parts := strings.SplitN(authHeader, " ", 2)
 		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || parts[1] == "" {
 			errorlog.HTTPError(w, r, `{"type":"error","error":{"type":"authentication_error","message":"Invalid authorization header format"}}`, http.StatusUnauthorized)
-			return
+			return nil, false
 		}
 		clientAPIKey = parts[1]
 	} else if xAPIKey := r.Header.Get("x-api-key"); xAPIKey != "" {
 		// Anthropic SDKs send x-api-key without Authorization header
 		clientAPIKey = xAPIKey
-		authHeader = "Bearer " + xAPIKey
 	} else {
 		errorlog.HTTPError(w, r, `{"type":"error","error":{"type":"authentication_error","message":"Authorization header is required"}}`, http.StatusUnauthorized)
-		return
+		return nil, false
 	}
 
 	// Validate API key - either from env (PROXY_API_KEY) or MongoDB (user_keys)
@@ -3361,16 +3663,14 @@ func handleAnthropicMessagesEndpoint(w http.ResponseWriter, r *http.Request) {
 		clientKeyMask = clientKeyMask[:4] + "..." + clientKeyMask[len(clientKeyMask)-4:]
 	}
 
-	var username string // Username for credit deduction
-	var isFriendKeyRequest bool
-	var friendKeyID string // Store Friend Key ID for model limit check later
+	auth := &anthropicAuth{clientAPIKey: clientAPIKey, clientKeyMask: clientKeyMask}
 
 	if proxyAPIKey != "" {
 		// Validate with fixed PROXY_API_KEY from env
 		if clientAPIKey != proxyAPIKey {
 			log.Printf("❌ API Key validation failed (env): %s", clientKeyMask)
 			errorlog.HTTPErrorWithUser(w, r, `{"type":"error","error":{"type":"authentication_error","message":"Invalid API key"}}`, http.StatusUnauthorized, "", clientAPIKey)
-			return
+			return nil, false
 		}
 		log.Printf("🔑 Key validated (env): %s", clientKeyMask)
 	} else if userkey.IsFriendKey(clientAPIKey) {
@@ -3391,12 +3691,11 @@ func handleAnthropicMessagesEndpoint(w http.ResponseWriter, r *http.Request) {
 			default:
 				errorlog.HTTPErrorWithUser(w, r, `{"type":"error","error":{"type":"authentication_error","message":"Invalid API key"}}`, http.StatusUnauthorized, "", clientAPIKey)
 			}
-			return
+			return nil, false
 		}
 		log.Printf("🔑 Friend Key validated: %s [owner: %s]", clientKeyMask, friendKeyResult.Owner.Username)
-		username = friendKeyResult.Owner.Username
-		isFriendKeyRequest = true
-		friendKeyID = clientAPIKey
+		auth.username = friendKeyResult.Owner.Username
+		auth.friendKeyID = clientAPIKey
 	} else {
 		// Validate from MongoDB user_keys collection
 		userKey, err := userkey.ValidateKey(clientAPIKey)
@@ -3414,16 +3713,31 @@ func handleAnthropicMessagesEndpoint(w http.ResponseWriter, r *http.Request) {
 			} else {
 				errorlog.HTTPErrorWithUser(w, r, `{"type":"error","error":{"type":"authentication_error","message":"Invalid API key"}}`, http.StatusUnauthorized, "", clientAPIKey)
 			}
-			return
+			return nil, false
 		}
-		username = userKey.Name // Store username for credit deduction
+		auth.username = userKey.Name // Store username for credit deduction
 
 		// NOTE: Credit check moved to after upstream routing to support dual-credit system
 		// OpenHands uses creditsNew, OhMyGPT uses credits - check happens per-upstream
 	}
-	// Store Friend Key info for use in response handlers
-	_ = isFriendKeyRequest
-	_ = friendKeyID
+
+	return auth, true
+}
+
+// Anthropic Messages API endpoint - Direct pass-through to Factory AI
+// Supports Anthropic native provider in Droid CLI and Anthropic SDK
+func handleAnthropicMessagesEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errorlog.HTTPError(w, r, `{"type":"error","error":{"type":"invalid_request_error","message":"Method not allowed"}}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	auth, ok := authenticateAnthropicRequest(w, r)
+	if !ok {
+		return
+	}
+	clientAPIKey := auth.clientAPIKey
+	username := auth.username
 
 	if !enforcePriorityLineAccess(w, r, username, clientAPIKey, true) {
 		return
@@ -3447,6 +3761,18 @@ func handleAnthropicMessagesEndpoint(w http.ResponseWriter, r *http.Request) {
 		log.Printf("📥 /v1/messages request received (body: %d bytes)", len(bodyBytes))
 	}
 
+	serveAnthropicMessages(w, r, auth, bodyBytes, false)
+}
+
+// serveAnthropicMessages routes an authenticated /v1/messages body to its upstream.
+// isBatch bills at batch rates (Message Batches workers call it with non-streaming bodies).
+func serveAnthropicMessages(w http.ResponseWriter, r *http.Request, auth *anthropicAuth, bodyBytes []byte, isBatch bool) {
+	clientAPIKey := auth.clientAPIKey
+	clientKeyMask := auth.clientKeyMask
+	username := auth.username
+	isFriendKeyRequest := auth.friendKeyID != ""
+	friendKeyID := auth.friendKeyID
+
 	// Parse Anthropic request
 	var anthropicReq transformers.AnthropicRequest
 	if err := json.Unmarshal(bodyBytes, &anthropicReq); err != nil {
@@ -3488,16 +3814,6 @@ func handleAnthropicMessagesEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// NEW MODEL-BASED ROUTING - BEGIN
-	// Select upstream based on model configuration
-	upstreamConfig, selectedProxy, err := selectUpstreamConfig(model.ID, clientAPIKey)
-	if err != nil {
-		log.Printf("❌ Failed to select upstream: %v", err)
-		errorlog.HTTPErrorWithUser(w, r, `{"type":"error","error":{"type":"api_error","message":"Server configuration error"}}`, http.StatusInternalServerError, username, clientAPIKey)
-		return
-	}
-	authHeader = "Bearer " + upstreamConfig.APIKey
-	trollKeyID := upstreamConfig.KeyID
-
 	// Credit pre-check based on billing_upstream config (not upstream provider)
 	// billing_upstream="openhands" → check creditsNew field
 	// billing_upstream="ohmygpt" → check credits+refCredits fields
@@ -3536,24 +3852,59 @@ func handleAnthropicMessagesEndpoint(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// For "main" upstream: forward original request as-is (no transformation)
-	if upstreamConfig.KeyID == "main" {
-		handleMainTargetMessagesRequest(w, bodyBytes, stream, anthropicReq.Model, clientAPIKey, username)
+	// Identify the request for its log, its ledger entries and the client
+	r = withRequestID(w, r)
+
+	// Hold the request's worst-case cost so parallel requests cannot overspend the balance or the spend caps
+	r, holds, err := reserveCredits(r, model.ID, username, clientAPIKey, func() int64 { return estimateAnthropicInputTokens(&anthropicReq) }, int64(anthropicReq.MaxTokens), isBatch)
+	var capped *spendcap.ExceededError
+	if errors.As(err, &capped) {
+		errorlog.JSONErrorWithUser(w, r, anthropicSpendCapError(capped), http.StatusPaymentRequired, username, clientAPIKey)
 		return
 	}
-
-	// For "openhands" upstream: forward via OpenHands LLM Proxy
-	if upstreamConfig.KeyID == "openhands" {
-		handleOpenHandsMessagesRequest(w, bodyBytes, stream, anthropicReq.Model, clientAPIKey, username)
+	var insufficient *reservation.InsufficientError
+	if errors.As(err, &insufficient) {
+		errorlog.JSONErrorWithUser(w, r, fmt.Sprintf(`{"type":"error","error":{"type":"insufficient_credits","message":"Insufficient credits for this request. Estimated cost: $%.2f, available balance: $%.2f"}}`, insufficient.Amount, insufficient.Available), http.StatusPaymentRequired, username, clientAPIKey)
 		return
 	}
+	defer holds.Release()
 
-	// For "ohmygpt" upstream: forward via OhMyGPT Provider
-	if upstreamConfig.KeyID == "ohmygpt" {
-		handleOhMyGPTMessagesRequest(w, bodyBytes, stream, anthropicReq.Model, clientAPIKey, username)
-		return
+	// Pin the conversation to the key that served its earlier turns (prompt cache),
+	// and to its experiment arm if the model has an upstream_model_id pool
+	r = r.WithContext(affinity.WithPrefix(r.Context(), affinity.Prefix(bodyBytes)))
+	r = withExperiment(r, model.ID, username)
+	if stream {
+		r = withStreamKeepalive(r, sse.AnthropicPing)
+	}
+
+	// Route by upstream, walking the model's fallback chain
+	err = serveWithFallbacks(w, r, model.ID, clientAPIKey, username, func(w http.ResponseWriter, r *http.Request, upstreamConfig *UpstreamConfig, selectedProxy *proxy.Proxy) {
+		if messagesViaChatCompletions(model.ID, upstreamConfig.Type) {
+			// Upstream only speaks chat completions: translate the request and the response
+			tierReq := anthropicReq
+			serveMessagesViaChatCompletions(w, r, &tierReq, model, upstreamConfig, clientAPIKey, username, isBatch)
+			return
+		}
+
+		// Forward with the type's /v1/messages handler
+		upstreamHandlers[upstreamConfig.Type].messages(w, r, upstreamConfig.Provider, bodyBytes, stream, anthropicReq.Model, clientAPIKey, username, isBatch)
+	})
+	if errors.Is(err, breaker.ErrOpen) {
+		log.Printf("❌ No upstream available for %s: %v", model.ID, err)
+		errorlog.HTTPErrorWithUser(w, r, `{"type":"error","error":{"type":"overloaded_error","message":"Service temporarily unavailable. Please try again later."}}`, http.StatusServiceUnavailable, username, clientAPIKey)
+	} else if err != nil {
+		log.Printf("❌ Failed to select upstream: %v", err)
+		errorlog.HTTPErrorWithUser(w, r, `{"type":"error","error":{"type":"api_error","message":"Server configuration error"}}`, http.StatusInternalServerError, username, clientAPIKey)
 	}
 	// NEW MODEL-BASED ROUTING - END
+}
+
+// handleAnthropicMessagesTrollRequest sends /v1/messages to a Factory AI style upstream,
+// adding the system prompt and thinking config before forwarding
+func handleAnthropicMessagesTrollRequest(w http.ResponseWriter, r *http.Request, anthropicReq *transformers.AnthropicRequest, model *config.Model, upstreamConfig *UpstreamConfig, selectedProxy *proxy.Proxy, clientAPIKey string, username string, isBatch bool) {
+	stream := anthropicReq.Stream
+	authHeader := "Bearer " + upstreamConfig.APIKey
+	trollKeyID := upstreamConfig.KeyID
 
 	// Normalize message content format (convert string to array if needed)
 	for i := range anthropicReq.Messages {
@@ -3672,7 +4023,7 @@ func handleAnthropicMessagesEndpoint(w http.ResponseWriter, r *http.Request) {
 
 	// Create request to upstream (Factory AI or Main Target Server)
 	// OLD CODE: proxyReq, err := http.NewRequest(http.MethodPost, endpoint.BaseURL, bytes.NewBuffer(reqBody))
-	proxyReq, err := http.NewRequest(http.MethodPost, endpointURL, bytes.NewBuffer(reqBody))
+	proxyReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, endpointURL, bytes.NewBuffer(reqBody))
 	if err != nil {
 		log.Printf("Error creating request: %v", err)
 		http.Error(w, `{"type":"error","error":{"type":"api_error","message":"Failed to create request"}}`, http.StatusInternalServerError)
@@ -3682,7 +4033,7 @@ func handleAnthropicMessagesEndpoint(w http.ResponseWriter, r *http.Request) {
 	// Set headers based on upstream type
 	clientHeaders := extractClientHeaders(r)
 	var headers map[string]string
-	if upstreamConfig.KeyID == "main" {
+	if upstreamConfig.Type == maintarget.MainTargetType {
 		// Use Main Target headers (standard Anthropic API with x-api-key)
 		headers = transformers.GetMainTargetHeaders(upstreamConfig.APIKey, clientHeaders, stream)
 	} else {
@@ -3714,7 +4065,7 @@ func handleAnthropicMessagesEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Log upstream destination
-	if upstreamConfig.KeyID == "main" {
+	if upstreamConfig.Type == maintarget.MainTargetType {
 		log.Printf("📤 Sending request to Main Target Server...")
 	} else {
 		log.Printf("📤 Sending request to Factory API...")
@@ -3737,12 +4088,67 @@ func handleAnthropicMessagesEndpoint(w http.ResponseWriter, r *http.Request) {
 	if stream {
 		handleAnthropicMessagesStreamResponse(w, resp, anthropicReq.Model, clientAPIKey, trollKeyID, reqStart, username)
 	} else {
-		handleAnthropicMessagesNonStreamResponse(w, resp, anthropicReq.Model, clientAPIKey, trollKeyID, reqStart, username)
+		handleAnthropicMessagesNonStreamResponse(w, resp, anthropicReq.Model, clientAPIKey, trollKeyID, reqStart, username, isBatch)
+	}
+}
+
+// handleAnthropicCountTokensEndpoint serves /v1/messages/count_tokens
+// Same auth as /v1/messages, but tokens are counted locally: no upstream call, no credit deduction
+func handleAnthropicCountTokensEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errorlog.HTTPError(w, r, `{"type":"error","error":{"type":"invalid_request_error","message":"Method not allowed"}}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	auth, ok := authenticateAnthropicRequest(w, r)
+	if !ok {
+		return
+	}
+	clientAPIKey := auth.clientAPIKey
+	username := auth.username
+
+	if !enforcePriorityLineAccess(w, r, username, clientAPIKey, true) {
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		errorlog.HTTPErrorWithUser(w, r, `{"type":"error","error":{"type":"invalid_request_error","message":"Failed to read request body"}}`, http.StatusBadRequest, username, clientAPIKey)
+		return
+	}
+	defer r.Body.Close()
+
+	var anthropicReq transformers.AnthropicRequest
+	if err := json.Unmarshal(bodyBytes, &anthropicReq); err != nil {
+		log.Printf("Error parsing request: %v", err)
+		http.Error(w, `{"type":"error","error":{"type":"invalid_request_error","message":"Invalid JSON"}}`, http.StatusBadRequest)
+		return
+	}
+
+	if len(anthropicReq.Messages) == 0 {
+		errorlog.HTTPErrorWithUser(w, r, `{"type":"error","error":{"type":"invalid_request_error","message":"messages: field required"}}`, http.StatusBadRequest, username, clientAPIKey)
+		return
+	}
+
+	model := config.GetModelByID(anthropicReq.Model)
+	if model == nil {
+		log.Printf("❌ Unsupported model: %s", anthropicReq.Model)
+		errorlog.HTTPErrorWithUser(w, r, `{"type":"error","error":{"type":"invalid_request_error","message":"Model not found"}}`, http.StatusNotFound, username, clientAPIKey)
+		return
+	}
+
+	inputTokens := estimateAnthropicInputTokens(&anthropicReq)
+	log.Printf("🔢 /v1/messages/count_tokens - Model: %s, input_tokens=%d", model.ID, inputTokens)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int64{"input_tokens": inputTokens}); err != nil {
+		log.Printf("Error: failed to encode response: %v", err)
 	}
 }
 
 // Handle non-streaming response from Factory AI (Anthropic format)
-func handleAnthropicMessagesNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, userApiKey string, trollKeyID string, requestStartTime time.Time, username string) {
+func handleAnthropicMessagesNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, userApiKey string, trollKeyID string, requestStartTime time.Time, username string, isBatch bool) {
 	body, err := readResponseBody(resp)
 	if err != nil {
 		log.Printf("Error reading response: %v", err)
@@ -3768,6 +4174,7 @@ func handleAnthropicMessagesNonStreamResponse(w http.ResponseWriter, resp *http.
 		}
 		// Check if key needs rotation (async)
 		if trollKeyID != "" && trollKeyID != "env" && trollKeyID != "main" {
+			trollKeyPool.ObserveRateLimits(trollKeyID, resp.StatusCode, resp.Header)
 			trollKeyPool.CheckAndRotateOnError(trollKeyID, resp.StatusCode, string(body))
 		}
 		// Sanitize and return error response (hide upstream details)
@@ -3799,8 +4206,8 @@ func handleAnthropicMessagesNonStreamResponse(w http.ResponseWriter, resp *http.
 				if cht, ok := usageData["cache_read_input_tokens"].(float64); ok {
 					cacheHitTokens = int64(cht)
 				}
-				billingTokens := config.CalculateBillingTokensWithCache(modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
-				billingCost := config.CalculateBillingCostWithCache(modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
+				billingTokens := billingTokensFor(resp.Request, modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens)
+				billingCost := billingCostFor(resp.Request, modelID, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens, isBatch)
 
 				// Update user usage in database
 				if userApiKey != "" {
@@ -3814,13 +4221,13 @@ func handleAnthropicMessagesNonStreamResponse(w http.ResponseWriter, resp *http.
 					}
 					// Deduct credits and update tokensUsed for user
 					if username != "" {
-						if err := usage.DeductCreditsWithCache(username, billingCost, billingTokens, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens); err != nil {
+						if err := usage.DeductCreditsWithCache(username, requestIDFor(resp.Request), billingCost, billingTokens, inputTokens, outputTokens, cacheWriteTokens, cacheHitTokens); err != nil {
 							log.Printf("⚠️ Failed to update user: %v", err)
 						} else if debugMode {
 							log.Printf("💰 Deducted $%.6f, used %d tokens for user %s", billingCost, billingTokens, username)
 						}
 						// Update Friend Key usage if applicable
-						usage.UpdateFriendKeyUsageIfNeeded(userApiKey, modelID, billingCost)
+						usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(resp.Request), modelID, billingCost)
 					}
 					// Log request for analytics (include latency)
 					latencyMs := time.Since(requestStartTime).Milliseconds()
@@ -3829,6 +4236,12 @@ func handleAnthropicMessagesNonStreamResponse(w http.ResponseWriter, resp *http.
 						UserKeyID:        userApiKey,
 						TrollKeyID:       trollKeyID,
 						Model:            modelID,
+						FallbackHop:      tierFor(resp.Request).Hop,
+						Upstream:         tierFor(resp.Request).Upstream,
+						Experiment:       experimentFor(resp.Request).Experiment,
+						ExperimentArm:    experimentFor(resp.Request).Arm,
+						Hold:             holdFor(resp.Request),
+						RequestID:        requestIDFor(resp.Request),
 						InputTokens:      inputTokens,
 						OutputTokens:     outputTokens,
 						CacheWriteTokens: cacheWriteTokens,
@@ -3838,6 +4251,7 @@ func handleAnthropicMessagesNonStreamResponse(w http.ResponseWriter, resp *http.
 						TokensUsed:       billingTokens,
 						StatusCode:       resp.StatusCode,
 						LatencyMs:        latencyMs,
+						IsBatch:          isBatch,
 					})
 				}
 			}
@@ -3890,6 +4304,7 @@ func handleAnthropicMessagesStreamResponse(w http.ResponseWriter, resp *http.Res
 		}
 		// Check if key needs rotation (async)
 		if trollKeyID != "" && trollKeyID != "env" && trollKeyID != "main" {
+			trollKeyPool.ObserveRateLimits(trollKeyID, resp.StatusCode, resp.Header)
 			trollKeyPool.CheckAndRotateOnError(trollKeyID, resp.StatusCode, string(body))
 		}
 		// Sanitize and forward error response (hide upstream details)
@@ -3909,6 +4324,11 @@ func handleAnthropicMessagesStreamResponse(w http.ResponseWriter, resp *http.Res
 		return
 	}
 
+	// Keepalives stop idle timeouts from dropping the connection while upstream is silent
+	heartbeat := sse.StartHeartbeat(w, sse.AnthropicPing)
+	defer heartbeat.Stop()
+	w, flusher = heartbeat, heartbeat
+
 	// Process SSE events and filter Droid identity
 	scanner := bufio.NewScanner(resp.Body)
 	// Increase scanner buffer for large streaming responses
@@ -3920,6 +4340,7 @@ func handleAnthropicMessagesStreamResponse(w http.ResponseWriter, resp *http.Res
 	var lastEventType string
 	var lastEventTime time.Time
 	var hasError bool // Track if there was an error in the stream
+	var delivered transformers.DeliveredOutput
 	log.Printf("📡 Stream started")
 
 	for scanner.Scan() {
@@ -3941,6 +4362,7 @@ func handleAnthropicMessagesStreamResponse(w http.ResponseWriter, resp *http.Res
 
 				// Track last event type for debugging
 				lastEventType = eventType
+				delivered.AddAnthropicEvent(eventData)
 
 				// Check for error events - don't charge if there's an error
 				if eventType == "error" {
@@ -4013,10 +4435,18 @@ func handleAnthropicMessagesStreamResponse(w http.ResponseWriter, resp *http.Res
 		flusher.Flush()
 	}
 
+	// Client disconnected: bill only what was delivered before the cut
+	cancelled := scanner.Err() != nil && transformers.ClientCancelled(resp)
+	if cancelled {
+		if deliveredOutput := delivered.Tokens(modelID); deliveredOutput > totalOutputTokens {
+			totalOutputTokens = deliveredOutput
+		}
+	}
+
 	// Update usage after stream completes - only if no errors occurred
 	if !hasError && (totalInputTokens > 0 || totalOutputTokens > 0) {
-		billingTokens := config.CalculateBillingTokensWithCache(modelID, totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens)
-		billingCost := config.CalculateBillingCostWithCache(modelID, totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens)
+		billingTokens := billingTokensFor(resp.Request, modelID, totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens)
+		billingCost := billingCostFor(resp.Request, modelID, totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens, false)
 		if userApiKey != "" {
 			if err := usage.UpdateUsage(userApiKey, billingTokens); err != nil {
 				log.Printf("⚠️ Failed to update usage: %v", err)
@@ -4028,13 +4458,13 @@ func handleAnthropicMessagesStreamResponse(w http.ResponseWriter, resp *http.Res
 			}
 			// Deduct credits and update tokensUsed for user
 			if username != "" {
-				if err := usage.DeductCreditsWithCache(username, billingCost, billingTokens, totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens); err != nil {
+				if err := usage.DeductCreditsWithCache(username, requestIDFor(resp.Request), billingCost, billingTokens, totalInputTokens, totalOutputTokens, totalCacheWriteTokens, totalCacheHitTokens); err != nil {
 					log.Printf("⚠️ Failed to update user: %v", err)
 				} else if debugMode {
 					log.Printf("💰 Deducted $%.6f, used %d tokens for user %s", billingCost, billingTokens, username)
 				}
 				// Update Friend Key usage if applicable
-				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, modelID, billingCost)
+				usage.UpdateFriendKeyUsageIfNeeded(userApiKey, requestIDFor(resp.Request), modelID, billingCost)
 			}
 			// Log request for analytics (include latency)
 			latencyMs := time.Since(requestStartTime).Milliseconds()
@@ -4043,6 +4473,12 @@ func handleAnthropicMessagesStreamResponse(w http.ResponseWriter, resp *http.Res
 				UserKeyID:        userApiKey,
 				TrollKeyID:       trollKeyID,
 				Model:            modelID,
+				FallbackHop:      tierFor(resp.Request).Hop,
+				Upstream:         tierFor(resp.Request).Upstream,
+				Experiment:       experimentFor(resp.Request).Experiment,
+				ExperimentArm:    experimentFor(resp.Request).Arm,
+				Hold:             holdFor(resp.Request),
+				RequestID:        requestIDFor(resp.Request),
 				InputTokens:      totalInputTokens,
 				OutputTokens:     totalOutputTokens,
 				CacheWriteTokens: totalCacheWriteTokens,
@@ -4052,13 +4488,16 @@ func handleAnthropicMessagesStreamResponse(w http.ResponseWriter, resp *http.Res
 				TokensUsed:       billingTokens,
 				StatusCode:       200,
 				LatencyMs:        latencyMs,
+				Cancelled:        cancelled,
 			})
 		}
 	} else if hasError {
 		log.Printf("⚠️ Skipping billing due to error in stream")
 	}
 
-	if err := scanner.Err(); err != nil {
+	if cancelled {
+		log.Printf("🛑 Client disconnected after %d events (duration: %v), billed %d delivered output tokens", eventCount, time.Since(startTime), totalOutputTokens)
+	} else if err := scanner.Err(); err != nil {
 		timeSinceLastEvent := time.Since(lastEventTime)
 		log.Printf("❌ Error reading stream after %d events (duration: %v, last_event: %s, time_since_last: %v): %v",
 			eventCount, time.Since(startTime), lastEventType, timeSinceLastEvent, err)
@@ -4139,70 +4578,11 @@ func main() {
 	log.Printf("✅ Troll key pool loaded: %d keys", trollKeyPool.GetKeyCount())
 
 	// NEW MODEL-BASED ROUTING - BEGIN
-	// Load Main Target Server configuration (for Sonnet 4.5 and Haiku 4.5)
-	mainTargetServer = getEnv("MAIN_TARGET_SERVER", "")
-	mainUpstreamKey = getEnv("MAIN_UPSTREAM_KEY", "")
-	if mainTargetServer != "" && mainUpstreamKey != "" {
-		maintarget.Configure(mainTargetServer, mainUpstreamKey)
-		log.Printf("✅ Main Target Server configured: %s", mainTargetServer)
-	} else {
-		log.Printf("⚠️ Main Target Server not configured (Sonnet/Haiku will use Troll Key)")
-	}
-
-	// Load OpenHands configuration via TrollProxy (from MongoDB)
-	if err := openhands.ConfigureOpenHands(); err != nil {
-		log.Printf("⚠️ OpenHands configuration failed: %v", err)
-	} else {
-		openhandsProvider := openhands.GetOpenHands()
-		if openhandsProvider.GetKeyCount() > 0 {
-			// Start auto-reload for OpenHands keys
-			openhandsProvider.StartAutoReload(reloadInterval)
-			log.Printf("✅ OpenHands key pool loaded: %d keys", openhandsProvider.GetKeyCount())
-
-			// Set proxy pool for OpenHands (use same pool as Troll)
-			if proxyPool != nil && proxyPool.HasProxies() {
-				openhandsProvider.SetProxyPool(proxyPool)
-			}
-
-			// TEMP: disable SpendChecker startup for now.
-			log.Printf("⚠️ SpendChecker TEMPORARILY DISABLED")
-		} else {
-			log.Printf("⚠️ OpenHands not configured (no keys in openhands_keys collection)")
-		}
-	}
-
-	// Load OpenHands LLM Proxy key pool (from MongoDB)
-	openhandsKeyPool := openhandspool.GetPool()
-	if openhandsKeyPool.GetKeyCount() > 0 {
-		// Start auto-reload for OpenHands keys
-		openhandsKeyPool.StartAutoReload(reloadInterval)
-		log.Printf("✅ OpenHands key pool loaded: %d keys", openhandsKeyPool.GetKeyCount())
-	} else {
-		log.Printf("⚠️ OpenHands not configured (no keys in openhands_keys collection)")
-	}
+	// Upstream instances are built from the "upstreams" section once the config is loaded
 
 	// Start OpenHands backup key cleanup job (runs every 1 minute, deletes keys used > 12h)
 	openhands.StartBackupKeyCleanupJob(1 * time.Minute)
 
-	// OhMyGPT key pool disabled - only using OpenHands keys
-	// If you need to re-enable, uncomment below:
-	// if err := ohmygpt.ConfigureOhMyGPT(); err != nil {
-	// 	log.Printf("⚠️ OhMyGPT configuration failed: %v", err)
-	// } else {
-	// 	ohmygptProvider := ohmygpt.GetOhMyGPT()
-	// 	if ohmygptProvider.GetKeyCount() > 0 {
-	// 		ohmygptProvider.StartAutoReload(reloadInterval)
-	// 		log.Printf("✅ OhMyGPT key pool loaded: %d keys", ohmygptProvider.GetKeyCount())
-	// 		if proxyPool != nil && proxyPool.HasProxies() {
-	// 			ohmygptProvider.SetProxyPool(proxyPool)
-	// 		}
-	// 	} else {
-	// 		log.Printf("⚠️ OhMyGPT not configured (no keys in ohmygpt_keys collection)")
-	// 	}
-	// }
-	// ohmygpt.StartOhMyGPTBackupKeyCleanupJob(1 * time.Minute)
-	log.Printf("ℹ️ OhMyGPT key pool DISABLED (only OpenHands keys active)")
-
 	// Initialize cache fallback detection
 	cacheDetectionEnabled := getEnv("CACHE_FALLBACK_DETECTION", "false") == "true"
 	cache.InitCacheDetector(
@@ -4247,10 +4627,129 @@ func main() {
 		log.Printf("   • %s [%s]", model.ID, model.Type)
 	}
 
+	// Build and start the upstream instances declared in config ("upstreams")
+	if err := provider.Build(config.GetUpstreams()); err != nil {
+		log.Fatalf("❌ Failed to build upstreams: %v", err)
+	}
+	provider.StartAll(provider.Runtime{ProxyPool: proxyPool, ReloadInterval: reloadInterval})
+	log.Printf("✅ Upstreams: %s", strings.Join(provider.Names(), ", "))
+
+	// Start Message Batches and /v1/batches workers (batches are drained at low priority)
+	startMessageBatchWorkers()
+	startOpenAIBatchWorkers()
+
+	// Write deadlines: every route gets WRITE_TIMEOUT, file routes FILE_WRITE_TIMEOUT.
+	// Streams send keepalives every SSE_HEARTBEAT_INTERVAL of upstream silence and extend
+	// their deadline by STREAM_WRITE_TIMEOUT on each write.
+	writeTimeout := getEnvDuration("WRITE_TIMEOUT", 300*time.Second)
+	fileWriteTimeout := getEnvDuration("FILE_WRITE_TIMEOUT", 30*time.Minute)
+	sse.HeartbeatInterval = getEnvDuration("SSE_HEARTBEAT_INTERVAL", sse.HeartbeatInterval)
+	sse.WriteTimeout = getEnvDuration("STREAM_WRITE_TIMEOUT", sse.WriteTimeout)
+	log.Printf("⏱️ Write timeout: %v (files: %v), stream heartbeat: %v, stream write timeout: %v", writeTimeout, fileWriteTimeout, sse.HeartbeatInterval, sse.WriteTimeout)
+
+	// Cache affinity: a conversation (system prompt + first KEY_AFFINITY_MESSAGES messages)
+	// stays on the key that served it until it is idle for KEY_AFFINITY_TTL
+	affinity.TTL = getEnvDuration("KEY_AFFINITY_TTL", affinity.TTL)
+	if n := parseInt(os.Getenv("KEY_AFFINITY_MESSAGES")); n > 0 {
+		affinity.PrefixMessages = n
+	}
+	log.Printf("📌 Key affinity: ttl %v, prefix %d message(s)", affinity.TTL, affinity.PrefixMessages)
+
+	// Circuit breakers: an upstream or key opens after CIRCUIT_ERROR_RATE failures among at
+	// least CIRCUIT_MIN_REQUESTS calls in CIRCUIT_WINDOW, and is probed again after CIRCUIT_OPEN_TIMEOUT
+	breaker.Enabled = getEnv("CIRCUIT_BREAKER_ENABLED", "true") == "true"
+	breaker.Window = getEnvDuration("CIRCUIT_WINDOW", breaker.Window)
+	breaker.OpenTimeout = getEnvDuration("CIRCUIT_OPEN_TIMEOUT", breaker.OpenTimeout)
+	breaker.SlowCall = getEnvDuration("CIRCUIT_SLOW_CALL", breaker.SlowCall)
+	if n := parseInt(os.Getenv("CIRCUIT_MIN_REQUESTS")); n > 0 {
+		breaker.MinRequests = n
+	}
+	if n := parseInt(os.Getenv("CIRCUIT_HALF_OPEN_PROBES")); n > 0 {
+		breaker.HalfOpenProbes = n
+	}
+	if rate, err := strconv.ParseFloat(os.Getenv("CIRCUIT_ERROR_RATE"), 64); err == nil && rate > 0 && rate <= 1 {
+		breaker.ErrorRate = rate
+	}
+	log.Printf("🔌 Circuit breakers: enabled=%v, open at %.0f%% errors over %v (min %d calls), open for %v", breaker.Enabled, breaker.ErrorRate*100, breaker.Window, breaker.MinRequests, breaker.OpenTimeout)
+
+	// Admission queues: with every key of a chain's last upstream rate limited, requests wait
+	// up to ADMISSION_MAX_WAIT for one (clients can ask for less with X-Queue-Timeout)
+	admission.MaxWait = getEnvDuration("ADMISSION_MAX_WAIT", admission.MaxWait)
+	if d, err := time.ParseDuration(os.Getenv("ADMISSION_MAX_WAIT")); err == nil && d == 0 {
+		admission.MaxWait = 0 // disabled: fail fast as before
+	}
+	if n := parseInt(os.Getenv("ADMISSION_MAX_DEPTH")); n > 0 {
+		admission.MaxDepth = n
+	}
+	log.Printf("⏳ Admission queues: wait up to %v, %d requests per upstream", admission.MaxWait, admission.MaxDepth)
+
+	// Credit holds: each request holds its worst-case cost until its request log settles it;
+	// holds of requests that never finish expire after CREDIT_HOLD_TTL
+	reservation.Enabled = getEnv("CREDIT_HOLDS_ENABLED", "true") == "true"
+	reservation.TTL = getEnvDuration("CREDIT_HOLD_TTL", reservation.TTL)
+	if n := parseInt(os.Getenv("CREDIT_HOLD_OUTPUT_TOKENS")); n > 0 {
+		holdOutputTokens = int64(n)
+	}
+	log.Printf("💳 Credit holds: enabled=%v, expire after %v, %d output tokens assumed without max_tokens", reservation.Enabled, reservation.TTL, holdOutputTokens)
+
+	// Credit ledger: every balance change is recorded before it is written. The reconciler
+	// checks balances and request logs against it every LEDGER_RECONCILE_INTERVAL; with
+	// several instances, the one holding its lease runs it
+	ledger.EnsureIndexes()
+	ledger.SettleLag = getEnvDuration("LEDGER_SETTLE_LAG", ledger.SettleLag)
+	if getEnv("LEDGER_RECONCILE_ENABLED", "true") == "true" {
+		interval := getEnvDuration("LEDGER_RECONCILE_INTERVAL", time.Hour)
+		reconciler = ledger.NewReconciler(interval)
+		reconciler.Start()
+		log.Printf("📒 Credit ledger: reconciling every %v (entries settle for %v)", interval, ledger.SettleLag)
+	}
+
+	// Spend caps: spend is recorded on each user and key document in hourly and daily buckets
+	// and checked against its spendPolicy in the write that holds a request. Budget alerts are
+	// logged and, if SPEND_ALERT_WEBHOOK_URL is set, posted there
+	spendcap.Enabled = getEnv("SPEND_CAPS_ENABLED", "true") == "true"
+	if spendcap.Enabled {
+		spendcap.HoldTTL = reservation.TTL
+		notifiers := spendcap.Notifiers{spendcap.LogNotifier{}}
+		if url := os.Getenv("SPEND_ALERT_WEBHOOK_URL"); url != "" {
+			notifiers = append(notifiers, spendcap.WebhookNotifier{URL: url, Client: &http.Client{Timeout: 10 * time.Second}})
+		}
+		spendcap.EnsureIndexes()
+		spendcap.Init(spendcap.NewMongoStore(), notifiers)
+		log.Printf("🧮 Spend caps: alerts at %v%% (%d notifiers)", spendcap.AlertThresholds, len(notifiers))
+	}
+
+	// Usage WAL: queued request logs, key usage and credit deductions are written to
+	// USAGE_WAL_DIR before they are queued, and replayed here if they never reached MongoDB.
+	// USAGE_WAL_SYNC is always (fsync every write), interval (USAGE_WAL_SYNC_INTERVAL) or never
+	if usage.UseBatchedWrites {
+		walDir := ""
+		walOpts := wal.DefaultOptions()
+		if getEnv("USAGE_WAL_ENABLED", "true") == "true" {
+			walDir = getEnv("USAGE_WAL_DIR", "data/usage-wal")
+			if policy, err := wal.ParseSyncPolicy(getEnv("USAGE_WAL_SYNC", "always")); err == nil {
+				walOpts.Sync = policy
+			} else {
+				log.Printf("⚠️ %v, fsyncing every write", err)
+			}
+			walOpts.SyncEvery = getEnvDuration("USAGE_WAL_SYNC_INTERVAL", walOpts.SyncEvery)
+			if mb := parseInt(os.Getenv("USAGE_WAL_SEGMENT_MB")); mb > 0 {
+				walOpts.SegmentSize = int64(mb) << 20
+			}
+		}
+		if err := usage.InitBatcher(walDir, walOpts); err != nil {
+			log.Fatalf("❌ Failed to open usage WAL in %s: %v", walDir, err)
+		}
+		if walDir != "" {
+			log.Printf("🧾 Usage WAL: %s, sync %v", walDir, walOpts.Sync)
+		}
+	}
+
 	// Setup routes with CORS middleware
 	http.HandleFunc("/health", corsMiddleware(healthHandler))
 	http.HandleFunc("/keys/status", corsMiddleware(keysStatusHandler))
 	http.HandleFunc("/openhands/backup-keys", corsMiddleware(openhandsBackupKeysHandler))
+	http.HandleFunc("/experiments", corsMiddleware(experimentsHandler))
 	http.HandleFunc("/openhands/spend-stats", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
@@ -4270,8 +4769,16 @@ func main() {
 		json.NewEncoder(w).Encode(stats)
 	}))
 	http.HandleFunc("/v1/models", corsMiddleware(modelsHandler))
-	http.HandleFunc("/v1/chat/completions", corsMiddleware(chatCompletionsHandler))
-	http.HandleFunc("/v1/messages", corsMiddleware(handleAnthropicMessagesEndpoint))
+	http.HandleFunc("/v1/chat/completions", corsMiddleware(trackInteractive(chatCompletionsHandler)))
+	http.HandleFunc("/v1/responses", corsMiddleware(trackInteractive(responsesHandler)))
+	http.HandleFunc("/v1/messages", corsMiddleware(trackInteractive(handleAnthropicMessagesEndpoint)))
+	http.HandleFunc("/v1/messages/count_tokens", corsMiddleware(handleAnthropicCountTokensEndpoint))
+	http.HandleFunc("/v1/messages/batches", corsMiddleware(messageBatchesHandler))
+	http.HandleFunc("/v1/messages/batches/", corsMiddleware(messageBatchHandler))
+	http.HandleFunc("/v1/files", corsMiddleware(withWriteTimeout(fileWriteTimeout, filesHandler)))
+	http.HandleFunc("/v1/files/", corsMiddleware(withWriteTimeout(fileWriteTimeout, fileHandler)))
+	http.HandleFunc("/v1/batches", corsMiddleware(openAIBatchesHandler))
+	http.HandleFunc("/v1/batches/", corsMiddleware(openAIBatchHandler))
 
 	// Manual reload endpoint for admin to trigger binding refresh
 	http.HandleFunc("/reload", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
@@ -4299,45 +4806,35 @@ func main() {
 			log.Printf("⚠️ Troll key pool reload failed: %v", err)
 		}
 
-		// Reload OpenHands keys and bindings
-		openhandsReloaded := false
-		openhandsKeyCount := 0
-		if openhandsProv := openhands.GetOpenHands(); openhandsProv != nil {
-			if err := openhandsProv.Reload(); err != nil {
-				log.Printf("⚠️ OpenHands reload failed: %v", err)
-			} else {
-				openhandsReloaded = true
-				openhandsKeyCount = openhandsProv.GetKeyCount()
-				log.Printf("✅ OpenHands reloaded: %d keys", openhandsKeyCount)
-			}
+		// Reload the key pools of every upstream instance (aliases share their target's pool)
+		result := map[string]interface{}{
+			"success":     true,
+			"message":     "All pools reloaded successfully",
+			"proxy_count": proxyPool.GetProxyCount(),
+			"bindings":    proxyPool.GetBindingsInfo(),
 		}
-
-		// Reload OhMyGPT keys and bindings
-		ohmygptReloaded := false
-		ohmygptKeyCount := 0
-		if ohmygptProv := ohmygpt.GetOhMyGPT(); ohmygptProv != nil {
-			if err := ohmygptProv.Reload(); err != nil {
-				log.Printf("⚠️ OhMyGPT reload failed: %v", err)
+		reloaded := make(map[provider.Provider]bool)
+		for _, name := range provider.Names() {
+			p := provider.Get(name)
+			reloader, ok := p.(provider.Reloader)
+			if !ok || reloaded[p] {
+				continue
+			}
+			reloaded[p] = true
+			keyCount := 0
+			if err := reloader.Reload(); err != nil {
+				log.Printf("⚠️ %s reload failed: %v", p.Name(), err)
 			} else {
-				ohmygptReloaded = true
-				ohmygptKeyCount = ohmygptProv.GetKeyCount()
-				log.Printf("✅ OhMyGPT reloaded: %d keys", ohmygptKeyCount)
+				keyCount = reloader.GetKeyCount()
+				log.Printf("✅ %s reloaded: %d keys", p.Name(), keyCount)
 			}
+			result[p.Name()+"_reloaded"] = err == nil
+			result[p.Name()+"_keys"] = keyCount
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success":            true,
-			"message":            "All pools reloaded successfully",
-			"proxy_count":        proxyPool.GetProxyCount(),
-			"bindings":           proxyPool.GetBindingsInfo(),
-			"openhands_reloaded": openhandsReloaded,
-			"openhands_keys":     openhandsKeyCount,
-			"ohmygpt_reloaded":   ohmygptReloaded,
-			"ohmygpt_keys":       ohmygptKeyCount,
-		})
+		json.NewEncoder(w).Encode(result)
 	}))
-
 	// Root path
 	http.HandleFunc("/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
@@ -4353,7 +4850,12 @@ func main() {
 				"/health",
 				"/v1/models",
 				"/v1/chat/completions",
+				"/v1/responses",
 				"/v1/messages",
+				"/v1/messages/count_tokens",
+				"/v1/messages/batches",
+				"/v1/files",
+				"/v1/batches",
 			},
 		}); err != nil {
 			log.Printf("Error: failed to encode response: %v", err)
@@ -4363,16 +4865,19 @@ func main() {
 	// Start server
 	port := fmt.Sprintf(":%d", cfg.Port)
 	server := &http.Server{
-		Addr:         port,
-		ReadTimeout:  120 * time.Second,
-		WriteTimeout: 300 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		Addr:        port,
+		Handler:     trackRequests(withWriteTimeout(writeTimeout, http.DefaultServeMux.ServeHTTP)),
+		ReadTimeout: 120 * time.Second,
+		IdleTimeout: 120 * time.Second,
 	}
 
+	// Graceful shutdown: on SIGTERM/SIGINT /health reports draining for SHUTDOWN_DRAIN_DELAY,
+	// then requests in flight get the rest of SHUTDOWN_TIMEOUT to finish
+	drainDelay := getEnvDuration("SHUTDOWN_DRAIN_DELAY", 10*time.Second)
+	shutdownTimeout := getEnvDuration("SHUTDOWN_TIMEOUT", 120*time.Second)
+
 	log.Printf("🚀 Service started at http://localhost%s", port)
 	log.Printf("📖 Documentation: http://localhost%s/docs", port)
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("❌ Server failed to start: %v", err)
-	}
+	serve(server, drainDelay, shutdownTimeout)
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFallbackWriterHoldsBackFailure(t *testing.T) {
+	rr := httptest.NewRecorder()
+	fw := &fallbackWriter{ResponseWriter: rr, header: http.Header{}, canFallBack: true}
+
+	fw.Header().Set("Content-Type", "application/json")
+	fw.WriteHeader(529)
+	fw.Write([]byte(`{"error":"overloaded"}`))
+
+	if !fw.failed || fw.status != 529 {
+		t.Fatalf("failed=%v status=%d, want held-back 529", fw.failed, fw.status)
+	}
+	if rr.Body.Len() != 0 || rr.Header().Get("Content-Type") != "" {
+		t.Fatal("held-back failure leaked to the client")
+	}
+
+	fw.replay()
+	if rr.Code != 529 || rr.Body.String() != `{"error":"overloaded"}` || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("replay = %d %q, want the held-back 529", rr.Code, rr.Body.String())
+	}
+}
+
+func TestFallbackWriterPassesThrough(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		canFallBack bool
+	}{
+		{"success", http.StatusOK, true},
+		{"client error is not retried", http.StatusBadRequest, true},
+		{"last tier answers with its failure", http.StatusBadGateway, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			fw := &fallbackWriter{ResponseWriter: rr, header: http.Header{}, canFallBack: tt.canFallBack}
+			fw.WriteHeader(tt.status)
+			fw.Write([]byte("body"))
+
+			if fw.failed {
+				t.Fatal("response should not move to the next tier")
+			}
+			if rr.Code != tt.status || rr.Body.String() != "body" {
+				t.Fatalf("client got %d %q, want %d %q", rr.Code, rr.Body.String(), tt.status, "body")
+			}
+		})
+	}
+}
+
+func TestTierForDefaultsToOwnUpstream(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	if tier := tierFor(req); tier.Hop != 0 || tier.Model != nil {
+		t.Fatalf("tierFor(plain request) = %+v, want zero tier", tier)
+	}
+
+	tier := upstreamTier{Hop: 2, Upstream: "ohmygpt"}
+	if got := tierFor(withUpstreamTier(req, tier)); got.Hop != 2 || got.Upstream != "ohmygpt" {
+		t.Fatalf("tierFor = %+v, want %+v", got, tier)
+	}
+}
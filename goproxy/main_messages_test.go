@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMessagesWriter_NonStream(t *testing.T) {
+	rec := httptest.NewRecorder()
+	mw := &messagesWriter{ResponseWriter: rec, model: "glm-4.6"}
+
+	mw.Header().Set("Content-Type", "application/json")
+	mw.WriteHeader(http.StatusOK)
+	mw.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Hi"},"finish_reason":"stop"}],`))
+	mw.Write([]byte(`"usage":{"prompt_tokens":3,"completion_tokens":1}}`))
+	mw.finish()
+
+	var msg map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &msg); err != nil {
+		t.Fatalf("invalid JSON: %v (%s)", err, rec.Body.String())
+	}
+	if msg["type"] != "message" || msg["stop_reason"] != "end_turn" {
+		t.Errorf("Unexpected message: %v", msg)
+	}
+	if content := msg["content"].([]interface{}); len(content) != 1 {
+		t.Errorf("Expected 1 content block, got %v", content)
+	}
+}
+
+func TestMessagesWriter_Error(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		rec := httptest.NewRecorder()
+		mw := &messagesWriter{ResponseWriter: rec, model: "glm-4.6", stream: stream}
+
+		http.Error(mw, `{"error": {"message": "Rate limit exceeded", "type": "rate_limit_exceeded"}}`, http.StatusTooManyRequests)
+		mw.finish()
+
+		want := `{"error":{"message":"Rate limit exceeded","type":"rate_limit_error"},"type":"error"}`
+		if rec.Code != http.StatusTooManyRequests || rec.Body.String() != want {
+			t.Errorf("stream=%v: expected Anthropic error, got %d %s", stream, rec.Code, rec.Body.String())
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("stream=%v: expected JSON content type, got %s", stream, ct)
+		}
+	}
+}
+
+func TestMessagesWriter_Stream(t *testing.T) {
+	rec := httptest.NewRecorder()
+	mw := &messagesWriter{ResponseWriter: rec, model: "glm-4.6", stream: true, inputTokens: 7}
+
+	mw.Header().Set("Content-Type", "text/event-stream")
+	mw.WriteHeader(http.StatusOK)
+	// Lines split across writes must be reassembled
+	fmt.Fprint(mw, `data: {"choices":[{"index":0,"delta":{"content":"Hel`)
+	fmt.Fprint(mw, "lo\"}}]}\n\n")
+	mw.Flush()
+	fmt.Fprint(mw, ": keepalive\n\n")
+	fmt.Fprint(mw, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+	fmt.Fprint(mw, "data: [DONE]\n\n")
+	mw.finish()
+
+	out := rec.Body.String()
+	for _, want := range []string{"event: message_start", `"text":"Hello"`, "event: ping", `"stop_reason":"end_turn"`, "event: message_stop"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in stream:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "[DONE]") || strings.Contains(out, "choices") {
+		t.Errorf("Chat completions output leaked into Messages stream:\n%s", out)
+	}
+	if strings.Count(out, "event: message_stop") != 1 {
+		t.Errorf("Expected exactly one message_stop")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"goproxy/internal/admission"
+	"goproxy/internal/sse"
+)
+
+func TestQueueTimeoutHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", admission.MaxWait},
+		{"0", 0},
+		{"2.5", 2500 * time.Millisecond},
+		{"3600", admission.MaxWait},
+		{"soon", admission.MaxWait},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		if tt.header != "" {
+			req.Header.Set(queueTimeoutHeader, tt.header)
+		}
+		if got := queueTimeout(req); got != tt.want {
+			t.Errorf("queueTimeout(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestQueuedStreamSendsErrorEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepalive string
+		body      string
+		want      string
+	}{
+		{"anthropic", sse.AnthropicPing, `{"type":"error","error":{"type":"overloaded_error","message":"No keys available"}}`,
+			"event: error\ndata: {\"error\":{\"message\":\"No keys available\",\"type\":\"overloaded_error\"},\"type\":\"error\"}\n\n"},
+		{"openai", sse.OpenAIKeepalive, "{\"error\": {\"message\": \"No keys available\", \"type\": \"server_error\"}}\n",
+			"data: {\"error\":{\"message\":\"No keys available\",\"type\":\"server_error\"}}\n\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			qs := startQueuedStream(rr, tt.keepalive)
+
+			qs.Header().Set("Content-Type", "application/json")
+			qs.WriteHeader(http.StatusServiceUnavailable)
+			qs.Write([]byte(tt.body))
+			qs.finish()
+
+			if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/event-stream" {
+				t.Fatalf("client got %d %q, want the queued stream's 200 text/event-stream", rr.Code, rr.Header().Get("Content-Type"))
+			}
+			if rr.Body.String() != tt.want {
+				t.Fatalf("body = %q, want %q", rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestQueuedStreamPassesStreamThrough(t *testing.T) {
+	rr := httptest.NewRecorder()
+	qs := startQueuedStream(rr, sse.OpenAIKeepalive)
+
+	qs.Header().Set("Content-Type", "text/event-stream")
+	qs.WriteHeader(http.StatusOK)
+	qs.Write([]byte("data: {\"choices\":[]}\n\n"))
+	qs.finish()
+
+	if body := rr.Body.String(); !strings.HasPrefix(body, "data: {\"choices\"") || strings.Contains(body, "error") {
+		t.Fatalf("body = %q, want the stream untouched", body)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponsesWriter_NonStream(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw := &responsesWriter{ResponseWriter: rec, model: "gpt-5"}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Hi"},"finish_reason":"stop"}],`))
+	rw.Write([]byte(`"usage":{"prompt_tokens":3,"completion_tokens":1}}`))
+	rw.finish()
+
+	var resp map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON: %v (%s)", err, rec.Body.String())
+	}
+	if resp["object"] != "response" || resp["status"] != "completed" {
+		t.Errorf("Unexpected response: %v", resp)
+	}
+	if output := resp["output"].([]interface{}); len(output) != 1 {
+		t.Errorf("Expected 1 output item, got %v", output)
+	}
+}
+
+func TestResponsesWriter_ErrorPassthrough(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		rec := httptest.NewRecorder()
+		rw := &responsesWriter{ResponseWriter: rec, model: "gpt-5", stream: stream}
+
+		body := `{"error":{"message":"Rate limit exceeded","type":"rate_limit_error"}}`
+		rw.WriteHeader(http.StatusTooManyRequests)
+		rw.Write([]byte(body))
+		rw.finish()
+
+		if rec.Code != http.StatusTooManyRequests || rec.Body.String() != body {
+			t.Errorf("stream=%v: expected error passthrough, got %d %s", stream, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestResponsesWriter_Stream(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw := &responsesWriter{ResponseWriter: rec, model: "gpt-5", stream: true}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.WriteHeader(http.StatusOK)
+	// Lines split across writes must be reassembled
+	fmt.Fprint(rw, `data: {"choices":[{"index":0,"delta":{"content":"Hel`)
+	fmt.Fprint(rw, "lo\"}}]}\n\n")
+	rw.Flush()
+	fmt.Fprint(rw, ": keepalive\n\n")
+	fmt.Fprint(rw, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+	fmt.Fprint(rw, "data: [DONE]\n\n")
+	rw.finish()
+
+	out := rec.Body.String()
+	for _, want := range []string{"event: response.created", `"delta":"Hello"`, ": keepalive", "event: response.completed"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in stream:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "[DONE]") || strings.Contains(out, "chat.completion") {
+		t.Errorf("Chat completions output leaked into Responses stream:\n%s", out)
+	}
+	if strings.Count(out, "event: response.completed") != 1 {
+		t.Errorf("Expected exactly one response.completed")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"goproxy/internal/provider"
+	"goproxy/transformers"
+)
+
+// stubProvider is an upstream type with no handlers of its own
+type stubProvider struct {
+	gotBody string
+}
+
+func (s *stubProvider) Name() string       { return "stub" }
+func (s *stubProvider) Type() string       { return "stub_type" }
+func (s *stubProvider) IsConfigured() bool { return true }
+
+func (s *stubProvider) ForwardRequest(ctx context.Context, body []byte, isStreaming bool) (*http.Response, error) {
+	s.gotBody = string(body)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"choices":[{"message":{"role":"assistant","content":"Hi"}}]}`)),
+	}, nil
+}
+
+func (s *stubProvider) HandleStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage provider.UsageCallback) {
+}
+
+func (s *stubProvider) HandleNonStreamResponse(w http.ResponseWriter, resp *http.Response, modelID string, onUsage provider.UsageCallback) {
+	io.Copy(w, resp.Body)
+}
+
+func TestServeChatCompletions_UnregisteredTypeUsesProviderInterface(t *testing.T) {
+	stub := &stubProvider{}
+	upstreamConfig := &UpstreamConfig{Provider: stub, Type: stub.Type()}
+	openaiReq := &transformers.OpenAIRequest{Model: "stub-model"}
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	serveChatCompletions(rec, r, upstreamConfig, openaiReq, nil, "stub-model", "", "", false)
+
+	if !strings.Contains(stub.gotBody, `"stub-model"`) {
+		t.Fatalf("request not forwarded through the provider: %q", stub.gotBody)
+	}
+	if !strings.Contains(rec.Body.String(), `"Hi"`) {
+		t.Fatalf("response not served by the provider: %q", rec.Body.String())
+	}
+	if !messagesViaChatCompletions("stub-model", stub.Type()) {
+		t.Fatal("/v1/messages for a type without a messages handler should go through chat completions")
+	}
+}
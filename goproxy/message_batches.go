@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"goproxy/config"
+	"goproxy/internal/batch"
+	"goproxy/internal/errorlog"
+	"goproxy/transformers"
+)
+
+// Message Batches API (/v1/messages/batches)
+// Batches are stored in MongoDB and drained by a background worker pool through the
+// normal /v1/messages pipeline, billed at batch rates.
+
+const maxBatchBodyBytes = 256 << 20 // 256MB, same as Anthropic
+
+var (
+	batchStore batch.Store
+	batchPool  *batch.Pool
+
+	// interactiveRequests counts in-flight chat/messages requests; batch workers
+	// yield while it is at or above batchYieldThreshold
+	interactiveRequests int64
+	batchYieldThreshold int64 = 20
+)
+
+// startMessageBatchWorkers sets up the batch store and worker pool
+// BATCH_WORKERS (default 2) sets the worker count, BATCH_YIELD_INFLIGHT (default 20)
+// the interactive load at which workers pause
+func startMessageBatchWorkers() {
+	store := batch.NewMongoStore()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	store.EnsureIndexes(ctx)
+	cancel()
+
+	if threshold := parseInt(getEnv("BATCH_YIELD_INFLIGHT", "20")); threshold > 0 {
+		batchYieldThreshold = int64(threshold)
+	}
+
+	batchStore = store
+	batchPool = batch.NewPool(store, executeMessageBatchRequest, parseInt(getEnv("BATCH_WORKERS", "2")), shouldYieldToInteractive)
+	batchPool.Start()
+}
+
+// shouldYieldToInteractive reports whether batch workers should pause for interactive load
+func shouldYieldToInteractive() bool {
+	return atomic.LoadInt64(&interactiveRequests) >= batchYieldThreshold
+}
+
+// trackInteractive counts a handler's in-flight requests as interactive load
+func trackInteractive(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&interactiveRequests, 1)
+		defer atomic.AddInt64(&interactiveRequests, -1)
+		next(w, r)
+	}
+}
+
+// messageBatchesHandler serves POST (create) and GET (list) on /v1/messages/batches
+func messageBatchesHandler(w http.ResponseWriter, r *http.Request) {
+	auth, ok := authenticateAnthropicRequest(w, r)
+	if !ok {
+		return
+	}
+	if !enforcePriorityLineAccess(w, r, auth.username, auth.clientAPIKey, true) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		createMessageBatch(w, r, auth)
+	case http.MethodGet:
+		listMessageBatches(w, r, auth)
+	default:
+		errorlog.HTTPError(w, r, `{"type":"error","error":{"type":"invalid_request_error","message":"Method not allowed"}}`, http.StatusMethodNotAllowed)
+	}
+}
+
+// messageBatchHandler serves /v1/messages/batches/{id}, /{id}/cancel and /{id}/results
+func messageBatchHandler(w http.ResponseWriter, r *http.Request) {
+	auth, ok := authenticateAnthropicRequest(w, r)
+	if !ok {
+		return
+	}
+	if !enforcePriorityLineAccess(w, r, auth.username, auth.clientAPIKey, true) {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/messages/batches/"), "/")
+	batchID := parts[0]
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	if batchID == "" || len(parts) > 2 {
+		writeBatchError(w, r, auth, http.StatusNotFound, "not_found_error", "Not found")
+		return
+	}
+
+	method := http.MethodGet
+	if action == "cancel" {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		errorlog.HTTPError(w, r, `{"type":"error","error":{"type":"invalid_request_error","message":"Method not allowed"}}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	b, err := batchStore.GetBatch(ctx, batchID)
+	if err == nil && b.UserKeyID != auth.clientAPIKey {
+		err = batch.ErrNotFound
+	}
+	if err != nil {
+		writeBatchStoreError(w, r, auth, batchID, err)
+		return
+	}
+
+	switch action {
+	case "":
+		writeBatchJSON(w, http.StatusOK, b.View(batchResultsURL(r, b.ID)))
+	case "cancel":
+		canceled, err := batchStore.CancelBatch(ctx, batchID)
+		if err != nil {
+			writeBatchStoreError(w, r, auth, batchID, err)
+			return
+		}
+		log.Printf("🛑 [Batch] %s cancel requested by %s", batchID, auth.clientKeyMask)
+		writeBatchJSON(w, http.StatusOK, canceled.View(batchResultsURL(r, canceled.ID)))
+	case "results":
+		streamMessageBatchResults(w, r, auth, b)
+	default:
+		writeBatchError(w, r, auth, http.StatusNotFound, "not_found_error", "Not found")
+	}
+}
+
+func createMessageBatch(w http.ResponseWriter, r *http.Request, auth *anthropicAuth) {
+	if !checkRateLimitWithUsername(w, auth.clientAPIKey, auth.username, true) {
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBodyBytes))
+	if err != nil {
+		writeBatchError(w, r, auth, http.StatusRequestEntityTooLarge, "request_too_large", "Request body exceeds 256MB")
+		return
+	}
+	defer r.Body.Close()
+
+	var params batch.CreateParams
+	if err := json.Unmarshal(bodyBytes, &params); err != nil {
+		writeBatchError(w, r, auth, http.StatusBadRequest, "invalid_request_error", "Invalid JSON")
+		return
+	}
+	if err := params.Validate(); err != nil {
+		writeBatchError(w, r, auth, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	for i, req := range params.Requests {
+		var messagesReq transformers.AnthropicRequest
+		if err := json.Unmarshal(req.Params, &messagesReq); err != nil {
+			writeBatchError(w, r, auth, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("requests.%d.params: %v", i, err))
+			return
+		}
+		if config.GetModelByID(messagesReq.Model) == nil {
+			writeBatchError(w, r, auth, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("requests.%d.params.model: model '%s' not found", i, messagesReq.Model))
+			return
+		}
+		if messagesReq.Stream {
+			writeBatchError(w, r, auth, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("requests.%d.params.stream: streaming is not supported in batches", i))
+			return
+		}
+	}
+
+	b, requests := batch.NewBatch(auth.username, auth.clientAPIKey, &params, time.Now())
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+	if err := batchStore.CreateBatch(ctx, b, requests); err != nil {
+		log.Printf("❌ [Batch] Failed to create batch: %v", err)
+		writeBatchError(w, r, auth, http.StatusInternalServerError, "api_error", "Failed to create message batch")
+		return
+	}
+	batchPool.Wake()
+
+	log.Printf("📦 [Batch] Created %s with %d requests (key=%s)", b.ID, len(requests), auth.clientKeyMask)
+	writeBatchJSON(w, http.StatusOK, b.View(""))
+}
+
+func listMessageBatches(w http.ResponseWriter, r *http.Request, auth *anthropicAuth) {
+	query := r.URL.Query()
+	limit := 20
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeBatchError(w, r, auth, http.StatusBadRequest, "invalid_request_error", "limit: must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	batches, hasMore, err := batchStore.ListBatches(ctx, auth.clientAPIKey, limit, query.Get("before_id"), query.Get("after_id"))
+	if err != nil {
+		log.Printf("❌ [Batch] Failed to list batches: %v", err)
+		writeBatchError(w, r, auth, http.StatusInternalServerError, "api_error", "Failed to list message batches")
+		return
+	}
+
+	data := make([]map[string]interface{}, 0, len(batches))
+	for _, b := range batches {
+		data = append(data, b.View(batchResultsURL(r, b.ID)))
+	}
+	var firstID, lastID interface{}
+	if len(batches) > 0 {
+		firstID = batches[0].ID
+		lastID = batches[len(batches)-1].ID
+	}
+	writeBatchJSON(w, http.StatusOK, map[string]interface{}{
+		"data":     data,
+		"has_more": hasMore,
+		"first_id": firstID,
+		"last_id":  lastID,
+	})
+}
+
+// streamMessageBatchResults writes one JSONL line per request, in request order
+func streamMessageBatchResults(w http.ResponseWriter, r *http.Request, auth *anthropicAuth, b *batch.MessageBatch) {
+	if b.ProcessingStatus != batch.StatusEnded {
+		writeBatchError(w, r, auth, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("Message batch %s has not finished processing", b.ID))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-jsonl")
+	w.WriteHeader(http.StatusOK)
+	err := batchStore.EachResult(r.Context(), b.ID, func(req *batch.BatchRequest) error {
+		_, err := w.Write(batch.ResultLine(req))
+		return err
+	})
+	if err != nil {
+		log.Printf("⚠️ [Batch] Results stream for %s interrupted: %v", b.ID, err)
+	}
+}
+
+// executeMessageBatchRequest runs one batch request as the batch owner through
+// serveAnthropicMessages, skipping the rate limiter and billing at batch rates
+func executeMessageBatchRequest(ctx context.Context, b *batch.MessageBatch, params []byte) (int, []byte) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/messages", bytes.NewReader(params))
+	if err != nil {
+		return http.StatusInternalServerError, nil
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("x-api-key", b.UserKeyID)
+
+	w := newBufferedResponseWriter()
+	// Re-authenticate so revoked keys and exhausted credits stop the batch
+	auth, ok := authenticateAnthropicRequest(w, r)
+	if ok {
+		serveAnthropicMessages(w, r, auth, params, true)
+	}
+	return w.statusCode, w.body.Bytes()
+}
+
+// bufferedResponseWriter captures a handler response in memory
+type bufferedResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{header: make(http.Header), statusCode: http.StatusOK}
+}
+
+func (w *bufferedResponseWriter) Header() http.Header         { return w.header }
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) { return w.body.Write(b) }
+func (w *bufferedResponseWriter) WriteHeader(statusCode int)  { w.statusCode = statusCode }
+
+// batchResultsURL returns the absolute results URL for a batch
+func batchResultsURL(r *http.Request, batchID string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/v1/messages/batches/%s/results", scheme, r.Host, batchID)
+}
+
+func writeBatchJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error: failed to encode response: %v", err)
+	}
+}
+
+func writeBatchError(w http.ResponseWriter, r *http.Request, auth *anthropicAuth, status int, errType, message string) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"type":  "error",
+		"error": map[string]interface{}{"type": errType, "message": message},
+	})
+	errorlog.JSONErrorWithUser(w, r, string(body), status, auth.username, auth.clientAPIKey)
+}
+
+func writeBatchStoreError(w http.ResponseWriter, r *http.Request, auth *anthropicAuth, batchID string, err error) {
+	switch {
+	case errors.Is(err, batch.ErrNotFound):
+		writeBatchError(w, r, auth, http.StatusNotFound, "not_found_error", fmt.Sprintf("Message batch %s not found", batchID))
+	case errors.Is(err, batch.ErrNotActive):
+		writeBatchError(w, r, auth, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("Message batch %s is not in progress", batchID))
+	default:
+		log.Printf("❌ [Batch] Store error for %s: %v", batchID, err)
+		writeBatchError(w, r, auth, http.StatusInternalServerError, "api_error", "Message batch store error")
+	}
+}
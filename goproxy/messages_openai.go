@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"goproxy/config"
+	"goproxy/internal/errorlog"
+	"goproxy/internal/sse"
+	"goproxy/transformers"
+)
+
+// /v1/messages over chat completions
+// Models whose upstream only speaks /v1/chat/completions (types without a /v1/messages
+// handler, such as openai_compat instances, or api_format "openai") are served to Anthropic clients by translating the request with
+// transformers.TransformToOpenAI, running the chat completions handler for the upstream,
+// and converting its output back with messagesWriter.
+
+// messagesViaChatCompletions reports whether /v1/messages for modelID must go through
+// the upstream's chat completions route
+func messagesViaChatCompletions(modelID, upstreamType string) bool {
+	return upstreamHandlers[upstreamType].messages == nil || config.GetModelAPIFormat(modelID) == "openai"
+}
+
+// serveMessagesViaChatCompletions serves one tier of an Anthropic Messages request on the
+// upstream's chat completions handler. Billing and usage logging stay in that handler.
+func serveMessagesViaChatCompletions(w http.ResponseWriter, r *http.Request, anthropicReq *transformers.AnthropicRequest, model *config.Model, upstreamConfig *UpstreamConfig, clientAPIKey string, username string, isBatch bool) {
+	openaiReq := transformers.TransformToOpenAI(anthropicReq)
+	openaiReq.Model = model.ID
+
+	bodyBytes, err := json.Marshal(openaiReq)
+	if err != nil {
+		log.Printf("Error: failed to serialize request: %v", err)
+		errorlog.HTTPErrorWithUser(w, r, `{"type":"error","error":{"type":"api_error","message":"Failed to serialize request"}}`, http.StatusInternalServerError, username, clientAPIKey)
+		return
+	}
+
+	log.Printf("🔄 [/v1/messages] %s via %s chat completions (messages=%d, tools=%d, stream=%v)", model.ID, upstreamConfig.Type, len(openaiReq.Messages), len(openaiReq.Tools), openaiReq.Stream)
+
+	mw := &messagesWriter{
+		ResponseWriter: w,
+		model:          anthropicReq.Model,
+		stream:         anthropicReq.Stream,
+		inputTokens:    estimateInputTokens(openaiReq),
+	}
+
+	serveChatCompletions(mw, r, upstreamConfig, openaiReq, bodyBytes, model.ID, clientAPIKey, username, isBatch)
+	mw.finish()
+}
+
+// messagesWriter rewrites chat completions output into Anthropic Messages format.
+// Streams are converted line by line; non-streaming bodies and errors are buffered
+// and converted in finish.
+type messagesWriter struct {
+	http.ResponseWriter
+	model       string
+	stream      bool
+	inputTokens int64 // prompt estimate for message_start
+	statusCode  int
+	wroteHeader bool
+	buf         bytes.Buffer // non-stream or error body, or the unterminated tail of the SSE stream
+	event       string       // current SSE event name
+	started     bool
+	transformer *transformers.OpenAIToAnthropicResponseTransformer
+}
+
+func (mw *messagesWriter) WriteHeader(code int) {
+	if mw.wroteHeader {
+		return
+	}
+	mw.wroteHeader = true
+	mw.statusCode = code
+	// Only streams are sent right away; everything else is sent from finish once converted
+	if code == http.StatusOK && mw.stream {
+		mw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (mw *messagesWriter) Write(p []byte) (int, error) {
+	if !mw.wroteHeader {
+		mw.WriteHeader(http.StatusOK)
+	}
+	mw.buf.Write(p)
+	if mw.stream && mw.statusCode == http.StatusOK {
+		if err := mw.convertStream(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Unwrap lets http.ResponseController reach the connection (write deadlines)
+func (mw *messagesWriter) Unwrap() http.ResponseWriter {
+	return mw.ResponseWriter
+}
+
+func (mw *messagesWriter) Flush() {
+	if !mw.wroteHeader || !mw.stream || mw.statusCode != http.StatusOK {
+		return
+	}
+	if flusher, ok := mw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// convertStream converts every complete SSE line in buf into Anthropic events
+func (mw *messagesWriter) convertStream() error {
+	if mw.transformer == nil {
+		mw.transformer = transformers.NewOpenAIToAnthropicResponseTransformer(mw.model)
+		mw.transformer.InputTokens = mw.inputTokens
+	}
+
+	for {
+		line, err := mw.buf.ReadString('\n')
+		if err != nil {
+			// Incomplete line - keep it until the rest arrives
+			mw.buf.Reset()
+			mw.buf.WriteString(line)
+			return nil
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		var out string
+		switch {
+		case line == "":
+			mw.event = ""
+		case strings.HasPrefix(line, ":"):
+			// Keepalive comment → the ping Anthropic clients expect
+			out = mw.startEvents() + sse.AnthropicPing
+		case strings.HasPrefix(line, "event: "):
+			mw.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			dataStr := strings.TrimPrefix(line, "data: ")
+			if strings.TrimSpace(dataStr) == "[DONE]" {
+				out = mw.startEvents() + mw.transformer.Finish()
+				break
+			}
+			var chunk map[string]interface{}
+			if err := json.Unmarshal([]byte(dataStr), &chunk); err != nil {
+				continue
+			}
+			if errData, ok := chunk["error"].(map[string]interface{}); ok || mw.event == "error" {
+				message, _ := errData["message"].(string)
+				if message == "" {
+					message = "Upstream stream error"
+				}
+				out = mw.startEvents() + mw.transformer.Fail(message)
+				break
+			}
+			out = mw.startEvents() + mw.transformer.TransformChunk(chunk)
+		}
+
+		if out != "" {
+			if _, err := io.WriteString(mw.ResponseWriter, out); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// startEvents returns message_start the first time it is called
+func (mw *messagesWriter) startEvents() string {
+	if mw.started {
+		return ""
+	}
+	mw.started = true
+	return mw.transformer.Start()
+}
+
+// finish completes the response after the chat completions handler returns
+func (mw *messagesWriter) finish() {
+	if !mw.wroteHeader {
+		return
+	}
+
+	if mw.statusCode != http.StatusOK {
+		mw.Header().Del("Content-Length")
+		mw.Header().Set("Content-Type", "application/json")
+		mw.ResponseWriter.WriteHeader(mw.statusCode)
+		mw.ResponseWriter.Write(anthropicErrorBody(mw.statusCode, mw.buf.Bytes()))
+		return
+	}
+
+	if mw.stream {
+		if mw.transformer != nil && !mw.transformer.Finished() {
+			// Upstream ended without [DONE]
+			io.WriteString(mw.ResponseWriter, mw.startEvents()+mw.transformer.Finish())
+			mw.Flush()
+		}
+		return
+	}
+
+	var chatResp map[string]interface{}
+	if err := json.Unmarshal(mw.buf.Bytes(), &chatResp); err != nil {
+		log.Printf("⚠️ [/v1/messages] Failed to parse chat completion: %v", err)
+		mw.ResponseWriter.WriteHeader(http.StatusOK)
+		mw.ResponseWriter.Write(mw.buf.Bytes())
+		return
+	}
+
+	mw.Header().Del("Content-Length")
+	mw.Header().Set("Content-Type", "application/json")
+	mw.ResponseWriter.WriteHeader(http.StatusOK)
+	transformer := transformers.NewOpenAIToAnthropicResponseTransformer(mw.model)
+	if err := json.NewEncoder(mw.ResponseWriter).Encode(transformer.TransformNonStreamResponse(chatResp)); err != nil {
+		log.Printf("Error: failed to encode response: %v", err)
+	}
+}
+
+// anthropicErrorBody converts an OpenAI error body to Anthropic's error format
+func anthropicErrorBody(statusCode int, body []byte) []byte {
+	var openaiErr struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    string `json:"code"`
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &openaiErr)
+
+	message := openaiErr.Error.Message
+	if message == "" {
+		message = http.StatusText(statusCode)
+	}
+	errType := openaiErr.Error.Type
+	if openaiErr.Error.Code == spendCapCode {
+		errType = spendCapCode
+	}
+	switch errType {
+	case "invalid_request_error", "authentication_error", "permission_error", "not_found_error", "rate_limit_error", "api_error", "overloaded_error", "insufficient_credits", spendCapCode:
+	default:
+		errType = anthropicErrorType(statusCode)
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"type": "error",
+		"error": map[string]interface{}{
+			"type":    errType,
+			"message": message,
+		},
+	})
+	return data
+}
+
+// anthropicErrorType is the Anthropic error type for an HTTP status
+func anthropicErrorType(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case 529:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
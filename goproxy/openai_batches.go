@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"goproxy/internal/errorlog"
+	"goproxy/internal/files"
+	"goproxy/internal/openaibatch"
+)
+
+// OpenAI Files (/v1/files) and Batch (/v1/batches) APIs
+// Files live in GridFS; batches replay each input line through chatCompletionsHandler in a
+// background worker pool and write the results to output and error files, billed at batch rates.
+
+const maxFileBytes = 512 << 20 // 512MB, same as OpenAI
+
+var (
+	openaiBatchStore openaibatch.Store
+	openaiBatchPool  *openaibatch.Pool
+)
+
+// batchBillingKey marks requests replayed by a batch worker. It is a context value,
+// not a header, so clients cannot claim batch pricing.
+type batchBillingKey struct{}
+
+func withBatchBilling(ctx context.Context) context.Context {
+	return context.WithValue(ctx, batchBillingKey{}, true)
+}
+
+// isBatchBillingRequest reports whether the request comes from a /v1/batches worker
+func isBatchBillingRequest(r *http.Request) bool {
+	isBatch, _ := r.Context().Value(batchBillingKey{}).(bool)
+	return isBatch
+}
+
+// startOpenAIBatchWorkers sets up the /v1/batches store and worker pool, sharing
+// BATCH_WORKERS and the interactive-load yield with the Message Batches pool
+func startOpenAIBatchWorkers() {
+	store := openaibatch.NewMongoStore()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	store.EnsureIndexes(ctx)
+	cancel()
+
+	openaiBatchStore = store
+	openaiBatchPool = openaibatch.NewPool(store, executeOpenAIBatchRequest, parseInt(getEnv("BATCH_WORKERS", "2")), shouldYieldToInteractive)
+	openaiBatchPool.Start()
+}
+
+// authenticateOpenAIRequest runs the shared key validation and rewrites its
+// Anthropic-format errors into OpenAI format
+func authenticateOpenAIRequest(w http.ResponseWriter, r *http.Request) (*anthropicAuth, bool) {
+	buffered := newBufferedResponseWriter()
+	auth, ok := authenticateAnthropicRequest(buffered, r)
+	if ok {
+		return auth, true
+	}
+
+	var anthropicErr struct {
+		Error json.RawMessage `json:"error"`
+	}
+	body := buffered.body.Bytes()
+	if json.Unmarshal(body, &anthropicErr) == nil && len(anthropicErr.Error) > 0 {
+		body, _ = json.Marshal(map[string]json.RawMessage{"error": anthropicErr.Error})
+	}
+	for key, values := range buffered.header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(buffered.statusCode)
+	w.Write(body)
+	return nil, false
+}
+
+// filesHandler serves POST (upload) and GET (list) on /v1/files
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	auth, ok := authenticateOpenAIRequest(w, r)
+	if !ok {
+		return
+	}
+	if !enforcePriorityLineAccess(w, r, auth.username, auth.clientAPIKey, false) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		uploadFile(w, r, auth)
+	case http.MethodGet:
+		listFiles(w, r, auth)
+	default:
+		errorlog.HTTPError(w, r, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+// fileHandler serves GET/DELETE /v1/files/{id} and GET /v1/files/{id}/content
+func fileHandler(w http.ResponseWriter, r *http.Request) {
+	auth, ok := authenticateOpenAIRequest(w, r)
+	if !ok {
+		return
+	}
+	if !enforcePriorityLineAccess(w, r, auth.username, auth.clientAPIKey, false) {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/files/"), "/")
+	fileID := parts[0]
+	if fileID == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "content") {
+		writeOpenAIError(w, r, auth, http.StatusNotFound, "invalid_request_error", "Not found")
+		return
+	}
+	isContent := len(parts) == 2
+	if r.Method != http.MethodGet && (isContent || r.Method != http.MethodDelete) {
+		errorlog.HTTPError(w, r, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	f, err := files.Get(ctx, fileID)
+	if err == nil && f.Metadata.UserKeyID != auth.clientAPIKey {
+		err = files.ErrNotFound
+	}
+	if err != nil {
+		writeFileStoreError(w, r, auth, fileID, err)
+		return
+	}
+
+	switch {
+	case isContent:
+		content, err := files.Open(fileID)
+		if err != nil {
+			writeFileStoreError(w, r, auth, fileID, err)
+			return
+		}
+		defer content.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(f.Bytes, 10))
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.Copy(w, content); err != nil {
+			log.Printf("⚠️ [Files] Download of %s interrupted: %v", fileID, err)
+		}
+	case r.Method == http.MethodDelete:
+		if err := files.Delete(ctx, fileID); err != nil {
+			writeFileStoreError(w, r, auth, fileID, err)
+			return
+		}
+		log.Printf("🗑️ [Files] Deleted %s (key=%s)", fileID, auth.clientKeyMask)
+		writeBatchJSON(w, http.StatusOK, map[string]interface{}{"id": fileID, "object": "file", "deleted": true})
+	default:
+		writeBatchJSON(w, http.StatusOK, f.View())
+	}
+}
+
+func uploadFile(w http.ResponseWriter, r *http.Request, auth *anthropicAuth) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileBytes)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeOpenAIError(w, r, auth, http.StatusBadRequest, "invalid_request_error", "Expected a multipart/form-data body of at most 512MB with 'file' and 'purpose' fields")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	if purpose := r.FormValue("purpose"); purpose != files.PurposeBatch {
+		writeOpenAIError(w, r, auth, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("purpose: only '%s' is supported", files.PurposeBatch))
+		return
+	}
+	upload, header, err := r.FormFile("file")
+	if err != nil {
+		writeOpenAIError(w, r, auth, http.StatusBadRequest, "invalid_request_error", "file: is required")
+		return
+	}
+	defer upload.Close()
+	if !strings.HasSuffix(header.Filename, ".jsonl") {
+		writeOpenAIError(w, r, auth, http.StatusBadRequest, "invalid_request_error", "file: batch input files must be .jsonl")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+	f, err := files.Upload(ctx, auth.clientAPIKey, header.Filename, files.PurposeBatch, upload)
+	if err != nil {
+		log.Printf("❌ [Files] Failed to store upload: %v", err)
+		writeOpenAIError(w, r, auth, http.StatusInternalServerError, "server_error", "Failed to store file")
+		return
+	}
+
+	log.Printf("📁 [Files] Uploaded %s (%d bytes, key=%s)", f.ID, f.Bytes, auth.clientKeyMask)
+	writeBatchJSON(w, http.StatusOK, f.View())
+}
+
+func listFiles(w http.ResponseWriter, r *http.Request, auth *anthropicAuth) {
+	query := r.URL.Query()
+	limit, ok := parseListLimit(w, r, auth, query.Get("limit"), 10000)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	list, hasMore, err := files.List(ctx, auth.clientAPIKey, query.Get("purpose"), limit, query.Get("after"))
+	if err != nil {
+		log.Printf("❌ [Files] Failed to list files: %v", err)
+		writeOpenAIError(w, r, auth, http.StatusInternalServerError, "server_error", "Failed to list files")
+		return
+	}
+
+	data := make([]map[string]interface{}, 0, len(list))
+	for _, f := range list {
+		data = append(data, f.View())
+	}
+	writeOpenAIList(w, data, hasMore)
+}
+
+// openAIBatchesHandler serves POST (create) and GET (list) on /v1/batches
+func openAIBatchesHandler(w http.ResponseWriter, r *http.Request) {
+	auth, ok := authenticateOpenAIRequest(w, r)
+	if !ok {
+		return
+	}
+	if !enforcePriorityLineAccess(w, r, auth.username, auth.clientAPIKey, false) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		createOpenAIBatch(w, r, auth)
+	case http.MethodGet:
+		listOpenAIBatches(w, r, auth)
+	default:
+		errorlog.HTTPError(w, r, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+// openAIBatchHandler serves GET /v1/batches/{id} and POST /v1/batches/{id}/cancel
+func openAIBatchHandler(w http.ResponseWriter, r *http.Request) {
+	auth, ok := authenticateOpenAIRequest(w, r)
+	if !ok {
+		return
+	}
+	if !enforcePriorityLineAccess(w, r, auth.username, auth.clientAPIKey, false) {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/batches/"), "/")
+	batchID := parts[0]
+	if batchID == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "cancel") {
+		writeOpenAIError(w, r, auth, http.StatusNotFound, "invalid_request_error", "Not found")
+		return
+	}
+	isCancel := len(parts) == 2
+	method := http.MethodGet
+	if isCancel {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		errorlog.HTTPError(w, r, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	b, err := openaiBatchStore.GetBatch(ctx, batchID)
+	if err == nil && b.UserKeyID != auth.clientAPIKey {
+		err = openaibatch.ErrNotFound
+	}
+	if err != nil {
+		writeOpenAIBatchStoreError(w, r, auth, batchID, err)
+		return
+	}
+
+	if !isCancel {
+		writeBatchJSON(w, http.StatusOK, b.View())
+		return
+	}
+	cancelled, err := openaiBatchStore.CancelBatch(ctx, batchID)
+	if err != nil {
+		writeOpenAIBatchStoreError(w, r, auth, batchID, err)
+		return
+	}
+	openaiBatchPool.Wake()
+	log.Printf("🛑 [OpenAIBatch] %s cancel requested by %s", batchID, auth.clientKeyMask)
+	writeBatchJSON(w, http.StatusOK, cancelled.View())
+}
+
+func createOpenAIBatch(w http.ResponseWriter, r *http.Request, auth *anthropicAuth) {
+	if !checkRateLimitWithUsername(w, auth.clientAPIKey, auth.username, false) {
+		return
+	}
+
+	var params openaibatch.CreateParams
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&params); err != nil {
+		writeOpenAIError(w, r, auth, http.StatusBadRequest, "invalid_request_error", "Invalid JSON")
+		return
+	}
+	if err := params.Validate(); err != nil {
+		writeOpenAIError(w, r, auth, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	input, err := files.Get(ctx, params.InputFileID)
+	if err == nil && input.Metadata.UserKeyID != auth.clientAPIKey {
+		err = files.ErrNotFound
+	}
+	if err != nil {
+		writeFileStoreError(w, r, auth, params.InputFileID, err)
+		return
+	}
+	if input.Metadata.Purpose != files.PurposeBatch {
+		writeOpenAIError(w, r, auth, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("input_file_id: file %s must have purpose '%s'", input.ID, files.PurposeBatch))
+		return
+	}
+
+	b := openaibatch.NewBatch(auth.username, auth.clientAPIKey, &params, time.Now())
+	if err := openaiBatchStore.CreateBatch(ctx, b); err != nil {
+		log.Printf("❌ [OpenAIBatch] Failed to create batch: %v", err)
+		writeOpenAIError(w, r, auth, http.StatusInternalServerError, "server_error", "Failed to create batch")
+		return
+	}
+	openaiBatchPool.Wake()
+
+	log.Printf("📦 [OpenAIBatch] Created %s from %s (key=%s)", b.ID, input.ID, auth.clientKeyMask)
+	writeBatchJSON(w, http.StatusOK, b.View())
+}
+
+func listOpenAIBatches(w http.ResponseWriter, r *http.Request, auth *anthropicAuth) {
+	query := r.URL.Query()
+	limit, ok := parseListLimit(w, r, auth, query.Get("limit"), 100)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	batches, hasMore, err := openaiBatchStore.ListBatches(ctx, auth.clientAPIKey, limit, query.Get("after"))
+	if err != nil {
+		log.Printf("❌ [OpenAIBatch] Failed to list batches: %v", err)
+		writeOpenAIError(w, r, auth, http.StatusInternalServerError, "server_error", "Failed to list batches")
+		return
+	}
+
+	data := make([]map[string]interface{}, 0, len(batches))
+	for _, b := range batches {
+		data = append(data, b.View())
+	}
+	writeOpenAIList(w, data, hasMore)
+}
+
+// executeOpenAIBatchRequest replays one input line as the batch owner through
+// chatCompletionsHandler, skipping the rate limiter and billing at batch rates
+func executeOpenAIBatchRequest(ctx context.Context, b *openaibatch.Batch, body []byte) (int, []byte) {
+	r, err := http.NewRequestWithContext(withBatchBilling(ctx), http.MethodPost, openaibatch.EndpointChatCompletions, bytes.NewReader(body))
+	if err != nil {
+		return http.StatusInternalServerError, nil
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+b.UserKeyID)
+
+	w := newBufferedResponseWriter()
+	chatCompletionsHandler(w, r)
+	return w.statusCode, w.body.Bytes()
+}
+
+// parseListLimit parses the limit query parameter (default 20)
+func parseListLimit(w http.ResponseWriter, r *http.Request, auth *anthropicAuth, value string, max int) (int, bool) {
+	if value == "" {
+		return 20, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > max {
+		writeOpenAIError(w, r, auth, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("limit: must be between 1 and %d", max))
+		return 0, false
+	}
+	return n, true
+}
+
+func writeOpenAIList(w http.ResponseWriter, data []map[string]interface{}, hasMore bool) {
+	var firstID, lastID interface{}
+	if len(data) > 0 {
+		firstID = data[0]["id"]
+		lastID = data[len(data)-1]["id"]
+	}
+	writeBatchJSON(w, http.StatusOK, map[string]interface{}{
+		"object":   "list",
+		"data":     data,
+		"first_id": firstID,
+		"last_id":  lastID,
+		"has_more": hasMore,
+	})
+}
+
+func writeOpenAIError(w http.ResponseWriter, r *http.Request, auth *anthropicAuth, status int, errType, message string) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "type": errType, "param": nil, "code": nil},
+	})
+	errorlog.JSONErrorWithUser(w, r, string(body), status, auth.username, auth.clientAPIKey)
+}
+
+func writeFileStoreError(w http.ResponseWriter, r *http.Request, auth *anthropicAuth, fileID string, err error) {
+	if errors.Is(err, files.ErrNotFound) {
+		writeOpenAIError(w, r, auth, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("No such File object: %s", fileID))
+		return
+	}
+	log.Printf("❌ [Files] Store error for %s: %v", fileID, err)
+	writeOpenAIError(w, r, auth, http.StatusInternalServerError, "server_error", "File store error")
+}
+
+func writeOpenAIBatchStoreError(w http.ResponseWriter, r *http.Request, auth *anthropicAuth, batchID string, err error) {
+	switch {
+	case errors.Is(err, openaibatch.ErrNotFound):
+		writeOpenAIError(w, r, auth, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("No such Batch object: %s", batchID))
+	case errors.Is(err, openaibatch.ErrNotActive):
+		writeOpenAIError(w, r, auth, http.StatusConflict, "invalid_request_error", fmt.Sprintf("Batch %s cannot be cancelled in its current status", batchID))
+	default:
+		log.Printf("❌ [OpenAIBatch] Store error for %s: %v", batchID, err)
+		writeOpenAIError(w, r, auth, http.StatusInternalServerError, "server_error", "Batch store error")
+	}
+}
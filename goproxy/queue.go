@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"goproxy/internal/admission"
+	"goproxy/internal/provider"
+	"goproxy/internal/sse"
+)
+
+// Admission queue for the last upstream of a chain
+// When every key of the upstream is rate limited, a request waits in the upstream's queue
+// (admission.Queue) for up to admission.MaxWait instead of failing with 503 right away.
+// Streaming requests are answered with SSE headers and keepalives while they wait, so the
+// client and any proxy in between do not time out; their status line is gone by the time the
+// upstream answers, so an error becomes an error event instead.
+
+// queueTimeoutHeader lets a client cap the wait in seconds; 0 fails fast
+const queueTimeoutHeader = "X-Queue-Timeout"
+
+type streamKeepaliveKey struct{}
+
+// withStreamKeepalive marks r as a streaming request whose format uses keepalive
+// (sse.AnthropicPing or sse.OpenAIKeepalive)
+func withStreamKeepalive(r *http.Request, keepalive string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), streamKeepaliveKey{}, keepalive))
+}
+
+func streamKeepaliveFor(r *http.Request) string {
+	keepalive, _ := r.Context().Value(streamKeepaliveKey{}).(string)
+	return keepalive
+}
+
+// queueTimeout is how long r may wait for a key: admission.MaxWait unless the client asked
+// for less
+func queueTimeout(r *http.Request) time.Duration {
+	v := r.Header.Get(queueTimeoutHeader)
+	if v == "" {
+		return admission.MaxWait
+	}
+	secs, err := strconv.ParseFloat(v, 64)
+	if err != nil || secs < 0 {
+		return admission.MaxWait
+	}
+	if wait := time.Duration(secs * float64(time.Second)); wait < admission.MaxWait {
+		return wait
+	}
+	return admission.MaxWait
+}
+
+// admit waits until upstream has a key available for r. It returns the writer the request
+// must be served with: a queued stream has already sent its headers, and finish turns a late
+// error response into an error event. release frees the key slot an admitted request holds in
+// the queue; call it once the upstream has answered. A request that gives up is still served,
+// which answers it with the upstream's usual "no keys" error. Requests take turns by client,
+// the user when known so one user's several keys do not get several turns.
+func admit(w http.ResponseWriter, r *http.Request, upstream string, p provider.Provider, client string) (tierWriter http.ResponseWriter, finish func(), release func(), err error) {
+	avail, ok := p.(provider.KeyAvailability)
+	if !ok {
+		return w, func() {}, func() {}, nil
+	}
+
+	var queued *queuedStream
+	var heartbeat *sse.Writer
+	start := time.Now()
+	release, err = admission.For(upstream).Wait(r.Context(), client, queueTimeout(r), avail.AvailableKeys, func() {
+		log.Printf("⏳ [Admission] %s: no available key, queued (depth %d)", upstream, admission.For(upstream).Stats().Depth)
+		if keepalive := streamKeepaliveFor(r); keepalive != "" {
+			queued = startQueuedStream(w, keepalive)
+			heartbeat = sse.StartHeartbeat(w, keepalive)
+		}
+	})
+	if heartbeat != nil {
+		heartbeat.Stop()
+	}
+
+	switch {
+	case err == nil && time.Since(start) > time.Millisecond:
+		log.Printf("✅ [Admission] %s: admitted after %v", upstream, time.Since(start).Round(time.Millisecond))
+	case errors.Is(err, admission.ErrTimeout), errors.Is(err, admission.ErrQueueFull):
+		log.Printf("⚠️ [Admission] %s: %v after %v", upstream, err, time.Since(start).Round(time.Millisecond))
+		err = nil
+	}
+	if release == nil {
+		release = func() {}
+	}
+
+	if queued == nil {
+		return w, func() {}, release, err
+	}
+	return queued, queued.finish, release, err
+}
+
+// queuedStream is the writer of a streaming request whose SSE headers were sent while it
+// was queued. Headers the handler sets later are dropped; an error response is held back
+// and sent as an error event by finish.
+type queuedStream struct {
+	http.ResponseWriter
+	anthropic bool
+	header    http.Header // scratch, the real headers are gone
+	status    int
+	errBody   bytes.Buffer
+}
+
+func startQueuedStream(w http.ResponseWriter, keepalive string) *queuedStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return &queuedStream{ResponseWriter: w, anthropic: keepalive == sse.AnthropicPing, header: http.Header{}}
+}
+
+func (q *queuedStream) Header() http.Header {
+	return q.header
+}
+
+func (q *queuedStream) WriteHeader(code int) {
+	if q.status == 0 {
+		q.status = code
+	}
+}
+
+func (q *queuedStream) Write(p []byte) (int, error) {
+	if q.status == 0 {
+		q.status = http.StatusOK
+	}
+	if q.status >= http.StatusBadRequest {
+		return q.errBody.Write(p)
+	}
+	return q.ResponseWriter.Write(p)
+}
+
+func (q *queuedStream) Flush() {
+	if flusher, ok := q.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection (write deadlines)
+func (q *queuedStream) Unwrap() http.ResponseWriter {
+	return q.ResponseWriter
+}
+
+// finish sends a held-back error response as an error event in the request's format
+func (q *queuedStream) finish() {
+	if q.status < http.StatusBadRequest {
+		return
+	}
+	var event string
+	if q.anthropic {
+		event = fmt.Sprintf("event: error\ndata: %s\n\n", anthropicErrorBody(q.status, q.errBody.Bytes()))
+	} else {
+		event = fmt.Sprintf("data: %s\n\n", openAIErrorBody(q.status, q.errBody.Bytes()))
+	}
+	q.ResponseWriter.Write([]byte(event))
+	q.Flush()
+}
+
+// openAIErrorBody compacts an OpenAI error body onto one line, wrapping anything else
+func openAIErrorBody(statusCode int, body []byte) []byte {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, bytes.TrimSpace(body)); err == nil && bytes.HasPrefix(compact.Bytes(), []byte(`{"error"`)) {
+		return compact.Bytes()
+	}
+	message := string(bytes.TrimSpace(body))
+	if message == "" {
+		message = http.StatusText(statusCode)
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    "server_error",
+		},
+	})
+	return data
+}
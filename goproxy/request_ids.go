@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Request IDs
+// Every billed request gets an ID, returned to the client in X-Request-Id. It is the request
+// log's requestId and the idempotency key of the request's credit ledger entries, so a
+// disputed charge can be traced from the client to the balance change. Client-supplied IDs
+// are not trusted: a reused ID would make the ledger skip a charge.
+
+const requestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// withRequestID assigns r a new request ID and returns it to the client
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	b := make([]byte, 12)
+	rand.Read(b)
+	id := "req_" + hex.EncodeToString(b)
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// requestIDFor returns the request ID of r (the upstream request of a response works too)
+func requestIDFor(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
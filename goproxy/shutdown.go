@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"goproxy/db"
+	"goproxy/internal/ledger"
+	"goproxy/internal/openhands"
+	"goproxy/internal/provider"
+	"goproxy/internal/usage"
+)
+
+// Graceful shutdown
+// On SIGTERM or SIGINT the instance drains: /health reports "draining" with a 503, new
+// requests are refused and the ones in flight, streams included, get SHUTDOWN_TIMEOUT to
+// finish; batch requests still running then are cancelled and go back to pending. Then the
+// background jobs stop, the usage batcher writes what it has queued and MongoDB is
+// disconnected. A second signal kills the process.
+
+var (
+	draining       atomic.Bool
+	activeRequests atomic.Int64
+
+	reconciler *ledger.Reconciler // nil if LEDGER_RECONCILE_ENABLED is off
+)
+
+// closeGrace is how long handlers get to return once their connections were closed at the
+// deadline, so the requests they served are still billed
+const closeGrace = 5 * time.Second
+
+// trackRequests counts the requests in flight and refuses new ones while draining.
+// /health is always served so load balancers can see the instance draining.
+func trackRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() && r.URL.Path != "/health" {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, `{"error": {"message": "Server is shutting down, please retry", "type": "server_error"}}`, http.StatusServiceUnavailable)
+			return
+		}
+		activeRequests.Add(1)
+		defer activeRequests.Add(-1)
+		next(w, r)
+	}
+}
+
+// serve runs server until SIGTERM or SIGINT, then shuts the instance down. drainDelay is
+// how long /health reports draining before the listener closes; timeout bounds the whole drain.
+func serve(server *http.Server, drainDelay, timeout time.Duration) {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-serveErr:
+		log.Fatalf("❌ Server failed to start: %v", err)
+	case sig := <-signals:
+		log.Printf("🛑 Received %v, draining %d requests (timeout %v)", sig, activeRequests.Load(), timeout)
+	}
+	signal.Stop(signals)
+
+	shutdown(server, drainDelay, timeout)
+}
+
+// shutdown drains the server and stops everything main started
+func shutdown(server *http.Server, drainDelay, timeout time.Duration) {
+	draining.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Batch workers stop claiming and finish what they run within the same deadline, at which
+	// their runs are cancelled
+	batchesStopped := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, stop := range []func(context.Context){batchPool.Stop, openaiBatchPool.Stop} {
+			wg.Add(1)
+			go func(stop func(context.Context)) {
+				defer wg.Done()
+				stop(ctx)
+			}(stop)
+		}
+		wg.Wait()
+		close(batchesStopped)
+	}()
+
+	if drainDelay > 0 {
+		select {
+		case <-time.After(drainDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	// Shutdown closes the listener and idle connections, then waits for active ones
+	start := time.Now()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("⚠️ %d requests still in flight after %v, closing their connections", activeRequests.Load(), timeout)
+		server.Close()
+		for deadline := time.Now().Add(closeGrace); activeRequests.Load() > 0 && time.Now().Before(deadline); {
+			time.Sleep(100 * time.Millisecond)
+		}
+	} else {
+		log.Printf("✅ Requests drained in %v", time.Since(start))
+	}
+
+	// Batch runs bill through the usage batcher, which is only stopped once they all returned
+	<-batchesStopped
+
+	healthChecker.Stop()
+	proxyPool.StopAutoReload()
+	trollKeyPool.StopAutoReload()
+	provider.StopAll()
+	openhands.StopBackupKeyCleanupJob()
+	if reconciler != nil {
+		reconciler.Stop()
+	}
+
+	if usage.UseBatchedWrites {
+		stats := usage.GetBatcher().Stats()
+		usage.GetBatcher().Stop()
+		log.Printf("✅ Usage batcher flushed (%d request logs, %d usage updates, %d credit updates queued)", stats.RequestLogs, stats.Usage, stats.Credits)
+	}
+
+	db.Disconnect()
+	log.Printf("👋 Shutdown complete")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"goproxy/internal/spendcap"
+)
+
+// Spend caps
+// Users and user keys may carry a spendPolicy with a daily and a monthly USD cap and a
+// per-request maximum (internal/spendcap). Requests over a cap are refused with a 402 and
+// the code spend_cap_exceeded; alerts go out at 50, 80 and 100% of the daily and monthly caps.
+
+// spendCapCode is the error code of requests refused by a spend cap
+const spendCapCode = "spend_cap_exceeded"
+
+// spendCapMessage is the client-facing message of a refused request
+func spendCapMessage(e *spendcap.ExceededError) string {
+	return fmt.Sprintf("Spend cap exceeded: %s", e.Error())
+}
+
+// openaiSpendCapError is the OpenAI-format body of a request refused by a spend cap
+func openaiSpendCapError(e *spendcap.ExceededError) string {
+	data, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": spendCapMessage(e),
+			"type":    "insufficient_quota",
+			"code":    spendCapCode,
+			"window":  e.Window,
+			"limit":   e.Limit,
+		},
+	})
+	return string(data)
+}
+
+// anthropicSpendCapError is the Anthropic-format body of a request refused by a spend cap
+func anthropicSpendCapError(e *spendcap.ExceededError) string {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type": "error",
+		"error": map[string]interface{}{
+			"type":    spendCapCode,
+			"message": spendCapMessage(e),
+		},
+	})
+	return string(data)
+}
+
+// spendCapStats reports the spend cap guard, or nil if it is not running
+func spendCapStats() *spendcap.Stats {
+	guard := spendcap.Default()
+	if guard == nil {
+		return nil
+	}
+	stats := guard.Stats()
+	return &stats
+}
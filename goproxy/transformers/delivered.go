@@ -0,0 +1,89 @@
+package transformers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// DeliveredOutput collects the generated text of stream events already written to the
+// client. When the client disconnects the final usage event never arrives, so the
+// delivered text is tokenized to bill only what was actually sent.
+type DeliveredOutput struct {
+	text strings.Builder
+}
+
+// AddAnthropicEvent records a content_block_delta (text, thinking or tool input JSON)
+func (d *DeliveredOutput) AddAnthropicEvent(event map[string]interface{}) {
+	if event["type"] != "content_block_delta" {
+		return
+	}
+	delta, ok := event["delta"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	for _, field := range []string{"text", "thinking", "partial_json"} {
+		if s, ok := delta[field].(string); ok {
+			d.text.WriteString(s)
+		}
+	}
+}
+
+// AddOpenAIChunk records the delta content, reasoning and tool call arguments of a chat.completion.chunk
+func (d *DeliveredOutput) AddOpenAIChunk(chunk map[string]interface{}) {
+	choices, _ := chunk["choices"].([]interface{})
+	for _, c := range choices {
+		choice, _ := c.(map[string]interface{})
+		delta, ok := choice["delta"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, field := range []string{"content", "reasoning_content", "reasoning"} {
+			if s, ok := delta[field].(string); ok {
+				d.text.WriteString(s)
+			}
+		}
+		toolCalls, _ := delta["tool_calls"].([]interface{})
+		for _, tc := range toolCalls {
+			tcMap, _ := tc.(map[string]interface{})
+			if fn, ok := tcMap["function"].(map[string]interface{}); ok {
+				if name, ok := fn["name"].(string); ok {
+					d.text.WriteString(name)
+				}
+				if args, ok := fn["arguments"].(string); ok {
+					d.text.WriteString(args)
+				}
+			}
+		}
+	}
+}
+
+// AddOpenAISSE records the chat.completion.chunk events of already-formatted SSE output
+func (d *DeliveredOutput) AddOpenAISSE(sse string) {
+	for _, line := range strings.Split(sse, "\n") {
+		dataStr, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var chunk map[string]interface{}
+		if json.Unmarshal([]byte(dataStr), &chunk) == nil {
+			d.AddOpenAIChunk(chunk)
+		}
+	}
+}
+
+// Tokens counts the delivered text with the model's tokenizer
+func (d *DeliveredOutput) Tokens(modelID string) int64 {
+	if d.text.Len() == 0 {
+		return 0
+	}
+	return int64(encodingForModel(modelID).Count(d.text.String()))
+}
+
+// ClientCancelled reports whether the upstream response was cut short because the
+// client disconnected (the upstream request carries the client request's context)
+func ClientCancelled(resp *http.Response) bool {
+	return resp != nil && resp.Request != nil && errors.Is(resp.Request.Context().Err(), context.Canceled)
+}
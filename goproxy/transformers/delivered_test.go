@@ -0,0 +1,97 @@
+package transformers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func decodeEvent(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var event map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &event); err != nil {
+		t.Fatalf("invalid event %s: %v", s, err)
+	}
+	return event
+}
+
+// =============================================================================
+// Delivered Output Tests
+// =============================================================================
+
+func TestDeliveredOutput_AnthropicEvents(t *testing.T) {
+	var d DeliveredOutput
+	events := []string{
+		`{"type":"message_start","message":{"usage":{"input_tokens":10}}}`,
+		`{"type":"content_block_delta","delta":{"type":"thinking_delta","thinking":"Let me think. "}}`,
+		`{"type":"content_block_delta","delta":{"type":"text_delta","text":"Hello world"}}`,
+		`{"type":"content_block_delta","delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`,
+		`{"type":"message_delta","usage":{"output_tokens":99}}`,
+	}
+	for _, e := range events {
+		d.AddAnthropicEvent(decodeEvent(t, e))
+	}
+
+	expected := int64(encodingForModel("").Count(`Let me think. Hello world{"city":`))
+	if got := d.Tokens(""); got != expected {
+		t.Errorf("Expected %d tokens, got %d", expected, got)
+	}
+}
+
+func TestDeliveredOutput_OpenAIChunks(t *testing.T) {
+	var d DeliveredOutput
+	d.AddOpenAIChunk(decodeEvent(t, `{"choices":[{"delta":{"role":"assistant","reasoning_content":"Hmm. "}}]}`))
+	d.AddOpenAIChunk(decodeEvent(t, `{"choices":[{"delta":{"content":"Sunny"}}]}`))
+	d.AddOpenAIChunk(decodeEvent(t, `{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"name":"get_weather","arguments":"{}"}}]}}]}`))
+	d.AddOpenAIChunk(decodeEvent(t, `{"choices":[],"usage":{"completion_tokens":5}}`))
+
+	var fromSSE DeliveredOutput
+	fromSSE.AddOpenAISSE("data: {\"choices\":[{\"delta\":{\"role\":\"assistant\",\"reasoning_content\":\"Hmm. \"}}]}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"content\":\"Sunny\"}}]}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"name\":\"get_weather\",\"arguments\":\"{}\"}}]}}]}\n\n" +
+		"data: [DONE]\n\n")
+
+	expected := int64(encodingForModel("").Count("Hmm. Sunnyget_weather{}"))
+	if got := d.Tokens(""); got != expected {
+		t.Errorf("Expected %d tokens from chunks, got %d", expected, got)
+	}
+	if got := fromSSE.Tokens(""); got != expected {
+		t.Errorf("Expected %d tokens from SSE, got %d", expected, got)
+	}
+}
+
+func TestDeliveredOutput_Empty(t *testing.T) {
+	var d DeliveredOutput
+	d.AddAnthropicEvent(decodeEvent(t, `{"type":"ping"}`))
+	if got := d.Tokens(""); got != 0 {
+		t.Errorf("Expected 0 tokens, got %d", got)
+	}
+}
+
+func TestClientCancelled(t *testing.T) {
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	timedOutCtx, cancelTimeout := context.WithTimeout(context.Background(), 0)
+	defer cancelTimeout()
+
+	tests := []struct {
+		name     string
+		resp     *http.Response
+		expected bool
+	}{
+		{"nil response", nil, false},
+		{"no request", &http.Response{}, false},
+		{"active", &http.Response{Request: (&http.Request{}).WithContext(context.Background())}, false},
+		{"cancelled", &http.Response{Request: (&http.Request{}).WithContext(cancelledCtx)}, true},
+		{"deadline exceeded", &http.Response{Request: (&http.Request{}).WithContext(timedOutCtx)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClientCancelled(tt.resp); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
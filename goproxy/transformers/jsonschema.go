@@ -0,0 +1,272 @@
+package transformers
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// ValidateJSONSchema checks a decoded JSON value against a JSON Schema.
+// It covers the subset OpenAI structured outputs accept: type, properties, required,
+// additionalProperties, items, enum, const, anyOf/oneOf/allOf, $ref into $defs/definitions
+// and the basic string/number/array bounds.
+// The returned error names the offending path, e.g. "$.items[2].name: expected string, got number".
+func ValidateJSONSchema(schema map[string]interface{}, value interface{}) error {
+	v := &schemaValidator{root: schema}
+	return v.validate(schema, value, "$", 0)
+}
+
+// maxSchemaDepth bounds $ref recursion on self-referencing schemas
+const maxSchemaDepth = 64
+
+type schemaValidator struct {
+	root map[string]interface{}
+}
+
+func (v *schemaValidator) validate(schema map[string]interface{}, value interface{}, path string, depth int) error {
+	if schema == nil {
+		return nil
+	}
+	if depth > maxSchemaDepth {
+		return fmt.Errorf("%s: schema nesting too deep", path)
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, err := v.resolveRef(ref)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		return v.validate(resolved, value, path, depth+1)
+	}
+
+	if types, ok := schema["type"]; ok {
+		if err := checkType(types, value, path); err != nil {
+			return err
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if jsonEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value %v is not one of %v", path, value, enum)
+		}
+	}
+	if constValue, ok := schema["const"]; ok && !jsonEqual(constValue, value) {
+		return fmt.Errorf("%s: expected constant %v", path, constValue)
+	}
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			subSchema, _ := sub.(map[string]interface{})
+			if err := v.validate(subSchema, value, path, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if options, ok := schema[key].([]interface{}); ok {
+			var firstErr error
+			matched := false
+			for _, sub := range options {
+				subSchema, _ := sub.(map[string]interface{})
+				if err := v.validate(subSchema, value, path, depth+1); err == nil {
+					matched = true
+					break
+				} else if firstErr == nil {
+					firstErr = err
+				}
+			}
+			if !matched {
+				return fmt.Errorf("%s: value does not match any of the %s options (%v)", path, key, firstErr)
+			}
+		}
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		return v.validateObject(schema, val, path, depth)
+	case []interface{}:
+		return v.validateArray(schema, val, path, depth)
+	case string:
+		return validateString(schema, val, path)
+	case float64:
+		return validateNumber(schema, val, path)
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateObject(schema map[string]interface{}, obj map[string]interface{}, path string, depth int) error {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, present := obj[name]; !present {
+					return fmt.Errorf("%s: missing required property '%s'", path, name)
+				}
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	for name, propValue := range obj {
+		propPath := path + "." + name
+		if propSchema, ok := properties[name].(map[string]interface{}); ok {
+			if err := v.validate(propSchema, propValue, propPath, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: additional property '%s' is not allowed", path, name)
+			}
+		case map[string]interface{}:
+			if err := v.validate(additional, propValue, propPath, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateArray(schema map[string]interface{}, arr []interface{}, path string, depth int) error {
+	if min, ok := schemaInt(schema, "minItems"); ok && len(arr) < min {
+		return fmt.Errorf("%s: expected at least %d items, got %d", path, min, len(arr))
+	}
+	if max, ok := schemaInt(schema, "maxItems"); ok && len(arr) > max {
+		return fmt.Errorf("%s: expected at most %d items, got %d", path, max, len(arr))
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		for i, item := range arr {
+			if err := v.validate(items, item, fmt.Sprintf("%s[%d]", path, i), depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateString(schema map[string]interface{}, s string, path string) error {
+	length := len([]rune(s))
+	if min, ok := schemaInt(schema, "minLength"); ok && length < min {
+		return fmt.Errorf("%s: expected at least %d characters, got %d", path, min, length)
+	}
+	if max, ok := schemaInt(schema, "maxLength"); ok && length > max {
+		return fmt.Errorf("%s: expected at most %d characters, got %d", path, max, length)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err == nil && !re.MatchString(s) {
+			return fmt.Errorf("%s: value does not match pattern %s", path, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNumber(schema map[string]interface{}, n float64, path string) error {
+	if min, ok := schema["minimum"].(float64); ok && n < min {
+		return fmt.Errorf("%s: %v is less than minimum %v", path, n, min)
+	}
+	if max, ok := schema["maximum"].(float64); ok && n > max {
+		return fmt.Errorf("%s: %v is greater than maximum %v", path, n, max)
+	}
+	if min, ok := schema["exclusiveMinimum"].(float64); ok && n <= min {
+		return fmt.Errorf("%s: %v must be greater than %v", path, n, min)
+	}
+	if max, ok := schema["exclusiveMaximum"].(float64); ok && n >= max {
+		return fmt.Errorf("%s: %v must be less than %v", path, n, max)
+	}
+	return nil
+}
+
+// checkType validates the JSON type; types may be a single name or a list of names
+func checkType(types interface{}, value interface{}, path string) error {
+	var allowed []string
+	switch t := types.(type) {
+	case string:
+		allowed = []string{t}
+	case []interface{}:
+		for _, name := range t {
+			if s, ok := name.(string); ok {
+				allowed = append(allowed, s)
+			}
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	actual := jsonTypeName(value)
+	for _, name := range allowed {
+		if name == actual || (name == "number" && actual == "integer") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(allowed, " or "), actual)
+}
+
+func jsonTypeName(value interface{}) string {
+	switch val := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) && !math.IsInf(val, 0) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// resolveRef resolves local references such as "#/$defs/Item" or "#"
+func (v *schemaValidator) resolveRef(ref string) (map[string]interface{}, error) {
+	if ref == "#" {
+		return v.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported $ref %q (only local references are allowed)", ref)
+	}
+
+	var node interface{} = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		node = m[part]
+	}
+	resolved, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unresolvable $ref %q", ref)
+	}
+	return resolved, nil
+}
+
+func schemaInt(schema map[string]interface{}, key string) (int, bool) {
+	if n, ok := schema[key].(float64); ok {
+		return int(n), true
+	}
+	return 0, false
+}
+
+func jsonEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
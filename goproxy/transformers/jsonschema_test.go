@@ -0,0 +1,87 @@
+package transformers
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// JSON Schema Validation Tests
+// =============================================================================
+
+func TestValidateJSONSchema(t *testing.T) {
+	schema := map[string]interface{}{}
+	json.Unmarshal([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"role": {"enum": ["admin", "user"]},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+			"owner": {"$ref": "#/$defs/Person"},
+			"score": {"anyOf": [{"type": "number"}, {"type": "null"}]}
+		},
+		"required": ["name"],
+		"additionalProperties": false,
+		"$defs": {
+			"Person": {"type": "object", "properties": {"email": {"type": "string"}}, "required": ["email"]}
+		}
+	}`), &schema)
+
+	tests := []struct {
+		name     string
+		value    string
+		errorHas string // substring of the expected error, "" if valid
+	}{
+		{"valid minimal", `{"name":"a"}`, ""},
+		{"valid full", `{"name":"a","age":3,"role":"user","tags":["x"],"owner":{"email":"e"},"score":null}`, ""},
+		{"missing required", `{"age":3}`, "$: missing required property 'name'"},
+		{"wrong type", `{"name":5}`, "$.name: expected string, got integer"},
+		{"integer expected", `{"name":"a","age":1.5}`, "$.age: expected integer, got number"},
+		{"below minimum", `{"name":"a","age":-1}`, "less than minimum"},
+		{"empty string", `{"name":""}`, "at least 1 characters"},
+		{"enum", `{"name":"a","role":"root"}`, "$.role: value root is not one of"},
+		{"item type", `{"name":"a","tags":["x",1]}`, "$.tags[1]: expected string"},
+		{"too many items", `{"name":"a","tags":["x","y","z"]}`, "at most 2 items"},
+		{"additional property", `{"name":"a","extra":true}`, "additional property 'extra'"},
+		{"ref", `{"name":"a","owner":{}}`, "$.owner: missing required property 'email'"},
+		{"anyOf", `{"name":"a","score":"high"}`, "$.score: value does not match any of the anyOf options"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value interface{}
+			if err := json.Unmarshal([]byte(tt.value), &value); err != nil {
+				t.Fatalf("invalid value: %v", err)
+			}
+			err := ValidateJSONSchema(schema, value)
+			if tt.errorHas == "" {
+				if err != nil {
+					t.Errorf("Expected valid, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errorHas) {
+				t.Errorf("Expected error containing %q, got %v", tt.errorHas, err)
+			}
+		})
+	}
+}
+
+func TestValidateJSONSchema_RecursiveRef(t *testing.T) {
+	schema := map[string]interface{}{}
+	json.Unmarshal([]byte(`{
+		"type": "object",
+		"properties": {"value": {"type": "string"}, "children": {"type": "array", "items": {"$ref": "#"}}},
+		"required": ["value"]
+	}`), &schema)
+
+	var value interface{}
+	json.Unmarshal([]byte(`{"value":"root","children":[{"value":"a","children":[{"children":[]}]}]}`), &value)
+
+	err := ValidateJSONSchema(schema, value)
+	if err == nil || !strings.Contains(err.Error(), "$.children[0].children[0]: missing required property 'value'") {
+		t.Errorf("Expected nested missing property error, got %v", err)
+	}
+}
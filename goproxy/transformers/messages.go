@@ -0,0 +1,332 @@
+package transformers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// OpenAIToAnthropicResponseTransformer converts chat completions output into Anthropic
+// Messages format, so /v1/messages can be served by upstreams that only speak
+// /v1/chat/completions. Non-streaming responses go through TransformNonStreamResponse;
+// streams are converted chunk by chunk into message_start, content_block_*,
+// message_delta and message_stop events.
+type OpenAIToAnthropicResponseTransformer struct {
+	InputTokens int64 // prompt estimate for message_start, before upstream reports usage
+
+	id       string
+	model    string
+	finished bool
+
+	// Content block receiving deltas (only one block streams at a time)
+	nextIndex int
+	openType  string
+	openIndex int
+
+	// Chat tool call index → content block index
+	toolBlocks   map[int]int
+	finishReason string
+
+	usage    map[string]interface{}
+	hasUsage bool
+}
+
+// NewOpenAIToAnthropicResponseTransformer creates a transformer for the client-facing model ID
+func NewOpenAIToAnthropicResponseTransformer(model string) *OpenAIToAnthropicResponseTransformer {
+	return &OpenAIToAnthropicResponseTransformer{
+		id:         newResponsesID("msg"),
+		model:      model,
+		toolBlocks: make(map[int]int),
+	}
+}
+
+// TransformNonStreamResponse converts a chat.completion object to an Anthropic message
+func (t *OpenAIToAnthropicResponseTransformer) TransformNonStreamResponse(openaiResp map[string]interface{}) map[string]interface{} {
+	content := []interface{}{}
+	finishReason := ""
+
+	choices, _ := openaiResp["choices"].([]interface{})
+	if len(choices) > 0 {
+		choice, _ := choices[0].(map[string]interface{})
+		message, _ := choice["message"].(map[string]interface{})
+		finishReason, _ = choice["finish_reason"].(string)
+
+		reasoning := reasoningText(message)
+		if thinking, ok := openaiResp["thinking"].(string); ok && reasoning == "" {
+			reasoning = thinking
+		}
+		if reasoning != "" {
+			content = append(content, map[string]interface{}{
+				"type":      "thinking",
+				"thinking":  reasoning,
+				"signature": "",
+			})
+		}
+
+		if text, ok := message["content"].(string); ok && text != "" {
+			content = append(content, map[string]interface{}{
+				"type": "text",
+				"text": text,
+			})
+		}
+
+		toolCalls, _ := message["tool_calls"].([]interface{})
+		for _, block := range convertToolCallsToAnthropic(toolCalls) {
+			content = append(content, block)
+		}
+	}
+
+	usageData, _ := openaiResp["usage"].(map[string]interface{})
+	return map[string]interface{}{
+		"id":            t.id,
+		"type":          "message",
+		"role":          "assistant",
+		"model":         t.model,
+		"content":       content,
+		"stop_reason":   anthropicStopReason(finishReason, hasToolUse(content)),
+		"stop_sequence": nil,
+		"usage":         anthropicUsage(usageData),
+	}
+}
+
+// Start returns the message_start event
+func (t *OpenAIToAnthropicResponseTransformer) Start() string {
+	return t.event("message_start", map[string]interface{}{
+		"message": map[string]interface{}{
+			"id":            t.id,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         t.model,
+			"content":       []interface{}{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage": map[string]interface{}{
+				"input_tokens":  t.InputTokens,
+				"output_tokens": 0,
+			},
+		},
+	})
+}
+
+// TransformChunk converts one chat.completion.chunk into zero or more Anthropic events
+func (t *OpenAIToAnthropicResponseTransformer) TransformChunk(chunk map[string]interface{}) string {
+	if t.finished {
+		return ""
+	}
+
+	var out strings.Builder
+
+	if usageData, ok := chunk["usage"].(map[string]interface{}); ok {
+		t.usage = usageData
+		t.hasUsage = true
+	}
+	if thinking, ok := chunk["thinking"].(string); ok && thinking != "" {
+		out.WriteString(t.thinkingDelta(thinking))
+	}
+
+	choices, _ := chunk["choices"].([]interface{})
+	for _, rawChoice := range choices {
+		choice, _ := rawChoice.(map[string]interface{})
+		if delta, ok := choice["delta"].(map[string]interface{}); ok {
+			if reasoning := reasoningText(delta); reasoning != "" {
+				out.WriteString(t.thinkingDelta(reasoning))
+			}
+			if text, ok := delta["content"].(string); ok && text != "" {
+				out.WriteString(t.textDelta(text))
+			}
+			if toolCalls, ok := delta["tool_calls"].([]interface{}); ok {
+				for _, rawCall := range toolCalls {
+					if call, ok := rawCall.(map[string]interface{}); ok {
+						out.WriteString(t.toolCallDelta(call))
+					}
+				}
+			}
+		}
+		if finishReason, ok := choice["finish_reason"].(string); ok && finishReason != "" {
+			t.finishReason = finishReason
+		}
+	}
+
+	return out.String()
+}
+
+// Fail ends the stream with an error event (upstream error mid-stream)
+func (t *OpenAIToAnthropicResponseTransformer) Fail(message string) string {
+	if t.finished {
+		return ""
+	}
+	t.finished = true
+	return t.event("error", map[string]interface{}{
+		"error": map[string]interface{}{
+			"type":    "api_error",
+			"message": message,
+		},
+	})
+}
+
+// Finish closes any open block and returns message_delta (stop reason and usage) and message_stop
+func (t *OpenAIToAnthropicResponseTransformer) Finish() string {
+	if t.finished {
+		return ""
+	}
+	out := t.closeOpenBlock()
+	t.finished = true
+
+	usage := anthropicUsage(t.usage)
+	if !t.hasUsage {
+		usage["input_tokens"] = t.InputTokens
+	}
+	out += t.event("message_delta", map[string]interface{}{
+		"delta": map[string]interface{}{
+			"stop_reason":   anthropicStopReason(t.finishReason, len(t.toolBlocks) > 0),
+			"stop_sequence": nil,
+		},
+		"usage": usage,
+	})
+	return out + t.event("message_stop", map[string]interface{}{})
+}
+
+// Finished reports whether a terminal event has been emitted
+func (t *OpenAIToAnthropicResponseTransformer) Finished() bool {
+	return t.finished
+}
+
+func (t *OpenAIToAnthropicResponseTransformer) thinkingDelta(text string) string {
+	var out string
+	if t.openType != "thinking" {
+		out = t.openBlock("thinking", map[string]interface{}{"type": "thinking", "thinking": "", "signature": ""})
+	}
+	return out + t.blockDelta(map[string]interface{}{"type": "thinking_delta", "thinking": text})
+}
+
+func (t *OpenAIToAnthropicResponseTransformer) textDelta(text string) string {
+	var out string
+	if t.openType != "text" {
+		out = t.openBlock("text", map[string]interface{}{"type": "text", "text": ""})
+	}
+	return out + t.blockDelta(map[string]interface{}{"type": "text_delta", "text": text})
+}
+
+func (t *OpenAIToAnthropicResponseTransformer) toolCallDelta(call map[string]interface{}) string {
+	callIndex := 0
+	if idx, ok := call["index"].(float64); ok {
+		callIndex = int(idx)
+	}
+	function, _ := call["function"].(map[string]interface{})
+	arguments, _ := function["arguments"].(string)
+
+	var out string
+	blockIndex, seen := t.toolBlocks[callIndex]
+	if !seen {
+		callID, _ := call["id"].(string)
+		name, _ := function["name"].(string)
+		out = t.openBlock("tool_use", map[string]interface{}{
+			"type":  "tool_use",
+			"id":    callID,
+			"name":  name,
+			"input": map[string]interface{}{},
+		})
+		t.toolBlocks[callIndex] = t.openIndex
+		blockIndex = t.openIndex
+	}
+	// A closed block cannot receive more deltas; upstreams send each call's arguments in one run
+	if arguments == "" || t.openType != "tool_use" || t.openIndex != blockIndex {
+		return out
+	}
+	return out + t.blockDelta(map[string]interface{}{"type": "input_json_delta", "partial_json": arguments})
+}
+
+// openBlock closes the open block and starts a new one
+func (t *OpenAIToAnthropicResponseTransformer) openBlock(blockType string, block map[string]interface{}) string {
+	out := t.closeOpenBlock()
+	t.openType = blockType
+	t.openIndex = t.nextIndex
+	t.nextIndex++
+	return out + t.event("content_block_start", map[string]interface{}{
+		"index":         t.openIndex,
+		"content_block": block,
+	})
+}
+
+func (t *OpenAIToAnthropicResponseTransformer) closeOpenBlock() string {
+	if t.openType == "" {
+		return ""
+	}
+	t.openType = ""
+	return t.event("content_block_stop", map[string]interface{}{"index": t.openIndex})
+}
+
+func (t *OpenAIToAnthropicResponseTransformer) blockDelta(delta map[string]interface{}) string {
+	return t.event("content_block_delta", map[string]interface{}{
+		"index": t.openIndex,
+		"delta": delta,
+	})
+}
+
+// event formats an Anthropic SSE event
+func (t *OpenAIToAnthropicResponseTransformer) event(eventType string, data map[string]interface{}) string {
+	data["type"] = eventType
+	jsonData, _ := json.Marshal(data)
+	return fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, string(jsonData))
+}
+
+// reasoningText returns the reasoning of a chat message or delta
+// (reasoning_content on DeepSeek/GLM style servers, reasoning on vLLM/OpenRouter)
+func reasoningText(message map[string]interface{}) string {
+	if reasoning, ok := message["reasoning_content"].(string); ok && reasoning != "" {
+		return reasoning
+	}
+	reasoning, _ := message["reasoning"].(string)
+	return reasoning
+}
+
+// anthropicStopReason maps a chat completions finish_reason to an Anthropic stop_reason.
+// Some servers finish tool calls with "stop", so tool use wins over end_turn.
+func anthropicStopReason(finishReason string, toolUse bool) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	}
+	if toolUse {
+		return "tool_use"
+	}
+	return "end_turn"
+}
+
+// anthropicUsage converts chat completions usage to Anthropic usage.
+// Anthropic input_tokens excludes cache reads, OpenAI prompt_tokens includes them.
+func anthropicUsage(usageData map[string]interface{}) map[string]interface{} {
+	getInt := func(m map[string]interface{}, key string) int64 {
+		if v, ok := m[key].(float64); ok {
+			return int64(v)
+		}
+		return 0
+	}
+
+	input := getInt(usageData, "prompt_tokens")
+	var cached int64
+	if details, ok := usageData["prompt_tokens_details"].(map[string]interface{}); ok {
+		cached = getInt(details, "cached_tokens")
+	}
+	if cached > input {
+		cached = input
+	}
+	return map[string]interface{}{
+		"input_tokens":            input - cached,
+		"output_tokens":           getInt(usageData, "completion_tokens"),
+		"cache_read_input_tokens": cached,
+	}
+}
+
+func hasToolUse(content []interface{}) bool {
+	for _, rawBlock := range content {
+		if block, ok := rawBlock.(map[string]interface{}); ok && block["type"] == "tool_use" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package transformers
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// Anthropic Messages over Chat Completions Tests
+// =============================================================================
+
+func TestTransformToOpenAI_ToolConversation(t *testing.T) {
+	var req AnthropicRequest
+	err := json.Unmarshal([]byte(`{
+		"model": "glm-4.6",
+		"system": [{"type": "text", "text": "Use tools."}],
+		"max_tokens": 1024,
+		"stream": true,
+		"thinking": {"type": "enabled", "budget_tokens": 5000},
+		"stop_sequences": ["END"],
+		"metadata": {"user_id": "user-42"},
+		"tools": [
+			{"name": "get_weather", "description": "Get weather", "input_schema": {"type": "object"}},
+			{"type": "web_search_20250305", "name": "web_search"}
+		],
+		"tool_choice": {"type": "tool", "name": "get_weather"},
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "Weather here?"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "iVBOR"}}
+			]},
+			{"role": "assistant", "content": [
+				{"type": "thinking", "thinking": "need a tool", "signature": "sig"},
+				{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Hanoi"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "toolu_1", "content": [{"type": "text", "text": "31C"}]},
+				{"type": "text", "text": "Thanks"}
+			]}
+		]
+	}`), &req)
+	if err != nil {
+		t.Fatalf("invalid request: %v", err)
+	}
+
+	openaiReq := TransformToOpenAI(&req)
+
+	roles := make([]string, len(openaiReq.Messages))
+	for i, msg := range openaiReq.Messages {
+		roles[i] = msg.Role
+	}
+	if !reflect.DeepEqual(roles, []string{"system", "user", "assistant", "tool", "user"}) {
+		t.Fatalf("Unexpected message roles: %v", roles)
+	}
+	if parts, ok := openaiReq.Messages[1].Content.([]interface{}); !ok || len(parts) != 2 {
+		t.Errorf("Expected text and image_url parts, got %v", openaiReq.Messages[1].Content)
+	} else if url := parts[1].(map[string]interface{})["image_url"].(map[string]interface{})["url"]; url != "data:image/png;base64,iVBOR" {
+		t.Errorf("Expected base64 image as data URL, got %v", url)
+	}
+
+	assistant := openaiReq.Messages[2]
+	call := assistant.ToolCalls.([]interface{})[0].(map[string]interface{})
+	if call["id"] != "toolu_1" || call["function"].(map[string]interface{})["arguments"] != `{"city":"Hanoi"}` {
+		t.Errorf("Unexpected tool call: %v", call)
+	}
+	if assistant.Content != nil {
+		t.Errorf("Expected thinking to be dropped and content null, got %v", assistant.Content)
+	}
+	if tool := openaiReq.Messages[3]; tool.ToolCallID != "toolu_1" || tool.Content != "31C" {
+		t.Errorf("Unexpected tool message: %+v", tool)
+	}
+	if openaiReq.Messages[4].Content != "Thanks" {
+		t.Errorf("Expected text-only user content as a string, got %v", openaiReq.Messages[4].Content)
+	}
+
+	if len(openaiReq.Tools) != 1 {
+		t.Errorf("Expected server tools to be dropped, got %v", openaiReq.Tools)
+	}
+	wantChoice := map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "get_weather"}}
+	if !reflect.DeepEqual(openaiReq.ToolChoice, wantChoice) {
+		t.Errorf("Expected forced function tool_choice, got %v", openaiReq.ToolChoice)
+	}
+	if openaiReq.ReasoningEffort != "medium" || openaiReq.User != "user-42" || !openaiReq.IncludeUsage() {
+		t.Errorf("Parameters not carried over: %+v", openaiReq)
+	}
+	if !reflect.DeepEqual(openaiReq.StopSequences(), []string{"END"}) {
+		t.Errorf("Expected stop [END], got %v", openaiReq.Stop)
+	}
+}
+
+func TestOpenAIToAnthropic_NonStream(t *testing.T) {
+	transformer := NewOpenAIToAnthropicResponseTransformer("glm-4.6")
+	msg := transformer.TransformNonStreamResponse(decodeJSON(t, `{
+		"choices": [{
+			"message": {
+				"role": "assistant",
+				"reasoning_content": "thinking...",
+				"content": "Checking.",
+				"tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Hanoi\"}"}}]
+			},
+			"finish_reason": "tool_calls"
+		}],
+		"usage": {"prompt_tokens": 100, "completion_tokens": 20, "prompt_tokens_details": {"cached_tokens": 60}}
+	}`))
+
+	if msg["type"] != "message" || msg["model"] != "glm-4.6" || msg["stop_reason"] != "tool_use" {
+		t.Errorf("Unexpected message: %v", msg)
+	}
+	content := msg["content"].([]interface{})
+	var types []string
+	for _, block := range content {
+		types = append(types, block.(map[string]interface{})["type"].(string))
+	}
+	if !reflect.DeepEqual(types, []string{"thinking", "text", "tool_use"}) {
+		t.Fatalf("Unexpected content blocks: %v", types)
+	}
+	if input := content[2].(map[string]interface{})["input"]; !reflect.DeepEqual(input, map[string]interface{}{"city": "Hanoi"}) {
+		t.Errorf("Expected parsed tool input, got %v", input)
+	}
+	usage := msg["usage"].(map[string]interface{})
+	if usage["input_tokens"] != int64(40) || usage["output_tokens"] != int64(20) || usage["cache_read_input_tokens"] != int64(60) {
+		t.Errorf("Unexpected usage: %v", usage)
+	}
+}
+
+func TestOpenAIToAnthropic_Stream(t *testing.T) {
+	transformer := NewOpenAIToAnthropicResponseTransformer("gpt-5.1")
+	transformer.InputTokens = 42
+
+	out := transformer.Start()
+	for _, chunk := range []string{
+		`{"choices":[{"index":0,"delta":{"role":"assistant","reasoning_content":"Hmm"}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"Let me check."}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Hanoi\"}"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+		`{"choices":[],"usage":{"prompt_tokens":50,"completion_tokens":12}}`,
+	} {
+		out += transformer.TransformChunk(decodeJSON(t, chunk))
+	}
+	out += transformer.Finish()
+
+	var events []string
+	var partialJSON string
+	var messageDelta map[string]interface{}
+	for _, frame := range strings.Split(strings.TrimSpace(out), "\n\n") {
+		lines := strings.SplitN(frame, "\n", 2)
+		eventType := strings.TrimPrefix(lines[0], "event: ")
+		data := decodeJSON(t, strings.TrimPrefix(lines[1], "data: "))
+		if data["type"] != eventType {
+			t.Errorf("event %s carries type %v", eventType, data["type"])
+		}
+		events = append(events, eventType)
+		if delta, ok := data["delta"].(map[string]interface{}); ok && delta["type"] == "input_json_delta" {
+			partialJSON += delta["partial_json"].(string)
+		}
+		if eventType == "message_delta" {
+			messageDelta = data
+		}
+	}
+
+	want := []string{
+		"message_start",
+		"content_block_start", "content_block_delta", "content_block_stop", // thinking
+		"content_block_start", "content_block_delta", "content_block_stop", // text
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop", // tool_use
+		"message_delta", "message_stop",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("Unexpected events:\n got %v\nwant %v", events, want)
+	}
+	if partialJSON != `{"city":"Hanoi"}` {
+		t.Errorf("Expected tool input deltas to rebuild the arguments, got %s", partialJSON)
+	}
+	if messageDelta["delta"].(map[string]interface{})["stop_reason"] != "tool_use" {
+		t.Errorf("Expected stop_reason tool_use, got %v", messageDelta["delta"])
+	}
+	if usage := messageDelta["usage"].(map[string]interface{}); usage["input_tokens"] != float64(50) || usage["output_tokens"] != float64(12) {
+		t.Errorf("Expected upstream usage in message_delta, got %v", usage)
+	}
+	if !strings.Contains(out, `"input_tokens":42`) {
+		t.Errorf("Expected the input estimate in message_start:\n%s", out)
+	}
+	if !transformer.Finished() || transformer.Finish() != "" || transformer.Fail("late") != "" {
+		t.Error("Expected no events after Finish")
+	}
+}
@@ -0,0 +1,366 @@
+package transformers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"goproxy/config"
+)
+
+// UnsupportedParamError reports an OpenAI request parameter the target upstream cannot honor.
+// Handlers return it as a 400 instead of silently dropping the parameter.
+type UnsupportedParamError struct {
+	Param   string
+	Message string
+}
+
+func (e *UnsupportedParamError) Error() string {
+	return e.Message
+}
+
+func unsupportedParam(param, format string, args ...interface{}) *UnsupportedParamError {
+	return &UnsupportedParamError{Param: param, Message: fmt.Sprintf(format, args...)}
+}
+
+// validateCommonParams checks parameters whose values are invalid regardless of upstream
+func validateCommonParams(req *OpenAIRequest) error {
+	switch req.ReasoningEffort {
+	case "", "none", "minimal", "low", "medium", "high":
+	default:
+		return unsupportedParam("reasoning_effort", "Invalid reasoning_effort '%s': expected one of none, minimal, low, medium, high", req.ReasoningEffort)
+	}
+	if req.N > 1 {
+		return unsupportedParam("n", "Parameter 'n' must be 1 for model '%s': multiple choices are not supported", req.Model)
+	}
+	if req.Stop != nil && req.StopSequences() == nil {
+		if _, ok := req.Stop.(string); !ok {
+			return unsupportedParam("stop", "Parameter 'stop' must be a string or an array of strings")
+		}
+	}
+	if req.ResponseFormat != nil {
+		switch req.ResponseFormat.Type {
+		case "text", "json_object":
+		case "json_schema":
+			if req.ResponseFormat.JSONSchema == nil || req.ResponseFormat.JSONSchema.Name == "" {
+				return unsupportedParam("response_format", "response_format.json_schema.name is required")
+			}
+		default:
+			return unsupportedParam("response_format", "Invalid response_format type '%s'", req.ResponseFormat.Type)
+		}
+	}
+	if _, _, err := normalizeToolChoice(req.ToolChoice); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ValidateAnthropicParams returns an *UnsupportedParamError for parameters that
+// cannot be expressed in an Anthropic Messages request
+func ValidateAnthropicParams(req *OpenAIRequest) error {
+	if err := validateCommonParams(req); err != nil {
+		return err
+	}
+	if req.Seed != nil {
+		return unsupportedParam("seed", "Parameter 'seed' is not supported for model '%s'", req.Model)
+	}
+	if req.Logprobs || req.TopLogprobs > 0 {
+		return unsupportedParam("logprobs", "Parameter 'logprobs' is not supported for model '%s'", req.Model)
+	}
+	// json_object / json_schema are emulated with a forced tool call
+	if err := validateStructuredOutputFormat(req.ResponseFormat); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ValidateTrollOpenAIParams returns an *UnsupportedParamError for parameters that
+// cannot be expressed in a TrollLLM OpenAI (/v1/responses) request
+func ValidateTrollOpenAIParams(req *OpenAIRequest) error {
+	if err := validateCommonParams(req); err != nil {
+		return err
+	}
+	if req.Stop != nil {
+		return unsupportedParam("stop", "Parameter 'stop' is not supported for model '%s'", req.Model)
+	}
+	if req.Seed != nil {
+		return unsupportedParam("seed", "Parameter 'seed' is not supported for model '%s'", req.Model)
+	}
+	if req.Logprobs || req.TopLogprobs > 0 {
+		return unsupportedParam("logprobs", "Parameter 'logprobs' is not supported for model '%s'", req.Model)
+	}
+	return nil
+}
+
+// ThinkingBudget returns the Anthropic thinking budget for a request. reasoning_effort
+// takes precedence over the model's reasoning config; 0 means thinking stays off.
+func ThinkingBudget(modelID, reasoningEffort string) int {
+	if reasoningEffort != "" {
+		return config.ThinkingBudgetForEffort(reasoningEffort)
+	}
+	if config.GetModelReasoning(modelID) == "" {
+		return 0
+	}
+	return config.GetModelThinkingBudget(modelID)
+}
+
+// normalizeToolChoice validates tool_choice and returns its mode ("none", "auto",
+// "required" or "function") and, for "function", the forced tool name
+func normalizeToolChoice(toolChoice interface{}) (mode string, name string, err error) {
+	switch tc := toolChoice.(type) {
+	case nil:
+		return "", "", nil
+	case string:
+		switch tc {
+		case "none", "auto", "required":
+			return tc, "", nil
+		}
+	case map[string]interface{}:
+		if tc["type"] == "function" {
+			if function, ok := tc["function"].(map[string]interface{}); ok {
+				if name, ok := function["name"].(string); ok && name != "" {
+					return "function", name, nil
+				}
+			}
+			// Responses API shape: {"type":"function","name":"..."}
+			if name, ok := tc["name"].(string); ok && name != "" {
+				return "function", name, nil
+			}
+		}
+	}
+	data, _ := json.Marshal(toolChoice)
+	return "", "", unsupportedParam("tool_choice", "Invalid tool_choice %s: expected \"none\", \"auto\", \"required\" or {\"type\":\"function\",\"function\":{\"name\":...}}", string(data))
+}
+
+// convertToolChoiceToAnthropic maps OpenAI tool_choice to Anthropic tool_choice
+// auto → auto, required → any, none → none, function → tool
+func convertToolChoiceToAnthropic(toolChoice interface{}) interface{} {
+	mode, name, err := normalizeToolChoice(toolChoice)
+	if err != nil {
+		return nil
+	}
+	switch mode {
+	case "auto":
+		return map[string]interface{}{"type": "auto"}
+	case "required":
+		return map[string]interface{}{"type": "any"}
+	case "none":
+		return map[string]interface{}{"type": "none"}
+	case "function":
+		return map[string]interface{}{"type": "tool", "name": name}
+	}
+	return nil
+}
+
+// convertToolChoiceToTrollOpenAI maps OpenAI tool_choice to the /v1/responses shape
+func convertToolChoiceToTrollOpenAI(toolChoice interface{}) interface{} {
+	mode, name, err := normalizeToolChoice(toolChoice)
+	if err != nil || mode == "" {
+		return nil
+	}
+	if mode == "function" {
+		return map[string]interface{}{"type": "function", "name": name}
+	}
+	return mode
+}
+
+// ForcesToolUse reports whether an Anthropic tool_choice forces a tool call.
+// Anthropic rejects extended thinking combined with a forced tool.
+func ForcesToolUse(toolChoice interface{}) bool {
+	tc, ok := toolChoice.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	return tc["type"] == "any" || tc["type"] == "tool"
+}
+
+// convertToolsToAnthropic converts OpenAI function tools to Anthropic tools
+// {"type":"function","function":{name,description,parameters}} → {name,description,input_schema}
+func convertToolsToAnthropic(tools []interface{}) []interface{} {
+	result := make([]interface{}, 0, len(tools))
+	for _, rawTool := range tools {
+		tool, ok := rawTool.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		function, ok := tool["function"].(map[string]interface{})
+		if !ok {
+			// Already in Anthropic shape (or a server tool) - pass through
+			result = append(result, tool)
+			continue
+		}
+		anthropicTool := map[string]interface{}{
+			"name": function["name"],
+		}
+		if description, ok := function["description"]; ok {
+			anthropicTool["description"] = description
+		}
+		if parameters, ok := function["parameters"].(map[string]interface{}); ok {
+			anthropicTool["input_schema"] = parameters
+		} else {
+			anthropicTool["input_schema"] = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+		result = append(result, anthropicTool)
+	}
+	return result
+}
+
+// convertToolCallsToAnthropic converts assistant tool_calls to Anthropic tool_use blocks
+func convertToolCallsToAnthropic(toolCalls interface{}) []map[string]interface{} {
+	var calls []interface{}
+	switch tc := toolCalls.(type) {
+	case []interface{}:
+		calls = tc
+	case []map[string]interface{}:
+		for _, call := range tc {
+			calls = append(calls, call)
+		}
+	}
+
+	blocks := make([]map[string]interface{}, 0, len(calls))
+	for _, rawCall := range calls {
+		call, ok := rawCall.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		function, _ := call["function"].(map[string]interface{})
+		input := map[string]interface{}{}
+		if arguments, ok := function["arguments"].(string); ok && arguments != "" {
+			if err := json.Unmarshal([]byte(arguments), &input); err != nil {
+				input = map[string]interface{}{}
+			}
+		}
+		blocks = append(blocks, map[string]interface{}{
+			"type":  "tool_use",
+			"id":    call["id"],
+			"name":  function["name"],
+			"input": input,
+		})
+	}
+	return blocks
+}
+
+// convertToolMessageToAnthropic converts a role=tool message to an Anthropic tool_result block
+func convertToolMessageToAnthropic(msg OpenAIMessage) map[string]interface{} {
+	block := map[string]interface{}{
+		"type":        "tool_result",
+		"tool_use_id": msg.ToolCallID,
+	}
+	switch content := msg.Content.(type) {
+	case string:
+		block["content"] = content
+	case []interface{}:
+		parts := make([]interface{}, 0, len(content))
+		for _, part := range content {
+			if partMap, ok := part.(map[string]interface{}); ok && partMap["type"] == "text" {
+				parts = append(parts, map[string]interface{}{"type": "text", "text": partMap["text"]})
+			}
+		}
+		block["content"] = parts
+	default:
+		block["content"] = ""
+	}
+	return block
+}
+
+// convertToolChoiceToOpenAI maps Anthropic tool_choice to OpenAI tool_choice
+// auto → auto, any → required, none → none, tool → function
+func convertToolChoiceToOpenAI(toolChoice interface{}) interface{} {
+	tc, ok := toolChoice.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	switch tc["type"] {
+	case "auto":
+		return "auto"
+	case "any":
+		return "required"
+	case "none":
+		return "none"
+	case "tool":
+		return map[string]interface{}{
+			"type":     "function",
+			"function": map[string]interface{}{"name": tc["name"]},
+		}
+	}
+	return nil
+}
+
+// convertToolsToOpenAI converts Anthropic tools to OpenAI function tools
+// {name,description,input_schema} → {"type":"function","function":{name,description,parameters}}
+// Server tools (web_search, bash, ...) run on Anthropic's side and are dropped.
+func convertToolsToOpenAI(tools []interface{}) []interface{} {
+	result := make([]interface{}, 0, len(tools))
+	for _, rawTool := range tools {
+		tool, ok := rawTool.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if toolType, ok := tool["type"].(string); ok && toolType != "custom" {
+			continue
+		}
+		function := map[string]interface{}{
+			"name": tool["name"],
+		}
+		if description, ok := tool["description"]; ok {
+			function["description"] = description
+		}
+		if schema, ok := tool["input_schema"].(map[string]interface{}); ok {
+			function["parameters"] = schema
+		} else {
+			function["parameters"] = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+		result = append(result, map[string]interface{}{
+			"type":     "function",
+			"function": function,
+		})
+	}
+	return result
+}
+
+// convertToolUseToOpenAI converts an Anthropic tool_use block to an OpenAI tool call
+func convertToolUseToOpenAI(block map[string]interface{}) map[string]interface{} {
+	arguments := "{}"
+	if input, ok := block["input"]; ok && input != nil {
+		if data, err := json.Marshal(input); err == nil {
+			arguments = string(data)
+		}
+	}
+	return map[string]interface{}{
+		"id":   block["id"],
+		"type": "function",
+		"function": map[string]interface{}{
+			"name":      block["name"],
+			"arguments": arguments,
+		},
+	}
+}
+
+// convertToolResultToOpenAI converts an Anthropic tool_result block to a role=tool message.
+// Tool messages only carry text, so image results are dropped.
+func convertToolResultToOpenAI(block map[string]interface{}) OpenAIMessage {
+	toolUseID, _ := block["tool_use_id"].(string)
+	var content string
+	switch c := block["content"].(type) {
+	case string:
+		content = c
+	case []interface{}:
+		var texts []string
+		for _, rawPart := range c {
+			if part, ok := rawPart.(map[string]interface{}); ok && part["type"] == "text" {
+				if text, ok := part["text"].(string); ok {
+					texts = append(texts, text)
+				}
+			}
+		}
+		content = strings.Join(texts, "\n")
+	}
+	if isError, _ := block["is_error"].(bool); isError && content != "" {
+		content = "Error: " + content
+	}
+	return OpenAIMessage{
+		Role:       "tool",
+		ToolCallID: toolUseID,
+		Content:    content,
+	}
+}
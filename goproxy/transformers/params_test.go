@@ -0,0 +1,222 @@
+package transformers
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// =============================================================================
+// OpenAI Parameter Mapping Tests
+// =============================================================================
+
+func parseOpenAIRequest(t *testing.T, body string) *OpenAIRequest {
+	t.Helper()
+	var req OpenAIRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("invalid request %q: %v", body, err)
+	}
+	return &req
+}
+
+func TestTransformToAnthropic_ParameterMapping(t *testing.T) {
+	req := parseOpenAIRequest(t, `{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [{"role": "user", "content": "Hi"}],
+		"max_tokens": 100,
+		"max_completion_tokens": 2000,
+		"stop": "END",
+		"user": "user-42",
+		"reasoning_effort": "low",
+		"tools": [{"type": "function", "function": {"name": "get_weather", "description": "Get weather", "parameters": {"type": "object"}}}],
+		"tool_choice": "required"
+	}`)
+
+	anthropicReq := TransformToAnthropic(req)
+
+	if anthropicReq.MaxTokens != 2000 {
+		t.Errorf("Expected max_completion_tokens to win over max_tokens (2000), got %d", anthropicReq.MaxTokens)
+	}
+	if !reflect.DeepEqual(anthropicReq.StopSequences, []string{"END"}) {
+		t.Errorf("Expected stop_sequences [END], got %v", anthropicReq.StopSequences)
+	}
+	if anthropicReq.Metadata["user_id"] != "user-42" {
+		t.Errorf("Expected metadata.user_id, got %v", anthropicReq.Metadata)
+	}
+	if !reflect.DeepEqual(anthropicReq.ToolChoice, map[string]interface{}{"type": "any"}) {
+		t.Errorf("Expected tool_choice any, got %v", anthropicReq.ToolChoice)
+	}
+	tool := anthropicReq.Tools[0].(map[string]interface{})
+	if tool["name"] != "get_weather" || tool["input_schema"] == nil {
+		t.Errorf("Expected Anthropic tool with input_schema, got %v", tool)
+	}
+	// Forced tool use disables thinking even with reasoning_effort set
+	if anthropicReq.Thinking != nil {
+		t.Errorf("Expected thinking disabled with forced tool use, got %+v", anthropicReq.Thinking)
+	}
+}
+
+func TestTransformToAnthropic_ReasoningEffort(t *testing.T) {
+	tests := []struct {
+		effort string
+		budget int
+	}{
+		{"minimal", 1024},
+		{"low", 2000},
+		{"medium", 5000},
+		{"high", 10000},
+		{"none", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.effort, func(t *testing.T) {
+			req := &OpenAIRequest{
+				Model:           "claude-sonnet-4-5-20250929",
+				Messages:        []OpenAIMessage{{Role: "user", Content: "Hi"}},
+				ReasoningEffort: tt.effort,
+			}
+			anthropicReq := TransformToAnthropic(req)
+			budget := 0
+			if anthropicReq.Thinking != nil {
+				budget = anthropicReq.Thinking.BudgetTokens
+			}
+			if budget != tt.budget {
+				t.Errorf("reasoning_effort=%s: expected budget %d, got %d", tt.effort, tt.budget, budget)
+			}
+		})
+	}
+}
+
+func TestTransformToAnthropic_ToolChoice(t *testing.T) {
+	tests := []struct {
+		choice   interface{}
+		expected interface{}
+	}{
+		{"auto", map[string]interface{}{"type": "auto"}},
+		{"none", map[string]interface{}{"type": "none"}},
+		{"required", map[string]interface{}{"type": "any"}},
+		{
+			map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "get_weather"}},
+			map[string]interface{}{"type": "tool", "name": "get_weather"},
+		},
+		{nil, nil},
+	}
+
+	for _, tt := range tests {
+		if result := convertToolChoiceToAnthropic(tt.choice); !reflect.DeepEqual(result, tt.expected) {
+			t.Errorf("tool_choice %v: expected %v, got %v", tt.choice, tt.expected, result)
+		}
+	}
+}
+
+func TestTransformToAnthropic_ToolMessages(t *testing.T) {
+	req := parseOpenAIRequest(t, `{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": "Weather in Hanoi and Paris?"},
+			{"role": "assistant", "content": "", "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Hanoi\"}"}},
+				{"id": "call_2", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "30C"},
+			{"role": "tool", "tool_call_id": "call_2", "content": "18C"}
+		]
+	}`)
+
+	anthropicReq := TransformToAnthropic(req)
+
+	if len(anthropicReq.Messages) != 3 {
+		t.Fatalf("Expected 3 messages (tool results merged), got %d", len(anthropicReq.Messages))
+	}
+
+	assistant := anthropicReq.Messages[1].Content.([]map[string]interface{})
+	if len(assistant) != 2 || assistant[0]["type"] != "tool_use" || assistant[0]["id"] != "call_1" {
+		t.Fatalf("Expected two tool_use blocks without an empty text block, got %v", assistant)
+	}
+	if input := assistant[1]["input"].(map[string]interface{}); input["city"] != "Paris" {
+		t.Errorf("Expected parsed tool input, got %v", input)
+	}
+
+	results := anthropicReq.Messages[2].Content.([]map[string]interface{})
+	if anthropicReq.Messages[2].Role != "user" || len(results) != 2 {
+		t.Fatalf("Expected one user message with two tool_result blocks, got %+v", anthropicReq.Messages[2])
+	}
+	if results[1]["tool_use_id"] != "call_2" || results[1]["content"] != "18C" {
+		t.Errorf("Unexpected tool_result: %v", results[1])
+	}
+}
+
+func TestTransformToTrollOpenAI_ParameterMapping(t *testing.T) {
+	req := parseOpenAIRequest(t, `{
+		"model": "gpt-5-2025-08-07",
+		"messages": [{"role": "user", "content": "Hi"}],
+		"max_completion_tokens": 3000,
+		"user": "user-42",
+		"reasoning_effort": "high",
+		"tool_choice": {"type": "function", "function": {"name": "lookup"}},
+		"response_format": {"type": "json_schema", "json_schema": {"name": "answer", "schema": {"type": "object"}, "strict": true}}
+	}`)
+
+	trollReq := TransformToTrollOpenAI(req)
+
+	if trollReq.MaxOutputTokens != 3000 || trollReq.User != "user-42" {
+		t.Errorf("Expected max_output_tokens and user carried over, got %d %q", trollReq.MaxOutputTokens, trollReq.User)
+	}
+	if trollReq.Reasoning == nil || trollReq.Reasoning.Effort != "high" {
+		t.Errorf("Expected reasoning effort high, got %+v", trollReq.Reasoning)
+	}
+	if !reflect.DeepEqual(trollReq.ToolChoice, map[string]interface{}{"type": "function", "name": "lookup"}) {
+		t.Errorf("Unexpected tool_choice: %v", trollReq.ToolChoice)
+	}
+	if trollReq.Text == nil || trollReq.Text.Format["type"] != "json_schema" || trollReq.Text.Format["name"] != "answer" {
+		t.Errorf("Expected text.format json_schema, got %+v", trollReq.Text)
+	}
+}
+
+func TestValidateParams(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		anthropic string // expected param error for Anthropic, "" if valid
+		troll     string // expected param error for TrollOpenAI, "" if valid
+	}{
+		{"plain", `{"model":"m","messages":[]}`, "", ""},
+		{"seed", `{"model":"m","seed":7}`, "seed", "seed"},
+		{"n", `{"model":"m","n":2}`, "n", "n"},
+		{"n=1", `{"model":"m","n":1}`, "", ""},
+		{"logprobs", `{"model":"m","logprobs":true}`, "logprobs", "logprobs"},
+		{"stop", `{"model":"m","stop":["a","b"]}`, "", "stop"},
+		{"invalid stop", `{"model":"m","stop":5}`, "stop", "stop"},
+		{"json_object", `{"model":"m","response_format":{"type":"json_object"}}`, "", ""},
+		{"json_schema", `{"model":"m","response_format":{"type":"json_schema","json_schema":{"name":"a","schema":{"type":"object"}}}}`, "", ""},
+		{"json_schema array root", `{"model":"m","response_format":{"type":"json_schema","json_schema":{"name":"a","schema":{"type":"array"}}}}`, "response_format", ""},
+		{"json_schema without name", `{"model":"m","response_format":{"type":"json_schema","json_schema":{"schema":{"type":"object"}}}}`, "response_format", "response_format"},
+		{"text format", `{"model":"m","response_format":{"type":"text"}}`, "", ""},
+		{"bad effort", `{"model":"m","reasoning_effort":"max"}`, "reasoning_effort", "reasoning_effort"},
+		{"bad tool_choice", `{"model":"m","tool_choice":"always"}`, "tool_choice", "tool_choice"},
+		{"stream_options", `{"model":"m","stream":true,"stream_options":{"include_usage":true}}`, "", ""},
+	}
+
+	check := func(t *testing.T, err error, expected string) {
+		t.Helper()
+		if expected == "" {
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			return
+		}
+		var paramErr *UnsupportedParamError
+		if !errors.As(err, &paramErr) || paramErr.Param != expected {
+			t.Errorf("Expected error for param %q, got %v", expected, err)
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := parseOpenAIRequest(t, tt.body)
+			check(t, ValidateAnthropicParams(req), tt.anthropic)
+			check(t, ValidateTrollOpenAIParams(req), tt.troll)
+		})
+	}
+}
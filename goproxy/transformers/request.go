@@ -74,15 +74,79 @@ type ContentPart struct {
 
 // OpenAIRequest represents OpenAI standard request format
 type OpenAIRequest struct {
-	Model            string          `json:"model"`
-	Messages         []OpenAIMessage `json:"messages"`
-	MaxTokens        int             `json:"max_tokens,omitempty"`
-	Temperature      float64         `json:"temperature,omitempty"`
-	TopP             float64         `json:"top_p,omitempty"`
-	Stream           bool            `json:"stream,omitempty"`
-	Tools            []interface{}   `json:"tools,omitempty"`
-	PresencePenalty  float64         `json:"presence_penalty,omitempty"`
-	FrequencyPenalty float64         `json:"frequency_penalty,omitempty"`
+	Model               string          `json:"model"`
+	Messages            []OpenAIMessage `json:"messages"`
+	MaxTokens           int             `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int             `json:"max_completion_tokens,omitempty"`
+	Temperature         float64         `json:"temperature,omitempty"`
+	TopP                float64         `json:"top_p,omitempty"`
+	Stream              bool            `json:"stream,omitempty"`
+	StreamOptions       *StreamOptions  `json:"stream_options,omitempty"`
+	Tools               []interface{}   `json:"tools,omitempty"`
+	ToolChoice          interface{}     `json:"tool_choice,omitempty"`     // "none" | "auto" | "required" | {"type":"function","function":{"name":...}}
+	ResponseFormat      *ResponseFormat `json:"response_format,omitempty"` // text | json_object | json_schema
+	Stop                interface{}     `json:"stop,omitempty"`            // Can be string or []string
+	Seed                *int64          `json:"seed,omitempty"`
+	N                   int             `json:"n,omitempty"`
+	User                string          `json:"user,omitempty"`
+	Logprobs            bool            `json:"logprobs,omitempty"`
+	TopLogprobs         int             `json:"top_logprobs,omitempty"`
+	PresencePenalty     float64         `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    float64         `json:"frequency_penalty,omitempty"`
+	ReasoningEffort     string          `json:"reasoning_effort,omitempty"` // none | minimal | low | medium | high
+}
+
+// StreamOptions represents OpenAI stream_options
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ResponseFormat represents OpenAI response_format
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat represents the json_schema member of response_format
+type JSONSchemaFormat struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Schema      map[string]interface{} `json:"schema,omitempty"`
+	Strict      bool                   `json:"strict,omitempty"`
+}
+
+// OutputTokenLimit returns max_completion_tokens, falling back to the legacy max_tokens
+func (r *OpenAIRequest) OutputTokenLimit() int {
+	if r.MaxCompletionTokens > 0 {
+		return r.MaxCompletionTokens
+	}
+	return r.MaxTokens
+}
+
+// IncludeUsage reports whether a streaming client asked for the final usage chunk
+func (r *OpenAIRequest) IncludeUsage() bool {
+	return r.Stream && r.StreamOptions != nil && r.StreamOptions.IncludeUsage
+}
+
+// StopSequences returns stop as a list (it can be a single string or an array)
+func (r *OpenAIRequest) StopSequences() []string {
+	switch stop := r.Stop.(type) {
+	case string:
+		if stop != "" {
+			return []string{stop}
+		}
+	case []interface{}:
+		sequences := make([]string, 0, len(stop))
+		for _, s := range stop {
+			if str, ok := s.(string); ok && str != "" {
+				sequences = append(sequences, str)
+			}
+		}
+		return sequences
+	case []string:
+		return stop
+	}
+	return nil
 }
 
 // AnthropicMessage represents an Anthropic format message
@@ -99,15 +163,17 @@ type CacheControl struct {
 
 // AnthropicRequest represents Anthropic request format
 type AnthropicRequest struct {
-	Model       string             `json:"model"`
-	Messages    []AnthropicMessage `json:"messages"`
-	System      interface{}        `json:"system,omitempty"` // Can be string or []map[string]interface{}
-	MaxTokens   int                `json:"max_tokens"`
-	Temperature float64            `json:"temperature,omitempty"`
-	Stream      bool               `json:"stream,omitempty"`
-	Thinking    *ThinkingConfig    `json:"thinking,omitempty"`
-	Tools       []interface{}      `json:"tools,omitempty"`
-	ToolChoice  interface{}        `json:"tool_choice,omitempty"`
+	Model         string             `json:"model"`
+	Messages      []AnthropicMessage `json:"messages"`
+	System        interface{}        `json:"system,omitempty"` // Can be string or []map[string]interface{}
+	MaxTokens     int                `json:"max_tokens"`
+	Temperature   float64            `json:"temperature,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+	Thinking      *ThinkingConfig    `json:"thinking,omitempty"`
+	Tools         []interface{}      `json:"tools,omitempty"`
+	ToolChoice    interface{}        `json:"tool_choice,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Metadata      map[string]string  `json:"metadata,omitempty"`
 }
 
 // GetSystemAsArray returns the System field as []map[string]interface{}, converting from string if needed
@@ -177,6 +243,14 @@ type TrollOpenAIRequest struct {
 	PresencePenalty   float64              `json:"presence_penalty,omitempty"`
 	FrequencyPenalty  float64              `json:"frequency_penalty,omitempty"`
 	ParallelToolCalls bool                 `json:"parallel_tool_calls,omitempty"`
+	ToolChoice        interface{}          `json:"tool_choice,omitempty"`
+	Text              *TrollOpenAIText     `json:"text,omitempty"`
+	User              string               `json:"user,omitempty"`
+}
+
+// TrollOpenAIText represents the text output configuration (structured output format)
+type TrollOpenAIText struct {
+	Format map[string]interface{} `json:"format"`
 }
 
 // ReasoningConfig represents OpenAI reasoning configuration
@@ -205,12 +279,12 @@ func TransformToAnthropic(req *OpenAIRequest) *AnthropicRequest {
 		maxLimit = 64000
 	}
 
-	if req.MaxTokens > 0 {
-		// User specified max_tokens, limit to model maximum
-		if req.MaxTokens > maxLimit {
+	if limit := req.OutputTokenLimit(); limit > 0 {
+		// User specified max_completion_tokens/max_tokens, limit to model maximum
+		if limit > maxLimit {
 			anthropicReq.MaxTokens = maxLimit
 		} else {
-			anthropicReq.MaxTokens = req.MaxTokens
+			anthropicReq.MaxTokens = limit
 		}
 	} else {
 		// Use model maximum as default when not specified
@@ -222,6 +296,17 @@ func TransformToAnthropic(req *OpenAIRequest) *AnthropicRequest {
 		anthropicReq.Temperature = req.Temperature
 	}
 
+	// Convert tools, tool_choice, stop and user
+	if len(req.Tools) > 0 {
+		anthropicReq.Tools = convertToolsToAnthropic(req.Tools)
+	}
+	anthropicReq.ToolChoice = convertToolChoiceToAnthropic(req.ToolChoice)
+	anthropicReq.StopSequences = req.StopSequences()
+	if req.User != "" {
+		anthropicReq.Metadata = map[string]string{"user_id": req.User}
+	}
+	applyStructuredOutput(anthropicReq, req)
+
 	// Convert messages and extract system
 	var userSystemMessages []string
 
@@ -234,10 +319,27 @@ func TransformToAnthropic(req *OpenAIRequest) *AnthropicRequest {
 			continue
 		}
 
+		// Tool results become tool_result blocks in a user message.
+		// Consecutive results share one user message, as Anthropic requires.
+		if msg.Role == "tool" {
+			toolResult := convertToolMessageToAnthropic(msg)
+			if n := len(anthropicReq.Messages); n > 0 && anthropicReq.Messages[n-1].Role == "user" {
+				if blocks, ok := anthropicReq.Messages[n-1].Content.([]map[string]interface{}); ok && len(blocks) > 0 && blocks[0]["type"] == "tool_result" {
+					anthropicReq.Messages[n-1].Content = append(blocks, toolResult)
+					continue
+				}
+			}
+			anthropicReq.Messages = append(anthropicReq.Messages, AnthropicMessage{
+				Role:    "user",
+				Content: []map[string]interface{}{toolResult},
+			})
+			continue
+		}
+
 		// Convert user and assistant messages
 		contentArray := []map[string]interface{}{}
 
-		if text, ok := msg.Content.(string); ok {
+		if text, ok := msg.Content.(string); ok && (text != "" || msg.ToolCalls == nil) {
 			// For long text content (e.g., file contents, conversation history),
 			// enable caching if it's user message (helps with repeated context)
 			textBlock := map[string]interface{}{
@@ -289,6 +391,11 @@ func TransformToAnthropic(req *OpenAIRequest) *AnthropicRequest {
 			}
 		}
 
+		// Assistant tool calls become tool_use blocks after the text
+		if msg.Role == "assistant" && msg.ToolCalls != nil {
+			contentArray = append(contentArray, convertToolCallsToAnthropic(msg.ToolCalls)...)
+		}
+
 		anthropicMsg := AnthropicMessage{
 			Role:    msg.Role,
 			Content: contentArray,
@@ -319,12 +426,9 @@ func TransformToAnthropic(req *OpenAIRequest) *AnthropicRequest {
 		anthropicReq.System = systemEntries
 	}
 
-	// Handle thinking field
-	reasoning := config.GetModelReasoning(req.Model)
-	if reasoning != "" {
-		// Get thinking budget from config (allows per-model customization)
-		budgetTokens := config.GetModelThinkingBudget(req.Model)
-
+	// Handle thinking field: reasoning_effort overrides the model config,
+	// "none" disables thinking. Anthropic rejects thinking with a forced tool.
+	if budgetTokens := ThinkingBudget(req.Model, req.ReasoningEffort); budgetTokens > 0 && !ForcesToolUse(anthropicReq.ToolChoice) {
 		// Ensure max_tokens is greater than budget_tokens
 		if anthropicReq.MaxTokens <= budgetTokens {
 			// Increase max_tokens to meet requirement
@@ -341,12 +445,18 @@ func TransformToAnthropic(req *OpenAIRequest) *AnthropicRequest {
 }
 
 // TransformToOpenAI converts Anthropic format to OpenAI format
+// system → system message, tool_use → tool_calls, tool_result → role=tool messages,
+// images → image_url parts, thinking budget → reasoning_effort
 func TransformToOpenAI(req *AnthropicRequest) *OpenAIRequest {
 	openaiReq := &OpenAIRequest{
 		Model:    req.Model,
 		Messages: []OpenAIMessage{},
 		Stream:   req.Stream,
 	}
+	if req.Stream {
+		// message_delta carries usage, so always request the usage chunk
+		openaiReq.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
 
 	// Convert max_tokens
 	if req.MaxTokens > 0 {
@@ -360,59 +470,146 @@ func TransformToOpenAI(req *AnthropicRequest) *OpenAIRequest {
 		openaiReq.Temperature = req.Temperature
 	}
 
+	// Convert tools, tool_choice, stop and user
+	if len(req.Tools) > 0 {
+		openaiReq.Tools = convertToolsToOpenAI(req.Tools)
+	}
+	openaiReq.ToolChoice = convertToolChoiceToOpenAI(req.ToolChoice)
+	if len(req.StopSequences) > 0 {
+		openaiReq.Stop = req.StopSequences
+	}
+	if userID := req.Metadata["user_id"]; userID != "" {
+		openaiReq.User = userID
+	}
+
+	// Extended thinking maps to the closest reasoning effort
+	if req.Thinking != nil && req.Thinking.Type == "enabled" {
+		openaiReq.ReasoningEffort = config.EffortForThinkingBudget(req.Thinking.BudgetTokens)
+	}
+
 	// Handle system messages
-	systemArray := req.GetSystemAsArray()
-	if len(systemArray) > 0 {
-		var systemText string
-		for _, sys := range systemArray {
-			if text, ok := sys["text"].(string); ok {
-				if systemText != "" {
-					systemText += "\n"
-				}
-				systemText += text
-			}
-		}
-		if systemText != "" {
-			openaiReq.Messages = append(openaiReq.Messages, OpenAIMessage{
-				Role:    "system",
-				Content: systemText,
-			})
+	var systemTexts []string
+	for _, sys := range req.GetSystemAsArray() {
+		if text, ok := sys["text"].(string); ok && text != "" {
+			systemTexts = append(systemTexts, text)
 		}
 	}
+	if len(systemTexts) > 0 {
+		openaiReq.Messages = append(openaiReq.Messages, OpenAIMessage{
+			Role:    "system",
+			Content: strings.Join(systemTexts, "\n\n"),
+		})
+	}
 
 	// Convert messages
 	for _, msg := range req.Messages {
-		openaiMsg := OpenAIMessage{
-			Role: msg.Role,
-		}
-
-		// Handle content conversion
-		switch content := msg.Content.(type) {
-		case string:
-			openaiMsg.Content = content
-		case []interface{}:
-			// For array content, extract text parts
-			var textParts []string
-			for _, part := range content {
-				if partMap, ok := part.(map[string]interface{}); ok {
-					if partMap["type"] == "text" {
-						if text, ok := partMap["text"].(string); ok {
-							textParts = append(textParts, text)
-						}
-					}
+		if msg.Role == "assistant" {
+			openaiReq.Messages = append(openaiReq.Messages, convertAssistantToOpenAI(anthropicBlocks(msg.Content)))
+			continue
+		}
+
+		// Tool results become role=tool messages, which must directly follow the tool calls
+		var parts []interface{}
+		var texts []string
+		hasImage := false
+		for _, block := range anthropicBlocks(msg.Content) {
+			switch block["type"] {
+			case "tool_result":
+				openaiReq.Messages = append(openaiReq.Messages, convertToolResultToOpenAI(block))
+			case "text":
+				text, _ := block["text"].(string)
+				texts = append(texts, text)
+				parts = append(parts, map[string]interface{}{"type": "text", "text": text})
+			case "image":
+				if part := convertImageToOpenAI(block); part != nil {
+					parts = append(parts, part)
+					hasImage = true
 				}
 			}
-			openaiMsg.Content = strings.Join(textParts, "")
-		default:
-			openaiMsg.Content = ""
 		}
 
+		if len(parts) == 0 {
+			continue
+		}
+		openaiMsg := OpenAIMessage{Role: msg.Role, Content: parts}
+		if !hasImage {
+			openaiMsg.Content = strings.Join(texts, "\n\n")
+		}
 		openaiReq.Messages = append(openaiReq.Messages, openaiMsg)
 	}
 
 	return openaiReq
 }
 
+// anthropicBlocks returns message content as content blocks (a string becomes one text block)
+func anthropicBlocks(content interface{}) []map[string]interface{} {
+	switch c := content.(type) {
+	case string:
+		return []map[string]interface{}{{"type": "text", "text": c}}
+	case []map[string]interface{}:
+		return c
+	case []interface{}:
+		blocks := make([]map[string]interface{}, 0, len(c))
+		for _, rawBlock := range c {
+			if block, ok := rawBlock.(map[string]interface{}); ok {
+				blocks = append(blocks, block)
+			}
+		}
+		return blocks
+	}
+	return nil
+}
+
+// convertAssistantToOpenAI converts assistant content blocks to one OpenAI message.
+// Thinking blocks are dropped: their signatures only verify against the Anthropic upstream.
+func convertAssistantToOpenAI(blocks []map[string]interface{}) OpenAIMessage {
+	var texts []string
+	var toolCalls []interface{}
+	for _, block := range blocks {
+		switch block["type"] {
+		case "text":
+			if text, ok := block["text"].(string); ok {
+				texts = append(texts, text)
+			}
+		case "tool_use":
+			toolCalls = append(toolCalls, convertToolUseToOpenAI(block))
+		}
+	}
+
+	msg := OpenAIMessage{Role: "assistant", Content: strings.Join(texts, "")}
+	if len(toolCalls) > 0 {
+		msg.ToolCalls = toolCalls
+		if len(texts) == 0 {
+			msg.Content = nil
+		}
+	}
+	return msg
+}
+
+// convertImageToOpenAI converts an Anthropic image block to an OpenAI image_url part
+func convertImageToOpenAI(block map[string]interface{}) map[string]interface{} {
+	source, _ := block["source"].(map[string]interface{})
+	var url string
+	switch source["type"] {
+	case "base64":
+		mediaType, _ := source["media_type"].(string)
+		data, _ := source["data"].(string)
+		if data == "" {
+			return nil
+		}
+		url = "data:" + mediaType + ";base64," + data
+	case "url":
+		url, _ = source["url"].(string)
+	}
+	if url == "" {
+		return nil
+	}
+	return map[string]interface{}{
+		"type":      "image_url",
+		"image_url": map[string]interface{}{"url": url},
+	}
+}
+
 // TransformToTrollOpenAI converts OpenAI format to TrollLLM OpenAI format
 func TransformToTrollOpenAI(req *OpenAIRequest) *TrollOpenAIRequest {
 	trollReq := &TrollOpenAIRequest{
@@ -427,12 +624,12 @@ func TransformToTrollOpenAI(req *OpenAIRequest) *TrollOpenAIRequest {
 	// GPT-5 Codex: Max 128,000
 	maxLimit := 128000
 
-	if req.MaxTokens > 0 {
-		// User specified max_tokens, limit to model maximum
-		if req.MaxTokens > maxLimit {
+	if limit := req.OutputTokenLimit(); limit > 0 {
+		// User specified max_completion_tokens/max_tokens, limit to model maximum
+		if limit > maxLimit {
 			trollReq.MaxOutputTokens = maxLimit
 		} else {
-			trollReq.MaxOutputTokens = req.MaxTokens
+			trollReq.MaxOutputTokens = limit
 		}
 	} else {
 		// Use model maximum as default when not specified
@@ -457,6 +654,22 @@ func TransformToTrollOpenAI(req *OpenAIRequest) *TrollOpenAIRequest {
 	if len(req.Tools) > 0 {
 		trollReq.Tools = req.Tools
 	}
+	trollReq.ToolChoice = convertToolChoiceToTrollOpenAI(req.ToolChoice)
+	trollReq.User = req.User
+
+	// Convert response_format to text.format
+	if rf := req.ResponseFormat; rf != nil && rf.Type != "text" {
+		format := map[string]interface{}{"type": rf.Type}
+		if rf.Type == "json_schema" && rf.JSONSchema != nil {
+			format["name"] = rf.JSONSchema.Name
+			format["schema"] = rf.JSONSchema.Schema
+			format["strict"] = rf.JSONSchema.Strict
+			if rf.JSONSchema.Description != "" {
+				format["description"] = rf.JSONSchema.Description
+			}
+		}
+		trollReq.Text = &TrollOpenAIText{Format: format}
+	}
 
 	// Extract system message as instructions - keep user system prompt only
 	var userSystemMessages []string
@@ -523,7 +736,11 @@ func TransformToTrollOpenAI(req *OpenAIRequest) *TrollOpenAIRequest {
 
 	// Handle reasoning field
 	// Fix: GPT-5 and GPT-5.1 require reasoning parameter with valid value
+	// reasoning_effort from the request overrides the model config
 	reasoning := config.GetModelReasoning(req.Model)
+	if req.ReasoningEffort != "" {
+		reasoning = req.ReasoningEffort
+	}
 
 	// GPT-5 and GPT-5.1 must have reasoning (low/medium/high)
 	if req.Model == "gpt-5-2025-08-07" || req.Model == "gpt-5.1-2025-11-13" {
@@ -531,12 +748,14 @@ func TransformToTrollOpenAI(req *OpenAIRequest) *TrollOpenAIRequest {
 		effort := reasoning
 		if effort == "" || effort == "off" {
 			effort = "medium" // TrollLLM default
+		} else if effort == "none" && req.Model == "gpt-5-2025-08-07" {
+			effort = "minimal" // GPT-5 cannot turn reasoning off
 		}
 		trollReq.Reasoning = &ReasoningConfig{
 			Effort:  effort,
 			Summary: "auto",
 		}
-	} else if reasoning != "" {
+	} else if reasoning != "" && reasoning != "none" {
 		// Cho các models khác
 		trollReq.Reasoning = &ReasoningConfig{
 			Effort:  reasoning,
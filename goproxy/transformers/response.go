@@ -3,6 +3,7 @@ package transformers
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
@@ -299,6 +300,19 @@ type AnthropicResponseTransformer struct {
 	Model     string
 	RequestID string
 	Created   int64
+
+	// ResponseFormat set to json_object/json_schema unwraps the structured output
+	// tool call (see applyStructuredOutput) into message content
+	ResponseFormat *ResponseFormat
+
+	// IncludeUsage sends UsageChunk even without token counts (stream_options.include_usage)
+	IncludeUsage bool
+
+	// Streaming state for the structured output tool block
+	structuredIndex  float64
+	structuredActive bool
+	structuredJSON   strings.Builder
+	clientToolCalls  bool
 }
 
 // NewAnthropicResponseTransformer creates an Anthropic response transformer
@@ -338,6 +352,7 @@ func (t *AnthropicResponseTransformer) TransformNonStreamResponse(anthropicResp
 	var textContent string
 	var thinkingContent string
 	var toolCalls []map[string]interface{}
+	var structuredOutput *string
 
 	if content, ok := anthropicResp["content"].([]interface{}); ok && len(content) > 0 {
 		for _, item := range content {
@@ -362,6 +377,13 @@ func (t *AnthropicResponseTransformer) TransformNonStreamResponse(anthropicResp
 						textContent = FilterDroidIdentity(text)
 					}
 				case "tool_use":
+					if t.ResponseFormat.wantsJSON() && contentItem["name"] == StructuredOutputToolName {
+						// Structured output: the tool input is the answer
+						inputBytes, _ := json.Marshal(contentItem["input"])
+						output := string(inputBytes)
+						structuredOutput = &output
+						continue
+					}
 					// Convert Anthropic tool_use to OpenAI tool_calls format
 					toolCall := map[string]interface{}{
 						"id":   contentItem["id"],
@@ -383,6 +405,13 @@ func (t *AnthropicResponseTransformer) TransformNonStreamResponse(anthropicResp
 		}
 	}
 
+	if structuredOutput != nil {
+		if err := checkStructuredOutput(t.ResponseFormat, *structuredOutput); err != nil {
+			return nil, err
+		}
+		textContent = *structuredOutput
+	}
+
 	openaiResp.Choices[0].Message.Content = textContent
 	if len(toolCalls) > 0 {
 		openaiResp.Choices[0].Message.ToolCalls = toolCalls
@@ -400,6 +429,9 @@ func (t *AnthropicResponseTransformer) TransformNonStreamResponse(anthropicResp
 			finishReason = "length"
 		case "tool_use":
 			finishReason = "tool_calls"
+			if structuredOutput != nil && len(toolCalls) == 0 {
+				finishReason = "stop"
+			}
 		case "end_turn":
 			finishReason = "stop"
 		}
@@ -436,6 +468,14 @@ func (t *AnthropicResponseTransformer) TransformStreamChunk(eventType string, ev
 		// Handle tool_use block start
 		if contentBlock, ok := eventData["content_block"].(map[string]interface{}); ok {
 			if blockType, ok := contentBlock["type"].(string); ok && blockType == "tool_use" {
+				if t.ResponseFormat.wantsJSON() && contentBlock["name"] == StructuredOutputToolName {
+					// Structured output: the tool input becomes message content once it validates
+					t.structuredIndex, _ = eventData["index"].(float64)
+					t.structuredActive = true
+					t.structuredJSON.Reset()
+					return "", nil
+				}
+				t.clientToolCalls = true
 				toolCall := map[string]interface{}{
 					"index": eventData["index"],
 					"id":    contentBlock["id"],
@@ -471,6 +511,11 @@ func (t *AnthropicResponseTransformer) TransformStreamChunk(eventType string, ev
 				}
 				return t.createOpenAIChunk(text, "", false, "", nil), nil
 			case "input_json_delta":
+				if partialJson, ok := delta["partial_json"].(string); ok && t.isStructuredBlock(eventData) {
+					// Held back until content_block_stop validates it
+					t.structuredJSON.WriteString(partialJson)
+					return "", nil
+				}
 				// Stream tool call arguments
 				if partialJson, ok := delta["partial_json"].(string); ok {
 					toolCallDelta := map[string]interface{}{
@@ -491,6 +536,18 @@ func (t *AnthropicResponseTransformer) TransformStreamChunk(eventType string, ev
 		return "", nil
 
 	case "content_block_stop":
+		if t.isStructuredBlock(eventData) {
+			t.structuredActive = false
+			output := t.structuredJSON.String()
+			if err := checkStructuredOutput(t.ResponseFormat, output); err != nil {
+				var structuredErr *StructuredOutputError
+				if errors.As(err, &structuredErr) {
+					return structuredErr.ErrorChunk(), nil
+				}
+				return "", nil
+			}
+			return t.createOpenAIChunk(output, "", false, "", nil), nil
+		}
 		return "", nil
 
 	case "message_delta":
@@ -502,6 +559,9 @@ func (t *AnthropicResponseTransformer) TransformStreamChunk(eventType string, ev
 					finishReason = "length"
 				case "tool_use":
 					finishReason = "tool_calls"
+					if t.ResponseFormat.wantsJSON() && !t.clientToolCalls {
+						finishReason = "stop"
+					}
 				case "end_turn":
 					finishReason = "stop"
 				}
@@ -517,6 +577,26 @@ func (t *AnthropicResponseTransformer) TransformStreamChunk(eventType string, ev
 	}
 }
 
+// isStructuredBlock reports whether a content block event belongs to the structured output tool
+func (t *AnthropicResponseTransformer) isStructuredBlock(eventData map[string]interface{}) bool {
+	if !t.structuredActive {
+		return false
+	}
+	index, _ := eventData["index"].(float64)
+	return index == t.structuredIndex
+}
+
+// UsageChunk returns the final usage-only chunk. Like before stream_options existed, it is
+// sent whenever tokens were counted; with include_usage it is sent regardless. It takes the
+// billed Anthropic counts: input_tokens excludes cache reads and writes, while OpenAI
+// prompt_tokens includes them.
+func (t *AnthropicResponseTransformer) UsageChunk(input, output, cacheWrite, cacheHit int64) string {
+	if !t.IncludeUsage && input+cacheWrite+cacheHit == 0 && output == 0 {
+		return ""
+	}
+	return createUsageChunk(t.RequestID, t.Created, t.Model, input+cacheWrite+cacheHit, output, cacheHit)
+}
+
 // createOpenAIChunk creates an OpenAI format streaming chunk
 func (t *AnthropicResponseTransformer) createOpenAIChunk(content, role string, finish bool, finishReason string, toolCall map[string]interface{}) string {
 	return t.createOpenAIChunkWithThinking(content, role, finish, finishReason, toolCall, "")
@@ -598,6 +678,9 @@ type TrollOpenAIResponseTransformer struct {
 	Model     string
 	RequestID string
 	Created   int64
+
+	// IncludeUsage sends UsageChunk even without token counts (stream_options.include_usage)
+	IncludeUsage bool
 }
 
 // NewTrollOpenAIResponseTransformer creates a TrollLLM OpenAI response transformer
@@ -803,6 +886,15 @@ func (t *TrollOpenAIResponseTransformer) TransformStreamChunk(eventType string,
 	}
 }
 
+// UsageChunk returns the final usage-only chunk, sent whenever tokens were counted and
+// always with include_usage. TrollLLM input_tokens already include cached tokens.
+func (t *TrollOpenAIResponseTransformer) UsageChunk(input, output, cacheHit int64) string {
+	if !t.IncludeUsage && input == 0 && output == 0 {
+		return ""
+	}
+	return createUsageChunk(t.RequestID, t.Created, t.Model, input, output, cacheHit)
+}
+
 // createOpenAIChunk creates an OpenAI format streaming chunk
 func (t *TrollOpenAIResponseTransformer) createOpenAIChunk(content, role string, finish bool, finishReason string) string {
 	chunk := OpenAIResponse{
@@ -906,6 +998,27 @@ func (t *TrollOpenAIResponseTransformer) TransformStream(reader io.Reader) chan
 	return output
 }
 
+// createUsageChunk builds an OpenAI usage chunk: empty choices and the usage totals
+func createUsageChunk(id string, created int64, model string, promptTokens, completionTokens, cachedTokens int64) string {
+	chunk := OpenAIResponse{
+		ID:      id,
+		Object:  "chat.completion.chunk",
+		Created: created,
+		Model:   model,
+		Choices: []OpenAIChoice{},
+		Usage: map[string]interface{}{
+			"prompt_tokens":     promptTokens,
+			"completion_tokens": completionTokens,
+			"total_tokens":      promptTokens + completionTokens,
+			"prompt_tokens_details": map[string]interface{}{
+				"cached_tokens": cachedTokens,
+			},
+		},
+	}
+	jsonData, _ := json.Marshal(chunk)
+	return fmt.Sprintf("data: %s\n\n", string(jsonData))
+}
+
 // stringPtr returns a string pointer
 func stringPtr(s string) *string {
 	return &s
@@ -0,0 +1,86 @@
+package transformers
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// Stream Usage Chunk Tests (stream_options.include_usage)
+// =============================================================================
+
+func parseUsageChunk(t *testing.T, chunk string) OpenAIResponse {
+	t.Helper()
+	var resp OpenAIResponse
+	data := strings.TrimSuffix(strings.TrimPrefix(chunk, "data: "), "\n\n")
+	if err := json.Unmarshal([]byte(data), &resp); err != nil {
+		t.Fatalf("invalid usage chunk %q: %v", chunk, err)
+	}
+	return resp
+}
+
+func TestAnthropicUsageChunk(t *testing.T) {
+	transformer := NewAnthropicResponseTransformer("claude-sonnet-4-5-20250929", "chatcmpl-1")
+	// Clients that don't opt in still get usage, as before stream_options was supported
+	if resp := parseUsageChunk(t, transformer.UsageChunk(10, 5, 0, 0)); resp.Usage["total_tokens"] != float64(15) {
+		t.Errorf("Expected a usage chunk without include_usage, got %v", resp.Usage)
+	}
+	if chunk := transformer.UsageChunk(0, 0, 0, 0); chunk != "" {
+		t.Errorf("Expected no usage chunk without tokens or include_usage, got %s", chunk)
+	}
+
+	transformer.IncludeUsage = true
+	if chunk := transformer.UsageChunk(0, 0, 0, 0); chunk == "" {
+		t.Errorf("Expected a usage chunk with include_usage even without tokens")
+	}
+	resp := parseUsageChunk(t, transformer.UsageChunk(100, 20, 30, 50))
+
+	if resp.ID != "chatcmpl-1" || resp.Object != "chat.completion.chunk" || len(resp.Choices) != 0 {
+		t.Errorf("Expected usage-only chunk with the stream id, got %+v", resp)
+	}
+	// prompt_tokens includes cache writes and reads; cached_tokens is the cache read count
+	if resp.Usage["prompt_tokens"] != float64(180) || resp.Usage["completion_tokens"] != float64(20) || resp.Usage["total_tokens"] != float64(200) {
+		t.Errorf("Unexpected usage totals: %v", resp.Usage)
+	}
+	details, _ := resp.Usage["prompt_tokens_details"].(map[string]interface{})
+	if details["cached_tokens"] != float64(50) {
+		t.Errorf("Expected cached_tokens 50, got %v", resp.Usage["prompt_tokens_details"])
+	}
+}
+
+func TestTrollOpenAIUsageChunk(t *testing.T) {
+	transformer := NewTrollOpenAIResponseTransformer("gpt-5-2025-08-07", "chatcmpl-2")
+	if chunk := transformer.UsageChunk(10, 5, 0); chunk == "" {
+		t.Errorf("Expected a usage chunk without include_usage once tokens were counted")
+	}
+	if chunk := transformer.UsageChunk(0, 0, 0); chunk != "" {
+		t.Errorf("Expected no usage chunk without tokens or include_usage, got %s", chunk)
+	}
+
+	transformer.IncludeUsage = true
+	resp := parseUsageChunk(t, transformer.UsageChunk(100, 20, 40))
+
+	details, _ := resp.Usage["prompt_tokens_details"].(map[string]interface{})
+	if resp.Usage["prompt_tokens"] != float64(100) || resp.Usage["completion_tokens"] != float64(20) || details["cached_tokens"] != float64(40) {
+		t.Errorf("Unexpected usage: %v", resp.Usage)
+	}
+}
+
+func TestIncludeUsage(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected bool
+	}{
+		{`{"model":"m","stream":true,"stream_options":{"include_usage":true}}`, true},
+		{`{"model":"m","stream":true,"stream_options":{"include_usage":false}}`, false},
+		{`{"model":"m","stream":true}`, false},
+		{`{"model":"m","stream_options":{"include_usage":true}}`, false},
+	}
+
+	for _, tt := range tests {
+		if result := parseOpenAIRequest(t, tt.body).IncludeUsage(); result != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.body, tt.expected, result)
+		}
+	}
+}
@@ -0,0 +1,684 @@
+package transformers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ResponsesRequest represents an OpenAI Responses API request (/v1/responses)
+type ResponsesRequest struct {
+	Model              string           `json:"model"`
+	Input              interface{}      `json:"input"` // Can be string or []item
+	Instructions       string           `json:"instructions,omitempty"`
+	MaxOutputTokens    int              `json:"max_output_tokens,omitempty"`
+	Temperature        float64          `json:"temperature,omitempty"`
+	TopP               float64          `json:"top_p,omitempty"`
+	Stream             bool             `json:"stream,omitempty"`
+	Tools              []interface{}    `json:"tools,omitempty"`
+	ToolChoice         interface{}      `json:"tool_choice,omitempty"`
+	Text               *TrollOpenAIText `json:"text,omitempty"`
+	Reasoning          *ReasoningConfig `json:"reasoning,omitempty"`
+	User               string           `json:"user,omitempty"`
+	PreviousResponseID string           `json:"previous_response_id,omitempty"`
+}
+
+// ResponsesResponse represents an OpenAI Responses API response object
+type ResponsesResponse struct {
+	ID                string                   `json:"id"`
+	Object            string                   `json:"object"`
+	CreatedAt         int64                    `json:"created_at"`
+	Status            string                   `json:"status"`
+	IncompleteDetails map[string]interface{}   `json:"incomplete_details"`
+	Error             map[string]interface{}   `json:"error"`
+	Model             string                   `json:"model"`
+	Output            []map[string]interface{} `json:"output"`
+	Usage             *ResponsesUsage          `json:"usage,omitempty"`
+}
+
+// ResponsesUsage represents token usage in Responses API format
+type ResponsesUsage struct {
+	InputTokens         int64            `json:"input_tokens"`
+	InputTokensDetails  map[string]int64 `json:"input_tokens_details"`
+	OutputTokens        int64            `json:"output_tokens"`
+	OutputTokensDetails map[string]int64 `json:"output_tokens_details"`
+	TotalTokens         int64            `json:"total_tokens"`
+}
+
+// TransformResponsesToOpenAI converts a Responses API request to chat completions format
+// instructions → system message, input items → messages, function tools → chat tools
+func TransformResponsesToOpenAI(req *ResponsesRequest) (*OpenAIRequest, error) {
+	if req.PreviousResponseID != "" {
+		return nil, fmt.Errorf("previous_response_id is not supported, send the full conversation in input")
+	}
+
+	openaiReq := &OpenAIRequest{
+		Model:       req.Model,
+		Messages:    []OpenAIMessage{},
+		MaxTokens:   req.MaxOutputTokens,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		Stream:      req.Stream,
+		User:        req.User,
+	}
+	if req.Stream {
+		// response.completed carries usage, so always request the usage chunk
+		openaiReq.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+
+	if req.Instructions != "" {
+		openaiReq.Messages = append(openaiReq.Messages, OpenAIMessage{
+			Role:    "system",
+			Content: req.Instructions,
+		})
+	}
+
+	switch input := req.Input.(type) {
+	case nil:
+	case string:
+		openaiReq.Messages = append(openaiReq.Messages, OpenAIMessage{
+			Role:    "user",
+			Content: input,
+		})
+	case []interface{}:
+		for i, rawItem := range input {
+			item, ok := rawItem.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("input[%d]: expected an object", i)
+			}
+			messages, err := appendResponsesInputItem(openaiReq.Messages, item)
+			if err != nil {
+				return nil, fmt.Errorf("input[%d]: %v", i, err)
+			}
+			openaiReq.Messages = messages
+		}
+	default:
+		return nil, fmt.Errorf("input: expected a string or an array of items")
+	}
+
+	for i, rawTool := range req.Tools {
+		tool, ok := rawTool.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("tools[%d]: expected an object", i)
+		}
+		toolType, _ := tool["type"].(string)
+		if toolType != "function" {
+			return nil, fmt.Errorf("tools[%d]: tool type '%s' is not supported", i, toolType)
+		}
+		function := map[string]interface{}{
+			"name": tool["name"],
+		}
+		if description, ok := tool["description"]; ok {
+			function["description"] = description
+		}
+		if parameters, ok := tool["parameters"]; ok {
+			function["parameters"] = parameters
+		}
+		openaiReq.Tools = append(openaiReq.Tools, map[string]interface{}{
+			"type":     "function",
+			"function": function,
+		})
+	}
+
+	// tool_choice {"type":"function","name":...} → {"type":"function","function":{"name":...}}
+	mode, name, err := normalizeToolChoice(req.ToolChoice)
+	if err != nil {
+		return nil, err
+	}
+	if mode == "function" {
+		openaiReq.ToolChoice = map[string]interface{}{
+			"type":     "function",
+			"function": map[string]interface{}{"name": name},
+		}
+	} else if mode != "" {
+		openaiReq.ToolChoice = mode
+	}
+
+	// text.format → response_format
+	if req.Text != nil && req.Text.Format != nil {
+		formatType, _ := req.Text.Format["type"].(string)
+		openaiReq.ResponseFormat = &ResponseFormat{Type: formatType}
+		if formatType == "json_schema" {
+			schema, _ := req.Text.Format["schema"].(map[string]interface{})
+			schemaName, _ := req.Text.Format["name"].(string)
+			description, _ := req.Text.Format["description"].(string)
+			strict, _ := req.Text.Format["strict"].(bool)
+			openaiReq.ResponseFormat.JSONSchema = &JSONSchemaFormat{
+				Name:        schemaName,
+				Description: description,
+				Schema:      schema,
+				Strict:      strict,
+			}
+		}
+	}
+
+	if req.Reasoning != nil && req.Reasoning.Effort != "" {
+		openaiReq.ReasoningEffort = req.Reasoning.Effort
+	}
+
+	return openaiReq, nil
+}
+
+// appendResponsesInputItem converts one Responses input item and appends it to messages.
+// Consecutive function_call items are merged into a single assistant message with tool_calls.
+func appendResponsesInputItem(messages []OpenAIMessage, item map[string]interface{}) ([]OpenAIMessage, error) {
+	itemType, _ := item["type"].(string)
+	if itemType == "" && item["role"] != nil {
+		itemType = "message"
+	}
+
+	switch itemType {
+	case "message":
+		role, _ := item["role"].(string)
+		switch role {
+		case "user", "assistant", "system":
+		case "developer":
+			role = "system"
+		default:
+			return nil, fmt.Errorf("unsupported role '%s'", role)
+		}
+		content, err := convertResponsesContent(item["content"])
+		if err != nil {
+			return nil, err
+		}
+		return append(messages, OpenAIMessage{Role: role, Content: content}), nil
+
+	case "function_call":
+		callID, _ := item["call_id"].(string)
+		name, _ := item["name"].(string)
+		arguments, _ := item["arguments"].(string)
+		toolCall := map[string]interface{}{
+			"id":   callID,
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":      name,
+				"arguments": arguments,
+			},
+		}
+		if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+			last := &messages[n-1]
+			toolCalls, _ := last.ToolCalls.([]interface{})
+			last.ToolCalls = append(toolCalls, toolCall)
+			return messages, nil
+		}
+		return append(messages, OpenAIMessage{
+			Role:      "assistant",
+			ToolCalls: []interface{}{toolCall},
+		}), nil
+
+	case "function_call_output":
+		callID, _ := item["call_id"].(string)
+		output, ok := item["output"].(string)
+		if !ok {
+			data, _ := json.Marshal(item["output"])
+			output = string(data)
+		}
+		return append(messages, OpenAIMessage{
+			Role:       "tool",
+			ToolCallID: callID,
+			Content:    output,
+		}), nil
+
+	case "reasoning":
+		// Reasoning items are upstream-specific and cannot be replayed across providers
+		return messages, nil
+
+	default:
+		return nil, fmt.Errorf("input item type '%s' is not supported", itemType)
+	}
+}
+
+// convertResponsesContent converts Responses content parts to chat completions content parts
+func convertResponsesContent(content interface{}) (interface{}, error) {
+	switch c := content.(type) {
+	case string:
+		return c, nil
+	case []interface{}:
+		parts := make([]interface{}, 0, len(c))
+		for _, rawPart := range c {
+			part, ok := rawPart.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			partType, _ := part["type"].(string)
+			switch partType {
+			case "input_text", "output_text", "text":
+				parts = append(parts, map[string]interface{}{
+					"type": "text",
+					"text": part["text"],
+				})
+			case "input_image":
+				url, _ := part["image_url"].(string)
+				if url == "" {
+					return nil, fmt.Errorf("input_image requires image_url")
+				}
+				imageURL := map[string]interface{}{"url": url}
+				if detail, ok := part["detail"].(string); ok {
+					imageURL["detail"] = detail
+				}
+				parts = append(parts, map[string]interface{}{
+					"type":      "image_url",
+					"image_url": imageURL,
+				})
+			default:
+				return nil, fmt.Errorf("content type '%s' is not supported", partType)
+			}
+		}
+		return parts, nil
+	default:
+		return nil, fmt.Errorf("content: expected a string or an array of parts")
+	}
+}
+
+// newResponsesID generates an ID in the Responses API style (prefix + hex)
+func newResponsesID(prefix string) string {
+	return prefix + "_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// TransformChatCompletionToResponse converts a chat.completion object to a Responses API response
+func TransformChatCompletionToResponse(chatResp map[string]interface{}, model string) *ResponsesResponse {
+	resp := &ResponsesResponse{
+		ID:        newResponsesID("resp"),
+		Object:    "response",
+		CreatedAt: time.Now().Unix(),
+		Status:    "completed",
+		Model:     model,
+		Output:    []map[string]interface{}{},
+	}
+
+	choices, _ := chatResp["choices"].([]interface{})
+	if len(choices) > 0 {
+		choice, _ := choices[0].(map[string]interface{})
+		message, _ := choice["message"].(map[string]interface{})
+
+		reasoning, _ := message["reasoning_content"].(string)
+		if thinking, ok := chatResp["thinking"].(string); ok && reasoning == "" {
+			reasoning = thinking
+		}
+		if reasoning != "" {
+			resp.Output = append(resp.Output, reasoningItem(newResponsesID("rs"), reasoning))
+		}
+
+		if text, ok := message["content"].(string); ok && text != "" {
+			resp.Output = append(resp.Output, messageItem(newResponsesID("msg"), text, "completed"))
+		}
+
+		toolCalls, _ := message["tool_calls"].([]interface{})
+		for _, rawCall := range toolCalls {
+			call, _ := rawCall.(map[string]interface{})
+			function, _ := call["function"].(map[string]interface{})
+			callID, _ := call["id"].(string)
+			name, _ := function["name"].(string)
+			arguments, _ := function["arguments"].(string)
+			resp.Output = append(resp.Output, functionCallItem(newResponsesID("fc"), callID, name, arguments, "completed"))
+		}
+
+		finishReason, _ := choice["finish_reason"].(string)
+		resp.Status, resp.IncompleteDetails = responsesStatus(finishReason)
+	}
+
+	if usageData, ok := chatResp["usage"].(map[string]interface{}); ok {
+		resp.Usage = convertChatUsage(usageData)
+	}
+
+	return resp
+}
+
+// responsesStatus maps a chat completions finish_reason to a Responses status
+func responsesStatus(finishReason string) (string, map[string]interface{}) {
+	switch finishReason {
+	case "length":
+		return "incomplete", map[string]interface{}{"reason": "max_output_tokens"}
+	case "content_filter":
+		return "incomplete", map[string]interface{}{"reason": "content_filter"}
+	default:
+		return "completed", nil
+	}
+}
+
+// convertChatUsage converts chat completions usage to Responses usage
+func convertChatUsage(usageData map[string]interface{}) *ResponsesUsage {
+	getInt := func(m map[string]interface{}, key string) int64 {
+		if v, ok := m[key].(float64); ok {
+			return int64(v)
+		}
+		return 0
+	}
+
+	u := &ResponsesUsage{
+		InputTokens:         getInt(usageData, "prompt_tokens"),
+		OutputTokens:        getInt(usageData, "completion_tokens"),
+		InputTokensDetails:  map[string]int64{"cached_tokens": 0},
+		OutputTokensDetails: map[string]int64{"reasoning_tokens": 0},
+	}
+	if details, ok := usageData["prompt_tokens_details"].(map[string]interface{}); ok {
+		u.InputTokensDetails["cached_tokens"] = getInt(details, "cached_tokens")
+	}
+	if details, ok := usageData["completion_tokens_details"].(map[string]interface{}); ok {
+		u.OutputTokensDetails["reasoning_tokens"] = getInt(details, "reasoning_tokens")
+	}
+	u.TotalTokens = getInt(usageData, "total_tokens")
+	if u.TotalTokens == 0 {
+		u.TotalTokens = u.InputTokens + u.OutputTokens
+	}
+	return u
+}
+
+func reasoningItem(id, text string) map[string]interface{} {
+	summary := []interface{}{}
+	if text != "" {
+		summary = append(summary, map[string]interface{}{"type": "summary_text", "text": text})
+	}
+	return map[string]interface{}{
+		"type":    "reasoning",
+		"id":      id,
+		"summary": summary,
+	}
+}
+
+func messageItem(id, text, status string) map[string]interface{} {
+	content := []interface{}{}
+	if status == "completed" {
+		content = append(content, outputTextPart(text))
+	}
+	return map[string]interface{}{
+		"type":    "message",
+		"id":      id,
+		"status":  status,
+		"role":    "assistant",
+		"content": content,
+	}
+}
+
+func outputTextPart(text string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "output_text",
+		"text":        text,
+		"annotations": []interface{}{},
+	}
+}
+
+func functionCallItem(id, callID, name, arguments, status string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":      "function_call",
+		"id":        id,
+		"call_id":   callID,
+		"name":      name,
+		"arguments": arguments,
+		"status":    status,
+	}
+}
+
+// ResponsesStreamTransformer converts chat.completion.chunk SSE data into
+// Responses API stream events (response.created, response.output_text.delta, ...)
+type ResponsesStreamTransformer struct {
+	response *ResponsesResponse
+	sequence int
+	finished bool
+
+	// Currently open output item (only one item streams at a time)
+	openType  string
+	openIndex int
+	openText  strings.Builder
+
+	// Chat tool call index → output index, for argument deltas
+	toolCalls    map[int]int
+	finishReason string
+}
+
+// NewResponsesStreamTransformer creates a Responses stream transformer
+func NewResponsesStreamTransformer(model string) *ResponsesStreamTransformer {
+	return &ResponsesStreamTransformer{
+		response: &ResponsesResponse{
+			ID:        newResponsesID("resp"),
+			Object:    "response",
+			CreatedAt: time.Now().Unix(),
+			Status:    "in_progress",
+			Model:     model,
+			Output:    []map[string]interface{}{},
+		},
+		toolCalls: make(map[int]int),
+	}
+}
+
+// Start returns the response.created and response.in_progress events
+func (t *ResponsesStreamTransformer) Start() string {
+	snapshot := *t.response
+	return t.event("response.created", map[string]interface{}{"response": &snapshot}) +
+		t.event("response.in_progress", map[string]interface{}{"response": &snapshot})
+}
+
+// TransformChunk converts one chat.completion.chunk into zero or more Responses events
+func (t *ResponsesStreamTransformer) TransformChunk(chunk map[string]interface{}) string {
+	if t.finished {
+		return ""
+	}
+
+	var out strings.Builder
+
+	if usageData, ok := chunk["usage"].(map[string]interface{}); ok {
+		t.response.Usage = convertChatUsage(usageData)
+	}
+	if thinking, ok := chunk["thinking"].(string); ok && thinking != "" {
+		out.WriteString(t.reasoningDelta(thinking))
+	}
+
+	choices, _ := chunk["choices"].([]interface{})
+	for _, rawChoice := range choices {
+		choice, _ := rawChoice.(map[string]interface{})
+		if delta, ok := choice["delta"].(map[string]interface{}); ok {
+			if reasoning, ok := delta["reasoning_content"].(string); ok && reasoning != "" {
+				out.WriteString(t.reasoningDelta(reasoning))
+			}
+			if text, ok := delta["content"].(string); ok && text != "" {
+				out.WriteString(t.textDelta(text))
+			}
+			if toolCalls, ok := delta["tool_calls"].([]interface{}); ok {
+				for _, rawCall := range toolCalls {
+					if call, ok := rawCall.(map[string]interface{}); ok {
+						out.WriteString(t.toolCallDelta(call))
+					}
+				}
+			}
+		}
+		if finishReason, ok := choice["finish_reason"].(string); ok && finishReason != "" {
+			t.finishReason = finishReason
+		}
+	}
+
+	return out.String()
+}
+
+// Fail closes the stream with response.failed (upstream error mid-stream)
+func (t *ResponsesStreamTransformer) Fail(message string) string {
+	if t.finished {
+		return ""
+	}
+	out := t.closeOpenItem()
+	t.finished = true
+	t.response.Status = "failed"
+	t.response.Error = map[string]interface{}{
+		"code":    "server_error",
+		"message": message,
+	}
+	return out + t.event("response.failed", map[string]interface{}{"response": t.response})
+}
+
+// Finish closes any open item and returns response.completed (or response.incomplete)
+func (t *ResponsesStreamTransformer) Finish() string {
+	if t.finished {
+		return ""
+	}
+	out := t.closeOpenItem()
+	t.finished = true
+	t.response.Status, t.response.IncompleteDetails = responsesStatus(t.finishReason)
+	if t.response.Status == "incomplete" {
+		return out + t.event("response.incomplete", map[string]interface{}{"response": t.response})
+	}
+	return out + t.event("response.completed", map[string]interface{}{"response": t.response})
+}
+
+// Finished reports whether a terminal event has been emitted
+func (t *ResponsesStreamTransformer) Finished() bool {
+	return t.finished
+}
+
+func (t *ResponsesStreamTransformer) reasoningDelta(text string) string {
+	var out string
+	if t.openType != "reasoning" {
+		out = t.closeOpenItem()
+		item := t.openItem("reasoning", reasoningItem(newResponsesID("rs"), ""))
+		out += t.event("response.output_item.added", map[string]interface{}{"output_index": t.openIndex, "item": item})
+		out += t.event("response.reasoning_summary_part.added", map[string]interface{}{
+			"item_id":       item["id"],
+			"output_index":  t.openIndex,
+			"summary_index": 0,
+			"part":          map[string]interface{}{"type": "summary_text", "text": ""},
+		})
+	}
+	t.openText.WriteString(text)
+	return out + t.event("response.reasoning_summary_text.delta", map[string]interface{}{
+		"item_id":       t.response.Output[t.openIndex]["id"],
+		"output_index":  t.openIndex,
+		"summary_index": 0,
+		"delta":         text,
+	})
+}
+
+func (t *ResponsesStreamTransformer) textDelta(text string) string {
+	var out string
+	if t.openType != "message" {
+		out = t.closeOpenItem()
+		item := t.openItem("message", messageItem(newResponsesID("msg"), "", "in_progress"))
+		out += t.event("response.output_item.added", map[string]interface{}{"output_index": t.openIndex, "item": item})
+		out += t.event("response.content_part.added", map[string]interface{}{
+			"item_id":       item["id"],
+			"output_index":  t.openIndex,
+			"content_index": 0,
+			"part":          outputTextPart(""),
+		})
+	}
+	t.openText.WriteString(text)
+	return out + t.event("response.output_text.delta", map[string]interface{}{
+		"item_id":       t.response.Output[t.openIndex]["id"],
+		"output_index":  t.openIndex,
+		"content_index": 0,
+		"delta":         text,
+	})
+}
+
+func (t *ResponsesStreamTransformer) toolCallDelta(call map[string]interface{}) string {
+	callIndex := 0
+	if idx, ok := call["index"].(float64); ok {
+		callIndex = int(idx)
+	}
+	function, _ := call["function"].(map[string]interface{})
+	arguments, _ := function["arguments"].(string)
+
+	var out string
+	outputIndex, seen := t.toolCalls[callIndex]
+	if !seen {
+		out = t.closeOpenItem()
+		callID, _ := call["id"].(string)
+		name, _ := function["name"].(string)
+		item := t.openItem("function_call", functionCallItem(newResponsesID("fc"), callID, name, "", "in_progress"))
+		t.toolCalls[callIndex] = t.openIndex
+		outputIndex = t.openIndex
+		out += t.event("response.output_item.added", map[string]interface{}{"output_index": t.openIndex, "item": item})
+	}
+	if arguments == "" {
+		return out
+	}
+
+	if t.openType != "function_call" || t.openIndex != outputIndex {
+		// Late arguments for an item that was already closed: keep them in the final output only
+		item := t.response.Output[outputIndex]
+		item["arguments"] = item["arguments"].(string) + arguments
+		return out
+	}
+	t.openText.WriteString(arguments)
+	return out + t.event("response.function_call_arguments.delta", map[string]interface{}{
+		"item_id":      t.response.Output[outputIndex]["id"],
+		"output_index": outputIndex,
+		"delta":        arguments,
+	})
+}
+
+// openItem appends item to the output and marks it as the item receiving deltas
+func (t *ResponsesStreamTransformer) openItem(itemType string, item map[string]interface{}) map[string]interface{} {
+	t.response.Output = append(t.response.Output, item)
+	t.openType = itemType
+	t.openIndex = len(t.response.Output) - 1
+	t.openText.Reset()
+	return item
+}
+
+// closeOpenItem emits the *.done events for the open item and stores its final state
+func (t *ResponsesStreamTransformer) closeOpenItem() string {
+	if t.openType == "" {
+		return ""
+	}
+
+	item := t.response.Output[t.openIndex]
+	text := t.openText.String()
+	var out string
+
+	switch t.openType {
+	case "reasoning":
+		part := map[string]interface{}{"type": "summary_text", "text": text}
+		out += t.event("response.reasoning_summary_text.done", map[string]interface{}{
+			"item_id":       item["id"],
+			"output_index":  t.openIndex,
+			"summary_index": 0,
+			"text":          text,
+		})
+		out += t.event("response.reasoning_summary_part.done", map[string]interface{}{
+			"item_id":       item["id"],
+			"output_index":  t.openIndex,
+			"summary_index": 0,
+			"part":          part,
+		})
+		item["summary"] = []interface{}{part}
+	case "message":
+		part := outputTextPart(text)
+		out += t.event("response.output_text.done", map[string]interface{}{
+			"item_id":       item["id"],
+			"output_index":  t.openIndex,
+			"content_index": 0,
+			"text":          text,
+		})
+		out += t.event("response.content_part.done", map[string]interface{}{
+			"item_id":       item["id"],
+			"output_index":  t.openIndex,
+			"content_index": 0,
+			"part":          part,
+		})
+		item["content"] = []interface{}{part}
+		item["status"] = "completed"
+	case "function_call":
+		item["arguments"] = text
+		item["status"] = "completed"
+		out += t.event("response.function_call_arguments.done", map[string]interface{}{
+			"item_id":      item["id"],
+			"output_index": t.openIndex,
+			"arguments":    text,
+		})
+	}
+
+	out += t.event("response.output_item.done", map[string]interface{}{"output_index": t.openIndex, "item": item})
+	t.openType = ""
+	t.openText.Reset()
+	return out
+}
+
+// event formats a Responses SSE event with its type and sequence number
+func (t *ResponsesStreamTransformer) event(eventType string, data map[string]interface{}) string {
+	data["type"] = eventType
+	data["sequence_number"] = t.sequence
+	t.sequence++
+	jsonData, _ := json.Marshal(data)
+	return fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, string(jsonData))
+}
@@ -0,0 +1,320 @@
+package transformers
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// Responses API Tests
+// =============================================================================
+
+func decodeJSON(t *testing.T, data string) map[string]interface{} {
+	t.Helper()
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		t.Fatalf("invalid JSON %q: %v", data, err)
+	}
+	return m
+}
+
+func TestTransformResponsesToOpenAI_StringInput(t *testing.T) {
+	req := &ResponsesRequest{
+		Model:           "gpt-5",
+		Input:           "Hello",
+		Instructions:    "Be brief.",
+		MaxOutputTokens: 500,
+		Stream:          true,
+		Reasoning:       &ReasoningConfig{Effort: "high"},
+	}
+
+	openaiReq, err := TransformResponsesToOpenAI(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(openaiReq.Messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(openaiReq.Messages))
+	}
+	if openaiReq.Messages[0].Role != "system" || openaiReq.Messages[0].Content != "Be brief." {
+		t.Errorf("Expected instructions as system message, got %+v", openaiReq.Messages[0])
+	}
+	if openaiReq.Messages[1].Role != "user" || openaiReq.Messages[1].Content != "Hello" {
+		t.Errorf("Expected user message, got %+v", openaiReq.Messages[1])
+	}
+	if openaiReq.MaxTokens != 500 || !openaiReq.Stream || openaiReq.ReasoningEffort != "high" {
+		t.Errorf("Parameters not carried over: %+v", openaiReq)
+	}
+}
+
+func TestTransformResponsesToOpenAI_ToolCallItems(t *testing.T) {
+	body := `{
+		"model": "claude-sonnet-4-5-20250929",
+		"input": [
+			{"role": "developer", "content": "Use tools."},
+			{"type": "message", "role": "user", "content": [
+				{"type": "input_text", "text": "Weather in Hanoi and Paris?"},
+				{"type": "input_image", "image_url": "https://example.com/a.png"}
+			]},
+			{"type": "reasoning", "id": "rs_1", "summary": []},
+			{"type": "function_call", "call_id": "call_1", "name": "get_weather", "arguments": "{\"city\":\"Hanoi\"}"},
+			{"type": "function_call", "call_id": "call_2", "name": "get_weather", "arguments": "{\"city\":\"Paris\"}"},
+			{"type": "function_call_output", "call_id": "call_1", "output": "30C"},
+			{"type": "function_call_output", "call_id": "call_2", "output": {"temp": 18}}
+		],
+		"tools": [
+			{"type": "function", "name": "get_weather", "description": "Get weather", "parameters": {"type": "object"}}
+		]
+	}`
+	var req ResponsesRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	openaiReq, err := TransformResponsesToOpenAI(&req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	roles := []string{}
+	for _, msg := range openaiReq.Messages {
+		roles = append(roles, msg.Role)
+	}
+	if strings.Join(roles, ",") != "system,user,assistant,tool,tool" {
+		t.Fatalf("Unexpected roles: %v", roles)
+	}
+
+	parts, _ := openaiReq.Messages[1].Content.([]interface{})
+	if len(parts) != 2 || parts[1].(map[string]interface{})["type"] != "image_url" {
+		t.Errorf("Expected text and image_url parts, got %v", openaiReq.Messages[1].Content)
+	}
+
+	toolCalls, _ := openaiReq.Messages[2].ToolCalls.([]interface{})
+	if len(toolCalls) != 2 {
+		t.Fatalf("Expected both function calls merged into one assistant message, got %v", openaiReq.Messages[2].ToolCalls)
+	}
+
+	if openaiReq.Messages[3].ToolCallID != "call_1" || openaiReq.Messages[3].Content != "30C" {
+		t.Errorf("Unexpected tool result: %+v", openaiReq.Messages[3])
+	}
+	if openaiReq.Messages[4].Content != `{"temp":18}` {
+		t.Errorf("Expected non-string output as JSON, got %v", openaiReq.Messages[4].Content)
+	}
+
+	if len(openaiReq.Tools) != 1 {
+		t.Fatalf("Expected 1 tool, got %d", len(openaiReq.Tools))
+	}
+	function := openaiReq.Tools[0].(map[string]interface{})["function"].(map[string]interface{})
+	if function["name"] != "get_weather" || function["description"] != "Get weather" {
+		t.Errorf("Unexpected tool conversion: %v", function)
+	}
+}
+
+func TestTransformResponsesToOpenAI_Unsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		req  ResponsesRequest
+	}{
+		{"previous response", ResponsesRequest{Input: "hi", PreviousResponseID: "resp_1"}},
+		{"built-in tool", ResponsesRequest{Input: "hi", Tools: []interface{}{map[string]interface{}{"type": "web_search"}}}},
+		{"unknown item", ResponsesRequest{Input: []interface{}{map[string]interface{}{"type": "file_search_call"}}}},
+		{"input file", ResponsesRequest{Input: []interface{}{map[string]interface{}{
+			"role":    "user",
+			"content": []interface{}{map[string]interface{}{"type": "input_file", "file_id": "file_1"}},
+		}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := TransformResponsesToOpenAI(&tt.req); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestTransformChatCompletionToResponse(t *testing.T) {
+	chatResp := decodeJSON(t, `{
+		"id": "chatcmpl-1",
+		"object": "chat.completion",
+		"thinking": "Let me check.",
+		"choices": [{
+			"index": 0,
+			"message": {
+				"role": "assistant",
+				"content": "Checking the weather.",
+				"tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Hanoi\"}"}}]
+			},
+			"finish_reason": "tool_calls"
+		}],
+		"usage": {"prompt_tokens": 100, "completion_tokens": 20, "prompt_tokens_details": {"cached_tokens": 80}}
+	}`)
+
+	resp := TransformChatCompletionToResponse(chatResp, "claude-sonnet-4-5-20250929")
+
+	if resp.Object != "response" || resp.Status != "completed" || !strings.HasPrefix(resp.ID, "resp_") {
+		t.Errorf("Unexpected response envelope: %+v", resp)
+	}
+
+	types := []string{}
+	for _, item := range resp.Output {
+		types = append(types, item["type"].(string))
+	}
+	if strings.Join(types, ",") != "reasoning,message,function_call" {
+		t.Fatalf("Unexpected output items: %v", types)
+	}
+	if resp.Output[2]["call_id"] != "call_1" || resp.Output[2]["arguments"] != `{"city":"Hanoi"}` {
+		t.Errorf("Unexpected function_call item: %v", resp.Output[2])
+	}
+
+	if resp.Usage == nil || resp.Usage.InputTokens != 100 || resp.Usage.OutputTokens != 20 || resp.Usage.TotalTokens != 120 {
+		t.Errorf("Unexpected usage: %+v", resp.Usage)
+	}
+	if resp.Usage.InputTokensDetails["cached_tokens"] != 80 {
+		t.Errorf("Expected cached_tokens=80, got %v", resp.Usage.InputTokensDetails)
+	}
+}
+
+func TestTransformChatCompletionToResponse_Length(t *testing.T) {
+	chatResp := decodeJSON(t, `{"choices": [{"message": {"role": "assistant", "content": "Trunc"}, "finish_reason": "length"}]}`)
+
+	resp := TransformChatCompletionToResponse(chatResp, "gpt-5")
+	if resp.Status != "incomplete" || resp.IncompleteDetails["reason"] != "max_output_tokens" {
+		t.Errorf("Expected incomplete/max_output_tokens, got %s %v", resp.Status, resp.IncompleteDetails)
+	}
+}
+
+// parseResponsesEvents splits SSE output into (event type, data) pairs
+func parseResponsesEvents(t *testing.T, stream string) ([]string, []map[string]interface{}) {
+	t.Helper()
+	var types []string
+	var data []map[string]interface{}
+	for _, block := range strings.Split(strings.TrimSpace(stream), "\n\n") {
+		lines := strings.SplitN(block, "\n", 2)
+		if len(lines) != 2 {
+			t.Fatalf("malformed event %q", block)
+		}
+		eventType := strings.TrimPrefix(lines[0], "event: ")
+		payload := decodeJSON(t, strings.TrimPrefix(lines[1], "data: "))
+		if payload["type"] != eventType {
+			t.Errorf("event %s has type %v", eventType, payload["type"])
+		}
+		types = append(types, eventType)
+		data = append(data, payload)
+	}
+	return types, data
+}
+
+func TestResponsesStreamTransformer(t *testing.T) {
+	transformer := NewResponsesStreamTransformer("gpt-5")
+
+	chunks := []string{
+		`{"choices":[{"index":0,"delta":{"role":"assistant"}}]}`,
+		`{"choices":[{"index":0,"delta":{"reasoning_content":"Think"}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"Hel"}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Hanoi\"}"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+		`{"choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`,
+	}
+
+	var out strings.Builder
+	out.WriteString(transformer.Start())
+	for _, chunk := range chunks {
+		out.WriteString(transformer.TransformChunk(decodeJSON(t, chunk)))
+	}
+	out.WriteString(transformer.Finish())
+
+	if !transformer.Finished() || transformer.Finish() != "" {
+		t.Error("Expected Finish to be terminal and idempotent")
+	}
+
+	types, data := parseResponsesEvents(t, out.String())
+	expected := []string{
+		"response.created",
+		"response.in_progress",
+		"response.output_item.added",
+		"response.reasoning_summary_part.added",
+		"response.reasoning_summary_text.delta",
+		"response.reasoning_summary_text.done",
+		"response.reasoning_summary_part.done",
+		"response.output_item.done",
+		"response.output_item.added",
+		"response.content_part.added",
+		"response.output_text.delta",
+		"response.output_text.delta",
+		"response.output_text.done",
+		"response.content_part.done",
+		"response.output_item.done",
+		"response.output_item.added",
+		"response.function_call_arguments.delta",
+		"response.function_call_arguments.delta",
+		"response.function_call_arguments.done",
+		"response.output_item.done",
+		"response.completed",
+	}
+	if strings.Join(types, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected event sequence:\n%s", strings.Join(types, "\n"))
+	}
+
+	for i, payload := range data {
+		if int(payload["sequence_number"].(float64)) != i {
+			t.Errorf("event %d has sequence_number %v", i, payload["sequence_number"])
+		}
+	}
+
+	if data[12]["text"] != "Hello" {
+		t.Errorf("Expected output_text.done text 'Hello', got %v", data[12]["text"])
+	}
+
+	completed := data[len(data)-1]["response"].(map[string]interface{})
+	if completed["status"] != "completed" {
+		t.Errorf("Expected status completed, got %v", completed["status"])
+	}
+	output := completed["output"].([]interface{})
+	if len(output) != 3 {
+		t.Fatalf("Expected 3 output items, got %d", len(output))
+	}
+	call := output[2].(map[string]interface{})
+	if call["arguments"] != `{"city":"Hanoi"}` || call["call_id"] != "call_1" || call["status"] != "completed" {
+		t.Errorf("Unexpected final function_call item: %v", call)
+	}
+	usage := completed["usage"].(map[string]interface{})
+	if usage["input_tokens"].(float64) != 10 || usage["output_tokens"].(float64) != 5 {
+		t.Errorf("Unexpected usage: %v", usage)
+	}
+}
+
+func TestResponsesStreamTransformer_AnthropicThinkingAndFailure(t *testing.T) {
+	transformer := NewResponsesStreamTransformer("claude-sonnet-4-5-20250929")
+
+	var out strings.Builder
+	out.WriteString(transformer.Start())
+	out.WriteString(transformer.TransformChunk(decodeJSON(t, `{"choices":[{"index":0,"delta":{}}],"thinking":"Hmm"}`)))
+	out.WriteString(transformer.TransformChunk(decodeJSON(t, `{"choices":[{"index":0,"delta":{"content":"Par"}}]}`)))
+	out.WriteString(transformer.Fail("Stream interrupted"))
+
+	if transformer.TransformChunk(decodeJSON(t, `{"choices":[{"index":0,"delta":{"content":"tial"}}]}`)) != "" {
+		t.Error("Expected no events after a terminal event")
+	}
+
+	types, data := parseResponsesEvents(t, out.String())
+	if types[2] != "response.output_item.added" || data[2]["item"].(map[string]interface{})["type"] != "reasoning" {
+		t.Errorf("Expected top-level thinking to open a reasoning item, got %s", types[2])
+	}
+
+	last := data[len(data)-1]
+	if types[len(types)-1] != "response.failed" {
+		t.Fatalf("Expected response.failed, got %s", types[len(types)-1])
+	}
+	response := last["response"].(map[string]interface{})
+	if response["error"].(map[string]interface{})["message"] != "Stream interrupted" {
+		t.Errorf("Unexpected error: %v", response["error"])
+	}
+	if types[len(types)-2] != "response.output_item.done" {
+		t.Errorf("Expected the open message to be closed before response.failed")
+	}
+}
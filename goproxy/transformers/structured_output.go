@@ -0,0 +1,113 @@
+package transformers
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// StructuredOutputToolName is the tool Anthropic requests are forced to call when
+// response_format asks for JSON. Its input is unwrapped back into message.content.
+const StructuredOutputToolName = "structured_output"
+
+// StructuredOutputError reports model output that does not satisfy response_format
+type StructuredOutputError struct {
+	Reason string
+}
+
+func (e *StructuredOutputError) Error() string {
+	return "Model output does not match response_format: " + e.Reason
+}
+
+// ErrorChunk returns the error as an OpenAI stream error event
+func (e *StructuredOutputError) ErrorChunk() string {
+	data, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": e.Error(),
+			"type":    "invalid_response_error",
+			"code":    "structured_output_invalid",
+		},
+	})
+	return fmt.Sprintf("data: %s\n\n", string(data))
+}
+
+// wantsJSON reports whether response_format requests JSON output
+func (rf *ResponseFormat) wantsJSON() bool {
+	return rf != nil && (rf.Type == "json_object" || rf.Type == "json_schema")
+}
+
+// structuredOutputSchema returns the input_schema for the structured output tool
+func structuredOutputSchema(rf *ResponseFormat) map[string]interface{} {
+	if rf.Type == "json_schema" && rf.JSONSchema != nil && rf.JSONSchema.Schema != nil {
+		return rf.JSONSchema.Schema
+	}
+	return map[string]interface{}{"type": "object"}
+}
+
+// validateStructuredOutputFormat checks that response_format can be emulated with a tool:
+// Anthropic tool inputs are always objects, so the schema root must be an object
+func validateStructuredOutputFormat(rf *ResponseFormat) error {
+	if rf == nil || rf.Type != "json_schema" {
+		return nil
+	}
+	if rf.JSONSchema.Schema == nil {
+		return unsupportedParam("response_format", "response_format.json_schema.schema is required")
+	}
+	if rootType, _ := rf.JSONSchema.Schema["type"].(string); rootType != "object" {
+		return unsupportedParam("response_format", "response_format.json_schema.schema must have type 'object' at the root")
+	}
+	return nil
+}
+
+// applyStructuredOutput emulates response_format on an Anthropic request by adding a tool
+// whose input_schema is the requested schema and forcing the model to call it.
+// With client tools present the model may call either (tool_choice any), matching
+// OpenAI where the final answer, not tool calls, follows the format. Client tools are
+// always kept, even when forcing the output tool: Anthropic rejects a history with
+// tool_use blocks for tools the request does not define.
+func applyStructuredOutput(anthropicReq *AnthropicRequest, req *OpenAIRequest) {
+	rf := req.ResponseFormat
+	if !rf.wantsJSON() {
+		return
+	}
+
+	description := "Respond by calling this tool. Its input is the final answer as JSON."
+	if rf.JSONSchema != nil && rf.JSONSchema.Description != "" {
+		description += " " + rf.JSONSchema.Description
+	}
+	outputTool := map[string]interface{}{
+		"name":         StructuredOutputToolName,
+		"description":  description,
+		"input_schema": structuredOutputSchema(rf),
+	}
+
+	mode, _, _ := normalizeToolChoice(req.ToolChoice)
+	switch {
+	case mode == "function":
+		// Client forces one of its own tools this turn; keep that
+		anthropicReq.Tools = append(anthropicReq.Tools, outputTool)
+	case len(anthropicReq.Tools) > 0 && mode != "none":
+		anthropicReq.Tools = append(anthropicReq.Tools, outputTool)
+		anthropicReq.ToolChoice = map[string]interface{}{"type": "any"}
+	default:
+		// No client tools, or tool_choice none: only the output tool may be called
+		anthropicReq.Tools = append(anthropicReq.Tools, outputTool)
+		anthropicReq.ToolChoice = map[string]interface{}{"type": "tool", "name": StructuredOutputToolName}
+	}
+}
+
+// checkStructuredOutput validates the unwrapped JSON text against response_format
+func checkStructuredOutput(rf *ResponseFormat, text string) error {
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return &StructuredOutputError{Reason: "invalid JSON: " + err.Error()}
+	}
+	if _, ok := value.(map[string]interface{}); !ok {
+		return &StructuredOutputError{Reason: "expected a JSON object"}
+	}
+	if rf.Type == "json_schema" && rf.JSONSchema != nil && rf.JSONSchema.Schema != nil {
+		if err := ValidateJSONSchema(rf.JSONSchema.Schema, value); err != nil {
+			return &StructuredOutputError{Reason: err.Error()}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package transformers
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// Structured Output (response_format on Anthropic) Tests
+// =============================================================================
+
+const personFormat = `{"type":"json_schema","json_schema":{"name":"person","schema":{
+	"type":"object",
+	"properties":{"name":{"type":"string"},"age":{"type":"integer"}},
+	"required":["name","age"],
+	"additionalProperties":false
+}}}`
+
+func TestTransformToAnthropic_StructuredOutput(t *testing.T) {
+	req := parseOpenAIRequest(t, `{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [{"role": "user", "content": "Who?"}],
+		"reasoning_effort": "high",
+		"response_format": `+personFormat+`
+	}`)
+
+	anthropicReq := TransformToAnthropic(req)
+
+	if len(anthropicReq.Tools) != 1 {
+		t.Fatalf("Expected only the structured output tool, got %v", anthropicReq.Tools)
+	}
+	tool := anthropicReq.Tools[0].(map[string]interface{})
+	schema := tool["input_schema"].(map[string]interface{})
+	if tool["name"] != StructuredOutputToolName || schema["required"] == nil {
+		t.Errorf("Expected structured output tool with the requested schema, got %v", tool)
+	}
+	expectedChoice := map[string]interface{}{"type": "tool", "name": StructuredOutputToolName}
+	if !reflect.DeepEqual(anthropicReq.ToolChoice, expectedChoice) {
+		t.Errorf("Expected tool_choice %v, got %v", expectedChoice, anthropicReq.ToolChoice)
+	}
+	if anthropicReq.Thinking != nil {
+		t.Errorf("Expected thinking disabled with forced structured output, got %+v", anthropicReq.Thinking)
+	}
+}
+
+func TestTransformToAnthropic_StructuredOutputWithTools(t *testing.T) {
+	req := parseOpenAIRequest(t, `{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [{"role": "user", "content": "Who?"}],
+		"tools": [{"type": "function", "function": {"name": "lookup", "parameters": {"type": "object"}}}],
+		"response_format": {"type": "json_object"}
+	}`)
+
+	anthropicReq := TransformToAnthropic(req)
+
+	if len(anthropicReq.Tools) != 2 {
+		t.Fatalf("Expected client tool plus structured output tool, got %v", anthropicReq.Tools)
+	}
+	if !reflect.DeepEqual(anthropicReq.ToolChoice, map[string]interface{}{"type": "any"}) {
+		t.Errorf("Expected tool_choice any, got %v", anthropicReq.ToolChoice)
+	}
+}
+
+func TestTransformToAnthropic_StructuredOutputToolChoiceNone(t *testing.T) {
+	req := parseOpenAIRequest(t, `{
+		"model": "claude-sonnet-4-5-20250929",
+		"messages": [
+			{"role": "user", "content": "Who?"},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "lookup", "arguments": "{}"}}]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "Ada"}
+		],
+		"tools": [{"type": "function", "function": {"name": "lookup", "parameters": {"type": "object"}}}],
+		"tool_choice": "none",
+		"response_format": {"type": "json_object"}
+	}`)
+
+	anthropicReq := TransformToAnthropic(req)
+
+	if len(anthropicReq.Tools) != 2 {
+		t.Fatalf("Expected the client tool kept for the tool_use history, got %v", anthropicReq.Tools)
+	}
+	expectedChoice := map[string]interface{}{"type": "tool", "name": StructuredOutputToolName}
+	if !reflect.DeepEqual(anthropicReq.ToolChoice, expectedChoice) {
+		t.Errorf("Expected tool_choice %v, got %v", expectedChoice, anthropicReq.ToolChoice)
+	}
+}
+
+func structuredTransformer(t *testing.T) *AnthropicResponseTransformer {
+	t.Helper()
+	req := parseOpenAIRequest(t, `{"model":"claude-sonnet-4-5-20250929","response_format":`+personFormat+`}`)
+	transformer := NewAnthropicResponseTransformer("claude-sonnet-4-5-20250929", "req-1")
+	transformer.ResponseFormat = req.ResponseFormat
+	return transformer
+}
+
+func TestAnthropicNonStream_StructuredOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		errorHas string
+	}{
+		{"valid", `{"name":"Ada","age":36}`, ""},
+		{"schema mismatch", `{"name":"Ada"}`, "missing required property 'age'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var anthropicResp map[string]interface{}
+			json.Unmarshal([]byte(`{
+				"id": "msg_1",
+				"stop_reason": "tool_use",
+				"content": [{"type": "tool_use", "id": "toolu_1", "name": "structured_output", "input": `+tt.input+`}],
+				"usage": {"input_tokens": 10, "output_tokens": 5}
+			}`), &anthropicResp)
+
+			resp, err := structuredTransformer(t).TransformNonStreamResponse(anthropicResp)
+
+			if tt.errorHas != "" {
+				var structuredErr *StructuredOutputError
+				if !errors.As(err, &structuredErr) || !strings.Contains(err.Error(), tt.errorHas) {
+					t.Errorf("Expected StructuredOutputError containing %q, got %v", tt.errorHas, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var content map[string]interface{}
+			if err := json.Unmarshal([]byte(resp.Choices[0].Message.Content), &content); err != nil || content["name"] != "Ada" {
+				t.Errorf("Expected JSON content, got %v", resp.Choices[0].Message.Content)
+			}
+			if resp.Choices[0].Message.ToolCalls != nil {
+				t.Errorf("Expected structured output tool call to be hidden, got %v", resp.Choices[0].Message.ToolCalls)
+			}
+			if resp.Choices[0].FinishReason == nil || *resp.Choices[0].FinishReason != "stop" {
+				t.Errorf("Expected finish_reason stop, got %v", resp.Choices[0].FinishReason)
+			}
+		})
+	}
+}
+
+func TestAnthropicStream_StructuredOutput(t *testing.T) {
+	run := func(partials ...string) string {
+		transformer := structuredTransformer(t)
+		events := [][2]string{
+			{"content_block_start", `{"index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":"structured_output","input":{}}}`},
+		}
+		for _, p := range partials {
+			data, _ := json.Marshal(map[string]interface{}{"index": 0, "delta": map[string]interface{}{"type": "input_json_delta", "partial_json": p}})
+			events = append(events, [2]string{"content_block_delta", string(data)})
+		}
+		events = append(events,
+			[2]string{"content_block_stop", `{"index":0}`},
+			[2]string{"message_delta", `{"delta":{"stop_reason":"tool_use"}}`},
+		)
+
+		var out strings.Builder
+		for _, e := range events {
+			var data map[string]interface{}
+			json.Unmarshal([]byte(e[1]), &data)
+			chunk, err := transformer.TransformStreamChunk(e[0], data)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			out.WriteString(chunk)
+		}
+		return out.String()
+	}
+
+	valid := run(`{"name":`, `"Ada","age":36}`)
+	if !strings.Contains(valid, `"content":"{\"name\":\"Ada\",\"age\":36}"`) || strings.Contains(valid, "tool_calls") {
+		t.Errorf("Expected validated tool input sent as one content chunk, got %s", valid)
+	}
+	if !strings.Contains(valid, `"finish_reason":"stop"`) || strings.Contains(valid, "structured_output_invalid") {
+		t.Errorf("Expected clean finish with stop, got %s", valid)
+	}
+
+	invalid := run(`{"name":"Ada",`, `"age":"old"}`)
+	if !strings.Contains(invalid, "structured_output_invalid") || !strings.Contains(invalid, "$.age: expected integer, got string") {
+		t.Errorf("Expected structured output error chunk, got %s", invalid)
+	}
+	if strings.Contains(invalid, `"content":"{`) {
+		t.Errorf("Expected no partial content before the error, got %s", invalid)
+	}
+}
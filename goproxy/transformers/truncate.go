@@ -3,7 +3,9 @@ package transformers
 import (
 	"log"
 	"strings"
-	"unicode/utf8"
+
+	"goproxy/config"
+	"goproxy/internal/tokenizer"
 )
 
 // Token limits for different models
@@ -16,17 +18,9 @@ const (
 	// Default max tokens to target (200K - 15K safety = 185K)
 	DefaultTargetMaxTokens = DefaultMaxContextTokens - DefaultSafetyMargin
 
-	// Token estimation ratios
-	// English text: ~4 chars per token
-	// Unicode/CJK/Vietnamese: ~1.5-2 chars per token
-	// We use rune count with conservative ratio of 3 runes per token
-	RunesPerToken = 3
-
 	// Overhead constants
-	TokensPerMessageOverhead  = 4   // Tokens for role, separators, etc.
-	TokensPerToolDefinition   = 100 // Rough estimate for tool schema
-	TokensPerImageEstimate    = 750 // Conservative estimate for images
-	TokensPerToolCallOverhead = 50  // Overhead for tool_calls structure
+	TokensPerMessageOverhead  = tokenizer.MessageOverhead // Tokens for role, separators, etc.
+	TokensPerToolCallOverhead = 10                        // Overhead for tool_calls structure (id, type wrapper)
 )
 
 // TruncationResult contains information about what was truncated
@@ -38,103 +32,73 @@ type TruncationResult struct {
 	TokensRemoved   int64
 }
 
-// EstimateOpenAITokens estimates token count for an OpenAI request
-// Uses rune-based estimation for better Unicode support
-// Anthropic doesn't provide a local tokenizer, so this is an approximation
-func EstimateOpenAITokens(req *OpenAIRequest) int64 {
-	var totalTokens int64
-
-	// Count tokens in all messages
-	for _, msg := range req.Messages {
-		totalTokens += estimateMessageTokens(&msg)
+// encodingForModel returns the tokenizer configured for a model (see config.Model.Tokenizer).
+// If no vocabulary loads it returns nil, which estimates counts from the text length.
+func encodingForModel(modelID string) *tokenizer.Encoding {
+	enc, err := tokenizer.Get(config.GetModelTokenizer(modelID))
+	if err != nil {
+		log.Printf("⚠️ [Tokenizer] %v, estimating tokens from text length", err)
 	}
+	return enc
+}
 
-	// Add overhead for message structure
-	totalTokens += int64(len(req.Messages) * TokensPerMessageOverhead)
+// EstimateOpenAITokens estimates token count for an OpenAI request
+// Counts with the model's BPE tokenizer, including tool schemas and image blocks
+func EstimateOpenAITokens(req *OpenAIRequest) int64 {
+	enc := encodingForModel(req.Model)
+	return estimateOpenAIMessagesTokens(enc, req.Messages) + estimateToolsTokens(enc, req.Tools)
+}
 
-	// Add overhead for tools if present
-	if len(req.Tools) > 0 {
-		totalTokens += int64(len(req.Tools) * TokensPerToolDefinition)
+// estimateOpenAIMessagesTokens counts messages plus per-message overhead
+func estimateOpenAIMessagesTokens(enc *tokenizer.Encoding, messages []OpenAIMessage) int64 {
+	var totalTokens int64
+	for i := range messages {
+		totalTokens += estimateMessageTokens(enc, &messages[i])
 	}
-
-	return totalTokens
+	return totalTokens + int64(len(messages)*TokensPerMessageOverhead)
 }
 
-// estimateMessageTokens estimates tokens for a single message
-// Uses utf8.RuneCountInString for proper Unicode handling
-func estimateMessageTokens(msg *OpenAIMessage) int64 {
+// estimateToolsTokens counts tool definitions as their JSON schema
+func estimateToolsTokens(enc *tokenizer.Encoding, tools []interface{}) int64 {
 	var tokens int64
-
-	// Add role tokens (role is always ASCII)
-	tokens += int64(len(msg.Role)) / 4
-	if tokens == 0 {
-		tokens = 1 // Minimum 1 token for role
+	for _, tool := range tools {
+		tokens += int64(enc.CountJSON(tool))
 	}
+	return tokens
+}
 
-	// Add content tokens
-	if content, ok := msg.Content.(string); ok {
-		tokens += estimateStringTokens(content)
-	} else if parts, ok := msg.Content.([]interface{}); ok {
-		for _, part := range parts {
-			if partMap, ok := part.(map[string]interface{}); ok {
-				if text, ok := partMap["text"].(string); ok {
-					tokens += estimateStringTokens(text)
-				}
-				// Images have fixed token cost
-				if partMap["type"] == "image_url" {
-					tokens += TokensPerImageEstimate
-				}
-			}
-		}
-	}
+// estimateMessageTokens estimates tokens for a single message
+// Content may be a string or an array of parts (text, image_url)
+func estimateMessageTokens(enc *tokenizer.Encoding, msg *OpenAIMessage) int64 {
+	tokens := int64(enc.CountContent(msg.Content))
 
-	// Add tool_calls overhead
+	// Add tool_calls tokens
 	if msg.ToolCalls != nil {
-		tokens += TokensPerToolCallOverhead
-		// Estimate tokens for tool call content
 		if toolCalls, ok := msg.ToolCalls.([]interface{}); ok {
 			for _, tc := range toolCalls {
+				tokens += TokensPerToolCallOverhead
 				if tcMap, ok := tc.(map[string]interface{}); ok {
-					// Function name
-					if name, ok := tcMap["function"].(map[string]interface{}); ok {
-						if fnName, ok := name["name"].(string); ok {
-							tokens += estimateStringTokens(fnName)
+					if fn, ok := tcMap["function"].(map[string]interface{}); ok {
+						if fnName, ok := fn["name"].(string); ok {
+							tokens += estimateStringTokens(enc, fnName)
 						}
-						if args, ok := name["arguments"].(string); ok {
-							tokens += estimateStringTokens(args)
+						if args, ok := fn["arguments"].(string); ok {
+							tokens += estimateStringTokens(enc, args)
 						}
 					}
 				}
 			}
+		} else {
+			tokens += int64(enc.CountJSON(msg.ToolCalls))
 		}
 	}
 
 	return tokens
 }
 
-// estimateStringTokens estimates tokens for a string using rune count
-// This provides better accuracy for Unicode text (Vietnamese, CJK, etc.)
-func estimateStringTokens(s string) int64 {
-	if len(s) == 0 {
-		return 0
-	}
-
-	// Count runes (Unicode code points) instead of bytes
-	runeCount := utf8.RuneCountInString(s)
-
-	// Use conservative ratio: ~3 runes per token
-	// This works reasonably well for:
-	// - English: 1 word ≈ 1.3 tokens, average word length 4-5 chars
-	// - Vietnamese: diacritics make chars ≈ 1-2 tokens each
-	// - CJK: 1-2 characters per token
-	tokens := int64(runeCount) / RunesPerToken
-
-	// Minimum 1 token for non-empty strings
-	if tokens == 0 {
-		tokens = 1
-	}
-
-	return tokens
+// estimateStringTokens counts tokens in a string with the BPE tokenizer
+func estimateStringTokens(enc *tokenizer.Encoding, s string) int64 {
+	return int64(enc.Count(s))
 }
 
 // TruncateOpenAIRequest truncates messages to fit within token limit
@@ -169,11 +133,20 @@ func TruncateOpenAIRequest(req *OpenAIRequest, maxTokens int64) (*OpenAIRequest,
 	removedCount := 0
 	removedTokens := int64(0)
 
+	// Count each message once; the running total is updated as messages are removed
+	enc := encodingForModel(req.Model)
+	messageTokens := make([]int64, len(messages))
+	currentTokens := estimateToolsTokens(enc, req.Tools)
+	for i := range messages {
+		messageTokens[i] = estimateMessageTokens(enc, &messages[i]) + TokensPerMessageOverhead
+		currentTokens += messageTokens[i]
+	}
+
 	// SAFETY: Prevent infinite loop - max iterations is number of messages
 	maxIterations := len(messages)
 	iterations := 0
 
-	for EstimateOpenAIRequestTokens(messages) > maxTokens {
+	for currentTokens > maxTokens {
 		iterations++
 		if iterations > maxIterations {
 			log.Printf("🚨 [Truncate] Max iterations (%d) reached, breaking to prevent infinite loop", maxIterations)
@@ -286,28 +259,22 @@ func TruncateOpenAIRequest(req *OpenAIRequest, maxTokens int64) (*OpenAIRequest,
 		// Calculate tokens being removed and remove messages
 		for _, idx := range indicesToRemove {
 			if idx < len(messages) {
-				removedTokens += estimateMessageTokens(&messages[idx]) / 4
+				removedTokens += messageTokens[idx]
+				currentTokens -= messageTokens[idx]
 				messages = append(messages[:idx], messages[idx+1:]...)
+				messageTokens = append(messageTokens[:idx], messageTokens[idx+1:]...)
 				removedCount++
 			}
 		}
 	}
 
 	// Create new request with truncated messages
-	truncatedReq := &OpenAIRequest{
-		Model:            req.Model,
-		Messages:         messages,
-		MaxTokens:        req.MaxTokens,
-		Temperature:      req.Temperature,
-		TopP:             req.TopP,
-		Stream:           req.Stream,
-		Tools:            req.Tools,
-		PresencePenalty:  req.PresencePenalty,
-		FrequencyPenalty: req.FrequencyPenalty,
-	}
+	// Copy so every other request parameter is carried over unchanged
+	truncatedReq := *req
+	truncatedReq.Messages = messages
 
 	result.WasTruncated = removedCount > 0
-	result.FinalTokens = EstimateOpenAITokens(truncatedReq)
+	result.FinalTokens = EstimateOpenAITokens(&truncatedReq)
 	result.MessagesRemoved = removedCount
 	result.TokensRemoved = removedTokens
 
@@ -316,74 +283,27 @@ func TruncateOpenAIRequest(req *OpenAIRequest, maxTokens int64) (*OpenAIRequest,
 			removedCount, removedTokens, result.OriginalTokens, result.FinalTokens)
 	}
 
-	return truncatedReq, result
+	return &truncatedReq, result
 }
 
 // EstimateOpenAIRequestTokens estimates tokens for a slice of messages
-func EstimateOpenAIRequestTokens(messages []OpenAIMessage) int64 {
-	var totalTokens int64
-	for _, msg := range messages {
-		totalTokens += estimateMessageTokens(&msg)
-	}
-	return totalTokens + int64(len(messages)*TokensPerMessageOverhead)
+func EstimateOpenAIRequestTokens(modelID string, messages []OpenAIMessage) int64 {
+	return estimateOpenAIMessagesTokens(encodingForModel(modelID), messages)
 }
 
 // EstimateAnthropicTokens estimates token count for an Anthropic request
-// Uses rune-based estimation for better Unicode support
+// Counts system prompt, content blocks (text, images, tool_use/tool_result) and tool
+// definitions with the model's BPE tokenizer. Also backs /v1/messages/count_tokens.
 func EstimateAnthropicTokens(req *AnthropicRequest) int64 {
-	var totalTokens int64
-
-	// Count system prompt tokens
-	if req.System != nil {
-		if systemArray, ok := req.System.([]interface{}); ok {
-			for _, item := range systemArray {
-				if itemMap, ok := item.(map[string]interface{}); ok {
-					if text, ok := itemMap["text"].(string); ok {
-						totalTokens += estimateStringTokens(text)
-					}
-				}
-			}
-		} else if systemStr, ok := req.System.(string); ok {
-			totalTokens += estimateStringTokens(systemStr)
-		}
-	}
+	enc := encodingForModel(req.Model)
 
-	// Count tokens in all messages
-	for _, msg := range req.Messages {
-		// Role tokens (always ASCII)
-		totalTokens += 1 // role is typically 1 token
+	totalTokens := estimateSystemTokens(enc, req.System) + estimateAnthropicMessagesTokens(enc, req.Messages)
 
-		if content, ok := msg.Content.(string); ok {
-			totalTokens += estimateStringTokens(content)
-		} else if contentArray, ok := msg.Content.([]interface{}); ok {
-			for _, item := range contentArray {
-				if itemMap, ok := item.(map[string]interface{}); ok {
-					if text, ok := itemMap["text"].(string); ok {
-						totalTokens += estimateStringTokens(text)
-					}
-					// Images have fixed token cost
-					if itemMap["type"] == "image" {
-						totalTokens += TokensPerImageEstimate
-					}
-					// Tool use/result blocks
-					if itemMap["type"] == "tool_use" || itemMap["type"] == "tool_result" {
-						totalTokens += TokensPerToolCallOverhead
-						// Add content tokens if present
-						if input, ok := itemMap["input"].(string); ok {
-							totalTokens += estimateStringTokens(input)
-						}
-						if content, ok := itemMap["content"].(string); ok {
-							totalTokens += estimateStringTokens(content)
-						}
-					}
-				}
-			}
-		}
+	// Anthropic injects a tool-use system prompt when tools are defined
+	if len(req.Tools) > 0 {
+		totalTokens += tokenizer.ToolUseSystemTokens + estimateToolsTokens(enc, req.Tools)
 	}
 
-	// Add message overhead
-	totalTokens += int64(len(req.Messages) * TokensPerMessageOverhead)
-
 	return totalTokens
 }
 
@@ -419,11 +339,23 @@ func TruncateAnthropicRequest(req *AnthropicRequest, maxTokens int64) (*Anthropi
 	removedCount := 0
 	removedTokens := int64(0)
 
+	// Count each message once; the running total is updated as messages are removed
+	enc := encodingForModel(req.Model)
+	currentTokens := estimateSystemTokens(enc, req.System)
+	if len(req.Tools) > 0 {
+		currentTokens += tokenizer.ToolUseSystemTokens + estimateToolsTokens(enc, req.Tools)
+	}
+	messageTokens := make([]int64, len(messages))
+	for i := range messages {
+		messageTokens[i] = estimateAnthropicMessageTokens(enc, &messages[i]) + TokensPerMessageOverhead
+		currentTokens += messageTokens[i]
+	}
+
 	// SAFETY: Prevent infinite loop - max iterations is number of messages
 	maxIterations := len(messages)
 	iterations := 0
 
-	for EstimateAnthropicMessagesTokens(messages) > maxTokens-estimateSystemTokens(req.System) {
+	for currentTokens > maxTokens {
 		iterations++
 		if iterations > maxIterations {
 			log.Printf("🚨 [Truncate-Anthropic] Max iterations (%d) reached, breaking to prevent infinite loop", maxIterations)
@@ -524,28 +456,21 @@ func TruncateAnthropicRequest(req *AnthropicRequest, maxTokens int64) (*Anthropi
 		// Calculate tokens being removed and remove messages
 		for _, idx := range indicesToRemove {
 			if idx < len(messages) {
-				removedTokens += estimateAnthropicMessageTokens(&messages[idx]) / 4
+				removedTokens += messageTokens[idx]
+				currentTokens -= messageTokens[idx]
 				messages = append(messages[:idx], messages[idx+1:]...)
+				messageTokens = append(messageTokens[:idx], messageTokens[idx+1:]...)
 				removedCount++
 			}
 		}
 	}
 
 	// Create truncated request
-	truncatedReq := &AnthropicRequest{
-		Model:       req.Model,
-		Messages:    messages,
-		System:      req.System,
-		MaxTokens:   req.MaxTokens,
-		Temperature: req.Temperature,
-		Stream:      req.Stream,
-		Thinking:    req.Thinking,
-		Tools:       req.Tools,
-		ToolChoice:  req.ToolChoice,
-	}
+	truncatedReq := *req
+	truncatedReq.Messages = messages
 
 	result.WasTruncated = removedCount > 0
-	result.FinalTokens = EstimateAnthropicTokens(truncatedReq)
+	result.FinalTokens = EstimateAnthropicTokens(&truncatedReq)
 	result.MessagesRemoved = removedCount
 	result.TokensRemoved = removedTokens
 
@@ -554,71 +479,30 @@ func TruncateAnthropicRequest(req *AnthropicRequest, maxTokens int64) (*Anthropi
 			removedCount, removedTokens, result.OriginalTokens, result.FinalTokens)
 	}
 
-	return truncatedReq, result
+	return &truncatedReq, result
 }
 
 // estimateAnthropicMessageTokens estimates tokens for a single Anthropic message
-func estimateAnthropicMessageTokens(msg *AnthropicMessage) int64 {
-	var chars int64
-	chars += int64(len(msg.Role))
-
-	if content, ok := msg.Content.(string); ok {
-		chars += int64(len(content))
-	} else if contentArray, ok := msg.Content.([]interface{}); ok {
-		for _, item := range contentArray {
-			if itemMap, ok := item.(map[string]interface{}); ok {
-				if text, ok := itemMap["text"].(string); ok {
-					chars += int64(len(text))
-				}
-				// Images
-				if itemMap["type"] == "image" {
-					chars += 3000
-				}
-			}
-		}
-	}
-
-	return chars
+func estimateAnthropicMessageTokens(enc *tokenizer.Encoding, msg *AnthropicMessage) int64 {
+	return int64(enc.CountContent(msg.Content))
 }
 
 // EstimateAnthropicMessagesTokens estimates tokens for Anthropic messages
-func EstimateAnthropicMessagesTokens(messages []AnthropicMessage) int64 {
-	var totalChars int64
-	for _, msg := range messages {
-		totalChars += int64(len(msg.Role))
-		if content, ok := msg.Content.(string); ok {
-			totalChars += int64(len(content))
-		} else if contentArray, ok := msg.Content.([]interface{}); ok {
-			for _, item := range contentArray {
-				if itemMap, ok := item.(map[string]interface{}); ok {
-					if text, ok := itemMap["text"].(string); ok {
-						totalChars += int64(len(text))
-					}
-				}
-			}
-		}
-	}
-	return totalChars/4 + int64(len(messages)*4)
+func EstimateAnthropicMessagesTokens(modelID string, messages []AnthropicMessage) int64 {
+	return estimateAnthropicMessagesTokens(encodingForModel(modelID), messages)
 }
 
-// estimateSystemTokens estimates tokens for system prompt
-func estimateSystemTokens(system interface{}) int64 {
-	if system == nil {
-		return 0
-	}
-	var chars int64
-	if systemArray, ok := system.([]interface{}); ok {
-		for _, item := range systemArray {
-			if itemMap, ok := item.(map[string]interface{}); ok {
-				if text, ok := itemMap["text"].(string); ok {
-					chars += int64(len(text))
-				}
-			}
-		}
-	} else if systemStr, ok := system.(string); ok {
-		chars += int64(len(systemStr))
+func estimateAnthropicMessagesTokens(enc *tokenizer.Encoding, messages []AnthropicMessage) int64 {
+	var totalTokens int64
+	for i := range messages {
+		totalTokens += estimateAnthropicMessageTokens(enc, &messages[i])
 	}
-	return chars / 4
+	return totalTokens + int64(len(messages)*TokensPerMessageOverhead)
+}
+
+// estimateSystemTokens estimates tokens for system prompt (string or array of text blocks)
+func estimateSystemTokens(enc *tokenizer.Encoding, system interface{}) int64 {
+	return int64(enc.CountContent(system))
 }
 
 // uniqueSortedDesc returns unique indices sorted in descending order
@@ -1,7 +1,10 @@
 package transformers
 
 import (
+	"strings"
 	"testing"
+
+	"goproxy/internal/tokenizer"
 )
 
 // =============================================================================
@@ -43,11 +46,7 @@ func TestEstimateOpenAITokens_MultipleMessages(t *testing.T) {
 }
 
 func TestEstimateOpenAITokens_LongContent(t *testing.T) {
-	// Create a long content string (~10K chars = ~3333 tokens with RunesPerToken=3)
-	longContent := ""
-	for i := 0; i < 10000; i++ {
-		longContent += "a"
-	}
+	longContent := strings.Repeat("a", 10000)
 
 	req := &OpenAIRequest{
 		Model: "claude-sonnet-4-20250514",
@@ -58,10 +57,72 @@ func TestEstimateOpenAITokens_LongContent(t *testing.T) {
 
 	tokens := EstimateOpenAITokens(req)
 
-	// 10000 chars / 3 (RunesPerToken) = ~3333 tokens + overhead
-	// Accept range from 3200 to 3500
-	if tokens < 3200 || tokens > 3500 {
-		t.Errorf("Expected tokens around 3333, got %d", tokens)
+	// Exact BPE count of the content + per-message overhead
+	expected := int64(encodingForModel(req.Model).Count(longContent)) + TokensPerMessageOverhead
+	if tokens != expected {
+		t.Errorf("Expected %d tokens, got %d", expected, tokens)
+	}
+}
+
+func TestEstimateOpenAITokens_Vietnamese(t *testing.T) {
+	// Exact counts with the embedded vocabularies (internal/tokenizer/vocab).
+	// The old runes/3 heuristic gave 21 and 7: diacritics split into more tokens.
+	tests := []struct {
+		model string
+		text  string
+		want  int64
+	}{
+		{"gpt-5.1", "Xin chào, tôi muốn hỏi về cách tối ưu hóa truy vấn cơ sở dữ liệu.", 34},
+		{"claude-sonnet-4-5", "Xin chào, tôi muốn hỏi về cách tối ưu hóa truy vấn cơ sở dữ liệu.", 40},
+		{"gpt-5.1", "Cảm ơn bạn rất nhiều!", 12},
+		{"claude-sonnet-4-5", "Cảm ơn bạn rất nhiều!", 13},
+	}
+
+	for _, tt := range tests {
+		req := &OpenAIRequest{
+			Model: tt.model,
+			Messages: []OpenAIMessage{
+				{Role: "user", Content: tt.text},
+			},
+		}
+		if got := EstimateOpenAITokens(req); got != tt.want+TokensPerMessageOverhead {
+			t.Errorf("%s: %q estimated at %d tokens, want %d + %d overhead", tt.model, tt.text, got, tt.want, TokensPerMessageOverhead)
+		}
+	}
+}
+
+func TestEstimateOpenAITokens_CountsToolsAndImages(t *testing.T) {
+	tool := map[string]interface{}{
+		"type": "function",
+		"function": map[string]interface{}{
+			"name":        "read_file",
+			"description": "Read a file from disk",
+			"parameters":  map[string]interface{}{"type": "object", "properties": map[string]interface{}{"path": map[string]interface{}{"type": "string"}}},
+		},
+	}
+	base := &OpenAIRequest{
+		Model:    "gpt-5.1",
+		Messages: []OpenAIMessage{{Role: "user", Content: "Hi"}},
+	}
+	withTool := &OpenAIRequest{
+		Model:    "gpt-5.1",
+		Messages: base.Messages,
+		Tools:    []interface{}{tool},
+	}
+	withImage := &OpenAIRequest{
+		Model: "gpt-5.1",
+		Messages: []OpenAIMessage{{Role: "user", Content: []interface{}{
+			map[string]interface{}{"type": "text", "text": "Hi"},
+			map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "https://example.com/cat.png"}},
+		}}},
+	}
+
+	baseTokens := EstimateOpenAITokens(base)
+	if diff := EstimateOpenAITokens(withTool) - baseTokens; diff != int64(encodingForModel("gpt-5.1").CountJSON(tool)) {
+		t.Errorf("Tool schema added %d tokens, want %d", diff, encodingForModel("gpt-5.1").CountJSON(tool))
+	}
+	if diff := EstimateOpenAITokens(withImage) - baseTokens; diff != tokenizer.MaxImageTokens {
+		t.Errorf("Image added %d tokens, want %d", diff, tokenizer.MaxImageTokens)
 	}
 }
 
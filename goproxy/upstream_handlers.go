@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+
+	"goproxy/internal/maintarget"
+	"goproxy/internal/ohmygpt"
+	"goproxy/internal/openhands"
+	"goproxy/internal/provider"
+	"goproxy/transformers"
+)
+
+// chatHandler serves one tier of a /v1/chat/completions request on a provider instance
+type chatHandler func(w http.ResponseWriter, r *http.Request, p provider.Provider, openaiReq *transformers.OpenAIRequest, bodyBytes []byte, modelID string, userApiKey string, username string, isBatch bool)
+
+// messagesHandler serves one tier of an Anthropic /v1/messages request on a provider instance
+type messagesHandler func(w http.ResponseWriter, r *http.Request, p provider.Provider, originalBody []byte, isStreaming bool, modelID string, userApiKey string, username string, isBatch bool)
+
+// upstreamHandler holds the handlers of a provider type that shapes requests or bills keys
+// on its own. A nil messages handler serves /v1/messages through chat completions.
+type upstreamHandler struct {
+	chat     chatHandler
+	messages messagesHandler
+}
+
+// upstreamHandlers maps provider types to their handlers. Types not listed here are served
+// through the provider.Provider interface (handleProviderOpenAIRequest), so a new upstream
+// type only needs to register itself with the provider registry.
+var upstreamHandlers = map[string]upstreamHandler{
+	maintarget.MainTargetType: {
+		chat:     chatFor(handleMainTargetRequestOpenAI),
+		messages: messagesFor(handleMainTargetMessagesRequest),
+	},
+	openhands.OpenHandsType: {
+		chat:     chatFor(handleOpenHandsOpenAIRequest),
+		messages: messagesFor(handleOpenHandsMessagesRequest),
+	},
+	ohmygpt.OhMyGPTType: {
+		chat:     chatFor(handleOhMyGPTOpenAIRequest),
+		messages: messagesFor(handleOhMyGPTMessagesRequest),
+	},
+}
+
+// chatFor adapts a handler taking its provider's concrete type. Handlers are looked up by
+// provider.Provider.Type, so the instance is always of that type.
+func chatFor[P provider.Provider](h func(http.ResponseWriter, *http.Request, P, *transformers.OpenAIRequest, []byte, string, string, string, bool)) chatHandler {
+	return func(w http.ResponseWriter, r *http.Request, p provider.Provider, openaiReq *transformers.OpenAIRequest, bodyBytes []byte, modelID string, userApiKey string, username string, isBatch bool) {
+		h(w, r, p.(P), openaiReq, bodyBytes, modelID, userApiKey, username, isBatch)
+	}
+}
+
+// messagesFor is chatFor for /v1/messages handlers
+func messagesFor[P provider.Provider](h func(http.ResponseWriter, *http.Request, P, []byte, bool, string, string, string, bool)) messagesHandler {
+	return func(w http.ResponseWriter, r *http.Request, p provider.Provider, originalBody []byte, isStreaming bool, modelID string, userApiKey string, username string, isBatch bool) {
+		h(w, r, p.(P), originalBody, isStreaming, modelID, userApiKey, username, isBatch)
+	}
+}
+
+// serveChatCompletions serves one tier of a chat completions request on the tier's provider,
+// with the handler its type registered or through the provider.Provider interface
+func serveChatCompletions(w http.ResponseWriter, r *http.Request, upstreamConfig *UpstreamConfig, openaiReq *transformers.OpenAIRequest, bodyBytes []byte, modelID string, userApiKey string, username string, isBatch bool) {
+	if h := upstreamHandlers[upstreamConfig.Type].chat; h != nil {
+		h(w, r, upstreamConfig.Provider, openaiReq, bodyBytes, modelID, userApiKey, username, isBatch)
+		return
+	}
+	handleProviderOpenAIRequest(w, r, upstreamConfig.Provider, openaiReq, modelID, userApiKey, username, isBatch)
+}